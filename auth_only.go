@@ -0,0 +1,106 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+var (
+	errAuthOnlyNotNegotiated = errors.New("auth only was not negotiated for this tunnel")
+	errAuthOnlyUntrusted     = errors.New("remote is not in auth_only.networks")
+)
+
+// AuthOnly holds the underlay networks we trust enough to send tunnel data over without encryption. A tunnel is only
+// negotiated as auth only if both peers have auth_only configured, and even then data is only sent in the clear while
+// the remote is within one of our trusted networks. Packets are still authenticated with the tunnel key, the header and
+// payload are passed to the AEAD as associated data the same way relayed packets are protected.
+type AuthOnly struct {
+	networks []netip.Prefix
+}
+
+// NewAuthOnlyFromConfig returns nil if auth_only is not configured
+func NewAuthOnlyFromConfig(l *logrus.Logger, c *config.C) (*AuthOnly, error) {
+	raw := c.GetStringSlice("auth_only.networks", []string{})
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	a := &AuthOnly{}
+	for i, s := range raw {
+		network, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("auth_only.networks entry #%v; %s", i, err)
+		}
+
+		a.networks = append(a.networks, network.Masked())
+	}
+
+	l.WithField("networks", a.networks).
+		Warn("auth_only is enabled, data sent to peers that also enable it over these networks will NOT be encrypted")
+
+	return a, nil
+}
+
+// Enabled returns true if we are willing to negotiate auth only tunnels
+func (a *AuthOnly) Enabled() bool {
+	return a != nil
+}
+
+// Trusted returns true if data to or from addr may be sent without encryption on an auth only tunnel
+func (a *AuthOnly) Trusted(addr netip.AddrPort) bool {
+	if a == nil || !addr.IsValid() {
+		return false
+	}
+
+	ip := addr.Addr().Unmap()
+	for _, network := range a.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// logNegotiation makes auth only tunnels obvious in the logs, as well as peers that did not agree to it
+func (a *AuthOnly) logNegotiation(l *logrus.Logger, hostinfo *HostInfo, peerAuthOnly bool) {
+	switch {
+	case hostinfo.ConnectionState.authOnly:
+		hostinfo.logger(l).WithField("remote", hostinfo.remote).
+			Warn("Tunnel is auth only, data sent over trusted networks is NOT encrypted")
+	case a.Enabled():
+		hostinfo.logger(l).Info("Peer did not opt in to auth_only, tunnel is encrypted")
+	case peerAuthOnly:
+		hostinfo.logger(l).Info("Peer asked for auth_only but it is not configured, tunnel is encrypted")
+	}
+}
+
+// authOnlyOpen verifies an auth only packet and copies its payload into out. The packet is refused unless the tunnel
+// negotiated auth only and it arrived directly from a network we trust, a peer can not downgrade us on its own.
+func (f *Interface) authOnlyOpen(hostinfo *HostInfo, addr netip.AddrPort, h *header.H, out, packet, nb []byte) ([]byte, error) {
+	ci := hostinfo.ConnectionState
+	if !ci.authOnly {
+		return nil, errAuthOnlyNotNegotiated
+	}
+
+	if !f.authOnly.Trusted(addr) {
+		return nil, errAuthOnlyUntrusted
+	}
+
+	overhead := ci.dKey.Overhead()
+	if len(packet) < header.Len+overhead {
+		return nil, header.ErrHeaderTooShort
+	}
+
+	signed := packet[:len(packet)-overhead]
+	_, err := ci.dKey.DecryptDanger(out[:0], signed, packet[len(packet)-overhead:], h.MessageCounter, nb)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(out[:0], signed[header.Len:]...), nil
+}
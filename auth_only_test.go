@@ -0,0 +1,93 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAuthOnlyFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	a, err := NewAuthOnlyFromConfig(l, c)
+	require.NoError(t, err)
+	assert.False(t, a.Enabled())
+	assert.False(t, a.Trusted(netip.MustParseAddrPort("10.0.0.1:4242")))
+
+	c.Settings["auth_only"] = map[interface{}]interface{}{"networks": []interface{}{"nope"}}
+	_, err = NewAuthOnlyFromConfig(l, c)
+	assert.EqualError(t, err, `auth_only.networks entry #0; netip.ParsePrefix("nope"): no '/'`)
+
+	c.Settings["auth_only"] = map[interface{}]interface{}{"networks": []interface{}{"10.0.0.1/24", "fd00::/64"}}
+	a, err = NewAuthOnlyFromConfig(l, c)
+	require.NoError(t, err)
+	assert.True(t, a.Enabled())
+	assert.True(t, a.Trusted(netip.MustParseAddrPort("10.0.0.200:4242")))
+	assert.True(t, a.Trusted(netip.MustParseAddrPort("[::ffff:10.0.0.200]:4242")))
+	assert.True(t, a.Trusted(netip.MustParseAddrPort("[fd00::1]:4242")))
+	assert.False(t, a.Trusted(netip.MustParseAddrPort("10.0.1.1:4242")))
+	assert.False(t, a.Trusted(netip.AddrPort{}))
+}
+
+func TestInterface_authOnlyOpen(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["auth_only"] = map[interface{}]interface{}{"networks": []interface{}{"10.0.0.0/24"}}
+	a, err := NewAuthOnlyFromConfig(l, c)
+	require.NoError(t, err)
+	f := &Interface{l: l, authOnly: a}
+
+	cs := &NebulaCipherState{c: noise.CipherChaChaPoly.Cipher([32]byte{1})}
+	hostinfo := &HostInfo{ConnectionState: &ConnectionState{eKey: cs, dKey: cs, authOnly: true}}
+	trusted := netip.MustParseAddrPort("10.0.0.2:4242")
+
+	nb := make([]byte, 12)
+	seal := func(payload string) ([]byte, *header.H) {
+		p := header.Encode(make([]byte, header.Len, mtu), header.Version, header.Message, header.MessageAuthOnly, 1, 3)
+		p = append(p, payload...)
+		p, err := cs.EncryptDanger(p, p, nil, 3, nb)
+		require.NoError(t, err)
+
+		h := &header.H{}
+		require.NoError(t, h.Parse(p))
+		return p, h
+	}
+
+	// The payload is sent in the clear but authenticated
+	p, h := seal("hello")
+	assert.Contains(t, string(p), "hello")
+	out, err := f.authOnlyOpen(hostinfo, trusted, h, make([]byte, mtu), p, nb)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), out)
+
+	p[header.Len] ^= 0xff
+	_, err = f.authOnlyOpen(hostinfo, trusted, h, make([]byte, mtu), p, nb)
+	assert.Error(t, err)
+
+	// Only from networks we trust
+	p, h = seal("hello")
+	_, err = f.authOnlyOpen(hostinfo, netip.MustParseAddrPort("10.0.1.2:4242"), h, make([]byte, mtu), p, nb)
+	assert.ErrorIs(t, err, errAuthOnlyUntrusted)
+
+	// Relayed packets have no address
+	_, err = f.authOnlyOpen(hostinfo, netip.AddrPort{}, h, make([]byte, mtu), p, nb)
+	assert.ErrorIs(t, err, errAuthOnlyUntrusted)
+
+	// A peer can not downgrade a tunnel we did not agree to
+	hostinfo.ConnectionState.authOnly = false
+	_, err = f.authOnlyOpen(hostinfo, trusted, h, make([]byte, mtu), p, nb)
+	assert.ErrorIs(t, err, errAuthOnlyNotNegotiated)
+
+	// Or if we have not opted in at all
+	hostinfo.ConnectionState.authOnly = true
+	f.authOnly = nil
+	_, err = f.authOnlyOpen(hostinfo, trusted, h, make([]byte, mtu), p, nb)
+	assert.ErrorIs(t, err, errAuthOnlyUntrusted)
+}
@@ -1,6 +1,9 @@
 package nebula
 
 import (
+	"sync/atomic"
+	"time"
+
 	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 )
@@ -13,12 +16,22 @@ type Bits struct {
 	lostCounter        metrics.Counter
 	dupeCounter        metrics.Counter
 	outOfWindowCounter metrics.Counter
+
+	// received counts the counters accepted into the window and lost counts the counters that left the window without
+	// ever arriving. Reordering within the window is never counted as loss. See TunnelQuality.
+	received atomic.Uint64
+	lost     atomic.Uint64
+
+	// arrived holds when each counter in the window arrived in unix nanoseconds, 0 if it was accepted by Update rather
+	// than UpdateAt
+	arrived []int64
 }
 
 func NewBits(bits uint64) *Bits {
 	return &Bits{
 		length:             bits,
 		bits:               make([]bool, bits, bits),
+		arrived:            make([]int64, bits),
 		current:            0,
 		lostCounter:        metrics.GetOrRegisterCounter("network.packets.lost", nil),
 		dupeCounter:        metrics.GetOrRegisterCounter("network.packets.duplicate", nil),
@@ -53,22 +66,33 @@ func (b *Bits) Update(l *logrus.Logger, i uint64) bool {
 		// Report missed packets, we can only understand what was missed after the first window has been gone through
 		if i > b.length && b.bits[i%b.length] == false {
 			b.lostCounter.Inc(1)
+			b.lost.Add(1)
 		}
 		b.bits[i%b.length] = true
+		b.arrived[i%b.length] = 0
 		b.current = i
+		b.received.Add(1)
 		return true
 	}
 
 	// If i packet is greater than current but less than the maximum length of our bitmap,
 	// flip everything in between to false and move ahead.
 	if i > b.current && i < b.current+b.length {
-		// In between current and i need to be zero'd to allow those packets to come in later
-		for n := b.current + 1; n < i; n++ {
+		// In between current and i need to be zero'd to allow those packets to come in later. Each slot still holds the
+		// counter one window back, if it never arrived it is lost now.
+		var lost uint64
+		for n := b.current + 1; n <= i; n++ {
+			if n > b.length && !b.bits[n%b.length] {
+				lost++
+			}
 			b.bits[n%b.length] = false
 		}
 
 		b.bits[i%b.length] = true
+		b.arrived[i%b.length] = 0
 		b.current = i
+		b.lost.Add(lost)
+		b.received.Add(1)
 		//l.Debugf("missed %d packets between %d and %d\n", i-b.current, i, b.current)
 		return true
 	}
@@ -76,6 +100,21 @@ func (b *Bits) Update(l *logrus.Logger, i uint64) bool {
 	// If i is greater than the delta between current and the total length of our bitmap,
 	// just flip everything in the map and move ahead.
 	if i >= b.current+b.length {
+		// Everything missing from the current window and everything jumped over is gone for good
+		var windowLost uint64
+		if i > b.current+b.length {
+			windowLost = i - b.current - b.length
+		}
+		start := uint64(1)
+		if b.current >= b.length {
+			start = b.current - b.length + 1
+		}
+		for n := start; n <= b.current; n++ {
+			if !b.bits[n%b.length] {
+				windowLost++
+			}
+		}
+
 		// The current window loss will be accounted for later, only record the jump as loss up until then
 		lost := maxInt64(0, int64(i-b.current-b.length))
 		//TODO: explain this
@@ -93,12 +132,15 @@ func (b *Bits) Update(l *logrus.Logger, i uint64) bool {
 		}
 
 		b.lostCounter.Inc(lost)
+		b.lost.Add(windowLost)
+		b.received.Add(1)
 
 		if l.Level >= logrus.DebugLevel {
 			l.WithField("receiveWindow", m{"accepted": true, "currentCounter": b.current, "incomingCounter": i, "reason": "window shifting"}).
 				Debug("Receive window")
 		}
 		b.bits[i%b.length] = true
+		b.arrived[i%b.length] = 0
 		b.current = i
 		return true
 	}
@@ -107,6 +149,7 @@ func (b *Bits) Update(l *logrus.Logger, i uint64) bool {
 	if i == 0 && b.firstSeen == false && b.current < b.length {
 		b.firstSeen = true
 		b.bits[i%b.length] = true
+		b.arrived[i%b.length] = 0
 		return true
 	}
 
@@ -132,6 +175,8 @@ func (b *Bits) Update(l *logrus.Logger, i uint64) bool {
 		}
 
 		b.bits[i%b.length] = true
+		b.arrived[i%b.length] = 0
+		b.received.Add(1)
 		return true
 
 	}
@@ -148,6 +193,40 @@ func (b *Bits) Update(l *logrus.Logger, i uint64) bool {
 	return false
 }
 
+// UpdateAt is Update for a packet that arrived at now. If the counter is accepted it also returns how long ago the
+// earliest of the packets with a higher counter arrived. Nebula data packets carry no timestamp, a packet that is
+// overtaken has been delayed at least that long relative to the packets sent after it. The lateness is 0 for packets
+// that arrived in order or when no higher counter in the window has a known arrival time.
+func (b *Bits) UpdateAt(l *logrus.Logger, i uint64, now time.Time) (bool, time.Duration) {
+	if !b.Update(l, i) {
+		return false, 0
+	}
+
+	at := now.UnixNano()
+	b.arrived[i%b.length] = at
+	if i >= b.current {
+		return true, 0
+	}
+
+	// Higher counters are not always received in order either, the earliest to arrive is the one i was first late for
+	var earliest int64
+	for n := i + 1; n <= b.current; n++ {
+		slot := n % b.length
+		if b.bits[slot] && b.arrived[slot] != 0 && (earliest == 0 || b.arrived[slot] < earliest) {
+			earliest = b.arrived[slot]
+		}
+	}
+	if earliest == 0 {
+		return true, 0
+	}
+	return true, time.Duration(at - earliest)
+}
+
+// counts returns the number of counters received and lost over the life of the window
+func (b *Bits) counts() (received, lost uint64) {
+	return b.received.Load(), b.lost.Load()
+}
+
 func maxInt64(a, b int64) int64 {
 	if a > b {
 		return a
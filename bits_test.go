@@ -2,9 +2,11 @@ package nebula
 
 import (
 	"testing"
+	"time"
 
 	"github.com/slackhq/nebula/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBits(t *testing.T) {
@@ -214,6 +216,114 @@ func TestBitsLostCounter(t *testing.T) {
 	assert.Equal(t, int64(0), b.outOfWindowCounter.Count())
 }
 
+func TestBitsCounts(t *testing.T) {
+	l := test.NewLogger()
+	b := NewBits(10)
+
+	for i := uint64(1); i <= 5; i++ {
+		assert.True(t, b.Update(l, i))
+	}
+	received, lost := b.counts()
+	assert.EqualValues(t, 5, received)
+	assert.EqualValues(t, 0, lost)
+
+	// Reordering within the window is not loss
+	assert.True(t, b.Update(l, 7))
+	assert.True(t, b.Update(l, 6))
+	for i := uint64(8); i <= 20; i++ {
+		assert.True(t, b.Update(l, i))
+	}
+	received, lost = b.counts()
+	assert.EqualValues(t, 20, received)
+	assert.EqualValues(t, 0, lost)
+
+	// Duplicates and out of window counters are not received
+	assert.False(t, b.Update(l, 20))
+	assert.False(t, b.Update(l, 2))
+	received, _ = b.counts()
+	assert.EqualValues(t, 20, received)
+
+	// 21 never arrives, it is only lost once it leaves the window
+	for i := uint64(22); i <= 30; i++ {
+		assert.True(t, b.Update(l, i))
+	}
+	received, lost = b.counts()
+	assert.EqualValues(t, 29, received)
+	assert.EqualValues(t, 0, lost)
+
+	assert.True(t, b.Update(l, 31))
+	received, lost = b.counts()
+	assert.EqualValues(t, 30, received)
+	assert.EqualValues(t, 1, lost)
+
+	// Skipping ahead within the window counts what left the window, 32 is pushed out by 42
+	assert.True(t, b.Update(l, 33))
+	assert.True(t, b.Update(l, 41))
+	received, lost = b.counts()
+	assert.EqualValues(t, 32, received)
+	assert.EqualValues(t, 1, lost)
+	assert.True(t, b.Update(l, 42))
+	received, lost = b.counts()
+	assert.EqualValues(t, 33, received)
+	assert.EqualValues(t, 2, lost)
+
+	// Jumping past the window counts what was missing in the window, 34 to 40, and the gap up to the new window, 43 to 90
+	assert.True(t, b.Update(l, 100))
+	received, lost = b.counts()
+	assert.EqualValues(t, 34, received)
+	assert.EqualValues(t, 2+7+48, lost)
+
+	// A late arrival after the jump is still received
+	assert.True(t, b.Update(l, 95))
+	received, _ = b.counts()
+	assert.EqualValues(t, 35, received)
+}
+
+func TestBitsUpdateAt(t *testing.T) {
+	l := test.NewLogger()
+	b := NewBits(10)
+	now := time.Now()
+
+	// updateAt is UpdateAt for a packet that arrived ms after now
+	updateAt := func(i uint64, ms int) time.Duration {
+		ok, late := b.UpdateAt(l, i, now.Add(time.Duration(ms)*time.Millisecond))
+		require.True(t, ok)
+		return late
+	}
+
+	// In order packets are never late
+	for i := uint64(1); i <= 3; i++ {
+		assert.Zero(t, updateAt(i, int(i)))
+	}
+
+	// 4 is overtaken by 5 and 6, it is late by the time since 5 arrived
+	assert.Zero(t, updateAt(5, 5))
+	assert.Zero(t, updateAt(6, 6))
+	assert.Equal(t, 25*time.Millisecond, updateAt(4, 30))
+
+	// Counters accepted without an arrival time are skipped
+	assert.True(t, b.Update(l, 8))
+	assert.Zero(t, updateAt(9, 40))
+	assert.Equal(t, 10*time.Millisecond, updateAt(7, 50))
+
+	// The earliest arrival counts, not the lowest higher counter
+	assert.Zero(t, updateAt(12, 60))
+	assert.Equal(t, 5*time.Millisecond, updateAt(11, 65))
+	assert.Equal(t, 10*time.Millisecond, updateAt(10, 70))
+
+	// A stamp left over from a counter one window back does not count
+	for i := uint64(13); i <= 20; i++ {
+		assert.True(t, b.Update(l, i))
+	}
+	assert.True(t, b.Update(l, 22))
+	assert.Zero(t, updateAt(21, 1000))
+
+	// A rejected counter records nothing
+	ok, late := b.UpdateAt(l, 21, now.Add(2*time.Second))
+	assert.False(t, ok)
+	assert.Zero(t, late)
+}
+
 func BenchmarkBits(b *testing.B) {
 	z := NewBits(10)
 	for n := 0; n < b.N; n++ {
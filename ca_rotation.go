@@ -0,0 +1,90 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+)
+
+// CATunnels is a CA along with the tunnels it authenticated, used to confirm every peer has moved to a new CA before
+// the old one is retired
+type CATunnels struct {
+	Fingerprint string `json:"fingerprint"`
+	Name        string `json:"name,omitempty"`
+	// RotatingIn is set for CAs loaded from pki.ca_rotating_in
+	RotatingIn bool `json:"rotatingIn"`
+	// Trusted is false once the CA was removed from the pool, its tunnels stay up until they are replaced
+	Trusted bool         `json:"trusted"`
+	Tunnels int          `json:"tunnels"`
+	VpnIps  []netip.Addr `json:"vpnIps"`
+}
+
+// caTunnels groups the established tunnels by the CA that validated them, every CA in caPool is listed even without
+// any tunnels
+func caTunnels(hm *HostMap, caPool *cert.NebulaCAPool) []CATunnels {
+	byCA := map[string]*CATunnels{}
+	for fp, ca := range caPool.CAs {
+		byCA[fp] = &CATunnels{
+			Fingerprint: fp,
+			Name:        ca.Details.Name,
+			RotatingIn:  caPool.IsRotatingIn(fp),
+			Trusted:     true,
+			VpnIps:      []netip.Addr{},
+		}
+	}
+
+	hm.ForEachVpnIp(func(hostinfo *HostInfo) {
+		if hostinfo.caFingerprint == "" {
+			return
+		}
+
+		ct, ok := byCA[hostinfo.caFingerprint]
+		if !ok {
+			ct = &CATunnels{Fingerprint: hostinfo.caFingerprint, VpnIps: []netip.Addr{}}
+			byCA[hostinfo.caFingerprint] = ct
+		}
+		ct.Tunnels++
+		ct.VpnIps = append(ct.VpnIps, hostinfo.vpnIp)
+	})
+
+	out := make([]CATunnels, 0, len(byCA))
+	for _, ct := range byCA {
+		sort.Slice(ct.VpnIps, func(i, j int) bool {
+			return ct.VpnIps[i].Less(ct.VpnIps[j])
+		})
+		out = append(out, *ct)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Fingerprint < out[j].Fingerprint
+	})
+	return out
+}
+
+// newCATunnelsEmitter returns a func that reports the tunnels per CA as the pki.ca.<fingerprint>.tunnels gauges.
+// Gauges of CAs that are gone from both the pool and the hostmap are unregistered.
+func newCATunnelsEmitter(hm *HostMap, pki *PKI) func() {
+	reported := map[string]struct{}{}
+
+	return func() {
+		seen := map[string]struct{}{}
+		for _, ct := range caTunnels(hm, pki.GetCAPool()) {
+			metrics.GetOrRegisterGauge(caTunnelsGaugeName(ct.Fingerprint), nil).Update(int64(ct.Tunnels))
+			seen[ct.Fingerprint] = struct{}{}
+		}
+
+		for fp := range reported {
+			if _, ok := seen[fp]; !ok {
+				metrics.Unregister(caTunnelsGaugeName(fp))
+			}
+		}
+		reported = seen
+	}
+}
+
+func caTunnelsGaugeName(fingerprint string) string {
+	return fmt.Sprintf("pki.ca.%s.tunnels", fingerprint)
+}
@@ -0,0 +1,78 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadCAPoolFromConfig_rotatingIn(t *testing.T) {
+	l := test.NewLogger()
+	oldCA, newCA := newTestCA(t, "old"), newTestCA(t, "new")
+
+	c := config.NewC(l)
+	c.Settings["pki"] = map[interface{}]interface{}{
+		"ca": string(oldCA.pem),
+		// A CA in both places is fully trusted
+		"ca_rotating_in": string(newCA.pem) + string(oldCA.pem),
+	}
+
+	caPool, err := loadCAPoolFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Len(t, caPool.CAs, 2)
+	assert.True(t, caPool.IsRotatingIn(newCA.fp))
+	assert.False(t, caPool.IsRotatingIn(oldCA.fp))
+
+	c.Settings["pki"] = map[interface{}]interface{}{"ca": string(oldCA.pem), "ca_rotating_in": "/does/not/exist"}
+	_, err = loadCAPoolFromConfig(l, c)
+	assert.ErrorContains(t, err, "unable to read pki.ca_rotating_in file /does/not/exist")
+}
+
+func TestCATunnels(t *testing.T) {
+	l := test.NewLogger()
+	oldCA, newCA := newTestCA(t, "old"), newTestCA(t, "new")
+
+	c := config.NewC(l)
+	c.Settings["pki"] = map[interface{}]interface{}{"ca": string(oldCA.pem), "ca_rotating_in": string(newCA.pem)}
+	caPool, err := loadCAPoolFromConfig(l, c)
+	require.NoError(t, err)
+	pki := &PKI{}
+	pki.caPool.Store(caPool)
+
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	add := func(vpnIp string, idx uint32, fp string) {
+		hm.unlockedAddHostInfo(&HostInfo{vpnIp: netip.MustParseAddr(vpnIp), localIndexId: idx, caFingerprint: fp}, &Interface{})
+	}
+	add("10.128.0.3", 1, oldCA.fp)
+	add("10.128.0.2", 2, oldCA.fp)
+	add("10.128.0.4", 3, newCA.fp)
+
+	gone := "0000000000000000000000000000000000000000000000000000000000000000"
+	add("10.128.0.5", 4, gone)
+
+	expected := []CATunnels{
+		{Fingerprint: gone, Tunnels: 1, VpnIps: []netip.Addr{netip.MustParseAddr("10.128.0.5")}},
+		{Fingerprint: oldCA.fp, Name: "old", Trusted: true, Tunnels: 2, VpnIps: []netip.Addr{netip.MustParseAddr("10.128.0.2"), netip.MustParseAddr("10.128.0.3")}},
+		{Fingerprint: newCA.fp, Name: "new", Trusted: true, RotatingIn: true, Tunnels: 1, VpnIps: []netip.Addr{netip.MustParseAddr("10.128.0.4")}},
+	}
+	if newCA.fp < oldCA.fp {
+		expected[1], expected[2] = expected[2], expected[1]
+	}
+	assert.Equal(t, expected, caTunnels(hm, caPool))
+
+	emit := newCATunnelsEmitter(hm, pki)
+	emit()
+	assert.Equal(t, int64(2), metrics.GetOrRegisterGauge(caTunnelsGaugeName(oldCA.fp), nil).Value())
+	assert.Equal(t, int64(1), metrics.GetOrRegisterGauge(caTunnelsGaugeName(newCA.fp), nil).Value())
+	assert.NotNil(t, metrics.Get(caTunnelsGaugeName(gone)))
+
+	// Once the last tunnel of a removed CA is gone so is its gauge
+	hm.unlockedDeleteHostInfo(hm.Indexes[4])
+	emit()
+	assert.Nil(t, metrics.Get(caTunnelsGaugeName(gone)))
+}
@@ -10,6 +10,7 @@ import (
 type NebulaCAPool struct {
 	CAs           map[string]*NebulaCertificate
 	certBlocklist map[string]struct{}
+	rotatingIn    map[string]struct{}
 }
 
 // NewCAPool creates a CAPool
@@ -17,6 +18,7 @@ func NewCAPool() *NebulaCAPool {
 	ca := NebulaCAPool{
 		CAs:           make(map[string]*NebulaCertificate),
 		certBlocklist: make(map[string]struct{}),
+		rotatingIn:    make(map[string]struct{}),
 	}
 
 	return &ca
@@ -111,6 +113,21 @@ func (ncp *NebulaCAPool) isBlocklistedWithCache(c *NebulaCertificate, useCache b
 	return false
 }
 
+// MarkRotatingIn flags a CA fingerprint as rotating in. The CA is trusted like any other but is not yet issuing
+// certificates, this is purely informational and lets an operator track a staged CA rotation.
+func (ncp *NebulaCAPool) MarkRotatingIn(f string) {
+	if ncp.rotatingIn == nil {
+		ncp.rotatingIn = make(map[string]struct{})
+	}
+	ncp.rotatingIn[f] = struct{}{}
+}
+
+// IsRotatingIn returns true if the CA fingerprint was marked with MarkRotatingIn
+func (ncp *NebulaCAPool) IsRotatingIn(f string) bool {
+	_, ok := ncp.rotatingIn[f]
+	return ok
+}
+
 // GetCAForCert attempts to return the signing certificate for the provided certificate.
 // No signature validation is performed
 func (ncp *NebulaCAPool) GetCAForCert(c *NebulaCertificate) (*NebulaCertificate, error) {
@@ -17,6 +17,7 @@ import (
 	"math"
 	"math/big"
 	"net"
+	"sort"
 	"sync/atomic"
 	"time"
 
@@ -67,6 +68,10 @@ type NebulaCertificateDetails struct {
 	// Map of groups for faster lookup
 	InvertedGroups map[string]struct{}
 
+	// Attributes are arbitrary key value pairs, such as env: production, that firewall rules can match on.
+	// nil when the certificate has none.
+	Attributes map[string]string
+
 	Curve Curve
 }
 
@@ -108,6 +113,10 @@ func UnmarshalNebulaCertificate(b []byte) (*NebulaCertificate, error) {
 		return nil, fmt.Errorf("encoded Subnets should be in pairs, an odd number was found")
 	}
 
+	if len(rc.Details.Attributes)%2 != 0 {
+		return nil, fmt.Errorf("encoded Attributes should be in pairs, an odd number was found")
+	}
+
 	nc := NebulaCertificate{
 		Details: NebulaCertificateDetails{
 			Name:           rc.Details.Name,
@@ -153,6 +162,17 @@ func UnmarshalNebulaCertificate(b []byte) (*NebulaCertificate, error) {
 		nc.Details.InvertedGroups[g] = struct{}{}
 	}
 
+	if len(rc.Details.Attributes) > 0 {
+		nc.Details.Attributes = make(map[string]string, len(rc.Details.Attributes)/2)
+		for i := 0; i < len(rc.Details.Attributes); i += 2 {
+			k := rc.Details.Attributes[i]
+			if _, ok := nc.Details.Attributes[k]; ok {
+				return nil, fmt.Errorf("encoded Attributes contained the key %q more than once", k)
+			}
+			nc.Details.Attributes[k] = rc.Details.Attributes[i+1]
+		}
+	}
+
 	return &nc, nil
 }
 
@@ -600,9 +620,28 @@ func (nc *NebulaCertificate) Expired(t time.Time) bool {
 	return nc.Details.NotBefore.After(t) || nc.Details.NotAfter.Before(t)
 }
 
+// validAt returns ErrNotYetValid or ErrExpired if the certificate is not valid at t, allowing t to be off by skew in
+// either direction
+func (nc *NebulaCertificate) validAt(t time.Time, skew time.Duration) error {
+	if nc.Details.NotBefore.After(t.Add(skew)) {
+		return ErrNotYetValid
+	}
+	if nc.Details.NotAfter.Before(t.Add(-skew)) {
+		return ErrExpired
+	}
+	return nil
+}
+
 // Verify will ensure a certificate is good in all respects (expiry, group membership, signature, cert blocklist, etc)
 func (nc *NebulaCertificate) Verify(t time.Time, ncp *NebulaCAPool) (bool, error) {
-	return nc.verify(t, ncp, false)
+	return nc.verify(t, 0, ncp, false)
+}
+
+// VerifyWithSkew is Verify allowing t to be off by up to skew in either direction, for hosts whose clock can not be
+// trusted to be exact. A certificate outside of its validity period fails with ErrNotYetValid or ErrExpired, and
+// ErrRootNotYetValid or ErrRootExpired for its CA.
+func (nc *NebulaCertificate) VerifyWithSkew(t time.Time, skew time.Duration, ncp *NebulaCAPool) (bool, error) {
+	return nc.verify(t, skew, ncp, false)
 }
 
 // VerifyWithCache will ensure a certificate is good in all respects (expiry, group membership, signature, cert blocklist, etc)
@@ -610,7 +649,12 @@ func (nc *NebulaCertificate) Verify(t time.Time, ncp *NebulaCAPool) (bool, error
 // NOTE: This uses an internal cache that will not be invalidated automatically
 // if you manually change any fields in the NebulaCertificate.
 func (nc *NebulaCertificate) VerifyWithCache(t time.Time, ncp *NebulaCAPool) (bool, error) {
-	return nc.verify(t, ncp, true)
+	return nc.verify(t, 0, ncp, true)
+}
+
+// VerifyWithCacheAndSkew is VerifyWithCache allowing t to be off by up to skew in either direction, see VerifyWithSkew
+func (nc *NebulaCertificate) VerifyWithCacheAndSkew(t time.Time, skew time.Duration, ncp *NebulaCAPool) (bool, error) {
+	return nc.verify(t, skew, ncp, true)
 }
 
 // ResetCache resets the cache used by VerifyWithCache.
@@ -620,7 +664,7 @@ func (nc *NebulaCertificate) ResetCache() {
 }
 
 // Verify will ensure a certificate is good in all respects (expiry, group membership, signature, cert blocklist, etc)
-func (nc *NebulaCertificate) verify(t time.Time, ncp *NebulaCAPool, useCache bool) (bool, error) {
+func (nc *NebulaCertificate) verify(t time.Time, skew time.Duration, ncp *NebulaCAPool, useCache bool) (bool, error) {
 	if ncp.isBlocklistedWithCache(nc, useCache) {
 		return false, ErrBlockListed
 	}
@@ -630,12 +674,15 @@ func (nc *NebulaCertificate) verify(t time.Time, ncp *NebulaCAPool, useCache boo
 		return false, err
 	}
 
-	if signer.Expired(t) {
+	switch signer.validAt(t, skew) {
+	case ErrNotYetValid:
+		return false, ErrRootNotYetValid
+	case ErrExpired:
 		return false, ErrRootExpired
 	}
 
-	if nc.Expired(t) {
-		return false, ErrExpired
+	if err := nc.validAt(t, skew); err != nil {
+		return false, err
 	}
 
 	if !nc.checkSignatureWithCache(signer.Details.PublicKey, useCache) {
@@ -670,6 +717,15 @@ func (nc *NebulaCertificate) CheckRootConstrains(signer *NebulaCertificate) erro
 		}
 	}
 
+	// If the signer has a limited set of attributes make sure the cert only contains a subset with the same values
+	if len(signer.Details.Attributes) > 0 {
+		for k, v := range nc.Details.Attributes {
+			if sv, ok := signer.Details.Attributes[k]; !ok || sv != v {
+				return fmt.Errorf("certificate contained an attribute not present on the signing ca: %s=%s", k, v)
+			}
+		}
+	}
+
 	// If the signer has a limited set of ip ranges to issue from make sure the cert only contains a subset
 	if len(signer.Details.Ips) > 0 {
 		for _, ip := range nc.Details.Ips {
@@ -786,6 +842,14 @@ func (nc *NebulaCertificate) String() string {
 		s += "\t\tGroups: []\n"
 	}
 
+	if len(nc.Details.Attributes) > 0 {
+		s += "\t\tAttributes: {\n"
+		for _, k := range nc.attributeKeys() {
+			s += fmt.Sprintf("\t\t\t\"%v\": \"%v\"\n", k, nc.Details.Attributes[k])
+		}
+		s += "\t\t}\n"
+	}
+
 	s += fmt.Sprintf("\t\tNot before: %v\n", nc.Details.NotBefore)
 	s += fmt.Sprintf("\t\tNot After: %v\n", nc.Details.NotAfter)
 	s += fmt.Sprintf("\t\tIs CA: %v\n", nc.Details.IsCA)
@@ -823,6 +887,10 @@ func (nc *NebulaCertificate) getRawDetails() *RawNebulaCertificateDetails {
 		rd.Subnets = append(rd.Subnets, ip2int(ipNet.IP), ip2int(ipNet.Mask))
 	}
 
+	for _, k := range nc.attributeKeys() {
+		rd.Attributes = append(rd.Attributes, k, nc.Details.Attributes[k])
+	}
+
 	copy(rd.PublicKey, nc.Details.PublicKey[:])
 
 	// I know, this is terrible
@@ -831,6 +899,16 @@ func (nc *NebulaCertificate) getRawDetails() *RawNebulaCertificateDetails {
 	return rd
 }
 
+// attributeKeys returns the attribute keys sorted so the marshaled certificate, and its signature, are stable
+func (nc *NebulaCertificate) attributeKeys() []string {
+	keys := make([]string, 0, len(nc.Details.Attributes))
+	for k := range nc.Details.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // Marshal will marshal a nebula cert into a protobuf byte array
 func (nc *NebulaCertificate) Marshal() ([]byte, error) {
 	rc := RawNebulaCertificate{
@@ -906,6 +984,9 @@ func (nc *NebulaCertificate) MarshalJSON() ([]byte, error) {
 		"fingerprint": fp,
 		"signature":   fmt.Sprintf("%x", nc.Signature),
 	}
+	if len(nc.Details.Attributes) > 0 {
+		jc["details"].(m)["attributes"] = nc.Details.Attributes
+	}
 	return json.Marshal(jc)
 }
 
@@ -963,6 +1044,13 @@ func (nc *NebulaCertificate) Copy() *NebulaCertificate {
 		c.Details.InvertedGroups[g] = struct{}{}
 	}
 
+	if nc.Details.Attributes != nil {
+		c.Details.Attributes = make(map[string]string, len(nc.Details.Attributes))
+		for k, v := range nc.Details.Attributes {
+			c.Details.Attributes[k] = v
+		}
+	}
+
 	return c
 }
 
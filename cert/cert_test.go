@@ -262,6 +262,43 @@ func TestNebulaCertificate_Verify(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestNebulaCertificate_VerifyWithSkew(t *testing.T) {
+	now := time.Now()
+	ca, _, caKey, err := newTestCaCert(now.Add(-time.Hour), now.Add(time.Hour), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+
+	h, err := ca.Sha256Sum()
+	assert.Nil(t, err)
+	caPool := NewCAPool()
+	caPool.CAs[h] = ca
+
+	// Issued by a host whose clock is a little ahead of ours
+	c, _, _, err := newTestCert(ca, caKey, now.Add(2*time.Minute), now.Add(30*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+
+	v, err := c.Verify(now, caPool)
+	assert.False(t, v)
+	assert.ErrorIs(t, err, ErrNotYetValid)
+
+	v, err = c.VerifyWithSkew(now, 5*time.Minute, caPool)
+	assert.True(t, v)
+	assert.Nil(t, err)
+
+	// Skew works both ways
+	v, err = c.VerifyWithSkew(now.Add(33*time.Minute), 5*time.Minute, caPool)
+	assert.True(t, v)
+	assert.Nil(t, err)
+
+	v, err = c.VerifyWithSkew(now.Add(40*time.Minute), 5*time.Minute, caPool)
+	assert.False(t, v)
+	assert.ErrorIs(t, err, ErrExpired)
+
+	// The root is checked first
+	v, err = c.VerifyWithSkew(now.Add(-2*time.Hour), 5*time.Minute, caPool)
+	assert.False(t, v)
+	assert.ErrorIs(t, err, ErrRootNotYetValid)
+}
+
 func TestNebulaCertificate_VerifyP256(t *testing.T) {
 	ca, _, caKey, err := newTestCaCertP256(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
 	assert.Nil(t, err)
@@ -1049,6 +1086,77 @@ func TestNebulaCertificate_Copy(t *testing.T) {
 	test.AssertDeepCopyEqual(t, c, cc)
 }
 
+func TestNebulaCertificate_Attributes(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+	h, err := ca.Sha256Sum()
+	assert.Nil(t, err)
+	caPool := NewCAPool()
+	caPool.CAs[h] = ca
+
+	// Certs without attributes marshal exactly as before and have none after a round trip
+	c, _, _, err := newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+	assert.Empty(t, c.getRawDetails().Attributes)
+	b, err := c.Marshal()
+	assert.Nil(t, err)
+	c2, err := UnmarshalNebulaCertificate(b)
+	assert.Nil(t, err)
+	assert.Nil(t, c2.Details.Attributes)
+	assert.NotContains(t, c2.String(), "Attributes")
+
+	c.Details.Attributes = map[string]string{"env": "production", "department": "eng", "device-class": "server"}
+	assert.Nil(t, c.Sign(Curve_CURVE25519, caKey))
+	assert.Equal(t, []string{"department", "eng", "device-class", "server", "env", "production"}, c.getRawDetails().Attributes)
+
+	b, err = c.Marshal()
+	assert.Nil(t, err)
+	c2, err = UnmarshalNebulaCertificate(b)
+	assert.Nil(t, err)
+	assert.Equal(t, c.Details.Attributes, c2.Details.Attributes)
+	v, err := c2.Verify(time.Now(), caPool)
+	assert.True(t, v)
+	assert.Nil(t, err)
+	assert.Contains(t, c2.String(), "\t\tAttributes: {\n\t\t\t\"department\": \"eng\"\n")
+	js, err := c2.MarshalJSON()
+	assert.Nil(t, err)
+	assert.Contains(t, string(js), `"attributes":{"department":"eng","device-class":"server","env":"production"}`)
+
+	cc := c2.Copy()
+	cc.Details.Attributes["env"] = "staging"
+	assert.Equal(t, "production", c2.Details.Attributes["env"])
+
+	// Attributes are covered by the signature
+	c2.Details.Attributes["env"] = "staging"
+	v, err = c2.Verify(time.Now(), caPool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "certificate signature did not match")
+
+	rd := c.getRawDetails()
+	rd.Attributes = rd.Attributes[:3]
+	b, err = proto.Marshal(&RawNebulaCertificate{Details: rd, Signature: c.Signature})
+	assert.Nil(t, err)
+	_, err = UnmarshalNebulaCertificate(b)
+	assert.EqualError(t, err, "encoded Attributes should be in pairs, an odd number was found")
+
+	rd.Attributes = []string{"env", "production", "env", "staging"}
+	b, err = proto.Marshal(&RawNebulaCertificate{Details: rd, Signature: c.Signature})
+	assert.Nil(t, err)
+	_, err = UnmarshalNebulaCertificate(b)
+	assert.EqualError(t, err, `encoded Attributes contained the key "env" more than once`)
+
+	// A ca with attributes limits subordinate certs to those attributes and values
+	ca.Details.Attributes = map[string]string{"env": "production", "department": "eng"}
+	assert.Nil(t, ca.Sign(Curve_CURVE25519, caKey))
+	c.Details.Issuer, _ = ca.Sha256Sum()
+	c.Details.Attributes = map[string]string{"env": "production"}
+	assert.Nil(t, c.CheckRootConstrains(ca))
+	c.Details.Attributes = map[string]string{"env": "staging"}
+	assert.EqualError(t, c.CheckRootConstrains(ca), "certificate contained an attribute not present on the signing ca: env=staging")
+	c.Details.Attributes = map[string]string{"device-class": "server"}
+	assert.EqualError(t, c.CheckRootConstrains(ca), "certificate contained an attribute not present on the signing ca: device-class=server")
+}
+
 func TestUnmarshalNebulaCertificate(t *testing.T) {
 	// Test that we don't panic with an invalid certificate (#332)
 	data := []byte("\x98\x00\x00")
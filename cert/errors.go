@@ -7,6 +7,8 @@ import (
 var (
 	ErrRootExpired       = errors.New("root certificate is expired")
 	ErrExpired           = errors.New("certificate is expired")
+	ErrRootNotYetValid   = errors.New("root certificate is not valid yet")
+	ErrNotYetValid       = errors.New("certificate is not valid yet")
 	ErrNotCA             = errors.New("certificate is not a CA")
 	ErrNotSelfSigned     = errors.New("certificate is not self-signed")
 	ErrBlockListed       = errors.New("certificate is in the block list")
@@ -0,0 +1,162 @@
+package nebula
+
+import (
+	"net/netip"
+	"slices"
+	"sync/atomic"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+// CertIPChange handles a peer completing a handshake with a certificate that claims other vpn ips than the certificate
+// of a tunnel we already have with it, a re-issued certificate during renumbering. The peer is recognized by the name
+// and issuer of its certificate. handshakes.cert_ip_change picks what happens to the tunnels built on the old one:
+//
+//   - replace: tunnels whose certificate claims an ip the new one does not are removed in the same hostmap update that
+//     adds the new tunnel and closed, nothing keeps routing to or accepting packets from an ip the peer gave up, it may
+//     already belong to another host. Tunnels on an old certificate that only claims ips still claimed are left to the
+//     connection manager, as after any rehandshake. This is the default.
+//   - keep: the old tunnels are left alone until they close on their own.
+//
+// Either way the change is logged and counted in handshakes.cert_ip_change, the tunnels closed for it in
+// handshakes.cert_ip_change.closed.
+type CertIPChange struct {
+	replace atomic.Bool
+
+	metricChanged metrics.Counter
+	metricClosed  metrics.Counter
+	l             *logrus.Logger
+}
+
+// staleTunnel is a tunnel removed from the hostmap by unlockedCheck, final is true if it was the last one for its vpn ip
+type staleTunnel struct {
+	hostinfo *HostInfo
+	final    bool
+}
+
+func NewCertIPChangeFromConfig(l *logrus.Logger, c *config.C) *CertIPChange {
+	ch := &CertIPChange{
+		metricChanged: metrics.GetOrRegisterCounter("handshakes.cert_ip_change", nil),
+		metricClosed:  metrics.GetOrRegisterCounter("handshakes.cert_ip_change.closed", nil),
+		l:             l,
+	}
+
+	ch.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		ch.reload(c, false)
+	})
+
+	return ch
+}
+
+func (ch *CertIPChange) reload(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("handshakes.cert_ip_change") {
+		return
+	}
+
+	mode := c.GetString("handshakes.cert_ip_change", "replace")
+	switch mode {
+	case "replace":
+		ch.replace.Store(true)
+	case "keep":
+		ch.replace.Store(false)
+	default:
+		ch.l.WithField("cert_ip_change", mode).Warn("Invalid handshakes.cert_ip_change, using replace")
+		ch.replace.Store(true)
+	}
+
+	if !initial {
+		ch.l.Infof("handshakes.cert_ip_change changed to %v", mode)
+	}
+}
+
+// unlockedCheck looks for tunnels with the peer of hostinfo, which was just added to hm, built on a certificate that
+// claims other vpn ips. hm must be locked. With replace the stale tunnels are removed from hm and returned, closeStale
+// finishes tearing them down once hm is unlocked.
+func (ch *CertIPChange) unlockedCheck(hm *HostMap, hostinfo *HostInfo) []staleTunnel {
+	if ch == nil {
+		return nil
+	}
+	c := hostinfo.GetCert()
+	if c == nil {
+		return nil
+	}
+	claimed := certVpnIps(c)
+
+	var changed, stale []*HostInfo
+	for _, h := range hm.Hosts {
+		for ; h != nil; h = h.next {
+			oc := h.GetCert()
+			if h == hostinfo || oc == nil || oc.Details.Name != c.Details.Name || oc.Details.Issuer != c.Details.Issuer {
+				continue
+			}
+
+			ips := certVpnIps(oc)
+			if slices.Equal(ips, claimed) {
+				continue
+			}
+			changed = append(changed, h)
+			if slices.ContainsFunc(ips, func(ip netip.Addr) bool { return !slices.Contains(claimed, ip) }) {
+				stale = append(stale, h)
+			}
+		}
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	replace := ch.replace.Load()
+	ch.metricChanged.Inc(1)
+	for _, h := range changed {
+		hostinfo.logger(ch.l).
+			WithField("oldVpnIp", h.vpnIp).
+			WithField("oldVpnIps", certVpnIps(h.GetCert())).
+			WithField("newVpnIps", claimed).
+			WithField("stale", slices.Contains(stale, h)).
+			WithField("replace", replace).
+			Info("Peer certificate claims other vpn ips than an existing tunnel")
+	}
+
+	if !replace {
+		return nil
+	}
+
+	out := make([]staleTunnel, 0, len(stale))
+	for _, h := range stale {
+		hm.unlockedDeleteHostInfo(h)
+		_, ok := hm.Hosts[h.vpnIp]
+		out = append(out, staleTunnel{hostinfo: h, final: !ok})
+	}
+	ch.metricClosed.Inc(int64(len(out)))
+	return out
+}
+
+// closeStale tells the peer about the tunnels unlockedCheck removed and clears the lighthouse state of vpn ips left
+// without a tunnel
+func (ch *CertIPChange) closeStale(f *Interface, stale []staleTunnel) {
+	if f == nil {
+		return
+	}
+
+	for _, s := range stale {
+		f.sendCloseTunnel(s.hostinfo)
+		if s.final {
+			f.lightHouse.DeleteVpnIp(s.hostinfo.vpnIp)
+		}
+	}
+}
+
+// certVpnIps returns the vpn ips claimed by c, the first is the one its tunnels are keyed by
+func certVpnIps(c *cert.NebulaCertificate) []netip.Addr {
+	ips := make([]netip.Addr, 0, len(c.Details.Ips))
+	for _, ipNet := range c.Details.Ips {
+		if ip, ok := netip.AddrFromSlice(ipNet.IP); ok {
+			ips = append(ips, ip.Unmap())
+		}
+	}
+	return ips
+}
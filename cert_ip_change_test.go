@@ -0,0 +1,128 @@
+package nebula
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertIPChange(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("handshakes: {}"))
+	ch := NewCertIPChangeFromConfig(l, c)
+	assert.True(t, ch.replace.Load())
+
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	lh := newTestLighthouse()
+	hc := defaultHandshakeConfig
+	hc.certIPChange = ch
+	conn := &controlConn{sent: map[netip.AddrPort][][]byte{}}
+	f := &Interface{
+		l:                 l,
+		hostMap:           hm,
+		lightHouse:        lh,
+		sendBackoff:       NewSendBackoffFromConfig(l, c),
+		writers:           []udp.Conn{conn},
+		connectionManager: &connectionManager{checkInterval: time.Minute, out: map[uint32]struct{}{}, outLock: &sync.RWMutex{}},
+	}
+	handshakes := NewHandshakeManager(l, hm, lh, &udp.NoopConn{}, hc)
+	f.handshakeManager = handshakes
+
+	cs := &NebulaCipherState{c: noise.CipherChaChaPoly.Cipher([32]byte{1})}
+	newTunnel := func(name string, idx uint32, ips ...string) *HostInfo {
+		crt := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: name, Issuer: "ca"}}
+		for _, ip := range ips {
+			crt.Details.Ips = append(crt.Details.Ips, &net.IPNet{IP: net.ParseIP(ip).To4(), Mask: net.CIDRMask(24, 32)})
+		}
+		vpnIp := netip.MustParseAddr(ips[0])
+		lh.addrMap[vpnIp] = NewRemoteList(nil)
+		return &HostInfo{
+			vpnIp:             vpnIp,
+			localIndexId:      idx,
+			remoteIndexId:     idx + 100,
+			remote:            netip.AddrPortFrom(netip.MustParseAddr("192.168.0.1"), uint16(4000+idx)),
+			HandshakePacket:   map[uint8][]byte{0: {byte(idx)}},
+			lastHandshakeTime: uint64(idx),
+			ConnectionState:   &ConnectionState{eKey: cs, dKey: cs, peerCert: crt},
+		}
+	}
+
+	// consistent checks every tunnel is reachable by its vpn ip and both of its indexes and nothing else is left
+	consistent := func(want ...*HostInfo) {
+		assert.Len(t, hm.Indexes, len(want))
+		assert.Len(t, hm.RemoteIndexes, len(want))
+		for _, h := range want {
+			assert.Same(t, h, hm.Indexes[h.localIndexId])
+			assert.Same(t, h, hm.RemoteIndexes[h.remoteIndexId])
+			found := false
+			for p := hm.Hosts[h.vpnIp]; p != nil; p = p.next {
+				found = found || p == h
+			}
+			assert.True(t, found, h.vpnIp.String())
+		}
+	}
+
+	old := newTunnel("peer", 1, "10.128.0.2")
+	other := newTunnel("other", 2, "10.128.0.9")
+	_, err := handshakes.CheckAndComplete(old, 0, f)
+	require.NoError(t, err)
+	_, err = handshakes.CheckAndComplete(other, 0, f)
+	require.NoError(t, err)
+	consistent(old, other)
+
+	t.Log("A rehandshake on the same certificate is not a change")
+	changed, closed := ch.metricChanged.Count(), ch.metricClosed.Count()
+	same := newTunnel("peer", 3, "10.128.0.2")
+	_, err = handshakes.CheckAndComplete(same, 0, f)
+	require.NoError(t, err)
+	assert.Equal(t, changed, ch.metricChanged.Count())
+	hm.DeleteHostInfo(same)
+	consistent(old, other)
+
+	t.Log("A superset of the old ips keeps the old tunnel")
+	superset := newTunnel("peer", 4, "10.128.0.3", "10.128.0.2")
+	_, err = handshakes.CheckAndComplete(superset, 0, f)
+	require.NoError(t, err)
+	assert.Equal(t, changed+1, ch.metricChanged.Count())
+	assert.Equal(t, closed, ch.metricClosed.Count())
+	assert.Same(t, old, hm.Hosts[old.vpnIp])
+	assert.Same(t, superset, hm.Hosts[superset.vpnIp])
+	consistent(old, other, superset)
+	assert.Empty(t, conn.sent)
+
+	t.Log("A disjoint set closes every tunnel on a certificate claiming an ip that is gone")
+	disjoint := newTunnel("peer", 5, "10.128.0.4")
+	handshakes.Complete(disjoint, f)
+	assert.Equal(t, changed+2, ch.metricChanged.Count())
+	assert.Equal(t, closed+2, ch.metricClosed.Count())
+	assert.Nil(t, hm.Hosts[old.vpnIp])
+	assert.Nil(t, hm.Hosts[superset.vpnIp])
+	assert.Same(t, disjoint, hm.Hosts[disjoint.vpnIp])
+	consistent(other, disjoint)
+	assert.Len(t, conn.sent[old.remote], 1, "close tunnel sent on the old tunnel")
+	assert.Len(t, conn.sent[superset.remote], 1, "close tunnel sent on the superset tunnel")
+	assert.NotContains(t, lh.addrMap, old.vpnIp)
+	assert.NotContains(t, lh.addrMap, superset.vpnIp)
+	assert.Contains(t, lh.addrMap, other.vpnIp)
+
+	t.Log("keep only logs and counts the change")
+	require.NoError(t, c.ReloadConfigString("handshakes: {cert_ip_change: keep}"))
+	assert.False(t, ch.replace.Load())
+	renumbered := newTunnel("peer", 6, "10.128.0.5")
+	_, err = handshakes.CheckAndComplete(renumbered, 0, f)
+	require.NoError(t, err)
+	assert.Equal(t, changed+3, ch.metricChanged.Count())
+	assert.Equal(t, closed+2, ch.metricClosed.Count())
+	consistent(other, disjoint, renumbered)
+}
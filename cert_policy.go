@@ -0,0 +1,206 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+// ErrCertPolicy is wrapped by every refusal from pki.cert_policy
+var ErrCertPolicy = errors.New("certificate refused by pki.cert_policy")
+
+// The reasons a certificate is refused by pki.cert_policy, each is counted in certificate.policy.rejected.<reason>
+const (
+	certPolicyCurve            = "curve"
+	certPolicyValidityTooShort = "validity_too_short"
+	certPolicyValidityTooLong  = "validity_too_long"
+
+	certPolicyMetricPrefix = "certificate.policy.rejected."
+)
+
+// certPolicyValidityTolerance covers certificates issued for a round lifetime with timestamps that are a little off
+const certPolicyValidityTolerance = time.Second
+
+// certPolicy is pki.cert_policy, the minimum a peer certificate must meet on top of being valid for our CAs. It lets
+// an operator that does not control every CA it trusts, such as in a federation, refuse peers on algorithms it has
+// deprecated or with certificates that suggest poor key hygiene. The signing CA is always on the same curve as the
+// certificates it signs, so the curve check covers it as well.
+type certPolicy struct {
+	// curves allowed for peer certificates, nil allows every curve
+	curves map[cert.Curve]struct{}
+	// minValidity and maxValidity bound the lifetime of a peer certificate, NotAfter - NotBefore, 0 is no bound
+	minValidity time.Duration
+	maxValidity time.Duration
+}
+
+// CertPolicyError is a refusal from pki.cert_policy, Reason is one of curve, validity_too_short or validity_too_long
+type CertPolicyError struct {
+	Reason string
+	detail string
+}
+
+func (e *CertPolicyError) Error() string {
+	return ErrCertPolicy.Error() + ": " + e.detail
+}
+
+func (e *CertPolicyError) Unwrap() error {
+	return ErrCertPolicy
+}
+
+func newCertPolicyFromConfig(c *config.C) (*certPolicy, error) {
+	raw := c.Get("pki.cert_policy")
+	if raw == nil {
+		return nil, nil
+	}
+	if _, ok := raw.(map[interface{}]interface{}); !ok {
+		return nil, errors.New("pki.cert_policy must be a map")
+	}
+
+	cp := &certPolicy{}
+	if names := c.GetStringSlice("pki.cert_policy.curves", nil); len(names) > 0 {
+		cp.curves = map[cert.Curve]struct{}{}
+		for _, name := range names {
+			v, ok := cert.Curve_value[strings.ToUpper(name)]
+			if !ok {
+				return nil, fmt.Errorf("pki.cert_policy.curves has unknown curve %q, known curves are %s", name, knownCurves())
+			}
+			cp.curves[cert.Curve(v)] = struct{}{}
+		}
+	}
+
+	cp.minValidity = c.GetDuration("pki.cert_policy.min_validity", 0)
+	cp.maxValidity = c.GetDuration("pki.cert_policy.max_validity", 0)
+	if cp.minValidity < 0 || cp.maxValidity < 0 {
+		return nil, errors.New("pki.cert_policy.min_validity and max_validity can not be negative")
+	}
+	if cp.maxValidity > 0 && cp.minValidity > cp.maxValidity {
+		return nil, fmt.Errorf("pki.cert_policy.min_validity %v is more than max_validity %v", cp.minValidity, cp.maxValidity)
+	}
+
+	if cp.curves == nil && cp.minValidity == 0 && cp.maxValidity == 0 {
+		return nil, nil
+	}
+	return cp, nil
+}
+
+func knownCurves() string {
+	names := make([]string, 0, len(cert.Curve_value))
+	for name := range cert.Curve_value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// check returns a *CertPolicyError if c does not meet the policy, it is safe to call on a nil policy
+func (cp *certPolicy) check(c *cert.NebulaCertificate) error {
+	if cp == nil || c == nil {
+		return nil
+	}
+
+	if cp.curves != nil {
+		if _, ok := cp.curves[c.Details.Curve]; !ok {
+			return &CertPolicyError{Reason: certPolicyCurve, detail: fmt.Sprintf("curve %s is not allowed", c.Details.Curve)}
+		}
+	}
+
+	validity := c.Details.NotAfter.Sub(c.Details.NotBefore)
+	if cp.minValidity > 0 && validity+certPolicyValidityTolerance < cp.minValidity {
+		return &CertPolicyError{
+			Reason: certPolicyValidityTooShort,
+			detail: fmt.Sprintf("it is valid for %v which is less than min_validity %v", validity, cp.minValidity),
+		}
+	}
+	if cp.maxValidity > 0 && validity-certPolicyValidityTolerance > cp.maxValidity {
+		return &CertPolicyError{
+			Reason: certPolicyValidityTooLong,
+			detail: fmt.Sprintf("it is valid for %v which is more than max_validity %v", validity, cp.maxValidity),
+		}
+	}
+
+	return nil
+}
+
+// String describes the policy for logging
+func (cp *certPolicy) String() string {
+	if cp == nil {
+		return "none"
+	}
+
+	var parts []string
+	if cp.curves != nil {
+		curves := make([]string, 0, len(cp.curves))
+		for curve := range cp.curves {
+			curves = append(curves, curve.String())
+		}
+		sort.Strings(curves)
+		parts = append(parts, "curves="+strings.Join(curves, ","))
+	}
+	if cp.minValidity > 0 {
+		parts = append(parts, "min_validity="+cp.minValidity.String())
+	}
+	if cp.maxValidity > 0 {
+		parts = append(parts, "max_validity="+cp.maxValidity.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (p *PKI) reloadCertPolicy(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("pki.cert_policy") {
+		return nil
+	}
+
+	cp, err := newCertPolicyFromConfig(c)
+	if err != nil {
+		return err
+	}
+
+	p.certPolicy.Store(cp)
+	if cp != nil || !initial {
+		p.l.WithField("certPolicy", cp.String()).Info("pki.cert_policy configured")
+	}
+
+	if err := cp.check(p.GetCertState().Certificate); err != nil {
+		p.l.WithError(err).Warn("Our own certificate does not meet pki.cert_policy, peers with the same policy will refuse it")
+	}
+	return nil
+}
+
+// checkCertPolicy returns a *CertPolicyError if c does not meet pki.cert_policy
+func (p *PKI) checkCertPolicy(c *cert.NebulaCertificate) error {
+	return p.certPolicy.Load().check(c)
+}
+
+// refusedByCertPolicy is called with a validated peer certificate from a handshake, it returns true if the certificate
+// does not meet pki.cert_policy and the handshake must be dropped
+func (f *Interface) refusedByCertPolicy(remoteCert *cert.NebulaCertificate, addr netip.AddrPort, stage int) bool {
+	err := f.pki.checkCertPolicy(remoteCert)
+	if err == nil {
+		return false
+	}
+
+	var pe *CertPolicyError
+	if errors.As(err, &pe) {
+		metrics.GetOrRegisterCounter(certPolicyMetricPrefix+pe.Reason, nil).Inc(1)
+	}
+
+	fingerprint, _ := remoteCert.Sha256Sum()
+	e := f.l.WithError(err).WithField("udpAddr", addr).
+		WithField("certName", remoteCert.Details.Name).
+		WithField("fingerprint", fingerprint).
+		WithField("issuer", remoteCert.Details.Issuer).
+		WithField("handshake", m{"stage": stage, "style": "ix_psk0"})
+	if pe != nil {
+		e = e.WithField("reason", pe.Reason)
+	}
+	e.Info("Refusing certificate from host")
+	f.securityEvents.Load().handshakeRejected(addr, stage, remoteCert, err)
+	return true
+}
@@ -0,0 +1,110 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertPolicy_check(t *testing.T) {
+	now := time.Now()
+	crt := func(curve cert.Curve, validity time.Duration) *cert.NebulaCertificate {
+		return &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+			Name:      "peer",
+			Curve:     curve,
+			NotBefore: now,
+			NotAfter:  now.Add(validity),
+		}}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		policy string
+		cert   *cert.NebulaCertificate
+		reason string
+	}{
+		{"no policy", "", crt(cert.Curve_CURVE25519, time.Hour), ""},
+		{"allowed curve", "{curves: [CURVE25519, P256]}", crt(cert.Curve_P256, time.Hour), ""},
+		{"curves are case insensitive", "{curves: [p256]}", crt(cert.Curve_P256, time.Hour), ""},
+		{"deprecated curve", "{curves: [P256]}", crt(cert.Curve_CURVE25519, time.Hour), certPolicyCurve},
+		{"long enough", "{min_validity: 24h}", crt(cert.Curve_CURVE25519, 24*time.Hour), ""},
+		{"slightly short", "{min_validity: 24h}", crt(cert.Curve_CURVE25519, 24*time.Hour-time.Second), ""},
+		{"too short", "{min_validity: 24h}", crt(cert.Curve_CURVE25519, 23*time.Hour), certPolicyValidityTooShort},
+		{"short enough", "{max_validity: 8760h}", crt(cert.Curve_CURVE25519, 8760*time.Hour), ""},
+		{"too long", "{max_validity: 8760h}", crt(cert.Curve_CURVE25519, 8761*time.Hour), certPolicyValidityTooLong},
+		{"curve is checked first", "{curves: [P256], max_validity: 1h}", crt(cert.Curve_CURVE25519, 2*time.Hour), certPolicyCurve},
+		{"meets everything", "{curves: [P256], min_validity: 1h, max_validity: 2h}", crt(cert.Curve_P256, 90*time.Minute), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := config.NewC(test.NewLogger())
+			if tc.policy != "" {
+				require.NoError(t, c.LoadString("pki:\n  cert_policy: "+tc.policy+"\n"))
+			}
+			cp, err := newCertPolicyFromConfig(c)
+			require.NoError(t, err)
+
+			err = cp.check(tc.cert)
+			if tc.reason == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorIs(t, err, ErrCertPolicy)
+			var pe *CertPolicyError
+			require.ErrorAs(t, err, &pe)
+			assert.Equal(t, tc.reason, pe.Reason)
+		})
+	}
+}
+
+func TestNewCertPolicyFromConfig(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		err    string
+	}{
+		{"nope", "pki.cert_policy must be a map"},
+		{"{curves: [ED448]}", `pki.cert_policy.curves has unknown curve "ED448", known curves are CURVE25519, P256`},
+		{"{min_validity: -1h}", "pki.cert_policy.min_validity and max_validity can not be negative"},
+		{"{min_validity: 2h, max_validity: 1h}", "pki.cert_policy.min_validity 2h0m0s is more than max_validity 1h0m0s"},
+	} {
+		c := config.NewC(test.NewLogger())
+		require.NoError(t, c.LoadString("pki:\n  cert_policy: "+tc.policy+"\n"))
+		_, err := newCertPolicyFromConfig(c)
+		assert.EqualError(t, err, tc.err, tc.policy)
+	}
+
+	c := config.NewC(test.NewLogger())
+	require.NoError(t, c.LoadString("pki:\n  cert_policy: {curves: []}\n"))
+	cp, err := newCertPolicyFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, cp, "an empty policy is no policy")
+}
+
+func TestInterface_refusedByCertPolicy(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("pki:\n  cert_policy:\n    curves: [P256]\n"))
+	cp, err := newCertPolicyFromConfig(c)
+	require.NoError(t, err)
+
+	f := &Interface{pki: &PKI{l: l}, l: l}
+	peer := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "peer", Curve: cert.Curve_CURVE25519}}
+	addr := netip.MustParseAddrPort("10.0.0.2:4242")
+	assert.False(t, f.refusedByCertPolicy(peer, addr, 1), "no policy")
+
+	f.pki.certPolicy.Store(cp)
+	rejected := metrics.GetOrRegisterCounter(certPolicyMetricPrefix+certPolicyCurve, nil)
+	before := rejected.Count()
+	assert.True(t, f.refusedByCertPolicy(peer, addr, 1))
+	assert.Equal(t, before+1, rejected.Count())
+
+	peer.Details.Curve = cert.Curve_P256
+	assert.False(t, f.refusedByCertPolicy(peer, addr, 2))
+}
@@ -0,0 +1,29 @@
+package nebula
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// clockOffsetWarn is how far our clock may be from a lighthouse clock before we warn that it is probably wrong
+const clockOffsetWarn = time.Minute
+
+// observeClock compares the time a lighthouse put in its handshake reply with our own clock. Lighthouses are usually
+// servers with a synchronized clock, a large difference means our clock is wrong and certificates will soon look not
+// yet valid or expired. The reply is a single packet so the measurement is off by at most the one way delay.
+func (lh *LightHouse) observeClock(vpnIp netip.Addr, peerTime uint64, now time.Time) {
+	if peerTime == 0 || !lh.IsLighthouseIP(vpnIp) {
+		return
+	}
+
+	offset := now.Sub(time.Unix(0, int64(peerTime)))
+	metrics.GetOrRegisterGauge("lighthouse.clock_offset_ms", nil).Update(offset.Milliseconds())
+
+	if offset > clockOffsetWarn || offset < -clockOffsetWarn {
+		lh.l.WithField("lighthouse", vpnIp).WithField("offset", offset.Round(time.Second)).
+			WithField("localTime", now).WithField("lighthouseTime", time.Unix(0, int64(peerTime))).
+			Warn("Local clock differs from the lighthouse clock, certificate validation will fail if it is off by more than pki.clock_skew")
+	}
+}
@@ -0,0 +1,36 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLightHouse_observeClock(t *testing.T) {
+	lhIp := netip.MustParseAddr("10.128.0.1")
+	lh := &LightHouse{l: test.NewLogger()}
+	lh.lighthouses.Store(&map[netip.Addr]struct{}{lhIp: {}})
+	gauge := metrics.GetOrRegisterGauge("lighthouse.clock_offset_ms", nil)
+	gauge.Update(0)
+
+	now := time.Now()
+
+	// Only lighthouses are trusted to have a good clock
+	lh.observeClock(netip.MustParseAddr("10.128.0.2"), uint64(now.Add(-time.Hour).UnixNano()), now)
+	assert.Zero(t, gauge.Value())
+
+	// We are an hour ahead
+	lh.observeClock(lhIp, uint64(now.Add(-time.Hour).UnixNano()), now)
+	assert.Equal(t, time.Hour.Milliseconds(), gauge.Value())
+
+	lh.observeClock(lhIp, uint64(now.Add(1500*time.Millisecond).UnixNano()), now)
+	assert.EqualValues(t, -1500, gauge.Value())
+
+	// Peers that did not send a time are skipped
+	lh.observeClock(lhIp, 0, now)
+	assert.EqualValues(t, -1500, gauge.Value())
+}
@@ -26,6 +26,7 @@ type caFlags struct {
 	outCertPath      *string
 	outQRPath        *string
 	groups           *string
+	attributes       *string
 	ips              *string
 	subnets          *string
 	argonMemory      *uint
@@ -45,6 +46,7 @@ func newCaFlags() *caFlags {
 	cf.outCertPath = cf.set.String("out-crt", "ca.crt", "Optional: path to write the certificate to")
 	cf.outQRPath = cf.set.String("out-qr", "", "Optional: output a qr code image (png) of the certificate")
 	cf.groups = cf.set.String("groups", "", "Optional: comma separated list of groups. This will limit which groups subordinate certs can use")
+	cf.attributes = cf.set.String("attributes", "", "Optional: comma separated list of key=value attributes. This will limit which attributes and values subordinate certs can use")
 	cf.ips = cf.set.String("ips", "", "Optional: comma separated list of ipv4 address and network in CIDR notation. This will limit which ipv4 addresses and networks subordinate certs can use for ip addresses")
 	cf.subnets = cf.set.String("subnets", "", "Optional: comma separated list of ipv4 address and network in CIDR notation. This will limit which ipv4 addresses and networks subordinate certs can use in subnets")
 	cf.argonMemory = cf.set.Uint("argon-memory", 2*1024*1024, "Optional: Argon2 memory parameter (in KiB) used for encrypted private key passphrase")
@@ -106,6 +108,11 @@ func ca(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error
 		}
 	}
 
+	attributes, err := parseAttributes(*cf.attributes)
+	if err != nil {
+		return err
+	}
+
 	var ips []*net.IPNet
 	if *cf.ips != "" {
 		for _, rs := range strings.Split(*cf.ips, ",") {
@@ -193,15 +200,16 @@ func ca(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error
 
 	nc := cert.NebulaCertificate{
 		Details: cert.NebulaCertificateDetails{
-			Name:      *cf.name,
-			Groups:    groups,
-			Ips:       ips,
-			Subnets:   subnets,
-			NotBefore: time.Now(),
-			NotAfter:  time.Now().Add(*cf.duration),
-			PublicKey: pub,
-			IsCA:      true,
-			Curve:     curve,
+			Name:       *cf.name,
+			Groups:     groups,
+			Attributes: attributes,
+			Ips:        ips,
+			Subnets:    subnets,
+			NotBefore:  time.Now(),
+			NotAfter:   time.Now().Add(*cf.duration),
+			PublicKey:  pub,
+			IsCA:       true,
+			Curve:      curve,
 		},
 	}
 
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 )
 
 var Build string
@@ -137,3 +138,29 @@ func mustFlagString(name string, val *string) error {
 	}
 	return nil
 }
+
+// parseAttributes parses a comma separated list of key=value certificate attributes, nil is returned if there are none
+func parseAttributes(s string) (map[string]string, error) {
+	var attributes map[string]string
+	for _, ra := range strings.Split(s, ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(ra, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, newHelpErrorf("invalid attribute definition: should be key=value, have %s", ra)
+		}
+
+		if attributes == nil {
+			attributes = make(map[string]string)
+		}
+		if _, ok := attributes[k]; ok {
+			return nil, newHelpErrorf("invalid attribute definition: %s was provided more than once", k)
+		}
+		attributes[k] = strings.TrimSpace(v)
+	}
+	return attributes, nil
+}
@@ -28,6 +28,7 @@ type signFlags struct {
 	outCertPath *string
 	outQRPath   *string
 	groups      *string
+	attributes  *string
 	subnets     *string
 }
 
@@ -44,6 +45,7 @@ func newSignFlags() *signFlags {
 	sf.outCertPath = sf.set.String("out-crt", "", "Optional: path to write the certificate to")
 	sf.outQRPath = sf.set.String("out-qr", "", "Optional: output a qr code image (png) of the certificate")
 	sf.groups = sf.set.String("groups", "", "Optional: comma separated list of groups")
+	sf.attributes = sf.set.String("attributes", "", "Optional: comma separated list of key=value attributes, firewall rules can match on them")
 	sf.subnets = sf.set.String("subnets", "", "Optional: comma separated list of ipv4 address and network in CIDR notation. Subnets this cert can serve for")
 	return &sf
 
@@ -158,6 +160,11 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 		}
 	}
 
+	attributes, err := parseAttributes(*sf.attributes)
+	if err != nil {
+		return err
+	}
+
 	subnets := []*net.IPNet{}
 	if *sf.subnets != "" {
 		for _, rs := range strings.Split(*sf.subnets, ",") {
@@ -195,16 +202,17 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 
 	nc := cert.NebulaCertificate{
 		Details: cert.NebulaCertificateDetails{
-			Name:      *sf.name,
-			Ips:       []*net.IPNet{ipNet},
-			Groups:    groups,
-			Subnets:   subnets,
-			NotBefore: time.Now(),
-			NotAfter:  time.Now().Add(*sf.duration),
-			PublicKey: pub,
-			IsCA:      false,
-			Issuer:    issuer,
-			Curve:     curve,
+			Name:       *sf.name,
+			Ips:        []*net.IPNet{ipNet},
+			Groups:     groups,
+			Attributes: attributes,
+			Subnets:    subnets,
+			NotBefore:  time.Now(),
+			NotAfter:   time.Now().Add(*sf.duration),
+			PublicKey:  pub,
+			IsCA:       false,
+			Issuer:     issuer,
+			Curve:      curve,
 		},
 	}
 
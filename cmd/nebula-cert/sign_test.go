@@ -28,6 +28,8 @@ func Test_signHelp(t *testing.T) {
 	assert.Equal(
 		t,
 		"Usage of "+os.Args[0]+" sign <flags>: create and sign a certificate\n"+
+			"  -attributes string\n"+
+			"    \tOptional: comma separated list of key=value attributes, firewall rules can match on them\n"+
 			"  -ca-crt string\n"+
 			"    \tOptional: path to the signing CA cert (default \"ca.crt\")\n"+
 			"  -ca-key string\n"+
@@ -283,6 +285,33 @@ func Test_signCert(t *testing.T) {
 	assert.Equal(t, issuer, lCrt.Details.Issuer)
 
 	assert.True(t, lCrt.CheckSignature(caPub))
+	assert.Nil(t, lCrt.Details.Attributes)
+
+	// test proper cert with attributes
+	os.Remove(keyF.Name())
+	os.Remove(crtF.Name())
+	ob.Reset()
+	eb.Reset()
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", crtF.Name(), "-out-key", keyF.Name(), "-duration", "100m", "-attributes", "env=production, ,department = eng"}
+	assert.Nil(t, signCert(args, ob, eb, nopw))
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	rb, _ = os.ReadFile(crtF.Name())
+	lCrt, _, err = cert.UnmarshalNebulaCertificateFromPEM(rb)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"env": "production", "department": "eng"}, lCrt.Details.Attributes)
+	assert.True(t, lCrt.CheckSignature(caPub))
+
+	// test bad attributes
+	os.Remove(keyF.Name())
+	os.Remove(crtF.Name())
+	ob.Reset()
+	eb.Reset()
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", crtF.Name(), "-out-key", keyF.Name(), "-duration", "100m", "-attributes", "production"}
+	assertHelpError(t, signCert(args, ob, eb, nopw), "invalid attribute definition: should be key=value, have production")
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", crtF.Name(), "-out-key", keyF.Name(), "-duration", "100m", "-attributes", "env=a,env=b"}
+	assertHelpError(t, signCert(args, ob, eb, nopw), "invalid attribute definition: env was provided more than once")
 
 	// test proper cert with in-pub
 	os.Remove(keyF.Name())
@@ -4,6 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula"
@@ -18,8 +21,21 @@ import (
 // at compile-time.
 var Build string
 
+// configPaths collects every -config flag
+type configPaths []string
+
+func (p *configPaths) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *configPaths) Set(v string) error {
+	*p = append(*p, v)
+	return nil
+}
+
 func main() {
-	configPath := flag.String("config", "", "Path to either a file or directory to load configuration from")
+	var paths configPaths
+	flag.Var(&paths, "config", "Path to either a file or directory to load configuration from. Repeat to run several overlay segments sharing the listen port of the first")
 	configTest := flag.Bool("test", false, "Test the config and print the end result. Non zero exit indicates a faulty config")
 	printVersion := flag.Bool("version", false, "Print version")
 	printUsage := flag.Bool("help", false, "Print command line usage")
@@ -36,17 +52,22 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *configPath == "" {
+	if len(paths) == 0 {
 		fmt.Println("-config flag must be set")
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	if len(paths) > 1 {
+		runSegments(paths, *configTest)
+		return
+	}
+
 	l := logrus.New()
 	l.Out = os.Stdout
 
 	c := config.NewC(l)
-	err := c.Load(*configPath)
+	err := c.Load(paths[0])
 	if err != nil {
 		fmt.Printf("failed to load config: %s", err)
 		os.Exit(1)
@@ -66,3 +87,56 @@ func main() {
 
 	os.Exit(0)
 }
+
+// runSegments runs an overlay segment for each config on a shared udp listener
+func runSegments(paths []string, configTest bool) {
+	sl := nebula.NewSharedListener(logrus.StandardLogger())
+
+	var ctrls []*nebula.Control
+	stop := func() {
+		for _, ctrl := range ctrls {
+			ctrl.Stop()
+		}
+	}
+
+	for _, path := range paths {
+		l := logrus.New()
+		l.Out = os.Stdout
+
+		c := config.NewC(l)
+		err := c.Load(path)
+		if err != nil {
+			fmt.Printf("failed to load config %s: %s", path, err)
+			stop()
+			os.Exit(1)
+		}
+
+		ctrl, err := sl.Main(c, configTest, Build, l, nil)
+		if err != nil {
+			util.LogWithContextIfNeeded("Failed to start "+path, err, l)
+			stop()
+			os.Exit(1)
+		}
+
+		if !configTest {
+			ctrls = append(ctrls, ctrl)
+		}
+	}
+
+	if configTest {
+		os.Exit(0)
+	}
+
+	for _, ctrl := range ctrls {
+		ctrl.Start()
+	}
+	notifyReady(logrus.StandardLogger())
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigChan
+	logrus.WithField("signal", sig.String()).Info("Caught signal, shutting down")
+	stop()
+
+	os.Exit(0)
+}
@@ -240,6 +240,17 @@ func (c *C) GetInt(k string, d int) int {
 	return v
 }
 
+// GetFloat64 will get the float64 for k or return the default d if not found or invalid
+func (c *C) GetFloat64(k string, d float64) float64 {
+	r := c.GetString(k, strconv.FormatFloat(d, 'g', -1, 64))
+	v, err := strconv.ParseFloat(r, 64)
+	if err != nil {
+		return d
+	}
+
+	return v
+}
+
 // GetUint32 will get the uint32 for k or return the default d if not found or invalid
 func (c *C) GetUint32(k string, d uint32) uint32 {
 	r := c.GetInt(k, int(d))
@@ -94,6 +94,21 @@ func TestConfig_GetBool(t *testing.T) {
 	assert.Equal(t, false, c.GetBool("bool", true))
 }
 
+func TestConfig_GetFloat64(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	assert.Equal(t, 0.5, c.GetFloat64("float", 0.5))
+
+	c.Settings["float"] = 0.25
+	assert.Equal(t, 0.25, c.GetFloat64("float", 0.5))
+
+	c.Settings["float"] = 2
+	assert.Equal(t, 2.0, c.GetFloat64("float", 0.5))
+
+	c.Settings["float"] = "nope"
+	assert.Equal(t, 0.5, c.GetFloat64("float", 0.5))
+}
+
 func TestConfig_HasChanged(t *testing.T) {
 	l := test.NewLogger()
 	// No reload has occurred, return false
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"net/netip"
 	"sync"
 	"time"
@@ -44,12 +45,13 @@ type connectionManager struct {
 	punchy                  *Punchy
 	checkInterval           time.Duration
 	pendingDeletionInterval time.Duration
+	tunnelIdle              *TunnelIdleTimeout
 	metricsTxPunchy         metrics.Counter
 
 	l *logrus.Logger
 }
 
-func newConnectionManager(ctx context.Context, l *logrus.Logger, intf *Interface, checkInterval, pendingDeletionInterval time.Duration, punchy *Punchy) *connectionManager {
+func newConnectionManager(ctx context.Context, l *logrus.Logger, intf *Interface, checkInterval, pendingDeletionInterval time.Duration, punchy *Punchy, tunnelIdle *TunnelIdleTimeout) *connectionManager {
 	var max time.Duration
 	if checkInterval < pendingDeletionInterval {
 		max = pendingDeletionInterval
@@ -71,6 +73,7 @@ func newConnectionManager(ctx context.Context, l *logrus.Logger, intf *Interface
 		checkInterval:           checkInterval,
 		pendingDeletionInterval: pendingDeletionInterval,
 		punchy:                  punchy,
+		tunnelIdle:              tunnelIdle,
 		metricsTxPunchy:         metrics.GetOrRegisterCounter("messages.tx.punchy", nil),
 		l:                       l,
 	}
@@ -177,7 +180,12 @@ func (n *connectionManager) Run(ctx context.Context) {
 }
 
 func (n *connectionManager) doTrafficCheck(localIndex uint32, p, nb, out []byte, now time.Time) {
-	decision, hostinfo, primary := n.makeTrafficDecision(localIndex, now)
+	decision, hostinfo, primary, keepalive := n.makeTrafficDecision(localIndex, now)
+
+	if keepalive != nil {
+		// Sent outside of the hostmap lock, an authenticated keepalive goes through the regular send path
+		n.sendKeepalive(keepalive, nb, out)
+	}
 
 	switch decision {
 	case deleteTunnel:
@@ -200,7 +208,13 @@ func (n *connectionManager) doTrafficCheck(localIndex uint32, p, nb, out []byte,
 		n.tryRehandshake(hostinfo)
 
 	case sendTestPacket:
-		n.intf.SendMessageToHostInfo(header.Test, header.TestRequest, hostinfo, p, nb, out)
+		n.intf.SendMessageToHostInfo(header.Test, header.TestRequest, hostinfo, n.intf.tunnelQuality.testPayload(hostinfo, now), nb, out)
+	}
+
+	switch decision {
+	case tryRehandshake, swapPrimary, migrateRelays:
+		// The tunnel is passing traffic, keep its loss and rtt estimates fresh
+		n.intf.tunnelQuality.check(n.intf, hostinfo, now, nb, out)
 	}
 
 	n.resetRelayTrafficCheck(hostinfo)
@@ -297,7 +311,9 @@ func (n *connectionManager) migrateRelayUsed(oldhostinfo, newhostinfo *HostInfo)
 	}
 }
 
-func (n *connectionManager) makeTrafficDecision(localIndex uint32, now time.Time) (trafficDecision, *HostInfo, *HostInfo) {
+// makeTrafficDecision decides what to do with the tunnel at localIndex. The last hostinfo returned, if any, should be sent
+// a keepalive to maintain NAT state.
+func (n *connectionManager) makeTrafficDecision(localIndex uint32, now time.Time) (trafficDecision, *HostInfo, *HostInfo, *HostInfo) {
 	n.hostMap.RLock()
 	defer n.hostMap.RUnlock()
 
@@ -305,12 +321,12 @@ func (n *connectionManager) makeTrafficDecision(localIndex uint32, now time.Time
 	if hostinfo == nil {
 		n.l.WithField("localIndex", localIndex).Debugf("Not found in hostmap")
 		delete(n.pendingDeletion, localIndex)
-		return doNothing, nil, nil
+		return doNothing, nil, nil, nil
 	}
 
 	if n.isInvalidCertificate(now, hostinfo) {
 		delete(n.pendingDeletion, hostinfo.localIndexId)
-		return closeTunnel, hostinfo, nil
+		return closeTunnel, hostinfo, nil, nil
 	}
 
 	primary := n.hostMap.Hosts[hostinfo.vpnIp]
@@ -321,6 +337,19 @@ func (n *connectionManager) makeTrafficDecision(localIndex uint32, now time.Time
 
 	// Check for traffic on this hostinfo
 	inTraffic, outTraffic := n.getAndResetTrafficCheck(localIndex)
+	if inTraffic || outTraffic {
+		hostinfo.lastUsed.Store(now.UnixNano())
+	}
+
+	if n.checkIdle(hostinfo, now) {
+		hostinfo.logger(n.l).WithField("idleTime", hostinfo.IdleTime(now)).
+			Info("Closing tunnel that exceeded tunnels.idle_timeout")
+		delete(n.pendingDeletion, hostinfo.localIndexId)
+		if n.tunnelIdle.GetSendClose() {
+			return closeTunnel, hostinfo, nil, nil
+		}
+		return deleteTunnel, hostinfo, nil, nil
+	}
 
 	// A hostinfo is determined alive if there is incoming traffic
 	if inTraffic {
@@ -346,12 +375,13 @@ func (n *connectionManager) makeTrafficDecision(localIndex uint32, now time.Time
 
 		n.trafficTimer.Add(hostinfo.localIndexId, n.checkInterval)
 
+		var keepalive *HostInfo
 		if !outTraffic {
-			// Send a punch packet to keep the NAT state alive
-			n.sendPunch(hostinfo)
+			// Send a keepalive to keep the NAT state alive
+			keepalive = hostinfo
 		}
 
-		return decision, hostinfo, primary
+		return decision, hostinfo, primary, keepalive
 	}
 
 	if _, ok := n.pendingDeletion[hostinfo.localIndexId]; ok {
@@ -361,17 +391,17 @@ func (n *connectionManager) makeTrafficDecision(localIndex uint32, now time.Time
 			Info("Tunnel status")
 
 		delete(n.pendingDeletion, hostinfo.localIndexId)
-		return deleteTunnel, hostinfo, nil
+		return deleteTunnel, hostinfo, nil, nil
 	}
 
+	var keepalive *HostInfo
 	decision := doNothing
 	if hostinfo != nil && hostinfo.ConnectionState != nil && mainHostInfo {
 		if !outTraffic {
 			// If we aren't sending or receiving traffic then its an unused tunnel and we don't to test the tunnel.
 			// Just maintain NAT state if configured to do so.
-			n.sendPunch(hostinfo)
 			n.trafficTimer.Add(hostinfo.localIndexId, n.checkInterval)
-			return doNothing, nil, nil
+			return doNothing, nil, nil, hostinfo
 
 		}
 
@@ -379,7 +409,7 @@ func (n *connectionManager) makeTrafficDecision(localIndex uint32, now time.Time
 			// This is similar to the old punchy behavior with a slight optimization.
 			// We aren't receiving traffic but we are sending it, punch on all known
 			// ips in case we need to re-prime NAT state
-			n.sendPunch(hostinfo)
+			keepalive = hostinfo
 		}
 
 		if n.l.Level >= logrus.DebugLevel {
@@ -399,7 +429,7 @@ func (n *connectionManager) makeTrafficDecision(localIndex uint32, now time.Time
 
 	n.pendingDeletion[hostinfo.localIndexId] = struct{}{}
 	n.trafficTimer.Add(hostinfo.localIndexId, n.pendingDeletionInterval)
-	return decision, hostinfo, nil
+	return decision, hostinfo, nil, keepalive
 }
 
 func (n *connectionManager) shouldSwapPrimary(current, primary *HostInfo) bool {
@@ -436,12 +466,21 @@ func (n *connectionManager) isInvalidCertificate(now time.Time, hostinfo *HostIn
 		return false
 	}
 
-	valid, err := remoteCert.VerifyWithCache(now, n.intf.pki.GetCAPool())
-	if valid {
-		return false
+	valid, err := remoteCert.VerifyWithCacheAndSkew(now, n.intf.pki.GetClockSkew(), n.intf.pki.GetCAPool())
+	if valid && err == nil {
+		// A tightened pki.cert_policy applies to established tunnels as well
+		err = n.intf.pki.checkCertPolicy(remoteCert)
+		valid = err == nil
+	}
+	if valid || n.intf.pki.inExpiredGrace(remoteCert, err, now) {
+		// pki.user has no grace period, the user certificate must still be valid
+		err = n.intf.pki.recheckUserCert(hostinfo.ConnectionState.peerUserCert, now)
+		if err == nil {
+			return false
+		}
 	}
 
-	if !n.intf.disconnectInvalid.Load() && err != cert.ErrBlockListed {
+	if !n.intf.disconnectInvalid.Load() && !errors.Is(err, cert.ErrBlockListed) {
 		// Block listed certificates should always be disconnected
 		return false
 	}
@@ -450,26 +489,53 @@ func (n *connectionManager) isInvalidCertificate(now time.Time, hostinfo *HostIn
 	hostinfo.logger(n.l).WithError(err).
 		WithField("fingerprint", fingerprint).
 		Info("Remote certificate is no longer valid, tearing down the tunnel")
+	if errors.Is(err, cert.ErrBlockListed) {
+		n.intf.securityEvents.Load().tunnelRevoked(hostinfo, remoteCert)
+	}
 
 	return true
 }
 
-func (n *connectionManager) sendPunch(hostinfo *HostInfo) {
+// sendKeepalive sends the punchy.keepalive packet to keep the NAT state of hostinfo alive. Authenticated keepalives only
+// go to the current remote since the peer roams to wherever they arrive from, with punchy.target_all_remotes every
+// other known remote is still sent a punch. Relayed tunnels have no remote of their own to authenticate to and punch.
+func (n *connectionManager) sendKeepalive(hostinfo *HostInfo, nb, out []byte) {
 	if !n.punchy.GetPunch() {
 		// Punching is disabled
 		return
 	}
 
+	ka := n.punchy.GetKeepalive()
+	if !hostinfo.remote.IsValid() || hostinfo.ConnectionState == nil {
+		ka = keepalivePunch
+	}
+
+	switch ka {
+	case keepaliveTest:
+		n.metricsTxPunchy.Inc(1)
+		n.intf.sendTo(header.Test, header.TestRequest, hostinfo.ConnectionState, hostinfo, hostinfo.remote, []byte(""), nb, out)
+	case keepaliveNoop:
+		n.metricsTxPunchy.Inc(1)
+		n.intf.sendTo(header.Message, header.MessageKeepalive, hostinfo.ConnectionState, hostinfo, hostinfo.remote, []byte(""), nb, out)
+	}
+
 	if n.punchy.GetTargetEverything() {
-		hostinfo.remotes.ForEach(n.hostMap.GetPreferredRanges(), func(addr netip.AddrPort, preferred bool) {
-			n.metricsTxPunchy.Inc(1)
-			n.intf.outside.WriteTo([]byte{1}, addr)
+		hostinfo.remotes.ForEach(n.hostMap.PreferredRangesFor(hostinfo), func(addr netip.AddrPort, preferred bool) {
+			if ka == keepalivePunch || addr != hostinfo.remote {
+				n.metricsTxPunchy.Inc(1)
+				n.intf.writeTo(0, hostinfo, []byte{1}, addr, ecnNotECT)
+			}
 		})
 
-	} else if hostinfo.remote.IsValid() {
+	} else if ka == keepalivePunch {
+		if !hostinfo.remote.IsValid() {
+			return
+		}
 		n.metricsTxPunchy.Inc(1)
-		n.intf.outside.WriteTo([]byte{1}, hostinfo.remote)
+		n.intf.writeTo(0, hostinfo, []byte{1}, hostinfo.remote, ecnNotECT)
 	}
+
+	hostinfo.keepalive.Store(uint32(ka))
 }
 
 func (n *connectionManager) tryRehandshake(hostinfo *HostInfo) {
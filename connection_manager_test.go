@@ -25,9 +25,11 @@ func newTestLighthouse() *LightHouse {
 	}
 	lighthouses := map[netip.Addr]struct{}{}
 	staticList := map[netip.Addr]struct{}{}
+	var relaysForMe []netip.Addr
 
 	lh.lighthouses.Store(&lighthouses)
 	lh.staticList.Store(&staticList)
+	lh.relaysForMe.Store(&relaysForMe)
 
 	return lh
 }
@@ -46,7 +48,6 @@ func Test_NewConnectionManagerTest(t *testing.T) {
 
 	cs := &CertState{
 		RawCertificate:      []byte{},
-		PrivateKey:          []byte{},
 		Certificate:         &cert.NebulaCertificate{},
 		RawCertificateNoKey: []byte{},
 	}
@@ -68,7 +69,7 @@ func Test_NewConnectionManagerTest(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	punchy := NewPunchyFromConfig(l, config.NewC(l))
-	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy)
+	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy, nil)
 	p := []byte("")
 	nb := make([]byte, 12, 12)
 	out := make([]byte, mtu)
@@ -129,7 +130,6 @@ func Test_NewConnectionManagerTest2(t *testing.T) {
 
 	cs := &CertState{
 		RawCertificate:      []byte{},
-		PrivateKey:          []byte{},
 		Certificate:         &cert.NebulaCertificate{},
 		RawCertificateNoKey: []byte{},
 	}
@@ -151,7 +151,7 @@ func Test_NewConnectionManagerTest2(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	punchy := NewPunchyFromConfig(l, config.NewC(l))
-	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy)
+	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy, nil)
 	p := []byte("")
 	nb := make([]byte, 12, 12)
 	out := make([]byte, mtu)
@@ -200,6 +200,87 @@ func Test_NewConnectionManagerTest2(t *testing.T) {
 	assert.Contains(t, nc.hostMap.Hosts, hostinfo.vpnIp)
 }
 
+func Test_NewConnectionManagerTest_IdleTimeout(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	vpnIp := netip.MustParseAddr("172.1.1.2")
+	hostMap := newHostMap(l, vpncidr)
+	hostMap.preferredRanges.Store(&[]netip.Prefix{})
+
+	lh := newTestLighthouse()
+	ifce := &Interface{
+		hostMap:          hostMap,
+		inside:           &test.NoopTun{},
+		outside:          &udp.NoopConn{},
+		firewall:         &Firewall{},
+		lightHouse:       lh,
+		pki:              &PKI{},
+		handshakeManager: NewHandshakeManager(l, hostMap, lh, &udp.NoopConn{}, defaultHandshakeConfig),
+		l:                l,
+	}
+	ifce.pki.cs.Store(&CertState{Certificate: &cert.NebulaCertificate{}})
+
+	c := config.NewC(l)
+	c.Settings["tunnels"] = map[interface{}]interface{}{
+		"idle_timeout":    "1m",
+		"idle_send_close": false,
+		"idle_exempt":     []interface{}{"172.1.1.3/32"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	punchy := NewPunchyFromConfig(l, c)
+	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy, NewTunnelIdleTimeoutFromConfig(l, c))
+	p := []byte("")
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+
+	hostinfo := &HostInfo{
+		vpnIp:         vpnIp,
+		localIndexId:  1099,
+		remoteIndexId: 9901,
+	}
+	hostinfo.ConnectionState = &ConnectionState{
+		myCert: &cert.NebulaCertificate{},
+		H:      &noise.HandshakeState{},
+	}
+	nc.hostMap.unlockedAddHostInfo(hostinfo, ifce)
+
+	exempt := &HostInfo{
+		vpnIp:         netip.MustParseAddr("172.1.1.3"),
+		localIndexId:  1100,
+		remoteIndexId: 9902,
+	}
+	exempt.ConnectionState = hostinfo.ConnectionState
+	nc.hostMap.unlockedAddHostInfo(exempt, ifce)
+
+	// Keepalives are flowing and inner traffic was seen, the tunnel stays up
+	now := time.Now()
+	nc.In(hostinfo.localIndexId)
+	hostinfo.markData()
+	nc.doTrafficCheck(hostinfo.localIndexId, p, nb, out, now)
+	assert.Contains(t, nc.hostMap.Indexes, hostinfo.localIndexId)
+	assert.Equal(t, time.Duration(0), hostinfo.IdleTime(now))
+
+	// Only keepalives for longer than the idle timeout, the tunnel is torn down
+	now = now.Add(2 * time.Minute)
+	nc.In(hostinfo.localIndexId)
+	nc.In(exempt.localIndexId)
+	assert.Equal(t, 2*time.Minute, hostinfo.IdleTime(now))
+	nc.doTrafficCheck(hostinfo.localIndexId, p, nb, out, now)
+	nc.doTrafficCheck(exempt.localIndexId, p, nb, out, now)
+	assert.NotContains(t, nc.hostMap.Indexes, hostinfo.localIndexId)
+	assert.NotContains(t, nc.hostMap.Hosts, hostinfo.vpnIp)
+
+	// Unless the tunnel is exempt
+	assert.Contains(t, nc.hostMap.Indexes, exempt.localIndexId)
+
+	// A nil timeout never closes tunnels
+	var nilIdle *TunnelIdleTimeout
+	assert.Equal(t, time.Duration(0), nilIdle.GetTimeout())
+	assert.False(t, nilIdle.GetSendClose())
+}
+
 // Check if we can disconnect the peer.
 // Validate if the peer's certificate is invalid (expired, etc.)
 // Disconnect only if disconnectInvalid: true is set.
@@ -252,7 +333,6 @@ func Test_NewConnectionManagerTest_DisconnectInvalid(t *testing.T) {
 
 	cs := &CertState{
 		RawCertificate:      []byte{},
-		PrivateKey:          []byte{},
 		Certificate:         &cert.NebulaCertificate{},
 		RawCertificateNoKey: []byte{},
 	}
@@ -276,7 +356,7 @@ func Test_NewConnectionManagerTest_DisconnectInvalid(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	punchy := NewPunchyFromConfig(l, config.NewC(l))
-	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy)
+	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy, nil)
 	ifce.connectionManager = nc
 
 	hostinfo := &HostInfo{
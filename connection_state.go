@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/flynn/noise"
 	"github.com/sirupsen/logrus"
@@ -15,37 +16,49 @@ import (
 const ReplayWindow = 1024
 
 type ConnectionState struct {
-	eKey           *NebulaCipherState
-	dKey           *NebulaCipherState
-	H              *noise.HandshakeState
-	myCert         *cert.NebulaCertificate
-	peerCert       *cert.NebulaCertificate
-	initiator      bool
+	eKey      *NebulaCipherState
+	dKey      *NebulaCipherState
+	H         *noise.HandshakeState
+	myCert    *cert.NebulaCertificate
+	peerCert  *cert.NebulaCertificate
+	initiator bool
+	// peerUserCert is the user certificate the peer presented if pki.user.ca is set, peerIdentity combines it with
+	// peerCert for the firewall, see newPeerIdentity
+	peerUserCert *cert.NebulaCertificate
+	peerIdentity *cert.NebulaCertificate
+	// authOnly is set if both peers agreed during the handshake that data may be sent without encryption
+	authOnly       bool
 	messageCounter atomic.Uint64
 	window         *Bits
 	writeLock      sync.Mutex
+	// exportKeys holds a copy of the session keys, only in binaries built with key export
+	exportKeys keyExportState
+	// keyCreated is when the handshake derived eKey and dKey
+	keyCreated time.Time
 }
 
 func NewConnectionState(l *logrus.Logger, cipher string, certState *CertState, initiator bool, pattern noise.HandshakePattern, psk []byte, pskStage int) *ConnectionState {
-	var dhFunc noise.DHFunc
-	switch certState.Certificate.Details.Curve {
-	case cert.Curve_CURVE25519:
-		dhFunc = noise.DH25519
-	case cert.Curve_P256:
-		dhFunc = noiseutil.DHP256
-	default:
-		l.Errorf("invalid curve: %s", certState.Certificate.Details.Curve)
+	dhFunc, err := dhFuncForCurve(certState.Certificate.Details.Curve)
+	if err != nil {
+		l.Error(err)
+		return nil
+	}
+
+	// All DH operations on our static key go through the NodeKey, the private key is never handed to noise
+	nodeDH, err := newNodeKeyDH(dhFunc, certState.PrivateKey)
+	if err != nil {
+		l.WithError(err).Error("Failed to prepare the node key for a handshake")
 		return nil
 	}
 
 	var cs noise.CipherSuite
 	if cipher == "chachapoly" {
-		cs = noise.NewCipherSuite(dhFunc, noise.CipherChaChaPoly, noise.HashSHA256)
+		cs = noise.NewCipherSuite(nodeDH, noise.CipherChaChaPoly, noise.HashSHA256)
 	} else {
-		cs = noise.NewCipherSuite(dhFunc, noiseutil.CipherAESGCM, noise.HashSHA256)
+		cs = noise.NewCipherSuite(nodeDH, noiseutil.CipherAESGCM, noise.HashSHA256)
 	}
 
-	static := noise.DHKey{Private: certState.PrivateKey, Public: certState.PublicKey}
+	static := noise.DHKey{Private: nodeDH.placeholder, Public: certState.PublicKey}
 
 	b := NewBits(ReplayWindow)
 	// Clear out bit 0, we never transmit it and we don't want it showing as packet loss
@@ -80,8 +93,10 @@ func NewConnectionState(l *logrus.Logger, cipher string, certState *CertState, i
 
 func (cs *ConnectionState) MarshalJSON() ([]byte, error) {
 	return json.Marshal(m{
-		"certificate":     cs.peerCert,
-		"initiator":       cs.initiator,
-		"message_counter": cs.messageCounter.Load(),
+		"certificate":      cs.peerCert,
+		"user_certificate": cs.peerUserCert,
+		"initiator":        cs.initiator,
+		"message_counter":  cs.messageCounter.Load(),
+		"auth_only":        cs.authOnly,
 	})
 }
@@ -0,0 +1,520 @@
+package nebula
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+const (
+	defaultConntrackSyncFullInterval  = 30 * time.Second
+	defaultConntrackSyncDeltaInterval = time.Second
+
+	// conntrackSyncMinKeyLen is the shortest conntrack_sync.key accepted
+	conntrackSyncMinKeyLen = 16
+	// conntrackSyncRedial is how long the exporter waits before connecting to the peer again
+	conntrackSyncRedial  = 5 * time.Second
+	conntrackSyncTimeout = 10 * time.Second
+
+	conntrackSyncVersion   = 1
+	conntrackSyncNonceLen  = 16
+	conntrackSyncMACLen    = sha256.Size
+	conntrackSyncEntryLen  = 16 + 16 + 2 + 2 + 1 + 1 + 4
+	conntrackSyncPerFrame  = 1000
+	conntrackSyncMaxFrame  = 2 + conntrackSyncEntryLen*conntrackSyncPerFrame
+	conntrackSyncKindFull  = 1
+	conntrackSyncKindDelta = 2
+)
+
+// Flags of a synced conntrack entry
+const (
+	conntrackSyncFlagIncoming = 1 << iota
+	conntrackSyncFlagRelayed
+	conntrackSyncFlagFragment
+)
+
+var errConntrackSyncMAC = errors.New("conntrack_sync frame failed authentication, check conntrack_sync.key on both gateways")
+
+// ConntrackSync copies the firewall conntrack table to the other gateway of an HA pair, so a standby that takes over
+// already knows the established flows and lets their replies through. The exporter connects to conntrack_sync.peer and
+// sends the whole table every full_interval and the flows added since the last send every delta_interval. The importer
+// listens on conntrack_sync.listen and adds what it receives to its own table. Both can be set on both gateways, entries
+// that were imported are not exported back until a packet has used them.
+//
+// An imported entry is checked against the local firewall rules, with the peer certificate of the tunnel it arrives
+// on, the first time a packet uses it. Syncing never lets through a flow the standby's own rules would not have
+// allowed, it only spares established flows from being dropped because the standby never saw them start.
+//
+// Syncing is best effort. Flows that started within the last delta_interval before a failover are not known to the
+// standby, nor are entries refreshed since the last full export, and entries that end on the primary stay on the
+// standby until they time out. Frames are authenticated with conntrack_sync.key but not encrypted.
+type ConntrackSync struct {
+	listen        string
+	peer          string
+	key           []byte
+	fullInterval  time.Duration
+	deltaInterval time.Duration
+
+	metricExported metrics.Counter
+	metricImported metrics.Counter
+	metricRejected metrics.Counter
+	l              *logrus.Logger
+}
+
+// conntrackDeltas collects the flows added to the conntrack table since the last delta export. It belongs to the
+// conntrack table, like conntrackFullReporter, and is guarded by its lock.
+type conntrackDeltas struct {
+	// added is nil unless an exporter is connected
+	added map[firewall.Packet]struct{}
+}
+
+// add records a new flow, caller must own the conntrack lock
+func (d *conntrackDeltas) add(fp firewall.Packet) {
+	if d.added != nil {
+		d.added[fp] = struct{}{}
+	}
+}
+
+// syncedConn is a conntrack entry as it is sent to the conntrack_sync peer
+type syncedConn struct {
+	fp       firewall.Packet
+	incoming bool
+	relayed  bool
+	// ttl is how long the entry has left, the clocks of the gateways need not agree
+	ttl time.Duration
+}
+
+// NewConntrackSyncFromConfig returns nil if neither conntrack_sync.listen nor conntrack_sync.peer is set. This section is
+// not reloadable.
+func NewConntrackSyncFromConfig(l *logrus.Logger, c *config.C) (*ConntrackSync, error) {
+	cs := &ConntrackSync{
+		listen:         c.GetString("conntrack_sync.listen", ""),
+		peer:           c.GetString("conntrack_sync.peer", ""),
+		key:            []byte(c.GetString("conntrack_sync.key", "")),
+		fullInterval:   c.GetDuration("conntrack_sync.full_interval", defaultConntrackSyncFullInterval),
+		deltaInterval:  c.GetDuration("conntrack_sync.delta_interval", defaultConntrackSyncDeltaInterval),
+		metricExported: metrics.GetOrRegisterCounter("conntrack_sync.exported", nil),
+		metricImported: metrics.GetOrRegisterCounter("conntrack_sync.imported", nil),
+		metricRejected: metrics.GetOrRegisterCounter("conntrack_sync.rejected", nil),
+		l:              l,
+	}
+
+	if cs.listen == "" && cs.peer == "" {
+		return nil, nil
+	}
+
+	if len(cs.key) < conntrackSyncMinKeyLen {
+		return nil, fmt.Errorf("conntrack_sync.key must be at least %d characters", conntrackSyncMinKeyLen)
+	}
+	if cs.fullInterval <= 0 || cs.deltaInterval <= 0 {
+		return nil, errors.New("conntrack_sync.full_interval and delta_interval must be positive")
+	}
+	if cs.listen != "" {
+		if _, err := netip.ParseAddrPort(cs.listen); err != nil {
+			return nil, fmt.Errorf("conntrack_sync.listen must be an ip:port: %w", err)
+		}
+	}
+
+	l.WithField("listen", cs.listen).
+		WithField("peer", cs.peer).
+		WithField("fullInterval", cs.fullInterval).
+		WithField("deltaInterval", cs.deltaInterval).
+		Info("Conntrack sync configured")
+	return cs, nil
+}
+
+// Run imports from and exports to the conntrack_sync peer until ctx is done, it is safe to call on a nil ConntrackSync
+func (cs *ConntrackSync) Run(ctx context.Context, f *Interface) {
+	if cs == nil {
+		return
+	}
+
+	if cs.listen != "" {
+		ln, err := net.Listen("tcp", cs.listen)
+		if err != nil {
+			cs.l.WithError(err).WithField("listen", cs.listen).Error("Failed to listen for conntrack sync")
+		} else {
+			go func() {
+				<-ctx.Done()
+				ln.Close()
+			}()
+			go cs.serve(ln, f)
+		}
+	}
+
+	if cs.peer == "" {
+		return
+	}
+
+	for {
+		err := cs.export(ctx, f)
+		if ctx.Err() != nil {
+			return
+		}
+		cs.l.WithError(err).WithField("peer", cs.peer).Warn("Conntrack sync to the peer stopped, retrying")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(conntrackSyncRedial):
+		}
+	}
+}
+
+// serve accepts conntrack exports from the peer until ln is closed
+func (cs *ConntrackSync) serve(ln net.Listener, f *Interface) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				cs.l.WithError(err).Error("Failed to accept a conntrack sync connection")
+			}
+			return
+		}
+
+		go func() {
+			err := cs.importFrom(conn, func() *Firewall { return f.firewall })
+			conn.Close()
+			if err != nil && !errors.Is(err, io.EOF) {
+				cs.l.WithError(err).WithField("peer", conn.RemoteAddr()).Warn("Conntrack sync from the peer stopped")
+			}
+		}()
+	}
+}
+
+// importFrom reads frames from conn and adds their entries to the conntrack table of the firewall fw returns. The
+// importer picks the nonce that every frame mac covers so frames from another connection can not be replayed.
+func (cs *ConntrackSync) importFrom(conn net.Conn, fw func() *Firewall) error {
+	nonce := make([]byte, conntrackSyncNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(conntrackSyncTimeout))
+	if _, err := conn.Write(nonce); err != nil {
+		return err
+	}
+
+	cs.l.WithField("peer", conn.RemoteAddr()).Info("Conntrack sync from the peer started")
+	r := bufio.NewReader(conn)
+	fr := conntrackSyncFramer{key: cs.key, nonce: nonce}
+	for {
+		// The exporter sends at least a delta every delta_interval
+		conn.SetReadDeadline(time.Now().Add(cs.deltaInterval + conntrackSyncTimeout))
+		payload, err := fr.read(r)
+		if err != nil {
+			if errors.Is(err, errConntrackSyncMAC) {
+				cs.metricRejected.Inc(1)
+			}
+			return err
+		}
+
+		entries, err := decodeSyncedConns(payload)
+		if err != nil {
+			cs.metricRejected.Inc(1)
+			return err
+		}
+
+		cs.metricImported.Inc(int64(fw().importConns(entries, time.Now())))
+	}
+}
+
+// export connects to the peer and sends the conntrack table until ctx is done or the connection fails
+func (cs *ConntrackSync) export(ctx context.Context, f *Interface) error {
+	d := net.Dialer{Timeout: conntrackSyncTimeout}
+	conn, err := d.DialContext(ctx, "tcp", cs.peer)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	nonce := make([]byte, conntrackSyncNonceLen)
+	conn.SetReadDeadline(time.Now().Add(conntrackSyncTimeout))
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		return err
+	}
+
+	fw := func() *Firewall { return f.firewall }
+	// Deltas are only collected while connected, the full export on connect covers the time in between
+	fw().collectDeltas(true)
+	defer fw().collectDeltas(false)
+
+	cs.l.WithField("peer", cs.peer).Info("Conntrack sync to the peer started")
+	fr := conntrackSyncFramer{key: cs.key, nonce: nonce}
+	send := func(kind byte, entries []syncedConn) error {
+		conn.SetWriteDeadline(time.Now().Add(conntrackSyncTimeout))
+		if err := fr.writeEntries(conn, kind, entries); err != nil {
+			return err
+		}
+		cs.metricExported.Inc(int64(len(entries)))
+		return nil
+	}
+
+	if err := send(conntrackSyncKindFull, fw().exportConns(time.Now(), true)); err != nil {
+		return err
+	}
+
+	full := time.NewTicker(cs.fullInterval)
+	defer full.Stop()
+	delta := time.NewTicker(cs.deltaInterval)
+	defer delta.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-full.C:
+			err = send(conntrackSyncKindFull, fw().exportConns(now, true))
+		case now := <-delta.C:
+			err = send(conntrackSyncKindDelta, fw().exportConns(now, false))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// conntrackSyncFramer reads and writes the frames of one connection. A frame is a big endian uint32 payload length,
+// the payload and an hmac-sha256 over the nonce of the connection, the frame sequence number and the payload.
+type conntrackSyncFramer struct {
+	key   []byte
+	nonce []byte
+	seq   uint64
+}
+
+func (fr *conntrackSyncFramer) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, fr.key)
+	h.Write(fr.nonce)
+	binary.Write(h, binary.BigEndian, fr.seq)
+	h.Write(payload)
+	fr.seq++
+	return h.Sum(nil)
+}
+
+// writeEntries sends entries as frames of at most conntrackSyncPerFrame entries, an empty list is still sent as one
+// frame so the importer knows the exporter is alive
+func (fr *conntrackSyncFramer) writeEntries(w io.Writer, kind byte, entries []syncedConn) error {
+	for {
+		n := len(entries)
+		if n > conntrackSyncPerFrame {
+			n = conntrackSyncPerFrame
+		}
+
+		payload := encodeSyncedConns(kind, entries[:n])
+		frame := make([]byte, 4, 4+len(payload)+conntrackSyncMACLen)
+		binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+		frame = append(frame, payload...)
+		frame = append(frame, fr.mac(payload)...)
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+
+		entries = entries[n:]
+		if len(entries) == 0 {
+			return nil
+		}
+	}
+}
+
+// read returns the payload of the next frame once its mac is verified
+func (fr *conntrackSyncFramer) read(r io.Reader) ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(l[:])
+	if n > conntrackSyncMaxFrame {
+		return nil, fmt.Errorf("conntrack_sync frame of %d bytes is too large", n)
+	}
+
+	b := make([]byte, int(n)+conntrackSyncMACLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	payload := b[:n]
+	if !hmac.Equal(fr.mac(payload), b[n:]) {
+		return nil, errConntrackSyncMAC
+	}
+	return payload, nil
+}
+
+func encodeSyncedConns(kind byte, entries []syncedConn) []byte {
+	b := make([]byte, 2, 2+len(entries)*conntrackSyncEntryLen)
+	b[0] = conntrackSyncVersion
+	b[1] = kind
+	for _, e := range entries {
+		local, remote := e.fp.LocalIP.As16(), e.fp.RemoteIP.As16()
+		b = append(b, local[:]...)
+		b = append(b, remote[:]...)
+		b = binary.BigEndian.AppendUint16(b, e.fp.LocalPort)
+		b = binary.BigEndian.AppendUint16(b, e.fp.RemotePort)
+
+		var flags byte
+		if e.incoming {
+			flags |= conntrackSyncFlagIncoming
+		}
+		if e.relayed {
+			flags |= conntrackSyncFlagRelayed
+		}
+		if e.fp.Fragment {
+			flags |= conntrackSyncFlagFragment
+		}
+		b = append(b, e.fp.Protocol, flags)
+		b = binary.BigEndian.AppendUint32(b, uint32(e.ttl.Milliseconds()))
+	}
+	return b
+}
+
+func decodeSyncedConns(b []byte) ([]syncedConn, error) {
+	if len(b) < 2 || b[0] != conntrackSyncVersion {
+		return nil, errors.New("conntrack_sync frame has an unknown version")
+	}
+	if b[1] != conntrackSyncKindFull && b[1] != conntrackSyncKindDelta {
+		return nil, fmt.Errorf("conntrack_sync frame has an unknown kind %d", b[1])
+	}
+
+	b = b[2:]
+	if len(b)%conntrackSyncEntryLen != 0 {
+		return nil, fmt.Errorf("conntrack_sync frame has a partial entry")
+	}
+
+	entries := make([]syncedConn, 0, len(b)/conntrackSyncEntryLen)
+	for ; len(b) > 0; b = b[conntrackSyncEntryLen:] {
+		flags := b[37]
+		entries = append(entries, syncedConn{
+			fp: firewall.Packet{
+				LocalIP:    netip.AddrFrom16([16]byte(b[0:16])).Unmap(),
+				RemoteIP:   netip.AddrFrom16([16]byte(b[16:32])).Unmap(),
+				LocalPort:  binary.BigEndian.Uint16(b[32:34]),
+				RemotePort: binary.BigEndian.Uint16(b[34:36]),
+				Protocol:   b[36],
+				Fragment:   flags&conntrackSyncFlagFragment != 0,
+			},
+			incoming: flags&conntrackSyncFlagIncoming != 0,
+			relayed:  flags&conntrackSyncFlagRelayed != 0,
+			ttl:      time.Duration(binary.BigEndian.Uint32(b[38:42])) * time.Millisecond,
+		})
+	}
+	return entries, nil
+}
+
+// collectDeltas starts or stops recording new flows for exportConns
+func (f *Firewall) collectDeltas(on bool) {
+	conntrack := f.Conntrack
+	conntrack.Lock()
+	if on {
+		conntrack.deltas.added = map[firewall.Packet]struct{}{}
+	} else {
+		conntrack.deltas.added = nil
+	}
+	conntrack.Unlock()
+}
+
+// exportConns returns the conntrack entries to send to the peer, every entry if full is true and otherwise the flows
+// added since the last call. Imported entries that no packet has used are left out.
+func (f *Firewall) exportConns(now time.Time, full bool) []syncedConn {
+	conntrack := f.Conntrack
+	conntrack.Lock()
+	defer conntrack.Unlock()
+
+	var entries []syncedConn
+	export := func(fp firewall.Packet, c *conn) {
+		ttl := c.Expires.Sub(now)
+		if c.synced || ttl <= 0 {
+			return
+		}
+		entries = append(entries, syncedConn{fp: fp, incoming: c.incoming, relayed: c.relayed, ttl: ttl})
+	}
+
+	if full {
+		entries = make([]syncedConn, 0, len(conntrack.Conns))
+		for fp, c := range conntrack.Conns {
+			export(fp, c)
+		}
+	} else {
+		for fp := range conntrack.deltas.added {
+			if c, ok := conntrack.Conns[fp]; ok {
+				export(fp, c)
+			}
+		}
+	}
+
+	if len(conntrack.deltas.added) > 0 {
+		conntrack.deltas.added = map[firewall.Packet]struct{}{}
+	}
+	return entries
+}
+
+// importConns adds entries from the peer to the conntrack table and returns how many were added or extended. Entries
+// are marked for the rules to be checked again on first use, an entry this firewall is already tracking on its own is
+// left alone.
+func (f *Firewall) importConns(entries []syncedConn, now time.Time) int {
+	conntrack := f.Conntrack
+	conntrack.Lock()
+	defer conntrack.Unlock()
+
+	imported := 0
+	for _, e := range entries {
+		ttl := e.ttl
+		if max := f.timeout(e.fp.Protocol); ttl > max {
+			ttl = max
+		}
+		expires := now.Add(ttl)
+
+		if c, ok := conntrack.Conns[e.fp]; ok {
+			if c.synced && expires.After(c.Expires) {
+				c.Expires = expires
+				imported++
+			}
+			continue
+		}
+
+		if !f.hasRoom(now) {
+			break
+		}
+
+		conntrack.TimerWheel.Advance(now)
+		conntrack.TimerWheel.Add(e.fp, ttl)
+		conntrack.Conns[e.fp] = &conn{
+			Expires:  expires,
+			incoming: e.incoming,
+			relayed:  e.relayed,
+			// Never the current version, the rules are matched again with the tunnel the first packet arrives on
+			rulesVersion: f.rulesVersion - 1,
+			synced:       true,
+		}
+		imported++
+	}
+	return imported
+}
+
+// timeout returns the conntrack timeout for proto
+func (f *Firewall) timeout(proto uint8) time.Duration {
+	switch proto {
+	case firewall.ProtoTCP:
+		return f.TCPTimeout
+	case firewall.ProtoUDP:
+		return f.UDPTimeout
+	default:
+		return f.DefaultTimeout
+	}
+}
@@ -0,0 +1,197 @@
+package nebula
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newConntrackSyncTestFirewall(t *testing.T, allow bool) (*Firewall, *HostInfo) {
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"default-group"},
+			InvertedGroups: map[string]struct{}{"default-group": {}},
+			Issuer:         "signer-shasum",
+		},
+	}
+	h := &HostInfo{
+		ConnectionState: &ConnectionState{peerCert: c},
+		vpnIp:           netip.MustParseAddr("1.2.3.4"),
+	}
+	h.CreateRemoteCIDR(c)
+
+	fw := NewFirewall(test.NewLogger(), time.Minute, time.Minute, time.Minute, c)
+	if allow {
+		require.NoError(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", netip.Prefix{}, netip.Prefix{}, "", ""))
+	}
+	return fw, h
+}
+
+func conntrackSyncTestPacket(port uint16) firewall.Packet {
+	return firewall.Packet{
+		LocalIP:    netip.MustParseAddr("1.2.3.4"),
+		RemoteIP:   netip.MustParseAddr("1.2.3.4"),
+		LocalPort:  port,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+}
+
+func TestFirewall_exportImportConns(t *testing.T) {
+	cp := cert.NewCAPool()
+	primary, h := newConntrackSyncTestFirewall(t, true)
+	now := time.Now()
+
+	p1 := conntrackSyncTestPacket(10)
+	require.NoError(t, primary.Drop(p1, true, false, h, cp, nil))
+
+	t.Log("Deltas are only collected while an exporter is connected")
+	assert.Empty(t, primary.exportConns(now, false))
+	primary.collectDeltas(true)
+	p2 := conntrackSyncTestPacket(11)
+	require.NoError(t, primary.Drop(p2, true, false, h, cp, nil))
+
+	delta := primary.exportConns(now, false)
+	require.Len(t, delta, 1)
+	assert.Equal(t, p2, delta[0].fp)
+	assert.True(t, delta[0].incoming)
+	assert.Empty(t, primary.exportConns(now, false), "a delta is only sent once")
+
+	full := primary.exportConns(now, true)
+	assert.Len(t, full, 2)
+
+	t.Log("A standby with the same rules lets the replies through")
+	standby, h2 := newConntrackSyncTestFirewall(t, true)
+	assert.Equal(t, 2, standby.importConns(full, now))
+	assert.Empty(t, standby.exportConns(now, true), "imported entries are not exported back")
+	assert.NoError(t, standby.Drop(p1, false, false, h2, cp, nil))
+	assert.Len(t, standby.exportConns(now, true), 1, "an entry a packet used is exported again")
+
+	t.Log("Imports extend synced entries but leave local ones alone")
+	standby.Conntrack.Conns[p2].Expires = now
+	assert.Equal(t, 1, standby.importConns(full, now))
+	assert.True(t, standby.Conntrack.Conns[p2].Expires.After(now))
+
+	t.Log("The ttl is capped at the local timeout")
+	long := []syncedConn{{fp: conntrackSyncTestPacket(12), ttl: 24 * time.Hour}}
+	standby.importConns(long, now)
+	assert.Equal(t, now.Add(time.Minute), standby.Conntrack.Conns[long[0].fp].Expires)
+
+	t.Log("A standby whose rules do not allow the flow drops it")
+	strict, h3 := newConntrackSyncTestFirewall(t, false)
+	assert.Equal(t, 2, strict.importConns(full, now))
+	assert.Equal(t, ErrNoMatchingRule, strict.Drop(p1, false, false, h3, cp, nil))
+}
+
+func TestConntrackSyncFramer(t *testing.T) {
+	entries := []syncedConn{
+		{fp: conntrackSyncTestPacket(10), incoming: true, relayed: true, ttl: 3 * time.Minute},
+		{fp: firewall.Packet{
+			LocalIP:    netip.MustParseAddr("fd00::1"),
+			RemoteIP:   netip.MustParseAddr("fd00::2"),
+			LocalPort:  443,
+			RemotePort: 50000,
+			Protocol:   firewall.ProtoTCP,
+			Fragment:   true,
+		}, ttl: time.Second},
+	}
+
+	key := []byte("0123456789abcdef")
+	nonce := bytes.Repeat([]byte{1}, conntrackSyncNonceLen)
+	buf := &bytes.Buffer{}
+	w := conntrackSyncFramer{key: key, nonce: nonce}
+	require.NoError(t, w.writeEntries(buf, conntrackSyncKindFull, entries))
+	require.NoError(t, w.writeEntries(buf, conntrackSyncKindDelta, nil))
+	frames := buf.Bytes()
+
+	r := conntrackSyncFramer{key: key, nonce: nonce}
+	payload, err := r.read(bytes.NewReader(frames))
+	require.NoError(t, err)
+	got, err := decodeSyncedConns(payload)
+	require.NoError(t, err)
+	assert.Equal(t, entries, got)
+
+	t.Log("Frames from another connection, out of order, or with another key are refused")
+	for _, fr := range []conntrackSyncFramer{
+		{key: key, nonce: bytes.Repeat([]byte{2}, conntrackSyncNonceLen)},
+		{key: key, nonce: nonce, seq: 1},
+		{key: []byte("fedcba9876543210"), nonce: nonce},
+	} {
+		_, err := fr.read(bytes.NewReader(frames))
+		assert.ErrorIs(t, err, errConntrackSyncMAC)
+	}
+
+	_, err = decodeSyncedConns([]byte{conntrackSyncVersion, conntrackSyncKindFull, 1})
+	assert.EqualError(t, err, "conntrack_sync frame has a partial entry")
+	_, err = decodeSyncedConns([]byte{2, conntrackSyncKindFull})
+	assert.EqualError(t, err, "conntrack_sync frame has an unknown version")
+}
+
+func TestConntrackSync(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	cs, err := NewConntrackSyncFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Nil(t, cs, "disabled by default")
+
+	require.NoError(t, c.LoadString("conntrack_sync:\n  peer: 127.0.0.1:1\n  key: short\n"))
+	_, err = NewConntrackSyncFromConfig(l, c)
+	assert.EqualError(t, err, "conntrack_sync.key must be at least 16 characters")
+
+	c = config.NewC(l)
+	require.NoError(t, c.LoadString("conntrack_sync:\n  peer: 127.0.0.1:1\n  key: 0123456789abcdef\n  delta_interval: 10ms\n"))
+	exporter, err := NewConntrackSyncFromConfig(l, c)
+	require.NoError(t, err)
+
+	c = config.NewC(l)
+	require.NoError(t, c.LoadString("conntrack_sync:\n  listen: 127.0.0.1:0\n  key: 0123456789abcdef\n"))
+	importer, err := NewConntrackSyncFromConfig(l, c)
+	require.NoError(t, err)
+
+	cp := cert.NewCAPool()
+	primary, h := newConntrackSyncTestFirewall(t, true)
+	standby, _ := newConntrackSyncTestFirewall(t, true)
+	p1, p2 := conntrackSyncTestPacket(10), conntrackSyncTestPacket(11)
+	require.NoError(t, primary.Drop(p1, true, false, h, cp, nil))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go importer.serve(ln, &Interface{firewall: standby})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exporter.peer = ln.Addr().String()
+	go exporter.Run(ctx, &Interface{firewall: primary})
+
+	tracked := func(fp firewall.Packet) func() bool {
+		return func() bool {
+			standby.Conntrack.Lock()
+			defer standby.Conntrack.Unlock()
+			_, ok := standby.Conntrack.Conns[fp]
+			return ok
+		}
+	}
+
+	t.Log("The full table is sent on connect and new flows follow as deltas")
+	assert.Eventually(t, tracked(p1), 5*time.Second, 10*time.Millisecond)
+	primary.Conntrack.Lock()
+	collecting := primary.Conntrack.deltas.added != nil
+	primary.Conntrack.Unlock()
+	require.True(t, collecting)
+	require.NoError(t, primary.Drop(p2, true, false, h, cp, nil))
+	assert.Eventually(t, tracked(p2), 5*time.Second, 10*time.Millisecond)
+}
@@ -6,9 +6,11 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/overlay"
 )
@@ -22,7 +24,7 @@ type controlHostLister interface {
 	QueryVpnIp(vpnIp netip.Addr) *HostInfo
 	ForEachIndex(each controlEach)
 	ForEachVpnIp(each controlEach)
-	GetPreferredRanges() []netip.Prefix
+	PreferredRangesFor(*HostInfo) []netip.Prefix
 }
 
 type Control struct {
@@ -31,7 +33,9 @@ type Control struct {
 	ctx             context.Context
 	cancel          context.CancelFunc
 	sshStart        func()
+	managementStart func()
 	statsStart      func()
+	healthStart     func()
 	dnsStart        func()
 	lighthouseStart func()
 }
@@ -42,10 +46,32 @@ type ControlHostInfo struct {
 	RemoteIndex            uint32                  `json:"remoteIndex"`
 	RemoteAddrs            []netip.AddrPort        `json:"remoteAddrs"`
 	Cert                   *cert.NebulaCertificate `json:"cert"`
+	UserCert               *cert.NebulaCertificate `json:"userCert,omitempty"`
 	MessageCounter         uint64                  `json:"messageCounter"`
 	CurrentRemote          netip.AddrPort          `json:"currentRemote"`
 	CurrentRelaysToMe      []netip.Addr            `json:"currentRelaysToMe"`
 	CurrentRelaysThroughMe []netip.Addr            `json:"currentRelaysThroughMe"`
+	IdleSeconds            int64                   `json:"idleSeconds"`
+	KeyAgeSeconds          int64                   `json:"keyAgeSeconds"`
+	RemoteLatencies        []CandidateRTT          `json:"remoteLatencies,omitempty"`
+	AuthOnly               bool                    `json:"authOnly"`
+	Errors                 TunnelErrors            `json:"errors"`
+	RoamingDisabled        bool                    `json:"roamingDisabled"`
+	CAFingerprint          string                  `json:"caFingerprint"`
+	SendBackoff            *SendBackoffStatus      `json:"sendBackoff,omitempty"`
+	Quality                *TunnelQualityStatus    `json:"quality,omitempty"`
+	RelayReason            *RelayReason            `json:"relayReason,omitempty"`
+	// Keepalive is the punchy.keepalive type last sent to keep the NAT state of this tunnel alive, empty if none was
+	Keepalive string `json:"keepalive,omitempty"`
+	// Source is the local address from listen.source_pins that packets to the current remote are sent from, empty if
+	// the kernel chooses
+	Source *netip.Addr `json:"source,omitempty"`
+	// Transport is udp or tcp, whichever the last packet to the current remote was sent on. See transport.tcp
+	Transport string `json:"transport,omitempty"`
+	// MTU is the largest tunneled packet the path to the current remote carries as found by mtu_probe, 0 if unknown
+	MTU int `json:"mtu,omitempty"`
+	// Paused is true while the data of the tunnel is stopped with Control.PauseTunnel
+	Paused bool `json:"paused"`
 }
 
 // Start actually runs nebula, this is a nonblocking call. To block use Control.ShutdownBlock()
@@ -57,9 +83,15 @@ func (c *Control) Start() {
 	if c.sshStart != nil {
 		go c.sshStart()
 	}
+	if c.managementStart != nil {
+		go c.managementStart()
+	}
 	if c.statsStart != nil {
 		go c.statsStart()
 	}
+	if c.healthStart != nil {
+		go c.healthStart()
+	}
 	if c.dnsStart != nil {
 		go c.dnsStart()
 	}
@@ -81,10 +113,16 @@ func (c *Control) Stop() {
 	// being created while we're shutting them all down.
 	c.cancel()
 
+	// Snapshot before closing tunnels so we still know which remotes were in use
+	if err := c.f.hostmapSnapshot.Save(c.f.lightHouse, c.f.hostMap); err != nil {
+		c.l.WithError(err).Error("Failed to save hostmap snapshot")
+	}
+
 	c.CloseAllTunnels(false)
 	if err := c.f.Close(); err != nil {
 		c.l.WithError(err).Error("Close interface failed")
 	}
+	c.f.health.markTunUp(false)
 	c.l.Info("Goodbye")
 }
 
@@ -102,13 +140,7 @@ func (c *Control) ShutdownBlock() {
 
 // RebindUDPServer asks the UDP listener to rebind it's listener. Mainly used on mobile clients when interfaces change
 func (c *Control) RebindUDPServer() {
-	_ = c.f.outside.Rebind()
-
-	// Trigger a lighthouse update, useful for mobile clients that should have an update interval of 0
-	c.f.lightHouse.SendUpdate()
-
-	// Let the main interface know that we rebound so that underlying tunnels know to trigger punches from their remotes
-	c.f.rebindCount++
+	c.f.rebindUnderlay()
 }
 
 // ListHostmapHosts returns details about the actual or pending (handshaking) hostmap by vpn ip
@@ -129,6 +161,17 @@ func (c *Control) ListHostmapIndexes(pendingMap bool) []ControlHostInfo {
 	}
 }
 
+// ListPendingHandshakes returns the handshakes we started that have not completed yet, oldest first
+func (c *Control) ListPendingHandshakes() []PendingHandshake {
+	return c.f.handshakeManager.ListPending()
+}
+
+// ClearPendingHandshakes gives up on the pending handshakes with vpnIps, or all of them if vpnIps is empty, that
+// were started more than olderThan ago. Returns the vpn ips that were cleared.
+func (c *Control) ClearPendingHandshakes(vpnIps []netip.Addr, olderThan time.Duration) []netip.Addr {
+	return c.f.handshakeManager.ClearPending(vpnIps, olderThan)
+}
+
 // GetCertByVpnIp returns the authenticated certificate of the given vpn IP, or nil if not found
 func (c *Control) GetCertByVpnIp(vpnIp netip.Addr) *cert.NebulaCertificate {
 	if c.f.myVpnNet.Addr() == vpnIp {
@@ -146,13 +189,225 @@ func (c *Control) CreateTunnel(vpnIp netip.Addr) {
 	c.f.handshakeManager.StartHandshake(vpnIp, nil)
 }
 
+// GetTunnelCounts returns the current number of tunnels, pending handshakes, and relays along with tunnels.max
+func (c *Control) GetTunnelCounts() TunnelCounts {
+	return c.f.handshakeManager.TunnelCounts()
+}
+
+// GetRuntimeInfo returns the effective runtime parameters such as the tun name, mtu, listen addresses, and cipher
+func (c *Control) GetRuntimeInfo() RuntimeInfo {
+	return c.f.RuntimeInfo()
+}
+
+// GetUDPSocketStats returns the effective kernel buffer sizes and drop counts of the outside sockets, where the platform
+// supports it
+func (c *Control) GetUDPSocketStats() []UDPSocketStats {
+	return c.f.UDPSocketStats()
+}
+
+// LoadCert replaces our certificate with the PEM encoded rawCert, see PKI.LoadCert
+func (c *Control) LoadCert(rawCert []byte) (*CertLoadResult, error) {
+	return c.f.pki.LoadCert(rawCert)
+}
+
+// GetExpiredCerts returns our certificate and the peer certificates in use that are expired, they are only accepted
+// within pki.expired_grace_period
+func (c *Control) GetExpiredCerts() ExpiredCerts {
+	return c.f.pki.expiredCerts(c.f.hostMap, time.Now())
+}
+
+// GetLighthouseOrder returns the lighthouses in the order host queries are sent to them, see lighthouse.weights
+func (c *Control) GetLighthouseOrder() []LighthouseStatus {
+	return c.f.lightHouse.selection.order(c.f.lightHouse.GetLighthouses(), time.Now())
+}
+
+// SetConntrackFullCallback sets a function to call when new flows are dropped because the firewall conntrack table is
+// full, at most once every 10 seconds while it stays full. It is called on its own goroutine, nil removes it.
+func (c *Control) SetConntrackFullCallback(cb func(ConntrackFull)) {
+	c.f.firewall.Conntrack.full.setCallback(cb)
+}
+
+// GetSendQueues returns the backlog of every send_priority class, the default class is last. Queues only fill while
+// the underlay socket is backed up.
+func (c *Control) GetSendQueues() []SendQueueStatus {
+	return c.f.sendPriority.Status()
+}
+
+// GetNATStatus returns what kind of NAT we appear to be behind based on the addresses our lighthouses see us at
+func (c *Control) GetNATStatus() NATStatus {
+	return c.f.lightHouse.GetNATStatus()
+}
+
+// GetUnderlayStatus returns the local underlay addresses and when they last changed, see underlay_watch
+func (c *Control) GetUnderlayStatus() UnderlayStatus {
+	return c.f.underlayWatch.Status()
+}
+
+// GetCATunnels returns every trusted CA along with the tunnels authenticated by it, a CA that has been removed from the
+// pool is still listed while tunnels validated by it remain
+func (c *Control) GetCATunnels() []CATunnels {
+	return caTunnels(c.f.hostMap, c.f.pki.GetCAPool())
+}
+
+// RehandshakeResult is the outcome of Control.Rehandshake
+type RehandshakeResult struct {
+	VpnIp       netip.Addr `json:"vpnIp"`
+	Established bool       `json:"established"`
+	// Path is direct or relay when established
+	Path     string         `json:"path,omitempty"`
+	Remote   netip.AddrPort `json:"remote,omitempty"`
+	Relays   []netip.Addr   `json:"relays,omitempty"`
+	Duration time.Duration  `json:"duration"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// Rehandshake starts a fresh handshake with vpnIp, for when the peer is known to have changed networks. The existing
+// tunnel, if any, keeps carrying traffic until the new one replaces it. Blocks until the handshake completes, fails, or
+// ctx is done.
+func (c *Control) Rehandshake(ctx context.Context, vpnIp netip.Addr) RehandshakeResult {
+	return c.f.rehandshake(ctx, vpnIp)
+}
+
+func (f *Interface) rehandshake(ctx context.Context, vpnIp netip.Addr) RehandshakeResult {
+	f.l.WithField("vpnIp", vpnIp).WithField("reason", "requested").Info("Re-handshaking with remote")
+
+	start := time.Now()
+	hostinfo, err := f.handshakeManager.Rehandshake(ctx, vpnIp)
+	res := RehandshakeResult{VpnIp: vpnIp, Duration: time.Since(start)}
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	res.Established = true
+	if hostinfo.remote.IsValid() {
+		res.Path = "direct"
+		res.Remote = hostinfo.remote
+	} else {
+		res.Path = "relay"
+		res.Relays = hostinfo.relayState.CopyRelayIps()
+	}
+	return res
+}
+
+// IsReachable reports whether there is an established tunnel with vpnIp, with its path and rtt if known. If there is
+// none and timeout is more than 0 a handshake is started and IsReachable waits up to timeout for it to complete.
+func (c *Control) IsReachable(vpnIp netip.Addr, timeout time.Duration) Reachability {
+	return c.f.IsReachable(vpnIp, timeout)
+}
+
+// GetRelayUtilization returns what has been sent through each relay to a destination with relay.load_share configured,
+// nil if there is no tunnel or the destination is not load shared
+func (c *Control) GetRelayUtilization(vpnIp netip.Addr) []RelayUtilization {
+	hostinfo := c.f.hostMap.QueryVpnIp(vpnIp)
+	if hostinfo == nil {
+		return nil
+	}
+	return c.f.relayLoadShare.GetRelayUtilization(c.f.hostMap, hostinfo)
+}
+
+// GetRekeyClasses returns the state of each rekey class on the tunnel with vpnIp, nil if there is no tunnel or no
+// classes are configured
+func (c *Control) GetRekeyClasses(vpnIp netip.Addr) []RekeyClassStatus {
+	hostinfo := c.f.hostMap.QueryVpnIp(vpnIp)
+	if hostinfo == nil {
+		return nil
+	}
+	return c.f.rekey.GetClasses(hostinfo)
+}
+
+// GetPathPolicy returns the path selection classes in the order they are matched, nil if none are configured
+func (c *Control) GetPathPolicy() []PathClassPolicy {
+	return c.f.pathSelection.GetPolicy()
+}
+
+// GetPathSelection returns the path the packets of each path selection class take to the tunnel with vpnIp, nil if
+// there is no tunnel or no classes are configured
+func (c *Control) GetPathSelection(vpnIp netip.Addr) []PathSelectionStatus {
+	hostinfo := c.f.hostMap.QueryVpnIp(vpnIp)
+	if hostinfo == nil {
+		return nil
+	}
+	return c.f.pathSelection.GetPaths(c.f, hostinfo)
+}
+
+// DrainRelay stops this relay from accepting new forwards and asks every peer we forward for to move to another relay.
+// Forwards that were not migrated are removed once grace is over, or after DefaultRelayDrainGrace if grace is 0.
+func (c *Control) DrainRelay(grace time.Duration) (RelayDrainStatus, error) {
+	return c.f.relayManager.startDrain(c.f, grace)
+}
+
+// ExportTunnelKeys returns the session keys of the tunnel with vpnIp so its captured traffic can be decrypted. It
+// always fails unless the binary was built with the nebula_key_export tag and key_export.dangerous is set.
+func (c *Control) ExportTunnelKeys(vpnIp netip.Addr) (*TunnelKeys, error) {
+	return c.f.exportTunnelKeys(vpnIp)
+}
+
+// GetFirewallRuleset returns the rules of the installed firewall as it enforces them, see FirewallRuleset
+func (c *Control) GetFirewallRuleset() FirewallRuleset {
+	return c.f.firewall.Ruleset()
+}
+
+// TestFirewall returns whether the installed firewall would allow fp exchanged with a peer holding the certificate
+// described by peer and the rule responsible, see Interface.TestFirewall. Nothing is sent and no state is changed.
+func (c *Control) TestFirewall(fp firewall.Packet, incoming bool, viaRelay bool, peer FirewallTestPeer) (FirewallVerdict, error) {
+	return c.f.TestFirewall(fp, incoming, viaRelay, peer)
+}
+
+// GetObserverStatus returns whether this node is an observer and which of its targets have a tunnel, see observer
+func (c *Control) GetObserverStatus() ObserverStatus {
+	return c.f.observer.Status(c.f.hostMap)
+}
+
+// GetTunRecoveryStatus returns whether the tun device is failing writes, see TunRecovery
+func (c *Control) GetTunRecoveryStatus() TunRecoveryStatus {
+	return c.f.tunRecovery.Status()
+}
+
+// EnableTunnelMetrics exports metrics labeled by vpn ip for vpnIps for d, see TunnelMetrics
+func (c *Control) EnableTunnelMetrics(vpnIps []netip.Addr, d time.Duration) error {
+	return c.f.tunnelMetrics.Enable(vpnIps, d, time.Now())
+}
+
+// DisableTunnelMetrics stops exporting metrics for vpnIps, or for every peer if vpnIps is empty
+func (c *Control) DisableTunnelMetrics(vpnIps []netip.Addr) {
+	c.f.tunnelMetrics.Disable(vpnIps)
+}
+
+// GetTunnelMetrics returns the metrics of every watched peer
+func (c *Control) GetTunnelMetrics() []TunnelMetricsStatus {
+	return c.f.tunnelMetrics.Status()
+}
+
+// GetRates returns the per second rates of traffic, handshakes and drops over rates.window, see Rates
+func (c *Control) GetRates() RatesStatus {
+	return c.f.rates.Status()
+}
+
+// GetRelayTopology returns every relay in the hostmap as a graph of who relays through whom
+func (c *Control) GetRelayTopology() RelayTopology {
+	return relayTopology(c.f.hostMap, c.f.myVpnNet.Addr())
+}
+
+// GetRelayDrainStatus returns the progress of draining this relay
+func (c *Control) GetRelayDrainStatus() RelayDrainStatus {
+	return c.f.relayManager.DrainStatus()
+}
+
+// WatchDrops streams firewall drops as they happen, at most rate per second or the default of 100 if rate is 0.
+// Events are discarded rather than slowing down the packet path, DropEvent.Missed counts what was skipped. The
+// returned function must be called to stop watching, it closes the channel.
+func (c *Control) WatchDrops(rate int) (<-chan DropEvent, func(), error) {
+	return c.f.dropWatch.watch(rate)
+}
+
 // PrintTunnel creates a new tunnel to the given vpn ip.
 func (c *Control) PrintTunnel(vpnIp netip.Addr) *ControlHostInfo {
 	hi := c.f.hostMap.QueryVpnIp(vpnIp)
 	if hi == nil {
 		return nil
 	}
-	chi := copyHostInfo(hi, c.f.hostMap.GetPreferredRanges())
+	chi := copyHostInfo(hi, c.f.hostMap.PreferredRangesFor(hi))
 	return &chi
 }
 
@@ -165,6 +420,12 @@ func (c *Control) QueryLighthouse(vpnIp netip.Addr) *CacheMap {
 	return hi.CopyCache()
 }
 
+// GetRemoteCandidates returns the learned and reported remotes for vpnIp and how long ago each was last set, see
+// lighthouse.remote_ttl. Unlike QueryLighthouse it does not send a query to the lighthouses.
+func (c *Control) GetRemoteCandidates(vpnIp netip.Addr) []RemoteCandidate {
+	return c.f.lightHouse.RemoteCandidates(vpnIp)
+}
+
 // GetHostInfoByVpnIp returns a single tunnels hostInfo, or nil if not found
 // Caller should take care to Unmap() any 4in6 addresses prior to calling.
 func (c *Control) GetHostInfoByVpnIp(vpnIp netip.Addr, pending bool) *ControlHostInfo {
@@ -180,7 +441,7 @@ func (c *Control) GetHostInfoByVpnIp(vpnIp netip.Addr, pending bool) *ControlHos
 		return nil
 	}
 
-	ch := copyHostInfo(h, c.f.hostMap.GetPreferredRanges())
+	ch := copyHostInfo(h, c.f.hostMap.PreferredRangesFor(h))
 	return &ch
 }
 
@@ -193,10 +454,20 @@ func (c *Control) SetRemoteForTunnel(vpnIp netip.Addr, addr netip.AddrPort) *Con
 	}
 
 	hostInfo.SetRemote(addr)
-	ch := copyHostInfo(hostInfo, c.f.hostMap.GetPreferredRanges())
+	ch := copyHostInfo(hostInfo, c.f.hostMap.PreferredRangesFor(hostInfo))
 	return &ch
 }
 
+// PauseTunnel drops the data to and from vpnIp without closing the tunnel until ResumeTunnel, see TunnelPause
+func (c *Control) PauseTunnel(vpnIp netip.Addr) error {
+	return c.f.tunnelPause.Pause(vpnIp)
+}
+
+// ResumeTunnel lets the data of a tunnel stopped with PauseTunnel flow again
+func (c *Control) ResumeTunnel(vpnIp netip.Addr) error {
+	return c.f.tunnelPause.Resume(vpnIp)
+}
+
 // CloseTunnel closes a fully established tunnel. If localOnly is false it will notify the remote end as well.
 // Caller should take care to Unmap() any 4in6 addresses prior to calling.
 func (c *Control) CloseTunnel(vpnIp netip.Addr, localOnly bool) bool {
@@ -283,10 +554,31 @@ func copyHostInfo(h *HostInfo, preferredRanges []netip.Prefix) ControlHostInfo {
 		CurrentRelaysToMe:      h.relayState.CopyRelayIps(),
 		CurrentRelaysThroughMe: h.relayState.CopyRelayForIps(),
 		CurrentRemote:          h.remote,
+		IdleSeconds:            int64(h.IdleTime(time.Now()) / time.Second),
+		KeyAgeSeconds:          int64(h.keyAge(time.Now()) / time.Second),
+		RemoteLatencies:        h.latency.copy(),
+		Errors:                 h.errCounters.copy(),
+		RoamingDisabled:        h.roamPinned.Load(),
+		CAFingerprint:          h.caFingerprint,
+		SendBackoff:            h.sendBackoff.status(),
+		Quality:                h.quality.status(),
+		RelayReason:            h.relayReason,
+		Keepalive:              keepaliveType(h.keepalive.Load()).String(),
+		Transport:              h.transportName(),
+		MTU:                    int(h.mtu.effective.Load()),
+		Paused:                 h.paused.Load(),
+	}
+
+	if src := h.source(h.remote); src.IsValid() && h.remote.IsValid() {
+		chi.Source = &src
 	}
 
 	if h.ConnectionState != nil {
 		chi.MessageCounter = h.ConnectionState.messageCounter.Load()
+		chi.AuthOnly = h.ConnectionState.authOnly
+		if uc := h.ConnectionState.peerUserCert; uc != nil {
+			chi.UserCert = uc.Copy()
+		}
 	}
 
 	if c := h.GetCert(); c != nil {
@@ -298,18 +590,16 @@ func copyHostInfo(h *HostInfo, preferredRanges []netip.Prefix) ControlHostInfo {
 
 func listHostMapHosts(hl controlHostLister) []ControlHostInfo {
 	hosts := make([]ControlHostInfo, 0)
-	pr := hl.GetPreferredRanges()
 	hl.ForEachVpnIp(func(hostinfo *HostInfo) {
-		hosts = append(hosts, copyHostInfo(hostinfo, pr))
+		hosts = append(hosts, copyHostInfo(hostinfo, hl.PreferredRangesFor(hostinfo)))
 	})
 	return hosts
 }
 
 func listHostMapIndexes(hl controlHostLister) []ControlHostInfo {
 	hosts := make([]ControlHostInfo, 0)
-	pr := hl.GetPreferredRanges()
 	hl.ForEachIndex(func(hostinfo *HostInfo) {
-		hosts = append(hosts, copyHostInfo(hostinfo, pr))
+		hosts = append(hosts, copyHostInfo(hostinfo, hl.PreferredRangesFor(hostinfo)))
 	})
 	return hosts
 }
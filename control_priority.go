@@ -0,0 +1,71 @@
+package nebula
+
+import (
+	"net/netip"
+
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+)
+
+// controlQueueLen is the number of control plane packets that can be waiting for the control routine before
+// readers fall back to processing them inline
+const controlQueueLen = 1024
+
+// controlPacket is an inbound control plane datagram waiting for the control routine
+type controlPacket struct {
+	addr   netip.AddrPort
+	packet []byte
+	ecn    uint8
+	q      int
+}
+
+// isControlPlane peeks at the message type of a raw datagram, returning true for handshakes, lighthouse, test, and
+// relay control messages
+func isControlPlane(packet []byte) bool {
+	if len(packet) < header.Len {
+		return false
+	}
+
+	switch header.MessageType(packet[0] & 0x0f) {
+	case header.Handshake, header.LightHouse, header.Test, header.Control:
+		return true
+	default:
+		return false
+	}
+}
+
+// queueControlPacket hands a control plane packet off to the control routine so it is not stuck behind a batch of
+// data packets in readOutsidePackets. Returns false if the packet must be processed inline, either because
+// listen.control_priority is off or the queue is full.
+func (f *Interface) queueControlPacket(addr netip.AddrPort, packet []byte, ecn uint8, q int) bool {
+	if !f.controlPriority.Load() || !isControlPlane(packet) {
+		return false
+	}
+
+	select {
+	case f.controlQueue <- controlPacket{addr: addr, packet: append([]byte(nil), packet...), ecn: ecn, q: q}:
+		return true
+	default:
+		f.metricControlQueueFull.Inc(1)
+		return false
+	}
+}
+
+// listenControl processes control plane packets queued by the udp readers. Responses are sent on the socket of the
+// routine that received the packet. It returns once the interface is closed.
+func (f *Interface) listenControl() {
+	lhf := lhHandleRequest(f.lightHouse.NewRequestHandler(), f)
+	h := &header.H{}
+	fwPacket := &firewall.Packet{}
+	out := make([]byte, mtu)
+	nb := make([]byte, 12, 12)
+
+	for {
+		select {
+		case <-f.controlDone:
+			return
+		case cp := <-f.controlQueue:
+			f.readOutsidePackets(cp.addr, nil, out[:0], cp.packet, cp.ecn, h, fwPacket, lhf, nb, cp.q, nil)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_isControlPlane(t *testing.T) {
+	for mt, want := range map[header.MessageType]bool{
+		header.Handshake:   true,
+		header.LightHouse:  true,
+		header.Test:        true,
+		header.Control:     true,
+		header.Message:     false,
+		header.RecvError:   false,
+		header.CloseTunnel: false,
+	} {
+		b := header.Encode(make([]byte, header.Len), header.Version, mt, 0, 1, 1)
+		assert.Equal(t, want, isControlPlane(b), "type %v", mt)
+	}
+
+	// Hole punches and other short packets are never queued
+	assert.False(t, isControlPlane([]byte{1}))
+}
+
+func Test_queueControlPacket(t *testing.T) {
+	f := &Interface{
+		controlQueue:           make(chan controlPacket, 1),
+		metricControlQueueFull: metrics.NewCounter(),
+	}
+
+	addr := netip.MustParseAddrPort("10.0.0.1:4242")
+	hs := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeIXPSK0, 0, 1)
+	data := header.Encode(make([]byte, header.Len), header.Version, header.Message, 0, 1, 1)
+
+	// Disabled by default
+	assert.False(t, f.queueControlPacket(addr, hs, 0, 0))
+	assert.Empty(t, f.controlQueue)
+
+	f.controlPriority.Store(true)
+	assert.False(t, f.queueControlPacket(addr, data, 0, 0), "data must be processed inline")
+	assert.True(t, f.queueControlPacket(addr, hs, ecnECT0, 2))
+
+	// A full queue falls back to inline processing
+	assert.False(t, f.queueControlPacket(addr, hs, 0, 0))
+	assert.Equal(t, int64(1), f.metricControlQueueFull.Count())
+
+	cp := <-f.controlQueue
+	assert.Equal(t, addr, cp.addr)
+	assert.Equal(t, ecnECT0, cp.ecn)
+	assert.Equal(t, 2, cp.q)
+	assert.Equal(t, hs, cp.packet)
+
+	// The queued packet must not alias the reader's buffer, it is reused for the next read
+	hs[0] = 0
+	assert.NotEqual(t, hs[0], cp.packet[0])
+}
+
+func TestInterface_listenControl_close(t *testing.T) {
+	f := &Interface{
+		inside:       &test.NoopTun{},
+		lightHouse:   &LightHouse{},
+		controlQueue: make(chan controlPacket, 1),
+		controlDone:  make(chan struct{}),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f.listenControl()
+		close(done)
+	}()
+
+	require.NoError(t, f.Close())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the control routine did not return after Close")
+	}
+}
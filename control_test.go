@@ -91,6 +91,9 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 		},
 	}, &Interface{})
 
+	hm.Hosts[vpnIp].errCounters.decryptFailures.Add(2)
+	hm.Hosts[vpnIp].errCounters.firewallDrops.Add(1)
+
 	c := Control{
 		f: &Interface{
 			hostMap: hm,
@@ -110,10 +113,13 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 		CurrentRemote:          remote1,
 		CurrentRelaysToMe:      []netip.Addr{},
 		CurrentRelaysThroughMe: []netip.Addr{},
+		IdleSeconds:            0,
+		Errors:                 TunnelErrors{DecryptFailures: 2, FirewallDrops: 1},
+		Transport:              "udp",
 	}
 
 	// Make sure we don't have any unexpected fields
-	assertFields(t, []string{"VpnIp", "LocalIndex", "RemoteIndex", "RemoteAddrs", "Cert", "MessageCounter", "CurrentRemote", "CurrentRelaysToMe", "CurrentRelaysThroughMe"}, thi)
+	assertFields(t, []string{"VpnIp", "LocalIndex", "RemoteIndex", "RemoteAddrs", "Cert", "UserCert", "MessageCounter", "CurrentRemote", "CurrentRelaysToMe", "CurrentRelaysThroughMe", "IdleSeconds", "KeyAgeSeconds", "RemoteLatencies", "AuthOnly", "Errors", "RoamingDisabled", "CAFingerprint", "SendBackoff", "Quality", "RelayReason", "Keepalive", "Source", "Transport", "MTU", "Paused"}, thi)
 	assert.EqualValues(t, &expectedInfo, thi)
 	//TODO: netip.Addr reuses global memory for zone identifiers which breaks our "no reused memory check" here
 	//test.AssertDeepCopyEqual(t, &expectedInfo, thi)
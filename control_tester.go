@@ -20,7 +20,7 @@ import (
 func (c *Control) WaitForType(msgType header.MessageType, subType header.MessageSubType, pipeTo *Control) {
 	h := &header.H{}
 	for {
-		p := c.f.outside.(*udp.TesterConn).Get(true)
+		p := underlay(c.f.outside).(*udp.TesterConn).Get(true)
 		if err := h.Parse(p.Data); err != nil {
 			panic(err)
 		}
@@ -36,7 +36,7 @@ func (c *Control) WaitForType(msgType header.MessageType, subType header.Message
 func (c *Control) WaitForTypeByIndex(toIndex uint32, msgType header.MessageType, subType header.MessageSubType, pipeTo *Control) {
 	h := &header.H{}
 	for {
-		p := c.f.outside.(*udp.TesterConn).Get(true)
+		p := underlay(c.f.outside).(*udp.TesterConn).Get(true)
 		if err := h.Parse(p.Data); err != nil {
 			panic(err)
 		}
@@ -82,11 +82,11 @@ func (c *Control) GetFromTun(block bool) []byte {
 
 // GetFromUDP will pull a udp packet off the udp side of nebula
 func (c *Control) GetFromUDP(block bool) *udp.Packet {
-	return c.f.outside.(*udp.TesterConn).Get(block)
+	return underlay(c.f.outside).(*udp.TesterConn).Get(block)
 }
 
 func (c *Control) GetUDPTxChan() <-chan *udp.Packet {
-	return c.f.outside.(*udp.TesterConn).TxPackets
+	return underlay(c.f.outside).(*udp.TesterConn).TxPackets
 }
 
 func (c *Control) GetTunTxChan() <-chan []byte {
@@ -95,7 +95,7 @@ func (c *Control) GetTunTxChan() <-chan []byte {
 
 // InjectUDPPacket will inject a packet into the udp side of nebula
 func (c *Control) InjectUDPPacket(p *udp.Packet) {
-	c.f.outside.(*udp.TesterConn).Send(p)
+	underlay(c.f.outside).(*udp.TesterConn).Send(p)
 }
 
 // InjectTunUDPPacket puts a udp packet on the tun interface. Using UDP here because it's a simpler protocol
@@ -131,12 +131,17 @@ func (c *Control) InjectTunUDPPacket(toIp netip.Addr, toPort uint16, fromPort ui
 	c.f.inside.(*overlay.TestTun).Send(buffer.Bytes())
 }
 
+// InjectTunPacket puts a raw ip packet on the tun interface, the source is not checked
+func (c *Control) InjectTunPacket(p []byte) {
+	c.f.inside.(*overlay.TestTun).Send(p)
+}
+
 func (c *Control) GetVpnIp() netip.Addr {
 	return c.f.myVpnNet.Addr()
 }
 
 func (c *Control) GetUDPAddr() netip.AddrPort {
-	return c.f.outside.(*udp.TesterConn).Addr
+	return underlay(c.f.outside).(*udp.TesterConn).Addr
 }
 
 func (c *Control) KillPendingTunnel(vpnIp netip.Addr) bool {
@@ -160,3 +165,24 @@ func (c *Control) GetCert() *cert.NebulaCertificate {
 func (c *Control) ReHandshake(vpnIp netip.Addr) {
 	c.f.handshakeManager.StartHandshake(vpnIp, nil)
 }
+
+// ForgetRelayFor drops the relay state relayVpnIp holds for peerVpnIp while leaving the hostmap relay index in place,
+// this is the state seen when a relay packet arrives with a "HostInfo missing remote relay index"
+func (c *Control) ForgetRelayFor(relayVpnIp, peerVpnIp netip.Addr) bool {
+	hostinfo := c.f.hostMap.QueryVpnIp(relayVpnIp)
+	if hostinfo == nil {
+		return false
+	}
+
+	rs := &hostinfo.relayState
+	rs.Lock()
+	defer rs.Unlock()
+	r, ok := rs.relayForByIp[peerVpnIp]
+	if !ok {
+		return false
+	}
+
+	delete(rs.relayForByIp, peerVpnIp)
+	delete(rs.relayForByIdx, r.LocalIndex)
+	return true
+}
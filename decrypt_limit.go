@@ -0,0 +1,46 @@
+package nebula
+
+import (
+	"sync/atomic"
+)
+
+// decryptLimit bounds how many data packets the udp readers decrypt at the same time, see
+// listen.max_decrypt_concurrency. A flood of valid looking data packets can otherwise keep every reader busy in
+// DecryptDanger, shedding the excess keeps readers cheap so handshakes and other control plane packets still get
+// through. Control plane packets are never limited.
+type decryptLimit struct {
+	// max is the number of concurrent decrypts allowed, 0 disables the limit
+	max      atomic.Int64
+	inflight atomic.Int64
+}
+
+// acquire reserves a decrypt slot, returning false if the packet should be shed. held is true if a slot was taken and
+// must be given back with release, when the limit is off nothing is counted.
+func (d *decryptLimit) acquire() (held bool, ok bool) {
+	max := d.max.Load()
+	if max <= 0 {
+		return false, true
+	}
+
+	if d.inflight.Add(1) > max {
+		d.inflight.Add(-1)
+		return false, false
+	}
+	return true, true
+}
+
+// release gives back a slot taken by acquire
+func (d *decryptLimit) release(held bool) {
+	if held {
+		d.inflight.Add(-1)
+	}
+}
+
+// shedDecrypt reserves a decrypt slot for a data packet, returning false and counting the drop if every slot is taken
+func (f *Interface) shedDecrypt() (held bool, ok bool) {
+	held, ok = f.decryptLimit.acquire()
+	if !ok {
+		f.metricDecryptShed.Inc(1)
+	}
+	return held, ok
+}
@@ -0,0 +1,41 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecryptLimit(t *testing.T) {
+	f := &Interface{metricDecryptShed: metrics.NewCounter()}
+
+	t.Log("Nothing is counted while the limit is off")
+	held, ok := f.shedDecrypt()
+	assert.True(t, ok)
+	assert.False(t, held)
+	assert.Equal(t, int64(0), f.decryptLimit.inflight.Load())
+
+	f.decryptLimit.max.Store(2)
+	held1, ok := f.shedDecrypt()
+	assert.True(t, ok)
+	assert.True(t, held1)
+	held2, ok := f.shedDecrypt()
+	assert.True(t, ok)
+
+	t.Log("Past the limit packets are shed")
+	_, ok = f.shedDecrypt()
+	assert.False(t, ok)
+	assert.Equal(t, int64(1), f.metricDecryptShed.Count())
+	assert.Equal(t, int64(2), f.decryptLimit.inflight.Load())
+
+	f.decryptLimit.release(held1)
+	_, ok = f.shedDecrypt()
+	assert.True(t, ok)
+
+	t.Log("Turning the limit off while slots are held does not unbalance the count")
+	f.decryptLimit.max.Store(0)
+	f.decryptLimit.release(held2)
+	f.decryptLimit.release(held)
+	assert.Equal(t, int64(1), f.decryptLimit.inflight.Load())
+}
@@ -0,0 +1,128 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+// doubleEncryptedLogInterval limits how often double encrypted packets are logged, a loop repeats them for every packet
+const doubleEncryptedLogInterval = 10 * time.Second
+
+// DoubleEncrypted reports nebula packets that arrive on the underlay from an address inside our vpn network. Such a
+// packet was already carried through the overlay by the host that sent it, usually because that host routes our
+// underlay address into its tun, or it is spoofed. Either way it is dropped, what this controls is how loudly. Every
+// one is counted in network.packets.double_encrypted and they are logged at listen.double_encrypted.log_level at most
+// every 10 seconds.
+type DoubleEncrypted struct {
+	level       atomic.Uint32
+	diagnostics atomic.Bool
+
+	// logged holds when the last log line was written in unix nanoseconds, suppressed the packets refused since
+	logged     atomic.Int64
+	suppressed atomic.Uint64
+
+	metric metrics.Counter
+	l      *logrus.Logger
+}
+
+func NewDoubleEncryptedFromConfig(l *logrus.Logger, c *config.C) (*DoubleEncrypted, error) {
+	de := &DoubleEncrypted{
+		metric: metrics.GetOrRegisterCounter("network.packets.double_encrypted", nil),
+		l:      l,
+	}
+
+	if err := de.reload(c, true); err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := de.reload(c, false); err != nil {
+			l.WithError(err).Error("Failed to reload listen.double_encrypted, keeping the previous config")
+		}
+	})
+
+	return de, nil
+}
+
+func (de *DoubleEncrypted) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("listen.double_encrypted") {
+		return nil
+	}
+
+	name := c.GetString("listen.double_encrypted.log_level", "warning")
+	level, err := logrus.ParseLevel(name)
+	if err != nil || level < logrus.ErrorLevel || level > logrus.DebugLevel {
+		return fmt.Errorf("listen.double_encrypted.log_level must be debug, info, warning or error, got %q", name)
+	}
+
+	de.level.Store(uint32(level))
+	de.diagnostics.Store(c.GetBool("listen.double_encrypted.diagnostics", false))
+
+	if !initial {
+		de.l.WithField("logLevel", level).
+			WithField("diagnostics", de.diagnostics.Load()).
+			Info("listen.double_encrypted has changed")
+	}
+	return nil
+}
+
+// refuse counts and logs a packet from addr, an address inside our vpn network. The packet is always dropped. It is
+// safe to call on a nil DoubleEncrypted.
+func (de *DoubleEncrypted) refuse(f *Interface, addr netip.AddrPort, h *header.H) {
+	if de == nil {
+		return
+	}
+
+	de.metric.Inc(1)
+	level := logrus.Level(de.level.Load())
+	if !f.l.IsLevelEnabled(level) {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	last := de.logged.Load()
+	if now-last < int64(doubleEncryptedLogInterval) || !de.logged.CompareAndSwap(last, now) {
+		de.suppressed.Add(1)
+		return
+	}
+
+	e := f.l.WithField("udpAddr", addr).
+		WithField("header", h).
+		WithField("suppressed", de.suppressed.Swap(0))
+	if de.diagnostics.Load() {
+		e = e.WithField("diagnostics", de.diagnose(f, addr.Addr().Unmap(), h))
+	}
+	e.Log(level, "Refusing to process double encrypted packet, its underlay source is inside the vpn network")
+}
+
+// diagnose explains where a double encrypted packet came from. The sender is the host with the outer source as its vpn
+// ip, the tunnel the packet was meant for is found by its index.
+func (de *DoubleEncrypted) diagnose(f *Interface, sender netip.Addr, h *header.H) m {
+	d := m{"sender": sender}
+
+	if hostinfo := f.hostMap.QueryVpnIp(sender); hostinfo != nil {
+		d["senderTunnel"] = true
+		d["senderRemote"] = hostinfo.remote
+	} else {
+		d["senderTunnel"] = false
+	}
+
+	if hostinfo := f.hostMap.QueryIndex(h.RemoteIndex); hostinfo != nil {
+		d["tunnel"] = hostinfo.vpnIp
+		d["tunnelRemote"] = hostinfo.remote
+		if hostinfo.vpnIp == sender {
+			d["cause"] = "the sender routes our underlay address through its tunnel with us, check its unsafe_routes and routes to our underlay address"
+			return d
+		}
+	}
+
+	d["cause"] = "a host in the vpn network sent a nebula packet over the overlay, check the unsafe_routes and routes of the sender and of the tunnel's peer"
+	return d
+}
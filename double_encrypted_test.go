@@ -0,0 +1,83 @@
+package nebula
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterface_doubleEncrypted(t *testing.T) {
+	l := test.NewLogger()
+	l.SetLevel(logrus.InfoLevel)
+	out := &bytes.Buffer{}
+	l.SetOutput(out)
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("listen:\n  double_encrypted:\n    diagnostics: true\n"))
+	de, err := NewDoubleEncryptedFromConfig(l, c)
+	require.NoError(t, err)
+	de.metric = metrics.NewCounter()
+
+	vpnNet := netip.MustParsePrefix("172.1.1.1/24")
+	f := &Interface{
+		hostMap:         newHostMap(l, vpnNet),
+		myVpnNet:        vpnNet,
+		doubleEncrypted: de,
+		l:               l,
+	}
+	sender := netip.MustParseAddr("172.1.1.2")
+	f.hostMap.unlockedAddHostInfo(&HostInfo{vpnIp: sender, localIndexId: 7, remote: netip.MustParseAddrPort("1.2.3.4:4242")}, f)
+
+	read := func(from string) {
+		packet := header.Encode(make([]byte, header.Len), header.Version, header.Message, header.MessageNone, 7, 1)
+		f.readOutsidePackets(netip.MustParseAddrPort(from), nil, nil, packet, 0, &header.H{}, &firewall.Packet{}, nil, nil, 0, nil)
+	}
+
+	t.Log("A packet from inside the vpn network is counted and logged with diagnostics")
+	read("172.1.1.2:4242")
+	assert.Equal(t, int64(1), de.metric.Count())
+	assert.Contains(t, out.String(), "level=warning")
+	assert.Contains(t, out.String(), "Refusing to process double encrypted packet")
+	assert.Contains(t, out.String(), "the sender routes our underlay address through its tunnel with us")
+
+	t.Log("Further packets are counted but the log is rate limited")
+	out.Reset()
+	read("[::ffff:172.1.1.2]:4242")
+	assert.Equal(t, int64(2), de.metric.Count())
+	assert.Empty(t, out.String())
+	assert.Equal(t, uint64(1), de.suppressed.Load())
+
+	t.Log("A level below the logger's is counted but not logged")
+	require.NoError(t, c.ReloadConfigString("listen:\n  double_encrypted:\n    log_level: debug\n"))
+	out.Reset()
+	de.logged.Store(0)
+	read("172.1.1.2:4242")
+	assert.Equal(t, int64(3), de.metric.Count())
+	assert.Empty(t, out.String())
+
+	require.NoError(t, c.ReloadConfigString("listen:\n  double_encrypted:\n    log_level: error\n"))
+	out.Reset()
+	read("172.1.1.2:4242")
+	assert.Contains(t, out.String(), "level=error")
+	assert.NotContains(t, out.String(), "diagnostics")
+}
+
+func TestNewDoubleEncryptedFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("listen:\n  double_encrypted:\n    log_level: fatal\n"))
+	_, err := NewDoubleEncryptedFromConfig(l, c)
+	assert.EqualError(t, err, `listen.double_encrypted.log_level must be debug, info, warning or error, got "fatal"`)
+
+	var nilDE *DoubleEncrypted
+	nilDE.refuse(&Interface{l: l}, netip.MustParseAddrPort("172.1.1.2:4242"), &header.H{})
+}
@@ -0,0 +1,123 @@
+package nebula
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/slackhq/nebula/firewall"
+)
+
+const (
+	maxDropWatchers        = 8
+	dropWatcherBuffer      = 256
+	defaultDropWatcherRate = 100
+)
+
+var ErrTooManyDropWatchers = errors.New("too many drop watchers")
+
+// DropEvent describes a single packet rejected by the firewall
+type DropEvent struct {
+	Time     time.Time       `json:"time"`
+	Incoming bool            `json:"incoming"`
+	VpnIp    netip.Addr      `json:"vpnIp"`
+	Packet   firewall.Packet `json:"packet"`
+	Reason   string          `json:"reason"`
+	// Rule is the rule responsible for the drop, see Firewall.DropRule
+	Rule string `json:"rule"`
+	// Missed is the number of drops this watcher did not see since the previous event, either because of its rate limit
+	// or because it was not keeping up
+	Missed uint64 `json:"missed,omitempty"`
+}
+
+// dropWatch fans firewall drops out to live watchers. Nothing beyond an atomic load happens on the packet path unless a
+// watcher is attached.
+type dropWatch struct {
+	active atomic.Bool
+
+	sync.Mutex
+	watchers map[*dropWatcher]struct{}
+}
+
+type dropWatcher struct {
+	events      chan DropEvent
+	rate        int
+	windowStart time.Time
+	windowCount int
+	missed      uint64
+}
+
+// watch attaches a watcher that receives at most rate events per second, 0 uses the default. The returned function
+// detaches the watcher and closes the channel.
+func (d *dropWatch) watch(rate int) (<-chan DropEvent, func(), error) {
+	if rate <= 0 {
+		rate = defaultDropWatcherRate
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if len(d.watchers) >= maxDropWatchers {
+		return nil, nil, ErrTooManyDropWatchers
+	}
+
+	if d.watchers == nil {
+		d.watchers = map[*dropWatcher]struct{}{}
+	}
+
+	w := &dropWatcher{events: make(chan DropEvent, dropWatcherBuffer), rate: rate}
+	d.watchers[w] = struct{}{}
+	d.active.Store(true)
+
+	var once sync.Once
+	return w.events, func() {
+		once.Do(func() {
+			d.Lock()
+			delete(d.watchers, w)
+			d.active.Store(len(d.watchers) > 0)
+			d.Unlock()
+			close(w.events)
+		})
+	}, nil
+}
+
+// notify is called for every firewall drop, it must stay cheap when nobody is watching
+func (d *dropWatch) notify(fp firewall.Packet, incoming bool, h *HostInfo, rule string, reason error) {
+	if d.active.Load() {
+		d.publish(fp, incoming, h, rule, reason, time.Now())
+	}
+}
+
+func (d *dropWatch) publish(fp firewall.Packet, incoming bool, h *HostInfo, rule string, reason error, now time.Time) {
+	ev := DropEvent{Time: now, Incoming: incoming, VpnIp: h.vpnIp, Packet: fp, Reason: reason.Error(), Rule: rule}
+
+	d.Lock()
+	defer d.Unlock()
+	for w := range d.watchers {
+		w.offer(ev, now)
+	}
+}
+
+// offer hands the event to the watcher without ever blocking the packet path. d must be locked.
+func (w *dropWatcher) offer(ev DropEvent, now time.Time) {
+	if now.Sub(w.windowStart) >= time.Second {
+		w.windowStart = now
+		w.windowCount = 0
+	}
+
+	if w.windowCount >= w.rate {
+		w.missed++
+		return
+	}
+
+	ev.Missed = w.missed
+	select {
+	case w.events <- ev:
+		w.windowCount++
+		w.missed = 0
+	default:
+		w.missed++
+	}
+}
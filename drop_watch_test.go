@@ -0,0 +1,76 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/firewall"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDropWatch(t *testing.T) {
+	d := &dropWatch{}
+	h := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.2")}
+	fp := firewall.Packet{
+		LocalIP:    netip.MustParseAddr("10.128.0.1"),
+		RemoteIP:   h.vpnIp,
+		LocalPort:  80,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	// Nobody is watching, nothing to do
+	assert.False(t, d.active.Load())
+	d.notify(fp, true, h, FirewallRuleNoMatch, ErrNoMatchingRule)
+
+	events, stop, err := d.watch(2)
+	require.NoError(t, err)
+	assert.True(t, d.active.Load())
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		d.publish(fp, true, h, FirewallRuleNoMatch, ErrNoMatchingRule, now)
+	}
+
+	ev := <-events
+	assert.Equal(t, DropEvent{Time: now, Incoming: true, VpnIp: h.vpnIp, Packet: fp, Reason: ErrNoMatchingRule.Error(), Rule: FirewallRuleNoMatch}, ev)
+	<-events
+	assert.Empty(t, events)
+
+	// The next event tells the watcher what the rate limit cost it
+	d.publish(fp, false, h, FirewallRuleLocalIP, ErrInvalidLocalIP, now.Add(time.Second))
+	ev = <-events
+	assert.Equal(t, uint64(3), ev.Missed)
+	assert.False(t, ev.Incoming)
+
+	// A watcher that does not keep up never blocks the packet path
+	_, slowStop, err := d.watch(dropWatcherBuffer * 2)
+	require.NoError(t, err)
+	for i := 0; i < dropWatcherBuffer+10; i++ {
+		d.publish(fp, true, h, FirewallRuleNoMatch, ErrNoMatchingRule, now.Add(2*time.Second))
+	}
+	slowStop()
+	slowStop()
+
+	stop()
+	assert.Len(t, events, 2)
+	for range events {
+	}
+	assert.False(t, d.active.Load())
+
+	// Watchers are bounded
+	var stops []func()
+	for i := 0; i < maxDropWatchers; i++ {
+		_, s, err := d.watch(0)
+		require.NoError(t, err)
+		stops = append(stops, s)
+	}
+	_, _, err = d.watch(0)
+	assert.ErrorIs(t, err, ErrTooManyDropWatchers)
+	for _, s := range stops {
+		s()
+	}
+	assert.False(t, d.active.Load())
+}
@@ -0,0 +1,124 @@
+package nebula
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+const defaultDuplicateVpnIpWindow = time.Minute
+
+// DuplicateVpnIp catches two nodes presenting certificates for the same vpn ip, usually a certificate that was issued
+// twice or copied to a second machine. Traffic to such a vpn ip flaps between the nodes as each handshake replaces the
+// other's tunnel.
+//
+// A duplicate is detected when a handshake for a vpn ip carries a different public key than the tunnel we already have
+// with it, and that tunnel carried traffic within duplicate_vpn_ip.window. Re-handshakes from the same node, including
+// one with a renewed certificate for the same key, are never reported. A node that was re-keyed while we still had a
+// live tunnel with its old key is indistinguishable from a duplicate until the old tunnel goes away.
+type DuplicateVpnIp struct {
+	reject atomic.Bool
+	window atomic.Int64
+
+	metricDetected metrics.Counter
+	metricRejected metrics.Counter
+	l              *logrus.Logger
+}
+
+func NewDuplicateVpnIpFromConfig(l *logrus.Logger, c *config.C) (*DuplicateVpnIp, error) {
+	d := &DuplicateVpnIp{
+		metricDetected: metrics.GetOrRegisterCounter("duplicate_vpn_ip.detected", nil),
+		metricRejected: metrics.GetOrRegisterCounter("duplicate_vpn_ip.rejected", nil),
+		l:              l,
+	}
+
+	err := d.reload(c, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		err := d.reload(c, false)
+		if err != nil {
+			l.WithError(err).Error("Failed to reload duplicate_vpn_ip")
+		}
+	})
+
+	return d, nil
+}
+
+func (d *DuplicateVpnIp) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("duplicate_vpn_ip") {
+		return nil
+	}
+
+	var reject bool
+	switch a := c.GetString("duplicate_vpn_ip.action", "warn"); a {
+	case "warn":
+	case "reject":
+		reject = true
+	default:
+		return fmt.Errorf("duplicate_vpn_ip.action must be warn or reject, got %q", a)
+	}
+
+	window := c.GetDuration("duplicate_vpn_ip.window", defaultDuplicateVpnIpWindow)
+	if window <= 0 {
+		return fmt.Errorf("duplicate_vpn_ip.window must be positive, got %v", window)
+	}
+
+	d.reject.Store(reject)
+	d.window.Store(int64(window))
+
+	if !initial {
+		d.l.WithField("reject", reject).WithField("window", window).Info("duplicate_vpn_ip changed")
+	}
+	return nil
+}
+
+// check looks for a live tunnel with a different node for vpnIp before a handshake from remoteCert at addr completes.
+// Returns true if the handshake must be refused. A detection is also reported to events when it is not nil.
+func (d *DuplicateVpnIp) check(hm *HostMap, vpnIp netip.Addr, remoteCert *cert.NebulaCertificate, addr netip.AddrPort, stage int, now time.Time, events *securityEventLog) bool {
+	if d == nil {
+		return false
+	}
+
+	existing := hm.QueryVpnIp(vpnIp)
+	if existing == nil {
+		return false
+	}
+
+	existingCert := existing.GetCert()
+	if existingCert == nil || bytes.Equal(existingCert.Details.PublicKey, remoteCert.Details.PublicKey) {
+		return false
+	}
+
+	if now.Sub(time.Unix(0, existing.lastUsed.Load())) > time.Duration(d.window.Load()) {
+		// The old tunnel is quiet, most likely the node was re-keyed and the tunnel is about to be torn down
+		return false
+	}
+
+	d.metricDetected.Inc(1)
+	existingFp, _ := existingCert.Sha256Sum()
+	newFp, _ := remoteCert.Sha256Sum()
+	reject := d.reject.Load()
+
+	d.l.WithField("vpnIp", vpnIp).
+		WithField("existing", m{"fingerprint": existingFp, "certName": existingCert.Details.Name, "udpAddr": existing.remote, "localIndex": existing.localIndexId}).
+		WithField("new", m{"fingerprint": newFp, "certName": remoteCert.Details.Name, "udpAddr": addr}).
+		WithField("handshake", m{"stage": stage, "style": "ix_psk0"}).
+		WithField("rejected", reject).
+		Warn("Duplicate vpnIp detected, two nodes present certificates for the same vpn ip")
+	events.duplicateVpnIp(vpnIp, existing, existingCert, remoteCert, addr, reject)
+
+	if reject {
+		d.metricRejected.Inc(1)
+	}
+	return reject
+}
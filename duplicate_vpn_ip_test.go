@@ -0,0 +1,69 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplicateVpnIp_check(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	d, err := NewDuplicateVpnIpFromConfig(l, c)
+	require.NoError(t, err)
+
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	vpnIp := netip.MustParseAddr("10.128.0.2")
+	newCert := func(name string, key byte) *cert.NebulaCertificate {
+		return &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: name, PublicKey: []byte{key, 1, 2, 3}}}
+	}
+
+	real := newCert("real", 1)
+	now := time.Now()
+	remote := netip.MustParseAddrPort("1.1.1.1:4242")
+
+	// Nothing to collide with yet
+	assert.False(t, d.check(hm, vpnIp, real, remote, 1, now, nil))
+
+	existing := &HostInfo{vpnIp: vpnIp, localIndexId: 1, remote: remote, ConnectionState: &ConnectionState{peerCert: real}}
+	hm.unlockedAddHostInfo(existing, &Interface{})
+
+	detected := d.metricDetected.Count()
+
+	// The same node re-handshaking, possibly with a renewed cert for the same key
+	renewed := newCert("real", 1)
+	renewed.Details.NotAfter = now.Add(time.Hour)
+	assert.False(t, d.check(hm, vpnIp, renewed, netip.MustParseAddrPort("1.1.1.9:4242"), 1, now, nil))
+	assert.Equal(t, detected, d.metricDetected.Count())
+
+	// A second node with the same vpn ip is reported but let through by default
+	imposter := newCert("imposter", 2)
+	assert.False(t, d.check(hm, vpnIp, imposter, netip.MustParseAddrPort("2.2.2.2:4242"), 1, now, nil))
+	assert.Equal(t, detected+1, d.metricDetected.Count())
+
+	// And refused with the reject action
+	require.NoError(t, c.ReloadConfigString("duplicate_vpn_ip:\n  action: reject\n  window: 10s\n"))
+	rejected := d.metricRejected.Count()
+	assert.True(t, d.check(hm, vpnIp, imposter, netip.MustParseAddrPort("2.2.2.2:4242"), 2, now, nil))
+	assert.Equal(t, detected+2, d.metricDetected.Count())
+	assert.Equal(t, rejected+1, d.metricRejected.Count())
+
+	// A quiet tunnel is most likely a re-keyed node, not a duplicate
+	assert.False(t, d.check(hm, vpnIp, imposter, netip.MustParseAddrPort("2.2.2.2:4242"), 1, now.Add(11*time.Second), nil))
+
+	var nilDup *DuplicateVpnIp
+	assert.False(t, nilDup.check(hm, vpnIp, imposter, remote, 1, now, nil))
+
+	for _, bad := range []string{"duplicate_vpn_ip:\n  action: drop\n", "duplicate_vpn_ip:\n  window: 0s\n"} {
+		c = config.NewC(l)
+		require.NoError(t, c.LoadString(bad))
+		_, err = NewDuplicateVpnIpFromConfig(l, c)
+		assert.Error(t, err, bad)
+	}
+}
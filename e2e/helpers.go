@@ -84,9 +84,8 @@ func NewTestCert(ca *cert.NebulaCertificate, key []byte, name string, before, af
 	ipb := ip.Addr().AsSlice()
 	nc := &cert.NebulaCertificate{
 		Details: cert.NebulaCertificateDetails{
-			Name: name,
-			Ips:  []*net.IPNet{{IP: ipb[:], Mask: net.CIDRMask(ip.Bits(), ip.Addr().BitLen())}},
-			//Subnets:        subnets,
+			Name:           name,
+			Ips:            []*net.IPNet{{IP: ipb[:], Mask: net.CIDRMask(ip.Bits(), ip.Addr().BitLen())}},
 			Groups:         groups,
 			NotBefore:      time.Unix(before.Unix(), 0),
 			NotAfter:       time.Unix(after.Unix(), 0),
@@ -97,6 +96,10 @@ func NewTestCert(ca *cert.NebulaCertificate, key []byte, name string, before, af
 		},
 	}
 
+	for _, subnet := range subnets {
+		nc.Details.Subnets = append(nc.Details.Subnets, &net.IPNet{IP: subnet.Addr().AsSlice(), Mask: net.CIDRMask(subnet.Bits(), subnet.Addr().BitLen())})
+	}
+
 	err = nc.Sign(ca.Details.Curve, key)
 	if err != nil {
 		panic(err)
@@ -27,6 +27,12 @@ type m map[string]interface{}
 
 // newSimpleServer creates a nebula instance with many assumptions
 func newSimpleServer(caCrt *cert.NebulaCertificate, caKey []byte, name string, sVpnIpNet string, overrides m) (*nebula.Control, netip.Prefix, netip.AddrPort, *config.C) {
+	return newSegmentServer(nil, caCrt, caKey, name, sVpnIpNet, overrides)
+}
+
+// newSegmentServer is newSimpleServer running as a segment of sl, the udp address returned is only used by the first
+// segment on sl
+func newSegmentServer(sl *nebula.SharedListener, caCrt *cert.NebulaCertificate, caKey []byte, name string, sVpnIpNet string, overrides m) (*nebula.Control, netip.Prefix, netip.AddrPort, *config.C) {
 	l := NewTestLogger()
 
 	vpnIpNet, err := netip.ParsePrefix(sVpnIpNet)
@@ -103,7 +109,12 @@ func newSimpleServer(caCrt *cert.NebulaCertificate, caKey []byte, name string, s
 	c := config.NewC(l)
 	c.LoadString(string(cb))
 
-	control, err := nebula.Main(c, false, "e2e-test", l, nil)
+	var control *nebula.Control
+	if sl != nil {
+		control, err = sl.Main(c, false, "e2e-test", l, nil)
+	} else {
+		control, err = nebula.Main(c, false, "e2e-test", l, nil)
+	}
 
 	if err != nil {
 		panic(err)
@@ -101,6 +101,8 @@ const (
 	ExitNow ExitType = 1
 	// RouteAndExit routes this packet and exits immediately afterwards
 	RouteAndExit ExitType = 2
+	// DropPacket does not route this packet, the function will get called again on the next packet
+	DropPacket ExitType = 3
 )
 
 type ExitFunc func(packet *udp.Packet, receiver *nebula.Control) ExitType
@@ -600,6 +602,7 @@ func (r *R) RouteForUntilAfterToAddr(sender *nebula.Control, toAddr netip.AddrPo
 //   - exitNow: the packet will not be routed and this call will return immediately
 //   - routeAndExit: this call will return immediately after routing the last packet from sender
 //   - keepRouting: the packet will be routed and whatDo will be called again on the next packet from sender
+//   - dropPacket: the packet will not be routed and whatDo will be called again on the next packet from sender
 func (r *R) RouteForAllExitFunc(whatDo ExitFunc) {
 	sc := make([]reflect.SelectCase, len(r.controls))
 	cm := make([]*nebula.Control, len(r.controls))
@@ -645,6 +648,9 @@ func (r *R) RouteForAllExitFunc(whatDo ExitFunc) {
 			receiver.InjectUDPPacket(p)
 			fp.WasReceived()
 
+		case DropPacket:
+			r.unlockedInjectFlow(cm[x], receiver, p, false)
+
 		default:
 			panic(fmt.Sprintf("Unknown exitFunc return: %v", e))
 		}
@@ -723,9 +729,15 @@ func (r *R) formatUdpPacket(p *packet) string {
 		from = c.GetUDPAddr().String()
 	}
 
-	udp := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
-	if udp == nil {
-		panic("not a udp packet")
+	udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		// Not everything sent over the tunnel is udp, show the protocol for the rest
+		return fmt.Sprintf(
+			"    %s-->>%s: proto: %v\n",
+			strings.Replace(from, ":", "-", 1),
+			strings.Replace(p.to.GetUDPAddr().String(), ":", "-", 1),
+			v4.Protocol,
+		)
 	}
 
 	data := packet.ApplicationLayer()
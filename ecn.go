@@ -0,0 +1,159 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+)
+
+// ECN codepoints, the low 2 bits of the ipv4 TOS or ipv6 traffic class byte
+const (
+	ecnNotECT uint8 = 0
+	ecnECT1   uint8 = 1
+	ecnECT0   uint8 = 2
+	ecnCE     uint8 = 3
+)
+
+// ecnDecapsulate combines the ECN codepoints of the inner and outer headers of an arriving packet following
+// the normal mode of RFC 6040 section 4.2. Returns false if the packet must be dropped, which happens when the
+// outer header was marked CE but the inner transport is not ECN capable.
+func ecnDecapsulate(inner, outer uint8) (uint8, bool) {
+	switch inner {
+	case ecnNotECT:
+		if outer == ecnCE {
+			return 0, false
+		}
+		return ecnNotECT, true
+	case ecnECT0:
+		if outer == ecnECT1 || outer == ecnCE {
+			return outer, true
+		}
+		return ecnECT0, true
+	case ecnECT1:
+		if outer == ecnCE {
+			return ecnCE, true
+		}
+		return ecnECT1, true
+	default:
+		return ecnCE, true
+	}
+}
+
+// ipv4ECN returns the ECN codepoint of an ipv4 packet, anything else is reported as not ECN capable
+func ipv4ECN(p []byte) uint8 {
+	if len(p) < 20 || p[0]>>4 != 4 {
+		return ecnNotECT
+	}
+	return p[1] & 0x03
+}
+
+// setIPv4ECN rewrites the ECN codepoint of an ipv4 packet, incrementally updating the header checksum as described
+// in RFC 1624
+func setIPv4ECN(p []byte, ecn uint8) {
+	old := binary.BigEndian.Uint16(p[0:2])
+	p[1] = p[1]&^0x03 | ecn
+	updated := binary.BigEndian.Uint16(p[0:2])
+	if old == updated {
+		return
+	}
+
+	sum := uint32(^binary.BigEndian.Uint16(p[10:12])) + uint32(^old) + uint32(updated)
+	sum = (sum & 0xffff) + (sum >> 16)
+	sum = (sum & 0xffff) + (sum >> 16)
+	binary.BigEndian.PutUint16(p[10:12], ^uint16(sum))
+}
+
+// outerECN returns the ECN codepoint to place on the outer header when encapsulating p, in RFC 6040 normal mode the
+// inner codepoint is copied as is
+func (f *Interface) outerECN(t header.MessageType, p []byte) uint8 {
+	if t != header.Message || !f.ecn.Load() {
+		return ecnNotECT
+	}
+	return ipv4ECN(p)
+}
+
+// applyECN updates the inner packet with the ECN codepoint from the outer header. Returns false if the packet must
+// be dropped.
+func (f *Interface) applyECN(p []byte, outer uint8) bool {
+	if !f.ecn.Load() {
+		return true
+	}
+
+	inner := ipv4ECN(p)
+	ecn, ok := ecnDecapsulate(inner, outer)
+	if !ok {
+		return false
+	}
+
+	if ecn != inner {
+		setIPv4ECN(p, ecn)
+	}
+	return true
+}
+
+// writeTo sends b on the udp socket for queue q from the source pinned for hostinfo, setting the outer ECN codepoint
+// when supported by the socket. hostinfo may be nil.
+func (f *Interface) writeTo(q int, hostinfo *HostInfo, b []byte, addr netip.AddrPort, ecn uint8) error {
+	if f.tcpTransport != nil {
+		// Neither the ECN codepoint nor the source pin apply to tcp
+		t := transportUDP
+		if f.tcpTransport.carries(addr) {
+			t = transportTCP
+		}
+		if hostinfo != nil {
+			hostinfo.setTransport(t)
+		}
+		if t == transportTCP {
+			return f.writer(q).WriteTo(b, addr)
+		}
+	}
+
+	sent, pinErr := f.writeFrom(f.writer(q), hostinfo, b, addr, ecn)
+	if sent {
+		return pinErr
+	}
+
+	err := f.writeToECN(q, b, addr, ecn)
+	if pinErr != nil && err == nil {
+		// Only blame the pin if the kernel could send the packet from a source of its own choosing
+		f.sourcePin.unavailable(hostinfo, pinErr)
+	}
+	return err
+}
+
+// writeToDontWait is writeTo without waiting for room in the send buffer of the udp socket, a full buffer fails the write
+// with EAGAIN. Sockets that can not do that, and tcp, are written to as usual.
+func (f *Interface) writeToDontWait(q int, hostinfo *HostInfo, b []byte, addr netip.AddrPort, ecn uint8) error {
+	w, ok := underlay(f.writer(q)).(udp.DontWaitWriter)
+	if !ok || f.tcpTransport.carries(addr) {
+		return f.writeTo(q, hostinfo, b, addr, ecn)
+	}
+
+	var src netip.Addr
+	if hostinfo != nil {
+		if f.tcpTransport != nil {
+			hostinfo.setTransport(transportUDP)
+		}
+		src = hostinfo.source(addr)
+	}
+
+	err := w.WriteToDontWait(b, addr, src, ecn)
+	if errors.Is(err, udp.ErrSourceUnavailable) {
+		// Let writeTo fall back to the kernel choice and record the unavailable source
+		return f.writeTo(q, hostinfo, b, addr, ecn)
+	}
+	return err
+}
+
+// writeToECN sends b on the udp socket for queue q, setting the outer ECN codepoint when supported by the socket
+func (f *Interface) writeToECN(q int, b []byte, addr netip.AddrPort, ecn uint8) error {
+	if ecn != ecnNotECT {
+		if w, ok := underlay(f.writer(q)).(udp.ECNWriter); ok {
+			return w.WriteToECN(b, addr, ecn)
+		}
+	}
+	return f.writer(q).WriteTo(b, addr)
+}
@@ -0,0 +1,78 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/ipv4"
+)
+
+func Test_ecnDecapsulate(t *testing.T) {
+	// RFC 6040 section 4.2, rows are the inner codepoint, columns the outer: Not-ECT, ECT(1), ECT(0), CE
+	expected := map[uint8][4]uint8{
+		ecnNotECT: {ecnNotECT, ecnNotECT, ecnNotECT, 0xff},
+		ecnECT1:   {ecnECT1, ecnECT1, ecnECT1, ecnCE},
+		ecnECT0:   {ecnECT0, ecnECT1, ecnECT0, ecnCE},
+		ecnCE:     {ecnCE, ecnCE, ecnCE, ecnCE},
+	}
+
+	for inner, row := range expected {
+		for outer, want := range row {
+			got, ok := ecnDecapsulate(inner, uint8(outer))
+			if want == 0xff {
+				assert.False(t, ok, "inner %d outer %d", inner, outer)
+				continue
+			}
+			assert.True(t, ok, "inner %d outer %d", inner, outer)
+			assert.Equal(t, want, got, "inner %d outer %d", inner, outer)
+		}
+	}
+}
+
+func Test_setIPv4ECN(t *testing.T) {
+	h := ipv4.Header{
+		Version:  4,
+		Len:      ipv4.HeaderLen,
+		TOS:      0xb8 | int(ecnECT0),
+		TotalLen: ipv4.HeaderLen,
+		TTL:      64,
+		Protocol: 17,
+		Src:      net.IPv4(10, 0, 0, 1),
+		Dst:      net.IPv4(10, 0, 0, 2),
+	}
+	b, err := h.Marshal()
+	assert.NoError(t, err)
+	binary.BigEndian.PutUint16(b[10:12], ipv4Checksum(b))
+	assert.Equal(t, ecnECT0, ipv4ECN(b))
+
+	setIPv4ECN(b, ecnCE)
+	assert.Equal(t, ecnCE, ipv4ECN(b))
+	assert.Equal(t, uint8(0xb8|ecnCE), b[1], "DSCP must be preserved")
+	assert.Equal(t, uint16(0), ^ipv4ChecksumRaw(b), "checksum must remain valid")
+
+	setIPv4ECN(b, ecnNotECT)
+	assert.Equal(t, ecnNotECT, ipv4ECN(b))
+	assert.Equal(t, uint16(0), ^ipv4ChecksumRaw(b), "checksum must remain valid")
+
+	// Not ipv4
+	assert.Equal(t, ecnNotECT, ipv4ECN([]byte{0x60, 0xff}))
+}
+
+// ipv4ChecksumRaw returns the ones complement sum of the header including the checksum field
+func ipv4ChecksumRaw(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i < int(b[0]&0x0f)*4; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return uint16(sum)
+}
+
+func ipv4Checksum(b []byte) uint16 {
+	binary.BigEndian.PutUint16(b[10:12], 0)
+	return ^ipv4ChecksumRaw(b)
+}
@@ -0,0 +1,97 @@
+package nebula
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+// ExpiredCerts lists the expired certificates in use, ours and our peers', see pki.expired_grace_period
+type ExpiredCerts struct {
+	GracePeriod time.Duration `json:"gracePeriod"`
+	// Own is set when our own certificate is expired
+	Own   *ExpiredCert  `json:"own,omitempty"`
+	Peers []ExpiredCert `json:"peers"`
+}
+
+type ExpiredCert struct {
+	VpnIp       netip.Addr    `json:"vpnIp"`
+	CertName    string        `json:"certName"`
+	Fingerprint string        `json:"fingerprint"`
+	NotAfter    time.Time     `json:"notAfter"`
+	ExpiredFor  time.Duration `json:"expiredFor"`
+	// InGrace is false once the certificate expired longer than the grace period ago, it will be refused from then on
+	InGrace bool `json:"inGrace"`
+}
+
+// inExpiredGrace returns true if err from validating c at now only reports that c expired, and it did so within
+// pki.expired_grace_period. The certificate must be good in every other respect.
+func (p *PKI) inExpiredGrace(c *cert.NebulaCertificate, err error, now time.Time) bool {
+	grace := p.GetExpiredGracePeriod()
+	if grace <= 0 || c == nil || !errors.Is(err, cert.ErrExpired) {
+		return false
+	}
+
+	if now.Sub(c.Details.NotAfter) > p.GetClockSkew()+grace {
+		return false
+	}
+
+	// ErrExpired is only reported once the block list and the CA have passed, check everything else as of the expiry
+	_, err = c.VerifyWithCache(c.Details.NotAfter, p.GetCAPool())
+	return err == nil
+}
+
+// acceptExpiredCert is called when the certificate in a handshake failed validation with err, it returns true if the
+// certificate is only expired and still within pki.expired_grace_period.
+func (f *Interface) acceptExpiredCert(remoteCert *cert.NebulaCertificate, err error, addr netip.AddrPort, stage int) bool {
+	if !f.pki.inExpiredGrace(remoteCert, err, time.Now()) {
+		return false
+	}
+
+	f.pki.metricExpiredGrace.Inc(1)
+	fingerprint, _ := remoteCert.Sha256Sum()
+	f.l.WithField("udpAddr", addr).
+		WithField("certName", remoteCert.Details.Name).
+		WithField("fingerprint", fingerprint).
+		WithField("notAfter", remoteCert.Details.NotAfter).
+		WithField("handshake", m{"stage": stage, "style": "ix_psk0"}).
+		Warn("Accepting an EXPIRED certificate because of pki.expired_grace_period, renew it now")
+	return true
+}
+
+// expiredCerts finds our certificate and every peer certificate in hm that is expired at now
+func (p *PKI) expiredCerts(hm *HostMap, now time.Time) ExpiredCerts {
+	grace := p.GetExpiredGracePeriod()
+	ec := ExpiredCerts{GracePeriod: grace, Peers: []ExpiredCert{}}
+	expired := func(vpnIp netip.Addr, c *cert.NebulaCertificate) *ExpiredCert {
+		if c == nil || !c.Details.NotAfter.Before(now) {
+			return nil
+		}
+
+		fingerprint, _ := c.Sha256Sum()
+		expiredFor := now.Sub(c.Details.NotAfter)
+		return &ExpiredCert{
+			VpnIp:       vpnIp,
+			CertName:    c.Details.Name,
+			Fingerprint: fingerprint,
+			NotAfter:    c.Details.NotAfter,
+			ExpiredFor:  expiredFor,
+			InGrace:     grace > 0 && expiredFor <= p.GetClockSkew()+grace,
+		}
+	}
+
+	if own := p.GetCertState().Certificate; len(own.Details.Ips) > 0 {
+		vpnIp, _ := netip.AddrFromSlice(own.Details.Ips[0].IP)
+		ec.Own = expired(vpnIp.Unmap(), own)
+	}
+
+	hm.ForEachVpnIp(func(hostinfo *HostInfo) {
+		if e := expired(hostinfo.vpnIp, hostinfo.GetCert()); e != nil {
+			ec.Peers = append(ec.Peers, *e)
+		}
+	})
+
+	return ec
+}
@@ -0,0 +1,117 @@
+package nebula
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPKI_inExpiredGrace(t *testing.T) {
+	l := test.NewLogger()
+	ca := newTestCA(t, "ca")
+	caPool := ca.pool()
+	_, crt := newTestNodeKey(t)
+
+	p := &PKI{l: l}
+	p.caPool.Store(caPool)
+
+	now := time.Now()
+	peer := func(notAfter time.Duration) (*cert.NebulaCertificate, error) {
+		c, _, err := cert.UnmarshalNebulaCertificateFromPEM(ca.sign(crt, notAfter))
+		require.NoError(t, err)
+		_, err = c.Verify(now, caPool)
+		return c, err
+	}
+
+	justExpired, err := peer(-time.Minute)
+	require.ErrorIs(t, err, cert.ErrExpired)
+	longExpired, err := peer(-2 * time.Hour)
+	require.ErrorIs(t, err, cert.ErrExpired)
+
+	// Strict by default
+	assert.False(t, p.inExpiredGrace(justExpired, err, now))
+
+	p.expiredGrace.Store(int64(time.Hour))
+	assert.True(t, p.inExpiredGrace(justExpired, err, now), "in grace")
+	assert.False(t, p.inExpiredGrace(longExpired, err, now), "past grace")
+
+	// The grace only covers expiry
+	assert.False(t, p.inExpiredGrace(justExpired, cert.ErrSignatureMismatch, now))
+	assert.False(t, p.inExpiredGrace(nil, err, now))
+
+	forged := justExpired.Copy()
+	_, otherCAPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	require.NoError(t, forged.Sign(cert.Curve_CURVE25519, otherCAPriv))
+	_, err = forged.Verify(now, caPool)
+	require.ErrorIs(t, err, cert.ErrExpired)
+	assert.False(t, p.inExpiredGrace(forged, err, now), "a bad signature must not be accepted")
+
+	fp, _ := justExpired.Sha256Sum()
+	caPool.BlocklistFingerprint(fp)
+	_, err = justExpired.Verify(now, caPool)
+	assert.False(t, p.inExpiredGrace(justExpired, err, now), "a blocklisted cert must not be accepted")
+}
+
+func TestPKI_expiredGraceOwnCert(t *testing.T) {
+	l := test.NewLogger()
+	ca := newTestCA(t, "ca")
+	key, crt := newTestNodeKey(t)
+	keyPem := cert.MarshalX25519PrivateKey(key.private)
+
+	loadPem := func(crtPem []byte, grace, skew string) (*CertState, error) {
+		c := config.NewC(l)
+		c.Settings["pki"] = map[interface{}]interface{}{
+			"key":                  string(keyPem),
+			"cert":                 string(crtPem),
+			"expired_grace_period": grace,
+			"clock_skew":           skew,
+		}
+		return newCertStateFromConfig(c)
+	}
+	load := func(notAfter time.Duration, grace string) (*CertState, error) {
+		return loadPem(ca.sign(crt, notAfter), grace, "0s")
+	}
+
+	_, err := load(-time.Minute, "0s")
+	assert.EqualError(t, err, "nebula certificate for this host is expired")
+
+	cs, err := load(-time.Minute, "1h")
+	require.NoError(t, err, "in grace")
+
+	_, err = load(-2*time.Hour, "1h")
+	assert.EqualError(t, err, "nebula certificate for this host is expired", "past grace")
+
+	_, err = loadPem(ca.sign(crt, -90*time.Minute), "1h", "1h")
+	assert.NoError(t, err, "peers accept it for the clock skew past the grace period, so do we")
+
+	_, err = loadPem(ca.sign(crt, -90*time.Minute), "0s", "1h")
+	assert.EqualError(t, err, "nebula certificate for this host is expired", "the clock skew alone is no grace period")
+
+	future := crt.Copy()
+	future.Details.NotBefore = time.Now().Add(time.Hour)
+	futurePem, err := future.MarshalToPEM()
+	require.NoError(t, err)
+	_, err = loadPem(futurePem, "0s", "0s")
+	assert.EqualError(t, err, "nebula certificate for this host is not yet valid")
+
+	p := &PKI{l: l}
+	p.cs.Store(cs)
+	p.expiredGrace.Store(int64(time.Hour))
+
+	hm := newHostMap(l, netip.MustParsePrefix("10.1.0.1/16"))
+	ec := p.expiredCerts(hm, time.Now())
+	assert.Equal(t, time.Hour, ec.GracePeriod)
+	require.NotNil(t, ec.Own)
+	assert.Equal(t, netip.MustParseAddr("10.1.0.1"), ec.Own.VpnIp)
+	assert.True(t, ec.Own.InGrace)
+	assert.Empty(t, ec.Peers)
+}
@@ -23,6 +23,35 @@ import (
 
 type FirewallInterface interface {
 	AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip, localIp netip.Prefix, caName string, caSha string) error
+	AddRuleWithConditions(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip, localIp netip.Prefix, caName string, caSha string, conditions FirewallRuleConditions) error
+}
+
+// FirewallRuleConditions holds the rule conditions that are not AddRule parameters, the zero value adds none
+type FirewallRuleConditions struct {
+	// Via restricts an inbound rule to packets that arrived directly or through a relay
+	Via FirewallVia
+	// Attributes must all be present with the same value in the peer certificate
+	Attributes map[string]string
+}
+
+// FirewallVia restricts an inbound rule to packets that arrived directly from the peer or through a relay
+type FirewallVia uint8
+
+const (
+	FirewallViaAny FirewallVia = iota
+	FirewallViaDirect
+	FirewallViaRelay
+)
+
+func (v FirewallVia) String() string {
+	switch v {
+	case FirewallViaDirect:
+		return "direct"
+	case FirewallViaRelay:
+		return "relay"
+	default:
+		return "any"
+	}
 }
 
 type conn struct {
@@ -33,15 +62,28 @@ type conn struct {
 	// fields pack for free after the uint32 above
 	incoming     bool
 	rulesVersion uint16
+
+	// relayed records the path an inbound connection was allowed on, a packet on the other path is checked again
+	relayed bool
+
+	// rule is the index of the rule that allowed this connection in its table, see Firewall.RuleName
+	rule int
+
+	// synced is set on entries imported from the conntrack_sync peer until a packet revalidates them, they are not
+	// exported back
+	synced bool
 }
 
-// TODO: need conntrack max tracked connections handling
 type Firewall struct {
 	Conntrack *FirewallConntrack
 
 	InRules  *FirewallTable
 	OutRules *FirewallTable
 
+	// Inbound rules that only apply to packets that arrived directly from the peer or through a relay
+	InDirectRules *FirewallTable
+	InRelayRules  *FirewallTable
+
 	InSendReject  bool
 	OutSendReject bool
 
@@ -51,6 +93,9 @@ type Firewall struct {
 	UDPTimeout     time.Duration //linux: 180s max
 	DefaultTimeout time.Duration //linux: 600s
 
+	// MaxConnections is the most conntrack entries allowed, new flows are dropped once it is reached. 0 is unlimited.
+	MaxConnections int
+
 	// Used to ensure we don't emit local packets for ips we don't own
 	localIps     *bart.Table[struct{}]
 	assignedCIDR netip.Prefix
@@ -59,7 +104,19 @@ type Firewall struct {
 	rules        string
 	rulesVersion uint16
 
+	// The number of rules added to each table, a rule is identified by its index in the table
+	inRuleCount  int
+	outRuleCount int
+
+	// The rules of each direction as they were added to the tables, see Firewall.Ruleset
+	compiledIn  []FirewallCompiledRule
+	compiledOut []FirewallCompiledRule
+
 	defaultLocalCIDRAny bool
+	newFlowLimit        *newFlowLimiter
+	unsafeRouteSources  *unsafeRouteSources
+	flowLog             *flowLogger
+	rejectLog           *flowLogger
 	incomingMetrics     firewallMetrics
 	outgoingMetrics     firewallMetrics
 
@@ -70,6 +127,7 @@ type firewallMetrics struct {
 	droppedLocalIP  metrics.Counter
 	droppedRemoteIP metrics.Counter
 	droppedNoRule   metrics.Counter
+	accepted        metrics.Meter
 }
 
 type FirewallConntrack struct {
@@ -77,6 +135,9 @@ type FirewallConntrack struct {
 
 	Conns      map[firewall.Packet]*conn
 	TimerWheel *TimerWheel[firewall.Packet]
+
+	full   *conntrackFullReporter
+	deltas *conntrackDeltas
 }
 
 // FirewallTable is the entry point for a rule, the evaluation order is:
@@ -104,11 +165,12 @@ type FirewallCA struct {
 }
 
 type FirewallRule struct {
-	// Any makes Hosts, Groups, and CIDR irrelevant
-	Any    *firewallLocalCIDR
-	Hosts  map[string]*firewallLocalCIDR
-	Groups []*firewallGroups
-	CIDR   *bart.Table[*firewallLocalCIDR]
+	// Any makes Hosts, Groups, Attributes, and CIDR irrelevant
+	Any        *firewallLocalCIDR
+	Hosts      map[string]*firewallLocalCIDR
+	Groups     []*firewallGroups
+	Attributes []*firewallAttributes
+	CIDR       *bart.Table[*firewallLocalCIDR]
 }
 
 type firewallGroups struct {
@@ -116,13 +178,22 @@ type firewallGroups struct {
 	LocalCIDR *firewallLocalCIDR
 }
 
+// firewallAttributes matches certificates that carry every attribute with the same value
+type firewallAttributes struct {
+	Attributes map[string]string
+	LocalCIDR  *firewallLocalCIDR
+}
+
 // Even though ports are uint16, int32 maps are faster for lookup
 // Plus we can use `-1` for fragment rules
 type firewallPort map[int32]*FirewallCA
 
 type firewallLocalCIDR struct {
-	Any       bool
-	LocalCIDR *bart.Table[struct{}]
+	Any bool
+	// AnyRule is the first rule that set Any
+	AnyRule int
+	// LocalCIDR maps each local cidr to the first rule that allowed it
+	LocalCIDR *bart.Table[int]
 }
 
 // NewFirewall creates a new Firewall object. A TimerWheel is created for you from the provided timeouts.
@@ -172,9 +243,13 @@ func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.D
 		Conntrack: &FirewallConntrack{
 			Conns:      make(map[firewall.Packet]*conn),
 			TimerWheel: NewTimerWheel[firewall.Packet](min, max),
+			full:       newConntrackFullReporter(),
+			deltas:     &conntrackDeltas{},
 		},
 		InRules:        newFirewallTable(),
 		OutRules:       newFirewallTable(),
+		InDirectRules:  newFirewallTable(),
+		InRelayRules:   newFirewallTable(),
 		TCPTimeout:     tcpTimeout,
 		UDPTimeout:     UDPTimeout,
 		DefaultTimeout: defaultTimeout,
@@ -187,11 +262,13 @@ func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.D
 			droppedLocalIP:  metrics.GetOrRegisterCounter("firewall.incoming.dropped.local_ip", nil),
 			droppedRemoteIP: metrics.GetOrRegisterCounter("firewall.incoming.dropped.remote_ip", nil),
 			droppedNoRule:   metrics.GetOrRegisterCounter("firewall.incoming.dropped.no_rule", nil),
+			accepted:        metrics.GetOrRegisterMeter("firewall.incoming.accepted", nil),
 		},
 		outgoingMetrics: firewallMetrics{
 			droppedLocalIP:  metrics.GetOrRegisterCounter("firewall.outgoing.dropped.local_ip", nil),
 			droppedRemoteIP: metrics.GetOrRegisterCounter("firewall.outgoing.dropped.remote_ip", nil),
 			droppedNoRule:   metrics.GetOrRegisterCounter("firewall.outgoing.dropped.no_rule", nil),
+			accepted:        metrics.GetOrRegisterMeter("firewall.outgoing.accepted", nil),
 		},
 	}
 }
@@ -203,9 +280,13 @@ func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *conf
 		c.GetDuration("firewall.conntrack.udp_timeout", time.Minute*3),
 		c.GetDuration("firewall.conntrack.default_timeout", time.Minute*10),
 		nc,
-		//TODO: max_connections
 	)
 
+	fw.MaxConnections = c.GetInt("firewall.conntrack.max_connections", 0)
+	if fw.MaxConnections < 0 {
+		return nil, fmt.Errorf("firewall.conntrack.max_connections must not be negative")
+	}
+
 	//TODO: Flip to false after v1.9 release
 	fw.defaultLocalCIDRAny = c.GetBool("firewall.default_local_cidr_any", true)
 
@@ -231,7 +312,31 @@ func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *conf
 		fw.OutSendReject = false
 	}
 
-	err := AddFirewallRulesFromConfig(l, false, c, fw)
+	newFlowLimit, err := newFlowLimiterFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	fw.newFlowLimit = newFlowLimit
+
+	unsafeRouteSources, err := newUnsafeRouteSourcesFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	fw.unsafeRouteSources = unsafeRouteSources
+
+	flowLog, err := newFlowLoggerFromConfig(l, c)
+	if err != nil {
+		return nil, err
+	}
+	fw.flowLog = flowLog
+
+	rejectLog, err := newRejectLoggerFromConfig(l, c)
+	if err != nil {
+		return nil, err
+	}
+	fw.rejectLog = rejectLog
+
+	err = AddFirewallRulesFromConfig(l, false, c, fw)
 	if err != nil {
 		return nil, err
 	}
@@ -246,6 +351,12 @@ func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *conf
 
 // AddRule properly creates the in memory rule structure for a firewall table.
 func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip, localIp netip.Prefix, caName string, caSha string) error {
+	return f.AddRuleWithConditions(incoming, proto, startPort, endPort, groups, host, ip, localIp, caName, caSha, FirewallRuleConditions{})
+}
+
+// AddRuleWithConditions is AddRule for a rule that also has conditions.
+func (f *Firewall) AddRuleWithConditions(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip, localIp netip.Prefix, caName string, caSha string, conditions FirewallRuleConditions) error {
+	via, attributes := conditions.Via, conditions.Attributes
 	// Under gomobile, stringing a nil pointer with fmt causes an abort in debug mode for iOS
 	// https://github.com/golang/go/issues/14131
 	sIp := ""
@@ -262,24 +373,47 @@ func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort
 		"incoming: %v, proto: %v, startPort: %v, endPort: %v, groups: %v, host: %v, ip: %v, localIp: %v, caName: %v, caSha: %s",
 		incoming, proto, startPort, endPort, groups, host, sIp, lIp, caName, caSha,
 	)
+	// Only added when set so the hash of existing rules does not change
+	if via != FirewallViaAny {
+		ruleString += ", via: " + via.String()
+	}
+	if len(attributes) > 0 {
+		// fmt prints maps sorted by key
+		ruleString += fmt.Sprintf(", attributes: %v", attributes)
+	}
 	f.rules += ruleString + "\n"
 
 	direction := "incoming"
 	if !incoming {
 		direction = "outgoing"
 	}
-	f.l.WithField("firewallRule", m{"direction": direction, "proto": proto, "startPort": startPort, "endPort": endPort, "groups": groups, "host": host, "ip": sIp, "localIp": lIp, "caName": caName, "caSha": caSha}).
+	f.l.WithField("firewallRule", m{"direction": direction, "proto": proto, "startPort": startPort, "endPort": endPort, "groups": groups, "host": host, "ip": sIp, "localIp": lIp, "caName": caName, "caSha": caSha, "via": via.String(), "attributes": attributes}).
 		Info("Firewall rule added")
 
 	var (
 		ft *FirewallTable
 		fp firewallPort
+		id int
 	)
 
 	if incoming {
-		ft = f.InRules
+		switch via {
+		case FirewallViaDirect:
+			ft = f.InDirectRules
+		case FirewallViaRelay:
+			ft = f.InRelayRules
+		default:
+			ft = f.InRules
+		}
+		id = f.inRuleCount
+		f.inRuleCount++
 	} else {
+		if via != FirewallViaAny {
+			return fmt.Errorf("via is only supported on inbound rules")
+		}
 		ft = f.OutRules
+		id = f.outRuleCount
+		f.outRuleCount++
 	}
 
 	switch proto {
@@ -295,7 +429,20 @@ func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort
 		return fmt.Errorf("unknown protocol %v", proto)
 	}
 
-	return fp.addRule(f, startPort, endPort, groups, host, ip, localIp, caName, caSha)
+	if err := fp.addRule(f, id, startPort, endPort, groups, host, ip, localIp, caName, caSha, attributes); err != nil {
+		return err
+	}
+
+	f.compileRule(incoming, id, proto, startPort, endPort, groups, host, ip, localIp, caName, caSha, conditions)
+	return nil
+}
+
+// RuleName returns the config name of the rule with the index rule in the inbound or outbound table
+func (f *Firewall) RuleName(incoming bool, rule int) string {
+	if incoming {
+		return fmt.Sprintf("firewall.inbound.%d", rule)
+	}
+	return fmt.Sprintf("firewall.outbound.%d", rule)
 }
 
 // GetRuleHash returns a hash representation of all inbound and outbound rules
@@ -345,8 +492,24 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 			return fmt.Errorf("%s rule #%v; only one of port or code should be provided", table, i)
 		}
 
-		if r.Host == "" && len(r.Groups) == 0 && r.Group == "" && r.Cidr == "" && r.LocalCidr == "" && r.CAName == "" && r.CASha == "" {
-			return fmt.Errorf("%s rule #%v; at least one of host, group, cidr, local_cidr, ca_name, or ca_sha must be provided", table, i)
+		var via FirewallVia
+		switch r.Via {
+		case "", "any":
+			via = FirewallViaAny
+		case "direct":
+			via = FirewallViaDirect
+		case "relay":
+			via = FirewallViaRelay
+		default:
+			return fmt.Errorf("%s rule #%v; via was not understood; `%s`", table, i, r.Via)
+		}
+
+		if via != FirewallViaAny && !inbound {
+			return fmt.Errorf("%s rule #%v; via is only supported on inbound rules", table, i)
+		}
+
+		if r.Host == "" && len(r.Groups) == 0 && r.Group == "" && len(r.Attributes) == 0 && r.Cidr == "" && r.LocalCidr == "" && r.CAName == "" && r.CASha == "" {
+			return fmt.Errorf("%s rule #%v; at least one of host, group, attributes, cidr, local_cidr, ca_name, or ca_sha must be provided", table, i)
 		}
 
 		if len(r.Groups) > 0 {
@@ -406,7 +569,7 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 			}
 		}
 
-		err = fw.AddRule(inbound, proto, startPort, endPort, groups, r.Host, cidr, localCidr, r.CAName, r.CASha)
+		err = fw.AddRuleWithConditions(inbound, proto, startPort, endPort, groups, r.Host, cidr, localCidr, r.CAName, r.CASha, FirewallRuleConditions{Via: via, Attributes: r.Attributes})
 		if err != nil {
 			return fmt.Errorf("%s rule #%v; `%s`", table, i, err)
 		}
@@ -419,27 +582,87 @@ var ErrInvalidRemoteIP = errors.New("remote IP is not in remote certificate subn
 var ErrInvalidLocalIP = errors.New("local IP is not in list of handled local IPs")
 var ErrNoMatchingRule = errors.New("no matching rule in firewall table")
 
+// The rules DropRule names for a packet that was not dropped by a rule in the tables, the firewall is default deny so
+// the tables only hold allow rules
+const (
+	FirewallRuleRemoteIP     = "certificate.ips"
+	FirewallRuleLocalIP      = "local_ips"
+	FirewallRuleUnsafeRoute  = "firewall.unsafe_route_sources"
+	FirewallRuleNoMatch      = "no matching allow rule"
+	FirewallRuleNewFlowLimit = "firewall.new_flow_limit"
+	FirewallRuleConntrackMax = "firewall.conntrack.max_connections"
+)
+
 // Drop returns an error if the packet should be dropped, explaining why. It
-// returns nil if the packet should not be dropped.
-func (f *Firewall) Drop(fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache) error {
+// returns nil if the packet should not be dropped. viaRelay is true for inbound packets that arrived through a relay.
+func (f *Firewall) Drop(fp firewall.Packet, incoming bool, viaRelay bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache) error {
+	_, err := f.DropRule(fp, incoming, viaRelay, h, caPool, localCache)
+	return err
+}
+
+// DropRule is Drop that also names the rule responsible for a dropped packet, one of the FirewallRule names or, for a
+// packet an allow rule matched that was dropped after, the limit that dropped it. Drops are written to
+// firewall.reject_log when it is enabled.
+func (f *Firewall) DropRule(fp firewall.Packet, incoming bool, viaRelay bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache) (string, error) {
+	rule, err := f.drop(fp, incoming, viaRelay, h, caPool, localCache)
+	if err != nil && f.rejectLog != nil {
+		f.rejectLog.logReject(fp, incoming, h, rule, err, time.Now())
+	}
+	return rule, err
+}
+
+func (f *Firewall) drop(fp firewall.Packet, incoming bool, viaRelay bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache) (string, error) {
 	// Check if we spoke to this tuple, if we did then allow this packet
-	if f.inConns(fp, h, caPool, localCache) {
-		return nil
+	if f.inConns(fp, incoming, viaRelay, h, caPool, localCache) {
+		return "", nil
+	}
+
+	rule, name, err := f.evaluate(fp, incoming, viaRelay, h, caPool)
+	if err != nil {
+		switch name {
+		case FirewallRuleRemoteIP:
+			f.metrics(incoming).droppedRemoteIP.Inc(1)
+		case FirewallRuleLocalIP:
+			f.metrics(incoming).droppedLocalIP.Inc(1)
+		case FirewallRuleNoMatch:
+			f.metrics(incoming).droppedNoRule.Inc(1)
+		}
+		return name, err
 	}
 
+	// This is a new inbound flow, make sure the peer is not opening them too quickly
+	if incoming && f.newFlowLimit != nil && !f.newFlowLimit.allow(h.vpnIp, h.GetCert(), time.Now()) {
+		return FirewallRuleNewFlowLimit, ErrNewFlowRateLimited
+	}
+
+	// We always want to conntrack since it is a faster operation
+	if !f.addConn(fp, incoming, viaRelay, rule) {
+		return FirewallRuleConntrackMax, ErrConntrackFull
+	}
+
+	// This is a new flow that was allowed
+	f.metrics(incoming).accepted.Mark(1)
+	if f.flowLog != nil {
+		f.flowLog.log(fp, incoming, h, name, time.Now())
+	}
+
+	return "", nil
+}
+
+// evaluate runs a packet of a new flow through the rules, it returns the index of the rule that allows it or the name
+// of the check that drops it. It does not change any state, see Firewall.Evaluate.
+func (f *Firewall) evaluate(fp firewall.Packet, incoming bool, viaRelay bool, h *HostInfo, caPool *cert.NebulaCAPool) (int, string, error) {
 	// Make sure remote address matches nebula certificate
 	if remoteCidr := h.remoteCidr; remoteCidr != nil {
 		//TODO: this would be better if we had a least specific match lookup, could waste time here, need to benchmark since the algo is different
 		_, ok := remoteCidr.Lookup(fp.RemoteIP)
 		if !ok {
-			f.metrics(incoming).droppedRemoteIP.Inc(1)
-			return ErrInvalidRemoteIP
+			return 0, FirewallRuleRemoteIP, ErrInvalidRemoteIP
 		}
 	} else {
 		// Simple case: Certificate has one IP and no subnets
 		if fp.RemoteIP != h.vpnIp {
-			f.metrics(incoming).droppedRemoteIP.Inc(1)
-			return ErrInvalidRemoteIP
+			return 0, FirewallRuleRemoteIP, ErrInvalidRemoteIP
 		}
 	}
 
@@ -447,25 +670,36 @@ func (f *Firewall) Drop(fp firewall.Packet, incoming bool, h *HostInfo, caPool *
 	//TODO: this would be better if we had a least specific match lookup, could waste time here, need to benchmark since the algo is different
 	_, ok := f.localIps.Lookup(fp.LocalIP)
 	if !ok {
-		f.metrics(incoming).droppedLocalIP.Inc(1)
-		return ErrInvalidLocalIP
+		return 0, FirewallRuleLocalIP, ErrInvalidLocalIP
 	}
 
-	table := f.OutRules
-	if incoming {
-		table = f.InRules
+	// Traffic headed out an unsafe route must come from a source that is allowed to use it
+	if incoming && f.unsafeRouteSources != nil && !f.unsafeRouteSources.allow(fp.LocalIP, fp.RemoteIP, h.GetCert()) {
+		return 0, FirewallRuleUnsafeRoute, ErrUnsafeRouteSource
 	}
 
-	// We now know which firewall table to check against
-	if !table.match(fp, incoming, h.ConnectionState.peerCert, caPool) {
-		f.metrics(incoming).droppedNoRule.Inc(1)
-		return ErrNoMatchingRule
+	rule, ok := f.matchRule(fp, incoming, viaRelay, h.ConnectionState.firewallCert(), caPool)
+	if !ok {
+		return 0, FirewallRuleNoMatch, ErrNoMatchingRule
 	}
+	return rule, f.RuleName(incoming, rule), nil
+}
 
-	// We always want to conntrack since it is a faster operation
-	f.addConn(fp, incoming)
+// matchRule returns the index of a rule that allows the packet, inbound packets are also checked against the rules for
+// the path they arrived on
+func (f *Firewall) matchRule(fp firewall.Packet, incoming, viaRelay bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) (int, bool) {
+	if !incoming {
+		return f.OutRules.matchRule(fp, false, c, caPool)
+	}
 
-	return nil
+	if rule, ok := f.InRules.matchRule(fp, true, c, caPool); ok {
+		return rule, true
+	}
+
+	if viaRelay {
+		return f.InRelayRules.matchRule(fp, true, c, caPool)
+	}
+	return f.InDirectRules.matchRule(fp, true, c, caPool)
 }
 
 func (f *Firewall) metrics(incoming bool) firewallMetrics {
@@ -492,9 +726,9 @@ func (f *Firewall) EmitStats() {
 	metrics.GetOrRegisterGauge("firewall.rules.hash", nil).Update(int64(f.GetRuleHashFNV()))
 }
 
-func (f *Firewall) inConns(fp firewall.Packet, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache) bool {
+func (f *Firewall) inConns(fp firewall.Packet, incoming, viaRelay bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache) bool {
 	if localCache != nil {
-		if _, ok := localCache[fp]; ok {
+		if relayed, ok := localCache[fp]; ok && (!incoming || relayed == viaRelay) {
 			return true
 		}
 	}
@@ -514,20 +748,22 @@ func (f *Firewall) inConns(fp firewall.Packet, h *HostInfo, caPool *cert.NebulaC
 		return false
 	}
 
-	if c.rulesVersion != f.rulesVersion {
-		// This conntrack entry was for an older rule set, validate
-		// it still passes with the current rule set
-		table := f.OutRules
-		if c.incoming {
-			table = f.InRules
-		}
+	// Only inbound packets know the path they took, outbound packets keep the path the connection was allowed on
+	relayed := c.relayed
+	if incoming && c.incoming {
+		relayed = viaRelay
+	}
 
-		// We now know which firewall table to check against
-		if !table.match(fp, c.incoming, h.ConnectionState.peerCert, caPool) {
+	if c.rulesVersion != f.rulesVersion || relayed != c.relayed {
+		// This conntrack entry was for an older rule set or the peer switched between a relay and a direct path,
+		// validate it still passes with the current rule set
+		rule, ok := f.matchRule(fp, c.incoming, relayed, h.ConnectionState.firewallCert(), caPool)
+		if !ok {
 			if f.l.Level >= logrus.DebugLevel {
 				h.logger(f.l).
 					WithField("fwPacket", fp).
 					WithField("incoming", c.incoming).
+					WithField("viaRelay", relayed).
 					WithField("rulesVersion", f.rulesVersion).
 					WithField("oldRulesVersion", c.rulesVersion).
 					Debugln("dropping old conntrack entry, does not match new ruleset")
@@ -547,6 +783,9 @@ func (f *Firewall) inConns(fp firewall.Packet, h *HostInfo, caPool *cert.NebulaC
 		}
 
 		c.rulesVersion = f.rulesVersion
+		c.relayed = relayed
+		c.rule = rule
+		c.synced = false
 	}
 
 	switch fp.Protocol {
@@ -561,13 +800,14 @@ func (f *Firewall) inConns(fp firewall.Packet, h *HostInfo, caPool *cert.NebulaC
 	conntrack.Unlock()
 
 	if localCache != nil {
-		localCache[fp] = struct{}{}
+		localCache[fp] = relayed
 	}
 
 	return true
 }
 
-func (f *Firewall) addConn(fp firewall.Packet, incoming bool) {
+// addConn tracks the connection of an allowed packet, it returns false if the conntrack table is full
+func (f *Firewall) addConn(fp firewall.Packet, incoming, viaRelay bool, rule int) bool {
 	var timeout time.Duration
 	c := &conn{}
 
@@ -583,17 +823,27 @@ func (f *Firewall) addConn(fp firewall.Packet, incoming bool) {
 	conntrack := f.Conntrack
 	conntrack.Lock()
 	if _, ok := conntrack.Conns[fp]; !ok {
+		if !f.hasRoom(time.Now()) {
+			f.conntrackFull(time.Now())
+			conntrack.Unlock()
+			return false
+		}
+
 		conntrack.TimerWheel.Advance(time.Now())
 		conntrack.TimerWheel.Add(fp, timeout)
+		conntrack.deltas.add(fp)
 	}
 
 	// Record which rulesVersion allowed this connection, so we can retest after
 	// firewall reload
 	c.incoming = incoming
+	c.relayed = incoming && viaRelay
 	c.rulesVersion = f.rulesVersion
+	c.rule = rule
 	c.Expires = time.Now().Add(timeout)
 	conntrack.Conns[fp] = c
 	conntrack.Unlock()
+	return true
 }
 
 // Evict checks if a conntrack entry has expired, if so it is removed, if not it is re-added to the wheel
@@ -620,29 +870,30 @@ func (f *Firewall) evict(p firewall.Packet) {
 }
 
 func (ft *FirewallTable) match(p firewall.Packet, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
-	if ft.AnyProto.match(p, incoming, c, caPool) {
-		return true
+	_, ok := ft.matchRule(p, incoming, c, caPool)
+	return ok
+}
+
+// matchRule returns the index of a rule that allows the packet. When more than one rule allows it the one returned is
+// the first found, not necessarily the first in the config.
+func (ft *FirewallTable) matchRule(p firewall.Packet, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) (int, bool) {
+	if rule, ok := ft.AnyProto.match(p, incoming, c, caPool); ok {
+		return rule, true
 	}
 
 	switch p.Protocol {
 	case firewall.ProtoTCP:
-		if ft.TCP.match(p, incoming, c, caPool) {
-			return true
-		}
+		return ft.TCP.match(p, incoming, c, caPool)
 	case firewall.ProtoUDP:
-		if ft.UDP.match(p, incoming, c, caPool) {
-			return true
-		}
+		return ft.UDP.match(p, incoming, c, caPool)
 	case firewall.ProtoICMP:
-		if ft.ICMP.match(p, incoming, c, caPool) {
-			return true
-		}
+		return ft.ICMP.match(p, incoming, c, caPool)
 	}
 
-	return false
+	return 0, false
 }
 
-func (fp firewallPort) addRule(f *Firewall, startPort int32, endPort int32, groups []string, host string, ip, localIp netip.Prefix, caName string, caSha string) error {
+func (fp firewallPort) addRule(f *Firewall, id int, startPort int32, endPort int32, groups []string, host string, ip, localIp netip.Prefix, caName string, caSha string, attributes map[string]string) error {
 	if startPort > endPort {
 		return fmt.Errorf("start port was lower than end port")
 	}
@@ -655,7 +906,7 @@ func (fp firewallPort) addRule(f *Firewall, startPort int32, endPort int32, grou
 			}
 		}
 
-		if err := fp[i].addRule(f, groups, host, ip, localIp, caName, caSha); err != nil {
+		if err := fp[i].addRule(f, id, groups, host, ip, localIp, caName, caSha, attributes); err != nil {
 			return err
 		}
 	}
@@ -663,10 +914,10 @@ func (fp firewallPort) addRule(f *Firewall, startPort int32, endPort int32, grou
 	return nil
 }
 
-func (fp firewallPort) match(p firewall.Packet, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
+func (fp firewallPort) match(p firewall.Packet, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) (int, bool) {
 	// We don't have any allowed ports, bail
 	if fp == nil {
-		return false
+		return 0, false
 	}
 
 	var port int32
@@ -679,14 +930,14 @@ func (fp firewallPort) match(p firewall.Packet, incoming bool, c *cert.NebulaCer
 		port = int32(p.RemotePort)
 	}
 
-	if fp[port].match(p, c, caPool) {
-		return true
+	if rule, ok := fp[port].match(p, c, caPool); ok {
+		return rule, true
 	}
 
 	return fp[firewall.PortAny].match(p, c, caPool)
 }
 
-func (fc *FirewallCA) addRule(f *Firewall, groups []string, host string, ip, localIp netip.Prefix, caName, caSha string) error {
+func (fc *FirewallCA) addRule(f *Firewall, id int, groups []string, host string, ip, localIp netip.Prefix, caName, caSha string, attributes map[string]string) error {
 	fr := func() *FirewallRule {
 		return &FirewallRule{
 			Hosts:  make(map[string]*firewallLocalCIDR),
@@ -700,14 +951,14 @@ func (fc *FirewallCA) addRule(f *Firewall, groups []string, host string, ip, loc
 			fc.Any = fr()
 		}
 
-		return fc.Any.addRule(f, groups, host, ip, localIp)
+		return fc.Any.addRule(f, id, groups, host, ip, localIp, attributes)
 	}
 
 	if caSha != "" {
 		if _, ok := fc.CAShas[caSha]; !ok {
 			fc.CAShas[caSha] = fr()
 		}
-		err := fc.CAShas[caSha].addRule(f, groups, host, ip, localIp)
+		err := fc.CAShas[caSha].addRule(f, id, groups, host, ip, localIp, attributes)
 		if err != nil {
 			return err
 		}
@@ -717,7 +968,7 @@ func (fc *FirewallCA) addRule(f *Firewall, groups []string, host string, ip, loc
 		if _, ok := fc.CANames[caName]; !ok {
 			fc.CANames[caName] = fr()
 		}
-		err := fc.CANames[caName].addRule(f, groups, host, ip, localIp)
+		err := fc.CANames[caName].addRule(f, id, groups, host, ip, localIp, attributes)
 		if err != nil {
 			return err
 		}
@@ -726,47 +977,47 @@ func (fc *FirewallCA) addRule(f *Firewall, groups []string, host string, ip, loc
 	return nil
 }
 
-func (fc *FirewallCA) match(p firewall.Packet, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
+func (fc *FirewallCA) match(p firewall.Packet, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) (int, bool) {
 	if fc == nil {
-		return false
+		return 0, false
 	}
 
-	if fc.Any.match(p, c) {
-		return true
+	if rule, ok := fc.Any.match(p, c); ok {
+		return rule, true
 	}
 
 	if t, ok := fc.CAShas[c.Details.Issuer]; ok {
-		if t.match(p, c) {
-			return true
+		if rule, ok := t.match(p, c); ok {
+			return rule, true
 		}
 	}
 
 	s, err := caPool.GetCAForCert(c)
 	if err != nil {
-		return false
+		return 0, false
 	}
 
 	return fc.CANames[s.Details.Name].match(p, c)
 }
 
-func (fr *FirewallRule) addRule(f *Firewall, groups []string, host string, ip, localCIDR netip.Prefix) error {
+func (fr *FirewallRule) addRule(f *Firewall, id int, groups []string, host string, ip, localCIDR netip.Prefix, attributes map[string]string) error {
 	flc := func() *firewallLocalCIDR {
 		return &firewallLocalCIDR{
-			LocalCIDR: new(bart.Table[struct{}]),
+			LocalCIDR: new(bart.Table[int]),
 		}
 	}
 
-	if fr.isAny(groups, host, ip) {
+	if fr.isAny(groups, host, ip, attributes) {
 		if fr.Any == nil {
 			fr.Any = flc()
 		}
 
-		return fr.Any.addRule(f, localCIDR)
+		return fr.Any.addRule(f, id, localCIDR)
 	}
 
 	if len(groups) > 0 {
 		nlc := flc()
-		err := nlc.addRule(f, localCIDR)
+		err := nlc.addRule(f, id, localCIDR)
 		if err != nil {
 			return err
 		}
@@ -777,12 +1028,25 @@ func (fr *FirewallRule) addRule(f *Firewall, groups []string, host string, ip, l
 		})
 	}
 
+	if len(attributes) > 0 {
+		nlc := flc()
+		err := nlc.addRule(f, id, localCIDR)
+		if err != nil {
+			return err
+		}
+
+		fr.Attributes = append(fr.Attributes, &firewallAttributes{
+			Attributes: attributes,
+			LocalCIDR:  nlc,
+		})
+	}
+
 	if host != "" {
 		nlc := fr.Hosts[host]
 		if nlc == nil {
 			nlc = flc()
 		}
-		err := nlc.addRule(f, localCIDR)
+		err := nlc.addRule(f, id, localCIDR)
 		if err != nil {
 			return err
 		}
@@ -794,7 +1058,7 @@ func (fr *FirewallRule) addRule(f *Firewall, groups []string, host string, ip, l
 		if nlc == nil {
 			nlc = flc()
 		}
-		err := nlc.addRule(f, localCIDR)
+		err := nlc.addRule(f, id, localCIDR)
 		if err != nil {
 			return err
 		}
@@ -804,8 +1068,8 @@ func (fr *FirewallRule) addRule(f *Firewall, groups []string, host string, ip, l
 	return nil
 }
 
-func (fr *FirewallRule) isAny(groups []string, host string, ip netip.Prefix) bool {
-	if len(groups) == 0 && host == "" && !ip.IsValid() {
+func (fr *FirewallRule) isAny(groups []string, host string, ip netip.Prefix, attributes map[string]string) bool {
+	if len(groups) == 0 && host == "" && len(attributes) == 0 && !ip.IsValid() {
 		return true
 	}
 
@@ -826,17 +1090,17 @@ func (fr *FirewallRule) isAny(groups []string, host string, ip netip.Prefix) boo
 	return false
 }
 
-func (fr *FirewallRule) match(p firewall.Packet, c *cert.NebulaCertificate) bool {
+func (fr *FirewallRule) match(p firewall.Packet, c *cert.NebulaCertificate) (int, bool) {
 	if fr == nil {
-		return false
+		return 0, false
 	}
 
 	// Shortcut path for if groups, hosts, or cidr contained an `any`
-	if fr.Any.match(p, c) {
-		return true
+	if rule, ok := fr.Any.match(p, c); ok {
+		return rule, true
 	}
 
-	// Need any of group, host, or cidr to match
+	// Need any of group, attributes, host, or cidr to match
 	for _, sg := range fr.Groups {
 		found := false
 
@@ -849,71 +1113,103 @@ func (fr *FirewallRule) match(p firewall.Packet, c *cert.NebulaCertificate) bool
 			found = true
 		}
 
-		if found && sg.LocalCIDR.match(p, c) {
-			return true
+		if found {
+			if rule, ok := sg.LocalCIDR.match(p, c); ok {
+				return rule, true
+			}
+		}
+	}
+
+	for _, sa := range fr.Attributes {
+		found := true
+		for k, v := range sa.Attributes {
+			if cv, ok := c.Details.Attributes[k]; !ok || cv != v {
+				found = false
+				break
+			}
+		}
+
+		if found {
+			if rule, ok := sa.LocalCIDR.match(p, c); ok {
+				return rule, true
+			}
 		}
 	}
 
 	if fr.Hosts != nil {
 		if flc, ok := fr.Hosts[c.Details.Name]; ok {
-			if flc.match(p, c) {
-				return true
+			if rule, ok := flc.match(p, c); ok {
+				return rule, true
 			}
 		}
 	}
 
 	matched := false
+	matchedRule := 0
 	prefix := netip.PrefixFrom(p.RemoteIP, p.RemoteIP.BitLen())
 	fr.CIDR.EachLookupPrefix(prefix, func(prefix netip.Prefix, val *firewallLocalCIDR) bool {
-		if prefix.Contains(p.RemoteIP) && val.match(p, c) {
-			matched = true
+		if !prefix.Contains(p.RemoteIP) {
+			return true
+		}
+		if rule, ok := val.match(p, c); ok {
+			matched, matchedRule = true, rule
 			return false
 		}
 		return true
 	})
-	return matched
+	return matchedRule, matched
 }
 
-func (flc *firewallLocalCIDR) addRule(f *Firewall, localIp netip.Prefix) error {
+func (flc *firewallLocalCIDR) addRule(f *Firewall, id int, localIp netip.Prefix) error {
 	if !localIp.IsValid() {
 		if !f.hasSubnets || f.defaultLocalCIDRAny {
-			flc.Any = true
+			flc.setAny(id)
 			return nil
 		}
 
 		localIp = f.assignedCIDR
 	} else if localIp.Bits() == 0 {
-		flc.Any = true
+		flc.setAny(id)
 	}
 
-	flc.LocalCIDR.Insert(localIp, struct{}{})
+	if _, ok := flc.LocalCIDR.Get(localIp); !ok {
+		flc.LocalCIDR.Insert(localIp, id)
+	}
 	return nil
 }
 
-func (flc *firewallLocalCIDR) match(p firewall.Packet, c *cert.NebulaCertificate) bool {
+func (flc *firewallLocalCIDR) setAny(id int) {
+	if !flc.Any {
+		flc.Any = true
+		flc.AnyRule = id
+	}
+}
+
+func (flc *firewallLocalCIDR) match(p firewall.Packet, c *cert.NebulaCertificate) (int, bool) {
 	if flc == nil {
-		return false
+		return 0, false
 	}
 
 	if flc.Any {
-		return true
+		return flc.AnyRule, true
 	}
 
-	_, ok := flc.LocalCIDR.Lookup(p.LocalIP)
-	return ok
+	return flc.LocalCIDR.Lookup(p.LocalIP)
 }
 
 type rule struct {
-	Port      string
-	Code      string
-	Proto     string
-	Host      string
-	Group     string
-	Groups    []string
-	Cidr      string
-	LocalCidr string
-	CAName    string
-	CASha     string
+	Port       string
+	Code       string
+	Proto      string
+	Host       string
+	Group      string
+	Groups     []string
+	Cidr       string
+	LocalCidr  string
+	CAName     string
+	CASha      string
+	Via        string
+	Attributes map[string]string
 }
 
 func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, error) {
@@ -940,6 +1236,7 @@ func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, er
 	r.LocalCidr = toString("local_cidr", m)
 	r.CAName = toString("ca_name", m)
 	r.CASha = toString("ca_sha", m)
+	r.Via = toString("via", m)
 
 	// Make sure group isn't an array
 	if v, ok := m["group"].([]interface{}); ok {
@@ -952,6 +1249,22 @@ func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, er
 	}
 	r.Group = toString("group", m)
 
+	if ra, ok := m["attributes"]; ok {
+		am, ok := ra.(map[interface{}]interface{})
+		if !ok {
+			return r, errors.New("attributes should be a map of attribute names to values")
+		}
+
+		r.Attributes = make(map[string]string, len(am))
+		for k, v := range am {
+			ks := fmt.Sprintf("%v", k)
+			if ks == "" {
+				return r, errors.New("attributes contained an empty attribute name")
+			}
+			r.Attributes[ks] = fmt.Sprintf("%v", v)
+		}
+	}
+
 	if rg, ok := m["groups"]; ok {
 		switch reflect.TypeOf(rg).Kind() {
 		case reflect.Slice:
@@ -8,8 +8,10 @@ import (
 )
 
 // ConntrackCache is used as a local routine cache to know if a given flow
-// has been seen in the conntrack table.
-type ConntrackCache map[Packet]struct{}
+// has been seen in the conntrack table. The value is true if the flow was
+// allowed through a relay, an inbound packet taking the other path has to be
+// checked against the conntrack table again.
+type ConntrackCache map[Packet]bool
 
 type ConntrackCacheTicker struct {
 	cacheV    uint64
@@ -0,0 +1,116 @@
+package nebula
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// conntrackFullReportInterval is how often a full conntrack table is logged and reported to the callback
+const conntrackFullReportInterval = 10 * time.Second
+
+var ErrConntrackFull = errors.New("firewall conntrack table is full")
+
+// ConntrackFull is reported when new flows are dropped because the conntrack table holds
+// firewall.conntrack.max_connections entries
+type ConntrackFull struct {
+	MaxConnections int `json:"maxConnections"`
+	// Dropped is the number of new flows dropped since the last report
+	Dropped uint64 `json:"dropped"`
+	// TopVpnIp is the remote overlay address with the most conntrack entries, the peer vpn ip unless its flows come
+	// from behind its unsafe routes. TopConnections is its number of entries.
+	TopVpnIp       netip.Addr `json:"topVpnIp"`
+	TopConnections int        `json:"topConnections"`
+}
+
+// conntrackFullReporter rate limits the reports of a full conntrack table. It belongs to the conntrack table so the
+// callback survives a firewall reload.
+type conntrackFullReporter struct {
+	sync.Mutex
+	lastReport time.Time
+	dropped    uint64
+	callback   func(ConntrackFull)
+
+	metricDropped metrics.Counter
+}
+
+func newConntrackFullReporter() *conntrackFullReporter {
+	return &conntrackFullReporter{
+		metricDropped: metrics.GetOrRegisterCounter("firewall.conntrack.dropped.full", nil),
+	}
+}
+
+// setCallback replaces the function called with every report, nil removes it
+func (r *conntrackFullReporter) setCallback(cb func(ConntrackFull)) {
+	r.Lock()
+	r.callback = cb
+	r.Unlock()
+}
+
+// hasRoom returns true if a new flow fits in the conntrack table, entries expired at now are purged to make room
+// first. Caller must own the conntrack lock.
+func (f *Firewall) hasRoom(now time.Time) bool {
+	if f.MaxConnections <= 0 {
+		return true
+	}
+
+	conntrack := f.Conntrack
+	if len(conntrack.Conns) >= f.MaxConnections {
+		conntrack.TimerWheel.Advance(now)
+	}
+	for len(conntrack.Conns) >= f.MaxConnections {
+		ep, has := conntrack.TimerWheel.Purge()
+		if !has {
+			return false
+		}
+		f.evict(ep)
+	}
+	return true
+}
+
+// conntrackFull counts a new flow dropped because the conntrack table is full and reports it at most once per
+// conntrackFullReportInterval. Caller must own the conntrack lock.
+func (f *Firewall) conntrackFull(now time.Time) {
+	r := f.Conntrack.full
+	r.metricDropped.Inc(1)
+
+	r.Lock()
+	defer r.Unlock()
+	r.dropped++
+	if now.Sub(r.lastReport) < conntrackFullReportInterval {
+		return
+	}
+
+	ev := ConntrackFull{MaxConnections: f.MaxConnections, Dropped: r.dropped}
+	ev.TopVpnIp, ev.TopConnections = f.topConntrackRemote()
+	r.lastReport = now
+	r.dropped = 0
+
+	f.l.WithFields(logrus.Fields{
+		"maxConnections": ev.MaxConnections,
+		"dropped":        ev.Dropped,
+		"topVpnIp":       ev.TopVpnIp,
+		"topConnections": ev.TopConnections,
+	}).Error("Firewall conntrack table is full, dropping new flows. Raise firewall.conntrack.max_connections or look into the top vpn ip")
+
+	if r.callback != nil {
+		go r.callback(ev)
+	}
+}
+
+// topConntrackRemote returns the remote address with the most conntrack entries. Caller must own the conntrack lock.
+func (f *Firewall) topConntrackRemote() (netip.Addr, int) {
+	counts := map[netip.Addr]int{}
+	var top netip.Addr
+	for fp := range f.Conntrack.Conns {
+		counts[fp.RemoteIP]++
+		if counts[fp.RemoteIP] > counts[top] {
+			top = fp.RemoteIP
+		}
+	}
+	return top, counts[top]
+}
@@ -0,0 +1,96 @@
+package nebula
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_conntrackFull(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+firewall:
+  conntrack:
+    udp_timeout: 1s
+    max_connections: 4
+  inbound:
+    - port: any
+      proto: any
+      host: any
+`))
+
+	myCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Ips: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)}},
+	}}
+	fw, err := NewFirewallFromConfig(l, myCert, c)
+	require.NoError(t, err)
+	assert.Equal(t, 4, fw.MaxConnections)
+
+	reports := make(chan ConntrackFull, 10)
+	fw.Conntrack.full.setCallback(func(ev ConntrackFull) { reports <- ev })
+
+	peer := func(vpnIp string) *HostInfo {
+		return &HostInfo{
+			vpnIp:           netip.MustParseAddr(vpnIp),
+			ConnectionState: &ConnectionState{peerCert: &cert.NebulaCertificate{}},
+		}
+	}
+	flow := func(h *HostInfo, port uint16) firewall.Packet {
+		return firewall.Packet{
+			LocalIP:    netip.MustParseAddr("10.0.0.1"),
+			RemoteIP:   h.vpnIp,
+			LocalPort:  80,
+			RemotePort: port,
+			Protocol:   firewall.ProtoUDP,
+		}
+	}
+
+	scanner, other := peer("10.0.0.2"), peer("10.0.0.3")
+	cp := cert.NewCAPool()
+
+	// Fill the table, mostly from the scanner
+	require.NoError(t, fw.Drop(flow(other, 1), true, false, other, cp, nil))
+	for port := uint16(1); port <= 3; port++ {
+		require.NoError(t, fw.Drop(flow(scanner, port), true, false, scanner, cp, nil))
+	}
+
+	dropped := fw.Conntrack.full.metricDropped.Count()
+	assert.Equal(t, ErrConntrackFull, fw.Drop(flow(scanner, 4), true, false, scanner, cp, nil))
+	assert.Equal(t, ErrConntrackFull, fw.Drop(flow(other, 2), true, false, other, cp, nil))
+	assert.Equal(t, dropped+2, fw.Conntrack.full.metricDropped.Count())
+
+	// Established flows are not affected
+	assert.NoError(t, fw.Drop(flow(other, 1), true, false, other, cp, nil))
+	assert.NoError(t, fw.Drop(flow(scanner, 1), false, false, scanner, cp, nil))
+
+	select {
+	case ev := <-reports:
+		assert.Equal(t, ConntrackFull{MaxConnections: 4, Dropped: 1, TopVpnIp: scanner.vpnIp, TopConnections: 3}, ev)
+	case <-time.After(time.Second):
+		t.Fatal("the callback was not called")
+	}
+
+	// The second drop came within the report interval
+	assert.Len(t, reports, 0)
+	assert.EqualValues(t, 1, fw.Conntrack.full.dropped)
+
+	// Expired entries make room again
+	fw.Conntrack.Lock()
+	for _, c := range fw.Conntrack.Conns {
+		c.Expires = time.Now().Add(-time.Second)
+	}
+	assert.True(t, fw.hasRoom(time.Now().Add(5*time.Second)))
+	// Only as much as needed is purged
+	assert.Len(t, fw.Conntrack.Conns, 3)
+	fw.Conntrack.Unlock()
+	assert.NoError(t, fw.Drop(flow(scanner, 5), true, false, scanner, cp, nil))
+}
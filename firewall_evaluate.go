@@ -0,0 +1,115 @@
+package nebula
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// FirewallTestPeer is the certificate of a simulated peer for Interface.TestFirewall
+type FirewallTestPeer struct {
+	Name       string
+	Groups     []string
+	Attributes map[string]string
+	// CA is the name or fingerprint of the CA that signed the certificate, the CA of our own certificate if empty
+	CA string
+	// Ips are the vpn ips of the certificate, the remote ip of the packet in our vpn network if empty
+	Ips     []netip.Prefix
+	Subnets []netip.Prefix
+}
+
+// FirewallVerdict is what the firewall would do with a packet, see Firewall.Evaluate
+type FirewallVerdict struct {
+	Allowed bool `json:"allowed"`
+	// Rule is the rule that allows the packet, see Firewall.RuleName, or the check that drops it, one of the
+	// FirewallRule names
+	Rule  string `json:"rule"`
+	Error string `json:"error,omitempty"`
+}
+
+// Evaluate returns what the firewall would do with fp, the first packet of a new flow with the peer h. It runs the same
+// checks as Drop without changing any state, nothing is added to the conntrack, counted or logged. The limits that
+// depend on the traffic at the time, firewall.new_flow_limit and firewall.conntrack.max_connections, are not applied.
+func (f *Firewall) Evaluate(fp firewall.Packet, incoming bool, viaRelay bool, h *HostInfo, caPool *cert.NebulaCAPool) FirewallVerdict {
+	_, name, err := f.evaluate(fp, incoming, viaRelay, h, caPool)
+	if err != nil {
+		return FirewallVerdict{Rule: name, Error: err.Error()}
+	}
+	return FirewallVerdict{Allowed: true, Rule: name}
+}
+
+// TestFirewall evaluates fp against the installed firewall as if it was exchanged with a peer holding the certificate
+// described by peer, see Firewall.Evaluate. Ports are ignored for icmp packets and fragments, as they are for live
+// traffic.
+func (f *Interface) TestFirewall(fp firewall.Packet, incoming bool, viaRelay bool, peer FirewallTestPeer) (FirewallVerdict, error) {
+	if !fp.RemoteIP.IsValid() || !fp.LocalIP.IsValid() {
+		return FirewallVerdict{}, fmt.Errorf("the packet needs a remote and a local ip")
+	}
+	if fp.Fragment || fp.Protocol == firewall.ProtoICMP {
+		fp.RemotePort = 0
+		fp.LocalPort = 0
+	}
+
+	caPool := f.pki.GetCAPool()
+	issuer, err := firewallTestIssuer(caPool, peer.CA)
+	if err != nil {
+		return FirewallVerdict{}, err
+	}
+	if issuer == "" {
+		issuer = f.pki.GetCertState().Certificate.Details.Issuer
+	}
+
+	ips := peer.Ips
+	if len(ips) == 0 {
+		ips = []netip.Prefix{netip.PrefixFrom(fp.RemoteIP, f.myVpnNet.Bits())}
+	}
+
+	c := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Name:           peer.Name,
+		Groups:         peer.Groups,
+		InvertedGroups: make(map[string]struct{}, len(peer.Groups)),
+		Attributes:     peer.Attributes,
+		Issuer:         issuer,
+	}}
+	for _, g := range peer.Groups {
+		c.Details.InvertedGroups[g] = struct{}{}
+	}
+	for _, p := range ips {
+		c.Details.Ips = append(c.Details.Ips, &net.IPNet{IP: p.Addr().AsSlice(), Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen())})
+	}
+	for _, p := range peer.Subnets {
+		c.Details.Subnets = append(c.Details.Subnets, &net.IPNet{IP: p.Addr().AsSlice(), Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen())})
+	}
+
+	h := &HostInfo{vpnIp: ips[0].Addr(), ConnectionState: &ConnectionState{peerCert: c}}
+	h.CreateRemoteCIDR(c)
+	return f.firewall.Evaluate(fp, incoming, viaRelay, h, caPool), nil
+}
+
+// firewallTestIssuer returns the fingerprint of the CA in caPool named or fingerprinted ca, empty if ca is
+func firewallTestIssuer(caPool *cert.NebulaCAPool, ca string) (string, error) {
+	if ca == "" {
+		return "", nil
+	}
+	if _, ok := caPool.CAs[ca]; ok {
+		return ca, nil
+	}
+
+	issuer := ""
+	for fp, c := range caPool.CAs {
+		if c.Details.Name != ca {
+			continue
+		}
+		if issuer != "" {
+			return "", fmt.Errorf("more than one CA is named %s, use its fingerprint", ca)
+		}
+		issuer = fp
+	}
+	if issuer == "" {
+		return "", fmt.Errorf("no CA is named or fingerprinted %s", ca)
+	}
+	return issuer, nil
+}
@@ -0,0 +1,182 @@
+package nebula
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterface_TestFirewall(t *testing.T) {
+	l := test.NewLogger()
+	oldCA, newCA := newTestCA(t, "old"), newTestCA(t, "new")
+
+	c := config.NewC(l)
+	c.Settings["pki"] = map[interface{}]interface{}{"ca": string(oldCA.pem) + string(newCA.pem)}
+	caPool, err := loadCAPoolFromConfig(l, c)
+	require.NoError(t, err)
+
+	require.NoError(t, c.LoadString(`
+firewall:
+  inbound:
+    - {port: 22, proto: tcp, group: admins}
+    - {port: 443, proto: tcp, host: any}
+    - {port: 5432, proto: tcp, host: db-client, ca_name: new}
+    - {port: any, proto: icmp, attributes: {env: prod}}
+  outbound:
+    - {port: 53, proto: udp, cidr: 10.0.0.53/32}
+`))
+	myCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Ips:    []*net.IPNet{{IP: net.IPv4(10, 0, 0, 1), Mask: net.IPMask{255, 255, 255, 0}}},
+		Issuer: oldCA.fp,
+	}}
+	fw, err := NewFirewallFromConfig(l, myCert, c)
+	require.NoError(t, err)
+
+	pki := &PKI{}
+	pki.caPool.Store(caPool)
+	pki.cs.Store(&CertState{Certificate: myCert})
+	f := &Interface{pki: pki, firewall: fw, myVpnNet: netip.MustParsePrefix("10.0.0.1/24")}
+
+	packet := func(remote string, localPort, remotePort uint16, proto uint8) firewall.Packet {
+		return firewall.Packet{
+			LocalIP:    netip.MustParseAddr("10.0.0.1"),
+			RemoteIP:   netip.MustParseAddr(remote),
+			LocalPort:  localPort,
+			RemotePort: remotePort,
+			Protocol:   proto,
+		}
+	}
+
+	tests := []struct {
+		name     string
+		fp       firewall.Packet
+		incoming bool
+		peer     FirewallTestPeer
+		want     FirewallVerdict
+	}{
+		{
+			name:     "group rule",
+			fp:       packet("10.0.0.2", 22, 40000, firewall.ProtoTCP),
+			incoming: true,
+			peer:     FirewallTestPeer{Groups: []string{"admins"}},
+			want:     FirewallVerdict{Allowed: true, Rule: "firewall.inbound.0"},
+		},
+		{
+			name:     "no group",
+			fp:       packet("10.0.0.4", 22, 40000, firewall.ProtoTCP),
+			incoming: true,
+			want:     FirewallVerdict{Rule: FirewallRuleNoMatch, Error: ErrNoMatchingRule.Error()},
+		},
+		{
+			name:     "any host",
+			fp:       packet("10.0.0.2", 443, 40000, firewall.ProtoTCP),
+			incoming: true,
+			want:     FirewallVerdict{Allowed: true, Rule: "firewall.inbound.1"},
+		},
+		{
+			name:     "ca by name",
+			fp:       packet("10.0.0.2", 5432, 40000, firewall.ProtoTCP),
+			incoming: true,
+			peer:     FirewallTestPeer{Name: "db-client", CA: "new"},
+			want:     FirewallVerdict{Allowed: true, Rule: "firewall.inbound.2"},
+		},
+		{
+			name:     "ca by fingerprint",
+			fp:       packet("10.0.0.2", 5432, 40000, firewall.ProtoTCP),
+			incoming: true,
+			peer:     FirewallTestPeer{Name: "db-client", CA: newCA.fp},
+			want:     FirewallVerdict{Allowed: true, Rule: "firewall.inbound.2"},
+		},
+		{
+			name:     "our ca by default",
+			fp:       packet("10.0.0.2", 5432, 40000, firewall.ProtoTCP),
+			incoming: true,
+			peer:     FirewallTestPeer{Name: "db-client"},
+			want:     FirewallVerdict{Rule: FirewallRuleNoMatch, Error: ErrNoMatchingRule.Error()},
+		},
+		{
+			name:     "icmp ignores ports",
+			fp:       packet("10.0.0.2", 1, 2, firewall.ProtoICMP),
+			incoming: true,
+			peer:     FirewallTestPeer{Attributes: map[string]string{"env": "prod"}},
+			want:     FirewallVerdict{Allowed: true, Rule: "firewall.inbound.3"},
+		},
+		{
+			name:     "outbound",
+			fp:       packet("10.0.0.53", 40000, 53, firewall.ProtoUDP),
+			incoming: false,
+			want:     FirewallVerdict{Allowed: true, Rule: "firewall.outbound.0"},
+		},
+		{
+			name:     "remote ip outside the certificate",
+			fp:       packet("10.0.0.3", 443, 40000, firewall.ProtoTCP),
+			incoming: true,
+			peer:     FirewallTestPeer{Ips: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/24")}},
+			want:     FirewallVerdict{Rule: FirewallRuleRemoteIP, Error: ErrInvalidRemoteIP.Error()},
+		},
+		{
+			name:     "remote ip in a subnet of the certificate",
+			fp:       packet("192.168.1.5", 443, 40000, firewall.ProtoTCP),
+			incoming: true,
+			peer: FirewallTestPeer{
+				Ips:     []netip.Prefix{netip.MustParsePrefix("10.0.0.2/24")},
+				Subnets: []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")},
+			},
+			want: FirewallVerdict{Allowed: true, Rule: "firewall.inbound.1"},
+		},
+	}
+
+	accepted := fw.incomingMetrics.accepted.Count()
+	dropped := fw.incomingMetrics.droppedNoRule.Count()
+	for _, tt := range tests {
+		got, err := f.TestFirewall(tt.fp, tt.incoming, false, tt.peer)
+		require.NoError(t, err, tt.name)
+		assert.Equal(t, tt.want, got, tt.name)
+	}
+
+	t.Log("Nothing is tracked or counted")
+	assert.Empty(t, fw.Conntrack.Conns)
+	assert.Equal(t, accepted, fw.incomingMetrics.accepted.Count())
+	assert.Equal(t, dropped, fw.incomingMetrics.droppedNoRule.Count())
+
+	t.Log("The verdict is the one live traffic from a peer with a single vpn ip from our CA gets")
+	for _, tt := range tests {
+		if len(tt.peer.Ips) > 0 || tt.peer.CA != "" {
+			continue
+		}
+
+		h := &HostInfo{vpnIp: tt.fp.RemoteIP, ConnectionState: &ConnectionState{peerCert: &cert.NebulaCertificate{
+			Details: cert.NebulaCertificateDetails{
+				Name:           tt.peer.Name,
+				InvertedGroups: map[string]struct{}{},
+				Attributes:     tt.peer.Attributes,
+				Issuer:         oldCA.fp,
+			},
+		}}}
+		for _, g := range tt.peer.Groups {
+			h.ConnectionState.peerCert.Details.InvertedGroups[g] = struct{}{}
+		}
+		fp := tt.fp
+		if fp.Protocol == firewall.ProtoICMP {
+			fp.LocalPort, fp.RemotePort = 0, 0
+		}
+		rule, err := fw.DropRule(fp, tt.incoming, false, h, caPool, nil)
+		if tt.want.Allowed {
+			assert.NoError(t, err, tt.name)
+		} else {
+			assert.Equal(t, tt.want.Rule, rule, tt.name)
+			assert.EqualError(t, err, tt.want.Error, tt.name)
+		}
+	}
+
+	t.Log("Unknown CAs are refused")
+	_, err = f.TestFirewall(packet("10.0.0.2", 22, 40000, firewall.ProtoTCP), true, false, FirewallTestPeer{CA: "nope"})
+	assert.EqualError(t, err, "no CA is named or fingerprinted nope")
+}
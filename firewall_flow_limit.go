@@ -0,0 +1,190 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+const defaultNewFlowLimitMaxTracked = 10000
+
+var ErrNewFlowRateLimited = errors.New("peer exceeded the new flow rate limit")
+
+// flowRate is a token bucket configuration, rate is in new flows per second
+type flowRate struct {
+	rate  float64
+	burst float64
+}
+
+// flowBucket tracks the new flow budget for a single peer
+type flowBucket struct {
+	limit  flowRate
+	tokens float64
+	last   time.Time
+}
+
+// newFlowLimiter rate limits the number of new inbound flows, packets that miss conntrack and pass the rules, a peer
+// can open. State is keyed by the peer vpn ip and bounded by maxTracked.
+type newFlowLimiter struct {
+	sync.Mutex
+	buckets map[netip.Addr]*flowBucket
+
+	defaultLimit flowRate
+	groupLimits  map[string]flowRate
+	maxTracked   int
+
+	metricDropped metrics.Counter
+}
+
+func newFlowLimiterFromConfig(c *config.C) (*newFlowLimiter, error) {
+	fl := &newFlowLimiter{
+		buckets: map[netip.Addr]*flowBucket{},
+		defaultLimit: flowRate{
+			rate:  float64(c.GetInt("firewall.new_flow_limit.rate", 0)),
+			burst: float64(c.GetInt("firewall.new_flow_limit.burst", 0)),
+		},
+		groupLimits:   map[string]flowRate{},
+		maxTracked:    c.GetInt("firewall.new_flow_limit.max_tracked", defaultNewFlowLimitMaxTracked),
+		metricDropped: metrics.GetOrRegisterCounter("firewall.incoming.dropped.new_flow_rate", nil),
+	}
+
+	if fl.defaultLimit.rate < 0 || fl.defaultLimit.burst < 0 {
+		return nil, fmt.Errorf("firewall.new_flow_limit.rate and burst must not be negative")
+	}
+	fl.defaultLimit.burst = defaultBurst(fl.defaultLimit)
+
+	if fl.maxTracked < 1 {
+		return nil, fmt.Errorf("firewall.new_flow_limit.max_tracked must be at least 1")
+	}
+
+	for k, v := range c.GetMap("firewall.new_flow_limit.groups", map[interface{}]interface{}{}) {
+		group := fmt.Sprintf("%v", k)
+		raw, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("firewall.new_flow_limit.groups.%s must be a map with rate and burst", group)
+		}
+
+		limit := flowRate{}
+		var err error
+		if limit.rate, err = toFlowRate(raw["rate"]); err != nil {
+			return nil, fmt.Errorf("firewall.new_flow_limit.groups.%s.rate %s", group, err)
+		}
+		if limit.burst, err = toFlowRate(raw["burst"]); err != nil {
+			return nil, fmt.Errorf("firewall.new_flow_limit.groups.%s.burst %s", group, err)
+		}
+		limit.burst = defaultBurst(limit)
+		fl.groupLimits[group] = limit
+	}
+
+	if fl.defaultLimit.rate == 0 && len(fl.groupLimits) == 0 {
+		return nil, nil
+	}
+
+	return fl, nil
+}
+
+// defaultBurst allows one second worth of new flows when no burst was configured
+func defaultBurst(limit flowRate) float64 {
+	if limit.burst == 0 {
+		return limit.rate
+	}
+	return limit.burst
+}
+
+func toFlowRate(v interface{}) (float64, error) {
+	if v == nil {
+		return 0, nil
+	}
+
+	i, err := strconv.Atoi(fmt.Sprintf("%v", v))
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("must be a positive integer")
+	}
+	return float64(i), nil
+}
+
+// limitFor returns the limit that applies to a peer. If the peer has any configured groups the most restrictive of
+// those applies, a group rate of 0 is unlimited. Otherwise the default applies.
+func (fl *newFlowLimiter) limitFor(peerCert *cert.NebulaCertificate) flowRate {
+	limit := fl.defaultLimit
+	if peerCert == nil {
+		return limit
+	}
+
+	found := false
+	for group, gl := range fl.groupLimits {
+		if _, ok := peerCert.Details.InvertedGroups[group]; !ok {
+			continue
+		}
+
+		if !found || (gl.rate != 0 && (limit.rate == 0 || gl.rate < limit.rate)) {
+			limit = gl
+			found = true
+		}
+	}
+	return limit
+}
+
+// allow consumes a new flow token for vpnIp and returns false if the peer is over its limit
+func (fl *newFlowLimiter) allow(vpnIp netip.Addr, peerCert *cert.NebulaCertificate, now time.Time) bool {
+	fl.Lock()
+	defer fl.Unlock()
+
+	b, ok := fl.buckets[vpnIp]
+	if !ok {
+		limit := fl.limitFor(peerCert)
+		if limit.rate == 0 {
+			// Unlimited, no need to track
+			return true
+		}
+
+		fl.makeRoom(now)
+		b = &flowBucket{limit: limit, tokens: limit.burst, last: now}
+		fl.buckets[vpnIp] = b
+	}
+
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens += elapsed * b.limit.rate
+		if b.tokens > b.limit.burst {
+			b.tokens = b.limit.burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		fl.metricDropped.Inc(1)
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// makeRoom keeps the number of tracked peers within maxTracked. Peers whose bucket has refilled are indistinguishable
+// from a new bucket so they are removed first, if that is not enough an arbitrary peer is removed.
+func (fl *newFlowLimiter) makeRoom(now time.Time) {
+	if len(fl.buckets) < fl.maxTracked {
+		return
+	}
+
+	for vpnIp, b := range fl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.limit.rate >= b.limit.burst {
+			delete(fl.buckets, vpnIp)
+		}
+	}
+
+	for vpnIp := range fl.buckets {
+		if len(fl.buckets) < fl.maxTracked {
+			break
+		}
+		delete(fl.buckets, vpnIp)
+	}
+}
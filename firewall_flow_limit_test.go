@@ -0,0 +1,178 @@
+package nebula
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFlowLimitTestHost(ip string, groups ...string) *HostInfo {
+	c := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           ip,
+			Ips:            []*net.IPNet{{IP: net.ParseIP(ip), Mask: net.IPMask{255, 255, 255, 0}}},
+			Groups:         groups,
+			InvertedGroups: map[string]struct{}{},
+		},
+	}
+	for _, g := range groups {
+		c.Details.InvertedGroups[g] = struct{}{}
+	}
+
+	h := &HostInfo{ConnectionState: &ConnectionState{peerCert: c}, vpnIp: netip.MustParseAddr(ip)}
+	h.CreateRemoteCIDR(c)
+	return h
+}
+
+func Test_newFlowLimiterFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Disabled by default
+	fl, err := newFlowLimiterFromConfig(c)
+	assert.NoError(t, err)
+	assert.Nil(t, fl)
+
+	c.Settings["firewall"] = map[interface{}]interface{}{
+		"new_flow_limit": map[interface{}]interface{}{
+			"rate": 50,
+			"groups": map[interface{}]interface{}{
+				"untrusted": map[interface{}]interface{}{"rate": 5, "burst": 10},
+				"servers":   map[interface{}]interface{}{"rate": 0},
+				"laptops":   map[interface{}]interface{}{"rate": 20},
+			},
+		},
+	}
+	fl, err = newFlowLimiterFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, flowRate{rate: 50, burst: 50}, fl.defaultLimit)
+	assert.Equal(t, defaultNewFlowLimitMaxTracked, fl.maxTracked)
+
+	limitFor := func(groups ...string) flowRate {
+		return fl.limitFor(newFlowLimitTestHost("10.0.0.1", groups...).GetCert())
+	}
+	assert.Equal(t, flowRate{rate: 50, burst: 50}, limitFor())
+	assert.Equal(t, flowRate{rate: 50, burst: 50}, limitFor("other"))
+	assert.Equal(t, flowRate{rate: 5, burst: 10}, limitFor("untrusted"))
+	assert.Equal(t, flowRate{rate: 0, burst: 0}, limitFor("servers"), "a group rate of 0 is unlimited")
+	assert.Equal(t, flowRate{rate: 5, burst: 10}, limitFor("untrusted", "laptops", "servers"), "the most restrictive group wins")
+	assert.Equal(t, flowRate{rate: 20, burst: 20}, limitFor("laptops", "servers"))
+
+	c.Settings["firewall"] = map[interface{}]interface{}{
+		"new_flow_limit": map[interface{}]interface{}{
+			"groups": map[interface{}]interface{}{"bad": map[interface{}]interface{}{"rate": "nope"}},
+		},
+	}
+	_, err = newFlowLimiterFromConfig(c)
+	assert.EqualError(t, err, "firewall.new_flow_limit.groups.bad.rate must be a positive integer")
+}
+
+func Test_newFlowLimiter_allow(t *testing.T) {
+	fl := &newFlowLimiter{
+		buckets:       map[netip.Addr]*flowBucket{},
+		defaultLimit:  flowRate{rate: 2, burst: 4},
+		maxTracked:    2,
+		metricDropped: metrics.NewCounter(),
+	}
+
+	now := time.Now()
+	a := netip.MustParseAddr("10.0.0.1")
+
+	for i := 0; i < 4; i++ {
+		assert.True(t, fl.allow(a, nil, now))
+	}
+	assert.False(t, fl.allow(a, nil, now))
+	assert.Equal(t, int64(1), fl.metricDropped.Count())
+
+	// Refills at rate per second
+	now = now.Add(time.Second)
+	assert.True(t, fl.allow(a, nil, now))
+	assert.True(t, fl.allow(a, nil, now))
+	assert.False(t, fl.allow(a, nil, now))
+
+	// State is bounded, an idle bucket is evicted before a busy one
+	assert.True(t, fl.allow(netip.MustParseAddr("10.0.0.2"), nil, now))
+	now = now.Add(10 * time.Second)
+	for fl.allow(a, nil, now) {
+	}
+	assert.True(t, fl.allow(netip.MustParseAddr("10.0.0.3"), nil, now))
+	assert.Len(t, fl.buckets, 2)
+	assert.Contains(t, fl.buckets, a)
+	assert.NotContains(t, fl.buckets, netip.MustParseAddr("10.0.0.2"))
+}
+
+func TestFirewall_Drop_SYNFlood(t *testing.T) {
+	l := test.NewLogger()
+	attacker := newFlowLimitTestHost("10.0.0.2")
+	other := newFlowLimitTestHost("10.0.0.3")
+	trusted := newFlowLimitTestHost("10.0.0.4", "servers")
+
+	c := config.NewC(l)
+	c.Settings["firewall"] = map[interface{}]interface{}{
+		"new_flow_limit": map[interface{}]interface{}{
+			"rate": 10,
+			"groups": map[interface{}]interface{}{
+				"servers": map[interface{}]interface{}{"rate": 0},
+			},
+		},
+	}
+
+	myCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Ips: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 1), Mask: net.IPMask{255, 255, 255, 0}}},
+	}}
+	fw := NewFirewall(l, time.Minute, time.Minute, time.Minute, myCert)
+	fl, err := newFlowLimiterFromConfig(c)
+	require.NoError(t, err)
+	fl.metricDropped = metrics.NewCounter()
+	fw.newFlowLimit = fl
+	require.NoError(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", netip.Prefix{}, netip.Prefix{}, "", ""))
+	cp := cert.NewCAPool()
+
+	syn := func(h *HostInfo, port uint16) firewall.Packet {
+		return firewall.Packet{
+			LocalIP:    netip.MustParseAddr("10.0.0.1"),
+			RemoteIP:   h.vpnIp,
+			LocalPort:  22,
+			RemotePort: port,
+			Protocol:   firewall.ProtoTCP,
+		}
+	}
+
+	// Every SYN is from a new source port, so every packet is a new flow
+	allowed := 0
+	for port := uint16(1000); port < 1100; port++ {
+		switch err := fw.Drop(syn(attacker, port), true, false, attacker, cp, nil); err {
+		case nil:
+			allowed++
+		default:
+			assert.Equal(t, ErrNewFlowRateLimited, err)
+		}
+	}
+	assert.InDelta(t, 10, allowed, 1, "only the burst should get through")
+	assert.Equal(t, int64(100-allowed), fl.metricDropped.Count())
+
+	// Flows that were established before the flood are unaffected
+	assert.NoError(t, fw.Drop(syn(attacker, 1000), true, false, attacker, cp, nil))
+
+	// Other peers have their own budget and exempt groups are never limited
+	assert.NoError(t, fw.Drop(syn(other, 1000), true, false, other, cp, nil))
+	for port := uint16(1000); port < 1100; port++ {
+		assert.NoError(t, fw.Drop(syn(trusted, port), true, false, trusted, cp, nil))
+	}
+
+	// Outbound flows are not limited
+	for port := uint16(2000); port < 2100; port++ {
+		p := syn(attacker, port)
+		p.LocalPort, p.RemotePort = port, 22
+		assert.NotEqual(t, ErrNewFlowRateLimited, fw.Drop(p, false, false, attacker, cp, nil))
+	}
+}
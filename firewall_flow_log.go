@@ -0,0 +1,120 @@
+package nebula
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+const defaultFlowLogRate = 100
+
+// flowLogger writes an audit record for new flows the firewall allowed, or for the packets it dropped with the rule
+// responsible. Only 1 in sample flows is considered and at most rate records are written per second, flows that are not
+// logged because of the rate are counted.
+type flowLogger struct {
+	sample uint64
+	rate   int
+
+	sync.Mutex
+	seen        uint64
+	windowStart time.Time
+	windowCount int
+
+	metricSuppressed metrics.Counter
+	l                *logrus.Logger
+}
+
+func newFlowLoggerFromConfig(l *logrus.Logger, c *config.C) (*flowLogger, error) {
+	return newSampledFlowLoggerFromConfig(l, c, "firewall.flow_log")
+}
+
+// newRejectLoggerFromConfig returns the flowLogger for firewall.reject_log, nil if it is disabled
+func newRejectLoggerFromConfig(l *logrus.Logger, c *config.C) (*flowLogger, error) {
+	return newSampledFlowLoggerFromConfig(l, c, "firewall.reject_log")
+}
+
+func newSampledFlowLoggerFromConfig(l *logrus.Logger, c *config.C, key string) (*flowLogger, error) {
+	if !c.GetBool(key+".enabled", false) {
+		return nil, nil
+	}
+
+	sample := c.GetInt(key+".sample", 1)
+	if sample < 1 {
+		return nil, fmt.Errorf("%s.sample must be at least 1", key)
+	}
+
+	rate := c.GetInt(key+".rate", defaultFlowLogRate)
+	if rate < 1 {
+		return nil, fmt.Errorf("%s.rate must be at least 1", key)
+	}
+
+	return &flowLogger{
+		sample:           uint64(sample),
+		rate:             rate,
+		metricSuppressed: metrics.GetOrRegisterCounter(key+".suppressed", nil),
+		l:                l,
+	}, nil
+}
+
+// log records a new flow allowed by rule, fp is the inner 5-tuple oriented to this node
+func (fl *flowLogger) log(fp firewall.Packet, incoming bool, h *HostInfo, rule string, now time.Time) {
+	if !fl.allow(now) {
+		return
+	}
+
+	fl.l.WithField("vpnIp", h.vpnIp).
+		WithField("direction", flowDirection(incoming)).
+		WithField("fwPacket", fp).
+		WithField("rule", rule).
+		Info("Flow allowed")
+}
+
+// logReject records a packet dropped by rule for reason, fp is the inner 5-tuple oriented to this node
+func (fl *flowLogger) logReject(fp firewall.Packet, incoming bool, h *HostInfo, rule string, reason error, now time.Time) {
+	if !fl.allow(now) {
+		return
+	}
+
+	fl.l.WithField("vpnIp", h.vpnIp).
+		WithField("direction", flowDirection(incoming)).
+		WithField("fwPacket", fp).
+		WithField("rule", rule).
+		WithField("reason", reason).
+		Info("Flow rejected")
+}
+
+func flowDirection(incoming bool) string {
+	if incoming {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+// allow applies the sampling and the per second rate limit
+func (fl *flowLogger) allow(now time.Time) bool {
+	fl.Lock()
+	defer fl.Unlock()
+
+	fl.seen++
+	if fl.seen%fl.sample != 0 {
+		return false
+	}
+
+	if now.Sub(fl.windowStart) >= time.Second {
+		fl.windowStart = now
+		fl.windowCount = 0
+	}
+
+	if fl.windowCount >= fl.rate {
+		fl.metricSuppressed.Inc(1)
+		return false
+	}
+
+	fl.windowCount++
+	return true
+}
@@ -0,0 +1,215 @@
+package nebula
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_newFlowLoggerFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Disabled by default
+	fl, err := newFlowLoggerFromConfig(l, c)
+	assert.NoError(t, err)
+	assert.Nil(t, fl)
+
+	c.Settings["firewall"] = map[interface{}]interface{}{"flow_log": map[interface{}]interface{}{"enabled": true}}
+	fl, err = newFlowLoggerFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), fl.sample)
+	assert.Equal(t, defaultFlowLogRate, fl.rate)
+
+	c.Settings["firewall"] = map[interface{}]interface{}{"flow_log": map[interface{}]interface{}{"enabled": true, "sample": 0}}
+	_, err = newFlowLoggerFromConfig(l, c)
+	assert.EqualError(t, err, "firewall.flow_log.sample must be at least 1")
+}
+
+func Test_flowLogger_allow(t *testing.T) {
+	fl := &flowLogger{sample: 2, rate: 3, metricSuppressed: metrics.NewCounter()}
+
+	now := time.Now()
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if fl.allow(now) {
+			allowed++
+		}
+	}
+	assert.Equal(t, 3, allowed, "half are sampled and the rate caps the rest")
+	assert.Equal(t, int64(2), fl.metricSuppressed.Count())
+
+	now = now.Add(time.Second)
+	assert.False(t, fl.allow(now))
+	assert.True(t, fl.allow(now))
+}
+
+func TestFirewall_Drop_FlowLog(t *testing.T) {
+	l := logrus.New()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+	l.SetFormatter(&logrus.JSONFormatter{})
+
+	c := config.NewC(l)
+	c.Settings["firewall"] = map[interface{}]interface{}{
+		"flow_log": map[interface{}]interface{}{"enabled": true},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "group": "admins"},
+			map[interface{}]interface{}{"port": "443", "proto": "tcp", "host": "any"},
+		},
+		"outbound": []interface{}{
+			map[interface{}]interface{}{"port": "any", "proto": "any", "host": "any"},
+		},
+	}
+
+	myCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Ips: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 1), Mask: net.IPMask{255, 255, 255, 0}}},
+	}}
+	fw, err := NewFirewallFromConfig(l, myCert, c)
+	require.NoError(t, err)
+	cp := cert.NewCAPool()
+
+	h := newFlowLimitTestHost("10.0.0.2")
+	p := firewall.Packet{
+		LocalIP:    netip.MustParseAddr("10.0.0.1"),
+		RemoteIP:   h.vpnIp,
+		LocalPort:  443,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	ob.Reset()
+	before := fw.incomingMetrics.accepted.Count()
+	require.NoError(t, fw.Drop(p, true, false, h, cp, nil))
+	assert.Equal(t, 1, fw.Conntrack.Conns[p].rule)
+	assert.Equal(t, before+1, fw.incomingMetrics.accepted.Count())
+
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(ob.Bytes(), &record))
+	assert.Equal(t, "Flow allowed", record["msg"])
+	assert.Equal(t, "10.0.0.2", record["vpnIp"])
+	assert.Equal(t, "inbound", record["direction"])
+	assert.Equal(t, "firewall.inbound.1", record["rule"])
+	assert.Equal(t, float64(443), record["fwPacket"].(map[string]interface{})["LocalPort"])
+
+	// Only new flows are logged
+	ob.Reset()
+	require.NoError(t, fw.Drop(p, true, false, h, cp, nil))
+	assert.Empty(t, ob.String())
+
+	// Dropped flows are not logged
+	p.LocalPort = 22
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, false, h, cp, nil))
+	assert.Empty(t, ob.String())
+
+	admin := newFlowLimitTestHost("10.0.0.3", "admins")
+	p.RemoteIP = admin.vpnIp
+	require.NoError(t, fw.Drop(p, true, false, admin, cp, nil))
+	assert.True(t, strings.Contains(ob.String(), `"rule":"firewall.inbound.0"`))
+
+	ob.Reset()
+	p.LocalPort, p.RemotePort = 40000, 80
+	require.NoError(t, fw.Drop(p, false, false, admin, cp, nil))
+	assert.True(t, strings.Contains(ob.String(), `"rule":"firewall.outbound.0"`))
+	assert.True(t, strings.Contains(ob.String(), `"direction":"outbound"`))
+}
+
+func TestFirewall_DropRule(t *testing.T) {
+	l := logrus.New()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+	l.SetFormatter(&logrus.JSONFormatter{})
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+firewall:
+  reject_log: {enabled: true}
+  conntrack: {max_connections: 2}
+  new_flow_limit: {rate: 1, burst: 1}
+  inbound:
+    - {port: 22, proto: tcp, group: admins}
+    - {port: 443, proto: tcp, host: any}
+  outbound:
+    - {port: any, proto: any, host: any}
+`))
+
+	myCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Ips: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 1), Mask: net.IPMask{255, 255, 255, 0}}},
+	}}
+	fw, err := NewFirewallFromConfig(l, myCert, c)
+	require.NoError(t, err)
+	cp := cert.NewCAPool()
+
+	h := newFlowLimitTestHost("10.0.0.2")
+	packet := func(localPort uint16) firewall.Packet {
+		return firewall.Packet{
+			LocalIP:    netip.MustParseAddr("10.0.0.1"),
+			RemoteIP:   h.vpnIp,
+			LocalPort:  localPort,
+			RemotePort: 40000,
+			Protocol:   firewall.ProtoTCP,
+		}
+	}
+
+	assertDrop := func(p firewall.Packet, incoming bool, wantRule string, wantErr error) {
+		t.Helper()
+		ob.Reset()
+		rule, err := fw.DropRule(p, incoming, false, h, cp, nil)
+		assert.Equal(t, wantErr, err)
+		assert.Equal(t, wantRule, rule)
+		if wantErr == nil {
+			assert.Empty(t, ob.String())
+			return
+		}
+
+		// A full conntrack table logs on its own, the reject record is last
+		lines := strings.Split(strings.TrimSpace(ob.String()), "\n")
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &record))
+		assert.Equal(t, "Flow rejected", record["msg"])
+		assert.Equal(t, wantRule, record["rule"])
+		assert.Equal(t, wantErr.Error(), record["reason"])
+		assert.Equal(t, float64(p.LocalPort), record["fwPacket"].(map[string]interface{})["LocalPort"])
+	}
+
+	p := packet(443)
+	p.RemoteIP = netip.MustParseAddr("10.0.0.9")
+	assertDrop(p, true, FirewallRuleRemoteIP, ErrInvalidRemoteIP)
+
+	p = packet(443)
+	p.LocalIP = netip.MustParseAddr("10.0.1.1")
+	assertDrop(p, true, FirewallRuleLocalIP, ErrInvalidLocalIP)
+
+	assertDrop(packet(22), true, FirewallRuleNoMatch, ErrNoMatchingRule)
+	assertDrop(packet(443), true, "", nil)
+	assertDrop(packet(443), true, "", nil)
+	assertDrop(packet(444), true, FirewallRuleNoMatch, ErrNoMatchingRule)
+
+	// The new flow limit and conntrack table are checked after an allow rule matched
+	p = packet(443)
+	p.RemotePort = 40001
+	assertDrop(p, true, FirewallRuleNewFlowLimit, ErrNewFlowRateLimited)
+	assertDrop(packet(8080), false, "", nil)
+	assertDrop(packet(8081), false, FirewallRuleConntrackMax, ErrConntrackFull)
+
+	// The rule is in the drop event too
+	d := &dropWatch{}
+	events, stop, err := d.watch(0)
+	require.NoError(t, err)
+	defer stop()
+	d.notify(packet(22), true, h, FirewallRuleNoMatch, ErrNoMatchingRule)
+	assert.Equal(t, FirewallRuleNoMatch, (<-events).Rule)
+}
@@ -0,0 +1,190 @@
+package nebula
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/slackhq/nebula/firewall"
+)
+
+// FirewallRuleset is the firewall as it is enforced, reported on the control socket to check it against the config.
+// Every default a rule left to the firewall is resolved: the local cidr a rule without one was given, whether a rule
+// matches any peer, the protocol and port range. It is the firewall installed by the last successful reload, a reload
+// that failed leaves the previous one in place.
+type FirewallRuleset struct {
+	// RulesVersion goes up by one every time a new firewall is installed
+	RulesVersion   uint16 `json:"rulesVersion"`
+	RulesHash      string `json:"rulesHash"`
+	InboundAction  string `json:"inboundAction"`
+	OutboundAction string `json:"outboundAction"`
+	// DefaultLocalCIDRAny is firewall.default_local_cidr_any, it decides the local cidr of rules without one
+	DefaultLocalCIDRAny bool                   `json:"defaultLocalCIDRAny"`
+	Inbound             []FirewallCompiledRule `json:"inbound"`
+	Outbound            []FirewallCompiledRule `json:"outbound"`
+}
+
+// FirewallCompiledRule is a rule as it was added to the firewall tables. A packet matches it if its protocol, port, CA
+// and local address match and the peer is any or matches one of the groups, host, cidr or attributes.
+type FirewallCompiledRule struct {
+	// Name is the config name of the rule, see Firewall.RuleName
+	Name  string `json:"name"`
+	Proto string `json:"proto"`
+	// Port is any, fragment, a single port or an inclusive range of ports
+	Port string `json:"port"`
+	// Via is which inbound packets the rule applies to, empty for outbound rules
+	Via    string `json:"via,omitempty"`
+	CAName string `json:"caName,omitempty"`
+	CASha  string `json:"caSha,omitempty"`
+	// AnyPeer is true if the rule matches every peer, the groups, host, cidr and attributes are then irrelevant
+	AnyPeer    bool              `json:"anyPeer"`
+	Groups     []string          `json:"groups,omitempty"`
+	Host       string            `json:"host,omitempty"`
+	Cidr       string            `json:"cidr,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// LocalCidr is the local address range the rule allows, any or a prefix
+	LocalCidr string `json:"localCidr"`
+}
+
+// compileRule records the rule with the index id added with AddRule as the tables see it
+func (f *Firewall) compileRule(incoming bool, id int, proto uint8, startPort, endPort int32, groups []string, host string, ip, localIp netip.Prefix, caName, caSha string, conditions FirewallRuleConditions) {
+	r := FirewallCompiledRule{
+		Proto:     firewallProtoName(proto),
+		Port:      firewallPortRange(startPort, endPort),
+		CAName:    caName,
+		CASha:     caSha,
+		LocalCidr: f.effectiveLocalCIDR(localIp),
+	}
+
+	// An empty peer, as FirewallRule.isAny sees it, is any
+	fr := FirewallRule{}
+	if fr.isAny(groups, host, ip, conditions.Attributes) {
+		r.AnyPeer = true
+	} else {
+		r.Groups = slices.Clone(groups)
+		r.Host = host
+		if ip.IsValid() {
+			r.Cidr = ip.String()
+		}
+		r.Attributes = maps.Clone(conditions.Attributes)
+	}
+
+	r.Name = f.RuleName(incoming, id)
+	if incoming {
+		r.Via = conditions.Via.String()
+		f.compiledIn = append(f.compiledIn, r)
+	} else {
+		f.compiledOut = append(f.compiledOut, r)
+	}
+}
+
+// effectiveLocalCIDR returns the local cidr a rule with localIp allows, as firewallLocalCIDR.addRule resolves it
+func (f *Firewall) effectiveLocalCIDR(localIp netip.Prefix) string {
+	if !localIp.IsValid() {
+		if !f.hasSubnets || f.defaultLocalCIDRAny {
+			return "any"
+		}
+		return f.assignedCIDR.String()
+	}
+
+	if localIp.Bits() == 0 {
+		return "any"
+	}
+	return localIp.String()
+}
+
+// Ruleset returns the rules of the firewall, a firewall is never changed once it is installed so this is consistent
+func (f *Firewall) Ruleset() FirewallRuleset {
+	rs := FirewallRuleset{
+		RulesVersion:        f.rulesVersion,
+		RulesHash:           f.GetRuleHash(),
+		InboundAction:       firewallAction(f.InSendReject),
+		OutboundAction:      firewallAction(f.OutSendReject),
+		DefaultLocalCIDRAny: f.defaultLocalCIDRAny,
+		Inbound:             make([]FirewallCompiledRule, len(f.compiledIn)),
+		Outbound:            make([]FirewallCompiledRule, len(f.compiledOut)),
+	}
+
+	for i, r := range f.compiledIn {
+		rs.Inbound[i] = r.copy()
+	}
+	for i, r := range f.compiledOut {
+		rs.Outbound[i] = r.copy()
+	}
+	return rs
+}
+
+func (r FirewallCompiledRule) copy() FirewallCompiledRule {
+	r.Groups = slices.Clone(r.Groups)
+	r.Attributes = maps.Clone(r.Attributes)
+	return r
+}
+
+// String is a readable one line form of the rule
+func (r FirewallCompiledRule) String() string {
+	peer := "any"
+	if !r.AnyPeer {
+		var peers []string
+		if len(r.Groups) > 0 {
+			peers = append(peers, "groups "+strings.Join(r.Groups, ","))
+		}
+		if r.Host != "" {
+			peers = append(peers, "host "+r.Host)
+		}
+		if r.Cidr != "" {
+			peers = append(peers, "cidr "+r.Cidr)
+		}
+		if len(r.Attributes) > 0 {
+			// fmt prints maps sorted by key
+			peers = append(peers, fmt.Sprintf("attributes %v", r.Attributes))
+		}
+		peer = strings.Join(peers, " or ")
+	}
+
+	s := fmt.Sprintf("%s: %s port %s from %s to %s", r.Name, r.Proto, r.Port, peer, r.LocalCidr)
+	if r.Via != "" && r.Via != FirewallViaAny.String() {
+		s += " via " + r.Via
+	}
+	if r.CAName != "" {
+		s += " ca_name " + r.CAName
+	}
+	if r.CASha != "" {
+		s += " ca_sha " + r.CASha
+	}
+	return s
+}
+
+func firewallAction(reject bool) string {
+	if reject {
+		return "reject"
+	}
+	return "drop"
+}
+
+func firewallProtoName(proto uint8) string {
+	switch proto {
+	case firewall.ProtoTCP:
+		return "tcp"
+	case firewall.ProtoUDP:
+		return "udp"
+	case firewall.ProtoICMP:
+		return "icmp"
+	case firewall.ProtoAny:
+		return "any"
+	}
+	return fmt.Sprintf("unknown %v", proto)
+}
+
+func firewallPortRange(startPort, endPort int32) string {
+	switch {
+	case startPort == firewall.PortAny:
+		return "any"
+	case startPort == firewall.PortFragment:
+		return "fragment"
+	case startPort == endPort:
+		return fmt.Sprintf("%d", startPort)
+	}
+	return fmt.Sprintf("%d-%d", startPort, endPort)
+}
@@ -0,0 +1,60 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_Ruleset(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Ips:     []*net.IPNet{{IP: net.IPv4(10, 128, 0, 1), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+		Subnets: []*net.IPNet{{IP: net.IPv4(192, 168, 1, 0), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+	}}
+	conf := config.NewC(l)
+	require.NoError(t, conf.LoadString(`
+firewall:
+  default_local_cidr_any: false
+  inbound_action: reject
+  outbound:
+    - {port: any, proto: any, host: any}
+  inbound:
+    - {port: 443, proto: tcp, groups: [web, ops]}
+    - {port: 8000-8080, proto: udp, host: laptop, local_cidr: 192.168.1.0/24, via: relay}
+    - {port: fragment, proto: any, group: any, ca_name: ca}
+    - {code: any, proto: icmp, cidr: 10.128.0.0/24, attributes: {site: a}}
+`))
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+
+	rs := fw.Ruleset()
+	assert.Equal(t, fw.GetRuleHash(), rs.RulesHash)
+	assert.Equal(t, "reject", rs.InboundAction)
+	assert.Equal(t, "drop", rs.OutboundAction)
+	assert.False(t, rs.DefaultLocalCIDRAny)
+
+	assert.Equal(t, []FirewallCompiledRule{
+		{Name: "firewall.outbound.0", Proto: "any", Port: "any", AnyPeer: true, LocalCidr: "10.128.0.1/32"},
+	}, rs.Outbound)
+	assert.Equal(t, []FirewallCompiledRule{
+		{Name: "firewall.inbound.0", Proto: "tcp", Port: "443", Via: "any", Groups: []string{"web", "ops"}, LocalCidr: "10.128.0.1/32"},
+		{Name: "firewall.inbound.1", Proto: "udp", Port: "8000-8080", Via: "relay", Host: "laptop", LocalCidr: "192.168.1.0/24"},
+		{Name: "firewall.inbound.2", Proto: "any", Port: "fragment", Via: "any", CAName: "ca", AnyPeer: true, LocalCidr: "10.128.0.1/32"},
+		{Name: "firewall.inbound.3", Proto: "icmp", Port: "any", Via: "any", Cidr: "10.128.0.0/24", Attributes: map[string]string{"site": "a"}, LocalCidr: "10.128.0.1/32"},
+	}, rs.Inbound)
+
+	assert.Equal(t, "firewall.inbound.0: tcp port 443 from groups web,ops to 10.128.0.1/32", rs.Inbound[0].String())
+	assert.Equal(t, "firewall.inbound.1: udp port 8000-8080 from host laptop to 192.168.1.0/24 via relay", rs.Inbound[1].String())
+	assert.Equal(t, "firewall.inbound.2: any port fragment from any to 10.128.0.1/32 ca_name ca", rs.Inbound[2].String())
+	assert.Equal(t, "firewall.inbound.3: icmp port any from cidr 10.128.0.0/24 or attributes map[site:a] to 10.128.0.1/32", rs.Inbound[3].String())
+
+	t.Log("The ruleset is a copy")
+	rs.Inbound[0].Groups[0] = "changed"
+	assert.Equal(t, []string{"web", "ops"}, fw.Ruleset().Inbound[0].Groups)
+}
@@ -164,44 +164,44 @@ func TestFirewall_Drop(t *testing.T) {
 	cp := cert.NewCAPool()
 
 	// Drop outbound
-	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, false, &h, cp, nil))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, false, false, &h, cp, nil))
 	// Allow inbound
 	resetConntrack(fw)
-	assert.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, true, false, &h, cp, nil))
 	// Allow outbound because conntrack
-	assert.NoError(t, fw.Drop(p, false, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, false, false, &h, cp, nil))
 
 	// test remote mismatch
 	oldRemote := p.RemoteIP
 	p.RemoteIP = netip.MustParseAddr("1.2.3.10")
-	assert.Equal(t, fw.Drop(p, false, &h, cp, nil), ErrInvalidRemoteIP)
+	assert.Equal(t, fw.Drop(p, false, false, &h, cp, nil), ErrInvalidRemoteIP)
 	p.RemoteIP = oldRemote
 
 	// ensure signer doesn't get in the way of group checks
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", netip.Prefix{}, netip.Prefix{}, "", "signer-shasum"))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", netip.Prefix{}, netip.Prefix{}, "", "signer-shasum-bad"))
-	assert.Equal(t, fw.Drop(p, true, &h, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop(p, true, false, &h, cp, nil), ErrNoMatchingRule)
 
 	// test caSha doesn't drop on match
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", netip.Prefix{}, netip.Prefix{}, "", "signer-shasum-bad"))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", netip.Prefix{}, netip.Prefix{}, "", "signer-shasum"))
-	assert.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, true, false, &h, cp, nil))
 
 	// ensure ca name doesn't get in the way of group checks
 	cp.CAs["signer-shasum"] = &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "ca-good"}}
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", netip.Prefix{}, netip.Prefix{}, "ca-good", ""))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", netip.Prefix{}, netip.Prefix{}, "ca-good-bad", ""))
-	assert.Equal(t, fw.Drop(p, true, &h, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop(p, true, false, &h, cp, nil), ErrNoMatchingRule)
 
 	// test caName doesn't drop on match
 	cp.CAs["signer-shasum"] = &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "ca-good"}}
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", netip.Prefix{}, netip.Prefix{}, "ca-good-bad", ""))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", netip.Prefix{}, netip.Prefix{}, "ca-good", ""))
-	assert.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, true, false, &h, cp, nil))
 }
 
 func BenchmarkFirewallTable_match(b *testing.B) {
@@ -211,8 +211,8 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 	}
 
 	pfix := netip.MustParsePrefix("172.1.1.1/32")
-	_ = ft.TCP.addRule(f, 10, 10, []string{"good-group"}, "good-host", pfix, netip.Prefix{}, "", "")
-	_ = ft.TCP.addRule(f, 100, 100, []string{"good-group"}, "good-host", netip.Prefix{}, pfix, "", "")
+	_ = ft.TCP.addRule(f, 0, 10, 10, []string{"good-group"}, "good-host", pfix, netip.Prefix{}, "", "", nil)
+	_ = ft.TCP.addRule(f, 1, 100, 100, []string{"good-group"}, "good-host", netip.Prefix{}, pfix, "", "", nil)
 	cp := cert.NewCAPool()
 
 	b.Run("fail on proto", func(b *testing.B) {
@@ -411,10 +411,82 @@ func TestFirewall_Drop2(t *testing.T) {
 	cp := cert.NewCAPool()
 
 	// h1/c1 lacks the proper groups
-	assert.Error(t, fw.Drop(p, true, &h1, cp, nil), ErrNoMatchingRule)
+	assert.Error(t, fw.Drop(p, true, false, &h1, cp, nil), ErrNoMatchingRule)
 	// c has the proper groups
 	resetConntrack(fw)
-	assert.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, true, false, &h, cp, nil))
+}
+
+func TestFirewall_DropAttributes(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	p := firewall.Packet{
+		LocalIP:    netip.MustParseAddr("1.2.3.4"),
+		RemoteIP:   netip.MustParseAddr("1.2.3.4"),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+		Fragment:   false,
+	}
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	newHost := func(attributes map[string]string) *HostInfo {
+		c := cert.NebulaCertificate{
+			Details: cert.NebulaCertificateDetails{
+				Name:           "host1",
+				Ips:            []*net.IPNet{&ipNet},
+				InvertedGroups: map[string]struct{}{"default-group": {}},
+				Attributes:     attributes,
+			},
+		}
+		h := &HostInfo{
+			ConnectionState: &ConnectionState{
+				peerCert: &c,
+			},
+			vpnIp: netip.MustParseAddr(ipNet.IP.String()),
+		}
+		h.CreateRemoteCIDR(&c)
+		return h
+	}
+
+	prod := newHost(map[string]string{"env": "production", "department": "eng"})
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, prod.ConnectionState.peerCert)
+	assert.NoError(t, fw.AddRuleWithConditions(true, firewall.ProtoAny, 0, 0, []string{}, "", netip.Prefix{}, netip.Prefix{}, "", "", FirewallRuleConditions{Attributes: map[string]string{"env": "production", "department": "eng"}}))
+	cp := cert.NewCAPool()
+
+	// Every attribute must be present with the same value
+	assert.NoError(t, fw.Drop(p, true, false, prod, cp, nil))
+	resetConntrack(fw)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, false, newHost(map[string]string{"env": "production"}), cp, nil))
+	resetConntrack(fw)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, false, newHost(map[string]string{"env": "staging", "department": "eng"}), cp, nil))
+	resetConntrack(fw)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, false, newHost(nil), cp, nil))
+
+	// Extra attributes on the certificate do not matter
+	resetConntrack(fw)
+	assert.NoError(t, fw.Drop(p, true, false, newHost(map[string]string{"env": "production", "department": "eng", "device-class": "laptop"}), cp, nil))
+
+	// Attributes are alternatives to groups like host and cidr are
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, prod.ConnectionState.peerCert)
+	assert.NoError(t, fw.AddRuleWithConditions(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", netip.Prefix{}, netip.Prefix{}, "", "", FirewallRuleConditions{Attributes: map[string]string{"env": "production"}}))
+	assert.NoError(t, fw.Drop(p, true, false, prod, cp, nil))
+	resetConntrack(fw)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, false, newHost(nil), cp, nil))
+
+	// Rules without attributes hash the same as before
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, prod.ConnectionState.peerCert)
+	assert.NoError(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", netip.Prefix{}, netip.Prefix{}, "", ""))
+	assert.NotContains(t, fw.rules, "attributes")
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, prod.ConnectionState.peerCert)
+	assert.NoError(t, fw.AddRuleWithConditions(true, firewall.ProtoAny, 0, 0, []string{}, "", netip.Prefix{}, netip.Prefix{}, "", "", FirewallRuleConditions{Attributes: map[string]string{"env": "production", "department": "eng"}}))
+	assert.Contains(t, fw.rules, ", attributes: map[department:eng env:production]")
 }
 
 func TestFirewall_Drop3(t *testing.T) {
@@ -494,13 +566,91 @@ func TestFirewall_Drop3(t *testing.T) {
 	cp := cert.NewCAPool()
 
 	// c1 should pass because host match
-	assert.NoError(t, fw.Drop(p, true, &h1, cp, nil))
+	assert.NoError(t, fw.Drop(p, true, false, &h1, cp, nil))
 	// c2 should pass because ca sha match
 	resetConntrack(fw)
-	assert.NoError(t, fw.Drop(p, true, &h2, cp, nil))
+	assert.NoError(t, fw.Drop(p, true, false, &h2, cp, nil))
 	// c3 should fail because no match
 	resetConntrack(fw)
-	assert.Equal(t, fw.Drop(p, true, &h3, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop(p, true, false, &h3, cp, nil), ErrNoMatchingRule)
+}
+
+func TestFirewall_DropVia(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"default-group"},
+			InvertedGroups: map[string]struct{}{"default-group": {}},
+			Issuer:         "signer-shasum",
+		},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+		},
+		vpnIp: netip.MustParseAddr("1.2.3.4"),
+	}
+	h.CreateRemoteCIDR(&c)
+
+	packet := func(port uint16) firewall.Packet {
+		return firewall.Packet{
+			LocalIP:    netip.MustParseAddr("1.2.3.4"),
+			RemoteIP:   netip.MustParseAddr("1.2.3.4"),
+			LocalPort:  port,
+			RemotePort: 90,
+			Protocol:   firewall.ProtoTCP,
+		}
+	}
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 80, 80, []string{"any"}, "", netip.Prefix{}, netip.Prefix{}, "", ""))
+	assert.NoError(t, fw.AddRuleWithConditions(true, firewall.ProtoTCP, 22, 22, []string{"any"}, "", netip.Prefix{}, netip.Prefix{}, "", "", FirewallRuleConditions{Via: FirewallViaDirect}))
+	assert.NoError(t, fw.AddRuleWithConditions(true, firewall.ProtoTCP, 53, 53, []string{"any"}, "", netip.Prefix{}, netip.Prefix{}, "", "", FirewallRuleConditions{Via: FirewallViaRelay}))
+	assert.Error(t, fw.AddRuleWithConditions(false, firewall.ProtoTCP, 22, 22, []string{"any"}, "", netip.Prefix{}, netip.Prefix{}, "", "", FirewallRuleConditions{Via: FirewallViaDirect}))
+	cp := cert.NewCAPool()
+
+	// Any path
+	assert.NoError(t, fw.Drop(packet(80), true, false, &h, cp, nil))
+	assert.NoError(t, fw.Drop(packet(80), true, true, &h, cp, nil))
+
+	// The same peer is only allowed in on 22 directly
+	assert.NoError(t, fw.Drop(packet(22), true, false, &h, cp, nil))
+	resetConntrack(fw)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(packet(22), true, true, &h, cp, nil))
+
+	// And only on 53 through a relay
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(packet(53), true, false, &h, cp, nil))
+	assert.NoError(t, fw.Drop(packet(53), true, true, &h, cp, nil))
+
+	// A connection allowed directly is checked again when the peer moves to a relay, replies are not affected
+	resetConntrack(fw)
+	assert.NoError(t, fw.Drop(packet(22), true, false, &h, cp, nil))
+	assert.NoError(t, fw.Drop(packet(22), false, false, &h, cp, nil))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(packet(22), true, true, &h, cp, nil))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(packet(22), false, false, &h, cp, nil))
+
+	// A connection on an any path rule survives the move
+	resetConntrack(fw)
+	assert.NoError(t, fw.Drop(packet(80), true, false, &h, cp, nil))
+	assert.NoError(t, fw.Drop(packet(80), true, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop(packet(80), true, false, &h, cp, nil))
+
+	// The routine cache does not let a packet on the other path skip the check
+	resetConntrack(fw)
+	localCache := firewall.ConntrackCache{}
+	assert.NoError(t, fw.Drop(packet(22), true, false, &h, cp, localCache))
+	assert.NoError(t, fw.Drop(packet(22), true, false, &h, cp, localCache))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(packet(22), true, true, &h, cp, localCache))
 }
 
 func TestFirewall_DropConntrackReload(t *testing.T) {
@@ -544,12 +694,12 @@ func TestFirewall_DropConntrackReload(t *testing.T) {
 	cp := cert.NewCAPool()
 
 	// Drop outbound
-	assert.Equal(t, fw.Drop(p, false, &h, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop(p, false, false, &h, cp, nil), ErrNoMatchingRule)
 	// Allow inbound
 	resetConntrack(fw)
-	assert.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, true, false, &h, cp, nil))
 	// Allow outbound because conntrack
-	assert.NoError(t, fw.Drop(p, false, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, false, false, &h, cp, nil))
 
 	oldFw := fw
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
@@ -558,7 +708,7 @@ func TestFirewall_DropConntrackReload(t *testing.T) {
 	fw.rulesVersion = oldFw.rulesVersion + 1
 
 	// Allow outbound because conntrack and new rules allow port 10
-	assert.NoError(t, fw.Drop(p, false, &h, cp, nil))
+	assert.NoError(t, fw.Drop(p, false, false, &h, cp, nil))
 
 	oldFw = fw
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
@@ -567,7 +717,7 @@ func TestFirewall_DropConntrackReload(t *testing.T) {
 	fw.rulesVersion = oldFw.rulesVersion + 1
 
 	// Drop outbound because conntrack doesn't match new ruleset
-	assert.Equal(t, fw.Drop(p, false, &h, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop(p, false, false, &h, cp, nil), ErrNoMatchingRule)
 }
 
 func BenchmarkLookup(b *testing.B) {
@@ -704,7 +854,7 @@ func TestNewFirewallFromConfig(t *testing.T) {
 	conf = config.NewC(l)
 	conf.Settings["firewall"] = map[interface{}]interface{}{"outbound": []interface{}{map[interface{}]interface{}{}}}
 	_, err = NewFirewallFromConfig(l, c, conf)
-	assert.EqualError(t, err, "firewall.outbound rule #0; at least one of host, group, cidr, local_cidr, ca_name, or ca_sha must be provided")
+	assert.EqualError(t, err, "firewall.outbound rule #0; at least one of host, group, attributes, cidr, local_cidr, ca_name, or ca_sha must be provided")
 
 	// Test code/port error
 	conf = config.NewC(l)
@@ -821,6 +971,41 @@ func TestAddFirewallRulesFromConfig(t *testing.T) {
 	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
 	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoAny, startPort: 1, endPort: 1, groups: []string{"a", "b"}, ip: netip.Prefix{}, localIp: netip.Prefix{}}, mf.lastCall)
 
+	// Test via
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "host": "a", "via": "relay"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoAny, startPort: 1, endPort: 1, groups: nil, host: "a", ip: netip.Prefix{}, localIp: netip.Prefix{}, conditions: FirewallRuleConditions{Via: FirewallViaRelay}}, mf.lastCall)
+
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "host": "a", "via": "direct"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, FirewallViaDirect, mf.lastCall.conditions.Via)
+
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "host": "a", "via": "carrier pigeon"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; via was not understood; `carrier pigeon`")
+
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"outbound": []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "host": "a", "via": "relay"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, false, conf, mf), "firewall.outbound rule #0; via is only supported on inbound rules")
+
+	// Test attributes
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "attributes": map[interface{}]interface{}{"env": "production", "tier": 1}}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoAny, startPort: 1, endPort: 1, groups: nil, ip: netip.Prefix{}, localIp: netip.Prefix{}, conditions: FirewallRuleConditions{Attributes: map[string]string{"env": "production", "tier": "1"}}}, mf.lastCall)
+
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "attributes": "env"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; attributes should be a map of attribute names to values")
+
 	// Test Add error
 	conf = config.NewC(l)
 	mf = &mockFirewall{}
@@ -866,16 +1051,17 @@ func TestFirewall_convertRule(t *testing.T) {
 }
 
 type addRuleCall struct {
-	incoming  bool
-	proto     uint8
-	startPort int32
-	endPort   int32
-	groups    []string
-	host      string
-	ip        netip.Prefix
-	localIp   netip.Prefix
-	caName    string
-	caSha     string
+	incoming   bool
+	proto      uint8
+	startPort  int32
+	endPort    int32
+	groups     []string
+	host       string
+	ip         netip.Prefix
+	localIp    netip.Prefix
+	caName     string
+	caSha      string
+	conditions FirewallRuleConditions
 }
 
 type mockFirewall struct {
@@ -884,17 +1070,22 @@ type mockFirewall struct {
 }
 
 func (mf *mockFirewall) AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip netip.Prefix, localIp netip.Prefix, caName string, caSha string) error {
+	return mf.AddRuleWithConditions(incoming, proto, startPort, endPort, groups, host, ip, localIp, caName, caSha, FirewallRuleConditions{})
+}
+
+func (mf *mockFirewall) AddRuleWithConditions(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip netip.Prefix, localIp netip.Prefix, caName string, caSha string, conditions FirewallRuleConditions) error {
 	mf.lastCall = addRuleCall{
-		incoming:  incoming,
-		proto:     proto,
-		startPort: startPort,
-		endPort:   endPort,
-		groups:    groups,
-		host:      host,
-		ip:        ip,
-		localIp:   localIp,
-		caName:    caName,
-		caSha:     caSha,
+		incoming:   incoming,
+		proto:      proto,
+		startPort:  startPort,
+		endPort:    endPort,
+		groups:     groups,
+		host:       host,
+		ip:         ip,
+		localIp:    localIp,
+		caName:     caName,
+		caSha:      caSha,
+		conditions: conditions,
 	}
 
 	err := mf.nextCallReturn
@@ -0,0 +1,130 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/gaissmai/bart"
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+var ErrUnsafeRouteSource = errors.New("inner source is not allowed to use the unsafe route")
+
+// unsafeRouteSource is who may send traffic out one unsafe route, a packet is allowed if its inner source is in cidrs
+// or the peer has any of the groups
+type unsafeRouteSource struct {
+	cidrs  *bart.Table[struct{}]
+	groups []string
+}
+
+// unsafeRouteSources restricts which inner sources may be forwarded out the unsafe routes this node serves. Traffic
+// destined to a route that is not configured is not restricted.
+type unsafeRouteSources struct {
+	routes        *bart.Table[*unsafeRouteSource]
+	metricDropped metrics.Counter
+}
+
+func newUnsafeRouteSourcesFromConfig(c *config.C) (*unsafeRouteSources, error) {
+	raw := c.Get("firewall.unsafe_route_sources")
+	if raw == nil {
+		return nil, nil
+	}
+
+	rawMap, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("firewall.unsafe_route_sources must be a map of routes, got %T", raw)
+	}
+
+	if len(rawMap) == 0 {
+		return nil, nil
+	}
+
+	us := &unsafeRouteSources{
+		routes:        new(bart.Table[*unsafeRouteSource]),
+		metricDropped: metrics.GetOrRegisterCounter("firewall.incoming.dropped.unsafe_route_source", nil),
+	}
+
+	for k, v := range rawMap {
+		rawRoute := fmt.Sprintf("%v", k)
+		route, err := netip.ParsePrefix(rawRoute)
+		if err != nil {
+			return nil, fmt.Errorf("firewall.unsafe_route_sources has an invalid route: %s", rawRoute)
+		}
+
+		rawSource, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("firewall.unsafe_route_sources.%s must be a map with cidrs and groups", rawRoute)
+		}
+
+		source := &unsafeRouteSource{cidrs: new(bart.Table[struct{}])}
+		cidrs, err := toStringList(rawSource["cidrs"])
+		if err != nil {
+			return nil, fmt.Errorf("firewall.unsafe_route_sources.%s.cidrs %s", rawRoute, err)
+		}
+		for _, rawCidr := range cidrs {
+			cidr, err := netip.ParsePrefix(rawCidr)
+			if err != nil {
+				addr, aErr := netip.ParseAddr(rawCidr)
+				if aErr != nil {
+					return nil, fmt.Errorf("firewall.unsafe_route_sources.%s.cidrs has an invalid cidr: %s", rawRoute, rawCidr)
+				}
+				cidr = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			source.cidrs.Insert(cidr.Masked(), struct{}{})
+		}
+
+		source.groups, err = toStringList(rawSource["groups"])
+		if err != nil {
+			return nil, fmt.Errorf("firewall.unsafe_route_sources.%s.groups %s", rawRoute, err)
+		}
+
+		us.routes.Insert(route.Masked(), source)
+	}
+
+	return us, nil
+}
+
+// toStringList accepts a single string or a list of strings
+func toStringList(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		out := make([]string, len(v))
+		for i, s := range v {
+			out[i] = fmt.Sprintf("%v", s)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("must be a string or a list of strings")
+	}
+}
+
+// allow returns false if localIp is served by a restricted unsafe route and neither remoteIp nor the peer is allowed to
+// use it
+func (us *unsafeRouteSources) allow(localIp, remoteIp netip.Addr, peerCert *cert.NebulaCertificate) bool {
+	source, ok := us.routes.Lookup(localIp)
+	if !ok {
+		return true
+	}
+
+	if _, ok := source.cidrs.Lookup(remoteIp); ok {
+		return true
+	}
+
+	if peerCert != nil {
+		for _, group := range source.groups {
+			if _, ok := peerCert.Details.InvertedGroups[group]; ok {
+				return true
+			}
+		}
+	}
+
+	us.metricDropped.Inc(1)
+	return false
+}
@@ -0,0 +1,131 @@
+package nebula
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_newUnsafeRouteSourcesFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Disabled by default
+	us, err := newUnsafeRouteSourcesFromConfig(c)
+	assert.NoError(t, err)
+	assert.Nil(t, us)
+
+	c.Settings["firewall"] = map[interface{}]interface{}{
+		"unsafe_route_sources": map[interface{}]interface{}{
+			"192.168.100.0/24": map[interface{}]interface{}{
+				"cidrs":  []interface{}{"10.0.0.2", "172.16.0.0/16"},
+				"groups": "gateway-users",
+			},
+		},
+	}
+	us, err = newUnsafeRouteSourcesFromConfig(c)
+	require.NoError(t, err)
+	source, ok := us.routes.Lookup(netip.MustParseAddr("192.168.100.1"))
+	require.True(t, ok)
+	assert.Equal(t, []string{"gateway-users"}, source.groups)
+	_, ok = source.cidrs.Lookup(netip.MustParseAddr("172.16.5.5"))
+	assert.True(t, ok)
+	_, ok = source.cidrs.Lookup(netip.MustParseAddr("10.0.0.3"))
+	assert.False(t, ok)
+
+	c.Settings["firewall"] = map[interface{}]interface{}{
+		"unsafe_route_sources": map[interface{}]interface{}{"nope": map[interface{}]interface{}{}},
+	}
+	_, err = newUnsafeRouteSourcesFromConfig(c)
+	assert.EqualError(t, err, "firewall.unsafe_route_sources has an invalid route: nope")
+
+	c.Settings["firewall"] = map[interface{}]interface{}{
+		"unsafe_route_sources": map[interface{}]interface{}{
+			"192.168.100.0/24": map[interface{}]interface{}{"cidrs": []interface{}{"bad"}},
+		},
+	}
+	_, err = newUnsafeRouteSourcesFromConfig(c)
+	assert.EqualError(t, err, "firewall.unsafe_route_sources.192.168.100.0/24.cidrs has an invalid cidr: bad")
+
+	c.Settings["firewall"] = map[interface{}]interface{}{
+		"unsafe_route_sources": map[interface{}]interface{}{
+			"192.168.100.0/24": map[interface{}]interface{}{"groups": 5},
+		},
+	}
+	_, err = newUnsafeRouteSourcesFromConfig(c)
+	assert.EqualError(t, err, "firewall.unsafe_route_sources.192.168.100.0/24.groups must be a string or a list of strings")
+}
+
+func TestFirewall_Drop_UnsafeRouteSource(t *testing.T) {
+	l := test.NewLogger()
+	byCidr := newFlowLimitTestHost("10.0.0.2")
+	byGroup := newFlowLimitTestHost("10.0.0.3", "gateway-users")
+	stranger := newFlowLimitTestHost("10.0.0.4")
+
+	c := config.NewC(l)
+	c.Settings["firewall"] = map[interface{}]interface{}{
+		"unsafe_route_sources": map[interface{}]interface{}{
+			"192.168.100.0/24": map[interface{}]interface{}{
+				"cidrs":  []interface{}{"10.0.0.2"},
+				"groups": []interface{}{"gateway-users"},
+			},
+		},
+	}
+
+	myCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Ips: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 1), Mask: net.IPMask{255, 255, 255, 0}}},
+		Subnets: []*net.IPNet{
+			{IP: net.IPv4(192, 168, 100, 0), Mask: net.IPMask{255, 255, 255, 0}},
+			{IP: net.IPv4(192, 168, 200, 0), Mask: net.IPMask{255, 255, 255, 0}},
+		},
+	}}
+	fw := NewFirewall(l, time.Minute, time.Minute, time.Minute, myCert)
+	us, err := newUnsafeRouteSourcesFromConfig(c)
+	require.NoError(t, err)
+	us.metricDropped = metrics.NewCounter()
+	fw.unsafeRouteSources = us
+	fw.defaultLocalCIDRAny = true
+	require.NoError(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", netip.Prefix{}, netip.Prefix{}, "", ""))
+	require.NoError(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{"any"}, "", netip.Prefix{}, netip.Prefix{}, "", ""))
+	cp := cert.NewCAPool()
+
+	to := func(h *HostInfo, dst string) firewall.Packet {
+		return firewall.Packet{
+			LocalIP:    netip.MustParseAddr(dst),
+			RemoteIP:   h.vpnIp,
+			LocalPort:  443,
+			RemotePort: 40000,
+			Protocol:   firewall.ProtoTCP,
+		}
+	}
+
+	assert.NoError(t, fw.Drop(to(byCidr, "192.168.100.10"), true, false, byCidr, cp, nil))
+	assert.NoError(t, fw.Drop(to(byGroup, "192.168.100.10"), true, false, byGroup, cp, nil))
+	assert.Equal(t, ErrUnsafeRouteSource, fw.Drop(to(stranger, "192.168.100.10"), true, false, stranger, cp, nil))
+	assert.Equal(t, int64(1), us.metricDropped.Count())
+
+	// Routes that are not restricted and the node itself are reachable by anyone
+	assert.NoError(t, fw.Drop(to(stranger, "192.168.200.10"), true, false, stranger, cp, nil))
+	assert.NoError(t, fw.Drop(to(stranger, "10.0.0.1"), true, false, stranger, cp, nil))
+
+	// Replies to flows that left through the unsafe route are not affected
+	p := firewall.Packet{
+		LocalIP:    netip.MustParseAddr("192.168.100.10"),
+		RemoteIP:   stranger.vpnIp,
+		LocalPort:  40001,
+		RemotePort: 443,
+		Protocol:   firewall.ProtoTCP,
+	}
+	require.NoError(t, fw.Drop(p, false, false, stranger, cp, nil))
+	assert.NoError(t, fw.Drop(p, true, false, stranger, cp, nil))
+	assert.Equal(t, int64(1), us.metricDropped.Count())
+}
@@ -0,0 +1,332 @@
+package nebula
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+// handshakeFragments splits handshake packets that are too large for the path, a large certificate can push them past
+// the path MTU where they are silently dropped, and puts them back together on the receiving end. A fragment is a
+// header.HandshakeFragment packet with the remote index and message counter of the packet it carries a part of:
+//
+//	header(16) | id(4) | index(1) | count(1) | size(2) | part
+//
+// id is picked at random for each fragmented packet, index is the position of the part among the count parts, and
+// size is the largest packet the sender sends and wants to receive. The parts put together are the whole packet,
+// header included, which is then handled as if it had arrived in one piece.
+//
+// Nodes that do not know about fragments ignore them. So that handshakes with them keep working over the paths that
+// carry the whole packet, an initiator with handshakes.fragment.max_packet_size sends its first message whole on odd
+// attempts and in fragments on even attempts, even when it fits, which tells the peer it understands them. A node that
+// received fragments from an address answers it in fragments of the size it asked for, for handshakeFragmentPeerTTL.
+//
+// Only handshakes sent directly are fragmented, relayed handshakes travel inside the tunnel to the relay. A shared
+// listener can not route the fragments of a first message, it needs the certificate in it to pick a segment.
+type handshakeFragments struct {
+	maxPacketSize atomic.Int64
+	maxBuffer     atomic.Int64
+	timeout       atomic.Int64
+
+	sync.Mutex
+	pending map[handshakeFragmentKey]*handshakeReassembly
+	// buffered is how many bytes the pending reassemblies hold
+	buffered int
+	// peers are the addresses that sent us fragments, with the size they asked for
+	peers map[netip.AddrPort]handshakeFragmentPeer
+
+	metricSent        metrics.Counter
+	metricReassembled metrics.Counter
+	metricTimeout     metrics.Counter
+	metricOverBudget  metrics.Counter
+	metricMalformed   metrics.Counter
+	l                 *logrus.Logger
+}
+
+type handshakeFragmentKey struct {
+	addr netip.AddrPort
+	id   uint32
+}
+
+type handshakeReassembly struct {
+	parts   [][]byte
+	have    int
+	bytes   int
+	size    int
+	started time.Time
+	h       header.H
+}
+
+type handshakeFragmentPeer struct {
+	size int
+	seen time.Time
+}
+
+const (
+	handshakeFragmentHeaderLen = 8
+	handshakeFragmentMaxCount  = 32
+	// handshakeFragmentMinSize leaves room for a useful part after the headers
+	handshakeFragmentMinSize = 128
+	// handshakeFragmentMaxPending is how many packets a single address can have waiting on their fragments
+	handshakeFragmentMaxPending = 4
+	handshakeFragmentMaxPeers   = 1024
+	handshakeFragmentPeerTTL    = time.Minute
+
+	defaultHandshakeFragmentMaxBuffer = 64 * 1024
+	defaultHandshakeFragmentTimeout   = 5 * time.Second
+)
+
+func newHandshakeFragmentsFromConfig(l *logrus.Logger, c *config.C) (*handshakeFragments, error) {
+	hf := &handshakeFragments{
+		pending:           map[handshakeFragmentKey]*handshakeReassembly{},
+		peers:             map[netip.AddrPort]handshakeFragmentPeer{},
+		metricSent:        metrics.GetOrRegisterCounter("handshakes.fragment.sent", nil),
+		metricReassembled: metrics.GetOrRegisterCounter("handshakes.fragment.reassembled", nil),
+		metricTimeout:     metrics.GetOrRegisterCounter("handshakes.fragment.failed.timeout", nil),
+		metricOverBudget:  metrics.GetOrRegisterCounter("handshakes.fragment.failed.buffer", nil),
+		metricMalformed:   metrics.GetOrRegisterCounter("handshakes.fragment.failed.malformed", nil),
+		l:                 l,
+	}
+
+	if err := hf.reload(c, true); err != nil {
+		return nil, err
+	}
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := hf.reload(c, false); err != nil {
+			l.WithError(err).Error("Failed to reload handshakes.fragment, keeping the previous settings")
+		}
+	})
+
+	return hf, nil
+}
+
+func (hf *handshakeFragments) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("handshakes.fragment") {
+		return nil
+	}
+
+	size := c.GetInt("handshakes.fragment.max_packet_size", 0)
+	if size != 0 && (size < handshakeFragmentMinSize || size > mtu) {
+		return fmt.Errorf("handshakes.fragment.max_packet_size must be 0 or between %v and %v, got %v",
+			handshakeFragmentMinSize, mtu, size)
+	}
+
+	maxBuffer := c.GetInt("handshakes.fragment.max_buffer", defaultHandshakeFragmentMaxBuffer)
+	if maxBuffer <= 0 {
+		return fmt.Errorf("handshakes.fragment.max_buffer must be positive, got %v", maxBuffer)
+	}
+
+	timeout := c.GetDuration("handshakes.fragment.timeout", defaultHandshakeFragmentTimeout)
+	if timeout <= 0 {
+		return fmt.Errorf("handshakes.fragment.timeout must be positive, got %v", timeout)
+	}
+
+	hf.maxPacketSize.Store(int64(size))
+	hf.maxBuffer.Store(int64(maxBuffer))
+	hf.timeout.Store(int64(timeout))
+	if size > 0 {
+		hf.l.WithField("maxPacketSize", size).Info("Handshake fragmentation is enabled")
+	}
+	return nil
+}
+
+// sizeFor returns the size to fragment a handshake packet to addr to, 0 to send it whole. initiate is true for a first
+// message sent on an attempt that announces fragments.
+func (hf *handshakeFragments) sizeFor(addr netip.AddrPort, initiate bool, now time.Time) int {
+	if hf == nil {
+		return 0
+	}
+
+	hf.Lock()
+	p, ok := hf.peers[addr]
+	hf.Unlock()
+	if ok && now.Sub(p.seen) < handshakeFragmentPeerTTL {
+		return p.size
+	}
+
+	if initiate {
+		return int(hf.maxPacketSize.Load())
+	}
+	return 0
+}
+
+// split returns the fragments of the handshake packet msg, none of them larger than size. It returns nil if msg needs
+// more than handshakeFragmentMaxCount fragments.
+func (hf *handshakeFragments) split(msg []byte, size int) [][]byte {
+	h := &header.H{}
+	if err := h.Parse(msg); err != nil {
+		return nil
+	}
+
+	partLen := size - header.Len - handshakeFragmentHeaderLen
+	count := (len(msg) + partLen - 1) / partLen
+	if count > handshakeFragmentMaxCount {
+		return nil
+	}
+
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	id := binary.BigEndian.Uint32(b[:])
+
+	out := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		part := msg[i*partLen : min((i+1)*partLen, len(msg))]
+		p := make([]byte, header.Len+handshakeFragmentHeaderLen, header.Len+handshakeFragmentHeaderLen+len(part))
+		header.Encode(p, header.Version, header.Handshake, header.HandshakeFragment, h.RemoteIndex, h.MessageCounter)
+		binary.BigEndian.PutUint32(p[header.Len:], id)
+		p[header.Len+4] = byte(i)
+		p[header.Len+5] = byte(count)
+		binary.BigEndian.PutUint16(p[header.Len+6:], uint16(size))
+		out = append(out, append(p, part...))
+	}
+
+	hf.metricSent.Inc(1)
+	return out
+}
+
+// add buffers the fragment packet from addr, it returns the whole packet and its header once every fragment arrived
+func (hf *handshakeFragments) add(addr netip.AddrPort, packet []byte, h *header.H, now time.Time) ([]byte, *header.H) {
+	if hf == nil {
+		return nil, nil
+	}
+	if !addr.IsValid() || len(packet) <= header.Len+handshakeFragmentHeaderLen {
+		hf.metricMalformed.Inc(1)
+		return nil, nil
+	}
+
+	fh := packet[header.Len : header.Len+handshakeFragmentHeaderLen]
+	key := handshakeFragmentKey{addr: addr, id: binary.BigEndian.Uint32(fh)}
+	index, count, size := int(fh[4]), int(fh[5]), int(binary.BigEndian.Uint16(fh[6:]))
+	if count == 0 || count > handshakeFragmentMaxCount || index >= count || size < handshakeFragmentMinSize || size > mtu {
+		hf.metricMalformed.Inc(1)
+		return nil, nil
+	}
+	part := packet[header.Len+handshakeFragmentHeaderLen:]
+
+	hf.Lock()
+	defer hf.Unlock()
+	hf.expire(now)
+
+	r, ok := hf.pending[key]
+	if !ok {
+		if hf.pendingFrom(addr) >= handshakeFragmentMaxPending {
+			hf.metricOverBudget.Inc(1)
+			return nil, nil
+		}
+		r = &handshakeReassembly{parts: make([][]byte, count), size: size, started: now, h: *h}
+		hf.pending[key] = r
+	} else if len(r.parts) != count || r.size != size || r.h != *h {
+		// Fragments of the same packet always agree
+		hf.drop(key, r)
+		hf.metricMalformed.Inc(1)
+		return nil, nil
+	}
+
+	if r.parts[index] != nil {
+		return nil, nil
+	}
+	if hf.buffered+len(part) > int(hf.maxBuffer.Load()) {
+		hf.metricOverBudget.Inc(1)
+		if r.have == 0 {
+			delete(hf.pending, key)
+		}
+		return nil, nil
+	}
+
+	r.parts[index] = append([]byte(nil), part...)
+	r.have++
+	r.bytes += len(part)
+	hf.buffered += len(part)
+	if r.have < count {
+		return nil, nil
+	}
+
+	hf.drop(key, r)
+	whole := make([]byte, 0, r.bytes)
+	for _, p := range r.parts {
+		whole = append(whole, p...)
+	}
+
+	wh := &header.H{}
+	if err := wh.Parse(whole); err != nil || wh.Type != header.Handshake || wh.Subtype == header.HandshakeFragment ||
+		wh.RemoteIndex != h.RemoteIndex || wh.MessageCounter != h.MessageCounter {
+		hf.metricMalformed.Inc(1)
+		return nil, nil
+	}
+
+	if _, ok := hf.peers[addr]; ok || len(hf.peers) < handshakeFragmentMaxPeers {
+		hf.peers[addr] = handshakeFragmentPeer{size: size, seen: now}
+	}
+	hf.metricReassembled.Inc(1)
+	return whole, wh
+}
+
+// expire drops the reassemblies that ran out of time and the peers we have not heard fragments from in a while, hf
+// must be locked
+func (hf *handshakeFragments) expire(now time.Time) {
+	timeout := time.Duration(hf.timeout.Load())
+	for key, r := range hf.pending {
+		if now.Sub(r.started) >= timeout {
+			hf.drop(key, r)
+			hf.metricTimeout.Inc(1)
+			hf.l.WithField("udpAddr", key.addr).WithField("fragments", len(r.parts)).WithField("received", r.have).
+				Debug("Gave up on reassembling a handshake packet")
+		}
+	}
+
+	for addr, p := range hf.peers {
+		if now.Sub(p.seen) >= handshakeFragmentPeerTTL {
+			delete(hf.peers, addr)
+		}
+	}
+}
+
+func (hf *handshakeFragments) drop(key handshakeFragmentKey, r *handshakeReassembly) {
+	delete(hf.pending, key)
+	hf.buffered -= r.bytes
+}
+
+func (hf *handshakeFragments) pendingFrom(addr netip.AddrPort) int {
+	n := 0
+	for key := range hf.pending {
+		if key.addr == addr {
+			n++
+		}
+	}
+	return n
+}
+
+// sendHandshake sends the handshake packet msg to addr directly, in fragments if the peer asked for them or initiate
+// announces them, see handshakeFragments
+func (f *Interface) sendHandshake(hostinfo *HostInfo, msg []byte, addr netip.AddrPort, initiate bool) error {
+	var hf *handshakeFragments
+	if f.handshakeManager != nil {
+		hf = f.handshakeManager.config.fragments
+	}
+
+	size := hf.sizeFor(addr, initiate, time.Now())
+	if size == 0 {
+		return f.writeTo(0, hostinfo, msg, addr, ecnNotECT)
+	}
+
+	fragments := hf.split(msg, size)
+	if fragments == nil {
+		return f.writeTo(0, hostinfo, msg, addr, ecnNotECT)
+	}
+	f.messageMetrics.Tx(header.Handshake, header.HandshakeFragment, int64(len(fragments)))
+	for _, p := range fragments {
+		if err := f.writeTo(0, hostinfo, p, addr, ecnNotECT); err != nil {
+			return err
+		}
+	}
+	return nil
+}
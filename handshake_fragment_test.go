@@ -0,0 +1,131 @@
+package nebula
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshakeFragments(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("handshakes: {fragment: {max_packet_size: 200, max_buffer: 1200, timeout: 1s}}"))
+	hf, err := newHandshakeFragmentsFromConfig(l, c)
+	require.NoError(t, err)
+
+	addr := netip.MustParseAddrPort("192.168.0.1:4242")
+	other := netip.MustParseAddrPort("192.168.0.2:4242")
+	now := time.Now()
+
+	// A packet about the size of a first message with a large certificate
+	msg := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeIXPSK0, 0, 1)
+	for i := 0; i < 1000; i++ {
+		msg = append(msg, byte(i))
+	}
+
+	add := func(from netip.AddrPort, p []byte, now time.Time) []byte {
+		h := &header.H{}
+		require.NoError(t, h.Parse(p))
+		require.Equal(t, header.HandshakeFragment, h.Subtype)
+		whole, wh := hf.add(from, p, h, now)
+		if whole != nil {
+			assert.Equal(t, header.HandshakeIXPSK0, wh.Subtype)
+			assert.Equal(t, uint64(1), wh.MessageCounter)
+		}
+		return whole
+	}
+
+	t.Log("Only an initiating attempt starts fragmenting")
+	assert.Equal(t, 200, hf.sizeFor(addr, true, now))
+	assert.Equal(t, 0, hf.sizeFor(addr, false, now))
+
+	t.Log("The fragments fit the size and put back together in any order make the packet")
+	frags := hf.split(msg, 200)
+	require.Len(t, frags, 6)
+	for _, p := range frags {
+		assert.LessOrEqual(t, len(p), 200)
+	}
+	reassembled := hf.metricReassembled.Count()
+	for i := len(frags) - 1; i > 0; i-- {
+		assert.Nil(t, add(addr, frags[i], now))
+	}
+	assert.Nil(t, add(addr, frags[1], now), "a duplicate is ignored")
+	assert.True(t, bytes.Equal(msg, add(addr, frags[0], now)))
+	assert.Equal(t, reassembled+1, hf.metricReassembled.Count())
+	assert.Empty(t, hf.pending)
+	assert.Zero(t, hf.buffered)
+
+	t.Log("The sender is answered in fragments of the size it asked for")
+	assert.Equal(t, 200, hf.sizeFor(addr, false, now))
+	assert.Equal(t, 0, hf.sizeFor(other, false, now))
+	assert.Equal(t, 0, hf.sizeFor(addr, false, now.Add(handshakeFragmentPeerTTL)))
+
+	t.Log("A packet that would take too many fragments is sent whole")
+	assert.Nil(t, hf.split(msg, handshakeFragmentMinSize/4))
+
+	t.Log("Fragments that do not agree are dropped")
+	malformed := hf.metricMalformed.Count()
+	frags = hf.split(msg, 200)
+	assert.Nil(t, add(addr, frags[0], now))
+	bad := append([]byte(nil), frags[1]...)
+	bad[header.Len+5] = 7
+	assert.Nil(t, add(addr, bad, now))
+	assert.Equal(t, malformed+1, hf.metricMalformed.Count())
+	assert.Empty(t, hf.pending)
+
+	for _, p := range [][]byte{
+		frags[0][:header.Len+handshakeFragmentHeaderLen],
+		append(append([]byte(nil), frags[0][:header.Len+4]...), 3, 2, 0, 200, 1),
+		append(append([]byte(nil), frags[0][:header.Len+4]...), 0, 1, 0, 10, 1),
+	} {
+		assert.Nil(t, add(addr, p, now))
+	}
+	assert.Equal(t, malformed+4, hf.metricMalformed.Count())
+
+	t.Log("A packet that is not a handshake once put together is dropped")
+	notHandshake := header.Encode(make([]byte, header.Len), header.Version, header.Message, header.MessageNone, 0, 1)
+	frags = hf.split(append(notHandshake, msg[header.Len:]...), 200)
+	for _, p := range frags {
+		assert.Nil(t, add(other, p, now))
+	}
+	assert.Equal(t, malformed+5, hf.metricMalformed.Count())
+	assert.Equal(t, 0, hf.sizeFor(other, false, now))
+
+	t.Log("Reassemblies that run out of time are dropped")
+	timeouts := hf.metricTimeout.Count()
+	frags = hf.split(msg, 200)
+	assert.Nil(t, add(addr, frags[0], now))
+	assert.Nil(t, add(addr, frags[1], now.Add(time.Second)))
+	assert.Equal(t, timeouts+1, hf.metricTimeout.Count())
+	assert.Len(t, hf.pending, 1, "the late fragment starts over")
+
+	t.Log("The buffer and the packets pending for a single address are limited")
+	overBudget := hf.metricOverBudget.Count()
+	later := now.Add(time.Hour)
+	for i := 0; i < handshakeFragmentMaxPending; i++ {
+		assert.Nil(t, add(addr, hf.split(msg, 200)[0], later))
+	}
+	assert.Nil(t, add(addr, hf.split(msg, 200)[0], later))
+	assert.Equal(t, overBudget+1, hf.metricOverBudget.Count())
+
+	frags = hf.split(msg, 200)
+	for _, p := range frags {
+		assert.Nil(t, add(other, p, later))
+	}
+	assert.Greater(t, hf.metricOverBudget.Count(), overBudget+1, "1200 bytes do not hold every fragment")
+	assert.LessOrEqual(t, hf.buffered, 1200)
+
+	t.Log("max_packet_size is 0 or large enough for a fragment")
+	require.NoError(t, c.ReloadConfigString("handshakes: {fragment: {max_packet_size: 10}}"))
+	assert.Equal(t, int64(200), hf.maxPacketSize.Load())
+
+	var nilHF *handshakeFragments
+	assert.Equal(t, 0, nilHF.sizeFor(addr, true, now))
+}
@@ -24,11 +24,15 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 	certState := f.pki.GetCertState()
 	ci := NewConnectionState(f.l, f.cipher, certState, true, noise.HandshakeIX, []byte{}, 0)
 	hh.hostinfo.ConnectionState = ci
+	f.sourcePin.update(hh.hostinfo)
 
 	hsProto := &NebulaHandshakeDetails{
 		InitiatorIndex: hh.hostinfo.localIndexId,
 		Time:           uint64(time.Now().UnixNano()),
 		Cert:           certState.RawCertificateNoKey,
+		UserCert:       f.pki.userCertFor(certState),
+		AuthOnly:       f.authOnly.Enabled(),
+		TraceParent:    hh.span.traceParent(),
 	}
 
 	hsBytes := []byte{}
@@ -59,6 +63,7 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 
 	hh.hostinfo.HandshakePacket[0] = msg
 	hh.ready = true
+	hh.span.event("stage 1 built", attr("initiator_index", hh.hostinfo.localIndexId))
 	return true
 }
 
@@ -86,7 +91,19 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 		return
 	}
 
-	remoteCert, err := RecombineCertAndValidate(ci.H, hs.Details.Cert, f.pki.GetCAPool())
+	// The span joins the trace of the initiator, it ends in error on every return that does not answer
+	sp := f.tracer.start("handshake.respond", spanKindServer, hs.Details.TraceParent, attr("udp_addr", addr))
+	defer sp.finish(errHandshakeIncomplete)
+	if via != nil {
+		sp.event("stage 1 received", attr("relay", via.relayHI.vpnIp))
+	} else {
+		sp.event("stage 1 received")
+	}
+
+	remoteCert, err := RecombineCertAndValidate(ci.H, hs.Details.Cert, f.pki.GetCAPool(), f.pki.GetClockSkew())
+	if err != nil && f.acceptExpiredCert(remoteCert, err, addr, 1) {
+		err = nil
+	}
 	if err != nil {
 		e := f.l.WithError(err).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"})
@@ -96,6 +113,16 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 		}
 
 		e.Info("Invalid certificate from host")
+		f.securityEvents.Load().handshakeRejected(addr, 1, remoteCert, err)
+		return
+	}
+
+	if f.refusedByCertPolicy(remoteCert, addr, 1) {
+		return
+	}
+
+	userCert, refused := f.refusedByUserCert(remoteCert, hs.Details.UserCert, addr, 1)
+	if refused {
 		return
 	}
 
@@ -133,7 +160,19 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 		}
 	}
 
-	myIndex, err := generateIndex(f.l)
+	if !f.handshakeManager.allowNewTunnel(vpnIp, false) {
+		return
+	}
+
+	if f.tunRecovery.refuse(f.hostMap, vpnIp) {
+		return
+	}
+
+	if f.duplicateVpnIp.check(f.hostMap, vpnIp, remoteCert, addr, 1, time.Now(), f.securityEvents.Load()) {
+		return
+	}
+
+	myIndex, err := f.hostMap.generateIndex(f.l)
 	if err != nil {
 		f.l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
 			WithField("certName", certName).
@@ -167,6 +206,11 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 
 	hs.Details.ResponderIndex = myIndex
 	hs.Details.Cert = certState.RawCertificateNoKey
+	hs.Details.UserCert = f.pki.userCertFor(certState)
+	// Auth only requires both sides to opt in, tell the initiator what we decided
+	peerAuthOnly := hs.Details.AuthOnly
+	ci.authOnly = peerAuthOnly && f.authOnly.Enabled()
+	hs.Details.AuthOnly = ci.authOnly
 	// Update the time in case their clock is way off from ours
 	hs.Details.Time = uint64(time.Now().UnixNano())
 
@@ -211,12 +255,20 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 	ci.window.Update(f.l, 2)
 
 	ci.peerCert = remoteCert
+	ci.peerUserCert = userCert
+	ci.peerIdentity = newPeerIdentity(remoteCert, userCert)
 	ci.dKey = NewNebulaCipherState(dKey)
 	ci.eKey = NewNebulaCipherState(eKey)
+	ci.exportKeys.record(eKey, dKey)
+	ci.keyCreated = time.Now()
+	hostinfo.caFingerprint = remoteCert.Details.Issuer
 
 	hostinfo.remotes = f.lightHouse.QueryCache(vpnIp)
 	hostinfo.SetRemote(addr)
 	hostinfo.CreateRemoteCIDR(remoteCert)
+	if !addr.IsValid() {
+		hostinfo.relayReason = &RelayReason{Reason: RelayReasonPeerInitiated, NATType: f.lightHouse.GetNATStatus().Type}
+	}
 
 	existing, err := f.handshakeManager.CheckAndComplete(hostinfo, 0, f)
 	if err != nil {
@@ -224,6 +276,7 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 		case ErrAlreadySeen:
 			// Update remote if preferred
 			if existing.SetRemoteIfPreferred(f.hostMap, addr) {
+				f.tunnelMetrics.roamed(existing)
 				// Send a test packet to ensure the other side has also switched to
 				// the preferred remote
 				f.SendMessageToVpnIp(header.Test, header.TestRequest, vpnIp, []byte(""), make([]byte, 12, 12), make([]byte, mtu))
@@ -232,7 +285,7 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 			msg = existing.HandshakePacket[2]
 			f.messageMetrics.Tx(header.Handshake, header.MessageSubType(msg[1]), 1)
 			if addr.IsValid() {
-				err := f.outside.WriteTo(msg, addr)
+				err := f.sendHandshake(existing, msg, addr, false)
 				if err != nil {
 					f.l.WithField("vpnIp", existing.vpnIp).WithField("udpAddr", addr).
 						WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).WithField("cached", true).
@@ -241,6 +294,8 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 					f.l.WithField("vpnIp", existing.vpnIp).WithField("udpAddr", addr).
 						WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).WithField("cached", true).
 						Info("Handshake message sent")
+					sp.event("stage 2 sent", attr("cached", true))
+					sp.finish(nil)
 				}
 				return
 			} else {
@@ -253,6 +308,8 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 				f.l.WithField("vpnIp", existing.vpnIp).WithField("relay", via.relayHI.vpnIp).
 					WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).WithField("cached", true).
 					Info("Handshake message sent")
+				sp.event("stage 2 sent", attr("cached", true))
+				sp.finish(nil)
 				return
 			}
 		case ErrExistingHostInfo:
@@ -281,6 +338,9 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 				WithField("localIndex", hostinfo.localIndexId).WithField("collision", existing.vpnIp).
 				Error("Failed to add HostInfo due to localIndex collision")
 			return
+		case ErrTunnelLimit:
+			// Already logged, the handshake is dropped
+			return
 		default:
 			// Shouldn't happen, but just in case someone adds a new error type to CheckAndComplete
 			// And we forget to update it here
@@ -298,7 +358,8 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 	// Do the send
 	f.messageMetrics.Tx(header.Handshake, header.MessageSubType(msg[1]), 1)
 	if addr.IsValid() {
-		err = f.outside.WriteTo(msg, addr)
+		f.sourcePin.update(hostinfo)
+		err = f.sendHandshake(hostinfo, msg, addr, false)
 		if err != nil {
 			f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
 				WithField("certName", certName).
@@ -307,6 +368,7 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 				WithField("initiatorIndex", hs.Details.InitiatorIndex).WithField("responderIndex", hs.Details.ResponderIndex).
 				WithField("remoteIndex", h.RemoteIndex).WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 				WithError(err).Error("Failed to send handshake")
+			sp.finish(err)
 		} else {
 			f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
 				WithField("certName", certName).
@@ -333,6 +395,9 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 	}
 
 	f.connectionManager.AddTrafficWatch(hostinfo.localIndexId)
+	f.authOnly.logNegotiation(f.l, hostinfo, peerAuthOnly)
+	sp.event("stage 2 sent")
+	sp.finish(nil)
 
 	hostinfo.remotes.ResetBlockedRemotes()
 
@@ -348,6 +413,11 @@ func ixHandshakeStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hh *Ha
 	hh.Lock()
 	defer hh.Unlock()
 
+	if hh.identityHidden {
+		// This attempt hides our certificate, an answer to a noise IX handshake can not complete it
+		return false
+	}
+
 	hostinfo := hh.hostinfo
 	if addr.IsValid() {
 		if !f.lightHouse.GetRemoteAllowList().Allow(hostinfo.vpnIp, addr.Addr()) {
@@ -387,7 +457,10 @@ func ixHandshakeStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hh *Ha
 		return true
 	}
 
-	remoteCert, err := RecombineCertAndValidate(ci.H, hs.Details.Cert, f.pki.GetCAPool())
+	remoteCert, err := RecombineCertAndValidate(ci.H, hs.Details.Cert, f.pki.GetCAPool(), f.pki.GetClockSkew())
+	if err != nil && f.acceptExpiredCert(remoteCert, err, addr, 2) {
+		err = nil
+	}
 	if err != nil {
 		e := f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"})
@@ -397,11 +470,21 @@ func ixHandshakeStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hh *Ha
 		}
 
 		e.Error("Invalid certificate from host")
+		f.securityEvents.Load().handshakeRejected(addr, 2, remoteCert, err)
 
 		// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
 		return true
 	}
 
+	if f.refusedByCertPolicy(remoteCert, addr, 2) {
+		return true
+	}
+
+	userCert, refused := f.refusedByUserCert(remoteCert, hs.Details.UserCert, addr, 2)
+	if refused {
+		return true
+	}
+
 	vpnIp, ok := netip.AddrFromSlice(remoteCert.Details.Ips[0].IP)
 	if !ok {
 		e := f.l.WithError(err).WithField("udpAddr", addr).
@@ -427,32 +510,11 @@ func ixHandshakeStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hh *Ha
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 			Info("Incorrect host responded to handshake")
 
-		// Release our old handshake from pending, it should not continue
-		f.handshakeManager.DeleteHostInfo(hostinfo)
-
-		// Create a new hostinfo/handshake for the intended vpn ip
-		f.handshakeManager.StartHandshake(hostinfo.vpnIp, func(newHH *HandshakeHostInfo) {
-			//TODO: this doesnt know if its being added or is being used for caching a packet
-			// Block the current used address
-			newHH.hostinfo.remotes = hostinfo.remotes
-			newHH.hostinfo.remotes.BlockRemote(addr)
-
-			// Get the correct remote list for the host we did handshake with
-			hostinfo.remotes = f.lightHouse.QueryCache(vpnIp)
-
-			f.l.WithField("blockedUdpAddrs", newHH.hostinfo.remotes.CopyBlockedRemotes()).WithField("vpnIp", vpnIp).
-				WithField("remotes", newHH.hostinfo.remotes.CopyAddrs(f.hostMap.GetPreferredRanges())).
-				Info("Blocked addresses for handshakes")
-
-			// Swap the packet store to benefit the original intended recipient
-			newHH.packetStore = hh.packetStore
-			hh.packetStore = []*cachedPacket{}
-
-			// Finally, put the correct vpn ip in the host info, tell them to close the tunnel, and return true to tear down
-			hostinfo.vpnIp = vpnIp
-			f.sendCloseTunnel(hostinfo)
-		})
+		handshakeWithIntendedHost(f, hh, addr, vpnIp)
+		return true
+	}
 
+	if f.duplicateVpnIp.check(f.hostMap, vpnIp, remoteCert, addr, 2, time.Now(), f.securityEvents.Load()) {
 		return true
 	}
 
@@ -460,23 +522,40 @@ func ixHandshakeStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hh *Ha
 	ci.window.Update(f.l, 2)
 
 	duration := time.Since(hh.startTime).Nanoseconds()
-	f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+	hl := f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
 		WithField("certName", certName).
 		WithField("fingerprint", fingerprint).
 		WithField("issuer", issuer).
 		WithField("initiatorIndex", hs.Details.InitiatorIndex).WithField("responderIndex", hs.Details.ResponderIndex).
 		WithField("remoteIndex", h.RemoteIndex).WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 		WithField("durationNs", duration).
-		WithField("sentCachedPackets", len(hh.packetStore)).
-		Info("Handshake message received")
+		WithField("sentCachedPackets", len(hh.packetStore))
+	if !addr.IsValid() {
+		hostinfo.relayReason = hh.relayReason(f.lightHouse.GetNATStatus().Type)
+		r := hostinfo.relayReason
+		hl = hl.WithField("relay", via.relayHI.vpnIp).WithField("relayReason", m{
+			"reason": r.Reason, "attempted": r.Attempted, "attempts": r.Attempts, "sendErrors": r.SendErrors,
+			"lastSendError": r.LastSendError, "natType": r.NATType,
+		})
+	}
+	hl.Info("Handshake message received")
+	hh.span.event("stage 2 received")
 
 	hostinfo.remoteIndexId = hs.Details.ResponderIndex
 	hostinfo.lastHandshakeTime = hs.Details.Time
+	f.lightHouse.observeClock(vpnIp, hs.Details.Time, time.Now())
 
 	// Store their cert and our symmetric keys
 	ci.peerCert = remoteCert
+	ci.peerUserCert = userCert
+	ci.peerIdentity = newPeerIdentity(remoteCert, userCert)
 	ci.dKey = NewNebulaCipherState(dKey)
 	ci.eKey = NewNebulaCipherState(eKey)
+	ci.exportKeys.record(eKey, dKey)
+	ci.keyCreated = time.Now()
+	hostinfo.caFingerprint = remoteCert.Details.Issuer
+	// We only asked for auth only if we opted in, the responder only agrees if it did too
+	ci.authOnly = hs.Details.AuthOnly && f.authOnly.Enabled()
 
 	// Make sure the current udpAddr being used is set for responding
 	if addr.IsValid() {
@@ -489,8 +568,14 @@ func ixHandshakeStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hh *Ha
 	hostinfo.CreateRemoteCIDR(remoteCert)
 
 	// Complete our handshake and update metrics, this will replace any existing tunnels for this vpnIp
+	hh.span.finish(nil)
 	f.handshakeManager.Complete(hostinfo, f)
 	f.connectionManager.AddTrafficWatch(hostinfo.localIndexId)
+	f.authOnly.logNegotiation(f.l, hostinfo, hs.Details.AuthOnly)
+
+	if maxAge := f.handshakeManager.config.packetBuffer.maxAge; maxAge > 0 {
+		hh.expireCachedPackets(time.Now(), maxAge, f.cachedPacketMetrics)
+	}
 
 	if f.l.Level >= logrus.DebugLevel {
 		hostinfo.logger(f.l).Debugf("Sending %d stored packets", len(hh.packetStore))
@@ -510,3 +595,34 @@ func ixHandshakeStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hh *Ha
 
 	return false
 }
+
+// handshakeWithIntendedHost starts the handshake of hh over after vpnIp answered at addr instead of the host we meant
+func handshakeWithIntendedHost(f *Interface, hh *HandshakeHostInfo, addr netip.AddrPort, vpnIp netip.Addr) {
+	hostinfo := hh.hostinfo
+
+	// Release our old handshake from pending, it should not continue
+	f.handshakeManager.DeleteHostInfo(hostinfo)
+
+	// Create a new hostinfo/handshake for the intended vpn ip
+	f.handshakeManager.StartHandshake(hostinfo.vpnIp, func(newHH *HandshakeHostInfo) {
+		//TODO: this doesnt know if its being added or is being used for caching a packet
+		// Block the current used address
+		newHH.hostinfo.remotes = hostinfo.remotes
+		newHH.hostinfo.remotes.BlockRemote(addr)
+
+		// Get the correct remote list for the host we did handshake with
+		hostinfo.remotes = f.lightHouse.QueryCache(vpnIp)
+
+		f.l.WithField("blockedUdpAddrs", newHH.hostinfo.remotes.CopyBlockedRemotes()).WithField("vpnIp", vpnIp).
+			WithField("remotes", newHH.hostinfo.remotes.CopyAddrs(f.hostMap.PreferredRangesFor(newHH.hostinfo))).
+			Info("Blocked addresses for handshakes")
+
+		// Swap the packet store to benefit the original intended recipient
+		newHH.packetStore = hh.packetStore
+		hh.packetStore = []*cachedPacket{}
+
+		// Finally, put the correct vpn ip in the host info, tell them to close the tunnel, and the caller tears down
+		hostinfo.vpnIp = vpnIp
+		f.sendCloseTunnel(hostinfo)
+	})
+}
@@ -21,6 +21,7 @@ const (
 	DefaultHandshakeTryInterval   = time.Millisecond * 100
 	DefaultHandshakeRetries       = 10
 	DefaultHandshakeTriggerBuffer = 64
+	DefaultHandshakePacketBuffer  = 100
 	DefaultUseRelays              = true
 )
 
@@ -29,6 +30,7 @@ var (
 		tryInterval:   DefaultHandshakeTryInterval,
 		retries:       DefaultHandshakeRetries,
 		triggerBuffer: DefaultHandshakeTriggerBuffer,
+		packetBuffer:  packetBufferConfig{max: DefaultHandshakePacketBuffer},
 		useRelays:     DefaultUseRelays,
 	}
 )
@@ -37,9 +39,13 @@ type HandshakeConfig struct {
 	tryInterval   time.Duration
 	retries       int64
 	triggerBuffer int
+	packetBuffer  packetBufferConfig
 	useRelays     bool
 
 	messageMetrics *MessageMetrics
+	tunnelLimit    *TunnelLimit
+	certIPChange   *CertIPChange
+	fragments      *handshakeFragments
 }
 
 type HandshakeManager struct {
@@ -57,6 +63,7 @@ type HandshakeManager struct {
 	messageMetrics         *MessageMetrics
 	metricInitiated        metrics.Counter
 	metricTimedOut         metrics.Counter
+	metricCleared          metrics.Counter
 	f                      *Interface
 	l                      *logrus.Logger
 
@@ -64,6 +71,15 @@ type HandshakeManager struct {
 	trigger chan netip.Addr
 }
 
+// packetBufferConfig bounds the outbound packets held for a peer while its tunnel handshakes, they are sent once the
+// tunnel is established. A max of 0 drops every data packet sent while handshaking, a maxAge of 0 keeps packets until
+// the handshake completes or times out. Lighthouse and control messages are held up to DefaultHandshakePacketBuffer even
+// when max is lower, they are few and losing them stalls lighthouse updates and relay setup.
+type packetBufferConfig struct {
+	max    int
+	maxAge time.Duration
+}
+
 type HandshakeHostInfo struct {
 	sync.Mutex
 
@@ -72,16 +88,40 @@ type HandshakeHostInfo struct {
 	counter     int64            // How many attempts have we made so far
 	lastRemotes []netip.AddrPort // Remotes that we sent to during the previous attempt
 	packetStore []*cachedPacket  // A set of packets to be transmitted once the handshake completes
+	queryLater  bool             // The lighthouse query was skipped because the remotes came from a hostmap snapshot
+	direct      directAttempts   // Where the handshake was sent directly, explains a fall back to a relay
+	span        *span            // Traces the handshake, nil unless tracing is enabled
+
+	identityHidden bool // The handshake is noise XX, our certificate is only sent to a validated responder
 
 	hostinfo *HostInfo
 }
 
-func (hh *HandshakeHostInfo) cachePacket(l *logrus.Logger, t header.MessageType, st header.MessageSubType, packet []byte, f packetCallback, m *cachedPacketMetrics) {
-	if len(hh.packetStore) < 100 {
+// style is the noise handshake pattern of the current attempt, for logging
+func (hh *HandshakeHostInfo) style() string {
+	if hh.identityHidden {
+		return "xx_psk0"
+	}
+	return "ix_psk0"
+}
+
+func (hh *HandshakeHostInfo) cachePacket(l *logrus.Logger, t header.MessageType, st header.MessageSubType, packet []byte, f packetCallback, m *cachedPacketMetrics, b packetBufferConfig) {
+	now := time.Now()
+	if b.maxAge > 0 {
+		// Make room by letting go of packets that would be too old to send anyway
+		hh.expireCachedPackets(now, b.maxAge, m)
+	}
+
+	limit := b.max
+	if t != header.Message {
+		limit = max(limit, DefaultHandshakePacketBuffer)
+	}
+
+	if len(hh.packetStore) < limit {
 		tempPacket := make([]byte, len(packet))
 		copy(tempPacket, packet)
 
-		hh.packetStore = append(hh.packetStore, &cachedPacket{t, st, f, tempPacket})
+		hh.packetStore = append(hh.packetStore, &cachedPacket{t, st, f, tempPacket, now})
 		if l.Level >= logrus.DebugLevel {
 			hh.hostinfo.logger(l).
 				WithField("length", len(hh.packetStore)).
@@ -101,6 +141,19 @@ func (hh *HandshakeHostInfo) cachePacket(l *logrus.Logger, t header.MessageType,
 	}
 }
 
+// expireCachedPackets drops the cached packets that were stored more than maxAge before now, counting them as dropped
+func (hh *HandshakeHostInfo) expireCachedPackets(now time.Time, maxAge time.Duration, m *cachedPacketMetrics) {
+	expired := 0
+	for expired < len(hh.packetStore) && now.Sub(hh.packetStore[expired].cachedAt) > maxAge {
+		expired++
+	}
+
+	if expired > 0 {
+		hh.packetStore = hh.packetStore[expired:]
+		m.dropped.Inc(int64(expired))
+	}
+}
+
 func NewHandshakeManager(l *logrus.Logger, mainHostMap *HostMap, lightHouse *LightHouse, outside udp.Conn, config HandshakeConfig) *HandshakeManager {
 	return &HandshakeManager{
 		vpnIps:                 map[netip.Addr]*HandshakeHostInfo{},
@@ -114,6 +167,7 @@ func NewHandshakeManager(l *logrus.Logger, mainHostMap *HostMap, lightHouse *Lig
 		messageMetrics:         config.messageMetrics,
 		metricInitiated:        metrics.GetOrRegisterCounter("handshake_manager.initiated", nil),
 		metricTimedOut:         metrics.GetOrRegisterCounter("handshake_manager.timed_out", nil),
+		metricCleared:          metrics.GetOrRegisterCounter("handshake_manager.cleared", nil),
 		l:                      l,
 	}
 }
@@ -144,9 +198,17 @@ func (hm *HandshakeManager) HandleIncoming(addr netip.AddrPort, via *ViaSender,
 	}
 
 	switch h.Subtype {
+	case header.HandshakeFragment:
+		if whole, wh := hm.config.fragments.add(addr, packet, h, time.Now()); whole != nil {
+			hm.HandleIncoming(addr, via, whole, wh)
+		}
+
 	case header.HandshakeIXPSK0:
 		switch h.MessageCounter {
 		case 1:
+			if hm.f.identityHiding.refuseIX(addr) {
+				return
+			}
 			ixHandshakeStage1(hm.f, addr, via, packet, h)
 
 		case 2:
@@ -156,6 +218,28 @@ func (hm *HandshakeManager) HandleIncoming(addr netip.AddrPort, via *ViaSender,
 				hm.DeleteHostInfo(newHostinfo.hostinfo)
 			}
 		}
+
+	case header.HandshakeXXPSK0:
+		switch h.MessageCounter {
+		case 1:
+			xxHandshakeStage1(hm.f, addr, via, packet, h)
+
+		case 2:
+			newHostinfo := hm.queryIndex(h.RemoteIndex)
+			if newHostinfo == nil {
+				// The responder did not get our third message and asks for it again
+				xxResendStage3(hm.f, via, packet, h)
+				return
+			}
+
+			tearDown := xxHandshakeStage2(hm.f, addr, via, newHostinfo, packet, h)
+			if tearDown {
+				hm.DeleteHostInfo(newHostinfo.hostinfo)
+			}
+
+		case 3:
+			xxHandshakeStage3(hm.f, addr, via, packet, h)
+		}
 	}
 }
 
@@ -181,13 +265,14 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 	hostinfo := hh.hostinfo
 	// If we are out of time, clean up
 	if hh.counter >= hm.config.retries {
-		hh.hostinfo.logger(hm.l).WithField("udpAddrs", hh.hostinfo.remotes.CopyAddrs(hm.mainHostMap.GetPreferredRanges())).
+		hh.hostinfo.logger(hm.l).WithField("udpAddrs", hh.hostinfo.remotes.CopyAddrs(hm.mainHostMap.PreferredRangesFor(hh.hostinfo))).
 			WithField("initiatorIndex", hh.hostinfo.localIndexId).
 			WithField("remoteIndex", hh.hostinfo.remoteIndexId).
-			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			WithField("handshake", m{"stage": 1, "style": hh.style()}).
 			WithField("durationNs", time.Since(hh.startTime).Nanoseconds()).
 			Info("Handshake timed out")
 		hm.metricTimedOut.Inc(1)
+		hh.span.finish(errHandshakeTimedOut)
 		hm.DeleteHostInfo(hostinfo)
 		return
 	}
@@ -195,9 +280,16 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 	// Increment the counter to increase our delay, linear backoff
 	hh.counter++
 
+	// Nobody answered while we hid our certificate, the peer may not know how to
+	if hh.ready && hh.identityHidden && !hm.f.identityHiding.hide(hh.counter) {
+		hm.f.identityHiding.fellBack(hostinfo.logger(hm.l), hh.counter)
+		hm.releaseIndex(hh)
+		hh.ready = false
+	}
+
 	// Check if we have a handshake packet to transmit yet
 	if !hh.ready {
-		if !ixHandshakeStage0(hm.f, hh) {
+		if !handshakeStage0(hm.f, hh) {
 			hm.OutboundHandshakeTimer.Add(vpnIp, hm.config.tryInterval*time.Duration(hh.counter))
 			return
 		}
@@ -211,7 +303,8 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 		hostinfo.remotes = hm.lightHouse.QueryCache(vpnIp)
 	}
 
-	remotes := hostinfo.remotes.CopyAddrs(hm.mainHostMap.GetPreferredRanges())
+	preferredRanges := hm.mainHostMap.PreferredRangesFor(hostinfo)
+	remotes := hostinfo.remotes.CopyAddrs(preferredRanges)
 	remotesHaveChanged := !slices.Equal(remotes, hh.lastRemotes)
 
 	// We only care about a lighthouse trigger if we have new remotes to send to.
@@ -233,15 +326,31 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 		hm.lightHouse.QueryServer(vpnIp)
 	}
 
+	// The snapshot addresses did not get us a tunnel on the first try, they may be stale so ask the lighthouse
+	if hh.queryLater && hh.counter > 1 {
+		hh.queryLater = false
+		hm.lightHouse.QueryServer(vpnIp)
+	}
+
+	// Udp may be blocked on the way to the peer, carry the handshake over tcp from now on
+	if hm.f.tcpTransport.fallback(hh.counter) {
+		hostinfo.remotes.ForEach(preferredRanges, func(addr netip.AddrPort, _ bool) {
+			hm.f.tcpTransport.dial(addr)
+		})
+	}
+
 	// Send the handshake to all known ips, stage 2 takes care of assigning the hostinfo.remote based on the first to reply
 	var sentTo []netip.AddrPort
-	hostinfo.remotes.ForEach(hm.mainHostMap.GetPreferredRanges(), func(addr netip.AddrPort, _ bool) {
+	hostinfo.remotes.ForEach(preferredRanges, func(addr netip.AddrPort, _ bool) {
 		hm.messageMetrics.Tx(header.Handshake, header.MessageSubType(hostinfo.HandshakePacket[0][1]), 1)
-		err := hm.outside.WriteTo(hostinfo.HandshakePacket[0], addr)
+		// Every other attempt goes out in fragments if they are enabled, see handshakeFragments
+		err := hm.f.sendHandshake(hostinfo, hostinfo.HandshakePacket[0], addr, hh.counter%2 == 0)
+		hh.direct.sent(addr, err)
+		hh.span.event("stage 1 sent", attr("attempt", hh.counter), attr("udp_addr", addr))
 		if err != nil {
 			hostinfo.logger(hm.l).WithField("udpAddr", addr).
 				WithField("initiatorIndex", hostinfo.localIndexId).
-				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+				WithField("handshake", m{"stage": 1, "style": hh.style()}).
 				WithError(err).Error("Failed to send handshake message")
 
 		} else {
@@ -254,12 +363,12 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 	if remotesHaveChanged {
 		hostinfo.logger(hm.l).WithField("udpAddrs", sentTo).
 			WithField("initiatorIndex", hostinfo.localIndexId).
-			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			WithField("handshake", m{"stage": 1, "style": hh.style()}).
 			Info("Handshake message sent")
 	} else if hm.l.IsLevelEnabled(logrus.DebugLevel) {
 		hostinfo.logger(hm.l).WithField("udpAddrs", sentTo).
 			WithField("initiatorIndex", hostinfo.localIndexId).
-			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			WithField("handshake", m{"stage": 1, "style": hh.style()}).
 			Debug("Handshake message sent")
 	}
 
@@ -277,11 +386,18 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 				hm.f.Handshake(relay)
 				continue
 			}
+			// A draining relay refuses new forwards, only a relay it already established is still usable
+			if relayHostInfo.relayDraining.Load() {
+				if existingRelay, ok := relayHostInfo.relayState.QueryRelayForByIp(vpnIp); !ok || existingRelay.State != Established {
+					continue
+				}
+			}
 			// Check the relay HostInfo to see if we already established a relay through it
 			if existingRelay, ok := relayHostInfo.relayState.QueryRelayForByIp(vpnIp); ok {
 				switch existingRelay.State {
 				case Established:
 					hostinfo.logger(hm.l).WithField("relay", relay.String()).Info("Send handshake via relay")
+					hh.span.event("stage 1 sent", attr("attempt", hh.counter), attr("relay", relay))
 					hm.f.SendVia(relayHostInfo, existingRelay, hostinfo.HandshakePacket[0], make([]byte, 12), make([]byte, mtu), false)
 				case Requested:
 					hostinfo.logger(hm.l).WithField("relay", relay.String()).Info("Re-send CreateRelay request")
@@ -296,6 +412,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 						InitiatorRelayIndex: existingRelay.LocalIndex,
 						RelayFromIp:         binary.BigEndian.Uint32(myVpnIpB[:]),
 						RelayToIp:           binary.BigEndian.Uint32(theirVpnIpB[:]),
+						TraceParent:         hh.span.traceParent(),
 					}
 					msg, err := m.Marshal()
 					if err != nil {
@@ -311,6 +428,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 							"initiatorRelayIndex": existingRelay.LocalIndex,
 							"relay":               relay}).
 							Info("send CreateRelayRequest")
+						hh.span.event("relay requested", attr("relay", relay))
 					}
 				default:
 					hostinfo.logger(hm.l).
@@ -336,6 +454,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 						InitiatorRelayIndex: idx,
 						RelayFromIp:         binary.BigEndian.Uint32(myVpnIpB[:]),
 						RelayToIp:           binary.BigEndian.Uint32(theirVpnIpB[:]),
+						TraceParent:         hh.span.traceParent(),
 					}
 					msg, err := m.Marshal()
 					if err != nil {
@@ -350,6 +469,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 							"initiatorRelayIndex": idx,
 							"relay":               relay}).
 							Info("send CreateRelayRequest")
+						hh.span.event("relay requested", attr("relay", relay))
 					}
 				}
 			}
@@ -372,7 +492,7 @@ func (hm *HandshakeManager) GetOrHandshake(vpnIp netip.Addr, cacheCb func(*Hands
 	if ok {
 		// Do not attempt promotion if you are a lighthouse
 		if !hm.lightHouse.amLighthouse {
-			h.TryPromoteBest(hm.mainHostMap.GetPreferredRanges(), hm.f)
+			h.TryPromoteBest(hm.mainHostMap, hm.f)
 		}
 		return h, true
 	}
@@ -381,7 +501,13 @@ func (hm *HandshakeManager) GetOrHandshake(vpnIp netip.Addr, cacheCb func(*Hands
 }
 
 // StartHandshake will ensure a handshake is currently being attempted for the provided vpn ip
+// Returns nil if a new tunnel would exceed tunnels.max
 func (hm *HandshakeManager) StartHandshake(vpnIp netip.Addr, cacheCb func(*HandshakeHostInfo)) *HostInfo {
+	if !hm.allowNewTunnel(vpnIp, true) {
+		return nil
+	}
+
+	hm.mainHostMap.RLock()
 	hm.Lock()
 
 	if hh, ok := hm.vpnIps[vpnIp]; ok {
@@ -390,9 +516,19 @@ func (hm *HandshakeManager) StartHandshake(vpnIp netip.Addr, cacheCb func(*Hands
 			cacheCb(hh)
 		}
 		hm.Unlock()
+		hm.mainHostMap.RUnlock()
 		return hh.hostinfo
 	}
 
+	// Take the slot while holding the lock so concurrent handshakes can not overshoot tunnels.max together
+	count, ok := hm.unlockedHasTunnelSlot(vpnIp)
+	hm.mainHostMap.RUnlock()
+	if !ok {
+		hm.Unlock()
+		hm.rejectTunnel(vpnIp, true, count)
+		return nil
+	}
+
 	hostinfo := &HostInfo{
 		vpnIp:           vpnIp,
 		HandshakePacket: make(map[uint8][]byte, 0),
@@ -406,6 +542,7 @@ func (hm *HandshakeManager) StartHandshake(vpnIp netip.Addr, cacheCb func(*Hands
 	hh := &HandshakeHostInfo{
 		hostinfo:  hostinfo,
 		startTime: time.Now(),
+		span:      hm.tracer().start("handshake", spanKindClient, "", attr("nebula.peer_vpn_ip", vpnIp)),
 	}
 	hm.vpnIps[vpnIp] = hh
 	hm.metricInitiated.Inc(1)
@@ -418,6 +555,11 @@ func (hm *HandshakeManager) StartHandshake(vpnIp netip.Addr, cacheCb func(*Hands
 	// If this is a static host, we don't need to wait for the HostQueryReply
 	// We can trigger the handshake right now
 	_, doTrigger := hm.lightHouse.GetStaticHostList()[vpnIp]
+	if hm.lightHouse.takeSnapshotSeed(vpnIp) {
+		// We already know where this host was before our restart, try there before bothering the lighthouse
+		hh.queryLater = true
+		doTrigger = true
+	}
 	if !doTrigger {
 		// Add any calculated remotes, and trigger early handshake if one found
 		doTrigger = hm.lightHouse.addCalculatedRemotes(vpnIp)
@@ -430,15 +572,92 @@ func (hm *HandshakeManager) StartHandshake(vpnIp netip.Addr, cacheCb func(*Hands
 		}
 	}
 
+	queryNow := !hh.queryLater
 	hm.Unlock()
-	hm.lightHouse.QueryServer(vpnIp)
+	if queryNow {
+		hm.lightHouse.QueryServer(vpnIp)
+	}
 	return hostinfo
 }
 
+var (
+	ErrHandshakeRefused = errors.New("handshake refused by tunnels.max")
+	ErrHandshakeFailed  = errors.New("handshake did not complete")
+)
+
+// Rehandshake starts a fresh handshake with vpnIp and waits for it to complete or fail. Any existing tunnel keeps
+// carrying traffic until the new one replaces it, the same as a handshake started by a certificate change. If a
+// handshake is already in progress it is waited on instead. Returns the new tunnel on success.
+func (hm *HandshakeManager) Rehandshake(ctx context.Context, vpnIp netip.Addr) (*HostInfo, error) {
+	before := hm.mainHostMap.QueryVpnIp(vpnIp)
+	hostinfo := hm.StartHandshake(vpnIp, nil)
+	if hostinfo == nil {
+		return nil, ErrHandshakeRefused
+	}
+
+	ticker := time.NewTicker(hm.config.tryInterval)
+	defer ticker.Stop()
+
+	for {
+		if hh := hm.queryVpnIp(vpnIp); hh == nil || hh.hostinfo != hostinfo {
+			// No longer pending, it either made it into the main hostmap or was given up on
+			if hm.mainHostMap.QueryIndex(hostinfo.localIndexId) == hostinfo {
+				return hostinfo, nil
+			}
+
+			// The peer may have won a handshake race with us, any new tunnel will do
+			if current := hm.mainHostMap.QueryVpnIp(vpnIp); current != nil && current != before {
+				return current, nil
+			}
+			return nil, ErrHandshakeFailed
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitForTunnel returns the established tunnel with vpnIp, starting a handshake if there is none and waiting for it
+// until it completes, fails, or ctx is done. Unlike Rehandshake an existing tunnel is returned right away.
+func (hm *HandshakeManager) WaitForTunnel(ctx context.Context, vpnIp netip.Addr) (*HostInfo, error) {
+	if hostinfo := hm.mainHostMap.QueryVpnIp(vpnIp); hostinfo != nil {
+		return hostinfo, nil
+	}
+
+	if hm.StartHandshake(vpnIp, nil) == nil {
+		return nil, ErrHandshakeRefused
+	}
+
+	ticker := time.NewTicker(hm.config.tryInterval)
+	defer ticker.Stop()
+
+	for {
+		// Check pending before main so a handshake completing in between is not mistaken for a failure
+		pending := hm.queryVpnIp(vpnIp) != nil
+		if hostinfo := hm.mainHostMap.QueryVpnIp(vpnIp); hostinfo != nil {
+			return hostinfo, nil
+		}
+
+		if !pending {
+			return nil, ErrHandshakeFailed
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
 var (
 	ErrExistingHostInfo    = errors.New("existing hostinfo")
 	ErrAlreadySeen         = errors.New("already seen")
 	ErrLocalIndexCollision = errors.New("local index collision")
+	ErrTunnelLimit         = errors.New("tunnel limit reached")
 )
 
 // CheckAndComplete checks for any conflicts in the main and pending hostmap
@@ -452,7 +671,14 @@ var (
 //
 // ErrLocalIndexCollision if we already have an entry in the main or pending
 // hostmap for the hostinfo.localIndexId.
+//
+// ErrTunnelLimit if this is a new tunnel and there is no room for it within
+// tunnels.max.
 func (c *HandshakeManager) CheckAndComplete(hostinfo *HostInfo, handshakePacket uint8, f *Interface) (*HostInfo, error) {
+	// Stale tunnels are closed once both locks are released
+	var stale []staleTunnel
+	defer func() { c.config.certIPChange.closeStale(f, stale) }()
+
 	c.mainHostMap.Lock()
 	defer c.mainHostMap.Unlock()
 	c.Lock()
@@ -477,6 +703,9 @@ func (c *HandshakeManager) CheckAndComplete(hostinfo *HostInfo, handshakePacket
 		}
 
 		existingHostInfo.logger(c.l).Info("Taking new handshake")
+	} else if count, ok := c.unlockedHasTunnelSlot(hostinfo.vpnIp); !ok {
+		c.rejectTunnel(hostinfo.vpnIp, false, count)
+		return nil, ErrTunnelLimit
 	}
 
 	existingIndex, found := c.mainHostMap.Indexes[hostinfo.localIndexId]
@@ -501,6 +730,7 @@ func (c *HandshakeManager) CheckAndComplete(hostinfo *HostInfo, handshakePacket
 	}
 
 	c.mainHostMap.unlockedAddHostInfo(hostinfo, f)
+	stale = c.config.certIPChange.unlockedCheck(c.mainHostMap, hostinfo)
 	return existingHostInfo, nil
 }
 
@@ -508,6 +738,9 @@ func (c *HandshakeManager) CheckAndComplete(hostinfo *HostInfo, handshakePacket
 // won't have a localIndexId collision because we already have an entry in the
 // pendingHostMap. An existing hostinfo is returned if there was one.
 func (hm *HandshakeManager) Complete(hostinfo *HostInfo, f *Interface) {
+	var stale []staleTunnel
+	defer func() { hm.config.certIPChange.closeStale(f, stale) }()
+
 	hm.mainHostMap.Lock()
 	defer hm.mainHostMap.Unlock()
 	hm.Lock()
@@ -525,6 +758,7 @@ func (hm *HandshakeManager) Complete(hostinfo *HostInfo, f *Interface) {
 	// We need to remove from the pending hostmap first to avoid undoing work when after to the main hostmap.
 	hm.unlockedDeleteHostInfo(hostinfo)
 	hm.mainHostMap.unlockedAddHostInfo(hostinfo, f)
+	stale = hm.config.certIPChange.unlockedCheck(hm.mainHostMap, hostinfo)
 }
 
 // allocateIndex generates a unique localIndexId for this HostInfo
@@ -537,7 +771,7 @@ func (hm *HandshakeManager) allocateIndex(hh *HandshakeHostInfo) error {
 	defer hm.Unlock()
 
 	for i := 0; i < 32; i++ {
-		index, err := generateIndex(hm.l)
+		index, err := hm.mainHostMap.generateIndex(hm.l)
 		if err != nil {
 			return err
 		}
@@ -555,6 +789,15 @@ func (hm *HandshakeManager) allocateIndex(hh *HandshakeHostInfo) error {
 	return errors.New("failed to generate unique localIndexId")
 }
 
+// releaseIndex removes the localIndexId of a handshake that is started over from the pendingHostMap
+func (hm *HandshakeManager) releaseIndex(hh *HandshakeHostInfo) {
+	hm.Lock()
+	defer hm.Unlock()
+	if hm.indexes[hh.hostinfo.localIndexId] == hh {
+		delete(hm.indexes, hh.hostinfo.localIndexId)
+	}
+}
+
 func (c *HandshakeManager) DeleteHostInfo(hostinfo *HostInfo) {
 	c.Lock()
 	defer c.Unlock()
@@ -562,6 +805,11 @@ func (c *HandshakeManager) DeleteHostInfo(hostinfo *HostInfo) {
 }
 
 func (c *HandshakeManager) unlockedDeleteHostInfo(hostinfo *HostInfo) {
+	if hh := c.vpnIps[hostinfo.vpnIp]; hh != nil && hh.hostinfo == hostinfo {
+		// A completed handshake has already finished its span
+		hh.span.finish(errHandshakeAbandoned)
+	}
+
 	delete(c.vpnIps, hostinfo.vpnIp)
 	if len(c.vpnIps) == 0 {
 		c.vpnIps = map[netip.Addr]*HandshakeHostInfo{}
@@ -579,6 +827,14 @@ func (c *HandshakeManager) unlockedDeleteHostInfo(hostinfo *HostInfo) {
 	}
 }
 
+// tracer returns the tracer of the interface, nil if there is no interface yet
+func (hm *HandshakeManager) tracer() *Tracer {
+	if hm.f == nil {
+		return nil
+	}
+	return hm.f.tracer
+}
+
 func (hm *HandshakeManager) QueryVpnIp(vpnIp netip.Addr) *HostInfo {
 	hh := hm.queryVpnIp(vpnIp)
 	if hh != nil {
@@ -608,8 +864,8 @@ func (hm *HandshakeManager) queryIndex(index uint32) *HandshakeHostInfo {
 	return hm.indexes[index]
 }
 
-func (c *HandshakeManager) GetPreferredRanges() []netip.Prefix {
-	return c.mainHostMap.GetPreferredRanges()
+func (c *HandshakeManager) PreferredRangesFor(h *HostInfo) []netip.Prefix {
+	return c.mainHostMap.PreferredRangesFor(h)
 }
 
 func (c *HandshakeManager) ForEachVpnIp(f controlEach) {
@@ -639,6 +895,10 @@ func (c *HandshakeManager) EmitStats() {
 	metrics.GetOrRegisterGauge("hostmap.pending.hosts", nil).Update(int64(hostLen))
 	metrics.GetOrRegisterGauge("hostmap.pending.indexes", nil).Update(int64(indexLen))
 	c.mainHostMap.EmitStats()
+
+	tc := c.TunnelCounts()
+	metrics.GetOrRegisterGauge("tunnels.current", nil).Update(int64(tc.Tunnels + tc.Pending))
+	metrics.GetOrRegisterGauge("tunnels.max", nil).Update(int64(tc.Max))
 }
 
 // Utility functions below
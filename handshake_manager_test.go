@@ -5,7 +5,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/test"
 	"github.com/slackhq/nebula/udp"
@@ -26,7 +28,6 @@ func Test_NewHandshakeManagerVpnIp(t *testing.T) {
 
 	cs := &CertState{
 		RawCertificate:      []byte{},
-		PrivateKey:          []byte{},
 		Certificate:         &cert.NebulaCertificate{},
 		RawCertificateNoKey: []byte{},
 	}
@@ -66,6 +67,97 @@ func Test_NewHandshakeManagerVpnIp(t *testing.T) {
 	assert.NotContains(t, blah.vpnIps, ip)
 }
 
+func Test_HandshakeManagerTunnelLimit(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip1 := netip.MustParseAddr("172.1.1.2")
+	ip2 := netip.MustParseAddr("172.1.1.3")
+
+	c := config.NewC(l)
+	c.Settings["tunnels"] = map[interface{}]interface{}{"max": 1}
+
+	mainHM := newHostMap(l, vpncidr)
+	lh := newTestLighthouse()
+
+	hc := defaultHandshakeConfig
+	hc.tunnelLimit = NewTunnelLimitFromConfig(l, c)
+	hm := NewHandshakeManager(l, mainHM, lh, &udp.NoopConn{}, hc)
+
+	i := hm.StartHandshake(ip1, nil)
+	assert.NotNil(t, i)
+
+	// A second vpn ip would exceed the limit
+	assert.Nil(t, hm.StartHandshake(ip2, nil))
+	assert.NotContains(t, hm.vpnIps, ip2)
+
+	// But the pending handshake is still reachable
+	assert.Same(t, i, hm.StartHandshake(ip1, nil))
+
+	assert.Equal(t, TunnelCounts{Tunnels: 0, Pending: 1, Relays: 0, Max: 1}, hm.TunnelCounts())
+
+	// A responder can not take the slot either
+	_, err := hm.CheckAndComplete(&HostInfo{vpnIp: ip2, localIndexId: 1}, 0, nil)
+	assert.ErrorIs(t, err, ErrTunnelLimit)
+	assert.NotContains(t, mainHM.Hosts, ip2)
+
+	// Lighthouses and relays are always allowed past the limit
+	lhIp := netip.MustParseAddr("172.1.1.10")
+	relayIp := netip.MustParseAddr("172.1.1.11")
+	lh.lighthouses.Store(&map[netip.Addr]struct{}{lhIp: {}})
+	lh.relaysForMe.Store(&[]netip.Addr{relayIp})
+	assert.NotNil(t, hm.StartHandshake(lhIp, nil))
+	assert.NotNil(t, hm.StartHandshake(relayIp, nil))
+	assert.Equal(t, TunnelCounts{Tunnels: 0, Pending: 3, Relays: 0, Max: 1}, hm.TunnelCounts())
+
+	// Raising the limit allows the new tunnel
+	hc.tunnelLimit.max.Store(4)
+	assert.NotNil(t, hm.StartHandshake(ip2, nil))
+}
+
+func TestHandshakeHostInfo_cachePacket(t *testing.T) {
+	l := test.NewLogger()
+	m := &cachedPacketMetrics{sent: metrics.NewCounter(), dropped: metrics.NewCounter()}
+	hh := &HandshakeHostInfo{hostinfo: &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.2")}}
+	cb := func(header.MessageType, header.MessageSubType, *HostInfo, []byte, []byte, []byte) {}
+
+	t.Log("Packets past max are dropped")
+	b := packetBufferConfig{max: 2}
+	for _, p := range []string{"one", "two", "three"} {
+		hh.cachePacket(l, header.Message, 0, []byte(p), cb, m, b)
+	}
+	assert.Len(t, hh.packetStore, 2)
+	assert.Equal(t, []byte("two"), hh.packetStore[1].packet)
+	assert.Equal(t, int64(1), m.dropped.Count())
+
+	t.Log("A max of 0 drops everything")
+	hh.packetStore = nil
+	hh.cachePacket(l, header.Message, 0, []byte("one"), cb, m, packetBufferConfig{})
+	assert.Empty(t, hh.packetStore)
+	assert.Equal(t, int64(2), m.dropped.Count())
+
+	t.Log("Lighthouse and control messages are not limited by max")
+	hh.cachePacket(l, header.LightHouse, 0, []byte("query"), cb, m, packetBufferConfig{})
+	hh.cachePacket(l, header.Control, 0, []byte("relay"), cb, m, packetBufferConfig{})
+	assert.Len(t, hh.packetStore, 2)
+	assert.Equal(t, int64(2), m.dropped.Count())
+
+	t.Log("Expired packets make room for new ones")
+	hh.packetStore = nil
+	b = packetBufferConfig{max: 2, maxAge: time.Second}
+	hh.cachePacket(l, header.Message, 0, []byte("one"), cb, m, b)
+	hh.cachePacket(l, header.Message, 0, []byte("two"), cb, m, b)
+	hh.packetStore[0].cachedAt = time.Now().Add(-2 * time.Second)
+	hh.cachePacket(l, header.Message, 0, []byte("three"), cb, m, b)
+	assert.Len(t, hh.packetStore, 2)
+	assert.Equal(t, []byte("two"), hh.packetStore[0].packet)
+	assert.Equal(t, []byte("three"), hh.packetStore[1].packet)
+	assert.Equal(t, int64(3), m.dropped.Count())
+
+	hh.expireCachedPackets(time.Now().Add(time.Minute), time.Second, m)
+	assert.Empty(t, hh.packetStore)
+	assert.Equal(t, int64(5), m.dropped.Count())
+}
+
 func testCountTimerWheelEntries(tw *LockingTimerWheel[netip.Addr]) (c int) {
 	for _, i := range tw.t.wheel {
 		n := i.Head
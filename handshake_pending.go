@@ -0,0 +1,103 @@
+package nebula
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// PendingHandshake is a handshake we started that has not completed yet
+type PendingHandshake struct {
+	VpnIp      netip.Addr `json:"vpnIp"`
+	LocalIndex uint32     `json:"localIndex"`
+	// Attempts is how many times the handshake was sent, or tried to be sent while we had no remotes
+	Attempts int64         `json:"attempts"`
+	Started  time.Time     `json:"started"`
+	Age      time.Duration `json:"age"`
+	// LastRemotes are the remotes the last attempt was sent to
+	LastRemotes []netip.AddrPort `json:"lastRemotes"`
+	Relays      []netip.Addr     `json:"relays"`
+}
+
+// ListPending returns the pending handshakes, oldest first
+func (hm *HandshakeManager) ListPending() []PendingHandshake {
+	hm.RLock()
+	hhs := make([]*HandshakeHostInfo, 0, len(hm.vpnIps))
+	for _, hh := range hm.vpnIps {
+		hhs = append(hhs, hh)
+	}
+	hm.RUnlock()
+
+	now := time.Now()
+	pending := make([]PendingHandshake, 0, len(hhs))
+	for _, hh := range hhs {
+		// handleOutbound locks a handshake before the manager, so this must happen without holding the manager lock
+		hh.Lock()
+		ph := PendingHandshake{
+			VpnIp:       hh.hostinfo.vpnIp,
+			LocalIndex:  hh.hostinfo.localIndexId,
+			Attempts:    hh.counter,
+			Started:     hh.startTime,
+			Age:         now.Sub(hh.startTime),
+			LastRemotes: append([]netip.AddrPort{}, hh.lastRemotes...),
+			Relays:      hh.hostinfo.relayState.CopyRelayIps(),
+		}
+		hh.Unlock()
+		pending = append(pending, ph)
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Started.Before(pending[j].Started)
+	})
+	return pending
+}
+
+// ClearPending gives up on the pending handshakes started more than olderThan ago, the same as if they had timed out.
+// Only the handshakes with vpnIps are considered, or every one if vpnIps is empty. Returns the vpn ips that were
+// cleared.
+func (hm *HandshakeManager) ClearPending(vpnIps []netip.Addr, olderThan time.Duration) []netip.Addr {
+	cutoff := time.Now().Add(-olderThan)
+
+	hm.Lock()
+	defer hm.Unlock()
+
+	candidates := hm.vpnIps
+	if len(vpnIps) > 0 {
+		candidates = make(map[netip.Addr]*HandshakeHostInfo, len(vpnIps))
+		for _, vpnIp := range vpnIps {
+			if hh, ok := hm.vpnIps[vpnIp]; ok {
+				candidates[vpnIp] = hh
+			}
+		}
+	}
+
+	// startTime never changes so it can be read without locking the handshake
+	cleared := map[*HandshakeHostInfo]struct{}{}
+	for _, hh := range candidates {
+		if hh.startTime.Before(cutoff) {
+			cleared[hh] = struct{}{}
+		}
+	}
+
+	clearedIps := make([]netip.Addr, 0, len(cleared))
+	for hh := range cleared {
+		hm.unlockedDeleteHostInfo(hh.hostinfo)
+		clearedIps = append(clearedIps, hh.hostinfo.vpnIp)
+		hh.hostinfo.logger(hm.l).
+			WithField("durationNs", time.Since(hh.startTime).Nanoseconds()).
+			Info("Pending handshake cleared")
+	}
+
+	// Make sure no index is left pointing at a handshake that is gone
+	for index, hh := range hm.indexes {
+		if _, ok := cleared[hh]; ok {
+			delete(hm.indexes, index)
+		}
+	}
+
+	hm.metricCleared.Inc(int64(len(clearedIps)))
+	sort.Slice(clearedIps, func(i, j int) bool {
+		return clearedIps[i].Less(clearedIps[j])
+	})
+	return clearedIps
+}
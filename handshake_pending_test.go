@@ -0,0 +1,64 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshakeManager_pending(t *testing.T) {
+	l := test.NewLogger()
+	mainHM := newHostMap(l, netip.MustParsePrefix("172.1.1.1/24"))
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+	hm.f = &Interface{handshakeManager: hm, pki: &PKI{}, l: l}
+	hm.f.pki.cs.Store(&CertState{Certificate: &cert.NebulaCertificate{}})
+	hm.metricCleared = metrics.NewCounter()
+
+	old := netip.MustParseAddr("172.1.1.2")
+	older := netip.MustParseAddr("172.1.1.3")
+	recent := netip.MustParseAddr("172.1.1.4")
+	for _, vpnIp := range []netip.Addr{old, older, recent} {
+		require.NotNil(t, hm.StartHandshake(vpnIp, nil))
+	}
+
+	now := time.Now()
+	hh := hm.queryVpnIp(old)
+	hh.startTime = now.Add(-time.Minute)
+	hh.counter = 3
+	hh.lastRemotes = []netip.AddrPort{netip.MustParseAddrPort("10.0.0.2:4242")}
+	require.NoError(t, hm.allocateIndex(hh))
+	hm.queryVpnIp(older).startTime = now.Add(-time.Hour)
+
+	pending := hm.ListPending()
+	require.Len(t, pending, 3)
+	assert.Equal(t, older, pending[0].VpnIp, "oldest first")
+	assert.Equal(t, old, pending[1].VpnIp)
+	assert.Equal(t, recent, pending[2].VpnIp)
+	assert.Equal(t, int64(3), pending[1].Attempts)
+	assert.Equal(t, hh.hostinfo.localIndexId, pending[1].LocalIndex)
+	assert.Equal(t, hh.lastRemotes, pending[1].LastRemotes)
+	assert.GreaterOrEqual(t, pending[1].Age, time.Minute)
+
+	t.Log("Only the listed vpn ips that are old enough are cleared")
+	assert.Empty(t, hm.ClearPending([]netip.Addr{old}, 2*time.Minute))
+	assert.Equal(t, []netip.Addr{old}, hm.ClearPending([]netip.Addr{old, recent}, 30*time.Second))
+	assert.Nil(t, hm.QueryVpnIp(old))
+	assert.Nil(t, hm.QueryIndex(hh.hostinfo.localIndexId), "the index is cleared with the vpn ip")
+
+	t.Log("Without vpn ips every pending handshake is considered")
+	assert.Equal(t, []netip.Addr{older}, hm.ClearPending(nil, 30*time.Second))
+	assert.Equal(t, []netip.Addr{recent}, hm.ClearPending(nil, 0))
+	assert.Empty(t, hm.ListPending())
+	assert.Equal(t, int64(3), hm.metricCleared.Count())
+
+	t.Log("A cleared vpn ip handshakes again")
+	assert.NotNil(t, hm.StartHandshake(old, nil))
+	assert.Len(t, hm.ListPending(), 1)
+}
@@ -0,0 +1,688 @@
+package nebula
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/header"
+)
+
+// NOISE XX Handshakes
+
+// The initiator sends an ephemeral key in the first message, nothing that identifies it. The responder sends its
+// certificate encrypted in the second and the initiator sends its own encrypted in the third, once it validated the
+// responder. Both sides have their keys after the third message.
+
+// handshakeStage0 constructs the first handshake packet of the attempt, hiding our certificate if
+// handshakes.hide_identity asks for it
+func handshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
+	if f.identityHiding.hide(hh.counter) {
+		return xxHandshakeStage0(f, hh)
+	}
+
+	hh.identityHidden = false
+	return ixHandshakeStage0(f, hh)
+}
+
+// This function constructs a handshake packet, but does not actually send it
+// Sending is done by the handshake manager
+func xxHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
+	err := f.handshakeManager.allocateIndex(hh)
+	if err != nil {
+		f.l.WithError(err).WithField("vpnIp", hh.hostinfo.vpnIp).
+			WithField("handshake", m{"stage": 0, "style": "xx_psk0"}).Error("Failed to generate index")
+		return false
+	}
+
+	certState := f.pki.GetCertState()
+	ci := NewConnectionState(f.l, f.cipher, certState, true, noise.HandshakeXX, []byte{}, 0)
+	hh.hostinfo.ConnectionState = ci
+	f.sourcePin.update(hh.hostinfo)
+
+	// The first message is in the clear, our certificate is only sent once the responder is known
+	hs := &NebulaHandshake{
+		Details: &NebulaHandshakeDetails{
+			InitiatorIndex: hh.hostinfo.localIndexId,
+			Time:           uint64(time.Now().UnixNano()),
+			AuthOnly:       f.authOnly.Enabled(),
+			TraceParent:    hh.span.traceParent(),
+		},
+	}
+	hsBytes, err := hs.Marshal()
+	if err != nil {
+		f.l.WithError(err).WithField("vpnIp", hh.hostinfo.vpnIp).
+			WithField("handshake", m{"stage": 0, "style": "xx_psk0"}).Error("Failed to marshal handshake message")
+		return false
+	}
+
+	h := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeXXPSK0, 0, 1)
+	msg, _, _, err := ci.H.WriteMessage(h, hsBytes)
+	if err != nil {
+		f.l.WithError(err).WithField("vpnIp", hh.hostinfo.vpnIp).
+			WithField("handshake", m{"stage": 0, "style": "xx_psk0"}).Error("Failed to call noise.WriteMessage")
+		return false
+	}
+
+	// We are sending handshake packet 1, so we don't expect to receive
+	// handshake packet 1 from the responder
+	ci.window.Update(f.l, 1)
+
+	hh.hostinfo.HandshakePacket[0] = msg
+	hh.ready = true
+	hh.identityHidden = true
+	hh.span.event("stage 1 built", attr("initiator_index", hh.hostinfo.localIndexId), attr("hide_identity", true))
+	return true
+}
+
+func xxHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet []byte, h *header.H) {
+	if f.identityHiding == nil {
+		return
+	}
+
+	certState := f.pki.GetCertState()
+	ci := NewConnectionState(f.l, f.cipher, certState, false, noise.HandshakeXX, []byte{}, 0)
+	// Mark packet 1 as seen so it doesn't show up as missed
+	ci.window.Update(f.l, 1)
+
+	msg, _, _, err := ci.H.ReadMessage(nil, packet[header.Len:])
+	if err != nil {
+		f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).Error("Failed to call noise.ReadMessage")
+		return
+	}
+
+	hs := &NebulaHandshake{}
+	err = hs.Unmarshal(msg)
+	if err != nil || hs.Details == nil {
+		f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).Error("Failed unmarshal handshake message")
+		return
+	}
+
+	first := xxFirstMessage{addr: addr, initiatorIndex: hs.Details.InitiatorIndex}
+	if via != nil {
+		first.relay = via.relayHI.vpnIp
+	}
+
+	now := time.Now()
+	if myIndex, msg2, ok := f.identityHiding.answered(first, now); ok {
+		// Our answer did not make it to the initiator, send the same one again
+		hl := f.l.WithField("udpAddr", addr).WithField("initiatorIndex", first.initiatorIndex).
+			WithField("responderIndex", myIndex).WithField("cached", true).
+			WithField("handshake", m{"stage": 2, "style": "xx_psk0"})
+		if err := xxHandshakeSend(f, nil, addr, via, msg2); err != nil {
+			hl.WithError(err).Error("Failed to send handshake message")
+		} else {
+			hl.Info("Handshake message sent")
+		}
+		return
+	}
+
+	myIndex, err := f.hostMap.generateIndex(f.l)
+	if err != nil {
+		f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).Error("Failed to generate index")
+		return
+	}
+
+	f.l.WithField("udpAddr", addr).
+		WithField("initiatorIndex", hs.Details.InitiatorIndex).WithField("remoteIndex", h.RemoteIndex).
+		WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).
+		Info("Handshake message received")
+
+	r := &xxResponder{
+		ci:             ci,
+		localIndex:     myIndex,
+		initiatorIndex: hs.Details.InitiatorIndex,
+		time:           hs.Details.Time,
+		authOnly:       hs.Details.AuthOnly,
+		first:          first,
+		via:            via,
+		created:        now,
+	}
+
+	hs.Details.ResponderIndex = myIndex
+	hs.Details.Cert = certState.RawCertificateNoKey
+	hs.Details.UserCert = f.pki.userCertFor(certState)
+	// Auth only requires both sides to opt in, tell the initiator what we decided
+	ci.authOnly = r.authOnly && f.authOnly.Enabled()
+	hs.Details.AuthOnly = ci.authOnly
+	// Update the time in case their clock is way off from ours
+	hs.Details.Time = uint64(now.UnixNano())
+
+	hsBytes, err := hs.Marshal()
+	if err != nil {
+		f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).Error("Failed to marshal handshake message")
+		return
+	}
+
+	nh := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeXXPSK0, hs.Details.InitiatorIndex, 2)
+	msg2, _, _, err := ci.H.WriteMessage(nh, hsBytes)
+	if err != nil {
+		f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).Error("Failed to call noise.WriteMessage")
+		return
+	}
+
+	// We are sending handshake packet 2, so we don't expect to receive
+	// handshake packet 2 from the initiator.
+	ci.window.Update(f.l, 2)
+
+	r.msg1 = make([]byte, len(packet[header.Len:]))
+	copy(r.msg1, packet[header.Len:])
+	r.msg2 = msg2
+
+	// The span joins the trace of the initiator and ends with the third message
+	r.span = f.tracer.start("handshake.respond", spanKindServer, hs.Details.TraceParent, attr("udp_addr", addr))
+	if via != nil {
+		r.span.event("stage 1 received", attr("relay", via.relayHI.vpnIp))
+	} else {
+		r.span.event("stage 1 received")
+	}
+
+	if !f.identityHiding.add(r) {
+		f.l.WithField("udpAddr", addr).WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).
+			Error("Too many handshakes are waiting for their last message, dropping")
+		r.span.finish(errHandshakeIncomplete)
+		return
+	}
+
+	err = xxHandshakeSend(f, nil, addr, via, msg2)
+	if err != nil {
+		f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("initiatorIndex", r.initiatorIndex).WithField("responderIndex", myIndex).
+			WithField("handshake", m{"stage": 2, "style": "xx_psk0"}).Error("Failed to send handshake")
+		return
+	}
+
+	f.l.WithField("udpAddr", addr).
+		WithField("initiatorIndex", r.initiatorIndex).WithField("responderIndex", myIndex).
+		WithField("handshake", m{"stage": 2, "style": "xx_psk0"}).Info("Handshake message sent")
+	r.span.event("stage 2 sent")
+}
+
+func xxHandshakeStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hh *HandshakeHostInfo, packet []byte, h *header.H) bool {
+	if hh == nil {
+		// Nothing here to tear down, got a bogus stage 2 packet
+		return true
+	}
+
+	hh.Lock()
+	defer hh.Unlock()
+
+	if !hh.identityHidden {
+		// This attempt did not hide our certificate, a late answer to an earlier attempt can not complete it
+		return false
+	}
+
+	hostinfo := hh.hostinfo
+	if addr.IsValid() {
+		if !f.lightHouse.GetRemoteAllowList().Allow(hostinfo.vpnIp, addr.Addr()) {
+			f.l.WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).Debug("lighthouse.remote_allow_list denied incoming handshake")
+			return false
+		}
+	}
+
+	ci := hostinfo.ConnectionState
+	msg, _, _, err := ci.H.ReadMessage(nil, packet[header.Len:])
+	if err != nil {
+		f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 2, "style": "xx_psk0"}).WithField("header", h).
+			Error("Failed to call noise.ReadMessage")
+
+		// We don't want to tear down the connection on a bad ReadMessage because it could be an attacker trying
+		// to DOS us. Every other error condition after should to allow a possible good handshake to complete in the
+		// near future
+		return false
+	}
+
+	hs := &NebulaHandshake{}
+	err = hs.Unmarshal(msg)
+	if err != nil || hs.Details == nil {
+		f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 2, "style": "xx_psk0"}).Error("Failed unmarshal handshake message")
+		return true
+	}
+
+	remoteCert, err := RecombineCertAndValidate(ci.H, hs.Details.Cert, f.pki.GetCAPool(), f.pki.GetClockSkew())
+	if err != nil && f.acceptExpiredCert(remoteCert, err, addr, 2) {
+		err = nil
+	}
+	if err != nil {
+		e := f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 2, "style": "xx_psk0"})
+
+		if f.l.Level > logrus.DebugLevel {
+			e = e.WithField("cert", remoteCert)
+		}
+
+		e.Error("Invalid certificate from host")
+		f.securityEvents.Load().handshakeRejected(addr, 2, remoteCert, err)
+
+		// We never revealed ourselves to this responder, tear down and start again
+		return true
+	}
+
+	if f.refusedByCertPolicy(remoteCert, addr, 2) {
+		return true
+	}
+
+	userCert, refused := f.refusedByUserCert(remoteCert, hs.Details.UserCert, addr, 2)
+	if refused {
+		return true
+	}
+
+	vpnIp, ok := netip.AddrFromSlice(remoteCert.Details.Ips[0].IP)
+	if !ok {
+		e := f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 2, "style": "xx_psk0"})
+
+		if f.l.Level > logrus.DebugLevel {
+			e = e.WithField("cert", remoteCert)
+		}
+
+		e.Info("Invalid vpn ip from host")
+		return true
+	}
+
+	vpnIp = vpnIp.Unmap()
+	certName := remoteCert.Details.Name
+	fingerprint, _ := remoteCert.Sha256Sum()
+	issuer := remoteCert.Details.Issuer
+
+	// Ensure the right host responded, before it learns who we are
+	if vpnIp != hostinfo.vpnIp {
+		f.l.WithField("intendedVpnIp", hostinfo.vpnIp).WithField("haveVpnIp", vpnIp).
+			WithField("udpAddr", addr).WithField("certName", certName).
+			WithField("handshake", m{"stage": 2, "style": "xx_psk0"}).
+			Info("Incorrect host responded to handshake")
+
+		handshakeWithIntendedHost(f, hh, addr, vpnIp)
+		return true
+	}
+
+	if f.duplicateVpnIp.check(f.hostMap, vpnIp, remoteCert, addr, 2, time.Now(), f.securityEvents.Load()) {
+		return true
+	}
+
+	certState := f.pki.GetCertState()
+	hs3 := &NebulaHandshake{
+		Details: &NebulaHandshakeDetails{
+			InitiatorIndex: hostinfo.localIndexId,
+			ResponderIndex: hs.Details.ResponderIndex,
+			Cert:           certState.RawCertificateNoKey,
+			UserCert:       f.pki.userCertFor(certState),
+			Time:           uint64(time.Now().UnixNano()),
+		},
+	}
+	hsBytes, err := hs3.Marshal()
+	if err != nil {
+		f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).Error("Failed to marshal handshake message")
+		return true
+	}
+
+	nh := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeXXPSK0, hs.Details.ResponderIndex, 3)
+	msg3, eKey, dKey, err := ci.H.WriteMessage(nh, hsBytes)
+	if err != nil {
+		f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).Error("Failed to call noise.WriteMessage")
+		return true
+	} else if dKey == nil || eKey == nil {
+		f.l.WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).Error("Noise did not arrive at a key")
+		return true
+	}
+
+	// Mark packet 2 as seen so it doesn't show up as missed, we sent packet 3 so our own traffic starts after it
+	ci.window.Update(f.l, 2)
+	ci.messageCounter.Add(1)
+
+	duration := time.Since(hh.startTime).Nanoseconds()
+	hl := f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+		WithField("certName", certName).
+		WithField("fingerprint", fingerprint).
+		WithField("issuer", issuer).
+		WithField("initiatorIndex", hs.Details.InitiatorIndex).WithField("responderIndex", hs.Details.ResponderIndex).
+		WithField("remoteIndex", h.RemoteIndex).WithField("handshake", m{"stage": 2, "style": "xx_psk0"}).
+		WithField("durationNs", duration).
+		WithField("sentCachedPackets", len(hh.packetStore))
+	if !addr.IsValid() {
+		hostinfo.relayReason = hh.relayReason(f.lightHouse.GetNATStatus().Type)
+		r := hostinfo.relayReason
+		hl = hl.WithField("relay", via.relayHI.vpnIp).WithField("relayReason", m{
+			"reason": r.Reason, "attempted": r.Attempted, "attempts": r.Attempts, "sendErrors": r.SendErrors,
+			"lastSendError": r.LastSendError, "natType": r.NATType,
+		})
+	}
+	hl.Info("Handshake message received")
+	hh.span.event("stage 2 received")
+
+	hostinfo.remoteIndexId = hs.Details.ResponderIndex
+	hostinfo.lastHandshakeTime = hs.Details.Time
+	f.lightHouse.observeClock(vpnIp, hs.Details.Time, time.Now())
+
+	// Keep the second message to recognize the responder asking for the third again
+	hostinfo.HandshakePacket[2] = make([]byte, len(packet[header.Len:]))
+	copy(hostinfo.HandshakePacket[2], packet[header.Len:])
+	hostinfo.HandshakePacket[3] = msg3
+
+	// Store their cert and our symmetric keys
+	ci.peerCert = remoteCert
+	ci.peerUserCert = userCert
+	ci.peerIdentity = newPeerIdentity(remoteCert, userCert)
+	ci.dKey = NewNebulaCipherState(dKey)
+	ci.eKey = NewNebulaCipherState(eKey)
+	ci.exportKeys.record(eKey, dKey)
+	ci.keyCreated = time.Now()
+	hostinfo.caFingerprint = remoteCert.Details.Issuer
+	// We only asked for auth only if we opted in, the responder only agrees if it did too
+	ci.authOnly = hs.Details.AuthOnly && f.authOnly.Enabled()
+
+	// Make sure the current udpAddr being used is set for responding
+	if addr.IsValid() {
+		hostinfo.SetRemote(addr)
+	} else {
+		hostinfo.relayState.InsertRelayTo(via.relayHI.vpnIp)
+	}
+
+	// Build up the radix for the firewall if we have subnets in the cert
+	hostinfo.CreateRemoteCIDR(remoteCert)
+
+	// The responder needs the third message before any of our traffic
+	err = xxHandshakeSend(f, hostinfo, addr, via, msg3)
+	if err != nil {
+		// The responder asks for it again when our traffic arrives
+		f.l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).Error("Failed to send handshake")
+	} else {
+		f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("initiatorIndex", hostinfo.localIndexId).WithField("responderIndex", hostinfo.remoteIndexId).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).Info("Handshake message sent")
+	}
+	hh.span.event("stage 3 sent")
+
+	// Complete our handshake and update metrics, this will replace any existing tunnels for this vpnIp
+	hh.span.finish(nil)
+	f.handshakeManager.Complete(hostinfo, f)
+	f.connectionManager.AddTrafficWatch(hostinfo.localIndexId)
+	f.authOnly.logNegotiation(f.l, hostinfo, hs.Details.AuthOnly)
+
+	if maxAge := f.handshakeManager.config.packetBuffer.maxAge; maxAge > 0 {
+		hh.expireCachedPackets(time.Now(), maxAge, f.cachedPacketMetrics)
+	}
+
+	if f.l.Level >= logrus.DebugLevel {
+		hostinfo.logger(f.l).Debugf("Sending %d stored packets", len(hh.packetStore))
+	}
+
+	if len(hh.packetStore) > 0 {
+		nb := make([]byte, 12, 12)
+		out := make([]byte, mtu)
+		for _, cp := range hh.packetStore {
+			cp.callback(cp.messageType, cp.messageSubType, hostinfo, cp.packet, nb, out)
+		}
+		f.cachedPacketMetrics.sent.Inc(int64(len(hh.packetStore)))
+	}
+
+	hostinfo.remotes.ResetBlockedRemotes()
+	f.metricHandshakes.Update(duration)
+
+	return false
+}
+
+func xxHandshakeStage3(f *Interface, addr netip.AddrPort, via *ViaSender, packet []byte, h *header.H) {
+	r := f.identityHiding.get(h.RemoteIndex, time.Now())
+	if r == nil {
+		if f.l.Level >= logrus.DebugLevel {
+			f.l.WithField("udpAddr", addr).WithField("remoteIndex", h.RemoteIndex).
+				WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).
+				Debug("No handshake is waiting for this message")
+		}
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.done {
+		return
+	}
+
+	ci := r.ci
+	msg, dKey, eKey, err := ci.H.ReadMessage(nil, packet[header.Len:])
+	if err != nil {
+		// Keep waiting, this could be an attacker that learned our index from the second message
+		f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).Error("Failed to call noise.ReadMessage")
+		return
+	}
+
+	// The handshake state machine is complete, whatever happens next there is no chance to recover
+	r.done = true
+	f.identityHiding.forget(r)
+	defer r.span.finish(errHandshakeIncomplete)
+
+	if dKey == nil || eKey == nil {
+		f.l.WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).Error("Noise did not arrive at a key")
+		return
+	}
+
+	hs := &NebulaHandshake{}
+	err = hs.Unmarshal(msg)
+	if err != nil || hs.Details == nil {
+		f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).Error("Failed unmarshal handshake message")
+		return
+	}
+	r.span.event("stage 3 received")
+
+	remoteCert, err := RecombineCertAndValidate(ci.H, hs.Details.Cert, f.pki.GetCAPool(), f.pki.GetClockSkew())
+	if err != nil && f.acceptExpiredCert(remoteCert, err, addr, 3) {
+		err = nil
+	}
+	if err != nil {
+		e := f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"})
+
+		if f.l.Level > logrus.DebugLevel {
+			e = e.WithField("cert", remoteCert)
+		}
+
+		e.Info("Invalid certificate from host")
+		f.securityEvents.Load().handshakeRejected(addr, 3, remoteCert, err)
+		return
+	}
+
+	if f.refusedByCertPolicy(remoteCert, addr, 3) {
+		return
+	}
+
+	userCert, refused := f.refusedByUserCert(remoteCert, hs.Details.UserCert, addr, 3)
+	if refused {
+		return
+	}
+
+	vpnIp, ok := netip.AddrFromSlice(remoteCert.Details.Ips[0].IP)
+	if !ok {
+		e := f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"})
+
+		if f.l.Level > logrus.DebugLevel {
+			e = e.WithField("cert", remoteCert)
+		}
+
+		e.Info("Invalid vpn ip from host")
+		return
+	}
+
+	vpnIp = vpnIp.Unmap()
+	certName := remoteCert.Details.Name
+	fingerprint, _ := remoteCert.Sha256Sum()
+	issuer := remoteCert.Details.Issuer
+
+	if vpnIp == f.myVpnNet.Addr() {
+		f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).Error("Refusing to handshake with myself")
+		return
+	}
+
+	if addr.IsValid() {
+		if !f.lightHouse.GetRemoteAllowList().Allow(vpnIp, addr.Addr()) {
+			f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).Debug("lighthouse.remote_allow_list denied incoming handshake")
+			return
+		}
+	}
+
+	if !f.handshakeManager.allowNewTunnel(vpnIp, false) {
+		return
+	}
+
+	if f.tunRecovery.refuse(f.hostMap, vpnIp) {
+		return
+	}
+
+	if f.duplicateVpnIp.check(f.hostMap, vpnIp, remoteCert, addr, 3, time.Now(), f.securityEvents.Load()) {
+		return
+	}
+
+	hostinfo := &HostInfo{
+		ConnectionState:   ci,
+		localIndexId:      r.localIndex,
+		remoteIndexId:     r.initiatorIndex,
+		vpnIp:             vpnIp,
+		HandshakePacket:   map[uint8][]byte{0: r.msg1, 2: r.msg2},
+		lastHandshakeTime: r.time,
+		relayState: RelayState{
+			relays:        map[netip.Addr]struct{}{},
+			relayForByIp:  map[netip.Addr]*Relay{},
+			relayForByIdx: map[uint32]*Relay{},
+		},
+	}
+
+	hl := f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+		WithField("certName", certName).
+		WithField("fingerprint", fingerprint).
+		WithField("issuer", issuer).
+		WithField("initiatorIndex", r.initiatorIndex).WithField("responderIndex", r.localIndex).
+		WithField("remoteIndex", h.RemoteIndex).WithField("handshake", m{"stage": 3, "style": "xx_psk0"})
+	hl.Info("Handshake message received")
+
+	// Mark packet 3 as seen so it doesn't show up as missed
+	ci.window.Update(f.l, 3)
+
+	ci.peerCert = remoteCert
+	ci.peerUserCert = userCert
+	ci.peerIdentity = newPeerIdentity(remoteCert, userCert)
+	ci.dKey = NewNebulaCipherState(dKey)
+	ci.eKey = NewNebulaCipherState(eKey)
+	ci.exportKeys.record(eKey, dKey)
+	ci.keyCreated = time.Now()
+	hostinfo.caFingerprint = remoteCert.Details.Issuer
+
+	hostinfo.remotes = f.lightHouse.QueryCache(vpnIp)
+	if addr.IsValid() {
+		hostinfo.SetRemote(addr)
+		f.sourcePin.update(hostinfo)
+	} else if via != nil {
+		hostinfo.relayState.InsertRelayTo(via.relayHI.vpnIp)
+		hostinfo.relayReason = &RelayReason{Reason: RelayReasonPeerInitiated, NATType: f.lightHouse.GetNATStatus().Type}
+	}
+	hostinfo.CreateRemoteCIDR(remoteCert)
+
+	existing, err := f.handshakeManager.CheckAndComplete(hostinfo, 0, f)
+	if err != nil {
+		switch err {
+		case ErrExistingHostInfo:
+			// This means there was an existing tunnel and this handshake was older than the one we are currently based on
+			hl.WithField("oldHandshakeTime", existing.lastHandshakeTime).
+				WithField("newHandshakeTime", hostinfo.lastHandshakeTime).
+				Info("Handshake too old")
+
+			// Send a test packet to trigger an authenticated tunnel test, this should suss out any lingering tunnel issues
+			f.SendMessageToVpnIp(header.Test, header.TestRequest, vpnIp, []byte(""), make([]byte, 12, 12), make([]byte, mtu))
+		case ErrLocalIndexCollision:
+			hl.WithField("localIndex", hostinfo.localIndexId).WithField("collision", existing.vpnIp).
+				Error("Failed to add HostInfo due to localIndex collision")
+		case ErrTunnelLimit:
+			// Already logged, the handshake is dropped
+		default:
+			hl.WithError(err).Error("Failed to add HostInfo to HostMap")
+		}
+		return
+	}
+
+	f.connectionManager.AddTrafficWatch(hostinfo.localIndexId)
+	f.authOnly.logNegotiation(f.l, hostinfo, r.authOnly)
+	r.span.finish(nil)
+
+	hostinfo.remotes.ResetBlockedRemotes()
+}
+
+// xxResendStage2 sends the second message again if a responder with localIndex is still waiting for the third. The
+// initiator has its keys once it sent the third message, if that got lost its traffic is the first we hear of it.
+// It returns true if there was a responder waiting.
+func xxResendStage2(f *Interface, localIndex uint32) bool {
+	r := f.identityHiding.get(localIndex, time.Now())
+	if r == nil {
+		return false
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.done || time.Since(r.resent) < xxResendInterval {
+		return true
+	}
+	r.resent = time.Now()
+
+	// Only ever answer where the first message came from, a spoofed packet can not direct this anywhere else
+	hl := f.l.WithField("udpAddr", r.first.addr).
+		WithField("initiatorIndex", r.initiatorIndex).WithField("responderIndex", r.localIndex).
+		WithField("cached", true).WithField("handshake", m{"stage": 2, "style": "xx_psk0"})
+	if err := xxHandshakeSend(f, nil, r.first.addr, r.via, r.msg2); err != nil {
+		hl.WithError(err).Error("Failed to send handshake message")
+	} else {
+		hl.Info("Traffic arrived before the last handshake message, asking for it again")
+	}
+	return true
+}
+
+// xxResendStage3 sends the third message again if packet is the second message of a tunnel we completed
+func xxResendStage3(f *Interface, via *ViaSender, packet []byte, h *header.H) {
+	hostinfo := f.hostMap.QueryIndex(h.RemoteIndex)
+	if hostinfo == nil || hostinfo.HandshakePacket[3] == nil ||
+		!bytes.Equal(hostinfo.HandshakePacket[2], packet[header.Len:]) {
+		return
+	}
+
+	// Only ever answer to the tunnel, a replayed second message can not direct this anywhere else
+	hl := hostinfo.logger(f.l).WithField("udpAddr", hostinfo.remote).WithField("cached", true).
+		WithField("handshake", m{"stage": 3, "style": "xx_psk0"})
+	if err := xxHandshakeSend(f, hostinfo, hostinfo.remote, via, hostinfo.HandshakePacket[3]); err != nil {
+		hl.WithError(err).Error("Failed to send handshake message")
+	} else {
+		hl.Info("Handshake message sent")
+	}
+}
+
+// xxHandshakeSend sends a handshake message to addr, or back through the relay it arrived on if addr is not valid
+func xxHandshakeSend(f *Interface, hostinfo *HostInfo, addr netip.AddrPort, via *ViaSender, msg []byte) error {
+	f.messageMetrics.Tx(header.Handshake, header.MessageSubType(msg[1]), 1)
+	if addr.IsValid() {
+		return f.sendHandshake(hostinfo, msg, addr, false)
+	}
+
+	if via == nil {
+		return errors.New("both addr and via are nil")
+	}
+	f.SendVia(via.relayHI, via.relay, msg, make([]byte, 12), make([]byte, mtu), false)
+	return nil
+}
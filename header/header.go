@@ -50,8 +50,12 @@ var typeMap = map[MessageType]string{
 }
 
 const (
-	MessageNone  MessageSubType = 0
-	MessageRelay MessageSubType = 1
+	MessageNone       MessageSubType = 0
+	MessageRelay      MessageSubType = 1
+	MessageAuthOnly   MessageSubType = 2
+	MessageKeepalive  MessageSubType = 3
+	MessageAuthorized MessageSubType = 4
+	MessagePadded     MessageSubType = 5
 )
 
 const (
@@ -60,8 +64,9 @@ const (
 )
 
 const (
-	HandshakeIXPSK0 MessageSubType = 0
-	HandshakeXXPSK0 MessageSubType = 1
+	HandshakeIXPSK0   MessageSubType = 0
+	HandshakeXXPSK0   MessageSubType = 1
+	HandshakeFragment MessageSubType = 2
 )
 
 var ErrHeaderTooShort = errors.New("header is too short")
@@ -75,15 +80,21 @@ var subTypeNoneMap = map[MessageSubType]string{0: "none"}
 
 var subTypeMap = map[MessageType]*map[MessageSubType]string{
 	Message: {
-		MessageNone:  "none",
-		MessageRelay: "relay",
+		MessageNone:       "none",
+		MessageRelay:      "relay",
+		MessageAuthOnly:   "authOnly",
+		MessageKeepalive:  "keepalive",
+		MessageAuthorized: "authorized",
+		MessagePadded:     "padded",
 	},
 	RecvError:   &subTypeNoneMap,
 	LightHouse:  &subTypeNoneMap,
 	Test:        &subTypeTestMap,
 	CloseTunnel: &subTypeNoneMap,
 	Handshake: {
-		HandshakeIXPSK0: "ix_psk0",
+		HandshakeIXPSK0:   "ix_psk0",
+		HandshakeXXPSK0:   "xx_psk0",
+		HandshakeFragment: "fragment",
 	},
 	Control: &subTypeNoneMap,
 }
@@ -87,15 +87,21 @@ func TestTypeMap(t *testing.T) {
 
 	assert.Equal(t, map[MessageType]*map[MessageSubType]string{
 		Message: {
-			MessageNone:  "none",
-			MessageRelay: "relay",
+			MessageNone:       "none",
+			MessageRelay:      "relay",
+			MessageAuthOnly:   "authOnly",
+			MessageKeepalive:  "keepalive",
+			MessageAuthorized: "authorized",
+			MessagePadded:     "padded",
 		},
 		RecvError:   &subTypeNoneMap,
 		LightHouse:  &subTypeNoneMap,
 		Test:        &subTypeTestMap,
 		CloseTunnel: &subTypeNoneMap,
 		Handshake: {
-			HandshakeIXPSK0: "ix_psk0",
+			HandshakeIXPSK0:   "ix_psk0",
+			HandshakeXXPSK0:   "xx_psk0",
+			HandshakeFragment: "fragment",
 		},
 		Control: &subTypeNoneMap,
 	}, subTypeMap)
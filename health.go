@@ -0,0 +1,346 @@
+package nebula
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+const (
+	defaultHealthPath     = "/health"
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthFailures = 3
+)
+
+// healthProbeMagic prefixes the payload of a health probe, followed by a big endian uint64 probe id
+var healthProbeMagic = probeMagic{'h', 'l', 't', 'h'}
+
+// HealthCheck probes every lighthouse once per interval, see probeTimers, and serves a readiness endpoint over http.
+// The node is ready when its certificate is valid, the tun device is up and enough lighthouses have answered a recent
+// probe. Lighthouses are only probed while the endpoint is served or LighthouseSelection needs their round trip times.
+type HealthCheck struct {
+	listen string
+	path   string
+
+	timers         atomic.Pointer[probeTimers]
+	minLighthouses atomic.Int64
+	requireTun     atomic.Bool
+
+	tunUp atomic.Bool
+	// tunFailing is set by TunRecovery while writes to the tun device fail
+	tunFailing atomic.Bool
+
+	sync.Mutex
+	probes probeSet[netip.Addr]
+
+	l *logrus.Logger
+}
+
+// HealthStatus is the body of the health endpoint
+type HealthStatus struct {
+	Ready       bool              `json:"ready"`
+	Cert        HealthComponent   `json:"cert"`
+	Tun         HealthComponent   `json:"tun"`
+	Lighthouses HealthLighthouses `json:"lighthouses"`
+}
+
+// HealthComponent is the status of a single readiness criteria
+type HealthComponent struct {
+	Ok      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// HealthLighthouses is the status of the lighthouse readiness criteria
+type HealthLighthouses struct {
+	Ok          bool                        `json:"ok"`
+	Required    int                         `json:"required"`
+	Reachable   []HealthLighthouseReachable `json:"reachable"`
+	Unreachable []netip.Addr                `json:"unreachable"`
+}
+
+// HealthLighthouseReachable is a lighthouse that answered a recent probe
+type HealthLighthouseReachable struct {
+	VpnIp netip.Addr    `json:"vpnIp"`
+	RTT   time.Duration `json:"rtt"`
+}
+
+// NewHealthCheckFromConfig always returns a HealthCheck, the endpoint is only served if health.listen is configured
+func NewHealthCheckFromConfig(l *logrus.Logger, c *config.C) (*HealthCheck, error) {
+	listen := c.GetString("health.listen", "")
+	if listen != "" {
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			return nil, fmt.Errorf("health.listen is invalid: %w", err)
+		}
+	}
+
+	hc := &HealthCheck{
+		listen: listen,
+		path:   c.GetString("health.path", defaultHealthPath),
+		l:      l,
+	}
+
+	err := hc.reload(c, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		err := hc.reload(c, false)
+		if err != nil {
+			l.WithError(err).Error("Failed to reload health")
+		}
+	})
+
+	return hc, nil
+}
+
+func (hc *HealthCheck) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("health") {
+		return nil
+	}
+
+	if !initial && (c.GetString("health.listen", "") != hc.listen || c.GetString("health.path", defaultHealthPath) != hc.path) {
+		hc.l.Warn("Changing health.listen or health.path requires a restart")
+	}
+
+	timers, err := newProbeTimersFromConfig(c, "health.", defaultHealthInterval, defaultHealthFailures)
+	if err != nil {
+		return err
+	}
+
+	// max_age predates failures, it is how long a lighthouse stays reachable after its last reply
+	if maxAge := c.GetDuration("health.max_age", 0); maxAge != 0 && c.Get("health.failures") == nil {
+		if maxAge < timers.interval {
+			return fmt.Errorf("health.max_age must not be shorter than health.interval")
+		}
+		timers.failures = min(int(maxAge/timers.interval), maxProbeFailures)
+		hc.l.WithField("failures", timers.failures).Warn("health.max_age is deprecated, use health.failures")
+	}
+
+	minLighthouses := c.GetInt("health.min_lighthouses", 1)
+	if minLighthouses < 0 {
+		return fmt.Errorf("health.min_lighthouses must not be negative")
+	}
+
+	hc.timers.Store(timers)
+	hc.minLighthouses.Store(int64(minLighthouses))
+	hc.requireTun.Store(c.GetBool("health.require_tun", true))
+
+	if !initial {
+		hc.l.Info("health changed")
+	}
+	return nil
+}
+
+// markTunUp records that the tun device was brought up successfully
+func (hc *HealthCheck) markTunUp(up bool) {
+	if hc != nil {
+		hc.tunUp.Store(up)
+	}
+}
+
+// markTunFailing records whether writes to the tun device are failing, see TunRecovery
+func (hc *HealthCheck) markTunFailing(failing bool) {
+	if hc != nil {
+		hc.tunFailing.Store(failing)
+	}
+}
+
+// Run probes every lighthouse once per interval until ctx is done, only while the endpoint is served or lighthouse
+// selection is enabled
+func (hc *HealthCheck) Run(ctx context.Context, f *Interface) {
+	if hc == nil {
+		return
+	}
+
+	clockSource := time.NewTicker(time.Second)
+	defer clockSource.Stop()
+
+	var nextRound time.Time
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case now := <-clockSource.C:
+			if now.Before(nextRound) || (hc.listen == "" && !f.lightHouse.selection.enabled()) {
+				continue
+			}
+			nextRound = now.Add(hc.timers.Load().interval)
+
+			lighthouses := f.lightHouse.GetLighthouses()
+			hc.forget(lighthouses)
+			for vpnIp := range lighthouses {
+				f.SendMessageToVpnIp(header.Test, header.TestRequest, vpnIp, hc.newProbe(vpnIp, now), nb, out)
+			}
+		}
+	}
+}
+
+// forget drops the probe state of lighthouses that were removed from the config
+func (hc *HealthCheck) forget(lighthouses map[netip.Addr]struct{}) {
+	hc.Lock()
+	hc.probes.retain(func(vpnIp netip.Addr) bool {
+		_, ok := lighthouses[vpnIp]
+		return ok
+	})
+	hc.Unlock()
+}
+
+// newProbe records a probe to a lighthouse and returns its payload
+func (hc *HealthCheck) newProbe(vpnIp netip.Addr, now time.Time) []byte {
+	hc.Lock()
+	id := hc.probes.send(vpnIp, now, hc.timers.Load())
+	hc.Unlock()
+
+	return healthProbeMagic.payload(id)
+}
+
+// handleReply records a test reply to one of our probes, returns false if the reply was not a probe
+func (hc *HealthCheck) handleReply(hostinfo *HostInfo, d []byte, now time.Time) bool {
+	id, ok := healthProbeMagic.parse(d)
+	if hc == nil || !ok || len(d) != probeLen {
+		return false
+	}
+
+	hc.Lock()
+	defer hc.Unlock()
+	_, ok = hc.probes.reply(hostinfo.vpnIp, id, now, hc.timers.Load())
+	return ok
+}
+
+// lighthouse returns a copy of the probe state of a lighthouse and the timers it is judged by, ok is false if the
+// lighthouse was never probed
+func (hc *HealthCheck) lighthouse(vpnIp netip.Addr) (p probe, timers *probeTimers, ok bool) {
+	timers = hc.timers.Load()
+	hc.Lock()
+	defer hc.Unlock()
+	if lp := hc.probes.get(vpnIp); lp != nil {
+		return *lp, timers, true
+	}
+	return probe{}, timers, false
+}
+
+// status evaluates the readiness criteria
+func (hc *HealthCheck) status(crt *cert.NebulaCertificate, lighthouses map[netip.Addr]struct{}, now time.Time) HealthStatus {
+	s := HealthStatus{
+		Cert: HealthComponent{Ok: true},
+		Tun:  HealthComponent{Ok: true},
+	}
+
+	switch {
+	case crt == nil:
+		s.Cert = HealthComponent{Message: "no certificate loaded"}
+	case crt.Details.NotBefore.After(now):
+		s.Cert = HealthComponent{Message: fmt.Sprintf("certificate is not valid until %s", crt.Details.NotBefore)}
+	case crt.Details.NotAfter.Before(now):
+		s.Cert = HealthComponent{Message: fmt.Sprintf("certificate expired at %s", crt.Details.NotAfter)}
+	}
+
+	if hc.requireTun.Load() {
+		if !hc.tunUp.Load() {
+			s.Tun = HealthComponent{Message: "tun device is not up"}
+		} else if hc.tunFailing.Load() {
+			s.Tun = HealthComponent{Message: "tun device is failing writes"}
+		}
+	}
+
+	// A node can never reach more lighthouses than it has, this keeps lighthouses themselves ready
+	required := int(hc.minLighthouses.Load())
+	if required > len(lighthouses) {
+		required = len(lighthouses)
+	}
+
+	s.Lighthouses = HealthLighthouses{
+		Required:    required,
+		Reachable:   []HealthLighthouseReachable{},
+		Unreachable: []netip.Addr{},
+	}
+
+	timers := hc.timers.Load()
+	hc.Lock()
+	for vpnIp := range lighthouses {
+		if p := hc.probes.get(vpnIp); p != nil && p.heardWithin(now, timers) {
+			s.Lighthouses.Reachable = append(s.Lighthouses.Reachable, HealthLighthouseReachable{VpnIp: vpnIp, RTT: p.rtt})
+		} else {
+			s.Lighthouses.Unreachable = append(s.Lighthouses.Unreachable, vpnIp)
+		}
+	}
+	hc.Unlock()
+
+	sort.Slice(s.Lighthouses.Reachable, func(i, j int) bool {
+		return s.Lighthouses.Reachable[i].VpnIp.Less(s.Lighthouses.Reachable[j].VpnIp)
+	})
+	sort.Slice(s.Lighthouses.Unreachable, func(i, j int) bool {
+		return s.Lighthouses.Unreachable[i].Less(s.Lighthouses.Unreachable[j])
+	})
+	s.Lighthouses.Ok = len(s.Lighthouses.Reachable) >= required
+
+	s.Ready = s.Cert.Ok && s.Tun.Ok && s.Lighthouses.Ok
+	return s
+}
+
+// handler answers 200 when ready and 503 otherwise, the body is always the json HealthStatus
+func (hc *HealthCheck) handler(f *Interface) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var crt *cert.NebulaCertificate
+		if cs := f.pki.GetCertState(); cs != nil {
+			crt = cs.Certificate
+		}
+
+		s := hc.status(crt, f.lightHouse.GetLighthouses(), time.Now())
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if s.Ready {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(s)
+	})
+}
+
+// start returns a func that serves the health endpoint until ctx is done, nil if health.listen is not configured
+func (hc *HealthCheck) start(ctx context.Context, f *Interface) func() {
+	if hc == nil || hc.listen == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(hc.path, hc.handler(f))
+	srv := &http.Server{
+		Addr:              hc.listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	return func() {
+		go func() {
+			<-ctx.Done()
+			_ = srv.Close()
+		}()
+
+		hc.l.WithField("listen", hc.listen).WithField("path", hc.path).Info("Health check listening")
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			hc.l.WithError(err).Error("Health check server failed")
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHealthCheckFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Lighthouses can be probed for LighthouseSelection but the endpoint is not served by default
+	hc, err := NewHealthCheckFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Nil(t, hc.start(context.Background(), nil))
+
+	c.Settings["health"] = map[interface{}]interface{}{"listen": "127.0.0.1:8090", "interval": "5s"}
+	hc, err = NewHealthCheckFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Equal(t, defaultHealthPath, hc.path)
+	assert.Equal(t, &probeTimers{interval: 5 * time.Second, timeout: 5 * time.Second, failures: 3}, hc.timers.Load())
+	assert.Equal(t, int64(1), hc.minLighthouses.Load())
+	assert.True(t, hc.requireTun.Load())
+
+	c.Settings["health"] = map[interface{}]interface{}{"listen": "nope"}
+	_, err = NewHealthCheckFromConfig(l, c)
+	assert.ErrorContains(t, err, "health.listen is invalid")
+
+	c.Settings["health"] = map[interface{}]interface{}{"listen": "127.0.0.1:8090", "interval": "10s", "max_age": "5s"}
+	_, err = NewHealthCheckFromConfig(l, c)
+	assert.EqualError(t, err, "health.max_age must not be shorter than health.interval")
+
+	// The deprecated max_age becomes failures unless failures is set
+	c.Settings["health"] = map[interface{}]interface{}{"listen": "127.0.0.1:8090", "interval": "10s", "max_age": "1m"}
+	hc, err = NewHealthCheckFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Equal(t, 6, hc.timers.Load().failures)
+
+	c.Settings["health"] = map[interface{}]interface{}{"listen": "127.0.0.1:8090", "interval": "10s", "max_age": "1m", "failures": 2}
+	hc, err = NewHealthCheckFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Equal(t, 2, hc.timers.Load().failures)
+
+	c.Settings["health"] = map[interface{}]interface{}{"listen": "127.0.0.1:8090", "timeout": "20s"}
+	_, err = NewHealthCheckFromConfig(l, c)
+	assert.EqualError(t, err, "health.timeout must be between 10ms and health.interval 10s, got 20s")
+}
+
+func TestHealthCheck_status(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["health"] = map[interface{}]interface{}{"listen": "127.0.0.1:8090", "interval": "10s", "min_lighthouses": 2}
+	hc, err := NewHealthCheckFromConfig(l, c)
+	require.NoError(t, err)
+
+	now := time.Now()
+	crt := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(time.Hour),
+	}}
+	lh1 := netip.MustParseAddr("10.128.0.1")
+	lh2 := netip.MustParseAddr("10.128.0.2")
+	lh3 := netip.MustParseAddr("10.128.0.3")
+	lighthouses := map[netip.Addr]struct{}{lh1: {}, lh2: {}, lh3: {}}
+
+	s := hc.status(crt, lighthouses, now)
+	assert.False(t, s.Ready)
+	assert.True(t, s.Cert.Ok)
+	assert.Equal(t, HealthComponent{Message: "tun device is not up"}, s.Tun)
+	assert.Equal(t, HealthLighthouses{
+		Required:    2,
+		Reachable:   []HealthLighthouseReachable{},
+		Unreachable: []netip.Addr{lh1, lh2, lh3},
+	}, s.Lighthouses)
+
+	hc.markTunUp(true)
+	reply := func(vpnIp netip.Addr, sent, at time.Time) {
+		p := hc.newProbe(vpnIp, sent)
+		assert.True(t, hc.handleReply(&HostInfo{vpnIp: vpnIp}, p, at))
+	}
+	reply(lh1, now.Add(-time.Second), now)
+	assert.False(t, hc.status(crt, lighthouses, now).Ready)
+
+	// Replies from another host, stale probes and other test replies are ignored
+	p := hc.newProbe(lh2, now)
+	assert.False(t, hc.handleReply(&HostInfo{vpnIp: lh3}, p, now))
+	hc.newProbe(lh2, now)
+	assert.False(t, hc.handleReply(&HostInfo{vpnIp: lh2}, p, now))
+	assert.False(t, hc.handleReply(&HostInfo{vpnIp: lh2}, []byte("rtt1"), now))
+
+	reply(lh2, now.Add(-2*time.Second), now.Add(-time.Second))
+	s = hc.status(crt, lighthouses, now)
+	assert.True(t, s.Ready)
+	assert.Equal(t, HealthLighthouses{
+		Ok:       true,
+		Required: 2,
+		Reachable: []HealthLighthouseReachable{
+			{VpnIp: lh1, RTT: time.Second},
+			{VpnIp: lh2, RTT: time.Second},
+		},
+		Unreachable: []netip.Addr{lh3},
+	}, s.Lighthouses)
+
+	// A lighthouse is unreachable once failures probes after its last reply timed out
+	s = hc.status(crt, lighthouses, now.Add(35*time.Second-2*time.Second))
+	assert.True(t, s.Lighthouses.Ok)
+	s = hc.status(crt, lighthouses, now.Add(35*time.Second))
+	assert.False(t, s.Lighthouses.Ok)
+	assert.Len(t, s.Lighthouses.Reachable, 1)
+
+	// A reply slower than the timeout does not count
+	p = hc.newProbe(lh3, now)
+	assert.True(t, hc.handleReply(&HostInfo{vpnIp: lh3}, p, now.Add(6*time.Second)), "the reply is still ours")
+	assert.Len(t, hc.status(crt, lighthouses, now.Add(6*time.Second)).Lighthouses.Unreachable, 1)
+
+	// Lighthouses, or nodes with fewer lighthouses than required, only need the ones they have
+	assert.True(t, hc.status(crt, nil, now).Ready)
+
+	s = hc.status(crt, lighthouses, now.Add(2*time.Hour))
+	assert.False(t, s.Cert.Ok)
+	assert.Contains(t, s.Cert.Message, "certificate expired at")
+	assert.False(t, hc.status(nil, lighthouses, now).Ready)
+}
@@ -35,6 +35,8 @@ const (
 	Requested = iota
 	PeerRequested
 	Established
+	// Disestablished is a relay we sent a RelayTeardown for and are waiting on the ack, it no longer carries traffic
+	Disestablished
 )
 
 const (
@@ -49,6 +51,12 @@ type Relay struct {
 	LocalIndex  uint32
 	RemoteIndex uint32
 	PeerIp      netip.Addr
+
+	// Since is when the relay entered its state, Sent is when the last request or teardown for it was sent and
+	// Attempts is how many were sent again because the peer did not answer, see relay_lifecycle.go
+	Since    time.Time
+	Sent     time.Time
+	Attempts int
 }
 
 type HostMap struct {
@@ -60,6 +68,15 @@ type HostMap struct {
 	preferredRanges atomic.Pointer[[]netip.Prefix]
 	vpnCIDR         netip.Prefix
 	l               *logrus.Logger
+
+	// preferredRangeOverrides give some peers their own preferred ranges, see preferredRangesFor
+	preferredRangeOverrides atomic.Pointer[[]preferredRangeOverride]
+
+	// retired holds tunnels that were replaced by a newer tunnel so their in flight packets can still be decrypted
+	retired map[uint32]retiredTunnel
+
+	// segment is set when this overlay shares its udp listener with other segments, see SharedListener
+	segment *listenerSegment
 }
 
 // For synchronization, treat the pointed-to Relay struct as immutable. To edit the Relay
@@ -79,6 +96,19 @@ func (rs *RelayState) DeleteRelay(ip netip.Addr) {
 	delete(rs.relays, ip)
 }
 
+// RemoveRelay removes the relay with the local index, returns the vpn ip it was for
+func (rs *RelayState) RemoveRelay(localIdx uint32) (netip.Addr, bool) {
+	rs.Lock()
+	defer rs.Unlock()
+	r, ok := rs.relayForByIdx[localIdx]
+	if !ok {
+		return netip.Addr{}, false
+	}
+	delete(rs.relayForByIdx, localIdx)
+	delete(rs.relayForByIp, r.PeerIp)
+	return r.PeerIp, true
+}
+
 func (rs *RelayState) CopyAllRelayFor() []*Relay {
 	rs.RLock()
 	defer rs.RUnlock()
@@ -142,6 +172,8 @@ func (rs *RelayState) CompleteRelayByIP(vpnIp netip.Addr, remoteIdx uint32) bool
 	newRelay := *r
 	newRelay.State = Established
 	newRelay.RemoteIndex = remoteIdx
+	newRelay.Since = time.Now()
+	newRelay.Attempts = 0
 	rs.relayForByIdx[r.LocalIndex] = &newRelay
 	rs.relayForByIp[r.PeerIp] = &newRelay
 	return true
@@ -157,6 +189,23 @@ func (rs *RelayState) CompleteRelayByIdx(localIdx uint32, remoteIdx uint32) (*Re
 	newRelay := *r
 	newRelay.State = Established
 	newRelay.RemoteIndex = remoteIdx
+	newRelay.Since = time.Now()
+	newRelay.Attempts = 0
+	rs.relayForByIdx[r.LocalIndex] = &newRelay
+	rs.relayForByIp[r.PeerIp] = &newRelay
+	return &newRelay, true
+}
+
+// UpdateRelay replaces the relay with the local index with a copy changed by update, returns the copy
+func (rs *RelayState) UpdateRelay(localIdx uint32, update func(r *Relay)) (*Relay, bool) {
+	rs.Lock()
+	defer rs.Unlock()
+	r, ok := rs.relayForByIdx[localIdx]
+	if !ok {
+		return nil, false
+	}
+	newRelay := *r
+	update(&newRelay)
 	rs.relayForByIdx[r.LocalIndex] = &newRelay
 	rs.relayForByIp[r.PeerIp] = &newRelay
 	return &newRelay, true
@@ -216,6 +265,74 @@ type HostInfo struct {
 	lastRoam       time.Time
 	lastRoamRemote netip.AddrPort
 
+	// lastUsed is the unix nano time this tunnel was last seen carrying traffic by the connection manager
+	lastUsed atomic.Int64
+
+	// dataSeen is set when inner traffic passes through this tunnel, the connection manager moves it into lastData
+	dataSeen atomic.Bool
+	lastData atomic.Int64
+
+	// lastIndexCollision is the unix nano time we last sent a recv_error for a packet that hit this tunnel's index
+	// but failed to decrypt
+	lastIndexCollision atomic.Int64
+
+	// lastRelayRepair is the unix nano time we last tried to repair a missing relay index on this relay tunnel,
+	// relayRepairAttempts counts the repairs since a relay was last established through it
+	lastRelayRepair     atomic.Int64
+	relayRepairAttempts atomic.Int32
+
+	// latency holds the latency probe results for each candidate remote
+	latency latencyState
+
+	// relayShare counts what was sent through each relay when traffic to this host is load shared
+	relayShare relayShareStats
+
+	// errCounters counts the packets this tunnel failed to deliver
+	errCounters tunnelErrors
+
+	// roamPinned is set when the peer is listed in roam_pin, the tunnel never roams away from its remote.
+	// lastRoamPinWarn is the unix nano time we last logged a refused roam.
+	roamPinned      atomic.Bool
+	lastRoamPinWarn atomic.Int64
+
+	// paused is set while the data of the tunnel is stopped with pause-tunnel
+	paused atomic.Bool
+
+	// sourcePin holds the local addresses from listen.source_pins that packets to this peer are sent from, nil if the
+	// kernel chooses
+	sourcePin atomic.Pointer[sourcePinAddrs]
+
+	// transport is the transportType the last packet to the peer was sent on
+	transport atomic.Uint32
+
+	// keepalive is the keepaliveType last sent to maintain NAT state, 0 until one is sent
+	keepalive atomic.Uint32
+
+	// relayDraining is set on the tunnel to a relay that told us it is draining, it is no longer used for new relays
+	// and tunnels through it move to another relay
+	relayDraining atomic.Bool
+
+	// sendBackoff pauses sends to this host while the underlay is failing, see SendBackoff
+	sendBackoff sendBackoffState
+
+	// quality holds the loss and rtt estimates for this tunnel, see TunnelQuality
+	quality tunnelQualityState
+
+	// mtu holds the mtu probe search and the discovered tunnel mtu, see MTUProbe
+	mtu mtuState
+
+	// rekeyClasses has a bit set for each rekey class the current keys have carried, rekeyKicked is set once a class
+	// packet found the keys too old and lastRekey is the unix nano time we last started a rekey. See Rekey.
+	rekeyClasses atomic.Uint32
+	rekeyKicked  atomic.Bool
+	lastRekey    atomic.Int64
+
+	// relayReason explains why the handshake that established this tunnel went through a relay, nil if it was direct
+	relayReason *RelayReason
+
+	// caFingerprint is the fingerprint of the CA that validated the peer certificate during the handshake
+	caFingerprint string
+
 	// Used to track other hostinfos for this vpn ip since only 1 can be primary
 	// Synchronised via hostmap lock and not the hostinfo lock.
 	next, prev *HostInfo
@@ -232,6 +349,7 @@ type cachedPacket struct {
 	messageSubType header.MessageSubType
 	callback       packetCallback
 	packet         []byte
+	cachedAt       time.Time
 }
 
 type packetCallback func(t header.MessageType, st header.MessageSubType, h *HostInfo, p, nb, out []byte)
@@ -288,6 +406,19 @@ func (hm *HostMap) reload(c *config.C, initial bool) {
 			hm.l.WithField("oldPreferredRanges", *oldRanges).WithField("newPreferredRanges", preferredRanges).Info("preferred_ranges changed")
 		}
 	}
+
+	if initial || c.HasChanged("preferred_range_overrides") {
+		overrides, err := parsePreferredRangeOverrides(c.Get("preferred_range_overrides"))
+		if err != nil {
+			hm.l.WithError(err).Error("Failed to parse preferred_range_overrides, keeping the old overrides")
+			return
+		}
+
+		hm.preferredRangeOverrides.Store(&overrides)
+		if !initial || len(overrides) > 0 {
+			hm.l.WithField("overrides", len(overrides)).Info("preferred_range_overrides loaded")
+		}
+	}
 }
 
 // EmitStats reports host, index, and relay counts to the stats collection system
@@ -360,6 +491,8 @@ func (hm *HostMap) unlockedMakePrimary(hostinfo *HostInfo) {
 }
 
 func (hm *HostMap) unlockedDeleteHostInfo(hostinfo *HostInfo) {
+	hm.unlockedRetire(hostinfo, time.Now())
+
 	primary, ok := hm.Hosts[hostinfo.vpnIp]
 	if ok && primary == hostinfo {
 		// The vpnIp pointer points to the same hostinfo as the local index id, we can remove it
@@ -415,6 +548,22 @@ func (hm *HostMap) unlockedDeleteHostInfo(hostinfo *HostInfo) {
 	}
 }
 
+// generateIndex returns a random local index. In a segment of a SharedListener the top bits are the segment id so
+// packets for the index can be dispatched to this segment.
+func (hm *HostMap) generateIndex(l *logrus.Logger) (uint32, error) {
+	for {
+		index, err := generateIndex(l)
+		if err != nil || hm.segment == nil {
+			return index, err
+		}
+
+		index = hm.segment.id<<segmentIndexShift | index&segmentIndexMask
+		if index != 0 {
+			return index, nil
+		}
+	}
+}
+
 func (hm *HostMap) QueryIndex(index uint32) *HostInfo {
 	hm.RLock()
 	if h, ok := hm.Indexes[index]; ok {
@@ -476,7 +625,7 @@ func (hm *HostMap) queryVpnIp(vpnIp netip.Addr, promoteIfce *Interface) *HostInf
 		hm.RUnlock()
 		// Do not attempt promotion if you are a lighthouse
 		if promoteIfce != nil && !promoteIfce.lightHouse.amLighthouse {
-			h.TryPromoteBest(hm.GetPreferredRanges(), promoteIfce)
+			h.TryPromoteBest(hm, promoteIfce)
 		}
 		return h
 
@@ -504,6 +653,12 @@ func (hm *HostMap) unlockedAddHostInfo(hostinfo *HostInfo, f *Interface) {
 
 	hm.Indexes[hostinfo.localIndexId] = hostinfo
 	hm.RemoteIndexes[hostinfo.remoteIndexId] = hostinfo
+	hostinfo.roamPinned.Store(f.roamPin.pinned(hostinfo))
+	hostinfo.paused.Store(f.tunnelPause.isPaused(hostinfo.vpnIp))
+	f.sourcePin.update(hostinfo)
+	now := time.Now().UnixNano()
+	hostinfo.lastUsed.Store(now)
+	hostinfo.lastData.Store(now)
 
 	if hm.l.Level >= logrus.DebugLevel {
 		hm.l.WithField("hostMap", m{"vpnIp": hostinfo.vpnIp, "mapTotalSize": len(hm.Hosts),
@@ -547,23 +702,20 @@ func (hm *HostMap) ForEachIndex(f controlEach) {
 
 // TryPromoteBest handles re-querying lighthouses and probing for better paths
 // NOTE: It is an error to call this if you are a lighthouse since they should not roam clients!
-func (i *HostInfo) TryPromoteBest(preferredRanges []netip.Prefix, ifce *Interface) {
+func (i *HostInfo) TryPromoteBest(hm *HostMap, ifce *Interface) {
 	c := i.promoteCounter.Add(1)
 	if c%ifce.tryPromoteEvery.Load() == 0 {
 		remote := i.remote
+		override, preferredRanges := hm.preferredRangesFor(i)
 
-		// return early if we are already on a preferred remote
-		if remote.IsValid() {
-			rIP := remote.Addr()
-			for _, l := range preferredRanges {
-				if l.Contains(rIP) {
-					return
-				}
-			}
+		// return early if we are already on a most preferred remote
+		tier := preferredTier(remote.Addr(), override, preferredRanges)
+		if remote.IsValid() && tier == 0 {
+			return
 		}
 
-		i.remotes.ForEach(preferredRanges, func(addr netip.AddrPort, preferred bool) {
-			if remote.IsValid() && (!addr.IsValid() || !preferred) {
+		i.remotes.ForEach(preferredRanges, func(addr netip.AddrPort, _ bool) {
+			if remote.IsValid() && (!addr.IsValid() || preferredTier(addr.Addr(), override, preferredRanges) >= tier) {
 				return
 			}
 
@@ -592,7 +744,10 @@ func (i *HostInfo) GetCert() *cert.NebulaCertificate {
 	return nil
 }
 
+// SetRemote changes the remote of the tunnel. Remotes are always stored unmapped, a dual stack socket hands us ipv4
+// sources as v4 mapped ipv6 and the same peer must not look like a new remote.
 func (i *HostInfo) SetRemote(remote netip.AddrPort) {
+	remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
 	// We copy here because we likely got this remote from a source that reuses the object
 	if i.remote != remote {
 		i.remote = remote
@@ -613,21 +768,9 @@ func (i *HostInfo) SetRemoteIfPreferred(hm *HostMap, newRemote netip.AddrPort) b
 		return true
 	}
 
-	// NOTE: We do this loop here instead of calling `isPreferred` in
-	// remote_list.go so that we only have to loop over preferredRanges once.
-	newIsPreferred := false
-	for _, l := range hm.GetPreferredRanges() {
-		// return early if we are already on a preferred remote
-		if l.Contains(currentRemote.Addr()) {
-			return false
-		}
-
-		if l.Contains(newRemote.Addr()) {
-			newIsPreferred = true
-		}
-	}
-
-	if newIsPreferred {
+	// Only roam if the new remote is in a more preferred range, an override for the peer wins over preferred_ranges
+	override, preferredRanges := hm.preferredRangesFor(i)
+	if preferredTier(newRemote.Addr(), override, preferredRanges) < preferredTier(currentRemote.Addr(), override, preferredRanges) {
 		// Consider this a roaming event
 		i.lastRoam = time.Now()
 		i.lastRoamRemote = currentRemote
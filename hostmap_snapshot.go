@@ -0,0 +1,269 @@
+package nebula
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	hostmapSnapshotVersion        = 1
+	defaultHostmapSnapshotMaxAge  = time.Hour
+	hostmapSnapshotFileMode       = 0600
+	hostmapSnapshotTempFileSuffix = ".tmp"
+)
+
+var errHostmapSnapshotVersion = errors.New("unsupported hostmap snapshot version")
+
+// HostmapSnapshot saves the addresses we know for our peers on a graceful shutdown and loads them again on the next
+// start, so tunnels can be re-established without waiting on the lighthouses. Only what we have learned about the
+// underlay is stored, never keys or certificates.
+type HostmapSnapshot struct {
+	path   string
+	maxAge time.Duration
+	l      *logrus.Logger
+}
+
+// hostmapSnapshotFile is the on disk format, Version must be bumped on any incompatible change
+type hostmapSnapshotFile struct {
+	Version int                   `json:"version"`
+	Time    time.Time             `json:"time"`
+	VpnIp   netip.Addr            `json:"vpnIp"`
+	Hosts   []hostmapSnapshotHost `json:"hosts"`
+}
+
+type hostmapSnapshotHost struct {
+	VpnIp          netip.Addr     `json:"vpnIp"`
+	Remote         netip.AddrPort `json:"remote,omitempty"`
+	LastRoam       time.Time      `json:"lastRoam,omitempty"`
+	LastRoamRemote netip.AddrPort `json:"lastRoamRemote,omitempty"`
+	Cache          CacheMap       `json:"cache"`
+}
+
+// NewHostmapSnapshotFromConfig returns nil if hostmap_snapshot.path is not configured
+func NewHostmapSnapshotFromConfig(l *logrus.Logger, c *config.C) *HostmapSnapshot {
+	path := c.GetString("hostmap_snapshot.path", "")
+	if path == "" {
+		return nil
+	}
+
+	return &HostmapSnapshot{
+		path:   path,
+		maxAge: c.GetDuration("hostmap_snapshot.max_age", defaultHostmapSnapshotMaxAge),
+		l:      l,
+	}
+}
+
+// Save writes the current lighthouse cache and tunnel remotes to the snapshot file. The file is replaced atomically so
+// a crash mid write never leaves a partial snapshot behind.
+func (s *HostmapSnapshot) Save(lh *LightHouse, hm *HostMap) error {
+	if s == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(buildHostmapSnapshot(lh, hm, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+"-*"+hostmapSnapshotTempFileSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Chmod(hostmapSnapshotFileMode); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Restore seeds the lighthouse cache from the snapshot file. A missing, stale, or foreign snapshot is not an error, we
+// simply start cold.
+func (s *HostmapSnapshot) Restore(lh *LightHouse) error {
+	if s == nil {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var snap hostmapSnapshotFile
+	if err = json.Unmarshal(b, &snap); err != nil {
+		return err
+	}
+
+	if snap.Version != hostmapSnapshotVersion {
+		return fmt.Errorf("%w: %v", errHostmapSnapshotVersion, snap.Version)
+	}
+
+	log := s.l.WithField("path", s.path).WithField("snapshotTime", snap.Time)
+	if age := time.Since(snap.Time); s.maxAge > 0 && age > s.maxAge {
+		log.WithField("maxAge", s.maxAge).Info("Ignoring stale hostmap snapshot")
+		return nil
+	}
+
+	if snap.VpnIp != lh.myVpnNet.Addr() {
+		log.WithField("snapshotVpnIp", snap.VpnIp).Info("Ignoring hostmap snapshot taken by a different host")
+		return nil
+	}
+
+	seeded := lh.restoreHostmapSnapshot(snap.Hosts)
+	log.WithField("hosts", seeded).Info("Restored hostmap snapshot")
+	return nil
+}
+
+func buildHostmapSnapshot(lh *LightHouse, hm *HostMap, now time.Time) hostmapSnapshotFile {
+	hosts := map[netip.Addr]*hostmapSnapshotHost{}
+
+	lh.RLock()
+	for vpnIp, rl := range lh.addrMap {
+		hosts[vpnIp] = &hostmapSnapshotHost{VpnIp: vpnIp, Cache: *rl.CopyCache()}
+	}
+	lh.RUnlock()
+
+	hm.RLock()
+	for vpnIp, hostinfo := range hm.Hosts {
+		h, ok := hosts[vpnIp]
+		if !ok {
+			h = &hostmapSnapshotHost{VpnIp: vpnIp, Cache: CacheMap{}}
+			hosts[vpnIp] = h
+		}
+		h.Remote = hostinfo.remote
+		h.LastRoam = hostinfo.lastRoam
+		h.LastRoamRemote = hostinfo.lastRoamRemote
+	}
+	hm.RUnlock()
+
+	snap := hostmapSnapshotFile{
+		Version: hostmapSnapshotVersion,
+		Time:    now,
+		VpnIp:   lh.myVpnNet.Addr(),
+		Hosts:   make([]hostmapSnapshotHost, 0, len(hosts)),
+	}
+	for _, h := range hosts {
+		snap.Hosts = append(snap.Hosts, *h)
+	}
+
+	sort.Slice(snap.Hosts, func(i, j int) bool {
+		return snap.Hosts[i].VpnIp.Less(snap.Hosts[j].VpnIp)
+	})
+	return snap
+}
+
+// restoreHostmapSnapshot adds the snapshot addresses to the cache, everything still passes through the remote allow
+// list. Peers that end up with an address are remembered so the first handshake to them does not wait on a lighthouse
+// query. Returns the number of hosts seeded.
+func (lh *LightHouse) restoreHostmapSnapshot(hosts []hostmapSnapshotHost) int {
+	staticList := lh.GetStaticHostList()
+	seeded := 0
+
+	for _, h := range hosts {
+		if !h.VpnIp.IsValid() || h.VpnIp == lh.myVpnNet.Addr() || !lh.myVpnNet.Contains(h.VpnIp) {
+			continue
+		}
+
+		lh.Lock()
+		rl := lh.unlockedGetRemoteList(h.VpnIp)
+		rl.Lock()
+		lh.Unlock()
+
+		for owner, c := range h.Cache {
+			ownerVpnIp, err := netip.ParseAddr(owner)
+			if err != nil {
+				continue
+			}
+			lh.unlockedRestoreCache(rl, ownerVpnIp, h.VpnIp, c)
+		}
+
+		if h.Remote.IsValid() && lh.shouldAdd(h.VpnIp, h.Remote.Addr()) {
+			if h.Remote.Addr().Is4() {
+				rl.unlockedSetLearnedV4(h.VpnIp, NewIp4AndPortFromNetIP(h.Remote.Addr(), h.Remote.Port()))
+			} else {
+				rl.unlockedSetLearnedV6(h.VpnIp, NewIp6AndPortFromNetIP(h.Remote.Addr(), h.Remote.Port()))
+			}
+		}
+
+		rl.unlockedCollect()
+		ok := len(rl.addrs) > 0 || len(rl.relays) > 0
+		rl.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		seeded++
+		if _, static := staticList[h.VpnIp]; !static && !lh.amLighthouse {
+			lh.snapshotSeeded.Store(h.VpnIp, struct{}{})
+		}
+	}
+
+	return seeded
+}
+
+// unlockedRestoreCache loads one owners entries into rl. rl must be write locked.
+func (lh *LightHouse) unlockedRestoreCache(rl *RemoteList, ownerVpnIp, vpnIp netip.Addr, c *Cache) {
+	if c == nil {
+		return
+	}
+
+	var v4 []*Ip4AndPort
+	var v6 []*Ip6AndPort
+	for _, a := range c.Reported {
+		if a.Addr().Is4() {
+			v4 = append(v4, NewIp4AndPortFromNetIP(a.Addr(), a.Port()))
+		} else {
+			v6 = append(v6, NewIp6AndPortFromNetIP(a.Addr(), a.Port()))
+		}
+	}
+	if len(v4) > 0 {
+		rl.unlockedSetV4(ownerVpnIp, vpnIp, v4, lh.unlockedShouldAddV4)
+	}
+	if len(v6) > 0 {
+		rl.unlockedSetV6(ownerVpnIp, vpnIp, v6, lh.unlockedShouldAddV6)
+	}
+
+	for _, a := range c.Learned {
+		if !lh.shouldAdd(vpnIp, a.Addr()) {
+			continue
+		}
+		if a.Addr().Is4() {
+			rl.unlockedSetLearnedV4(ownerVpnIp, NewIp4AndPortFromNetIP(a.Addr(), a.Port()))
+		} else {
+			rl.unlockedSetLearnedV6(ownerVpnIp, NewIp6AndPortFromNetIP(a.Addr(), a.Port()))
+		}
+	}
+
+	if len(c.Relay) > 0 {
+		rl.unlockedSetRelay(ownerVpnIp, vpnIp, c.Relay)
+	}
+}
+
+// takeSnapshotSeed returns true the first time it is called for a peer that was seeded from a hostmap snapshot
+func (lh *LightHouse) takeSnapshotSeed(vpnIp netip.Addr) bool {
+	_, ok := lh.snapshotSeeded.LoadAndDelete(vpnIp)
+	return ok
+}
@@ -0,0 +1,128 @@
+package nebula
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostmapSnapshot(t *testing.T) {
+	l := test.NewLogger()
+	path := filepath.Join(t.TempDir(), "hostmap.json")
+	myVpnNet := netip.MustParsePrefix("10.128.0.2/24")
+	lhIp := netip.MustParseAddr("10.128.0.1")
+	peer := netip.MustParseAddr("10.128.0.3")
+	relay := netip.MustParseAddr("10.128.0.4")
+
+	newLH := func() *LightHouse {
+		c := config.NewC(l)
+		c.Settings["lighthouse"] = map[interface{}]interface{}{"hosts": []interface{}{lhIp.String()}}
+		c.Settings["static_host_map"] = map[interface{}]interface{}{lhIp.String(): []interface{}{"100.1.1.1:4242"}}
+		lh, err := NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+		require.NoError(t, err)
+		return lh
+	}
+
+	c := config.NewC(l)
+	assert.Nil(t, NewHostmapSnapshotFromConfig(l, c))
+	c.Settings["hostmap_snapshot"] = map[interface{}]interface{}{"path": path}
+	s := NewHostmapSnapshotFromConfig(l, c)
+	require.NotNil(t, s)
+	assert.Equal(t, defaultHostmapSnapshotMaxAge, s.maxAge)
+
+	// Nothing saved yet, start cold
+	require.NoError(t, s.Restore(newLH()))
+
+	reported := netip.MustParseAddrPort("1.1.1.1:4242")
+	learned := netip.MustParseAddrPort("2.2.2.2:4242")
+	current := netip.MustParseAddrPort("[2001:db8::1]:4242")
+
+	lh := newLH()
+	rl := lh.QueryCache(peer)
+	rl.Lock()
+	rl.unlockedSetV4(lhIp, peer, []*Ip4AndPort{NewIp4AndPortFromNetIP(reported.Addr(), reported.Port())}, lh.unlockedShouldAddV4)
+	rl.unlockedSetRelay(lhIp, peer, []netip.Addr{relay})
+	rl.Unlock()
+	rl.LearnRemote(relay, learned)
+
+	hm := newHostMap(l, myVpnNet)
+	hm.unlockedAddHostInfo(&HostInfo{
+		vpnIp:          peer,
+		remote:         current,
+		lastRoam:       time.Now(),
+		lastRoamRemote: learned,
+		remotes:        rl,
+		relayState:     RelayState{relayForByIdx: map[uint32]*Relay{}, relayForByIp: map[netip.Addr]*Relay{}},
+	}, &Interface{})
+	require.NoError(t, s.Save(lh, hm))
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(hostmapSnapshotFileMode), fi.Mode().Perm())
+	tmps, _ := filepath.Glob(path + "-*" + hostmapSnapshotTempFileSuffix)
+	assert.Empty(t, tmps)
+
+	// Restore seeds the cache and skips the first lighthouse query for the peer only
+	lh = newLH()
+	require.NoError(t, s.Restore(lh))
+	addrs := lh.QueryCache(peer).CopyAddrs(nil)
+	assert.ElementsMatch(t, []netip.AddrPort{reported, learned, current}, addrs)
+	assert.Equal(t, []netip.Addr{relay}, (*lh.QueryCache(peer).CopyCache())[lhIp.String()].Relay)
+	assert.True(t, lh.takeSnapshotSeed(peer))
+	assert.False(t, lh.takeSnapshotSeed(peer))
+	assert.False(t, lh.takeSnapshotSeed(lhIp))
+
+	readSnap := func() hostmapSnapshotFile {
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		var snap hostmapSnapshotFile
+		require.NoError(t, json.Unmarshal(b, &snap))
+		return snap
+	}
+	writeSnap := func(snap hostmapSnapshotFile) {
+		b, err := json.Marshal(snap)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, b, hostmapSnapshotFileMode))
+	}
+
+	snap := readSnap()
+	assert.Equal(t, hostmapSnapshotVersion, snap.Version)
+	assert.Equal(t, myVpnNet.Addr(), snap.VpnIp)
+	for _, h := range snap.Hosts {
+		if h.VpnIp == peer {
+			assert.Equal(t, current, h.Remote)
+			assert.Equal(t, learned, h.LastRoamRemote)
+		}
+	}
+
+	// Stale snapshots are ignored
+	stale := snap
+	stale.Time = time.Now().Add(-2 * defaultHostmapSnapshotMaxAge)
+	writeSnap(stale)
+	lh = newLH()
+	require.NoError(t, s.Restore(lh))
+	assert.False(t, lh.takeSnapshotSeed(peer))
+
+	// As are snapshots from another host
+	foreign := snap
+	foreign.VpnIp = peer
+	writeSnap(foreign)
+	lh = newLH()
+	require.NoError(t, s.Restore(lh))
+	assert.False(t, lh.takeSnapshotSeed(peer))
+
+	// Unknown versions are an error
+	future := snap
+	future.Version = hostmapSnapshotVersion + 1
+	writeSnap(future)
+	assert.ErrorIs(t, s.Restore(newLH()), errHostmapSnapshotVersion)
+}
@@ -225,3 +225,14 @@ func TestHostMap_reload(t *testing.T) {
 	c.ReloadConfigString("preferred_ranges: [1.1.1.1/32]")
 	assert.EqualValues(t, []string{"1.1.1.1/32"}, toS(hm.GetPreferredRanges()))
 }
+
+func TestHostInfo_SetRemoteUnmaps(t *testing.T) {
+	h := &HostInfo{vpnIp: netip.MustParseAddr("10.0.0.2"), remotes: NewRemoteList(nil)}
+
+	h.SetRemote(netip.MustParseAddrPort("[::ffff:1.2.3.4]:4242"))
+	assert.Equal(t, netip.MustParseAddrPort("1.2.3.4:4242"), h.remote)
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("1.2.3.4:4242")}, h.remotes.CopyAddrs(nil))
+
+	h.SetRemote(netip.MustParseAddrPort("[2001:db8::1]:4242"))
+	assert.Equal(t, netip.MustParseAddrPort("[2001:db8::1]:4242"), h.remote)
+}
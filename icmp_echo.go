@@ -0,0 +1,44 @@
+package nebula
+
+import (
+	"net/netip"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// replyICMPEcho answers an icmp echo request to our own vpn ip in place of the host stack when tun.icmp_echo_reply is
+// set. packet has passed the inbound firewall as fwPacket, the reply is built over it and sent back on the tunnel it
+// arrived on if the outbound firewall allows it. Returns true if packet was consumed and must not be written to the tun.
+func (f *Interface) replyICMPEcho(packet []byte, fwPacket *firewall.Packet, hostinfo *HostInfo, nb, out []byte, q int, localCache firewall.ConntrackCache) bool {
+	// Echo requests to anything but our own vpn ip, such as an unsafe network, are for the host to answer
+	if !f.icmpEchoReply.Load() || fwPacket.Protocol != firewall.ProtoICMP || fwPacket.LocalIP != f.myVpnNet.Addr() {
+		return false
+	}
+
+	reply := iputil.CreateICMPEchoResponse(packet, packet)
+	if reply == nil {
+		return false
+	}
+
+	// The reply is the same flow seen from our side, its outbound firewall packet is the inbound one of the request
+	dropRule, dropReason := f.firewall.DropRule(*fwPacket, false, false, hostinfo, f.pki.GetCAPool(), localCache)
+	if dropReason != nil {
+		hostinfo.errCounters.firewallDrops.Add(1)
+		f.dropWatch.notify(*fwPacket, false, hostinfo, dropRule, dropReason)
+		f.securityEvents.Load().firewallDrop(*fwPacket, false, hostinfo, dropRule, dropReason)
+		if f.l.Level >= logrus.DebugLevel {
+			hostinfo.logger(f.l).WithField("fwPacket", fwPacket).
+				WithField("reason", dropReason).
+				WithField("rule", dropRule).
+				Debugln("dropping icmp echo reply")
+		}
+		return true
+	}
+
+	f.metricICMPEchoReply.Inc(1)
+	f.sendNoMetricsFlow(header.Message, 0, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, fwPacket, reply, nb, out, q)
+	return true
+}
@@ -0,0 +1,252 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// The modes of handshakes.hide_identity
+const (
+	hideIdentityOff     = "off"
+	hideIdentityPrefer  = "prefer"
+	hideIdentityRequire = "require"
+)
+
+const (
+	defaultHideIdentityFallback = 3
+
+	// xxPendingMax bounds the responders waiting for the last noise XX message, a flood of first messages can not
+	// grow it further
+	xxPendingMax = 1024
+	// xxPendingTimeout is how long a responder waits for the last noise XX message
+	xxPendingTimeout = 30 * time.Second
+	// xxResendInterval limits how often a responder asks for the last noise XX message again
+	xxResendInterval = time.Second
+)
+
+// IdentityHiding controls whether this node hides its certificate when it initiates a handshake. The default noise IX
+// handshake sends the certificate of the initiator, with its name, groups and ips, in the clear in the first message.
+// Hidden, the handshake is noise XX instead: the first message only carries an ephemeral key, the responder sends its
+// certificate encrypted in the second and the initiator sends its own in the third, encrypted and only once it has
+// validated the responder.
+//
+// Every node answers a noise XX handshake regardless of the mode. Older nodes silently ignore one, in prefer mode the
+// initiator falls back to noise IX after handshakes.hide_identity_fallback unanswered attempts, in require mode it never
+// does and incoming noise IX handshakes are refused.
+//
+// A responder has to keep the handshake state between the second and the third message, the pending responders are
+// kept here, bounded and expired, until the handshake completes.
+type IdentityHiding struct {
+	mode     atomic.Pointer[string]
+	fallback atomic.Int64
+
+	sync.Mutex
+	// pending is the responders waiting for the third message by their local index
+	pending map[uint32]*xxResponder
+	// sent is the local index of the responder that answered a first message, a retransmitted first message gets the
+	// same answer
+	sent map[xxFirstMessage]uint32
+
+	metricFallback    metrics.Counter
+	metricRefused     metrics.Counter
+	metricPendingFull metrics.Counter
+
+	l *logrus.Logger
+}
+
+// xxFirstMessage identifies the first message of a noise XX handshake, a retransmission has the same
+type xxFirstMessage struct {
+	addr           netip.AddrPort
+	relay          netip.Addr
+	initiatorIndex uint32
+}
+
+// xxResponder is the state of a responder that sent the second noise XX message
+type xxResponder struct {
+	sync.Mutex
+	// done is true once the third message was read, the handshake state can not be used again
+	done bool
+
+	ci             *ConnectionState
+	localIndex     uint32
+	initiatorIndex uint32
+	// time is the handshake time of the initiator
+	time uint64
+	// authOnly is true if the initiator asked for auth only
+	authOnly bool
+	msg1     []byte
+	msg2     []byte
+	first    xxFirstMessage
+	via      *ViaSender
+	created  time.Time
+	// resent is when the second message was last sent again
+	resent time.Time
+	span   *span
+}
+
+func NewIdentityHidingFromConfig(l *logrus.Logger, c *config.C) (*IdentityHiding, error) {
+	ih := &IdentityHiding{
+		pending:           map[uint32]*xxResponder{},
+		sent:              map[xxFirstMessage]uint32{},
+		metricFallback:    metrics.GetOrRegisterCounter("handshakes.hide_identity.fallback", nil),
+		metricRefused:     metrics.GetOrRegisterCounter("handshakes.hide_identity.refused", nil),
+		metricPendingFull: metrics.GetOrRegisterCounter("handshakes.hide_identity.pending_full", nil),
+		l:                 l,
+	}
+	if err := ih.reload(c, true); err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := ih.reload(c, false); err != nil {
+			l.WithError(err).Error("Failed to reload handshakes.hide_identity, keeping the previous mode")
+		}
+	})
+
+	return ih, nil
+}
+
+func (ih *IdentityHiding) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("handshakes.hide_identity") && !c.HasChanged("handshakes.hide_identity_fallback") {
+		return nil
+	}
+
+	mode := strings.ToLower(c.GetString("handshakes.hide_identity", hideIdentityOff))
+	if mode == "false" {
+		// yaml reads an unquoted off as false
+		mode = hideIdentityOff
+	}
+
+	switch mode {
+	case hideIdentityOff, hideIdentityPrefer, hideIdentityRequire:
+	default:
+		return fmt.Errorf("unknown handshakes.hide_identity mode `%s`. possible modes: %s", mode,
+			[]string{hideIdentityOff, hideIdentityPrefer, hideIdentityRequire})
+	}
+
+	fallback := c.GetInt("handshakes.hide_identity_fallback", defaultHideIdentityFallback)
+	if fallback < 1 {
+		return fmt.Errorf("handshakes.hide_identity_fallback must be at least 1, got %d", fallback)
+	}
+
+	ih.mode.Store(&mode)
+	ih.fallback.Store(int64(fallback))
+	if !initial || mode != hideIdentityOff {
+		ih.l.WithField("mode", mode).WithField("fallback", fallback).Info("Handshake identity hiding configured")
+	}
+	return nil
+}
+
+func (ih *IdentityHiding) getMode() string {
+	if ih == nil {
+		return hideIdentityOff
+	}
+	return *ih.mode.Load()
+}
+
+// hide returns true if attempt, counted from 1, of a handshake we initiate should hide our certificate
+func (ih *IdentityHiding) hide(attempt int64) bool {
+	switch ih.getMode() {
+	case hideIdentityRequire:
+		return true
+	case hideIdentityPrefer:
+		return attempt <= ih.fallback.Load()
+	}
+	return false
+}
+
+// fellBack records that a handshake gave up on hiding our certificate
+func (ih *IdentityHiding) fellBack(l *logrus.Entry, attempt int64) {
+	ih.metricFallback.Inc(1)
+	l.WithField("attempt", attempt).Info("No answer to a handshake hiding our certificate, falling back to one that does not")
+}
+
+// refuseIX returns true if a noise IX handshake from addr has to be refused because the initiator revealed its
+// certificate
+func (ih *IdentityHiding) refuseIX(addr netip.AddrPort) bool {
+	if ih.getMode() != hideIdentityRequire {
+		return false
+	}
+
+	ih.metricRefused.Inc(1)
+	ih.l.WithField("udpAddr", addr).WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+		Info("Refusing a handshake that does not hide the certificate, handshakes.hide_identity is require")
+	return true
+}
+
+// answered returns the local index and second message of the responder that already answered first, if any
+func (ih *IdentityHiding) answered(first xxFirstMessage, now time.Time) (uint32, []byte, bool) {
+	ih.Lock()
+	defer ih.Unlock()
+
+	r := ih.pending[ih.sent[first]]
+	if r == nil || r.first != first || now.Sub(r.created) > xxPendingTimeout {
+		return 0, nil, false
+	}
+	return r.localIndex, r.msg2, true
+}
+
+// add keeps r until the third message arrives, it returns false if there are too many responders pending already
+func (ih *IdentityHiding) add(r *xxResponder) bool {
+	ih.Lock()
+	defer ih.Unlock()
+
+	ih.expire(r.created)
+	if _, ok := ih.pending[r.localIndex]; ok || len(ih.pending) >= xxPendingMax {
+		ih.metricPendingFull.Inc(1)
+		return false
+	}
+
+	ih.pending[r.localIndex] = r
+	ih.sent[r.first] = r.localIndex
+	return true
+}
+
+// get returns the responder with localIndex, nil if there is none or it expired
+func (ih *IdentityHiding) get(localIndex uint32, now time.Time) *xxResponder {
+	if ih == nil {
+		return nil
+	}
+
+	ih.Lock()
+	defer ih.Unlock()
+
+	r := ih.pending[localIndex]
+	if r == nil || now.Sub(r.created) > xxPendingTimeout {
+		return nil
+	}
+	return r
+}
+
+// forget removes r once its handshake is over
+func (ih *IdentityHiding) forget(r *xxResponder) {
+	ih.Lock()
+	defer ih.Unlock()
+	ih.remove(r)
+}
+
+// expire forgets the responders that waited longer than xxPendingTimeout, ih must be locked
+func (ih *IdentityHiding) expire(now time.Time) {
+	for _, r := range ih.pending {
+		if now.Sub(r.created) > xxPendingTimeout {
+			ih.remove(r)
+			r.span.finish(errHandshakeIncomplete)
+		}
+	}
+}
+
+// remove forgets r, ih must be locked
+func (ih *IdentityHiding) remove(r *xxResponder) {
+	delete(ih.pending, r.localIndex)
+	if ih.sent[r.first] == r.localIndex {
+		delete(ih.sent, r.first)
+	}
+}
@@ -0,0 +1,101 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentityHiding_hide(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	ih, err := NewIdentityHidingFromConfig(l, c)
+	require.NoError(t, err)
+	assert.False(t, ih.hide(1))
+	assert.False(t, ih.refuseIX(netip.AddrPort{}))
+
+	require.NoError(t, c.ReloadConfigString("handshakes: {hide_identity: prefer, hide_identity_fallback: 2}"))
+	assert.True(t, ih.hide(1))
+	assert.True(t, ih.hide(2))
+	assert.False(t, ih.hide(3), "prefer falls back once the attempts are used up")
+	assert.False(t, ih.refuseIX(netip.AddrPort{}))
+
+	require.NoError(t, c.ReloadConfigString("handshakes: {hide_identity: require}"))
+	assert.True(t, ih.hide(100), "require never falls back")
+	assert.True(t, ih.refuseIX(netip.AddrPort{}))
+
+	t.Log("An invalid config keeps the previous mode")
+	require.NoError(t, c.ReloadConfigString("handshakes: {hide_identity: sometimes}"))
+	assert.Equal(t, hideIdentityRequire, ih.getMode())
+
+	require.NoError(t, c.ReloadConfigString("handshakes: {hide_identity: off}"))
+	assert.Equal(t, hideIdentityOff, ih.getMode())
+
+	var nilIH *IdentityHiding
+	assert.False(t, nilIH.hide(1))
+	assert.False(t, nilIH.refuseIX(netip.AddrPort{}))
+	assert.Nil(t, nilIH.get(1, time.Now()))
+
+	for cfg, want := range map[string]string{
+		"handshakes: {hide_identity: sometimes}":                          "unknown handshakes.hide_identity mode `sometimes`. possible modes: [off prefer require]",
+		"handshakes: {hide_identity_fallback: 0}":                         "handshakes.hide_identity_fallback must be at least 1, got 0",
+		"handshakes: {hide_identity: prefer, hide_identity_fallback: -1}": "handshakes.hide_identity_fallback must be at least 1, got -1",
+	} {
+		c := config.NewC(l)
+		require.NoError(t, c.LoadString(cfg))
+		_, err := NewIdentityHidingFromConfig(l, c)
+		assert.EqualError(t, err, want, cfg)
+	}
+}
+
+func TestIdentityHiding_pending(t *testing.T) {
+	l := test.NewLogger()
+	ih, err := NewIdentityHidingFromConfig(l, config.NewC(l))
+	require.NoError(t, err)
+
+	now := time.Now()
+	first := xxFirstMessage{addr: netip.MustParseAddrPort("10.0.0.1:4242"), initiatorIndex: 7}
+	r := &xxResponder{localIndex: 1, initiatorIndex: 7, first: first, msg2: []byte("msg2"), created: now}
+	require.True(t, ih.add(r))
+	assert.Same(t, r, ih.get(1, now))
+	assert.Nil(t, ih.get(2, now))
+
+	t.Log("A retransmitted first message gets the same answer")
+	index, msg2, ok := ih.answered(first, now)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(1), index)
+	assert.Equal(t, []byte("msg2"), msg2)
+
+	other := first
+	other.initiatorIndex = 8
+	_, _, ok = ih.answered(other, now)
+	assert.False(t, ok)
+
+	t.Log("An index is only used once")
+	assert.False(t, ih.add(&xxResponder{localIndex: 1, first: other, created: now}))
+
+	t.Log("A responder waits for the third message until it expires")
+	later := now.Add(xxPendingTimeout + time.Second)
+	assert.Nil(t, ih.get(1, later))
+	_, _, ok = ih.answered(first, later)
+	assert.False(t, ok)
+
+	require.True(t, ih.add(&xxResponder{localIndex: 2, first: other, created: later}))
+	assert.NotContains(t, ih.pending, uint32(1), "adding expires the old responders")
+	assert.NotContains(t, ih.sent, first)
+
+	ih.forget(ih.get(2, later))
+	assert.Empty(t, ih.pending)
+	assert.Empty(t, ih.sent)
+
+	t.Log("The responders are bounded")
+	for i := range xxPendingMax {
+		require.True(t, ih.add(&xxResponder{localIndex: uint32(i + 10), first: xxFirstMessage{initiatorIndex: uint32(i)}, created: later}))
+	}
+	assert.False(t, ih.add(&xxResponder{localIndex: 1, created: later}))
+}
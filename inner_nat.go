@@ -0,0 +1,287 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"golang.org/x/net/ipv4"
+)
+
+// innerNATRule maps an overlay range to an equally sized local range, host bits are preserved
+type innerNATRule struct {
+	overlay netip.Prefix
+	local   netip.Prefix
+}
+
+// InnerNAT performs static 1:1 translation of inner ipv4 addresses. Addresses in an overlay range are rewritten to the
+// matching local range after decrypting and before writing to tun, local addresses are rewritten back to the overlay
+// range after reading from tun and before the firewall and encryption. The firewall and conntrack only ever see
+// overlay addresses, which are the addresses in the certificates of our peers.
+type InnerNAT struct {
+	rules atomic.Pointer[[]innerNATRule]
+	l     *logrus.Logger
+}
+
+func NewInnerNATFromConfig(l *logrus.Logger, c *config.C) (*InnerNAT, error) {
+	n := &InnerNAT{l: l}
+
+	err := n.reload(c, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		err := n.reload(c, false)
+		if err != nil {
+			l.WithError(err).Error("Failed to reload inner_nat, keeping the previous rules")
+		}
+	})
+
+	return n, nil
+}
+
+func (n *InnerNAT) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("inner_nat") {
+		return nil
+	}
+
+	rules, err := parseInnerNATRules(c.Get("inner_nat"))
+	if err != nil {
+		return err
+	}
+
+	n.rules.Store(&rules)
+	if !initial || len(rules) > 0 {
+		n.l.WithField("rules", len(rules)).Info("Inner NAT rules loaded")
+	}
+	return nil
+}
+
+func parseInnerNATRules(raw interface{}) ([]innerNATRule, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	rs, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("inner_nat should be an array of rules")
+	}
+
+	var rules []innerNATRule
+	for i, r := range rs {
+		m, ok := r.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("inner_nat rule #%v; should be a map with overlay and local", i)
+		}
+
+		var rule innerNATRule
+		var err error
+		rule.overlay, err = netip.ParsePrefix(fmt.Sprintf("%v", m["overlay"]))
+		if err != nil {
+			return nil, fmt.Errorf("inner_nat rule #%v; overlay did not parse; %s", i, err)
+		}
+
+		rule.local, err = netip.ParsePrefix(fmt.Sprintf("%v", m["local"]))
+		if err != nil {
+			return nil, fmt.Errorf("inner_nat rule #%v; local did not parse; %s", i, err)
+		}
+
+		if !rule.overlay.Addr().Is4() || !rule.local.Addr().Is4() {
+			return nil, fmt.Errorf("inner_nat rule #%v; only ipv4 ranges are supported", i)
+		}
+
+		if rule.overlay.Bits() != rule.local.Bits() {
+			return nil, fmt.Errorf("inner_nat rule #%v; overlay and local must be the same size", i)
+		}
+
+		rule.overlay = rule.overlay.Masked()
+		rule.local = rule.local.Masked()
+		for j, other := range rules {
+			if rule.overlay.Overlaps(other.overlay) || rule.local.Overlaps(other.local) {
+				return nil, fmt.Errorf("inner_nat rule #%v; overlaps with rule #%v", i, j)
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Inbound translates overlay addresses in a decrypted packet to local addresses
+func (n *InnerNAT) Inbound(p []byte) {
+	n.translate(p, true)
+}
+
+// Outbound translates local addresses in a packet read from tun to overlay addresses
+func (n *InnerNAT) Outbound(p []byte) {
+	n.translate(p, false)
+}
+
+func (n *InnerNAT) translate(p []byte, inbound bool) {
+	if n == nil {
+		return
+	}
+
+	rules := n.rules.Load()
+	if rules == nil || len(*rules) == 0 {
+		return
+	}
+
+	translateIPv4(p, func(addr [4]byte) ([4]byte, bool) {
+		a := netip.AddrFrom4(addr)
+		for _, r := range *rules {
+			from, to := r.local, r.overlay
+			if inbound {
+				from, to = r.overlay, r.local
+			}
+
+			if from.Contains(a) {
+				return mapIPv4(addr, to), true
+			}
+		}
+		return addr, false
+	})
+}
+
+// mapIPv4 moves addr into prefix, keeping the host bits
+func mapIPv4(addr [4]byte, prefix netip.Prefix) [4]byte {
+	mask := ^uint32(0) << (32 - prefix.Bits())
+	base := prefix.Addr().As4()
+	v := binary.BigEndian.Uint32(base[:])&mask | binary.BigEndian.Uint32(addr[:])&^mask
+
+	var out [4]byte
+	binary.BigEndian.PutUint32(out[:], v)
+	return out
+}
+
+// translateIPv4 rewrites the source and destination of an ipv4 packet with fn, keeping the ip, tcp, and udp checksums
+// valid. ICMP errors also have the quoted packet rewritten so the sender can match it to a socket.
+func translateIPv4(p []byte, fn func([4]byte) ([4]byte, bool)) {
+	if len(p) < ipv4.HeaderLen || p[0]>>4 != 4 {
+		return
+	}
+
+	ihl := int(p[0]&0x0f) << 2
+	if ihl < ipv4.HeaderLen || len(p) < ihl {
+		return
+	}
+
+	// The transport checksum is only present in the first fragment
+	var l4sum []byte
+	proto := p[9]
+	firstFragment := binary.BigEndian.Uint16(p[6:8])&0x1fff == 0
+	if firstFragment {
+		switch proto {
+		case firewall.ProtoTCP:
+			if len(p) >= ihl+18 {
+				l4sum = p[ihl+16 : ihl+18]
+			}
+		case firewall.ProtoUDP:
+			// A udp checksum of 0 means no checksum was computed
+			if len(p) >= ihl+8 && binary.BigEndian.Uint16(p[ihl+6:ihl+8]) != 0 {
+				l4sum = p[ihl+6 : ihl+8]
+			}
+		}
+	}
+
+	changed := rewriteIPv4Addr(p, 12, l4sum, fn)
+	changed = rewriteIPv4Addr(p, 16, l4sum, fn) || changed
+
+	if proto == firewall.ProtoICMP && firstFragment && translateICMPError(p[ihl:], fn) {
+		changed = true
+	}
+
+	if changed && proto == firewall.ProtoUDP && l4sum != nil && binary.BigEndian.Uint16(l4sum) == 0 {
+		binary.BigEndian.PutUint16(l4sum, 0xffff)
+	}
+}
+
+// rewriteIPv4Addr rewrites the address at offset in the ip header p, incrementally updating the header checksum and
+// the transport checksum if one is provided, see RFC 1624
+func rewriteIPv4Addr(p []byte, offset int, l4sum []byte, fn func([4]byte) ([4]byte, bool)) bool {
+	old := [4]byte(p[offset : offset+4])
+	updated, ok := fn(old)
+	if !ok || updated == old {
+		return false
+	}
+
+	copy(p[offset:offset+4], updated[:])
+	checksumReplace4(p[10:12], old, updated)
+	if l4sum != nil {
+		checksumReplace4(l4sum, old, updated)
+	}
+	return true
+}
+
+// translateICMPError rewrites the packet quoted by an ICMP error and recomputes the ICMP checksum
+func translateICMPError(icmp []byte, fn func([4]byte) ([4]byte, bool)) bool {
+	if len(icmp) < 8+ipv4.HeaderLen {
+		return false
+	}
+
+	switch icmp[0] {
+	case 3, 4, 5, 11, 12:
+		// destination unreachable, source quench, redirect, time exceeded, parameter problem
+	default:
+		return false
+	}
+
+	quoted := icmp[8:]
+	if quoted[0]>>4 != 4 {
+		return false
+	}
+
+	ihl := int(quoted[0]&0x0f) << 2
+	if ihl < ipv4.HeaderLen || len(quoted) < ihl {
+		return false
+	}
+
+	// Only the first 8 bytes of the quoted transport header are guaranteed, which has the udp checksum but not tcp
+	var l4sum []byte
+	if quoted[9] == firewall.ProtoUDP && len(quoted) >= ihl+8 && binary.BigEndian.Uint16(quoted[ihl+6:ihl+8]) != 0 {
+		l4sum = quoted[ihl+6 : ihl+8]
+	}
+
+	changed := rewriteIPv4Addr(quoted, 12, l4sum, fn)
+	changed = rewriteIPv4Addr(quoted, 16, l4sum, fn) || changed
+	if !changed {
+		return false
+	}
+
+	binary.BigEndian.PutUint16(icmp[2:4], 0)
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp))
+	return true
+}
+
+// checksumReplace4 incrementally updates the ones complement checksum in sum for a 4 byte field changing from old to
+// updated
+func checksumReplace4(sum []byte, old, updated [4]byte) {
+	s := uint32(^binary.BigEndian.Uint16(sum))
+	s += uint32(^binary.BigEndian.Uint16(old[0:2])) + uint32(^binary.BigEndian.Uint16(old[2:4]))
+	s += uint32(binary.BigEndian.Uint16(updated[0:2])) + uint32(binary.BigEndian.Uint16(updated[2:4]))
+	for s > 0xffff {
+		s = (s & 0xffff) + (s >> 16)
+	}
+	binary.BigEndian.PutUint16(sum, ^uint16(s))
+}
+
+// checksum computes the internet checksum of b
+func checksum(b []byte) uint16 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s > 0xffff {
+		s = (s & 0xffff) + (s >> 16)
+	}
+	return ^uint16(s)
+}
@@ -0,0 +1,223 @@
+package nebula
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestInnerNAT(t *testing.T) *InnerNAT {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["inner_nat"] = []interface{}{
+		map[interface{}]interface{}{"overlay": "192.168.100.0/24", "local": "10.201.0.0/24"},
+	}
+
+	n, err := NewInnerNATFromConfig(l, c)
+	require.NoError(t, err)
+	return n
+}
+
+// buildIPv4 serializes an ipv4 packet with all checksums computed by gopacket
+func buildIPv4(t *testing.T, src, dst string, proto layers.IPProtocol, l4 ...gopacket.SerializableLayer) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Id:       1234,
+		Protocol: proto,
+		SrcIP:    net.ParseIP(src).To4(),
+		DstIP:    net.ParseIP(dst).To4(),
+	}
+
+	for _, layer := range l4 {
+		switch v := layer.(type) {
+		case *layers.TCP:
+			require.NoError(t, v.SetNetworkLayerForChecksum(ip))
+		case *layers.UDP:
+			require.NoError(t, v.SetNetworkLayerForChecksum(ip))
+		}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, append([]gopacket.SerializableLayer{ip}, l4...)...))
+	return buf.Bytes()
+}
+
+func TestInnerNAT_reload(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	n, err := NewInnerNATFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Empty(t, *n.rules.Load())
+
+	c.Settings["inner_nat"] = []interface{}{
+		map[interface{}]interface{}{"overlay": "192.168.100.0/24", "local": "10.201.0.0/16"},
+	}
+	_, err = NewInnerNATFromConfig(l, c)
+	assert.EqualError(t, err, "inner_nat rule #0; overlay and local must be the same size")
+
+	c.Settings["inner_nat"] = []interface{}{
+		map[interface{}]interface{}{"overlay": "fd00::/64", "local": "fd01::/64"},
+	}
+	_, err = NewInnerNATFromConfig(l, c)
+	assert.EqualError(t, err, "inner_nat rule #0; only ipv4 ranges are supported")
+
+	c.Settings["inner_nat"] = []interface{}{
+		map[interface{}]interface{}{"overlay": "192.168.100.0/24", "local": "10.201.0.0/24"},
+		map[interface{}]interface{}{"overlay": "192.168.100.128/25", "local": "10.202.0.0/25"},
+	}
+	_, err = NewInnerNATFromConfig(l, c)
+	assert.EqualError(t, err, "inner_nat rule #1; overlaps with rule #0")
+
+	c.Settings["inner_nat"] = []interface{}{
+		map[interface{}]interface{}{"overlay": "192.168.100.0/24", "local": "10.201.0.0/24"},
+	}
+	require.NoError(t, n.reload(c, true))
+	assert.Len(t, *n.rules.Load(), 1)
+
+	// A bad reload keeps the previous rules
+	c.Settings["inner_nat"] = "nope"
+	assert.EqualError(t, n.reload(c, true), "inner_nat should be an array of rules")
+	assert.Len(t, *n.rules.Load(), 1)
+}
+
+func TestInnerNAT_tcp(t *testing.T) {
+	n := newTestInnerNAT(t)
+
+	tcp := func() *layers.TCP {
+		return &layers.TCP{SrcPort: 40000, DstPort: 443, Seq: 99, SYN: true, Window: 1024}
+	}
+	payload := gopacket.Payload("hello")
+
+	// Outbound, our local source becomes the overlay source
+	p := buildIPv4(t, "10.201.0.1", "192.168.100.5", layers.IPProtocolTCP, tcp(), payload)
+	n.Outbound(p)
+	assert.Equal(t, buildIPv4(t, "192.168.100.1", "192.168.100.5", layers.IPProtocolTCP, tcp(), payload), p)
+
+	// Inbound, both overlay addresses are translated
+	p = buildIPv4(t, "192.168.100.5", "192.168.100.1", layers.IPProtocolTCP, tcp(), payload)
+	n.Inbound(p)
+	assert.Equal(t, buildIPv4(t, "10.201.0.5", "10.201.0.1", layers.IPProtocolTCP, tcp(), payload), p)
+
+	// Addresses outside of the rules are left alone
+	p = buildIPv4(t, "192.168.200.5", "172.16.0.1", layers.IPProtocolTCP, tcp(), payload)
+	expected := append([]byte(nil), p...)
+	n.Inbound(p)
+	assert.Equal(t, expected, p)
+}
+
+// capturingTun records the last packet written to it
+type capturingTun struct {
+	test.NoopTun
+	written []byte
+}
+
+func (t *capturingTun) Write(b []byte) (int, error) {
+	t.written = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestInterface_forwardToSelf(t *testing.T) {
+	tun := &capturingTun{}
+	f := &Interface{l: test.NewLogger(), innerNAT: newTestInnerNAT(t), readers: []io.ReadWriteCloser{tun}}
+
+	udp := func() *layers.UDP {
+		return &layers.UDP{SrcPort: 40000, DstPort: 53}
+	}
+	payload := gopacket.Payload("hello")
+
+	// A packet from our local address to itself is translated on the way in and must be translated back on the way out
+	p := buildIPv4(t, "10.201.0.1", "10.201.0.1", layers.IPProtocolUDP, udp(), payload)
+	f.innerNAT.Outbound(p)
+	assert.Equal(t, buildIPv4(t, "192.168.100.1", "192.168.100.1", layers.IPProtocolUDP, udp(), payload), p)
+
+	f.forwardToSelf(p, 0)
+	assert.Equal(t, buildIPv4(t, "10.201.0.1", "10.201.0.1", layers.IPProtocolUDP, udp(), payload), tun.written)
+}
+
+func TestInnerNAT_udp(t *testing.T) {
+	n := newTestInnerNAT(t)
+
+	udp := func() *layers.UDP {
+		return &layers.UDP{SrcPort: 5353, DstPort: 53}
+	}
+	payload := gopacket.Payload("odd length")
+
+	p := buildIPv4(t, "192.168.100.5", "192.168.100.1", layers.IPProtocolUDP, udp(), payload)
+	n.Inbound(p)
+	assert.Equal(t, buildIPv4(t, "10.201.0.5", "10.201.0.1", layers.IPProtocolUDP, udp(), payload), p)
+
+	p = buildIPv4(t, "10.201.0.1", "192.168.100.5", layers.IPProtocolUDP, udp(), payload)
+	n.Outbound(p)
+	assert.Equal(t, buildIPv4(t, "192.168.100.1", "192.168.100.5", layers.IPProtocolUDP, udp(), payload), p)
+
+	// A zero udp checksum means none was computed and must stay zero
+	p = buildIPv4(t, "192.168.100.5", "192.168.100.1", layers.IPProtocolUDP, udp(), payload)
+	p[26], p[27] = 0, 0
+	n.Inbound(p)
+	assert.Equal(t, []byte{0, 0}, p[26:28])
+	assert.Equal(t, uint16(0), checksum(p[:20]))
+}
+
+func TestInnerNAT_icmp(t *testing.T) {
+	n := newTestInnerNAT(t)
+
+	echo := func() *layers.ICMPv4 {
+		return &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 7, Seq: 1}
+	}
+	payload := gopacket.Payload("ping")
+
+	p := buildIPv4(t, "192.168.100.5", "192.168.100.1", layers.IPProtocolICMPv4, echo(), payload)
+	n.Inbound(p)
+	assert.Equal(t, buildIPv4(t, "10.201.0.5", "10.201.0.1", layers.IPProtocolICMPv4, echo(), payload), p)
+
+	// An unreachable from a peer quotes the packet we sent with overlay addresses, the quoted packet must be translated
+	// so the local stack can match it
+	unreachable := func() *layers.ICMPv4 {
+		return &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort)}
+	}
+	udp := func() *layers.UDP {
+		return &layers.UDP{SrcPort: 5353, DstPort: 53}
+	}
+	quoted := buildIPv4(t, "192.168.100.1", "192.168.100.5", layers.IPProtocolUDP, udp(), gopacket.Payload("query"))
+	p = buildIPv4(t, "192.168.100.5", "192.168.100.1", layers.IPProtocolICMPv4, unreachable(), gopacket.Payload(quoted[:28]))
+	n.Inbound(p)
+
+	expectedQuoted := buildIPv4(t, "10.201.0.1", "10.201.0.5", layers.IPProtocolUDP, udp(), gopacket.Payload("query"))
+	assert.Equal(t, buildIPv4(t, "10.201.0.5", "10.201.0.1", layers.IPProtocolICMPv4, unreachable(), gopacket.Payload(expectedQuoted[:28])), p)
+}
+
+func TestInnerNAT_fragment(t *testing.T) {
+	n := newTestInnerNAT(t)
+
+	// A non first fragment has no transport header, only the ip header should change
+	p := buildIPv4(t, "192.168.100.5", "192.168.100.1", layers.IPProtocolUDP, gopacket.Payload("0123456789abcdef"))
+	p[6], p[7] = 0, 2
+	p[10], p[11] = 0, 0
+	sum := checksum(p[:20])
+	p[10], p[11] = byte(sum>>8), byte(sum)
+	body := append([]byte(nil), p[20:]...)
+
+	n.Inbound(p)
+	assert.Equal(t, []byte{10, 201, 0, 5, 10, 201, 0, 1}, p[12:20])
+	assert.Equal(t, uint16(0), checksum(p[:20]))
+	assert.Equal(t, body, p[20:])
+}
+
+func TestInnerNAT_nil(t *testing.T) {
+	var n *InnerNAT
+	p := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 17, 0, 0, 192, 168, 100, 5, 192, 168, 100, 1}
+	expected := append([]byte(nil), p...)
+	n.Inbound(p)
+	n.Outbound(p)
+	assert.Equal(t, expected, p)
+}
@@ -11,14 +11,25 @@ import (
 )
 
 func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache) {
+	// Translate local addresses to overlay addresses before anything looks at the packet
+	f.innerNAT.Outbound(packet)
+
 	err := newPacket(packet, false, fwPacket)
 	if err != nil {
 		if f.l.Level >= logrus.DebugLevel {
-			f.l.WithField("packet", packet).Debugf("Error while validating outbound packet: %s", err)
+			f.l.WithField("packet", innerPacket(packet)).Debugf("Error while validating outbound packet: %s", err)
 		}
 		return
 	}
 
+	if f.deniedIPOptions(packet, fwPacket) {
+		return
+	}
+
+	if f.observer.drop(f.l, fwPacket, false) {
+		return
+	}
+
 	// Ignore local broadcast packets
 	if f.dropLocalBroadcast && fwPacket.RemoteIP == f.myBroadcastAddr {
 		return
@@ -30,10 +41,7 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 		// routes packets from the Nebula IP to the Nebula IP through the Nebula
 		// TUN device.
 		if immediatelyForwardToSelf {
-			_, err := f.readers[q].Write(packet)
-			if err != nil {
-				f.l.WithError(err).Error("Failed to forward to tun")
-			}
+			f.forwardToSelf(packet, q)
 		}
 		// Otherwise, drop. On linux, we should never see these packets - Linux
 		// routes packets from the nebula IP to the nebula IP through the loopback device.
@@ -45,14 +53,26 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 		return
 	}
 
+	// Replicate packets to overlay multicast destinations to each member of the peer group
+	if mc := f.multicast.isDestination(fwPacket.RemoteIP, f.myBroadcastAddr); mc != nil {
+		f.sendMulticast(mc, packet, fwPacket, nb, out, q, localCache)
+		return
+	}
+
 	hostinfo, ready := f.getOrHandshake(fwPacket.RemoteIP, func(hh *HandshakeHostInfo) {
-		hh.cachePacket(f.l, header.Message, 0, packet, f.sendMessageNow, f.cachedPacketMetrics)
+		hh.cachePacket(f.l, header.Message, 0, packet, f.sendMessageNow, f.cachedPacketMetrics, f.handshakeManager.config.packetBuffer)
 	})
 
 	if hostinfo == nil {
-		f.rejectInside(packet, out, q)
+		// A destination in our network or an unsafe route may still be refused a handshake, by tunnels.max for example,
+		// only a destination with no route at all is unknown
+		if f.unknownDestReject.Load() && !f.myVpnNet.Contains(fwPacket.RemoteIP) && !f.inside.RouteFor(fwPacket.RemoteIP).IsValid() {
+			f.rejectUnknownDestination(packet, out, q)
+		} else {
+			f.rejectInside(packet, out, q)
+		}
 		if f.l.Level >= logrus.DebugLevel {
-			f.l.WithField("vpnIp", fwPacket.RemoteIP).
+			f.l.WithField("vpnIp", innerAddr(fwPacket.RemoteIP)).
 				WithField("fwPacket", fwPacket).
 				Debugln("dropping outbound packet, vpnIp not in our CIDR or in unsafe routes")
 		}
@@ -63,16 +83,31 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 		return
 	}
 
-	dropReason := f.firewall.Drop(*fwPacket, false, hostinfo, f.pki.GetCAPool(), localCache)
+	if f.tunnelPause.dropOutgoing(hostinfo) {
+		return
+	}
+
+	dropRule, dropReason := f.firewall.DropRule(*fwPacket, false, false, hostinfo, f.pki.GetCAPool(), localCache)
 	if dropReason == nil {
-		f.sendNoMetrics(header.Message, 0, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, packet, nb, out, q)
+		if f.tooBig(hostinfo, packet, out, q) {
+			return
+		}
+
+		f.rekey.observe(hostinfo, packet)
+		hostinfo.markData()
+		f.sampler.Load().sample(packet, hostinfo, false, !hostinfo.remote.IsValid())
+		f.sendNoMetricsFlow(header.Message, 0, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, fwPacket, packet, nb, out, q)
 
 	} else {
 		f.rejectInside(packet, out, q)
+		hostinfo.errCounters.firewallDrops.Add(1)
+		f.dropWatch.notify(*fwPacket, false, hostinfo, dropRule, dropReason)
+		f.securityEvents.Load().firewallDrop(*fwPacket, false, hostinfo, dropRule, dropReason)
 		if f.l.Level >= logrus.DebugLevel {
 			hostinfo.logger(f.l).
 				WithField("fwPacket", fwPacket).
 				WithField("reason", dropReason).
+				WithField("rule", dropRule).
 				Debugln("dropping outbound packet")
 		}
 	}
@@ -83,18 +118,33 @@ func (f *Interface) rejectInside(packet []byte, out []byte, q int) {
 		return
 	}
 
-	out = iputil.CreateRejectPacket(packet, out)
+	f.writeInsideReject(iputil.CreateRejectPacket(packet, out), q)
+}
+
+// rejectUnknownDestination tells the local sender the destination is unreachable, see tun.unknown_destination_action
+func (f *Interface) rejectUnknownDestination(packet []byte, out []byte, q int) {
+	f.writeInsideReject(iputil.CreateHostUnreachablePacket(packet, out), q)
+}
+
+// forwardToSelf writes a packet from self to self straight back to tun. It was translated to overlay addresses when it
+// was read, translate it back like any other packet written to tun.
+func (f *Interface) forwardToSelf(packet []byte, q int) {
+	f.innerNAT.Inbound(packet)
+	_ = f.writeTun(q, packet)
+}
+
+func (f *Interface) writeInsideReject(out []byte, q int) {
 	if len(out) == 0 {
 		return
 	}
 
-	_, err := f.readers[q].Write(out)
-	if err != nil {
-		f.l.WithError(err).Error("Failed to write to tun")
-	}
+	// The reject was built from the translated packet, translate it back before it goes to tun
+	f.innerNAT.Inbound(out)
+	_ = f.writeTun(q, out)
 }
 
-func (f *Interface) rejectOutside(packet []byte, ci *ConnectionState, hostinfo *HostInfo, nb, out []byte, q int) {
+// rejectOutside answers the peer that sent packet with a reject, rule is the firewall rule that dropped it
+func (f *Interface) rejectOutside(packet []byte, ci *ConnectionState, hostinfo *HostInfo, rule string, nb, out []byte, q int) {
 	if !f.firewall.OutSendReject {
 		return
 	}
@@ -107,8 +157,9 @@ func (f *Interface) rejectOutside(packet []byte, ci *ConnectionState, hostinfo *
 	if len(out) > iputil.MaxRejectPacketSize {
 		if f.l.GetLevel() >= logrus.InfoLevel {
 			f.l.
-				WithField("packet", packet).
-				WithField("outPacket", out).
+				WithField("packet", innerPacket(packet)).
+				WithField("outPacket", innerPacket(out)).
+				WithField("rule", rule).
 				Info("rejectOutside: packet too big, not sending")
 		}
 		return
@@ -143,23 +194,32 @@ func (f *Interface) sendMessageNow(t header.MessageType, st header.MessageSubTyp
 	}
 
 	// check if packet is in outbound fw rules
-	dropReason := f.firewall.Drop(*fp, false, hostinfo, f.pki.GetCAPool(), nil)
+	dropRule, dropReason := f.firewall.DropRule(*fp, false, false, hostinfo, f.pki.GetCAPool(), nil)
 	if dropReason != nil {
+		hostinfo.errCounters.firewallDrops.Add(1)
+		f.dropWatch.notify(*fp, false, hostinfo, dropRule, dropReason)
+		f.securityEvents.Load().firewallDrop(*fp, false, hostinfo, dropRule, dropReason)
 		if f.l.Level >= logrus.DebugLevel {
 			f.l.WithField("fwPacket", fp).
 				WithField("reason", dropReason).
+				WithField("rule", dropRule).
 				Debugln("dropping cached packet")
 		}
 		return
 	}
 
-	f.sendNoMetrics(header.Message, st, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, p, nb, out, 0)
+	if f.tunnelPause.dropOutgoing(hostinfo) {
+		return
+	}
+
+	hostinfo.markData()
+	f.sendNoMetricsFlow(header.Message, st, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, fp, p, nb, out, 0)
 }
 
 // SendMessageToVpnIp handles real ip:port lookup and sends to the current best known address for vpnIp
 func (f *Interface) SendMessageToVpnIp(t header.MessageType, st header.MessageSubType, vpnIp netip.Addr, p, nb, out []byte) {
 	hostInfo, ready := f.getOrHandshake(vpnIp, func(hh *HandshakeHostInfo) {
-		hh.cachePacket(f.l, t, st, p, f.SendMessageToHostInfo, f.cachedPacketMetrics)
+		hh.cachePacket(f.l, t, st, p, f.SendMessageToHostInfo, f.cachedPacketMetrics, f.handshakeManager.config.packetBuffer)
 	})
 
 	if hostInfo == nil {
@@ -206,6 +266,10 @@ func (f *Interface) SendVia(via *HostInfo,
 	out []byte,
 	nocopy bool,
 ) {
+	if f.sendBackoff.paused(via) {
+		return
+	}
+
 	if noiseutil.EncryptLockNeeded {
 		// NOTE: for goboring AESGCMTLS we need to lock because of the nonce check
 		via.ConnectionState.writeLock.Lock()
@@ -249,20 +313,75 @@ func (f *Interface) SendVia(via *HostInfo,
 		via.logger(f.l).WithError(err).Info("Failed to EncryptDanger in sendVia")
 		return
 	}
-	err = f.writers[0].WriteTo(out, via.remote)
-	if err != nil {
-		via.logger(f.l).WithError(err).Info("Failed to WriteTo in sendVia")
-	}
+	err = f.writeTo(0, via, out, via.remote, ecnNotECT)
+	f.sendBackoff.result(via, via.remote, err)
 	f.connectionManager.RelayUsed(relay.LocalIndex)
 }
 
 func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote netip.AddrPort, p, nb, out []byte, q int) {
+	f.sendNoMetricsFlow(t, st, ci, hostinfo, remote, nil, p, nb, out, q)
+}
+
+// sendNoMetricsFlow is sendNoMetrics for a packet of the inner flow fp, which keeps the flow on one relay when traffic
+// to hostinfo is load shared across relays. fp may be nil.
+func (f *Interface) sendNoMetricsFlow(t header.MessageType, st header.MessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote netip.AddrPort, fp *firewall.Packet, p, nb, out []byte, q int) {
 	if ci.eKey == nil {
 		//TODO: log warning
 		return
 	}
 	useRelay := !remote.IsValid() && !hostinfo.remote.IsValid()
+
+	// Data may be steered onto a relay by its DSCP value, see PathSelection
+	var steeredHostInfo *HostInfo
+	var steeredRelay *Relay
+	if t == header.Message && st == header.MessageNone && !remote.IsValid() {
+		steeredHostInfo, steeredRelay = f.pathSelection.relayFor(f, hostinfo, fp, p, header.Len+len(p)+ci.eKey.Overhead())
+		if steeredHostInfo != nil {
+			useRelay = true
+		}
+	}
+
+	// The underlay refused our last packets to this host, give it a moment instead of spinning on the socket. Close
+	// is always attempted since it is the last packet we will send. Sends to other candidate remotes are not held back.
+	toCurrent := !remote.IsValid() || remote == hostinfo.remote
+	if !useRelay && toCurrent && t != header.CloseTunnel && f.sendBackoff.paused(hostinfo) {
+		return
+	}
 	fullOut := out
+	inner := p
+
+	// A packet authorization token rides in front of the inner packet, see PacketAuth
+	if t == header.Message && st == header.MessageNone {
+		if token := f.packetAuth.tokenFor(p); token != nil {
+			buf := payloadBufs.Get().(*[]byte)
+			defer payloadBufs.Put(buf)
+			p = append(append((*buf)[:0], token...), p...)
+			st = header.MessageAuthorized
+		}
+	}
+
+	// Data on an auth only tunnel is sent in the clear, but only directly to a remote we trust
+	authOnly := false
+	if ci.authOnly && t == header.Message && st == header.MessageNone && !useRelay {
+		to := remote
+		if !to.IsValid() {
+			to = hostinfo.remote
+		}
+		if f.authOnly.Trusted(to) {
+			authOnly = true
+			st = header.MessageAuthOnly
+		}
+	}
+
+	// Data is padded inside the encryption to hide its length, see Padding
+	if t == header.Message && (st == header.MessageNone || st == header.MessageAuthorized) && f.padding.enabled() {
+		buf := payloadBufs.Get().(*[]byte)
+		defer payloadBufs.Put(buf)
+		if padded, ok := f.padding.pad((*buf)[:0], st, p); ok {
+			*buf = padded
+			p, st = padded, header.MessagePadded
+		}
+	}
 
 	if useRelay {
 		if len(out) < header.Len {
@@ -282,7 +401,10 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 
 	//l.WithField("trace", string(debug.Stack())).Error("out Header ", &Header{Version, t, st, 0, hostinfo.remoteIndexId, c}, p)
 	out = header.Encode(out, header.Version, t, st, hostinfo.remoteIndexId, c)
-	f.connectionManager.Out(hostinfo.localIndexId)
+	if st != header.MessageKeepalive || t != header.Message {
+		// A keepalive is not traffic, the connection manager would otherwise test a tunnel that is only kept alive
+		f.connectionManager.Out(hostinfo.localIndexId)
+	}
 
 	// Query our LH if we haven't since the last time we've been rebound, this will cause the remote to punch against
 	// all our IPs and enable a faster roaming.
@@ -296,8 +418,16 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 		}
 	}
 
+	ecn := f.outerECN(t, inner)
+
 	var err error
-	out, err = ci.eKey.EncryptDanger(out, out, p, c, nb)
+	if authOnly {
+		// Authenticate the header and payload, but do not encrypt, the same as SendVia
+		out = append(out, p...)
+		out, err = ci.eKey.EncryptDanger(out, out, nil, c, nb)
+	} else {
+		out, err = ci.eKey.EncryptDanger(out, out, p, c, nb)
+	}
 	if noiseutil.EncryptLockNeeded {
 		ci.writeLock.Unlock()
 	}
@@ -309,20 +439,35 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 		return
 	}
 
+	if t == header.Message && st != header.MessageKeepalive {
+		f.tunnelMetrics.tx(hostinfo, len(inner))
+	}
+
 	if remote.IsValid() {
-		err = f.writers[q].WriteTo(out, remote)
-		if err != nil {
+		err = f.sendPriority.writeTo(f, hostinfo, q, out, remote, ecn)
+		if toCurrent {
+			f.sendBackoff.result(hostinfo, remote, err)
+		} else if err != nil {
 			hostinfo.logger(f.l).WithError(err).
 				WithField("udpAddr", remote).Error("Failed to write outgoing packet")
 		}
+	} else if steeredHostInfo != nil {
+		f.SendVia(steeredHostInfo, steeredRelay, out, nb, fullOut[:header.Len+len(out)], true)
 	} else if hostinfo.remote.IsValid() {
-		err = f.writers[q].WriteTo(out, hostinfo.remote)
-		if err != nil {
-			hostinfo.logger(f.l).WithError(err).
-				WithField("udpAddr", remote).Error("Failed to write outgoing packet")
-		}
+		err = f.sendPriority.writeTo(f, hostinfo, q, out, hostinfo.remote, ecn)
+		f.sendBackoff.result(hostinfo, hostinfo.remote, err)
 	} else {
-		// Try to send via a relay
+		if fp != nil {
+			relayHostInfo, relay, ok := f.relayLoadShare.pick(f.hostMap, hostinfo, fp, len(out))
+			if ok {
+				f.SendVia(relayHostInfo, relay, out, nb, fullOut[:header.Len+len(out)], true)
+				return
+			}
+		}
+
+		// Try to send via a relay, a draining relay is only used if there is nothing else
+		var drainingHostInfo *HostInfo
+		var drainingRelay *Relay
 		for _, relayIP := range hostinfo.relayState.CopyRelayIps() {
 			relayHostInfo, relay, err := f.hostMap.QueryVpnIpRelayFor(hostinfo.vpnIp, relayIP)
 			if err != nil {
@@ -330,8 +475,18 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 				hostinfo.logger(f.l).WithField("relay", relayIP).WithError(err).Info("sendNoMetrics failed to find HostInfo")
 				continue
 			}
+			if relayHostInfo.relayDraining.Load() {
+				if drainingHostInfo == nil {
+					drainingHostInfo, drainingRelay = relayHostInfo, relay
+				}
+				continue
+			}
 			f.SendVia(relayHostInfo, relay, out, nb, fullOut[:header.Len+len(out)], true)
-			break
+			return
+		}
+
+		if drainingHostInfo != nil {
+			f.SendVia(drainingHostInfo, drainingRelay, out, nb, fullOut[:header.Len+len(out)], true)
 		}
 	}
 }
@@ -37,11 +37,54 @@ type InterfaceConfig struct {
 	pendingDeletionInterval time.Duration
 	DropLocalBroadcast      bool
 	DropMulticast           bool
+	UnknownDestReject       bool
+	ECN                     bool
+	VerifyChecksums         bool
+	ICMPEchoReply           bool
+	DropIPOptions           bool
+	RoutingLoopDrop         bool
+	MaxPacketAge            time.Duration
+	ControlPriority         bool
+	MaxDecryptConcurrency   int
 	routines                int
+	readerAffinity          []int
 	MessageMetrics          *MessageMetrics
 	version                 string
 	relayManager            *relayManager
+	relayLoadShare          *RelayLoadShare
+	relayForwardScope       *RelayForwardScope
 	punchy                  *Punchy
+	tunnelIdle              *TunnelIdleTimeout
+	multicast               *OverlayMulticast
+	innerNAT                *InnerNAT
+	authOnly                *AuthOnly
+	latencyProbe            *LatencyProbe
+	hostmapSnapshot         *HostmapSnapshot
+	health                  *HealthCheck
+	roamPin                 *RoamPin
+	tunnelPause             *TunnelPause
+	sourcePin               *SourcePin
+	underlayDeny            *UnderlayDenyList
+	sendBackoff             *SendBackoff
+	sendPriority            *SendPriority
+	duplicateVpnIp          *DuplicateVpnIp
+	tunnelQuality           *TunnelQuality
+	underlayWatch           *UnderlayWatch
+	observer                *Observer
+	tunnelMetrics           *TunnelMetrics
+	rates                   *Rates
+	tunRecovery             *TunRecovery
+	memoryBudget            *MemoryBudget
+	identityHiding          *IdentityHiding
+	packetAuth              *PacketAuth
+	padding                 *Padding
+	tcpTransport            *TCPTransport
+	mtuProbe                *MTUProbe
+	rekey                   *Rekey
+	pathSelection           *PathSelection
+	tracer                  *Tracer
+	conntrackSync           *ConntrackSync
+	doubleEncrypted         *DoubleEncrypted
 
 	tryPromoteEvery uint32
 	reQueryEvery    uint32
@@ -68,15 +111,72 @@ type Interface struct {
 	dropLocalBroadcast bool
 	dropMulticast      bool
 	routines           int
+	readerAffinity     []int
 	disconnectInvalid  atomic.Bool
 	closed             atomic.Bool
+	ecn                atomic.Bool
+	verifyChecksums    atomic.Bool
+	icmpEchoReply      atomic.Bool
+	dropIPOptions      atomic.Bool
+	maxPacketAge       atomic.Int64
+	unknownDestReject  atomic.Bool
+	routingLoopDrop    atomic.Bool
+	routingLoopLogged  atomic.Int64
 	relayManager       *relayManager
+	relayLoadShare     *RelayLoadShare
+	relayForwardScope  *RelayForwardScope
+	multicast          *OverlayMulticast
+	innerNAT           *InnerNAT
+	authOnly           *AuthOnly
+	latencyProbe       *LatencyProbe
+	hostmapSnapshot    *HostmapSnapshot
+	health             *HealthCheck
+	roamPin            *RoamPin
+	tunnelPause        *TunnelPause
+	sourcePin          *SourcePin
+	underlayDeny       *UnderlayDenyList
+	sendBackoff        *SendBackoff
+	sendPriority       *SendPriority
+	duplicateVpnIp     *DuplicateVpnIp
+	tunnelQuality      *TunnelQuality
+	underlayWatch      *UnderlayWatch
+	observer           *Observer
+	tunnelMetrics      *TunnelMetrics
+	rates              *Rates
+	tunRecovery        *TunRecovery
+	memoryBudget       *MemoryBudget
+	identityHiding     *IdentityHiding
+	packetAuth         *PacketAuth
+	padding            *Padding
+	tcpTransport       *TCPTransport
+	mtuProbe           *MTUProbe
+	rekey              *Rekey
+	pathSelection      *PathSelection
+	tracer             *Tracer
+	conntrackSync      *ConntrackSync
+	doubleEncrypted    *DoubleEncrypted
+
+	// Live watchers of firewall drops, see the watch-drops ssh command
+	dropWatch dropWatch
 
 	tryPromoteEvery atomic.Uint32
 	reQueryEvery    atomic.Uint32
 	reQueryWait     atomic.Int64
 
-	sendRecvErrorConfig sendRecvErrorConfig
+	sendRecvErrorConfig     sendRecvErrorConfig
+	indexCollisionRecvError atomic.Bool
+
+	// controlPriority moves control plane packets out of the udp readers and onto controlQueue
+	controlPriority atomic.Bool
+	controlQueue    chan controlPacket
+	// controlDone stops the control routine, controlQueue is never closed since a udp reader may still be sending on it
+	controlDone chan struct{}
+
+	// decryptLimit sheds data packets once too many readers are decrypting at once
+	decryptLimit decryptLimit
+
+	// keyExport allows tunnel session keys to be exported, see key_export.go
+	keyExport atomic.Bool
 
 	// rebindCount is used to decide if an active tunnel should trigger a punch notification through a lighthouse
 	rebindCount int8
@@ -84,12 +184,31 @@ type Interface struct {
 
 	conntrackCacheTimeout time.Duration
 
+	// capture is non nil when inbound udp packets are being written to a capture file
+	capture atomic.Pointer[packetCapture]
+	// sampler is non nil when inner packets are sampled to an sFlow collector
+	sampler atomic.Pointer[packetSampler]
+	// securityEvents is non nil when security events are sent to a syslog destination
+	securityEvents atomic.Pointer[securityEventLog]
+
+	runtimeInfo atomic.Pointer[RuntimeInfo]
+
 	writers []udp.Conn
 	readers []io.ReadWriteCloser
 
-	metricHandshakes    metrics.Histogram
-	messageMetrics      *MessageMetrics
-	cachedPacketMetrics *cachedPacketMetrics
+	metricHandshakes              metrics.Histogram
+	metricPreviousKeyRx           metrics.Counter
+	metricBadChecksum             metrics.Counter
+	metricICMPEchoReply           metrics.Counter
+	metricIPOptions               metrics.Counter
+	metricTooLate                 metrics.Counter
+	metricRoutingLoop             metrics.Counter
+	metricIndexCollisionRecvError metrics.Counter
+	metricControlQueueFull        metrics.Counter
+	metricDecryptShed             metrics.Counter
+	metricKeyExports              metrics.Counter
+	messageMetrics                *MessageMetrics
+	cachedPacketMetrics           *cachedPacketMetrics
 
 	l *logrus.Logger
 }
@@ -191,16 +310,61 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 		dropLocalBroadcast: c.DropLocalBroadcast,
 		dropMulticast:      c.DropMulticast,
 		routines:           c.routines,
+		readerAffinity:     c.readerAffinity,
 		version:            c.version,
 		writers:            make([]udp.Conn, c.routines),
 		readers:            make([]io.ReadWriteCloser, c.routines),
 		myVpnNet:           myVpnNet,
 		relayManager:       c.relayManager,
+		relayLoadShare:     c.relayLoadShare,
+		relayForwardScope:  c.relayForwardScope,
+		multicast:          c.multicast,
+		innerNAT:           c.innerNAT,
+		authOnly:           c.authOnly,
+		latencyProbe:       c.latencyProbe,
+		hostmapSnapshot:    c.hostmapSnapshot,
+		health:             c.health,
+		roamPin:            c.roamPin,
+		tunnelPause:        c.tunnelPause,
+		sourcePin:          c.sourcePin,
+		underlayDeny:       c.underlayDeny,
+		sendBackoff:        c.sendBackoff,
+		sendPriority:       c.sendPriority,
+		duplicateVpnIp:     c.duplicateVpnIp,
+		tunnelQuality:      c.tunnelQuality,
+		underlayWatch:      c.underlayWatch,
+		observer:           c.observer,
+		tunnelMetrics:      c.tunnelMetrics,
+		rates:              c.rates,
+		tunRecovery:        c.tunRecovery,
+		memoryBudget:       c.memoryBudget,
+		identityHiding:     c.identityHiding,
+		packetAuth:         c.packetAuth,
+		padding:            c.padding,
+		tcpTransport:       c.tcpTransport,
+		mtuProbe:           c.mtuProbe,
+		rekey:              c.rekey,
+		pathSelection:      c.pathSelection,
+		tracer:             c.tracer,
+		conntrackSync:      c.conntrackSync,
+		doubleEncrypted:    c.doubleEncrypted,
+		controlQueue:       make(chan controlPacket, controlQueueLen),
+		controlDone:        make(chan struct{}),
 
 		conntrackCacheTimeout: c.ConntrackCacheTimeout,
 
-		metricHandshakes: metrics.GetOrRegisterHistogram("handshakes", nil, metrics.NewExpDecaySample(1028, 0.015)),
-		messageMetrics:   c.MessageMetrics,
+		metricHandshakes:              metrics.GetOrRegisterHistogram("handshakes", nil, metrics.NewExpDecaySample(1028, 0.015)),
+		metricPreviousKeyRx:           metrics.GetOrRegisterCounter("decrypt.previous_key", nil),
+		metricBadChecksum:             metrics.GetOrRegisterCounter("decrypt.bad_checksum", nil),
+		metricICMPEchoReply:           metrics.GetOrRegisterCounter("network.packets.icmp_echo_reply", nil),
+		metricTooLate:                 metrics.GetOrRegisterCounter("network.packets.too_late", nil),
+		metricRoutingLoop:             metrics.GetOrRegisterCounter("network.packets.routing_loop", nil),
+		metricIPOptions:               metrics.GetOrRegisterCounter("network.packets.ip_options", nil),
+		metricIndexCollisionRecvError: metrics.GetOrRegisterCounter("messages.tx.recv_error_index_collision", nil),
+		metricControlQueueFull:        metrics.GetOrRegisterCounter("messages.rx.control_queue_full", nil),
+		metricDecryptShed:             metrics.GetOrRegisterCounter("messages.rx.decrypt_shed", nil),
+		metricKeyExports:              metrics.GetOrRegisterCounter("key_export.exported", nil),
+		messageMetrics:                c.MessageMetrics,
 		cachedPacketMetrics: &cachedPacketMetrics{
 			sent:    metrics.GetOrRegisterCounter("hostinfo.cached_packets.sent", nil),
 			dropped: metrics.GetOrRegisterCounter("hostinfo.cached_packets.dropped", nil),
@@ -215,11 +379,20 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 		ifce.myBroadcastAddr = netip.AddrFrom4(addr)
 	}
 
+	ifce.ecn.Store(c.ECN)
+	ifce.verifyChecksums.Store(c.VerifyChecksums)
+	ifce.icmpEchoReply.Store(c.ICMPEchoReply)
+	ifce.dropIPOptions.Store(c.DropIPOptions)
+	ifce.maxPacketAge.Store(int64(c.MaxPacketAge))
+	ifce.unknownDestReject.Store(c.UnknownDestReject)
+	ifce.routingLoopDrop.Store(c.RoutingLoopDrop)
+	ifce.controlPriority.Store(c.ControlPriority)
+	ifce.decryptLimit.max.Store(int64(c.MaxDecryptConcurrency))
 	ifce.tryPromoteEvery.Store(c.tryPromoteEvery)
 	ifce.reQueryEvery.Store(c.reQueryEvery)
 	ifce.reQueryWait.Store(int64(c.reQueryWait))
 
-	ifce.connectionManager = newConnectionManager(ctx, c.l, ifce, c.checkInterval, c.pendingDeletionInterval, c.punchy)
+	ifce.connectionManager = newConnectionManager(ctx, c.l, ifce, c.checkInterval, c.pendingDeletionInterval, c.punchy, c.tunnelIdle)
 
 	return ifce, nil
 }
@@ -258,14 +431,20 @@ func (f *Interface) activate() {
 		f.inside.Close()
 		f.l.Fatal(err)
 	}
+	f.health.markTunUp(true)
 }
 
 func (f *Interface) run() {
+	f.tcpTransport.setInterface(f)
+
 	// Launch n queues to read packets from udp
 	for i := 0; i < f.routines; i++ {
 		go f.listenOut(i)
 	}
 
+	// Launch the control plane routine, it is idle unless listen.control_priority is enabled
+	go f.listenControl()
+
 	// Launch n queues to read packets from tun dev
 	for i := 0; i < f.routines; i++ {
 		go f.listenIn(f.readers[i], i)
@@ -274,20 +453,23 @@ func (f *Interface) run() {
 
 func (f *Interface) listenOut(i int) {
 	runtime.LockOSThread()
+	pinReader(f.l, f.readerAffinity, i)
 
-	var li udp.Conn
-	// TODO clean this up with a coherent interface for each outside connection
-	if i > 0 {
-		li = f.writers[i]
-	} else {
-		li = f.outside
-	}
-
+	li := f.writer(i)
 	lhh := f.lightHouse.NewRequestHandler()
 	conntrackCache := firewall.NewConntrackCacheTicker(f.conntrackCacheTimeout)
 	li.ListenOut(readOutsidePackets(f), lhHandleRequest(lhh, f), conntrackCache, i)
 }
 
+// writer returns the udp socket owned by routine q. Each routine reads from and sends on its own socket, with
+// SO_REUSEPORT the kernel hashes flows across them so a flow stays on one core end to end.
+func (f *Interface) writer(q int) udp.Conn {
+	if q < len(f.writers) && f.writers[q] != nil {
+		return f.writers[q]
+	}
+	return f.outside
+}
+
 func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 	runtime.LockOSThread()
 
@@ -310,6 +492,7 @@ func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 			os.Exit(2)
 		}
 
+		f.rates.tx(i, n)
 		f.consumeInsidePacket(packet[:n], fwPacket, nb, out, i, conntrackCache.Get(f.l))
 	}
 }
@@ -319,6 +502,11 @@ func (f *Interface) RegisterConfigChangeCallbacks(c *config.C) {
 	c.RegisterReloadCallback(f.reloadSendRecvError)
 	c.RegisterReloadCallback(f.reloadDisconnectInvalid)
 	c.RegisterReloadCallback(f.reloadMisc)
+	c.RegisterReloadCallback(f.reloadPacketCapture)
+	c.RegisterReloadCallback(f.reloadPacketSampling)
+	c.RegisterReloadCallback(f.reloadSecurityEvents)
+	c.RegisterReloadCallback(f.reloadKeyExport)
+	c.RegisterReloadCallback(f.reloadRuntimeInfo)
 
 	for _, udpConn := range f.writers {
 		c.RegisterReloadCallback(udpConn.ReloadConfig)
@@ -361,6 +549,8 @@ func (f *Interface) reloadFirewall(c *config.C) {
 			WithField("oldFirewallHashes", oldFw.GetRuleHashes()).
 			WithField("rulesVersion", fw.rulesVersion).
 			Warn("firewall rulesVersion has overflowed, resetting conntrack")
+		fw.Conntrack.full = conntrack.full
+		fw.Conntrack.deltas = conntrack.deltas
 	} else {
 		fw.Conntrack = conntrack
 	}
@@ -396,9 +586,72 @@ func (f *Interface) reloadSendRecvError(c *config.C) {
 		f.l.WithField("sendRecvError", f.sendRecvErrorConfig.String()).
 			Info("Loaded send_recv_error config")
 	}
+
+	if c.InitialLoad() || c.HasChanged("listen.index_collision_recv_error") {
+		f.indexCollisionRecvError.Store(c.GetBool("listen.index_collision_recv_error", false))
+		if !c.InitialLoad() {
+			f.l.Infof("listen.index_collision_recv_error changed to %v", f.indexCollisionRecvError.Load())
+		}
+	}
 }
 
 func (f *Interface) reloadMisc(c *config.C) {
+	if c.HasChanged("listen.ecn") {
+		f.ecn.Store(c.GetBool("listen.ecn", false))
+		f.l.Info("listen.ecn has changed")
+	}
+
+	if c.HasChanged("tun.verify_checksums") {
+		f.verifyChecksums.Store(c.GetBool("tun.verify_checksums", false))
+		f.l.Info("tun.verify_checksums has changed")
+	}
+
+	if c.HasChanged("tun.icmp_echo_reply") {
+		f.icmpEchoReply.Store(c.GetBool("tun.icmp_echo_reply", false))
+		f.l.Info("tun.icmp_echo_reply has changed")
+	}
+
+	if c.HasChanged("tun.drop_ip_options") {
+		f.dropIPOptions.Store(c.GetBool("tun.drop_ip_options", false))
+		f.l.Info("tun.drop_ip_options has changed")
+	}
+
+	if c.HasChanged("tun.max_packet_age") {
+		f.maxPacketAge.Store(int64(c.GetDuration("tun.max_packet_age", 0)))
+		f.l.WithField("maxPacketAge", c.GetDuration("tun.max_packet_age", 0)).Info("tun.max_packet_age has changed")
+	}
+
+	if c.HasChanged("listen.control_priority") {
+		f.controlPriority.Store(c.GetBool("listen.control_priority", false))
+		f.l.Info("listen.control_priority has changed")
+	}
+
+	if c.HasChanged("listen.max_decrypt_concurrency") {
+		f.decryptLimit.max.Store(int64(c.GetInt("listen.max_decrypt_concurrency", 0)))
+		f.l.WithField("maxDecryptConcurrency", c.GetInt("listen.max_decrypt_concurrency", 0)).
+			Info("listen.max_decrypt_concurrency has changed")
+	}
+
+	if c.HasChanged("tun.routing_loop_action") {
+		drop, err := routingLoopDrop(c)
+		if err != nil {
+			f.l.WithError(err).Error("Failed to reload tun.routing_loop_action, keeping the old value")
+		} else {
+			f.routingLoopDrop.Store(drop)
+			f.l.Info("tun.routing_loop_action has changed")
+		}
+	}
+
+	if c.HasChanged("tun.unknown_destination_action") {
+		reject, err := unknownDestinationReject(c)
+		if err != nil {
+			f.l.WithError(err).Error("Failed to reload tun.unknown_destination_action, keeping the old value")
+		} else {
+			f.unknownDestReject.Store(reject)
+			f.l.Info("tun.unknown_destination_action has changed")
+		}
+	}
+
 	if c.HasChanged("counters.try_promote") {
 		n := c.GetUint32("counters.try_promote", defaultPromoteEvery)
 		f.tryPromoteEvery.Store(n)
@@ -418,11 +671,29 @@ func (f *Interface) reloadMisc(c *config.C) {
 	}
 }
 
+// unknownDestinationReject returns true if tun.unknown_destination_action is reject
+func unknownDestinationReject(c *config.C) (bool, error) {
+	switch a := c.GetString("tun.unknown_destination_action", "drop"); a {
+	case "drop":
+		return false, nil
+	case "reject":
+		return true, nil
+	default:
+		return false, fmt.Errorf("tun.unknown_destination_action must be drop or reject, got %q", a)
+	}
+}
+
 func (f *Interface) emitStats(ctx context.Context, i time.Duration) {
 	ticker := time.NewTicker(i)
 	defer ticker.Stop()
 
-	udpStats := udp.NewUDPStatsEmitter(f.writers)
+	underlays := make([]udp.Conn, len(f.writers))
+	for i, w := range f.writers {
+		underlays[i] = underlay(w)
+	}
+	udpStats := udp.NewUDPStatsEmitter(underlays)
+	caStats := newCATunnelsEmitter(f.hostMap, f.pki)
+	qualityStats := newTunnelQualityEmitter(f.hostMap, f.tunnelQuality)
 
 	certExpirationGauge := metrics.GetOrRegisterGauge("certificate.ttl_seconds", nil)
 
@@ -434,6 +705,8 @@ func (f *Interface) emitStats(ctx context.Context, i time.Duration) {
 			f.firewall.EmitStats()
 			f.handshakeManager.EmitStats()
 			udpStats()
+			caStats()
+			qualityStats()
 			certExpirationGauge.Update(int64(f.pki.GetCertState().Certificate.Details.NotAfter.Sub(time.Now()) / time.Second))
 		}
 	}
@@ -442,6 +715,19 @@ func (f *Interface) emitStats(ctx context.Context, i time.Duration) {
 func (f *Interface) Close() error {
 	f.closed.Store(true)
 
+	if pc := f.capture.Swap(nil); pc != nil {
+		pc.Close()
+	}
+	if s := f.sampler.Swap(nil); s != nil {
+		s.Close()
+	}
+	if s := f.securityEvents.Swap(nil); s != nil {
+		s.Close()
+	}
+	if f.controlDone != nil {
+		close(f.controlDone)
+	}
+
 	for _, u := range f.writers {
 		err := u.Close()
 		if err != nil {
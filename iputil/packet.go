@@ -2,6 +2,7 @@ package iputil
 
 import (
 	"encoding/binary"
+	"errors"
 
 	"golang.org/x/net/ipv4"
 )
@@ -16,6 +17,75 @@ const (
 	MaxRejectPacketSize = ipv4.HeaderLen + 8 + 60 + 8
 )
 
+var (
+	ErrNotIPv4              = errors.New("packet is not ipv4")
+	ErrShortPacket          = errors.New("packet is shorter than its headers or total length")
+	ErrBadIPv4Checksum      = errors.New("bad ipv4 header checksum")
+	ErrBadTransportChecksum = errors.New("bad transport checksum")
+)
+
+// HasIPv4Options returns true if the ipv4 header of packet is longer than the fixed 20 bytes, meaning it carries ip
+// options. The caller is expected to have checked the packet is ipv4.
+func HasIPv4Options(packet []byte) bool {
+	return len(packet) > 0 && int(packet[0]&0x0f)<<2 > ipv4.HeaderLen
+}
+
+// VerifyIPv4Checksums checks the ipv4 header checksum and the tcp, udp, or icmp checksum of an unfragmented packet.
+// The transport of a fragment can not be checked without reassembling it so only its header is. A udp checksum of 0
+// means the sender did not compute one and is accepted.
+func VerifyIPv4Checksums(packet []byte) error {
+	if len(packet) < ipv4.HeaderLen || int(packet[0]>>4) != ipv4.Version {
+		return ErrNotIPv4
+	}
+
+	ihl := int(packet[0]&0x0f) << 2
+	totalLen := int(binary.BigEndian.Uint16(packet[2:4]))
+	if ihl < ipv4.HeaderLen || totalLen < ihl || totalLen > len(packet) {
+		return ErrShortPacket
+	}
+
+	if tcpipChecksum(packet[:ihl], 0) != 0 {
+		return ErrBadIPv4Checksum
+	}
+
+	// More fragments or a fragment offset
+	if binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0 {
+		return nil
+	}
+
+	payload := packet[ihl:totalLen]
+	proto := uint32(packet[9])
+	switch proto {
+	case 6: // tcp
+		if len(payload) < 20 {
+			return ErrShortPacket
+		}
+	case 17: // udp
+		if len(payload) < 8 {
+			return ErrShortPacket
+		}
+		if binary.BigEndian.Uint16(payload[6:8]) == 0 {
+			return nil
+		}
+	case 1: // icmp
+		if len(payload) < 4 {
+			return ErrShortPacket
+		}
+		if tcpipChecksum(payload, 0) != 0 {
+			return ErrBadTransportChecksum
+		}
+		return nil
+	default:
+		return nil
+	}
+
+	csum := ipv4PseudoheaderChecksum(packet[12:16], packet[16:20], proto, uint32(len(payload)))
+	if tcpipChecksum(payload, csum) != 0 {
+		return ErrBadTransportChecksum
+	}
+	return nil
+}
+
 func CreateRejectPacket(packet []byte, out []byte) []byte {
 	if len(packet) < ipv4.HeaderLen || int(packet[0]>>4) != ipv4.Version {
 		return nil
@@ -25,11 +95,59 @@ func CreateRejectPacket(packet []byte, out []byte) []byte {
 	case 6: // tcp
 		return ipv4CreateRejectTCPPacket(packet, out)
 	default:
-		return ipv4CreateRejectICMPPacket(packet, out)
+		return ipv4CreateRejectICMPPacket(packet, out, 3)
 	}
 }
 
-func ipv4CreateRejectICMPPacket(packet []byte, out []byte) []byte {
+// CreateHostUnreachablePacket builds an icmp host unreachable for packet into out, for any protocol. Nothing is built
+// for icmp errors or non first fragments, they never get an icmp error in return.
+func CreateHostUnreachablePacket(packet []byte, out []byte) []byte {
+	if len(packet) < ipv4.HeaderLen || int(packet[0]>>4) != ipv4.Version {
+		return nil
+	}
+
+	// Fragment offset
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+		return nil
+	}
+
+	ihl := int(packet[0]&0x0f) << 2
+	if packet[9] == 1 && len(packet) > ihl {
+		switch packet[ihl] {
+		case 3, 4, 5, 11, 12: // destination unreachable, source quench, redirect, time exceeded, parameter problem
+			return nil
+		}
+	}
+
+	return ipv4CreateRejectICMPPacket(packet, out, 1)
+}
+
+// CreateFragNeededPacket builds an icmp fragmentation needed for packet into out, advertising mtu as the next hop mtu.
+// Nothing is built unless packet has the DF bit set, packets that may be fragmented do not get one.
+func CreateFragNeededPacket(packet []byte, out []byte, mtu int) []byte {
+	if len(packet) < ipv4.HeaderLen || int(packet[0]>>4) != ipv4.Version {
+		return nil
+	}
+
+	// DF flag, a packet with DF set is never a non first fragment
+	if packet[6]&0x40 == 0 {
+		return nil
+	}
+
+	out = ipv4CreateRejectICMPPacket(packet, out, 4)
+	if len(out) == 0 {
+		return nil
+	}
+
+	icmpOut := out[ipv4.HeaderLen:]
+	binary.BigEndian.PutUint16(icmpOut[6:], uint16(mtu)) // next hop mtu
+	icmpOut[2] = 0
+	icmpOut[3] = 0
+	binary.BigEndian.PutUint16(icmpOut[2:], tcpipChecksum(icmpOut, 0))
+	return out
+}
+
+func ipv4CreateRejectICMPPacket(packet []byte, out []byte, code byte) []byte {
 	ihl := int(packet[0]&0x0f) << 2
 
 	if len(packet) < ihl {
@@ -73,14 +191,14 @@ func ipv4CreateRejectICMPPacket(packet []byte, out []byte) []byte {
 
 	// ICMP Destination Unreachable
 	icmpOut := out[ipv4.HeaderLen:]
-	icmpOut[0] = 3 // type (Destination unreachable)
-	icmpOut[1] = 3 // code (Port unreachable error)
-	icmpOut[2] = 0 // checksum
-	icmpOut[3] = 0 //  .
-	icmpOut[4] = 0 // unused
-	icmpOut[5] = 0 //  .
-	icmpOut[6] = 0 //  .
-	icmpOut[7] = 0 //  .
+	icmpOut[0] = 3    // type (Destination unreachable)
+	icmpOut[1] = code // code (Port or host unreachable error)
+	icmpOut[2] = 0    // checksum
+	icmpOut[3] = 0    //  .
+	icmpOut[4] = 0    // unused
+	icmpOut[5] = 0    //  .
+	icmpOut[6] = 0    //  .
+	icmpOut[7] = 0    //  .
 
 	// Copy original IP header and first 8 bytes as body
 	copy(icmpOut[8:], packet[:packetLen])
@@ -167,6 +285,8 @@ func ipv4CreateRejectTCPPacket(packet []byte, out []byte) []byte {
 	return out
 }
 
+// CreateICMPEchoResponse builds the echo reply to an icmp echo request in out, which may be packet itself. Returns
+// nil and leaves out alone if packet is not a simple unfragmented echo request.
 func CreateICMPEchoResponse(packet, out []byte) []byte {
 	// Return early if this is not a simple ICMP Echo Request
 	//TODO: make constants out of these
@@ -185,8 +305,10 @@ func CreateICMPEchoResponse(packet, out []byte) []byte {
 
 	// Swap dest / src IPs and recalculate checksum
 	ipv4 := out[0:20]
-	copy(ipv4[12:16], packet[16:20])
-	copy(ipv4[16:20], packet[12:16])
+	var src [4]byte
+	copy(src[:], ipv4[12:16])
+	copy(ipv4[12:16], ipv4[16:20])
+	copy(ipv4[16:20], src[:])
 	ipv4[10] = 0
 	ipv4[11] = 0
 	binary.BigEndian.PutUint16(ipv4[10:], tcpipChecksum(ipv4, 0))
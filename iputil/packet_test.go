@@ -1,10 +1,14 @@
 package iputil
 
 import (
+	"encoding/binary"
 	"net"
 	"testing"
 
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/ipv4"
 )
 
@@ -71,3 +75,227 @@ func Test_CreateRejectPacket(t *testing.T) {
 	assert.NotNil(t, rejectPacket)
 	assert.Len(t, rejectPacket, expectedLen)
 }
+
+func Test_CreateHostUnreachablePacket(t *testing.T) {
+	build := func(proto int, fragOff int, payload []byte) []byte {
+		h := ipv4.Header{
+			Version:  4,
+			Len:      20,
+			TotalLen: 20 + len(payload),
+			Src:      net.IPv4(10, 0, 0, 1),
+			Dst:      net.IPv4(10, 0, 0, 2),
+			Protocol: proto,
+			FragOff:  fragOff,
+		}
+		b, err := h.Marshal()
+		require.NoError(t, err)
+		return append(b, payload...)
+	}
+
+	// TCP gets an icmp instead of a reset
+	b := build(6, 0, make([]byte, 20))
+	out := CreateHostUnreachablePacket(b, make([]byte, MaxRejectPacketSize))
+	require.NotNil(t, out)
+	assert.Len(t, out, ipv4.HeaderLen+8+ipv4.HeaderLen+8)
+	assert.Equal(t, []byte{10, 0, 0, 2}, out[12:16])
+	assert.Equal(t, []byte{10, 0, 0, 1}, out[16:20])
+	assert.Equal(t, byte(1), out[9])
+	assert.Equal(t, []byte{3, 1}, out[20:22])
+	assert.NoError(t, VerifyIPv4Checksums(out))
+
+	// An echo request is answered
+	assert.NotNil(t, CreateHostUnreachablePacket(build(1, 0, []byte{8, 0, 0, 0, 0, 0, 0, 0}), make([]byte, MaxRejectPacketSize)))
+
+	// ICMP errors are not
+	assert.Nil(t, CreateHostUnreachablePacket(build(1, 0, []byte{3, 3, 0, 0, 0, 0, 0, 0}), make([]byte, MaxRejectPacketSize)))
+	assert.Nil(t, CreateHostUnreachablePacket(build(1, 0, []byte{11, 0, 0, 0, 0, 0, 0, 0}), make([]byte, MaxRejectPacketSize)))
+
+	// Only the first fragment is answered
+	assert.NotNil(t, CreateHostUnreachablePacket(build(17, 0, make([]byte, 8)), make([]byte, MaxRejectPacketSize)))
+	assert.Nil(t, CreateHostUnreachablePacket(build(17, 8, make([]byte, 8)), make([]byte, MaxRejectPacketSize)))
+
+	assert.Nil(t, CreateHostUnreachablePacket([]byte{0x60, 0, 0, 0}, make([]byte, MaxRejectPacketSize)))
+}
+
+func Test_CreateFragNeededPacket(t *testing.T) {
+	build := func(flags ipv4.HeaderFlags) []byte {
+		h := ipv4.Header{
+			Version:  4,
+			Len:      20,
+			TotalLen: 20 + 1400,
+			Src:      net.IPv4(10, 0, 0, 1),
+			Dst:      net.IPv4(10, 0, 0, 2),
+			Protocol: 17,
+			Flags:    flags,
+		}
+		b, err := h.Marshal()
+		require.NoError(t, err)
+		return append(b, make([]byte, 1400)...)
+	}
+
+	out := CreateFragNeededPacket(build(ipv4.DontFragment), make([]byte, MaxRejectPacketSize), 1280)
+	require.NotNil(t, out)
+	assert.Equal(t, []byte{10, 0, 0, 1}, out[16:20])
+	assert.Equal(t, []byte{3, 4}, out[20:22])
+	assert.Equal(t, uint16(1280), binary.BigEndian.Uint16(out[26:28]))
+	assert.NoError(t, VerifyIPv4Checksums(out))
+	assert.Zero(t, tcpipChecksum(out[ipv4.HeaderLen:], 0))
+
+	// Packets that may be fragmented are left alone
+	assert.Nil(t, CreateFragNeededPacket(build(0), make([]byte, MaxRejectPacketSize), 1280))
+	assert.Nil(t, CreateFragNeededPacket([]byte{0x60, 0, 0, 0}, make([]byte, MaxRejectPacketSize), 1280))
+}
+
+func Test_VerifyIPv4Checksums(t *testing.T) {
+	build := func(l4 ...gopacket.SerializableLayer) []byte {
+		ip := &layers.IPv4{
+			Version: 4,
+			TTL:     64,
+			SrcIP:   net.IPv4(10, 0, 0, 1).To4(),
+			DstIP:   net.IPv4(10, 0, 0, 2).To4(),
+		}
+		switch v := l4[0].(type) {
+		case *layers.TCP:
+			ip.Protocol = layers.IPProtocolTCP
+			require.NoError(t, v.SetNetworkLayerForChecksum(ip))
+		case *layers.UDP:
+			ip.Protocol = layers.IPProtocolUDP
+			require.NoError(t, v.SetNetworkLayerForChecksum(ip))
+		case *layers.ICMPv4:
+			ip.Protocol = layers.IPProtocolICMPv4
+		}
+
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+		require.NoError(t, gopacket.SerializeLayers(buf, opts, append([]gopacket.SerializableLayer{ip}, l4...)...))
+		return buf.Bytes()
+	}
+	payload := gopacket.Payload("hello world")
+
+	tcp := build(&layers.TCP{SrcPort: 1, DstPort: 2, Seq: 100, SYN: true, Window: 1024}, payload)
+	udp := build(&layers.UDP{SrcPort: 1, DstPort: 2}, payload)
+	icmp := build(&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 1, Seq: 1}, payload)
+	for _, p := range [][]byte{tcp, udp, icmp} {
+		assert.NoError(t, VerifyIPv4Checksums(p))
+
+		// Corrupt the last payload byte
+		bad := append([]byte{}, p...)
+		bad[len(bad)-1] ^= 0xff
+		assert.Equal(t, ErrBadTransportChecksum, VerifyIPv4Checksums(bad))
+
+		// Corrupt the ttl
+		bad = append([]byte{}, p...)
+		bad[8]--
+		assert.Equal(t, ErrBadIPv4Checksum, VerifyIPv4Checksums(bad))
+	}
+
+	// A udp checksum of 0 was never computed
+	noChecksum := append([]byte{}, udp...)
+	binary.BigEndian.PutUint16(noChecksum[ipv4.HeaderLen+6:], 0)
+	noChecksum[len(noChecksum)-1] ^= 0xff
+	assert.NoError(t, VerifyIPv4Checksums(noChecksum))
+
+	// Trailing bytes past the total length are ignored
+	assert.NoError(t, VerifyIPv4Checksums(append(append([]byte{}, tcp...), 0, 0, 0)))
+
+	// Truncated packets
+	assert.Equal(t, ErrShortPacket, VerifyIPv4Checksums(tcp[:len(tcp)-1]))
+	assert.Equal(t, ErrNotIPv4, VerifyIPv4Checksums(tcp[:ipv4.HeaderLen-1]))
+
+	// The transport of a fragment is not checked
+	fragment := append([]byte{}, udp...)
+	fragment[6] |= 0x20
+	binary.BigEndian.PutUint16(fragment[10:], 0)
+	binary.BigEndian.PutUint16(fragment[10:], tcpipChecksum(fragment[:ipv4.HeaderLen], 0))
+	fragment[len(fragment)-1] ^= 0xff
+	assert.NoError(t, VerifyIPv4Checksums(fragment))
+}
+
+func Test_CreateICMPEchoResponse(t *testing.T) {
+	build := func(icmp *layers.ICMPv4, payload []byte, flags layers.IPv4Flag) []byte {
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Flags:    flags,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    net.IPv4(10, 0, 0, 1).To4(),
+			DstIP:    net.IPv4(10, 0, 0, 2).To4(),
+		}
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+		require.NoError(t, gopacket.SerializeLayers(buf, opts, ip, icmp, gopacket.Payload(payload)))
+		return buf.Bytes()
+	}
+	echo := func(id, seq uint16) *layers.ICMPv4 {
+		return &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: id, Seq: seq}
+	}
+
+	// Even and odd payload lengths exercise both ends of the checksum
+	for _, payload := range [][]byte{[]byte("ping"), []byte("hello world"), {}} {
+		request := build(echo(0x1234, 7), payload, layers.IPv4DontFragment)
+		reply := CreateICMPEchoResponse(request, make([]byte, len(request)))
+		require.NotNil(t, reply)
+		require.NoError(t, VerifyIPv4Checksums(reply))
+
+		p := gopacket.NewPacket(reply, layers.LayerTypeIPv4, gopacket.Default)
+		require.Nil(t, p.ErrorLayer())
+		ip := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		assert.Equal(t, net.IPv4(10, 0, 0, 2).To4(), ip.SrcIP)
+		assert.Equal(t, net.IPv4(10, 0, 0, 1).To4(), ip.DstIP)
+
+		icmp := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+		assert.Equal(t, layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0), icmp.TypeCode)
+		assert.Equal(t, uint16(0x1234), icmp.Id)
+		assert.Equal(t, uint16(7), icmp.Seq)
+		assert.Equal(t, payload, icmp.Payload)
+	}
+
+	// The reply can be built in place
+	request := build(echo(0x1234, 7), []byte("ping"), 0)
+	want := CreateICMPEchoResponse(request, make([]byte, len(request)))
+	assert.Equal(t, want, CreateICMPEchoResponse(request, request))
+
+	// Only echo requests are answered
+	reply := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0), Id: 1, Seq: 1}
+	b := build(reply, []byte("pong"), 0)
+	assert.Nil(t, CreateICMPEchoResponse(b, make([]byte, len(b))))
+
+	// Fragments are not answered
+	b = build(echo(1, 1), []byte("ping"), layers.IPv4MoreFragments)
+	assert.Nil(t, CreateICMPEchoResponse(b, make([]byte, len(b))))
+}
+
+func Test_HasIPv4Options(t *testing.T) {
+	build := func(opts ...layers.IPv4Option) []byte {
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    net.IPv4(10, 0, 0, 1).To4(),
+			DstIP:    net.IPv4(10, 0, 0, 2).To4(),
+			Options:  opts,
+		}
+		udp := &layers.UDP{SrcPort: 1, DstPort: 2}
+		require.NoError(t, udp.SetNetworkLayerForChecksum(ip))
+		buf := gopacket.NewSerializeBuffer()
+		so := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+		require.NoError(t, gopacket.SerializeLayers(buf, so, ip, udp, gopacket.Payload("hi")))
+		return buf.Bytes()
+	}
+
+	assert.False(t, HasIPv4Options(build()))
+	assert.False(t, HasIPv4Options(nil))
+
+	// Record route with room for one address
+	rr := build(layers.IPv4Option{OptionType: 7, OptionLength: 7, OptionData: []byte{4, 0, 0, 0, 0}})
+	assert.Equal(t, byte(0x47), rr[0])
+	assert.True(t, HasIPv4Options(rr))
+	assert.NoError(t, VerifyIPv4Checksums(rr))
+
+	// Loose source route, a classic way around filtering
+	lsrr := build(layers.IPv4Option{OptionType: 131, OptionLength: 7, OptionData: []byte{4, 192, 168, 0, 1}})
+	assert.True(t, HasIPv4Options(lsrr))
+
+	// A lone end of options list still makes the header longer
+	assert.True(t, HasIPv4Options(build(layers.IPv4Option{OptionType: 0, OptionLength: 1})))
+}
@@ -0,0 +1,95 @@
+package nebula
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/netip"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// Exporting the session keys of a tunnel lets anyone holding them decrypt its captured traffic. It exists for protocol
+// debugging in a lab and takes two deliberate steps, a binary built with the nebula_key_export tag, see
+// `make bin-key-export`, and key_export.dangerous set in the config. Release builds never keep the keys around and
+// refuse every export. Each export is logged at warning level.
+
+var (
+	errKeyExportNotBuilt = errors.New("tunnel key export is not built in, it needs a binary built with -tags nebula_key_export")
+	errKeyExportDisabled = errors.New("tunnel key export is disabled, set key_export.dangerous to true")
+	errKeyExportNoTunnel = errors.New("no established tunnel with this vpn ip")
+)
+
+// TunnelKeys are the session keys of a single tunnel. Every packet is sealed with the key of its direction using the
+// tunnel cipher, the 16 byte nebula header is the associated data and the message counter in the header is the noise
+// nonce. Packets sent by us use EncryptKey and are addressed to RemoteIndex, packets we receive use DecryptKey and are
+// addressed to LocalIndex.
+type TunnelKeys struct {
+	VpnIp       netip.Addr `json:"vpnIp"`
+	LocalIndex  uint32     `json:"localIndex"`
+	RemoteIndex uint32     `json:"remoteIndex"`
+	Cipher      string     `json:"cipher"`
+	Initiator   bool       `json:"initiator"`
+	EncryptKey  string     `json:"encryptKey"`
+	DecryptKey  string     `json:"decryptKey"`
+}
+
+func (f *Interface) reloadKeyExport(c *config.C) {
+	initial := c.InitialLoad()
+	if !initial && !c.HasChanged("key_export") {
+		return
+	}
+
+	if initial && keyExportBuilt {
+		f.l.Warn("This binary is built with tunnel key export, it must never be used in production")
+	}
+
+	enabled := c.GetBool("key_export.dangerous", false)
+	if enabled && !keyExportBuilt {
+		f.l.Error("key_export.dangerous is set but this binary was not built with key export, exports are refused")
+		enabled = false
+	}
+	f.keyExport.Store(enabled)
+
+	if enabled {
+		f.l.Warn("key_export.dangerous is set, tunnel session keys can be exported")
+	} else if !initial {
+		f.l.Info("key_export.dangerous has changed, tunnel session keys can no longer be exported")
+	}
+}
+
+// exportTunnelKeys returns the session keys of the primary tunnel with vpnIp
+func (f *Interface) exportTunnelKeys(vpnIp netip.Addr) (*TunnelKeys, error) {
+	l := f.l.WithField("vpnIp", vpnIp)
+	if !keyExportBuilt {
+		l.WithError(errKeyExportNotBuilt).Warn("Refused to export tunnel session keys")
+		return nil, errKeyExportNotBuilt
+	}
+
+	if !f.keyExport.Load() {
+		l.WithError(errKeyExportDisabled).Warn("Refused to export tunnel session keys")
+		return nil, errKeyExportDisabled
+	}
+
+	hostinfo := f.hostMap.QueryVpnIp(vpnIp)
+	if hostinfo == nil || hostinfo.ConnectionState == nil || hostinfo.ConnectionState.dKey == nil {
+		l.WithError(errKeyExportNoTunnel).Warn("Refused to export tunnel session keys")
+		return nil, errKeyExportNoTunnel
+	}
+
+	ci := hostinfo.ConnectionState
+	eKey, dKey := ci.exportKeys.keys()
+	f.metricKeyExports.Inc(1)
+	hostinfo.logger(f.l).WithFields(logrus.Fields{"localIndex": hostinfo.localIndexId, "remoteIndex": hostinfo.remoteIndexId}).
+		Warn("EXPORTED TUNNEL SESSION KEYS, all traffic of this tunnel can be decrypted by whoever holds them")
+
+	return &TunnelKeys{
+		VpnIp:       hostinfo.vpnIp,
+		LocalIndex:  hostinfo.localIndexId,
+		RemoteIndex: hostinfo.remoteIndexId,
+		Cipher:      f.cipher,
+		Initiator:   ci.initiator,
+		EncryptKey:  hex.EncodeToString(eKey[:]),
+		DecryptKey:  hex.EncodeToString(dKey[:]),
+	}, nil
+}
@@ -0,0 +1,24 @@
+//go:build nebula_key_export
+// +build nebula_key_export
+
+package nebula
+
+import "github.com/flynn/noise"
+
+// keyExportBuilt is only true in binaries built with the nebula_key_export tag, see key_export.go
+const keyExportBuilt = true
+
+// keyExportState keeps a copy of the session keys of a tunnel so they can be exported
+type keyExportState struct {
+	eKey [32]byte
+	dKey [32]byte
+}
+
+func (k *keyExportState) record(eKey, dKey *noise.CipherState) {
+	k.eKey = eKey.UnsafeKey()
+	k.dKey = dKey.UnsafeKey()
+}
+
+func (k *keyExportState) keys() ([32]byte, [32]byte) {
+	return k.eKey, k.dKey
+}
@@ -0,0 +1,33 @@
+//go:build nebula_key_export
+// +build nebula_key_export
+
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterface_exportTunnelKeys(t *testing.T) {
+	f, hi := newKeyExportInterface(t, true)
+	hi.ConnectionState.exportKeys = keyExportState{eKey: [32]byte{1}, dKey: [32]byte{2}}
+
+	_, err := f.exportTunnelKeys(netip.MustParseAddr("10.128.0.3"))
+	assert.Equal(t, errKeyExportNoTunnel, err)
+
+	keys, err := f.exportTunnelKeys(hi.vpnIp)
+	require.NoError(t, err)
+	assert.Equal(t, &TunnelKeys{
+		VpnIp:       hi.vpnIp,
+		LocalIndex:  10,
+		RemoteIndex: 20,
+		Cipher:      "aes",
+		Initiator:   true,
+		EncryptKey:  "0100000000000000000000000000000000000000000000000000000000000000",
+		DecryptKey:  "0200000000000000000000000000000000000000000000000000000000000000",
+	}, keys)
+	assert.Equal(t, int64(1), f.metricKeyExports.Count())
+}
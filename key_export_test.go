@@ -0,0 +1,76 @@
+package nebula
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/sshd"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newKeyExportInterface returns an interface with a single tunnel to 10.128.0.2 for the key export tests
+func newKeyExportInterface(t *testing.T, dangerous bool) (*Interface, *HostInfo) {
+	l := test.NewLogger()
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	f := &Interface{l: l, hostMap: hm, cipher: "aes", metricKeyExports: metrics.NewCounter()}
+
+	hi := &HostInfo{
+		vpnIp:           netip.MustParseAddr("10.128.0.2"),
+		localIndexId:    10,
+		remoteIndexId:   20,
+		ConnectionState: &ConnectionState{dKey: &NebulaCipherState{}, eKey: &NebulaCipherState{}, initiator: true},
+	}
+	hm.unlockedAddHostInfo(hi, f)
+
+	c := config.NewC(l)
+	c.Settings["key_export"] = map[interface{}]interface{}{"dangerous": dangerous}
+	f.reloadKeyExport(c)
+	return f, hi
+}
+
+func TestInterface_exportTunnelKeys_refused(t *testing.T) {
+	f, _ := newKeyExportInterface(t, false)
+	_, err := f.exportTunnelKeys(netip.MustParseAddr("10.128.0.2"))
+	if keyExportBuilt {
+		assert.Equal(t, errKeyExportDisabled, err)
+	} else {
+		assert.Equal(t, errKeyExportNotBuilt, err)
+	}
+
+	t.Log("The runtime flag alone is not enough in a release build")
+	f, _ = newKeyExportInterface(t, true)
+	assert.Equal(t, keyExportBuilt, f.keyExport.Load())
+	if !keyExportBuilt {
+		_, err = f.exportTunnelKeys(netip.MustParseAddr("10.128.0.2"))
+		assert.Equal(t, errKeyExportNotBuilt, err)
+		require.Equal(t, int64(0), f.metricKeyExports.Count())
+	}
+}
+
+func TestExportKeys_readOnly(t *testing.T) {
+	f, _ := newKeyExportInterface(t, true)
+	ssh, err := sshd.NewSSHServer(f.l.WithField("subsystem", "sshd"))
+	require.NoError(t, err)
+	attachCommands(f.l, config.NewC(f.l), ssh, f)
+
+	// A read-only client of the management listener is dispatched without mutating access
+	out := &bytes.Buffer{}
+	err = ssh.Dispatch("export-keys 10.128.0.2", out, false)
+	if !keyExportBuilt {
+		assert.Contains(t, out.String(), "did not understand")
+		return
+	}
+	assert.ErrorIs(t, err, sshd.ErrCommandNotPermitted)
+	assert.Contains(t, out.String(), "not permitted")
+	assert.Equal(t, int64(0), f.metricKeyExports.Count())
+
+	out.Reset()
+	require.NoError(t, ssh.Dispatch("export-keys 10.128.0.2", out, true))
+	assert.NotContains(t, out.String(), "not permitted")
+	assert.Equal(t, int64(1), f.metricKeyExports.Count())
+}
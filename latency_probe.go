@@ -0,0 +1,319 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+const (
+	defaultLatencyProbeInterval      = 30 * time.Second
+	defaultLatencyProbeFailures      = 1
+	defaultLatencyProbeMaxCandidates = 4
+	defaultLatencyProbeHysteresis    = 5 * time.Millisecond
+)
+
+// latencyProbeMagic prefixes the payload of a latency probe, followed by a big endian uint64 probe id
+var latencyProbeMagic = probeMagic{'r', 't', 't', '1'}
+
+// LatencyProbe measures the round trip time to every candidate remote of a peer with test packets and moves the tunnel
+// to the lowest latency reachable candidate. Each tunnel is probed at most once per interval and the results are cached
+// on the HostInfo. Since every probe costs a packet per candidate this is off by default.
+type LatencyProbe struct {
+	enabled       atomic.Bool
+	timers        atomic.Pointer[probeTimers]
+	maxCandidates atomic.Int64
+	hysteresis    atomic.Int64
+
+	metricTx   metrics.Counter
+	metricRoam metrics.Counter
+	l          *logrus.Logger
+}
+
+// CandidateRTT is the most recent latency probe result for a single remote of a peer
+type CandidateRTT struct {
+	Remote netip.AddrPort `json:"remote"`
+	RTT    time.Duration  `json:"rtt"`
+	// Reachable is false if the candidate has never answered or did not answer the most recent completed probe
+	Reachable bool      `json:"reachable"`
+	LastProbe time.Time `json:"lastProbe"`
+}
+
+// latencyState is the per tunnel probe state
+type latencyState struct {
+	sync.Mutex
+	probes probeSet[netip.AddrPort]
+
+	// pinnedUntil is the unix nano time until which roaming to another known candidate is suppressed because we chose
+	// the current remote by latency
+	pinnedUntil atomic.Int64
+}
+
+func NewLatencyProbeFromConfig(l *logrus.Logger, c *config.C) *LatencyProbe {
+	lp := &LatencyProbe{
+		metricTx:   metrics.GetOrRegisterCounter("latency_probe.tx", nil),
+		metricRoam: metrics.GetOrRegisterCounter("latency_probe.roam", nil),
+		l:          l,
+	}
+
+	lp.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		lp.reload(c, false)
+	})
+
+	return lp
+}
+
+func (lp *LatencyProbe) reload(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("latency_probe") {
+		return
+	}
+
+	timers, err := newProbeTimersFromConfig(c, "latency_probe.", defaultLatencyProbeInterval, defaultLatencyProbeFailures)
+	if err != nil {
+		if initial {
+			lp.l.WithError(err).Warn("Invalid latency_probe timers, using the defaults")
+			timers = &probeTimers{interval: defaultLatencyProbeInterval, timeout: defaultProbeTimeout, failures: defaultLatencyProbeFailures}
+		} else {
+			lp.l.WithError(err).Warn("Invalid latency_probe timers, keeping the previous ones")
+			timers = lp.timers.Load()
+		}
+	}
+
+	maxCandidates := c.GetInt("latency_probe.max_candidates", defaultLatencyProbeMaxCandidates)
+	if maxCandidates < 2 {
+		lp.l.WithField("maxCandidates", maxCandidates).Warn("latency_probe.max_candidates must be at least 2, using the default")
+		maxCandidates = defaultLatencyProbeMaxCandidates
+	}
+
+	lp.timers.Store(timers)
+	lp.maxCandidates.Store(int64(maxCandidates))
+	lp.hysteresis.Store(int64(c.GetDuration("latency_probe.hysteresis", defaultLatencyProbeHysteresis)))
+	lp.enabled.Store(c.GetBool("latency_probe.enabled", false))
+
+	if !initial || lp.enabled.Load() {
+		lp.l.WithField("enabled", lp.enabled.Load()).
+			WithField("interval", timers.interval).
+			WithField("timeout", timers.timeout).
+			WithField("failures", timers.failures).
+			WithField("maxCandidates", maxCandidates).
+			WithField("hysteresis", time.Duration(lp.hysteresis.Load())).
+			Info("Latency probing configured")
+	}
+}
+
+// Run probes every eligible tunnel once per interval until ctx is done
+func (lp *LatencyProbe) Run(ctx context.Context, f *Interface) {
+	clockSource := time.NewTicker(time.Second)
+	defer clockSource.Stop()
+
+	var nextRound time.Time
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case now := <-clockSource.C:
+			if !lp.enabled.Load() || now.Before(nextRound) {
+				continue
+			}
+			nextRound = now.Add(lp.timers.Load().interval)
+
+			f.hostMap.RLock()
+			hosts := make([]*HostInfo, 0, len(f.hostMap.Hosts))
+			for _, hostinfo := range f.hostMap.Hosts {
+				hosts = append(hosts, hostinfo)
+			}
+			f.hostMap.RUnlock()
+
+			for _, hostinfo := range hosts {
+				lp.probe(f, hostinfo, now, nb, out)
+			}
+		}
+	}
+}
+
+// probe acts on the results of the previous round for hostinfo then sends a new probe to each candidate
+func (lp *LatencyProbe) probe(f *Interface, hostinfo *HostInfo, now time.Time, nb, out []byte) {
+	// Relayed tunnels have no remote to choose
+	if !hostinfo.remote.IsValid() || hostinfo.ConnectionState == nil {
+		return
+	}
+
+	addrs := hostinfo.remotes.CopyAddrs(f.hostMap.PreferredRangesFor(hostinfo))
+	if len(addrs) < 2 {
+		return
+	}
+
+	if max := int(lp.maxCandidates.Load()); len(addrs) > max {
+		addrs = addrs[:max]
+	}
+
+	// Always measure the current remote so there is something to compare against
+	found := false
+	for _, addr := range addrs {
+		if addr == hostinfo.remote {
+			found = true
+			break
+		}
+	}
+	if !found {
+		addrs[len(addrs)-1] = hostinfo.remote
+	}
+
+	ids := lp.nextRound(f, hostinfo, addrs, now)
+	for i, addr := range addrs {
+		lp.metricTx.Inc(1)
+		f.sendTo(header.Test, header.TestRequest, hostinfo.ConnectionState, hostinfo, addr, latencyProbeMagic.payload(ids[i]), nb, out)
+	}
+}
+
+// nextRound records a new probe to each of addrs, which counts the unanswered probes of the previous round as lost, then
+// evaluates the results. Candidates not in addrs are forgotten. Returns the probe ids in the order of addrs.
+func (lp *LatencyProbe) nextRound(f *Interface, hostinfo *HostInfo, addrs []netip.AddrPort, now time.Time) []uint64 {
+	timers := lp.timers.Load()
+	ls := &hostinfo.latency
+	ls.Lock()
+	defer ls.Unlock()
+
+	ls.probes.retain(func(addr netip.AddrPort) bool {
+		for _, a := range addrs {
+			if a == addr {
+				return true
+			}
+		}
+		return false
+	})
+
+	ids := make([]uint64, len(addrs))
+	for i, addr := range addrs {
+		ids[i] = ls.probes.send(addr, now, timers)
+	}
+
+	lp.evaluate(f, hostinfo, now)
+	return ids
+}
+
+// evaluate moves hostinfo to the lowest latency candidate that is up, see probe, if it is better than the current
+// remote by more than the hysteresis. Must be called with hostinfo.latency locked.
+func (lp *LatencyProbe) evaluate(f *Interface, hostinfo *HostInfo, now time.Time) {
+	ls := &hostinfo.latency
+	timers := lp.timers.Load()
+
+	var best netip.AddrPort
+	var bestRTT time.Duration
+	for addr, c := range ls.probes.probes {
+		if !c.up {
+			continue
+		}
+
+		if !best.IsValid() || c.rtt < bestRTT {
+			best = addr
+			bestRTT = c.rtt
+		}
+	}
+
+	if !best.IsValid() {
+		return
+	}
+
+	pinFor := 2 * timers.interval
+	if best == hostinfo.remote {
+		if ls.pinnedUntil.Load() != 0 {
+			ls.pinnedUntil.Store(now.Add(pinFor).UnixNano())
+		}
+		return
+	}
+
+	current := ls.probes.get(hostinfo.remote)
+	if current != nil && current.up && current.rtt <= bestRTT+time.Duration(lp.hysteresis.Load()) {
+		return
+	}
+
+	hostinfo.logger(f.l).WithField("udpAddr", hostinfo.remote).
+		WithField("newAddr", best).
+		WithField("rtt", bestRTT).
+		Info("Moving tunnel to lower latency remote")
+
+	lp.metricRoam.Inc(1)
+	ls.pinnedUntil.Store(now.Add(pinFor).UnixNano())
+	hostinfo.lastRoam = now
+	hostinfo.lastRoamRemote = hostinfo.remote
+	hostinfo.SetRemote(best)
+}
+
+// handleReply records the rtt for a test reply to one of our probes, returns false if the reply was not a probe
+func (lp *LatencyProbe) handleReply(hostinfo *HostInfo, d []byte, now time.Time) bool {
+	id, ok := latencyProbeMagic.parse(d)
+	if lp == nil || !ok || len(d) != probeLen {
+		return false
+	}
+
+	ls := &hostinfo.latency
+	ls.Lock()
+	defer ls.Unlock()
+	addr, ok := ls.probes.find(id)
+	if !ok {
+		return false
+	}
+	_, ok = ls.probes.reply(addr, id, now, lp.timers.Load())
+	return ok
+}
+
+// suppressRoam returns true if hostinfo was moved to its current remote by latency probing and addr is another
+// candidate we already know about. Peers often answer from a different address than the one we send to, without this
+// the next packet from the peer would roam us straight back. Unknown addresses are still roamed to.
+func (lp *LatencyProbe) suppressRoam(hostinfo *HostInfo, addr netip.AddrPort, preferredRanges []netip.Prefix) bool {
+	if lp == nil {
+		return false
+	}
+
+	until := hostinfo.latency.pinnedUntil.Load()
+	if until == 0 || time.Now().UnixNano() > until {
+		return false
+	}
+
+	known := false
+	hostinfo.remotes.ForEach(preferredRanges, func(candidate netip.AddrPort, _ bool) {
+		if candidate == addr {
+			known = true
+		}
+	})
+	return known
+}
+
+// copy returns the probe results sorted by rtt, unreachable candidates last
+func (ls *latencyState) copy() []CandidateRTT {
+	ls.Lock()
+	defer ls.Unlock()
+	if len(ls.probes.probes) == 0 {
+		return nil
+	}
+
+	out := make([]CandidateRTT, 0, len(ls.probes.probes))
+	for addr, c := range ls.probes.probes {
+		out = append(out, CandidateRTT{Remote: addr, RTT: c.rtt, Reachable: c.up, LastProbe: c.sent})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Reachable != out[j].Reachable {
+			return out[i].Reachable
+		}
+		if out[i].RTT != out[j].RTT {
+			return out[i].RTT < out[j].RTT
+		}
+		return out[i].Remote.String() < out[j].Remote.String()
+	})
+	return out
+}
@@ -0,0 +1,138 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyProbe(t *testing.T) {
+	l := test.NewLogger()
+	lp := NewLatencyProbeFromConfig(l, config.NewC(l))
+	lp.metricRoam = metrics.NewCounter()
+	f := &Interface{l: l, hostMap: newHostMap(l, netip.MustParsePrefix("172.1.1.1/24"))}
+
+	r1 := netip.MustParseAddrPort("10.0.0.1:4242")
+	r2 := netip.MustParseAddrPort("10.0.1.1:4242")
+	r3 := netip.MustParseAddrPort("10.0.2.1:4242")
+	hostinfo := &HostInfo{vpnIp: netip.MustParseAddr("172.1.1.2"), remote: r1, remotes: NewRemoteList(nil)}
+	// Learned from other owners so moving the tunnel, which learns under our own vpn ip, does not replace them
+	hostinfo.remotes.LearnRemote(netip.MustParseAddr("172.1.1.10"), r1)
+	hostinfo.remotes.LearnRemote(netip.MustParseAddr("172.1.1.11"), r2)
+
+	now := time.Now()
+	addrs := []netip.AddrPort{r1, r2, r3}
+	ids := lp.nextRound(f, hostinfo, addrs, now)
+	round := func(rtts map[netip.AddrPort]time.Duration) {
+		// Some of the probes of the previous round are answered, then the next round evaluates them
+		for i, addr := range addrs {
+			if rtt, ok := rtts[addr]; ok {
+				assert.True(t, lp.handleReply(hostinfo, latencyProbeMagic.payload(ids[i]), now.Add(rtt)))
+			}
+		}
+
+		now = now.Add(lp.timers.Load().interval)
+		ids = lp.nextRound(f, hostinfo, addrs, now)
+	}
+
+	// Replies that are not ours are ignored
+	assert.False(t, lp.handleReply(hostinfo, []byte(""), now))
+	assert.False(t, lp.handleReply(hostinfo, latencyProbeMagic.payload(12345), now))
+
+	// r3 never answers, r2 is the fastest
+	round(map[netip.AddrPort]time.Duration{r1: 30 * time.Millisecond, r2: 10 * time.Millisecond})
+	assert.Equal(t, r2, hostinfo.remote)
+	assert.Equal(t, int64(1), lp.metricRoam.Count())
+
+	assert.Equal(t, []CandidateRTT{
+		{Remote: r2, RTT: 10 * time.Millisecond, Reachable: true, LastProbe: now},
+		{Remote: r1, RTT: 30 * time.Millisecond, Reachable: true, LastProbe: now},
+		{Remote: r3, Reachable: false, LastProbe: now},
+	}, hostinfo.latency.copy())
+
+	// Traffic from the peer's other known address does not roam us back, unknown addresses still do
+	assert.True(t, lp.suppressRoam(hostinfo, r1, nil))
+	assert.False(t, lp.suppressRoam(hostinfo, netip.MustParseAddrPort("10.0.9.1:4242"), nil))
+
+	// Within the hysteresis we stay put
+	round(map[netip.AddrPort]time.Duration{r1: 8 * time.Millisecond, r2: 10 * time.Millisecond})
+	assert.Equal(t, r2, hostinfo.remote)
+
+	// Clearly better, move
+	round(map[netip.AddrPort]time.Duration{r1: 2 * time.Millisecond, r2: 10 * time.Millisecond})
+	assert.Equal(t, r1, hostinfo.remote)
+	assert.Equal(t, int64(2), lp.metricRoam.Count())
+
+	// The current remote stops answering, move to whatever still does
+	round(map[netip.AddrPort]time.Duration{r2: 50 * time.Millisecond})
+	assert.Equal(t, r2, hostinfo.remote)
+
+	// Nothing answers, stay put
+	round(map[netip.AddrPort]time.Duration{})
+	assert.Equal(t, r2, hostinfo.remote)
+	assert.Equal(t, int64(3), lp.metricRoam.Count())
+}
+
+func TestLatencyProbe_timers(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("latency_probe:\n  timeout: 100ms\n  failures: 2\n"))
+	lp := NewLatencyProbeFromConfig(l, c)
+	f := &Interface{l: l}
+
+	r1 := netip.MustParseAddrPort("10.0.0.1:4242")
+	hostinfo := &HostInfo{remote: r1}
+
+	now := time.Now()
+	ids := lp.nextRound(f, hostinfo, []netip.AddrPort{r1}, now)
+	cand := hostinfo.latency.probes.get(r1)
+	probe := func(rtt time.Duration) {
+		if rtt > 0 {
+			assert.True(t, lp.handleReply(hostinfo, latencyProbeMagic.payload(ids[0]), now.Add(rtt)))
+		}
+		now = now.Add(lp.timers.Load().interval)
+		ids = lp.nextRound(f, hostinfo, []netip.AddrPort{r1}, now)
+	}
+
+	probe(50 * time.Millisecond)
+	assert.True(t, cand.up)
+	assert.Equal(t, 50*time.Millisecond, cand.rtt)
+
+	t.Log("A reply slower than the timeout is lost, one lost probe is tolerated")
+	probe(200 * time.Millisecond)
+	assert.True(t, cand.up)
+	assert.Equal(t, 50*time.Millisecond, cand.rtt)
+
+	probe(0)
+	assert.False(t, cand.up, "two probes in a row were lost")
+
+	probe(20 * time.Millisecond)
+	assert.True(t, cand.up)
+
+	t.Log("Invalid timers on reload keep the previous ones")
+	require.NoError(t, c.ReloadConfigString("latency_probe:\n  timeout: 1h\n  failures: 2\n"))
+	assert.Equal(t, 100*time.Millisecond, lp.timers.Load().timeout)
+}
+
+func TestLatencyProbe_suppressRoamExpires(t *testing.T) {
+	var lp *LatencyProbe
+	hostinfo := &HostInfo{remotes: NewRemoteList(nil)}
+	assert.False(t, lp.suppressRoam(hostinfo, netip.MustParseAddrPort("10.0.0.1:4242"), nil))
+
+	lp = &LatencyProbe{}
+	r1 := netip.MustParseAddrPort("10.0.0.1:4242")
+	hostinfo.remotes.LearnRemote(netip.MustParseAddr("172.1.1.2"), r1)
+	assert.False(t, lp.suppressRoam(hostinfo, r1, nil))
+
+	hostinfo.latency.pinnedUntil.Store(time.Now().Add(-time.Second).UnixNano())
+	assert.False(t, lp.suppressRoam(hostinfo, r1, nil))
+
+	hostinfo.latency.pinnedUntil.Store(time.Now().Add(time.Minute).UnixNano())
+	assert.True(t, lp.suppressRoam(hostinfo, r1, nil))
+}
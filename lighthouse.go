@@ -58,6 +58,7 @@ type LightHouse struct {
 	lighthouses atomic.Pointer[map[netip.Addr]struct{}]
 
 	interval     atomic.Int64
+	remoteTTL    atomic.Int64
 	updateCancel context.CancelFunc
 	ifce         EncWriter
 	nebulaPort   uint32 // 32 bits because protobuf does not have a uint16
@@ -67,13 +68,27 @@ type LightHouse struct {
 	// IP's of relays that can be used by peers to access me
 	relaysForMe atomic.Pointer[[]netip.Addr]
 
+	// Seals our reported addresses for peers and opens theirs, nil when lighthouse.address_encryption is disabled
+	addrKey atomic.Pointer[addrCrypt]
+
 	queryChan chan netip.Addr
+	selection *LighthouseSelection
 
 	calculatedRemotes atomic.Pointer[bart.Table[[]*calculatedRemote]] // Maps VpnIp to []*calculatedRemote
 
-	metrics           *MessageMetrics
-	metricHolepunchTx metrics.Counter
-	l                 *logrus.Logger
+	// What the lighthouses see our host updates come from, used to classify our NAT
+	nat natState
+
+	// Coalesces the host updates we send, see lighthouse.update_batch
+	updates updateBatch
+
+	// Peers seeded from a hostmap snapshot, their first handshake does not wait on a lighthouse query
+	snapshotSeeded sync.Map
+
+	metrics              *MessageMetrics
+	metricHolepunchTx    metrics.Counter
+	metricExpiredRemotes metrics.Counter
+	l                    *logrus.Logger
 }
 
 // NewLightHouseFromConfig will build a Lighthouse struct from the values provided in the config object
@@ -103,7 +118,10 @@ func NewLightHouseFromConfig(ctx context.Context, l *logrus.Logger, c *config.C,
 		punchConn:    pc,
 		punchy:       p,
 		queryChan:    make(chan netip.Addr, c.GetUint32("handshakes.query_buffer", 64)),
+		updates:      newUpdateBatch(),
 		l:            l,
+
+		metricExpiredRemotes: metrics.GetOrRegisterCounter("lighthouse.remotes.expired", nil),
 	}
 	lighthouses := make(map[netip.Addr]struct{})
 	h.lighthouses.Store(&lighthouses)
@@ -122,6 +140,11 @@ func NewLightHouseFromConfig(ctx context.Context, l *logrus.Logger, c *config.C,
 		return nil, err
 	}
 
+	h.selection, err = NewLighthouseSelectionFromConfig(l, c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load the lighthouse selection", nil, err)
+	}
+
 	c.RegisterReloadCallback(func(c *config.C) {
 		err := h.reload(c, false)
 		switch v := err.(type) {
@@ -215,6 +238,19 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 		}
 	}
 
+	if initial || c.HasChanged("lighthouse.update_batch") {
+		window := c.GetDuration("lighthouse.update_batch", defaultLighthouseUpdateBatch)
+		if window < 0 {
+			lh.l.WithField("updateBatch", window).Warn("lighthouse.update_batch can not be negative, using the default")
+			window = defaultLighthouseUpdateBatch
+		}
+		lh.updates.window.Store(int64(window))
+
+		if !initial {
+			lh.l.WithField("updateBatch", window).Info("lighthouse.update_batch has changed")
+		}
+	}
+
 	if initial || c.HasChanged("lighthouse.interval") {
 		lh.interval.Store(int64(c.GetInt("lighthouse.interval", 10)))
 
@@ -230,6 +266,18 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 		}
 	}
 
+	if initial || c.HasChanged("lighthouse.remote_ttl") {
+		ttl := c.GetDuration("lighthouse.remote_ttl", 0)
+		if ttl < 0 {
+			return util.NewContextualError("lighthouse.remote_ttl can not be negative", m{"remote_ttl": ttl}, nil)
+		}
+		lh.remoteTTL.Store(int64(ttl))
+
+		if !initial {
+			lh.l.Infof("lighthouse.remote_ttl changed to %v", ttl)
+		}
+	}
+
 	if initial || c.HasChanged("lighthouse.remote_allow_list") || c.HasChanged("lighthouse.remote_allow_ranges") {
 		ral, err := NewRemoteAllowListFromConfig(c, "lighthouse.remote_allow_list", "lighthouse.remote_allow_ranges")
 		if err != nil {
@@ -321,6 +369,31 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 		}
 	}
 
+	if initial || c.HasChanged("lighthouse.address_encryption") {
+		var ac *addrCrypt
+		if c.GetBool("lighthouse.address_encryption.enabled", false) {
+			key := c.GetString("lighthouse.address_encryption.key", "")
+			if key == "" {
+				return util.NewContextualError("lighthouse.address_encryption.enabled is true but no key is set", nil, nil)
+			}
+
+			var err error
+			ac, err = newAddrCrypt([]byte(key))
+			if err != nil {
+				return util.NewContextualError("Invalid lighthouse.address_encryption.key", nil, err)
+			}
+
+			if lh.amLighthouse {
+				lh.l.Warn("lighthouse.address_encryption.key is set on a lighthouse, lighthouses do not need it and should not have it")
+			}
+		}
+
+		lh.addrKey.Store(ac)
+		if !initial {
+			lh.l.WithField("enabled", ac != nil).Info("lighthouse.address_encryption has changed")
+		}
+	}
+
 	if initial || c.HasChanged("relay.relays") {
 		switch c.GetBool("relay.am_relay", false) {
 		case true:
@@ -750,12 +823,7 @@ func (lh *LightHouse) innerQueryServer(ip netip.Addr, nb, out []byte) {
 		return
 	}
 
-	lighthouses := lh.GetLighthouses()
-	lh.metricTx(NebulaMeta_HostQuery, int64(len(lighthouses)))
-
-	for n := range lighthouses {
-		lh.ifce.SendMessageToVpnIp(header.LightHouse, 0, n, query, nb, out)
-	}
+	lh.selection.query(lh, ip, query, nb, out)
 }
 
 func (lh *LightHouse) StartUpdateWorker() {
@@ -784,7 +852,7 @@ func (lh *LightHouse) StartUpdateWorker() {
 	}()
 }
 
-func (lh *LightHouse) SendUpdate() {
+func (lh *LightHouse) sendUpdate() {
 	var v4 []*Ip4AndPort
 	var v6 []*Ip6AndPort
 
@@ -797,11 +865,14 @@ func (lh *LightHouse) SendUpdate() {
 	}
 
 	lal := lh.GetLocalAllowList()
+	var localAddrs []netip.AddrPort
 	for _, e := range localIps(lh.l, lal) {
 		if lh.myVpnNet.Contains(e) {
 			continue
 		}
 
+		localAddrs = append(localAddrs, netip.AddrPortFrom(e, uint16(lh.nebulaPort)))
+
 		// Only add IPs that aren't my VPN/tun IP
 		if e.Is4() {
 			v4 = append(v4, NewIp4AndPortFromNetIP(e, uint16(lh.nebulaPort)))
@@ -810,6 +881,8 @@ func (lh *LightHouse) SendUpdate() {
 		}
 	}
 
+	lh.setLocalAddrs(localAddrs)
+
 	var relays []uint32
 	for _, r := range lh.GetRelaysForMe() {
 		//TODO: IPV6-WORK both relays and vpnip need ipv6 support
@@ -830,6 +903,19 @@ func (lh *LightHouse) SendUpdate() {
 		},
 	}
 
+	// Only peers with the key get to see our addresses, the lighthouses are left with where they saw us from
+	if ac := lh.addrKey.Load(); ac != nil {
+		sealed, err := ac.seal(lh.myVpnNet.Addr(), v4, v6)
+		if err != nil {
+			lh.l.WithError(err).Error("Error while encrypting addresses for lighthouse update")
+			return
+		}
+
+		m.Details.Ip4AndPorts = nil
+		m.Details.Ip6AndPorts = nil
+		m.Details.EncryptedAddrs = sealed
+	}
+
 	lighthouses := lh.GetLighthouses()
 	lh.metricTx(NebulaMeta_HostUpdateNotification, int64(len(lighthouses)))
 	nb := make([]byte, 12, 12)
@@ -889,6 +975,9 @@ func (lhh *LightHouseHandler) resetMeta() *NebulaMeta {
 	details.Ip4AndPorts = details.Ip4AndPorts[:0]
 	details.Ip6AndPorts = details.Ip6AndPorts[:0]
 	details.RelayVpnIp = details.RelayVpnIp[:0]
+	details.ObservedIp4AndPort = nil
+	details.ObservedIp6AndPort = nil
+	details.EncryptedAddrs = details.EncryptedAddrs[:0]
 	lhh.meta.Details = details
 
 	return lhh.meta
@@ -927,14 +1016,14 @@ func (lhh *LightHouseHandler) HandleRequest(rAddr netip.AddrPort, vpnIp netip.Ad
 		lhh.handleHostQueryReply(n, vpnIp)
 
 	case NebulaMeta_HostUpdateNotification:
-		lhh.handleHostUpdateNotification(n, vpnIp, w)
+		lhh.handleHostUpdateNotification(n, vpnIp, rAddr, w)
 
 	case NebulaMeta_HostMovedNotification:
 	case NebulaMeta_HostPunchNotification:
 		lhh.handleHostPunchNotification(n, vpnIp, w)
 
 	case NebulaMeta_HostUpdateNotificationAck:
-		// noop
+		lhh.handleHostUpdateNotificationAck(n, vpnIp)
 	}
 }
 
@@ -1026,6 +1115,9 @@ func (lhh *LightHouseHandler) coalesceAnswers(c *cache, n *NebulaMeta) {
 		}
 	}
 
+	// Peers without the key only get the learned address and relays
+	n.Details.EncryptedAddrs = c.encrypted
+
 	if c.relay != nil {
 		//TODO: IPV6-WORK
 		relays := make([]uint32, len(c.relay.relay))
@@ -1052,6 +1144,8 @@ func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, vpnIp netip.Ad
 	am.Lock()
 	lhh.lh.Unlock()
 
+	lhh.openEncryptedAddrs(n, certVpnIp)
+
 	//TODO: IPV6-WORK
 	am.unlockedSetV4(vpnIp, certVpnIp, n.Details.Ip4AndPorts, lhh.lh.unlockedShouldAddV4)
 	am.unlockedSetV6(vpnIp, certVpnIp, n.Details.Ip6AndPorts, lhh.lh.unlockedShouldAddV6)
@@ -1065,6 +1159,9 @@ func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, vpnIp netip.Ad
 	am.unlockedSetRelay(vpnIp, certVpnIp, relays)
 	am.Unlock()
 
+	// The host was learned, later tiers of lighthouses do not need to be asked
+	lhh.lh.selection.answered(certVpnIp, 0)
+
 	// Non-blocking attempt to trigger, skip if it would block
 	select {
 	case lhh.lh.handshakeTrigger <- certVpnIp:
@@ -1072,7 +1169,7 @@ func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, vpnIp netip.Ad
 	}
 }
 
-func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, vpnIp netip.Addr, w EncWriter) {
+func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, vpnIp netip.Addr, addr netip.AddrPort, w EncWriter) {
 	if !lhh.lh.amLighthouse {
 		if lhh.l.Level >= logrus.DebugLevel {
 			lhh.l.Debugln("I am not a lighthouse, do not take host updates: ", vpnIp)
@@ -1099,6 +1196,13 @@ func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, vpnIp
 
 	am.unlockedSetV4(vpnIp, detailsVpnIp, n.Details.Ip4AndPorts, lhh.lh.unlockedShouldAddV4)
 	am.unlockedSetV6(vpnIp, detailsVpnIp, n.Details.Ip6AndPorts, lhh.lh.unlockedShouldAddV6)
+	if len(n.Details.EncryptedAddrs) > maxEncryptedAddrs {
+		lhh.l.WithField("vpnIp", vpnIp).WithField("size", len(n.Details.EncryptedAddrs)).
+			Debugln("Host sent oversized encrypted addresses, ignoring them")
+		am.unlockedSetEncrypted(vpnIp, nil)
+	} else {
+		am.unlockedSetEncrypted(vpnIp, n.Details.EncryptedAddrs)
+	}
 
 	//TODO: IPV6-WORK
 	relays := make([]netip.Addr, len(n.Details.RelayVpnIp))
@@ -1115,6 +1219,17 @@ func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, vpnIp
 	//TODO: IPV6-WORK
 	vpnIpB := vpnIp.As4()
 	n.Details.VpnIp = binary.BigEndian.Uint32(vpnIpB[:])
+
+	// Tell the host where we saw the update come from so it can work out what kind of NAT it is behind, relayed
+	// updates have no address
+	if addr.IsValid() {
+		if addr.Addr().Unmap().Is4() {
+			n.Details.ObservedIp4AndPort = NewIp4AndPortFromNetIP(addr.Addr().Unmap(), addr.Port())
+		} else {
+			n.Details.ObservedIp6AndPort = NewIp6AndPortFromNetIP(addr.Addr(), addr.Port())
+		}
+	}
+
 	ln, err := n.MarshalTo(lhh.pb)
 
 	if err != nil {
@@ -1126,6 +1241,24 @@ func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, vpnIp
 	w.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, lhh.pb[:ln], lhh.nb, lhh.out[:0])
 }
 
+func (lhh *LightHouseHandler) handleHostUpdateNotificationAck(n *NebulaMeta, vpnIp netip.Addr) {
+	if !lhh.lh.IsLighthouseIP(vpnIp) {
+		return
+	}
+
+	// Older lighthouses do not report what they observed
+	var observed netip.AddrPort
+	if n.Details.ObservedIp4AndPort != nil {
+		observed = AddrPortFromIp4AndPort(n.Details.ObservedIp4AndPort)
+	} else if n.Details.ObservedIp6AndPort != nil {
+		observed = AddrPortFromIp6AndPort(n.Details.ObservedIp6AndPort)
+	} else {
+		return
+	}
+
+	lhh.lh.observeNAT(vpnIp, observed, time.Now())
+}
+
 func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, vpnIp netip.Addr, w EncWriter) {
 	if !lhh.lh.IsLighthouseIP(vpnIp) {
 		return
@@ -1152,6 +1285,11 @@ func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, vpnIp n
 		}
 	}
 
+	//TODO: IPV6-WORK
+	b := [4]byte{}
+	binary.BigEndian.PutUint32(b[:], n.Details.VpnIp)
+	lhh.openEncryptedAddrs(n, netip.AddrFrom4(b))
+
 	for _, a := range n.Details.Ip4AndPorts {
 		punch(AddrPortFromIp4AndPort(a))
 	}
@@ -1164,9 +1302,6 @@ func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, vpnIp n
 	// of a double nat or other difficult scenario, this may help establish
 	// a tunnel.
 	if lhh.lh.punchy.GetRespond() {
-		//TODO: IPV6-WORK
-		b := [4]byte{}
-		binary.BigEndian.PutUint32(b[:], n.Details.VpnIp)
 		queryVpnIp := netip.AddrFrom4(b)
 		go func() {
 			time.Sleep(lhh.lh.punchy.GetRespondDelay())
@@ -1180,3 +1315,27 @@ func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, vpnIp n
 		}()
 	}
 }
+
+// openEncryptedAddrs adds the addresses owner sealed with lighthouse.address_encryption to the reported addresses in n.
+// Blobs we can not open, because we have no key or a different one, are ignored.
+func (lhh *LightHouseHandler) openEncryptedAddrs(n *NebulaMeta, owner netip.Addr) {
+	if len(n.Details.EncryptedAddrs) == 0 {
+		return
+	}
+
+	ac := lhh.lh.addrKey.Load()
+	if ac == nil {
+		return
+	}
+
+	v4, v6, err := ac.open(owner, n.Details.EncryptedAddrs)
+	if err != nil {
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.WithError(err).WithField("vpnIp", owner).Debugln("Failed to open encrypted addresses")
+		}
+		return
+	}
+
+	n.Details.Ip4AndPorts = append(n.Details.Ip4AndPorts, v4...)
+	n.Details.Ip6AndPorts = append(n.Details.Ip6AndPorts, v6...)
+}
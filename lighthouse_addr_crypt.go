@@ -0,0 +1,101 @@
+package nebula
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// addrCryptInfo binds the derived key to this use of the shared secret
+	addrCryptInfo = "nebula lighthouse address encryption"
+	// addrCryptMinSecret is the shortest lighthouse.address_encryption.key we accept
+	addrCryptMinSecret = 16
+	// maxEncryptedAddrs caps the size of a sealed address list, MaxRemotes v4 and v6 addresses fit well within it
+	maxEncryptedAddrs = 1024
+)
+
+var (
+	ErrEncryptedAddrsTooLarge = errors.New("encrypted addresses are too large")
+	ErrEncryptedAddrsShort    = errors.New("encrypted addresses are too short")
+)
+
+// addrCrypt seals the addresses a host reports to the lighthouses so that only other hosts holding the same
+// lighthouse.address_encryption.key can read them. The lighthouse stores and relays the sealed blob as is.
+type addrCrypt struct {
+	aead cipher.AEAD
+}
+
+func newAddrCrypt(secret []byte) (*addrCrypt, error) {
+	if len(secret) < addrCryptMinSecret {
+		return nil, fmt.Errorf("key must be at least %d bytes", addrCryptMinSecret)
+	}
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(addrCryptInfo)), key); err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &addrCrypt{aead: aead}, nil
+}
+
+// seal encrypts the addresses of owner, the vpn ip is bound to the result so a blob can not be replayed for another host
+func (ac *addrCrypt) seal(owner netip.Addr, v4 []*Ip4AndPort, v6 []*Ip6AndPort) ([]byte, error) {
+	d := &NebulaMetaDetails{
+		Ip4AndPorts: v4[:minInt(len(v4), MaxRemotes)],
+		Ip6AndPorts: v6[:minInt(len(v6), MaxRemotes)],
+	}
+
+	pt, err := d.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, ac.aead.NonceSize(), ac.aead.NonceSize()+len(pt)+ac.aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+
+	out = ac.aead.Seal(out, out, pt, owner.AsSlice())
+	if len(out) > maxEncryptedAddrs {
+		return nil, ErrEncryptedAddrsTooLarge
+	}
+
+	return out, nil
+}
+
+// open decrypts a blob sealed by owner and returns the addresses within
+func (ac *addrCrypt) open(owner netip.Addr, blob []byte) ([]*Ip4AndPort, []*Ip6AndPort, error) {
+	if len(blob) > maxEncryptedAddrs {
+		return nil, nil, ErrEncryptedAddrsTooLarge
+	}
+
+	ns := ac.aead.NonceSize()
+	if len(blob) < ns+ac.aead.Overhead() {
+		return nil, nil, ErrEncryptedAddrsShort
+	}
+
+	pt, err := ac.aead.Open(nil, blob[:ns], blob[ns:], owner.AsSlice())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d := &NebulaMetaDetails{}
+	if err := d.Unmarshal(pt); err != nil {
+		return nil, nil, err
+	}
+
+	return d.Ip4AndPorts, d.Ip6AndPorts, nil
+}
@@ -0,0 +1,170 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddrCrypt(t *testing.T) {
+	owner := netip.MustParseAddr("10.128.0.2")
+	v4 := []*Ip4AndPort{NewIp4AndPortFromNetIP(netip.MustParseAddr("1.2.3.4"), 4242)}
+	v6 := []*Ip6AndPort{NewIp6AndPortFromNetIP(netip.MustParseAddr("fd00::1"), 4243)}
+
+	_, err := newAddrCrypt([]byte("too short"))
+	assert.Error(t, err)
+
+	ac, err := newAddrCrypt([]byte("a shared secret for the tests"))
+	require.NoError(t, err)
+
+	blob, err := ac.seal(owner, v4, v6)
+	require.NoError(t, err)
+
+	gv4, gv6, err := ac.open(owner, blob)
+	require.NoError(t, err)
+	assertIp4InArray(t, gv4, netip.MustParseAddrPort("1.2.3.4:4242"))
+	require.Len(t, gv6, 1)
+	assert.Equal(t, netip.MustParseAddrPort("[fd00::1]:4243"), AddrPortFromIp6AndPort(gv6[0]))
+
+	// Every seal uses a fresh nonce
+	blob2, err := ac.seal(owner, v4, v6)
+	require.NoError(t, err)
+	assert.NotEqual(t, blob, blob2)
+
+	// A blob can not be replayed as another host
+	_, _, err = ac.open(netip.MustParseAddr("10.128.0.3"), blob)
+	assert.Error(t, err)
+
+	// Tampering is caught
+	tampered := append([]byte{}, blob...)
+	tampered[len(tampered)-1] ^= 1
+	_, _, err = ac.open(owner, tampered)
+	assert.Error(t, err)
+
+	_, _, err = ac.open(owner, blob[:10])
+	assert.ErrorIs(t, err, ErrEncryptedAddrsShort)
+
+	_, _, err = ac.open(owner, make([]byte, maxEncryptedAddrs+1))
+	assert.ErrorIs(t, err, ErrEncryptedAddrsTooLarge)
+
+	// A different key can not open it
+	other, err := newAddrCrypt([]byte("a different secret for the tests"))
+	require.NoError(t, err)
+	_, _, err = other.open(owner, blob)
+	assert.Error(t, err)
+
+	// The list is capped at MaxRemotes like plaintext updates are
+	many := make([]*Ip4AndPort, MaxRemotes+5)
+	for i := range many {
+		many[i] = NewIp4AndPortFromNetIP(netip.MustParseAddr("1.2.3.4"), uint16(4242+i))
+	}
+	blob, err = ac.seal(owner, many, nil)
+	require.NoError(t, err)
+	gv4, _, err = ac.open(owner, blob)
+	require.NoError(t, err)
+	assert.Len(t, gv4, MaxRemotes)
+}
+
+func TestLighthouse_EncryptedAddrs(t *testing.T) {
+	l := test.NewLogger()
+	lhVpnIp := netip.MustParseAddr("10.128.0.1")
+	myVpnIp := netip.MustParseAddr("10.128.0.2")
+	myUdpAddr := netip.MustParseAddrPort("10.0.0.2:4242")
+	myAdvertised := netip.MustParseAddrPort("1.2.3.4:4242")
+	theirVpnIp := netip.MustParseAddr("10.128.0.3")
+	theirUdpAddr := netip.MustParseAddrPort("10.0.0.3:4242")
+
+	lc := config.NewC(l)
+	require.NoError(t, lc.LoadString("lighthouse:\n  am_lighthouse: true\nlisten:\n  port: 4242\n"))
+	lh, err := NewLightHouseFromConfig(context.Background(), l, lc, netip.MustParsePrefix("10.128.0.1/24"), nil, nil)
+	require.NoError(t, err)
+	lhh := lh.NewRequestHandler()
+
+	newHost := func(vpnIp netip.Addr, key string) *LightHouse {
+		c := config.NewC(l)
+		require.NoError(t, c.LoadString(`
+listen:
+  port: 4242
+static_host_map:
+  10.128.0.1: ["10.0.0.1:4242"]
+lighthouse:
+  hosts: ["10.128.0.1"]
+  advertise_addrs: ["`+myAdvertised.String()+`"]
+  local_allow_list:
+    0.0.0.0/0: false
+    ::/0: false
+  address_encryption:
+    enabled: true
+    key: "`+key+`"
+`))
+		h, err := NewLightHouseFromConfig(context.Background(), l, c, netip.PrefixFrom(vpnIp, 24), nil, nil)
+		require.NoError(t, err)
+		return h
+	}
+
+	// Our update only carries the sealed addresses
+	me := newHost(myVpnIp, "a shared secret for the tests")
+	w := &testEncWriter{}
+	me.ifce = w
+	me.SendUpdate()
+	update := w.lastReply.msg
+	require.NotNil(t, update)
+	assert.Equal(t, lhVpnIp, w.lastReply.vpnIp)
+	assert.Empty(t, update.Details.Ip4AndPorts)
+	assert.Empty(t, update.Details.Ip6AndPorts)
+	assert.NotEmpty(t, update.Details.EncryptedAddrs)
+
+	b, err := update.Marshal()
+	require.NoError(t, err)
+	lhh.HandleRequest(myUdpAddr, myVpnIp, b, &testEncWriter{})
+
+	// The lighthouse has no reported addresses for us and hands the blob out untouched
+	r := newLHHostRequest(theirUdpAddr, theirVpnIp, myVpnIp, lhh)
+	assert.Empty(t, r.msg.Details.Ip4AndPorts)
+	assert.Equal(t, update.Details.EncryptedAddrs, r.msg.Details.EncryptedAddrs)
+
+	// A peer with the key learns the sealed addresses
+	them := newHost(theirVpnIp, "a shared secret for the tests")
+	b, err = r.msg.Marshal()
+	require.NoError(t, err)
+	them.NewRequestHandler().HandleRequest(netip.MustParseAddrPort("10.0.0.1:4242"), lhVpnIp, b, &testEncWriter{})
+	assert.Equal(t, []netip.AddrPort{myAdvertised}, them.QueryCache(myVpnIp).CopyAddrs(nil))
+
+	// A peer with another key gets nothing out of it
+	other := newHost(theirVpnIp, "a different secret for the tests")
+	other.NewRequestHandler().HandleRequest(netip.MustParseAddrPort("10.0.0.1:4242"), lhVpnIp, b, &testEncWriter{})
+	assert.Empty(t, other.QueryCache(myVpnIp).CopyAddrs(nil))
+
+	// Dropping encryption clears the blob on the lighthouse
+	newLHHostUpdate(myUdpAddr, myVpnIp, []netip.AddrPort{myAdvertised}, lhh)
+	r = newLHHostRequest(theirUdpAddr, theirVpnIp, myVpnIp, lhh)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, myAdvertised)
+	assert.Empty(t, r.msg.Details.EncryptedAddrs)
+}
+
+func TestLighthouse_EncryptedAddrsConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("lighthouse:\n  address_encryption:\n    enabled: true\n"))
+	_, err := NewLightHouseFromConfig(context.Background(), l, c, netip.MustParsePrefix("10.128.0.1/24"), nil, nil)
+	assert.Error(t, err)
+
+	c = config.NewC(l)
+	require.NoError(t, c.LoadString("lighthouse:\n  address_encryption:\n    enabled: false\n"))
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, netip.MustParsePrefix("10.128.0.1/24"), nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, lh.addrKey.Load())
+
+	require.NoError(t, c.ReloadConfigString("lighthouse:\n  address_encryption:\n    enabled: true\n    key: a shared secret for the tests\n"))
+	assert.NotNil(t, lh.addrKey.Load())
+
+	// A bad key on reload keeps the old one
+	ac := lh.addrKey.Load()
+	require.NoError(t, c.ReloadConfigString("lighthouse:\n  address_encryption:\n    enabled: true\n    key: short\n"))
+	assert.Equal(t, ac, lh.addrKey.Load())
+}
@@ -0,0 +1,252 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+const (
+	defaultLighthouseQueryFallback = 500 * time.Millisecond
+	// lighthouseRTTSlack puts auto weighted lighthouses whose round trip times are this close in the same tier
+	lighthouseRTTSlack = 5 * time.Millisecond
+)
+
+// LighthouseSelection decides which lighthouses a host query goes to. By default every lighthouse is queried at once.
+// With lighthouse.weights or lighthouse.auto_weight the lighthouses are split in tiers, a query is sent to the first
+// tier and moves on to the next one when the host was not learned within lighthouse.query_fallback.
+//
+// Tiers are ordered by weight, highest first, then by round trip time when auto weighting. The reachability and round
+// trip times come from the lighthouse probes of the HealthCheck, a lighthouse that left health.failures probes
+// unanswered is moved to the last tier.
+type LighthouseSelection struct {
+	weights    atomic.Pointer[map[netip.Addr]int]
+	autoWeight atomic.Bool
+	fallback   atomic.Int64
+
+	// health probes the lighthouses, without it every lighthouse is reachable and unmeasured
+	health *HealthCheck
+
+	sync.Mutex
+	// pending holds the generation of the fallback chain in progress for a queried vpn ip
+	pending map[netip.Addr]uint64
+	gen     uint64
+
+	metricFallback metrics.Counter
+	l              *logrus.Logger
+}
+
+// LighthouseStatus is a lighthouse in the order host queries are sent
+type LighthouseStatus struct {
+	VpnIp  netip.Addr `json:"vpnIp"`
+	Weight int        `json:"weight"`
+	// RTT is 0 until the lighthouse answered a probe
+	RTT       time.Duration `json:"rtt"`
+	Reachable bool          `json:"reachable"`
+	// Tier is the round of a query the lighthouse is asked in, starting at 0
+	Tier int `json:"tier"`
+}
+
+func NewLighthouseSelectionFromConfig(l *logrus.Logger, c *config.C) (*LighthouseSelection, error) {
+	ls := &LighthouseSelection{
+		pending:        map[netip.Addr]uint64{},
+		metricFallback: metrics.GetOrRegisterCounter("lighthouse.query.fallback", nil),
+		l:              l,
+	}
+
+	err := ls.reload(c, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		err := ls.reload(c, false)
+		if err != nil {
+			l.WithError(err).Error("Failed to reload the lighthouse selection")
+		}
+	})
+
+	return ls, nil
+}
+
+func (ls *LighthouseSelection) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("lighthouse.weights") && !c.HasChanged("lighthouse.auto_weight") &&
+		!c.HasChanged("lighthouse.query_fallback") {
+		return nil
+	}
+
+	weights := map[netip.Addr]int{}
+	rawWeights := c.GetMap("lighthouse.weights", map[interface{}]interface{}{})
+	for k, v := range rawWeights {
+		vpnIp, err := netip.ParseAddr(fmt.Sprintf("%v", k))
+		if err != nil {
+			return fmt.Errorf("lighthouse.weights has an invalid vpn ip %v: %w", k, err)
+		}
+		weight, err := strconv.Atoi(fmt.Sprintf("%v", v))
+		if err != nil || weight < 1 {
+			return fmt.Errorf("lighthouse.weights for %v must be a number of at least 1, got %v", vpnIp, v)
+		}
+		weights[vpnIp] = weight
+	}
+
+	fallback := c.GetDuration("lighthouse.query_fallback", defaultLighthouseQueryFallback)
+	if fallback <= 0 {
+		return fmt.Errorf("lighthouse.query_fallback must be positive")
+	}
+
+	ls.weights.Store(&weights)
+	ls.autoWeight.Store(c.GetBool("lighthouse.auto_weight", false))
+	ls.fallback.Store(int64(fallback))
+
+	if !initial {
+		ls.l.WithField("weights", weights).WithField("autoWeight", ls.autoWeight.Load()).Info("Lighthouse selection changed")
+	}
+	return nil
+}
+
+// enabled is false when every lighthouse is queried at once, the default
+func (ls *LighthouseSelection) enabled() bool {
+	return ls != nil && (len(*ls.weights.Load()) > 0 || ls.autoWeight.Load())
+}
+
+func (ls *LighthouseSelection) weight(vpnIp netip.Addr) int {
+	if w, ok := (*ls.weights.Load())[vpnIp]; ok {
+		return w
+	}
+	return 1
+}
+
+// order returns lighthouses in the order they are queried, with their tier
+func (ls *LighthouseSelection) order(lighthouses map[netip.Addr]struct{}, now time.Time) []LighthouseStatus {
+	statuses := make([]LighthouseStatus, 0, len(lighthouses))
+	if ls == nil {
+		for vpnIp := range lighthouses {
+			statuses = append(statuses, LighthouseStatus{VpnIp: vpnIp, Weight: 1, Reachable: true})
+		}
+		sort.Slice(statuses, func(i, j int) bool { return statuses[i].VpnIp.Less(statuses[j].VpnIp) })
+		return statuses
+	}
+
+	for vpnIp := range lighthouses {
+		// A lighthouse that was never probed is assumed to be up
+		s := LighthouseStatus{VpnIp: vpnIp, Weight: ls.weight(vpnIp), Reachable: true}
+		if ls.health != nil {
+			if p, timers, ok := ls.health.lighthouse(vpnIp); ok {
+				s.RTT = p.srtt
+				s.Reachable = p.heardWithin(now, timers) || (p.lastReply.IsZero() && now.Sub(p.firstSent) <= timers.downAfter())
+			}
+		}
+		statuses = append(statuses, s)
+	}
+
+	auto := ls.autoWeight.Load()
+	sort.Slice(statuses, func(i, j int) bool {
+		a, b := statuses[i], statuses[j]
+		if a.Reachable != b.Reachable {
+			return a.Reachable
+		}
+		if a.Weight != b.Weight {
+			return a.Weight > b.Weight
+		}
+		if auto && a.RTT != b.RTT {
+			// Lighthouses without a measurement go after the measured ones
+			return b.RTT == 0 || (a.RTT != 0 && a.RTT < b.RTT)
+		}
+		return a.VpnIp.Less(b.VpnIp)
+	})
+
+	if !ls.enabled() {
+		return statuses
+	}
+
+	// A tier starts with the best lighthouse not in an earlier tier and takes every lighthouse that is as good
+	tier := 0
+	var first LighthouseStatus
+	for i, s := range statuses {
+		if i == 0 {
+			first = s
+		} else if s.Reachable != first.Reachable || s.Weight != first.Weight ||
+			(auto && ((s.RTT == 0) != (first.RTT == 0) || s.RTT > first.RTT+lighthouseRTTSlack)) {
+			tier++
+			first = s
+		}
+		statuses[i].Tier = tier
+	}
+	return statuses
+}
+
+// query sends a host query for vpnIp, to every lighthouse by default or to the first tier with a fallback to the next
+func (ls *LighthouseSelection) query(lh *LightHouse, vpnIp netip.Addr, query, nb, out []byte) {
+	lighthouses := lh.GetLighthouses()
+	if !ls.enabled() {
+		lh.metricTx(NebulaMeta_HostQuery, int64(len(lighthouses)))
+		for n := range lighthouses {
+			lh.ifce.SendMessageToVpnIp(header.LightHouse, 0, n, query, nb, out)
+		}
+		return
+	}
+
+	// Handshake retries query again and again, let a fallback in progress run its course instead of starting over
+	ls.Lock()
+	if _, ok := ls.pending[vpnIp]; ok {
+		ls.Unlock()
+		return
+	}
+	ls.gen++
+	gen := ls.gen
+	ls.pending[vpnIp] = gen
+	ls.Unlock()
+
+	ls.queryTier(lh, vpnIp, gen, 0, query, nb, out)
+}
+
+func (ls *LighthouseSelection) queryTier(lh *LightHouse, vpnIp netip.Addr, gen uint64, tier int, query, nb, out []byte) {
+	sent := 0
+	for _, s := range ls.order(lh.GetLighthouses(), time.Now()) {
+		if s.Tier == tier {
+			lh.ifce.SendMessageToVpnIp(header.LightHouse, 0, s.VpnIp, query, nb, out)
+			sent++
+		}
+	}
+
+	if sent == 0 {
+		// Every tier has been asked
+		ls.answered(vpnIp, gen)
+		return
+	}
+	lh.metricTx(NebulaMeta_HostQuery, int64(sent))
+
+	time.AfterFunc(time.Duration(ls.fallback.Load()), func() {
+		ls.Lock()
+		waiting := ls.pending[vpnIp] == gen
+		ls.Unlock()
+		if !waiting || lh.ctx.Err() != nil {
+			return
+		}
+
+		ls.metricFallback.Inc(1)
+		ls.queryTier(lh, vpnIp, gen, tier+1, query, make([]byte, 12, 12), make([]byte, mtu))
+	})
+}
+
+// answered ends the fallback chain for vpnIp, gen 0 ends any chain
+func (ls *LighthouseSelection) answered(vpnIp netip.Addr, gen uint64) {
+	if ls == nil {
+		return
+	}
+
+	ls.Lock()
+	if g, ok := ls.pending[vpnIp]; ok && (gen == 0 || g == gen) {
+		delete(ls.pending, vpnIp)
+	}
+	ls.Unlock()
+}
@@ -0,0 +1,195 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// queryRecorder records the vpn ips lighthouse messages are sent to
+type queryRecorder struct {
+	mockEncWriter
+	sync.Mutex
+	sent []netip.Addr
+}
+
+func (qr *queryRecorder) SendMessageToVpnIp(t header.MessageType, st header.MessageSubType, vpnIp netip.Addr, p, nb, out []byte) {
+	qr.Lock()
+	qr.sent = append(qr.sent, vpnIp)
+	qr.Unlock()
+}
+
+func (qr *queryRecorder) take() []netip.Addr {
+	qr.Lock()
+	defer qr.Unlock()
+	sent := qr.sent
+	qr.sent = nil
+	return sent
+}
+
+func newTestSelectionLighthouse(t *testing.T, selection map[interface{}]interface{}) (*LightHouse, *queryRecorder, *config.C) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	lhc := map[interface{}]interface{}{"hosts": []interface{}{"10.128.0.2", "10.128.0.3", "10.128.0.4"}}
+	for k, v := range selection {
+		lhc[k] = v
+	}
+	c.Settings["lighthouse"] = lhc
+	c.Settings["static_host_map"] = map[interface{}]interface{}{
+		"10.128.0.2": []interface{}{"1.1.1.2:4242"},
+		"10.128.0.3": []interface{}{"1.1.1.3:4242"},
+		"10.128.0.4": []interface{}{"1.1.1.4:4242"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	lh, err := NewLightHouseFromConfig(ctx, l, c, netip.MustParsePrefix("10.128.0.1/16"), nil, nil)
+	require.NoError(t, err)
+	qr := &queryRecorder{}
+	lh.ifce = qr
+	return lh, qr, c
+}
+
+// newTestSelectionHealth returns the health check that probes the lighthouses for ls
+func newTestSelectionHealth(t *testing.T, ls *LighthouseSelection) *HealthCheck {
+	l := test.NewLogger()
+	hc, err := NewHealthCheckFromConfig(l, config.NewC(l))
+	require.NoError(t, err)
+	ls.health = hc
+	return hc
+}
+
+func TestLighthouseSelection_order(t *testing.T) {
+	lh2, lh3, lh4 := netip.MustParseAddr("10.128.0.2"), netip.MustParseAddr("10.128.0.3"), netip.MustParseAddr("10.128.0.4")
+	now := time.Now()
+
+	lh, _, _ := newTestSelectionLighthouse(t, nil)
+	ls := lh.selection
+	assert.False(t, ls.enabled())
+	for _, s := range ls.order(lh.GetLighthouses(), now) {
+		assert.Equal(t, 0, s.Tier, "every lighthouse is queried at once by default")
+	}
+
+	lh, _, _ = newTestSelectionLighthouse(t, map[interface{}]interface{}{
+		"weights": map[interface{}]interface{}{"10.128.0.3": 10, "10.128.0.4": 10},
+	})
+	ls = lh.selection
+	order := ls.order(lh.GetLighthouses(), now)
+	assert.Equal(t, []LighthouseStatus{
+		{VpnIp: lh3, Weight: 10, Reachable: true, Tier: 0},
+		{VpnIp: lh4, Weight: 10, Reachable: true, Tier: 0},
+		{VpnIp: lh2, Weight: 1, Reachable: true, Tier: 1},
+	}, order)
+
+	// lh3 stops answering the health probes and goes last
+	hc := newTestSelectionHealth(t, ls)
+	for _, vpnIp := range []netip.Addr{lh2, lh3, lh4} {
+		hc.newProbe(vpnIp, now)
+	}
+	later := now.Add(hc.timers.Load().downAfter() + time.Second)
+	hc.handleReply(&HostInfo{vpnIp: lh2}, hc.newProbe(lh2, later), later)
+	hc.handleReply(&HostInfo{vpnIp: lh4}, hc.newProbe(lh4, later), later)
+	order = ls.order(lh.GetLighthouses(), later)
+	assert.Equal(t, []netip.Addr{lh4, lh2, lh3}, []netip.Addr{order[0].VpnIp, order[1].VpnIp, order[2].VpnIp})
+	assert.Equal(t, []int{0, 1, 2}, []int{order[0].Tier, order[1].Tier, order[2].Tier})
+	assert.False(t, order[2].Reachable)
+
+	// Auto weighting orders by rtt, lighthouses within the slack of each other share a tier
+	lh, _, _ = newTestSelectionLighthouse(t, map[interface{}]interface{}{"auto_weight": true})
+	ls = lh.selection
+	hc = newTestSelectionHealth(t, ls)
+	reply := func(vpnIp netip.Addr, rtt time.Duration) {
+		p := hc.newProbe(vpnIp, now)
+		require.True(t, hc.handleReply(&HostInfo{vpnIp: vpnIp}, p, now.Add(rtt)))
+	}
+	reply(lh2, 80*time.Millisecond)
+	reply(lh3, 20*time.Millisecond)
+	reply(lh4, 22*time.Millisecond)
+	order = ls.order(lh.GetLighthouses(), now)
+	assert.Equal(t, []netip.Addr{lh3, lh4, lh2}, []netip.Addr{order[0].VpnIp, order[1].VpnIp, order[2].VpnIp})
+	assert.Equal(t, []int{0, 0, 1}, []int{order[0].Tier, order[1].Tier, order[2].Tier})
+	assert.Equal(t, 20*time.Millisecond, order[0].RTT)
+
+	// The rtt is smoothed, a single slow reply only moves it part of the way
+	reply(lh3, 100*time.Millisecond)
+	order = ls.order(lh.GetLighthouses(), now)
+	assert.Equal(t, []netip.Addr{lh4, lh3, lh2}, []netip.Addr{order[0].VpnIp, order[1].VpnIp, order[2].VpnIp})
+	assert.Equal(t, 30*time.Millisecond, order[1].RTT)
+	assert.Equal(t, []int{0, 1, 2}, []int{order[0].Tier, order[1].Tier, order[2].Tier})
+}
+
+func TestLighthouseSelection_query(t *testing.T) {
+	lh2, lh3, lh4 := netip.MustParseAddr("10.128.0.2"), netip.MustParseAddr("10.128.0.3"), netip.MustParseAddr("10.128.0.4")
+	peer := netip.MustParseAddr("10.128.0.100")
+	nb, out := make([]byte, 12, 12), make([]byte, mtu)
+
+	lh, qr, _ := newTestSelectionLighthouse(t, nil)
+	lh.innerQueryServer(peer, nb, out)
+	assert.ElementsMatch(t, []netip.Addr{lh2, lh3, lh4}, qr.take())
+
+	lh, qr, c := newTestSelectionLighthouse(t, map[interface{}]interface{}{
+		"weights":        map[interface{}]interface{}{"10.128.0.3": 10, "10.128.0.4": 5},
+		"query_fallback": "20ms",
+	})
+
+	t.Log("Only the heaviest lighthouse is asked first, the others in turn while the host is not learned")
+	lh.innerQueryServer(peer, nb, out)
+	assert.Equal(t, []netip.Addr{lh3}, qr.take())
+	lh.innerQueryServer(peer, nb, out)
+	assert.Empty(t, qr.take(), "a query in progress is not restarted")
+	assert.Eventually(t, func() bool {
+		qr.Lock()
+		defer qr.Unlock()
+		return len(qr.sent) == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []netip.Addr{lh4, lh2}, qr.take())
+
+	t.Log("Once every tier was asked a new query starts over")
+	assert.Eventually(t, func() bool {
+		lh.selection.Lock()
+		defer lh.selection.Unlock()
+		return len(lh.selection.pending) == 0
+	}, time.Second, time.Millisecond)
+	lh.innerQueryServer(peer, nb, out)
+	assert.Equal(t, []netip.Addr{lh3}, qr.take())
+
+	t.Log("An answer ends the fallback")
+	lh.selection.answered(peer, 0)
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, qr.take())
+
+	t.Log("Removing the weights goes back to asking everyone")
+	require.NoError(t, c.ReloadConfigString(`
+lighthouse:
+  hosts: ["10.128.0.2", "10.128.0.3", "10.128.0.4"]
+static_host_map:
+  "10.128.0.2": ["1.1.1.2:4242"]
+  "10.128.0.3": ["1.1.1.3:4242"]
+  "10.128.0.4": ["1.1.1.4:4242"]
+`))
+	assert.False(t, lh.selection.enabled())
+	lh.innerQueryServer(peer, nb, out)
+	assert.ElementsMatch(t, []netip.Addr{lh2, lh3, lh4}, qr.take())
+}
+
+func TestLighthouseSelection_reload(t *testing.T) {
+	l := test.NewLogger()
+	for _, bad := range []string{
+		"lighthouse: {weights: {nope: 1}}",
+		"lighthouse: {weights: {10.128.0.2: 0}}",
+		"lighthouse: {query_fallback: 0s}",
+	} {
+		c := config.NewC(l)
+		require.NoError(t, c.LoadString(bad))
+		_, err := NewLighthouseSelectionFromConfig(l, c)
+		assert.Error(t, err, bad)
+	}
+}
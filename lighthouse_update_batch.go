@@ -0,0 +1,97 @@
+package nebula
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+const defaultLighthouseUpdateBatch = time.Second
+
+// updateBatch coalesces the host updates we send to the lighthouses. A rebind storm, for example a mobile client that is
+// told about every network change, would otherwise send a full update per event. The first update after a quiet window
+// is sent right away so a genuinely new address is never held back, updates requested within lighthouse.update_batch of
+// the last one are folded into a single update sent when the window is over. The addresses are read when the update is
+// sent, the coalesced update always carries the latest ones.
+type updateBatch struct {
+	window atomic.Int64
+
+	sync.Mutex
+	lastSent time.Time
+	// pending is set while an update is scheduled for the end of the window
+	pending *time.Timer
+
+	metricSent      metrics.Counter
+	metricCoalesced metrics.Counter
+}
+
+func newUpdateBatch() updateBatch {
+	return updateBatch{
+		metricSent:      metrics.GetOrRegisterCounter("lighthouse.updates.sent", nil),
+		metricCoalesced: metrics.GetOrRegisterCounter("lighthouse.updates.coalesced", nil),
+	}
+}
+
+// admit returns true if an update requested at now should be sent right away. Otherwise it is coalesced, flush is
+// called once at the end of the window to send it.
+func (b *updateBatch) admit(now time.Time, flush func()) bool {
+	window := time.Duration(b.window.Load())
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.pending != nil {
+		b.metricCoalesced.Inc(1)
+		return false
+	}
+
+	wait := window - now.Sub(b.lastSent)
+	if window <= 0 || b.lastSent.IsZero() || wait <= 0 {
+		b.lastSent = now
+		b.metricSent.Inc(1)
+		return true
+	}
+
+	b.pending = time.AfterFunc(wait, flush)
+	return false
+}
+
+// flushed records the coalesced update as sent at now
+func (b *updateBatch) flushed(now time.Time) {
+	b.Lock()
+	b.pending = nil
+	b.lastSent = now
+	b.Unlock()
+	b.metricSent.Inc(1)
+}
+
+// stop drops a scheduled update
+func (b *updateBatch) stop() {
+	b.Lock()
+	if b.pending != nil {
+		b.pending.Stop()
+		b.pending = nil
+	}
+	b.Unlock()
+}
+
+// SendUpdate sends our addresses to the lighthouses, coalescing it with other updates requested within
+// lighthouse.update_batch
+func (lh *LightHouse) SendUpdate() {
+	if lh.updates.admit(time.Now(), lh.flushUpdate) {
+		lh.sendUpdate()
+	}
+}
+
+// flushUpdate sends an update that was coalesced
+func (lh *LightHouse) flushUpdate() {
+	if lh.ctx.Err() != nil {
+		lh.updates.stop()
+		return
+	}
+
+	lh.updates.flushed(time.Now())
+	lh.sendUpdate()
+}
@@ -0,0 +1,77 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateBatch(t *testing.T) {
+	// Other lighthouses in the tests share the registered counters
+	b := updateBatch{metricSent: metrics.NewCounter(), metricCoalesced: metrics.NewCounter()}
+	b.window.Store(int64(50 * time.Millisecond))
+
+	flushes := make(chan time.Time, 4)
+	flush := func() {
+		now := time.Now()
+		b.flushed(now)
+		flushes <- now
+	}
+
+	t.Log("The first update is sent right away")
+	now := time.Now()
+	assert.True(t, b.admit(now, flush))
+
+	t.Log("Updates within the window are sent once at the end of it")
+	assert.False(t, b.admit(now.Add(time.Millisecond), flush))
+	assert.False(t, b.admit(now.Add(2*time.Millisecond), flush))
+	assert.False(t, b.admit(now.Add(3*time.Millisecond), flush))
+	select {
+	case at := <-flushes:
+		assert.GreaterOrEqual(t, at.Sub(now), 45*time.Millisecond, "not before the window is over")
+	case <-time.After(time.Second):
+		t.Fatal("the coalesced update was never sent")
+	}
+	assert.Equal(t, int64(2), b.metricSent.Count())
+	assert.Equal(t, int64(2), b.metricCoalesced.Count())
+
+	t.Log("A quiet window later the next update is sent right away again")
+	assert.True(t, b.admit(time.Now().Add(time.Second), flush))
+	assert.Equal(t, int64(3), b.metricSent.Count())
+
+	t.Log("stop drops a scheduled update")
+	assert.False(t, b.admit(time.Now().Add(time.Second), flush))
+	b.stop()
+	select {
+	case <-flushes:
+		t.Fatal("a stopped update was sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	t.Log("A window of 0 sends every update")
+	b.window.Store(0)
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.admit(time.Now(), flush))
+	}
+}
+
+func TestLighthouse_reloadUpdateBatch(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, netip.MustParsePrefix("10.128.0.1/24"), nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(defaultLighthouseUpdateBatch), lh.updates.window.Load())
+
+	require.NoError(t, c.ReloadConfigString("lighthouse:\n  update_batch: 0s\n"))
+	assert.Equal(t, int64(0), lh.updates.window.Load())
+
+	require.NoError(t, c.ReloadConfigString("lighthouse:\n  update_batch: -1s\n"))
+	assert.Equal(t, int64(defaultLighthouseUpdateBatch), lh.updates.window.Load())
+}
@@ -0,0 +1,193 @@
+package nebula
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// The modes of logging.redact_inner
+const (
+	redactInnerOff  = "off"
+	redactInnerMask = "mask"
+	redactInnerHash = "hash"
+)
+
+// innerPacket marks the raw bytes of an inner packet in a log field so they are redacted with logging.redact_inner
+type innerPacket []byte
+
+// innerAddr marks an address from an inner packet in a log field so it is redacted with logging.redact_inner
+type innerAddr netip.Addr
+
+func (a innerAddr) String() string {
+	return netip.Addr(a).String()
+}
+
+func (a innerAddr) MarshalText() ([]byte, error) {
+	return netip.Addr(a).MarshalText()
+}
+
+// redactedPacket is logged in place of a firewall.Packet, it has the same fields
+type redactedPacket struct {
+	LocalIP    string
+	RemoteIP   string
+	LocalPort  string
+	RemotePort string
+	Protocol   string
+	Fragment   bool
+}
+
+// LogRedaction is a logrus hook that redacts the addresses and ports of inner packets, the traffic inside the tunnels,
+// from every log line so privacy sensitive deployments can log at a higher level. It rewrites any firewall.Packet,
+// innerPacket or innerAddr field just before the line is formatted, log sites only have to log inner packet data as one
+// of those. In mask mode an address keeps its low bits, the last octet of ipv4 and the last 16 bits of ipv6, and a port
+// is only kept below 1024 where it names a service rather than a connection. In hash mode an address or port is replaced
+// with a keyed hash, the key is random for every run so a host can be followed across the lines of a run but not
+// between runs or deployments. Raw inner packet bytes are replaced with their length in either mode.
+type LogRedaction struct {
+	mode atomic.Pointer[string]
+	key  []byte
+	l    *logrus.Logger
+}
+
+func NewLogRedactionFromConfig(l *logrus.Logger, c *config.C) (*LogRedaction, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate the logging.redact_inner key: %w", err)
+	}
+
+	r := &LogRedaction{key: key, l: l}
+	if err := r.reload(c, true); err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := r.reload(c, false); err != nil {
+			l.WithError(err).Error("Failed to reload logging.redact_inner, keeping the previous mode")
+		}
+	})
+
+	l.AddHook(r)
+	return r, nil
+}
+
+func (r *LogRedaction) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("logging.redact_inner") {
+		return nil
+	}
+
+	mode := strings.ToLower(c.GetString("logging.redact_inner", redactInnerOff))
+	if mode == "false" {
+		// yaml reads an unquoted off as false
+		mode = redactInnerOff
+	}
+
+	switch mode {
+	case redactInnerOff, redactInnerMask, redactInnerHash:
+	default:
+		return fmt.Errorf("unknown logging.redact_inner mode `%s`. possible modes: %s", mode,
+			[]string{redactInnerOff, redactInnerMask, redactInnerHash})
+	}
+
+	r.mode.Store(&mode)
+	if !initial || mode != redactInnerOff {
+		r.l.WithField("mode", mode).Info("Inner packet log redaction configured")
+	}
+	return nil
+}
+
+func (r *LogRedaction) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire redacts the inner packet data of a log line, e is a copy that only this line is formatted from
+func (r *LogRedaction) Fire(e *logrus.Entry) error {
+	mode := r.mode.Load()
+	if mode == nil || *mode == redactInnerOff {
+		return nil
+	}
+
+	for k, v := range e.Data {
+		switch v := v.(type) {
+		case firewall.Packet:
+			e.Data[k] = r.packet(*mode, v)
+		case *firewall.Packet:
+			if v != nil {
+				e.Data[k] = r.packet(*mode, *v)
+			}
+		case innerPacket:
+			e.Data[k] = fmt.Sprintf("redacted %d bytes", len(v))
+		case innerAddr:
+			e.Data[k] = r.addr(*mode, netip.Addr(v))
+		}
+	}
+	return nil
+}
+
+func (r *LogRedaction) packet(mode string, fp firewall.Packet) redactedPacket {
+	p := redactedPacket{
+		LocalIP:    r.addr(mode, fp.LocalIP),
+		RemoteIP:   r.addr(mode, fp.RemoteIP),
+		LocalPort:  r.port(mode, fp.LocalPort),
+		RemotePort: r.port(mode, fp.RemotePort),
+		Fragment:   fp.Fragment,
+	}
+
+	switch fp.Protocol {
+	case firewall.ProtoTCP:
+		p.Protocol = "tcp"
+	case firewall.ProtoICMP:
+		p.Protocol = "icmp"
+	case firewall.ProtoUDP:
+		p.Protocol = "udp"
+	default:
+		p.Protocol = fmt.Sprintf("unknown %v", fp.Protocol)
+	}
+	return p
+}
+
+func (r *LogRedaction) addr(mode string, addr netip.Addr) string {
+	if !addr.IsValid() {
+		return addr.String()
+	}
+
+	if mode == redactInnerHash {
+		return "h:" + r.hash('a', addr.AsSlice(), 4)
+	}
+
+	b := addr.As16()
+	if addr.Is4() || addr.Is4In6() {
+		return "x.x.x." + strconv.Itoa(int(b[15]))
+	}
+	return "x::" + strconv.FormatUint(uint64(binary.BigEndian.Uint16(b[14:])), 16)
+}
+
+func (r *LogRedaction) port(mode string, port uint16) string {
+	if mode == redactInnerHash {
+		return "h:" + r.hash('p', binary.BigEndian.AppendUint16(nil, port), 2)
+	}
+
+	if port < 1024 {
+		return strconv.Itoa(int(port))
+	}
+	return "x"
+}
+
+// hash returns the first n bytes of the keyed hash of b in hex, kind keeps an address from hashing the same as a port
+func (r *LogRedaction) hash(kind byte, b []byte, n int) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte{kind})
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)[:n])
+}
@@ -0,0 +1,89 @@
+package nebula
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/netip"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogRedaction(t *testing.T) {
+	l := logrus.New()
+	buf := &bytes.Buffer{}
+	l.SetOutput(buf)
+	l.Formatter = &logrus.JSONFormatter{DisableTimestamp: true}
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("logging: {redact_inner: mask}"))
+	r, err := NewLogRedactionFromConfig(l, c)
+	require.NoError(t, err)
+
+	fp := firewall.Packet{
+		LocalIP:    netip.MustParseAddr("10.1.2.3"),
+		RemoteIP:   netip.MustParseAddr("fd00::1:abcd"),
+		LocalPort:  443,
+		RemotePort: 51234,
+		Protocol:   firewall.ProtoTCP,
+	}
+	logLine := func() map[string]interface{} {
+		buf.Reset()
+		l.WithField("fwPacket", &fp).
+			WithField("vpnIp", innerAddr(fp.LocalIP)).
+			WithField("packet", innerPacket{0x45, 10, 1, 2, 3}).
+			WithField("peer", netip.MustParseAddr("10.1.2.3")).
+			Info("test")
+		line := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &line), buf.String())
+		return line
+	}
+
+	line := logLine()
+	assert.Equal(t, map[string]interface{}{
+		"LocalIP":    "x.x.x.3",
+		"RemoteIP":   "x::abcd",
+		"LocalPort":  "443",
+		"RemotePort": "x",
+		"Protocol":   "tcp",
+		"Fragment":   false,
+	}, line["fwPacket"])
+	assert.Equal(t, "x.x.x.3", line["vpnIp"])
+	assert.Equal(t, "redacted 5 bytes", line["packet"])
+	assert.Equal(t, "10.1.2.3", line["peer"], "only fields marked as inner packet data are redacted")
+
+	t.Log("Hashes are consistent within a run")
+	require.NoError(t, c.ReloadConfigString("logging: {redact_inner: hash}"))
+	line = logLine()
+	pkt := line["fwPacket"].(map[string]interface{})
+	assert.Regexp(t, `^h:[0-9a-f]{8}$`, pkt["LocalIP"])
+	assert.Regexp(t, `^h:[0-9a-f]{4}$`, pkt["RemotePort"])
+	assert.Equal(t, pkt["LocalIP"], line["vpnIp"])
+	assert.NotEqual(t, pkt["LocalIP"], pkt["RemoteIP"])
+	assert.NotContains(t, buf.String(), "51234")
+	assert.Equal(t, pkt, logLine()["fwPacket"])
+
+	t.Log("A new run has a new key")
+	other, err := NewLogRedactionFromConfig(logrus.New(), c)
+	require.NoError(t, err)
+	assert.NotEqual(t, r.addr(redactInnerHash, fp.LocalIP), other.addr(redactInnerHash, fp.LocalIP))
+
+	t.Log("An invalid mode keeps the previous one")
+	require.NoError(t, c.ReloadConfigString("logging: {redact_inner: scramble}"))
+	assert.Equal(t, redactInnerHash, *r.mode.Load())
+
+	require.NoError(t, c.ReloadConfigString("logging: {redact_inner: off}"))
+	line = logLine()
+	assert.Equal(t, "10.1.2.3", line["fwPacket"].(map[string]interface{})["LocalIP"])
+	assert.Equal(t, float64(51234), line["fwPacket"].(map[string]interface{})["RemotePort"])
+	assert.Equal(t, "10.1.2.3", line["vpnIp"])
+
+	c = config.NewC(l)
+	require.NoError(t, c.LoadString("logging: {redact_inner: scramble}"))
+	_, err = NewLogRedactionFromConfig(l, c)
+	assert.EqualError(t, err, "unknown logging.redact_inner mode `scramble`. possible modes: [off mask hash]")
+}
@@ -19,7 +19,12 @@ import (
 
 type m map[string]interface{}
 
-func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logger, deviceFactory overlay.DeviceFactory) (retcon *Control, reterr error) {
+func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logger, deviceFactory overlay.DeviceFactory) (*Control, error) {
+	return startNebula(nil, c, configTest, buildVersion, logger, deviceFactory)
+}
+
+// startNebula is Main, when sl is not nil the udp listener is shared with the other segments on it
+func startNebula(sl *SharedListener, c *config.C, configTest bool, buildVersion string, logger *logrus.Logger, deviceFactory overlay.DeviceFactory) (retcon *Control, reterr error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	// Automatically cancel the context if Main returns an error, to signal all created goroutines to quit.
 	defer func() {
@@ -56,6 +61,10 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		}
 	})
 
+	if _, err := NewLogRedactionFromConfig(l, c); err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to configure the logger", err)
+	}
+
 	pki, err := NewPKIFromConfig(l, c)
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Failed to load PKI from config", err)
@@ -93,10 +102,15 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		}
 	}
 
-	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// All non system modifying configuration consumption should live above this line
-	// tun config, listeners, anything modifying the computer should be below
-	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	management := newManagementServer(l, ssh)
+	wireManagementReload(l, management, c)
+	var managementStart func()
+	if c.GetBool("management.enabled", false) {
+		managementStart, err = configManagement(l, management, c)
+		if err != nil {
+			return nil, util.ContextualizeIfNeeded("Error while configuring the management listener", err)
+		}
+	}
 
 	var routines int
 
@@ -134,6 +148,151 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		l.WithField("duration", conntrackCacheTimeout).Info("Using routine-local conntrack cache")
 	}
 
+	cipher := c.GetString("cipher", "aes")
+	switch cipher {
+	case "aes":
+		noiseEndianness = binary.BigEndian
+	case "chachapoly":
+		noiseEndianness = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("unknown cipher: %v", cipher)
+	}
+
+	tcpTransport, err := NewTCPTransportFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load transport.tcp", err)
+	}
+	if tcpTransport != nil && sl != nil {
+		return nil, util.NewContextualError("transport.tcp can not be used with a shared listener", nil, nil)
+	}
+
+	hostMap := NewHostMapFromConfig(l, tunCidr, c)
+	handshakeFragments, err := newHandshakeFragmentsFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load handshakes.fragment", err)
+	}
+
+	innerNAT, err := NewInnerNATFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load inner_nat", err)
+	}
+
+	authOnly, err := NewAuthOnlyFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load auth_only", err)
+	}
+
+	relayLoadShare, err := NewRelayLoadShareFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load relay.load_share", err)
+	}
+
+	relayForwardScope, err := NewRelayForwardScopeFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load relay.forward_scope", err)
+	}
+
+	health, err := NewHealthCheckFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load health", err)
+	}
+
+	roamPin, err := NewRoamPinFromConfig(l, c, hostMap)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load roam_pin", err)
+	}
+
+	sourcePin, err := NewSourcePinFromConfig(l, c, hostMap)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load listen.source_pins", err)
+	}
+
+	underlayDeny, err := NewUnderlayDenyListFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load listen.deny_list", err)
+	}
+
+	sendBackoff := NewSendBackoffFromConfig(l, c)
+
+	sendPriority, err := NewSendPriorityFromConfig(l, c, routines)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load send_priority", err)
+	}
+
+	rekey, err := NewRekeyFromConfig(l, c, hostMap)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load rekey", err)
+	}
+
+	pathSelection, err := NewPathSelectionFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load path_selection", err)
+	}
+
+	tracer, err := NewTracerFromConfig(l, c, tunCidr.Addr().String(), buildVersion)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load tracing", err)
+	}
+
+	conntrackSync, err := NewConntrackSyncFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load conntrack_sync", err)
+	}
+
+	doubleEncrypted, err := NewDoubleEncryptedFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load listen.double_encrypted", err)
+	}
+
+	duplicateVpnIp, err := NewDuplicateVpnIpFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load duplicate_vpn_ip", err)
+	}
+
+	unknownDestReject, err := unknownDestinationReject(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load tun.unknown_destination_action", nil, err)
+	}
+
+	routingLoopDrop, err := routingLoopDrop(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load tun.routing_loop_action", nil, err)
+	}
+
+	observer, err := NewObserverFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load observer", err)
+	}
+
+	identityHiding, err := NewIdentityHidingFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load handshakes.hide_identity", err)
+	}
+
+	packetAuth, err := NewPacketAuthFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load packet_auth", err)
+	}
+
+	padding, err := NewPaddingFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load padding", err)
+	}
+
+	// A shared listener runs the udp readers itself and pins them with the config of the first segment
+	var readerAffinity []int
+	if sl == nil {
+		readerAffinity, err = parseReaderAffinity(l, c, routines)
+		if err != nil {
+			return nil, util.NewContextualError("Failed to load listen.cpu_affinity", nil, err)
+		}
+	}
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// All non system modifying configuration consumption should live above this line
+	// tun config, listeners, anything modifying the computer should be below
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
 	var tun overlay.Device
 	if !configTest {
 		c.CatchHUP(ctx)
@@ -156,53 +315,71 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 
 	// set up our UDP listener
 	udpConns := make([]udp.Conn, routines)
-	port := c.GetInt("listen.port", 0)
+	var segment *listenerSegment
 
 	if !configTest {
-		rawListenHost := c.GetString("listen.host", "0.0.0.0")
-		var listenHost netip.Addr
-		if rawListenHost == "[::]" {
-			// Old guidance was to provide the literal `[::]` in `listen.host` but that won't resolve.
-			listenHost = netip.IPv6Unspecified()
-
-		} else {
-			ips, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", rawListenHost)
+		if sl != nil {
+			segment, udpConns, err = sl.join(l, c, routines, pki)
 			if err != nil {
-				return nil, util.ContextualizeIfNeeded("Failed to resolve listen.host", err)
+				return nil, util.ContextualizeIfNeeded("Failed to join the shared udp listener", err)
 			}
-			if len(ips) == 0 {
-				return nil, util.ContextualizeIfNeeded("Failed to resolve listen.host", err)
-			}
-			listenHost = ips[0].Unmap()
-		}
 
-		for i := 0; i < routines; i++ {
-			l.Infof("listening on %v", netip.AddrPortFrom(listenHost, uint16(port)))
-			udpServer, err := udp.NewListener(l, listenHost, port, routines > 1, c.GetInt("listen.batch", 64))
+			defer func() {
+				if reterr != nil {
+					segment.leave()
+				}
+			}()
+
+		} else {
+			udpConns, err = openListeners(l, c, routines)
 			if err != nil {
-				return nil, util.NewContextualError("Failed to open udp listener", m{"queue": i}, err)
+				return nil, err
 			}
-			udpServer.ReloadConfig(c)
-			udpConns[i] = udpServer
-
-			// If port is dynamic, discover it before the next pass through the for loop
-			// This way all routines will use the same port correctly
-			if port == 0 {
-				uPort, err := udpServer.LocalAddr()
-				if err != nil {
-					return nil, util.NewContextualError("Failed to get listening port", nil, err)
+
+			listeners := udpConns
+			defer func() {
+				if reterr != nil {
+					for _, uc := range listeners {
+						uc.Close()
+					}
 				}
-				port = int(uPort.Port())
+			}()
+		}
+	}
+
+	if !configTest && tcpTransport != nil {
+		local, err := udpConns[0].LocalAddr()
+		if err != nil {
+			return nil, util.NewContextualError("Failed to get listening port", nil, err)
+		}
+		if err := tcpTransport.Listen(local); err != nil {
+			return nil, util.NewContextualError("Failed to open tcp listener", m{"addr": local}, err)
+		}
+		defer func() {
+			if reterr != nil {
+				tcpTransport.close()
 			}
+		}()
+
+		for i := range udpConns {
+			udpConns[i] = tcpTransport.wrap(udpConns[i])
 		}
 	}
 
-	hostMap := NewHostMapFromConfig(l, tunCidr, c)
+	hostMap.segment = segment
 	punchy := NewPunchyFromConfig(l, c)
 	lightHouse, err := NewLightHouseFromConfig(ctx, l, c, tunCidr, udpConns[0], punchy)
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Failed to initialize lighthouse handler", err)
 	}
+	lightHouse.selection.health = health
+
+	hostmapSnapshot := NewHostmapSnapshotFromConfig(l, c)
+	if !configTest {
+		if err := hostmapSnapshot.Restore(lightHouse); err != nil {
+			l.WithError(err).Warn("Failed to restore hostmap snapshot, starting without it")
+		}
+	}
 
 	var messageMetrics *MessageMetrics
 	if c.GetBool("stats.message_metrics", false) {
@@ -217,9 +394,16 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		tryInterval:   c.GetDuration("handshakes.try_interval", DefaultHandshakeTryInterval),
 		retries:       int64(c.GetInt("handshakes.retries", DefaultHandshakeRetries)),
 		triggerBuffer: c.GetInt("handshakes.trigger_buffer", DefaultHandshakeTriggerBuffer),
-		useRelays:     useRelays,
+		packetBuffer: packetBufferConfig{
+			max:    max(c.GetInt("handshakes.packet_buffer", DefaultHandshakePacketBuffer), 0),
+			maxAge: c.GetDuration("handshakes.packet_buffer_max_age", 0),
+		},
+		useRelays: useRelays,
 
 		messageMetrics: messageMetrics,
+		tunnelLimit:    NewTunnelLimitFromConfig(l, c),
+		certIPChange:   NewCertIPChangeFromConfig(l, c),
+		fragments:      handshakeFragments,
 	}
 
 	handshakeManager := NewHandshakeManager(l, hostMap, lightHouse, udpConns[0], handshakeConfig)
@@ -234,6 +418,9 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		}
 	}
 
+	tunnelMetrics := NewTunnelMetricsFromConfig(l, c, hostMap)
+	tunRecovery := NewTunRecoveryFromConfig(l, c, health)
+
 	checkInterval := c.GetInt("timers.connection_alive_interval", 5)
 	pendingDeletionInterval := c.GetInt("timers.pending_deletion_interval", 10)
 
@@ -242,7 +429,7 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		Inside:                  tun,
 		Outside:                 udpConns[0],
 		pki:                     pki,
-		Cipher:                  c.GetString("cipher", "aes"),
+		Cipher:                  cipher,
 		Firewall:                fw,
 		ServeDns:                serveDns,
 		HandshakeManager:        handshakeManager,
@@ -254,25 +441,59 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		reQueryWait:             c.GetDuration("timers.requery_wait_duration", defaultReQueryWait),
 		DropLocalBroadcast:      c.GetBool("tun.drop_local_broadcast", false),
 		DropMulticast:           c.GetBool("tun.drop_multicast", false),
+		UnknownDestReject:       unknownDestReject,
+		ECN:                     c.GetBool("listen.ecn", false),
+		VerifyChecksums:         c.GetBool("tun.verify_checksums", false),
+		ICMPEchoReply:           c.GetBool("tun.icmp_echo_reply", false),
+		DropIPOptions:           c.GetBool("tun.drop_ip_options", false),
+		RoutingLoopDrop:         routingLoopDrop,
+		MaxPacketAge:            c.GetDuration("tun.max_packet_age", 0),
+		ControlPriority:         c.GetBool("listen.control_priority", false),
+		MaxDecryptConcurrency:   c.GetInt("listen.max_decrypt_concurrency", 0),
 		routines:                routines,
+		readerAffinity:          readerAffinity,
 		MessageMetrics:          messageMetrics,
 		version:                 buildVersion,
 		relayManager:            NewRelayManager(ctx, l, hostMap, c),
+		relayLoadShare:          relayLoadShare,
+		relayForwardScope:       relayForwardScope,
 		punchy:                  punchy,
+		tunnelIdle:              NewTunnelIdleTimeoutFromConfig(l, c),
+		multicast:               NewOverlayMulticastFromConfig(l, c),
+		innerNAT:                innerNAT,
+		authOnly:                authOnly,
+		latencyProbe:            NewLatencyProbeFromConfig(l, c),
+		hostmapSnapshot:         hostmapSnapshot,
+		health:                  health,
+		roamPin:                 roamPin,
+		tunnelPause:             NewTunnelPause(l, hostMap),
+		sourcePin:               sourcePin,
+		underlayDeny:            underlayDeny,
+		sendBackoff:             sendBackoff,
+		sendPriority:            sendPriority,
+		duplicateVpnIp:          duplicateVpnIp,
+		tunnelQuality:           NewTunnelQualityFromConfig(l, c),
+		underlayWatch:           NewUnderlayWatchFromConfig(l, c),
+		observer:                observer,
+		tunnelMetrics:           tunnelMetrics,
+		rates:                   NewRatesFromConfig(l, c, routines),
+		tunRecovery:             tunRecovery,
+		memoryBudget:            NewMemoryBudgetFromConfig(l, c),
+		identityHiding:          identityHiding,
+		packetAuth:              packetAuth,
+		padding:                 padding,
+		tcpTransport:            tcpTransport,
+		mtuProbe:                NewMTUProbeFromConfig(l, c),
+		rekey:                   rekey,
+		pathSelection:           pathSelection,
+		tracer:                  tracer,
+		conntrackSync:           conntrackSync,
+		doubleEncrypted:         doubleEncrypted,
 
 		ConntrackCacheTimeout: conntrackCacheTimeout,
 		l:                     l,
 	}
 
-	switch ifConfig.Cipher {
-	case "aes":
-		noiseEndianness = binary.BigEndian
-	case "chachapoly":
-		noiseEndianness = binary.LittleEndian
-	default:
-		return nil, fmt.Errorf("unknown cipher: %v", ifConfig.Cipher)
-	}
-
 	var ifce *Interface
 	if !configTest {
 		ifce, err = NewInterface(ctx, ifConfig)
@@ -288,14 +509,35 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		ifce.RegisterConfigChangeCallbacks(c)
 		ifce.reloadDisconnectInvalid(c)
 		ifce.reloadSendRecvError(c)
+		ifce.reloadPacketCapture(c)
+		ifce.reloadPacketSampling(c)
+		ifce.reloadSecurityEvents(c)
+		ifce.reloadKeyExport(c)
+		ifce.reloadRuntimeInfo(c)
 
 		handshakeManager.f = ifce
 		go handshakeManager.Run(ctx)
+		go ifce.latencyProbe.Run(ctx, ifce)
+		go ifce.health.Run(ctx, ifce)
+		go lightHouse.RunRemoteExpiry(ctx, hostMap)
+		go ifce.underlayWatch.Run(ctx, ifce)
+		go ifce.observer.Run(ctx, ifce)
+		go ifce.tunnelMetrics.Run(ctx)
+		go ifce.rates.Run(ctx)
+		go ifce.tunRecovery.Run(ctx, ifce)
+		go ifce.memoryBudget.Run(ctx, ifce)
+		go ifce.packetAuth.Run(ctx)
+		go ifce.tcpTransport.Run(ctx)
+		go ifce.mtuProbe.Run(ctx, ifce)
+		go ifce.relayManager.Run(ctx, ifce)
+		go ifce.rekey.Run(ctx, ifce)
+		go ifce.tracer.Run(ctx)
+		go ifce.conntrackSync.Run(ctx, ifce)
 	}
 
 	// TODO - stats third-party modules start uncancellable goroutines. Update those libs to accept
 	// a context so that they can exit when the context is Done.
-	statsStart, err := startStats(l, c, buildVersion, configTest)
+	statsStart, err := startStats(l, c, buildVersion, configTest, tunnelMetrics)
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Failed to start stats emitter", err)
 	}
@@ -322,8 +564,66 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		ctx,
 		cancel,
 		sshStart,
+		managementStart,
 		statsStart,
+		ifce.health.start(ctx, ifce),
 		dnsStart,
 		lightHouse.StartUpdateWorker,
 	}, nil
 }
+
+// openListeners opens a udp listener for each routine as configured in listen, on error the ones already opened are
+// closed
+func openListeners(l *logrus.Logger, c *config.C, routines int) (_ []udp.Conn, reterr error) {
+	udpConns := make([]udp.Conn, routines)
+	defer func() {
+		if reterr != nil {
+			for _, uc := range udpConns {
+				if uc != nil {
+					uc.Close()
+				}
+			}
+		}
+	}()
+
+	port := c.GetInt("listen.port", 0)
+
+	rawListenHost := c.GetString("listen.host", "0.0.0.0")
+	var listenHost netip.Addr
+	if rawListenHost == "[::]" {
+		// Old guidance was to provide the literal `[::]` in `listen.host` but that won't resolve.
+		listenHost = netip.IPv6Unspecified()
+
+	} else {
+		ips, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", rawListenHost)
+		if err != nil {
+			return nil, util.ContextualizeIfNeeded("Failed to resolve listen.host", err)
+		}
+		if len(ips) == 0 {
+			return nil, util.ContextualizeIfNeeded("Failed to resolve listen.host", err)
+		}
+		listenHost = ips[0].Unmap()
+	}
+
+	for i := 0; i < routines; i++ {
+		l.Infof("listening on %v", netip.AddrPortFrom(listenHost, uint16(port)))
+		udpServer, err := udp.NewListener(l, listenHost, port, routines > 1, c.GetInt("listen.batch", 64))
+		if err != nil {
+			return nil, util.NewContextualError("Failed to open udp listener", m{"queue": i}, err)
+		}
+		udpServer.ReloadConfig(c)
+		udpConns[i] = udpServer
+
+		// If port is dynamic, discover it before the next pass through the for loop
+		// This way all routines will use the same port correctly
+		if port == 0 {
+			uPort, err := udpServer.LocalAddr()
+			if err != nil {
+				return nil, util.NewContextualError("Failed to get listening port", nil, err)
+			}
+			port = int(uPort.Port())
+		}
+	}
+
+	return udpConns, nil
+}
@@ -0,0 +1,77 @@
+package nebula
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestMain_configErrorsBeforeDevice(t *testing.T) {
+	l := test.NewLogger()
+	ca := newTestCA(t, "ca")
+
+	kp, err := noise.DH25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err)
+	crt := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Name:      "node",
+		Ips:       []*net.IPNet{{IP: net.IPv4(10, 1, 0, 1), Mask: net.CIDRMask(16, 32)}},
+		PublicKey: kp.Public,
+		Curve:     cert.Curve_CURVE25519,
+	}}
+
+	errNoDevice := errors.New("no device")
+	for _, tc := range []struct {
+		name     string
+		settings m
+	}{
+		{"", nil},
+		{"cipher", m{"cipher": "nope"}},
+		{"transport.tcp", m{"transport": m{"tcp": m{"enabled": true, "remotes": []string{"nope"}}}}},
+		{"handshakes.fragment", m{"handshakes": m{"fragment": m{"max_buffer": -1}}}},
+		{"inner_nat", m{"inner_nat": []m{{"overlay": "192.168.100.0/24", "local": "10.201.0.0/16"}}}},
+		{"relay.forward_scope", m{"relay": m{"forward_scope": "nope"}}},
+		{"rekey", m{"rekey": m{"classes": "nope"}}},
+		{"send_priority", m{"send_priority": m{"queue_len": 0}}},
+		{"conntrack_sync", m{"conntrack_sync": m{"peer": "10.0.0.1:4243", "key": "short"}}},
+		{"padding", m{"padding": m{"mode": "always"}}},
+	} {
+		settings := m{
+			"pki": m{"ca": string(ca.pem), "cert": string(ca.sign(crt, time.Hour)), "key": string(cert.MarshalX25519PrivateKey(kp.Private))},
+		}
+		for k, v := range tc.settings {
+			settings[k] = v
+		}
+		b, err := yaml.Marshal(settings)
+		require.NoError(t, err)
+		c := config.NewC(l)
+		require.NoError(t, c.LoadString(string(b)))
+
+		created := false
+		factory := func(*config.C, *logrus.Logger, netip.Prefix, int) (overlay.Device, error) {
+			created = true
+			return nil, errNoDevice
+		}
+		_, err = startNebula(nil, c, false, "test", l, factory)
+		if tc.settings == nil {
+			// A good config gets as far as the device
+			assert.ErrorIs(t, err, errNoDevice)
+			continue
+		}
+		require.Error(t, err, tc.name)
+		assert.NotErrorIs(t, err, errNoDevice, tc.name)
+		assert.False(t, created, "%s is checked before the tun device is created", tc.name)
+	}
+}
@@ -0,0 +1,206 @@
+package nebula
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/sshd"
+)
+
+// managementReadTimeout is how long a management client has to complete the TLS handshake and send its command
+const managementReadTimeout = 10 * time.Second
+
+// managementServer runs the sshd commands over mutual TLS for tooling that does not speak ssh. Each connection sends
+// one command line and receives its output, the connection is closed when the command is done. Clients are read-only
+// unless their certificate carries one of management.mutating_ous as an organizational unit.
+//
+// Nebula certificates are not X.509, the listener needs its own certificate and a CA for the client certificates.
+type managementServer struct {
+	ssh *sshd.SSHServer
+	l   *logrus.Logger
+
+	sync.Mutex
+	listener net.Listener
+}
+
+type managementConfig struct {
+	listen      string
+	tls         *tls.Config
+	mutatingOUs map[string]struct{}
+}
+
+func newManagementServer(l *logrus.Logger, ssh *sshd.SSHServer) *managementServer {
+	return &managementServer{ssh: ssh, l: l}
+}
+
+func wireManagementReload(l *logrus.Logger, m *managementServer, c *config.C) {
+	c.RegisterReloadCallback(func(c *config.C) {
+		if !c.GetBool("management.enabled", false) {
+			m.Stop()
+			return
+		}
+
+		run, err := configManagement(l, m, c)
+		if err != nil {
+			l.WithError(err).Error("Failed to reconfigure the management listener, keeping the previous one")
+			return
+		}
+		go run()
+	})
+}
+
+// configManagement validates the management config and returns a function that starts the listener with it
+func configManagement(l *logrus.Logger, m *managementServer, c *config.C) (func(), error) {
+	mc := &managementConfig{
+		listen:      c.GetString("management.listen", ""),
+		mutatingOUs: map[string]struct{}{},
+	}
+	if mc.listen == "" {
+		return nil, fmt.Errorf("management.listen must be provided")
+	}
+	if _, _, err := net.SplitHostPort(mc.listen); err != nil {
+		return nil, fmt.Errorf("invalid management.listen address: %s", err)
+	}
+
+	certPEM, err := readPEMOrFile(c.GetString("management.cert", ""))
+	if err != nil {
+		return nil, fmt.Errorf("error while loading management.cert: %s", err)
+	}
+	keyPEM, err := readPEMOrFile(c.GetString("management.key", ""))
+	if err != nil {
+		return nil, fmt.Errorf("error while loading management.key: %s", err)
+	}
+	serverCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("management.cert and management.key are not a valid key pair: %s", err)
+	}
+
+	caPEM, err := readPEMOrFile(c.GetString("management.ca", ""))
+	if err != nil {
+		return nil, fmt.Errorf("error while loading management.ca: %s", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("management.ca does not contain any PEM certificates")
+	}
+
+	for _, ou := range c.GetStringSlice("management.mutating_ous", []string{}) {
+		mc.mutatingOUs[ou] = struct{}{}
+	}
+
+	mc.tls = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS13,
+	}
+
+	return func() {
+		if err := m.Run(mc); err != nil {
+			l.WithError(err).Warn("Failed to run the management listener")
+		}
+	}, nil
+}
+
+// readPEMOrFile returns s if it holds a PEM block, otherwise the contents of the file at path s
+func readPEMOrFile(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("must be provided")
+	}
+	if strings.Contains(s, "-----BEGIN") {
+		return []byte(s), nil
+	}
+	return os.ReadFile(s)
+}
+
+// Run replaces any running listener with one for mc and serves it until Stop is called or the listener is replaced
+func (m *managementServer) Run(mc *managementConfig) error {
+	m.Lock()
+	if m.listener != nil {
+		m.listener.Close()
+	}
+	ln, err := tls.Listen("tcp", mc.listen, mc.tls)
+	if err != nil {
+		m.listener = nil
+		m.Unlock()
+		return err
+	}
+	m.listener = ln
+	m.Unlock()
+
+	m.l.WithField("managementListener", ln.Addr()).Info("Management listener is listening")
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				m.l.WithError(err).Warn("Error in management listener, shutting down")
+			}
+			break
+		}
+		go m.handle(conn.(*tls.Conn), mc)
+	}
+
+	m.l.WithField("managementListener", ln.Addr()).Info("Management listener stopped listening")
+	return nil
+}
+
+func (m *managementServer) Stop() {
+	m.Lock()
+	defer m.Unlock()
+	if m.listener != nil {
+		if err := m.listener.Close(); err != nil {
+			m.l.WithError(err).Warn("Failed to close the management listener")
+		}
+		m.listener = nil
+	}
+}
+
+func (m *managementServer) handle(conn *tls.Conn, mc *managementConfig) {
+	defer conn.Close()
+	l := m.l.WithField("remoteAddress", conn.RemoteAddr())
+
+	_ = conn.SetReadDeadline(time.Now().Add(managementReadTimeout))
+	if err := conn.Handshake(); err != nil {
+		l.WithError(err).Warn("Management client failed to handshake")
+		return
+	}
+
+	// The client certificate is verified against management.ca by the handshake
+	client := conn.ConnectionState().PeerCertificates[0]
+	allowMutating := false
+	for _, ou := range client.Subject.OrganizationalUnit {
+		if _, ok := mc.mutatingOUs[ou]; ok {
+			allowMutating = true
+			break
+		}
+	}
+	l = l.WithField("clientName", client.Subject.CommonName).WithField("mutating", allowMutating)
+
+	// A command without a trailing newline is fine if the client closed its side of the connection
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && (line == "" || !errors.Is(err, io.EOF)) {
+		l.WithError(err).Info("Management client did not send a command")
+		return
+	}
+	line = strings.TrimSpace(line)
+	_ = conn.SetReadDeadline(time.Time{})
+
+	l = l.WithField("command", line)
+	err = m.ssh.Dispatch(line, conn, allowMutating)
+	if errors.Is(err, sshd.ErrCommandNotPermitted) {
+		l.Warn("Refused a mutating command from a read-only management client")
+		return
+	}
+	l.Info("Management client ran a command")
+}
@@ -0,0 +1,205 @@
+package nebula
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/sshd"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testX509 struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+	tls  tls.Certificate
+}
+
+// newTestX509 creates a certificate signed by parent, or a self signed CA if parent is nil
+func newTestX509(t *testing.T, parent *testX509, cn string, ous ...string) *testX509 {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, OrganizationalUnit: ous},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	c, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	tc, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	return &testX509{cert: c, key: key, pem: string(certPEM) + string(keyPEM), tls: tc}
+}
+
+func TestManagementServer(t *testing.T) {
+	l := test.NewLogger()
+	ssh, err := sshd.NewSSHServer(l.WithField("subsystem", "sshd"))
+	require.NoError(t, err)
+	ssh.RegisterCommand(&sshd.Command{
+		Name: "look",
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return w.WriteLine("looked")
+		},
+	})
+	ssh.RegisterCommand(&sshd.Command{
+		Name: "touch",
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return w.WriteLine("touched")
+		},
+		Mutating: true,
+	})
+
+	ca := newTestX509(t, nil, "management ca")
+	server := newTestX509(t, ca, "server")
+	reader := newTestX509(t, ca, "reader", "ops")
+	admin := newTestX509(t, ca, "admin", "ops", "nebula-admin")
+	stranger := newTestX509(t, newTestX509(t, nil, "other ca"), "stranger", "nebula-admin")
+
+	c := config.NewC(l)
+	c.Settings["management"] = map[interface{}]interface{}{
+		"enabled":      true,
+		"listen":       "127.0.0.1:0",
+		"cert":         server.pem,
+		"key":          server.pem,
+		"ca":           ca.pem,
+		"mutating_ous": []interface{}{"nebula-admin"},
+	}
+
+	m := newManagementServer(l, ssh)
+	run, err := configManagement(l, m, c)
+	require.NoError(t, err)
+	go run()
+	defer m.Stop()
+
+	var addr string
+	require.Eventually(t, func() bool {
+		m.Lock()
+		defer m.Unlock()
+		if m.listener == nil {
+			return false
+		}
+		addr = m.listener.Addr().String()
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	run1 := func(client *testX509, line string) (string, error) {
+		conf := &tls.Config{RootCAs: roots}
+		if client != nil {
+			conf.Certificates = []tls.Certificate{client.tls}
+		}
+		conn, err := tls.Dial("tcp", addr, conf)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte(line + "\n"))
+		if err != nil {
+			return "", err
+		}
+		out, err := io.ReadAll(conn)
+		return string(out), err
+	}
+
+	out, err := run1(reader, "look")
+	require.NoError(t, err)
+	assert.Equal(t, "looked\n", out)
+
+	out, err = run1(reader, "touch")
+	require.NoError(t, err)
+	assert.Contains(t, out, "not permitted")
+	assert.NotContains(t, out, "touched")
+
+	out, err = run1(admin, "touch")
+	require.NoError(t, err)
+	assert.Equal(t, "touched\n", out)
+
+	// Help is available to everyone
+	out, err = run1(reader, "help touch")
+	require.NoError(t, err)
+	assert.Contains(t, out, "touch")
+
+	// Clients without a certificate from management.ca never get to run a command
+	out, _ = run1(nil, "look")
+	assert.NotContains(t, out, "looked")
+	out, _ = run1(stranger, "touch")
+	assert.NotContains(t, out, "touched")
+}
+
+func TestConfigManagement(t *testing.T) {
+	l := test.NewLogger()
+	ca := newTestX509(t, nil, "management ca")
+	server := newTestX509(t, ca, "server")
+	m := newManagementServer(l, nil)
+
+	good := map[interface{}]interface{}{
+		"listen": "127.0.0.1:4243",
+		"cert":   server.pem,
+		"key":    server.pem,
+		"ca":     ca.pem,
+	}
+
+	c := config.NewC(l)
+	c.Settings["management"] = good
+	_, err := configManagement(l, m, c)
+	require.NoError(t, err)
+
+	for _, missing := range []string{"listen", "cert", "key", "ca"} {
+		bad := map[interface{}]interface{}{}
+		for k, v := range good {
+			if k != missing {
+				bad[k] = v
+			}
+		}
+		c.Settings["management"] = bad
+		_, err = configManagement(l, m, c)
+		assert.Error(t, err, missing)
+	}
+
+	// The server key must belong to the server cert
+	other := newTestX509(t, ca, "other")
+	c.Settings["management"] = map[interface{}]interface{}{
+		"listen": "127.0.0.1:4243",
+		"cert":   server.pem,
+		"key":    other.pem,
+		"ca":     ca.pem,
+	}
+	_, err = configManagement(l, m, c)
+	assert.Error(t, err)
+}
@@ -0,0 +1,339 @@
+package nebula
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// MemoryBudget caps the memory held by the hostmap, the firewall conntrack table and the lighthouse cache together, for
+// hosts that can not afford to have them grow without bound. It is global backpressure on top of the caps of each
+// table: once the estimated usage reaches memoryBudgetHigh of the budget, entries are evicted until it is back under
+// memoryBudgetLow, cheapest to lose first:
+//
+//  1. Lighthouse candidates of hosts we have neither a tunnel nor a pending handshake with, largest first. They are
+//     asked for again when a tunnel is needed. A lighthouse keeps its cache, serving it is what it is for.
+//  2. Idle tunnels, least recently used first. Tunnels with a lighthouse or carrying relays are kept, as tunnels.evict_idle
+//     does.
+//  3. Conntrack entries, soonest to expire first. The tunnels they belong to stay up, a flow that was evicted has to be
+//     allowed by the firewall again.
+//
+// Active tunnels are never evicted. Usage is estimated from the number of entries in each table, not measured, so the
+// budget should leave room for the rest of the process.
+type MemoryBudget struct {
+	// max is the budget in bytes, 0 disables it
+	max      atomic.Int64
+	interval atomic.Int64
+	// over is true while the budget could not be met, to log it once
+	over atomic.Bool
+
+	metricUsedTunnels       metrics.Gauge
+	metricUsedConntrack     metrics.Gauge
+	metricUsedCandidates    metrics.Gauge
+	metricEvictedTunnels    metrics.Counter
+	metricEvictedConntrack  metrics.Counter
+	metricEvictedCandidates metrics.Counter
+
+	l *logrus.Logger
+}
+
+// MemoryUsage is the estimated memory held by each table in bytes
+type MemoryUsage struct {
+	Tunnels    int64 `json:"tunnels"`
+	Conntrack  int64 `json:"conntrack"`
+	Candidates int64 `json:"candidates"`
+}
+
+func (u MemoryUsage) Total() int64 {
+	return u.Tunnels + u.Conntrack + u.Candidates
+}
+
+const (
+	defaultMemoryBudgetInterval = 5 * time.Second
+
+	// memoryBudgetHigh and memoryBudgetLow are the percentages of the budget eviction starts at and stops at
+	memoryBudgetHigh = 90
+	memoryBudgetLow  = 80
+
+	// Rough sizes of an entry in each table on a 64 bit host, including the maps that index it
+	memoryBudgetTunnelBytes     = 4096
+	memoryBudgetConntrackBytes  = 256
+	memoryBudgetRemoteListBytes = 512
+	memoryBudgetRemoteBytes     = 64
+)
+
+func NewMemoryBudgetFromConfig(l *logrus.Logger, c *config.C) *MemoryBudget {
+	mb := &MemoryBudget{
+		metricUsedTunnels:       metrics.GetOrRegisterGauge("memory_budget.used.tunnels", nil),
+		metricUsedConntrack:     metrics.GetOrRegisterGauge("memory_budget.used.conntrack", nil),
+		metricUsedCandidates:    metrics.GetOrRegisterGauge("memory_budget.used.candidates", nil),
+		metricEvictedTunnels:    metrics.GetOrRegisterCounter("memory_budget.evicted.tunnels", nil),
+		metricEvictedConntrack:  metrics.GetOrRegisterCounter("memory_budget.evicted.conntrack", nil),
+		metricEvictedCandidates: metrics.GetOrRegisterCounter("memory_budget.evicted.candidates", nil),
+		l:                       l,
+	}
+
+	mb.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		mb.reload(c, false)
+	})
+
+	return mb
+}
+
+func (mb *MemoryBudget) reload(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("memory_budget") {
+		return
+	}
+
+	max, err := parseByteSize(c.GetString("memory_budget.max", "0"))
+	if err != nil {
+		mb.l.WithError(err).Warn("Invalid memory_budget.max, the memory budget is disabled")
+		max = 0
+	}
+	mb.max.Store(max)
+
+	interval := c.GetDuration("memory_budget.interval", defaultMemoryBudgetInterval)
+	if interval <= 0 {
+		mb.l.WithField("interval", interval).Warn("memory_budget.interval must be positive, using the default")
+		interval = defaultMemoryBudgetInterval
+	}
+	mb.interval.Store(int64(interval))
+
+	if !initial {
+		mb.l.WithField("max", max).WithField("interval", interval).Info("memory_budget has changed")
+	}
+}
+
+// parseByteSize parses a number of bytes with an optional KiB, MiB or GiB suffix
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	mult := int64(1)
+	for suffix, m := range map[string]int64{"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30} {
+		if strings.HasSuffix(s, suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, suffix)), m
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size in bytes, KiB, MiB or GiB", s)
+	}
+	return n * mult, nil
+}
+
+// Run enforces the budget every memory_budget.interval until ctx is done, nothing is done while memory_budget.max is 0
+func (mb *MemoryBudget) Run(ctx context.Context, f *Interface) {
+	timer := time.NewTimer(time.Duration(mb.interval.Load()))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-timer.C:
+			if mb.max.Load() > 0 {
+				mb.enforce(f, now)
+			}
+			timer.Reset(time.Duration(mb.interval.Load()))
+		}
+	}
+}
+
+// Usage estimates the memory held by each table of f
+func (mb *MemoryBudget) Usage(f *Interface) MemoryUsage {
+	var u MemoryUsage
+
+	f.hostMap.RLock()
+	u.Tunnels = int64(len(f.hostMap.Indexes)) * memoryBudgetTunnelBytes
+	f.hostMap.RUnlock()
+
+	conntrack := f.firewall.Conntrack
+	conntrack.Lock()
+	u.Conntrack = int64(len(conntrack.Conns)) * memoryBudgetConntrackBytes
+	conntrack.Unlock()
+
+	f.lightHouse.RLock()
+	lists := maps.Clone(f.lightHouse.addrMap)
+	f.lightHouse.RUnlock()
+	for _, rl := range lists {
+		u.Candidates += remoteListBytes(rl)
+	}
+
+	return u
+}
+
+func remoteListBytes(rl *RemoteList) int64 {
+	rl.RLock()
+	defer rl.RUnlock()
+	return memoryBudgetRemoteListBytes + int64(len(rl.addrs)+len(rl.relays))*memoryBudgetRemoteBytes
+}
+
+// enforce evicts entries in priority order if the usage reached memoryBudgetHigh of the budget
+func (mb *MemoryBudget) enforce(f *Interface, now time.Time) {
+	max := mb.max.Load()
+	u := mb.Usage(f)
+	mb.metricUsedTunnels.Update(u.Tunnels)
+	mb.metricUsedConntrack.Update(u.Conntrack)
+	mb.metricUsedCandidates.Update(u.Candidates)
+
+	if max <= 0 || u.Total()*100 < max*memoryBudgetHigh {
+		mb.over.Store(false)
+		return
+	}
+
+	excess := u.Total() - max*memoryBudgetLow/100
+	excess -= mb.evictCandidates(f, excess)
+	if excess > 0 {
+		excess -= mb.evictTunnels(f, now, excess)
+	}
+	if excess > 0 {
+		excess -= mb.evictConntrack(f, excess)
+	}
+
+	if excess > 0 {
+		if !mb.over.Swap(true) {
+			mb.l.WithField("budget", max).WithField("usage", u).
+				Warn("Memory budget exceeded, nothing is left to evict but active tunnels")
+		}
+	} else {
+		mb.over.Store(false)
+	}
+}
+
+// evictCandidates removes the lighthouse cache of hosts we are not talking to until want bytes are freed, returns the
+// bytes freed
+func (mb *MemoryBudget) evictCandidates(f *Interface, want int64) int64 {
+	lh := f.lightHouse
+	if lh.amLighthouse {
+		return 0
+	}
+
+	type candidate struct {
+		vpnIp netip.Addr
+		bytes int64
+	}
+
+	static := lh.GetStaticHostList()
+	lh.RLock()
+	lists := maps.Clone(lh.addrMap)
+	lh.RUnlock()
+
+	var evictable []candidate
+	for vpnIp, rl := range lists {
+		if _, ok := static[vpnIp]; ok || lh.IsLighthouseIP(vpnIp) {
+			continue
+		}
+		if f.hostMap.QueryVpnIp(vpnIp) != nil || f.handshakeManager.QueryVpnIp(vpnIp) != nil {
+			continue
+		}
+		evictable = append(evictable, candidate{vpnIp, remoteListBytes(rl)})
+	}
+	slices.SortFunc(evictable, func(a, b candidate) int { return cmp.Compare(b.bytes, a.bytes) })
+
+	var freed, n int64
+	for _, c := range evictable {
+		if freed >= want {
+			break
+		}
+		lh.DeleteVpnIp(c.vpnIp)
+		freed += c.bytes
+		n++
+	}
+
+	if n > 0 {
+		mb.metricEvictedCandidates.Inc(n)
+		mb.l.WithField("evicted", n).WithField("freed", freed).Info("Evicted lighthouse candidates to stay within memory_budget.max")
+	}
+	return freed
+}
+
+// evictTunnels closes idle tunnels, least recently used first, until want bytes are freed, returns the bytes freed
+func (mb *MemoryBudget) evictTunnels(f *Interface, now time.Time, want int64) int64 {
+	idleBefore := now.Add(-f.connectionManager.checkInterval).UnixNano()
+
+	var idle []*HostInfo
+	f.hostMap.RLock()
+	for vpnIp, hostinfo := range f.hostMap.Hosts {
+		if hostinfo.lastUsed.Load() > idleBefore || f.lightHouse.IsLighthouseIP(vpnIp) {
+			continue
+		}
+		if len(hostinfo.relayState.CopyRelayForIdxs()) > 0 {
+			continue
+		}
+		idle = append(idle, hostinfo)
+	}
+	f.hostMap.RUnlock()
+	slices.SortFunc(idle, func(a, b *HostInfo) int { return cmp.Compare(a.lastUsed.Load(), b.lastUsed.Load()) })
+
+	var freed int64
+	for _, hostinfo := range idle {
+		if freed >= want {
+			break
+		}
+
+		mb.metricEvictedTunnels.Inc(1)
+		hostinfo.logger(mb.l).
+			WithField("lastUsed", time.Unix(0, hostinfo.lastUsed.Load())).
+			Info("Evicting idle tunnel to stay within memory_budget.max")
+		f.sendCloseTunnel(hostinfo)
+		f.closeTunnel(hostinfo)
+		freed += memoryBudgetTunnelBytes
+	}
+	return freed
+}
+
+// evictConntrack removes conntrack entries, soonest to expire first, until want bytes are freed, returns the bytes freed
+func (mb *MemoryBudget) evictConntrack(f *Interface, want int64) int64 {
+	type entry struct {
+		fp      firewall.Packet
+		expires time.Time
+	}
+
+	// Sorting a large table takes a while, it is done without holding up the packet path on the conntrack lock
+	conntrack := f.firewall.Conntrack
+	conntrack.Lock()
+	entries := make([]entry, 0, len(conntrack.Conns))
+	for fp, c := range conntrack.Conns {
+		entries = append(entries, entry{fp, c.Expires})
+	}
+	conntrack.Unlock()
+	slices.SortFunc(entries, func(a, b entry) int { return a.expires.Compare(b.expires) })
+
+	var freed, n int64
+	conntrack.Lock()
+	for _, e := range entries {
+		if freed >= want {
+			break
+		}
+		// A flow that saw a packet since it was collected is no longer the one to lose
+		c, ok := conntrack.Conns[e.fp]
+		if !ok || !c.Expires.Equal(e.expires) {
+			continue
+		}
+		// The timer wheel entry is left to expire, evict ignores flows that are no longer tracked
+		delete(conntrack.Conns, e.fp)
+		freed += memoryBudgetConntrackBytes
+		n++
+	}
+	conntrack.Unlock()
+
+	if n > 0 {
+		mb.metricEvictedConntrack.Inc(n)
+		mb.l.WithField("evicted", n).Info("Evicted conntrack entries to stay within memory_budget.max")
+	}
+	return freed
+}
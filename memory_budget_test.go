@@ -0,0 +1,128 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for s, want := range map[string]int64{"0": 0, "1500": 1500, "16KiB": 16 << 10, "2 MiB": 2 << 20, "1GiB": 1 << 30} {
+		got, err := parseByteSize(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+
+	for _, s := range []string{"", "-1", "1MB", "lots"} {
+		_, err := parseByteSize(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestMemoryBudget_enforce(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("memory_budget: {max: 12000, interval: 1s}"))
+	mb := NewMemoryBudgetFromConfig(l, c)
+	assert.Equal(t, int64(12000), mb.max.Load())
+	assert.Equal(t, int64(time.Second), mb.interval.Load())
+
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	lh := newTestLighthouse()
+	f := &Interface{
+		l:                 l,
+		hostMap:           hm,
+		lightHouse:        lh,
+		handshakeManager:  NewHandshakeManager(l, hm, lh, &udp.NoopConn{}, defaultHandshakeConfig),
+		firewall:          &Firewall{Conntrack: &FirewallConntrack{Conns: map[firewall.Packet]*conn{}}},
+		sendBackoff:       NewSendBackoffFromConfig(l, c),
+		writers:           []udp.Conn{&udp.NoopConn{}},
+		connectionManager: &connectionManager{checkInterval: time.Minute, out: map[uint32]struct{}{}, outLock: &sync.RWMutex{}},
+	}
+
+	now := time.Now()
+	cs := &NebulaCipherState{c: noise.CipherChaChaPoly.Cipher([32]byte{1})}
+	newTunnel := func(vpnIp netip.Addr, idx uint32, lastUsed time.Time) *HostInfo {
+		h := &HostInfo{
+			vpnIp:           vpnIp,
+			localIndexId:    idx,
+			ConnectionState: &ConnectionState{eKey: cs, dKey: cs},
+		}
+		hm.unlockedAddHostInfo(h, f)
+		h.lastUsed.Store(lastUsed.UnixNano())
+		return h
+	}
+	active := newTunnel(netip.MustParseAddr("10.128.0.2"), 1, now)
+	idle := newTunnel(netip.MustParseAddr("10.128.0.3"), 2, now.Add(-time.Hour))
+
+	// The cache of the active tunnel is kept, the other two are evictable
+	for _, vpnIp := range []netip.Addr{active.vpnIp, netip.MustParseAddr("10.128.0.4"), netip.MustParseAddr("10.128.0.5")} {
+		lh.addrMap[vpnIp] = NewRemoteList(nil)
+	}
+
+	for i := range 8 {
+		fp := firewall.Packet{LocalPort: uint16(i)}
+		f.firewall.Conntrack.Conns[fp] = &conn{Expires: now.Add(time.Duration(i) * time.Second)}
+	}
+
+	u := mb.Usage(f)
+	assert.Equal(t, MemoryUsage{Tunnels: 2 * 4096, Conntrack: 8 * 256, Candidates: 3 * 512}, u)
+
+	t.Log("Under the high water mark nothing is evicted")
+	mb.max.Store(u.Total() * 2)
+	mb.enforce(f, now)
+	assert.Equal(t, u, mb.Usage(f))
+
+	t.Log("Candidates go first, then idle tunnels")
+	candidates := mb.metricEvictedCandidates.Count()
+	tunnels := mb.metricEvictedTunnels.Count()
+	mb.max.Store(u.Total())
+	mb.enforce(f, now)
+	assert.Equal(t, candidates+2, mb.metricEvictedCandidates.Count())
+	assert.Equal(t, tunnels+1, mb.metricEvictedTunnels.Count())
+	assert.Contains(t, lh.addrMap, active.vpnIp)
+	assert.Len(t, lh.addrMap, 1)
+	assert.Nil(t, hm.QueryVpnIp(idle.vpnIp))
+	assert.NotNil(t, hm.QueryVpnIp(active.vpnIp))
+	assert.Len(t, f.firewall.Conntrack.Conns, 8)
+
+	t.Log("Then conntrack entries, soonest to expire first")
+	u = mb.Usage(f)
+	conntrack := mb.metricEvictedConntrack.Count()
+	mb.max.Store(u.Total() * 100 / memoryBudgetHigh)
+	mb.enforce(f, now)
+	assert.Equal(t, conntrack+3, mb.metricEvictedConntrack.Count())
+	assert.Len(t, f.firewall.Conntrack.Conns, 5)
+	assert.NotContains(t, f.firewall.Conntrack.Conns, firewall.Packet{LocalPort: 2})
+	assert.Contains(t, f.firewall.Conntrack.Conns, firewall.Packet{LocalPort: 3})
+	assert.False(t, mb.over.Load())
+
+	t.Log("Active tunnels are never evicted")
+	mb.max.Store(1024)
+	mb.enforce(f, now)
+	assert.Empty(t, f.firewall.Conntrack.Conns)
+	assert.NotNil(t, hm.QueryVpnIp(active.vpnIp))
+	assert.True(t, mb.over.Load())
+}
+
+func TestMemoryBudget_RunDisabled(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("memory_budget: {interval: 1ms}"))
+	mb := NewMemoryBudgetFromConfig(l, c)
+
+	// Without a budget the tables are not even looked at, an empty interface would panic if they were
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	mb.Run(ctx, &Interface{})
+}
@@ -41,6 +41,8 @@ func newMessageMetrics() *MessageMetrics {
 		return [][]metrics.Counter{
 			{
 				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.handshake_ixpsk0", t), nil),
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.handshake_xxpsk0", t), nil),
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.handshake_fragment", t), nil),
 			},
 			nil,
 			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.recv_error", t), nil)},
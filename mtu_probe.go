@@ -0,0 +1,299 @@
+package nebula
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/overlay"
+)
+
+const (
+	defaultMTUProbeMin      = 1200
+	defaultMTUProbeInterval = 10 * time.Minute
+	defaultMTUProbeMaxRate  = 20
+
+	// mtuProbeAttempts is how many probes of a size go unanswered before the size is considered too big, a single lost
+	// probe would otherwise shrink the tunnel mtu until the next search
+	mtuProbeAttempts = 2
+
+	// mtuProbeOverhead is what encryption adds to a probe payload, the nebula header and the AEAD tag
+	mtuProbeOverhead = header.Len + 16
+)
+
+// mtuProbeMagic prefixes the payload of an mtu probe, followed by a big endian uint64 probe id and padding up to the
+// probed size
+var mtuProbeMagic = probeMagic{'m', 't', 'u', '1'}
+
+// mtuProbeTimers match the search, one probe of a size is sent a second and a probe not answered by the next second is
+// lost
+var mtuProbeTimers = &probeTimers{interval: time.Second, timeout: time.Second, failures: mtuProbeAttempts}
+
+// MTUProbe finds the largest packet each tunnel can carry by sending test packets padded to the size being probed. The
+// peer echoes the payload so the reply is just as large and both directions of the path are covered. A binary search
+// between mtu_probe.min and mtu_probe.max is run when a tunnel comes up and again every interval. A probe payload of n
+// bytes is exactly the size of an n byte tunneled packet once encrypted, the largest answered size is the tunnel mtu.
+// Larger packets with DF set are refused with an icmp fragmentation needed so the sender can lower its path mtu.
+//
+// Probes only find the path mtu if they are not fragmented along the way, see listen.dont_fragment.
+type MTUProbe struct {
+	enabled  atomic.Bool
+	min      atomic.Int64
+	max      atomic.Int64
+	interval atomic.Int64
+	maxRate  atomic.Int64
+
+	metricTx     metrics.Counter
+	metricTooBig metrics.Counter
+	l            *logrus.Logger
+}
+
+// mtuState is the per tunnel probe state
+type mtuState struct {
+	// effective is the discovered tunnel mtu, 0 until a search has finished with an answer
+	effective atomic.Int64
+
+	sync.Mutex
+	searching bool
+	// good is the largest size answered and bad the smallest size that went unanswered in the current search
+	good, bad int
+	// size is the size of the outstanding probe, 0 if there is none
+	size   int
+	tries  int
+	probes probeSet[int]
+	// next is when the tunnel is searched again
+	next time.Time
+}
+
+func NewMTUProbeFromConfig(l *logrus.Logger, c *config.C) *MTUProbe {
+	mp := &MTUProbe{
+		metricTx:     metrics.GetOrRegisterCounter("mtu_probe.tx", nil),
+		metricTooBig: metrics.GetOrRegisterCounter("mtu_probe.too_big", nil),
+		l:            l,
+	}
+
+	mp.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		mp.reload(c, false)
+	})
+
+	return mp
+}
+
+func (mp *MTUProbe) reload(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("mtu_probe") && !c.HasChanged("tun.mtu") {
+		return
+	}
+
+	max := c.GetInt("mtu_probe.max", c.GetInt("tun.mtu", overlay.DefaultMTU))
+	if max > mtu-mtuProbeOverhead {
+		mp.l.WithField("max", max).Warnf("mtu_probe.max can be at most %d, using that", mtu-mtuProbeOverhead)
+		max = mtu - mtuProbeOverhead
+	}
+
+	min := c.GetInt("mtu_probe.min", defaultMTUProbeMin)
+	if min < probeLen || min > max {
+		mp.l.WithField("min", min).WithField("max", max).
+			Warnf("mtu_probe.min must be at least %d and at most mtu_probe.max, using the default", probeLen)
+		min = defaultMTUProbeMin
+		if min > max {
+			min = max
+		}
+	}
+
+	interval := c.GetDuration("mtu_probe.interval", defaultMTUProbeInterval)
+	if interval < time.Minute {
+		mp.l.WithField("interval", interval).Warn("mtu_probe.interval must be at least 1m, using the default")
+		interval = defaultMTUProbeInterval
+	}
+
+	maxRate := c.GetInt("mtu_probe.max_rate", defaultMTUProbeMaxRate)
+	if maxRate < 1 {
+		mp.l.WithField("maxRate", maxRate).Warn("mtu_probe.max_rate must be at least 1, using the default")
+		maxRate = defaultMTUProbeMaxRate
+	}
+
+	mp.min.Store(int64(min))
+	mp.max.Store(int64(max))
+	mp.interval.Store(int64(interval))
+	mp.maxRate.Store(int64(maxRate))
+	mp.enabled.Store(c.GetBool("mtu_probe.enabled", false))
+
+	if !initial || mp.enabled.Load() {
+		mp.l.WithField("enabled", mp.enabled.Load()).
+			WithField("min", min).
+			WithField("max", max).
+			WithField("interval", interval).
+			WithField("maxRate", maxRate).
+			Info("MTU probing configured")
+	}
+}
+
+// Run advances the search of every eligible tunnel once a second, sending at most max_rate probes per second, until
+// ctx is done. A probe that is not answered by the next second is lost.
+func (mp *MTUProbe) Run(ctx context.Context, f *Interface) {
+	clockSource := time.NewTicker(time.Second)
+	defer clockSource.Stop()
+
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+	payload := make([]byte, mtu)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case now := <-clockSource.C:
+			if !mp.enabled.Load() {
+				continue
+			}
+
+			f.hostMap.RLock()
+			hosts := make([]*HostInfo, 0, len(f.hostMap.Hosts))
+			for _, hostinfo := range f.hostMap.Hosts {
+				hosts = append(hosts, hostinfo)
+			}
+			f.hostMap.RUnlock()
+
+			budget := int(mp.maxRate.Load())
+			for _, hostinfo := range hosts {
+				if budget == 0 {
+					break
+				}
+
+				// Relayed tunnels have another hop's overhead and tcp never drops a large packet
+				if !hostinfo.remote.IsValid() || hostinfo.ConnectionState == nil || f.tcpTransport.carries(hostinfo.remote) {
+					continue
+				}
+
+				size, id := mp.step(f.l, hostinfo, now)
+				if size == 0 {
+					continue
+				}
+
+				budget--
+				p := payload[:size]
+				copy(p, mtuProbeMagic.payload(id))
+				mp.metricTx.Inc(1)
+				f.sendTo(header.Test, header.TestRequest, hostinfo.ConnectionState, hostinfo, hostinfo.remote, p, nb, out)
+			}
+		}
+	}
+}
+
+// step acts on the outstanding probe for hostinfo and returns the size and id of the next probe to send, a size of 0
+// means nothing is sent this time
+func (mp *MTUProbe) step(l *logrus.Logger, hostinfo *HostInfo, now time.Time) (int, uint64) {
+	ms := &hostinfo.mtu
+	ms.Lock()
+	defer ms.Unlock()
+
+	min, max := int(mp.min.Load()), int(mp.max.Load())
+
+	if ms.size != 0 {
+		if ms.tries < mtuProbeAttempts {
+			ms.tries++
+			return ms.size, ms.probes.send(ms.size, now, mtuProbeTimers)
+		}
+
+		ms.bad = ms.size
+		ms.size = 0
+	}
+
+	if !ms.searching {
+		if now.Before(ms.next) {
+			return 0, 0
+		}
+
+		// The first probe is the largest size, on most paths that is the only one needed
+		ms.searching = true
+		ms.good = min - 1
+		ms.bad = max + 1
+		ms.probes.retain(func(int) bool { return false })
+		return mp.probe(ms, max, now)
+	}
+
+	if ms.bad-ms.good > 1 {
+		return mp.probe(ms, (ms.good+ms.bad)/2, now)
+	}
+
+	ms.searching = false
+	ms.next = now.Add(time.Duration(mp.interval.Load()))
+
+	found := ms.good
+	if found < min {
+		found = 0
+	}
+
+	if old := ms.effective.Swap(int64(found)); old != int64(found) {
+		if found == 0 {
+			hostinfo.logger(l).WithField("min", min).Warn("No mtu probe was answered, the tunnel mtu is unknown")
+		} else {
+			hostinfo.logger(l).WithField("mtu", found).WithField("previous", old).Info("Discovered tunnel mtu")
+		}
+	}
+
+	return 0, 0
+}
+
+// probe records an outstanding probe of size. Must be called with ms locked.
+func (mp *MTUProbe) probe(ms *mtuState, size int, now time.Time) (int, uint64) {
+	ms.size = size
+	ms.tries = 1
+	return ms.size, ms.probes.send(size, now, mtuProbeTimers)
+}
+
+// handleReply records a test reply to one of our probes as answered, returns false if the reply was not a probe
+func (mp *MTUProbe) handleReply(hostinfo *HostInfo, d []byte, now time.Time) bool {
+	id, ok := mtuProbeMagic.parse(d)
+	if mp == nil || !ok {
+		return false
+	}
+
+	ms := &hostinfo.mtu
+	ms.Lock()
+	defer ms.Unlock()
+	if ms.size == 0 || len(d) != ms.size {
+		return false
+	}
+
+	inTime, ok := ms.probes.reply(ms.size, id, now, mtuProbeTimers)
+	if !ok {
+		return false
+	}
+
+	if inTime {
+		ms.good = ms.size
+		ms.size = 0
+	}
+	return true
+}
+
+// tooBig returns true if packet is larger than the discovered mtu of hostinfo and was refused with an icmp
+// fragmentation needed. Packets without DF set are sent regardless.
+func (f *Interface) tooBig(hostinfo *HostInfo, packet []byte, out []byte, q int) bool {
+	if f.mtuProbe == nil || !f.mtuProbe.enabled.Load() {
+		return false
+	}
+
+	limit := hostinfo.mtu.effective.Load()
+	if limit == 0 || len(packet) <= int(limit) {
+		return false
+	}
+
+	reject := iputil.CreateFragNeededPacket(packet, out, int(limit))
+	if len(reject) == 0 {
+		return false
+	}
+
+	f.mtuProbe.metricTooBig.Inc(1)
+	f.writeInsideReject(reject, q)
+	return true
+}
@@ -0,0 +1,160 @@
+package nebula
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+)
+
+func mtuProbePayload(size int, id uint64) []byte {
+	b := make([]byte, size)
+	copy(b, mtuProbeMagic.payload(id))
+	return b
+}
+
+func TestMTUProbe(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["mtu_probe"] = map[interface{}]interface{}{"enabled": true, "min": 1000, "max": 1500}
+	mp := NewMTUProbeFromConfig(l, c)
+
+	// search runs the probes of a single search over a path that only carries probes up to pathMTU, lose drops the
+	// first probe of each size regardless. It returns the number of probes sent.
+	now := time.Now()
+	search := func(hostinfo *HostInfo, pathMTU int, lose bool) int {
+		sent := 0
+		lost := map[int]bool{}
+		for {
+			size, id := mp.step(l, hostinfo, now)
+			sentAt := now
+			now = now.Add(time.Second)
+			if size == 0 {
+				return sent
+			}
+
+			sent++
+			if size > pathMTU || (lose && !lost[size]) {
+				lost[size] = true
+				continue
+			}
+			assert.True(t, mp.handleReply(hostinfo, mtuProbePayload(size, id), sentAt.Add(10*time.Millisecond)))
+		}
+	}
+
+	t.Log("A path that carries the largest size is done after one probe")
+	hostinfo := &HostInfo{vpnIp: netip.MustParseAddr("172.1.1.2")}
+	assert.Equal(t, 1, search(hostinfo, 9000, false))
+	assert.Equal(t, int64(1500), hostinfo.mtu.effective.Load())
+
+	t.Log("Nothing is sent again until the interval is up")
+	size, _ := mp.step(l, hostinfo, now)
+	assert.Zero(t, size)
+
+	t.Log("A constrained path is found exactly")
+	hostinfo = &HostInfo{vpnIp: netip.MustParseAddr("172.1.1.3")}
+	search(hostinfo, 1372, false)
+	assert.Equal(t, int64(1372), hostinfo.mtu.effective.Load())
+
+	t.Log("A single lost probe does not shrink the mtu")
+	hostinfo = &HostInfo{vpnIp: netip.MustParseAddr("172.1.1.4")}
+	search(hostinfo, 1400, true)
+	assert.Equal(t, int64(1400), hostinfo.mtu.effective.Load())
+
+	t.Log("The next search follows a change in the path")
+	now = now.Add(defaultMTUProbeInterval)
+	search(hostinfo, 1280, false)
+	assert.Equal(t, int64(1280), hostinfo.mtu.effective.Load())
+
+	t.Log("A path that carries nothing leaves the mtu unknown")
+	hostinfo = &HostInfo{vpnIp: netip.MustParseAddr("172.1.1.5")}
+	search(hostinfo, 0, false)
+	assert.Zero(t, hostinfo.mtu.effective.Load())
+
+	t.Log("Replies that are not the outstanding probe are ignored")
+	hostinfo = &HostInfo{vpnIp: netip.MustParseAddr("172.1.1.6")}
+	size, id := mp.step(l, hostinfo, now)
+	assert.False(t, mp.handleReply(hostinfo, mtuProbePayload(size, id+1), now))
+	assert.False(t, mp.handleReply(hostinfo, mtuProbePayload(size-1, id), now))
+	assert.False(t, mp.handleReply(hostinfo, latencyProbeMagic.payload(id), now))
+	assert.True(t, mp.handleReply(hostinfo, mtuProbePayload(size, id), now))
+	assert.False(t, mp.handleReply(hostinfo, mtuProbePayload(size, id), now), "answered twice")
+
+	t.Log("A reply after the next second is lost and the size is probed again")
+	hostinfo = &HostInfo{vpnIp: netip.MustParseAddr("172.1.1.7")}
+	size, id = mp.step(l, hostinfo, now)
+	assert.True(t, mp.handleReply(hostinfo, mtuProbePayload(size, id), now.Add(2*time.Second)), "the reply is still ours")
+	now = now.Add(time.Second)
+	again, _ := mp.step(l, hostinfo, now)
+	assert.Equal(t, size, again)
+
+	var nilProbe *MTUProbe
+	assert.False(t, nilProbe.handleReply(hostinfo, mtuProbePayload(size, id), now))
+}
+
+func TestMTUProbe_reload(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	mp := NewMTUProbeFromConfig(l, c)
+	assert.False(t, mp.enabled.Load())
+	assert.Equal(t, int64(defaultMTUProbeMin), mp.min.Load())
+	assert.Equal(t, int64(1300), mp.max.Load(), "tun.mtu is the default max")
+
+	require.NoError(t, c.ReloadConfigString("tun:\n  mtu: 8000\n"))
+	assert.Equal(t, int64(8000), mp.max.Load())
+
+	require.NoError(t, c.ReloadConfigString("mtu_probe:\n  enabled: true\n  max: 20000\n  min: 1\n  interval: 1s\n  max_rate: 0\n"))
+	assert.True(t, mp.enabled.Load())
+	assert.Equal(t, int64(mtu-mtuProbeOverhead), mp.max.Load())
+	assert.Equal(t, int64(defaultMTUProbeMin), mp.min.Load())
+	assert.Equal(t, int64(defaultMTUProbeInterval), mp.interval.Load())
+	assert.Equal(t, int64(defaultMTUProbeMaxRate), mp.maxRate.Load())
+
+	require.NoError(t, c.ReloadConfigString("mtu_probe:\n  max: 1000\n"))
+	assert.Equal(t, int64(1000), mp.min.Load(), "min is capped at max")
+}
+
+func TestInterface_tooBig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["mtu_probe"] = map[interface{}]interface{}{"enabled": true}
+	mp := NewMTUProbeFromConfig(l, c)
+	mp.metricTooBig = metrics.NewCounter()
+	f := &Interface{l: l, mtuProbe: mp, readers: []io.ReadWriteCloser{&test.NoopTun{}}}
+
+	build := func(size int, flags ipv4.HeaderFlags) []byte {
+		h := ipv4.Header{
+			Version:  4,
+			Len:      ipv4.HeaderLen,
+			TotalLen: size,
+			Src:      net.IPv4(172, 1, 1, 1),
+			Dst:      net.IPv4(172, 1, 1, 2),
+			Protocol: 17,
+			Flags:    flags,
+		}
+		b, err := h.Marshal()
+		require.NoError(t, err)
+		return append(b, make([]byte, size-ipv4.HeaderLen)...)
+	}
+	out := make([]byte, mtu)
+
+	hostinfo := &HostInfo{vpnIp: netip.MustParseAddr("172.1.1.2")}
+	assert.False(t, f.tooBig(hostinfo, build(1400, ipv4.DontFragment), out, 0), "the mtu is unknown")
+
+	hostinfo.mtu.effective.Store(1280)
+	assert.False(t, f.tooBig(hostinfo, build(1280, ipv4.DontFragment), out, 0))
+	assert.False(t, f.tooBig(hostinfo, build(1400, 0), out, 0), "the packet may be fragmented")
+	assert.True(t, f.tooBig(hostinfo, build(1400, ipv4.DontFragment), out, 0))
+	assert.Equal(t, int64(1), mp.metricTooBig.Count())
+
+	mp.enabled.Store(false)
+	assert.False(t, f.tooBig(hostinfo, build(1400, ipv4.DontFragment), out, 0))
+}
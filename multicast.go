@@ -0,0 +1,265 @@
+package nebula
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+)
+
+const defaultMulticastMaxPeers = 16
+
+// multicastHandshakeInterval is how often a handshake is started with an explicitly listed host we have no tunnel with,
+// the handshake manager retries on its own in between
+const multicastHandshakeInterval = 5 * time.Second
+
+var limitedBroadcastAddr = netip.AddrFrom4([4]byte{255, 255, 255, 255})
+
+// OverlayMulticast replicates inner packets sent to configured multicast or broadcast destinations to every member of
+// a peer group. Members are peers with an established tunnel whose certificate has one of the configured groups, or
+// peers explicitly listed in config. Since every packet is sent once per member this is strictly opt-in.
+type OverlayMulticast struct {
+	config atomic.Pointer[multicastConfig]
+
+	metricTx       metrics.Counter
+	metricRx       metrics.Counter
+	metricFanout   metrics.Histogram
+	metricTruncate metrics.Counter
+	l              *logrus.Logger
+}
+
+type multicastConfig struct {
+	destinations []netip.Prefix
+	broadcast    bool
+	groups       []string
+	hosts        []netip.Addr
+	maxPeers     int
+	// handshakeAt is when a handshake was last started with each of hosts, in unix nanoseconds
+	handshakeAt []atomic.Int64
+}
+
+func NewOverlayMulticastFromConfig(l *logrus.Logger, c *config.C) *OverlayMulticast {
+	om := &OverlayMulticast{
+		metricTx:       metrics.GetOrRegisterCounter("multicast.tx", nil),
+		metricRx:       metrics.GetOrRegisterCounter("multicast.rx", nil),
+		metricFanout:   metrics.GetOrRegisterHistogram("multicast.fanout", nil, metrics.NewExpDecaySample(1028, 0.015)),
+		metricTruncate: metrics.GetOrRegisterCounter("multicast.fanout_limited", nil),
+		l:              l,
+	}
+
+	om.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		om.reload(c, false)
+	})
+
+	return om
+}
+
+func (om *OverlayMulticast) reload(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("multicast") {
+		return
+	}
+
+	if !c.GetBool("multicast.enabled", false) {
+		om.config.Store(nil)
+		if !initial {
+			om.l.Info("Overlay multicast disabled")
+		}
+		return
+	}
+
+	mc := &multicastConfig{
+		broadcast: c.GetBool("multicast.broadcast", false),
+		groups:    c.GetStringSlice("multicast.groups", []string{}),
+		maxPeers:  c.GetInt("multicast.max_peers", defaultMulticastMaxPeers),
+	}
+
+	if mc.maxPeers < 1 {
+		om.l.WithField("maxPeers", mc.maxPeers).Warn("multicast.max_peers must be at least 1, using the default")
+		mc.maxPeers = defaultMulticastMaxPeers
+	}
+
+	for _, raw := range c.GetStringSlice("multicast.destinations", []string{}) {
+		prefix, err := parsePrefixOrAddr(raw)
+		if err != nil {
+			om.l.WithError(err).WithField("destination", raw).Warn("Failed to parse multicast.destinations, ignoring")
+			continue
+		}
+
+		if !prefix.Addr().IsMulticast() {
+			om.l.WithField("destination", raw).Warn("multicast.destinations entry is not a multicast address, ignoring")
+			continue
+		}
+		mc.destinations = append(mc.destinations, prefix)
+	}
+
+	for _, raw := range c.GetStringSlice("multicast.hosts", []string{}) {
+		addr, err := netip.ParseAddr(raw)
+		if err != nil {
+			om.l.WithError(err).WithField("host", raw).Warn("Failed to parse multicast.hosts, ignoring")
+			continue
+		}
+		mc.hosts = append(mc.hosts, addr)
+	}
+	mc.handshakeAt = make([]atomic.Int64, len(mc.hosts))
+
+	om.config.Store(mc)
+	om.l.WithField("destinations", mc.destinations).
+		WithField("broadcast", mc.broadcast).
+		WithField("groups", mc.groups).
+		WithField("hosts", mc.hosts).
+		WithField("maxPeers", mc.maxPeers).
+		Info("Overlay multicast enabled")
+}
+
+// parsePrefixOrAddr accepts either a cidr or a bare ip, which is treated as a single address prefix
+func parsePrefixOrAddr(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err == nil {
+		return prefix.Masked(), nil
+	}
+
+	addr, aerr := netip.ParseAddr(s)
+	if aerr != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// isDestination returns the active config if ip is a destination that should be replicated, nil otherwise
+func (om *OverlayMulticast) isDestination(ip, broadcastAddr netip.Addr) *multicastConfig {
+	if om == nil {
+		return nil
+	}
+
+	mc := om.config.Load()
+	if mc == nil {
+		return nil
+	}
+
+	if mc.broadcast && (ip == broadcastAddr || ip == limitedBroadcastAddr) {
+		return mc
+	}
+
+	for _, prefix := range mc.destinations {
+		if prefix.Contains(ip) {
+			return mc
+		}
+	}
+	return nil
+}
+
+// isMember returns true if the peer on the other side of hostinfo should receive replicated packets
+func (mc *multicastConfig) isMember(hostinfo *HostInfo) bool {
+	for _, host := range mc.hosts {
+		if host == hostinfo.vpnIp {
+			return true
+		}
+	}
+
+	peerCert := hostinfo.GetCert()
+	if peerCert == nil {
+		return false
+	}
+
+	for _, want := range mc.groups {
+		if _, ok := peerCert.Details.InvertedGroups[want]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// handshakeDue returns true if a handshake should be started with hosts[i] now, at most once per
+// multicastHandshakeInterval no matter how many packets are replicated
+func (mc *multicastConfig) handshakeDue(i int, now time.Time) bool {
+	last := mc.handshakeAt[i].Load()
+	if last != 0 && now.UnixNano()-last < int64(multicastHandshakeInterval) {
+		return false
+	}
+	return mc.handshakeAt[i].CompareAndSwap(last, now.UnixNano())
+}
+
+// multicastMembers returns up to max_peers established tunnels that are members of the peer group. Explicitly listed
+// hosts without a tunnel will have a handshake started so they receive later packets, see handshakeDue.
+func (f *Interface) multicastMembers(mc *multicastConfig) []*HostInfo {
+	members := make([]*HostInfo, 0, mc.maxPeers)
+	truncated := false
+
+	f.hostMap.RLock()
+	for _, hostinfo := range f.hostMap.Hosts {
+		if !mc.isMember(hostinfo) {
+			continue
+		}
+
+		if len(members) == mc.maxPeers {
+			truncated = true
+			break
+		}
+		members = append(members, hostinfo)
+	}
+	f.hostMap.RUnlock()
+
+	if f.handshakeManager != nil {
+		now := time.Now()
+		for i, host := range mc.hosts {
+			if f.hostMap.QueryVpnIp(host) == nil && mc.handshakeDue(i, now) {
+				f.handshakeManager.StartHandshake(host, nil)
+			}
+		}
+	}
+
+	if truncated {
+		f.multicast.metricTruncate.Inc(1)
+	}
+	return members
+}
+
+// sendMulticast encrypts a copy of packet to each member of the peer group. The outbound firewall is evaluated per
+// member as if the packet were addressed to that member's vpn ip.
+func (f *Interface) sendMulticast(mc *multicastConfig, packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache) {
+	members := f.multicastMembers(mc)
+	f.multicast.metricFanout.Update(int64(len(members)))
+
+	caPool := f.pki.GetCAPool()
+	for _, hostinfo := range members {
+		if f.tunnelPause.dropOutgoing(hostinfo) {
+			continue
+		}
+
+		fp := *fwPacket
+		fp.RemoteIP = hostinfo.vpnIp
+		if dropRule, dropReason := f.firewall.DropRule(fp, false, false, hostinfo, caPool, localCache); dropReason != nil {
+			hostinfo.errCounters.firewallDrops.Add(1)
+			f.dropWatch.notify(fp, false, hostinfo, dropRule, dropReason)
+			f.securityEvents.Load().firewallDrop(fp, false, hostinfo, dropRule, dropReason)
+			if f.l.Level >= logrus.DebugLevel {
+				hostinfo.logger(f.l).
+					WithField("fwPacket", fwPacket).
+					WithField("reason", dropReason).
+					WithField("rule", dropRule).
+					Debugln("dropping outbound multicast packet")
+			}
+			continue
+		}
+
+		f.multicast.metricTx.Inc(1)
+		hostinfo.markData()
+		f.sendNoMetricsFlow(header.Message, 0, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, &fp, packet, nb, out, q)
+	}
+}
+
+// multicastInbound rewrites the local ip of an inbound packet sent to a replicated destination to our vpn ip so the
+// inbound firewall evaluates it like any other packet addressed to us
+func (f *Interface) multicastInbound(fp firewall.Packet) firewall.Packet {
+	if f.multicast.isDestination(fp.LocalIP, f.myBroadcastAddr) != nil {
+		f.multicast.metricRx.Inc(1)
+		fp.LocalIP = f.myVpnNet.Addr()
+	}
+	return fp
+}
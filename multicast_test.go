@@ -0,0 +1,116 @@
+package nebula
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverlayMulticast_reload(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	broadcast := netip.MustParseAddr("10.1.255.255")
+	mdns := netip.MustParseAddr("224.0.0.251")
+
+	// Disabled by default
+	om := NewOverlayMulticastFromConfig(l, c)
+	assert.Nil(t, om.isDestination(mdns, broadcast))
+
+	var nilOm *OverlayMulticast
+	assert.Nil(t, nilOm.isDestination(mdns, broadcast))
+
+	c.Settings["multicast"] = map[interface{}]interface{}{
+		"enabled":      true,
+		"destinations": []interface{}{"224.0.0.251", "239.255.0.0/16", "10.1.0.1", "nope"},
+		"max_peers":    0,
+	}
+	om.reload(c, true)
+
+	mc := om.isDestination(mdns, broadcast)
+	assert.NotNil(t, mc)
+	assert.Equal(t, defaultMulticastMaxPeers, mc.maxPeers)
+	assert.NotNil(t, om.isDestination(netip.MustParseAddr("239.255.255.250"), broadcast))
+	assert.Nil(t, om.isDestination(netip.MustParseAddr("224.0.0.252"), broadcast))
+	assert.Nil(t, om.isDestination(netip.MustParseAddr("10.1.0.1"), broadcast), "unicast destinations are ignored")
+	assert.Nil(t, om.isDestination(broadcast, broadcast), "broadcast is off by default")
+
+	c.Settings["multicast"].(map[interface{}]interface{})["broadcast"] = true
+	om.reload(c, true)
+	assert.NotNil(t, om.isDestination(broadcast, broadcast))
+	assert.NotNil(t, om.isDestination(netip.MustParseAddr("255.255.255.255"), broadcast))
+}
+
+func TestInterface_multicastMembers(t *testing.T) {
+	l := test.NewLogger()
+	f := &Interface{
+		hostMap:   newHostMap(l, netip.MustParsePrefix("10.1.0.1/16")),
+		multicast: NewOverlayMulticastFromConfig(l, config.NewC(l)),
+	}
+	f.multicast.metricTruncate = metrics.NewCounter()
+
+	newHost := func(ip string, groups ...string) *HostInfo {
+		crt := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{InvertedGroups: map[string]struct{}{}}}
+		for _, g := range groups {
+			crt.Details.InvertedGroups[g] = struct{}{}
+		}
+		h := &HostInfo{vpnIp: netip.MustParseAddr(ip), ConnectionState: &ConnectionState{peerCert: crt}}
+		f.hostMap.unlockedAddHostInfo(h, f)
+		return h
+	}
+
+	a := newHost("10.1.0.2", "discovery")
+	b := newHost("10.1.0.3", "discovery", "other")
+	newHost("10.1.0.4", "other")
+	d := newHost("10.1.0.5")
+
+	mc := &multicastConfig{groups: []string{"discovery"}, hosts: []netip.Addr{d.vpnIp}, handshakeAt: make([]atomic.Int64, 1), maxPeers: 16}
+	assert.ElementsMatch(t, []*HostInfo{a, b, d}, f.multicastMembers(mc))
+	assert.Equal(t, int64(0), f.multicast.metricTruncate.Count())
+
+	// Fan-out is bounded
+	mc.maxPeers = 2
+	assert.Len(t, f.multicastMembers(mc), 2)
+	assert.Equal(t, int64(1), f.multicast.metricTruncate.Count())
+}
+
+func TestMulticastConfig_handshakeDue(t *testing.T) {
+	mc := &multicastConfig{hosts: []netip.Addr{netip.MustParseAddr("10.1.0.2"), netip.MustParseAddr("10.1.0.3")}}
+	mc.handshakeAt = make([]atomic.Int64, len(mc.hosts))
+	now := time.Now()
+
+	assert.True(t, mc.handshakeDue(0, now))
+	assert.False(t, mc.handshakeDue(0, now.Add(time.Second)), "not for every replicated packet")
+	assert.True(t, mc.handshakeDue(1, now.Add(time.Second)), "each host has its own interval")
+	assert.True(t, mc.handshakeDue(0, now.Add(multicastHandshakeInterval)))
+	assert.False(t, mc.handshakeDue(0, now.Add(multicastHandshakeInterval)))
+}
+
+func TestInterface_multicastInbound(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["multicast"] = map[interface{}]interface{}{
+		"enabled":      true,
+		"destinations": []interface{}{"224.0.0.251"},
+	}
+
+	f := &Interface{
+		myVpnNet:        netip.MustParsePrefix("10.1.0.1/16"),
+		myBroadcastAddr: netip.MustParseAddr("10.1.255.255"),
+		multicast:       NewOverlayMulticastFromConfig(l, c),
+	}
+
+	fp := firewall.Packet{LocalIP: netip.MustParseAddr("224.0.0.251"), RemoteIP: netip.MustParseAddr("10.1.0.2")}
+	assert.Equal(t, f.myVpnNet.Addr(), f.multicastInbound(fp).LocalIP)
+	assert.Equal(t, netip.MustParseAddr("224.0.0.251"), fp.LocalIP, "the original packet is not modified")
+
+	fp.LocalIP = netip.MustParseAddr("224.0.0.252")
+	assert.Equal(t, fp.LocalIP, f.multicastInbound(fp).LocalIP)
+}
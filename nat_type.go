@@ -0,0 +1,157 @@
+package nebula
+
+import (
+	"net/netip"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NATType is our best guess at the kind of NAT between this host and the lighthouses. It is reported, not acted on.
+type NATType string
+
+const (
+	// NATUnknown means there are not enough observations to tell, usually because only one lighthouse has answered
+	NATUnknown NATType = "unknown"
+	// NATNone means a lighthouse saw one of our own interface addresses and listen port
+	NATNone NATType = "none"
+	// NATCone means every lighthouse saw the same public address and port, the NAT maps our socket the same way no
+	// matter who we talk to and hole punching is likely to work
+	NATCone NATType = "cone"
+	// NATSymmetric means lighthouses saw different public ports for the same socket, the NAT allocates a new mapping per
+	// destination and hole punching with other NATed hosts is unlikely to work
+	NATSymmetric NATType = "symmetric"
+)
+
+// NATObservation is the address a single lighthouse saw our most recent host update come from
+type NATObservation struct {
+	Lighthouse netip.Addr     `json:"lighthouse"`
+	Addr       netip.AddrPort `json:"addr"`
+	Time       time.Time      `json:"time"`
+}
+
+// NATStatus is the current NAT classification and the observations it was made from
+type NATStatus struct {
+	Type     NATType          `json:"type"`
+	Observed []NATObservation `json:"observed"`
+}
+
+// natState tracks what each lighthouse reported back in its HostUpdateNotificationAck
+type natState struct {
+	sync.Mutex
+	observed   map[netip.Addr]NATObservation
+	localAddrs []netip.AddrPort
+	natType    NATType
+}
+
+// setLocalAddrs records the interface addresses we reported in our last host update
+func (lh *LightHouse) setLocalAddrs(addrs []netip.AddrPort) {
+	lh.nat.Lock()
+	lh.nat.localAddrs = addrs
+	lh.nat.Unlock()
+}
+
+// observeNAT records the address lighthouse saw our host update come from and reclassifies our NAT
+func (lh *LightHouse) observeNAT(lighthouse netip.Addr, addr netip.AddrPort, now time.Time) {
+	lh.nat.Lock()
+	defer lh.nat.Unlock()
+
+	if lh.nat.observed == nil {
+		lh.nat.observed = map[netip.Addr]NATObservation{}
+	}
+	lh.nat.observed[lighthouse] = NATObservation{Lighthouse: lighthouse, Addr: addr, Time: now}
+
+	natType, observed := lh.unlockedClassifyNAT(now)
+	if natType != lh.nat.natType {
+		lh.l.WithField("natType", natType).WithField("observed", observed).Info("NAT type changed")
+		lh.nat.natType = natType
+	}
+}
+
+// unlockedClassifyNAT classifies our NAT from the current observations. lh.nat must be locked.
+func (lh *LightHouse) unlockedClassifyNAT(now time.Time) (NATType, []NATObservation) {
+	observed := lh.unlockedNATObservations(now)
+	addrs := make([]netip.AddrPort, len(observed))
+	for i, o := range observed {
+		addrs[i] = o.Addr
+	}
+
+	return classifyNAT(addrs, lh.nat.localAddrs), observed
+}
+
+// unlockedNATObservations drops observations from hosts that are no longer lighthouses or that have not been refreshed
+// in a few update intervals and returns the rest sorted by lighthouse. lh.nat must be locked.
+func (lh *LightHouse) unlockedNATObservations(now time.Time) []NATObservation {
+	lighthouses := lh.GetLighthouses()
+	maxAge := 3 * time.Duration(lh.interval.Load()) * time.Second
+
+	out := make([]NATObservation, 0, len(lh.nat.observed))
+	for vpnIp, o := range lh.nat.observed {
+		_, ok := lighthouses[vpnIp]
+		if !ok || (maxAge > 0 && now.Sub(o.Time) > maxAge) {
+			delete(lh.nat.observed, vpnIp)
+			continue
+		}
+		out = append(out, o)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Lighthouse.Less(out[j].Lighthouse)
+	})
+	return out
+}
+
+// GetNATStatus returns the current NAT classification along with the lighthouse observations it was made from
+func (lh *LightHouse) GetNATStatus() NATStatus {
+	lh.nat.Lock()
+	defer lh.nat.Unlock()
+
+	natType, observed := lh.unlockedClassifyNAT(time.Now())
+	return NATStatus{Type: natType, Observed: observed}
+}
+
+// classifyNAT compares the addresses the lighthouses saw our updates come from. Each lighthouse is a different
+// destination, if our socket is seen with the same public address and port by all of them the NAT mapping is endpoint
+// independent. Addresses are only compared within the same family.
+func classifyNAT(observed []netip.AddrPort, localAddrs []netip.AddrPort) NATType {
+	if len(observed) == 0 {
+		return NATUnknown
+	}
+
+	allLocal := true
+	for _, addr := range observed {
+		if !slices.Contains(localAddrs, addr) {
+			allLocal = false
+			break
+		}
+	}
+	if allLocal {
+		return NATNone
+	}
+
+	var v4, v6 []netip.AddrPort
+	for _, addr := range observed {
+		if addr.Addr().Unmap().Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+
+	natType := NATUnknown
+	for _, addrs := range [][]netip.AddrPort{v4, v6} {
+		if len(addrs) < 2 {
+			continue
+		}
+
+		for _, addr := range addrs[1:] {
+			if addr != addrs[0] {
+				return NATSymmetric
+			}
+		}
+		natType = NATCone
+	}
+
+	return natType
+}
@@ -0,0 +1,129 @@
+package nebula
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyNAT(t *testing.T) {
+	local := []netip.AddrPort{
+		netip.MustParseAddrPort("10.0.0.2:4242"),
+		netip.MustParseAddrPort("[fd00::2]:4242"),
+	}
+
+	tests := []struct {
+		name     string
+		observed []string
+		expected NATType
+	}{
+		{"nothing observed", nil, NATUnknown},
+		{"seen as ourselves", []string{"10.0.0.2:4242", "10.0.0.2:4242"}, NATNone},
+		{"single lighthouse", []string{"1.1.1.1:4242"}, NATUnknown},
+		{"same mapping", []string{"1.1.1.1:51820", "1.1.1.1:51820"}, NATCone},
+		{"port changes per destination", []string{"1.1.1.1:51820", "1.1.1.1:51821"}, NATSymmetric},
+		{"address changes per destination", []string{"1.1.1.1:51820", "1.1.1.2:51820"}, NATSymmetric},
+		{"families are not compared", []string{"1.1.1.1:51820", "[2001:db8::1]:4242"}, NATUnknown},
+		{"v6 is open, v4 is symmetric", []string{"[fd00::2]:4242", "1.1.1.1:1", "1.1.1.1:2"}, NATSymmetric},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var observed []netip.AddrPort
+			for _, o := range tt.observed {
+				observed = append(observed, netip.MustParseAddrPort(o))
+			}
+			assert.Equal(t, tt.expected, classifyNAT(observed, local))
+		})
+	}
+}
+
+func TestLighthouse_NATObservation(t *testing.T) {
+	l := test.NewLogger()
+	myVpnIp := netip.MustParseAddr("10.128.0.2")
+	myPublicAddr := netip.MustParseAddrPort("1.1.1.1:51820")
+
+	// The lighthouse reports where it saw our update come from in the ack
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, netip.MustParsePrefix("10.128.0.1/24"), nil, nil)
+	require.NoError(t, err)
+
+	bip := myVpnIp.As4()
+	update := &NebulaMeta{
+		Type:    NebulaMeta_HostUpdateNotification,
+		Details: &NebulaMetaDetails{VpnIp: binary.BigEndian.Uint32(bip[:])},
+	}
+	b, err := update.Marshal()
+	require.NoError(t, err)
+
+	filter := NebulaMeta_HostUpdateNotificationAck
+	w := &testEncWriter{metaFilter: &filter}
+	lh.NewRequestHandler().HandleRequest(myPublicAddr, myVpnIp, b, w)
+	require.NotNil(t, w.lastReply.msg)
+	assert.Equal(t, myPublicAddr, AddrPortFromIp4AndPort(w.lastReply.msg.Details.ObservedIp4AndPort))
+	assert.Nil(t, w.lastReply.msg.Details.ObservedIp6AndPort)
+
+	// The client classifies based on what every lighthouse saw
+	lh1 := netip.MustParseAddr("10.128.0.1")
+	lh2 := netip.MustParseAddr("10.128.0.3")
+	c = config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"hosts": []interface{}{lh1.String(), lh2.String()}}
+	c.Settings["static_host_map"] = map[interface{}]interface{}{
+		lh1.String(): []interface{}{"100.1.1.1:4242"},
+		lh2.String(): []interface{}{"100.1.1.2:4242"},
+	}
+	client, err := NewLightHouseFromConfig(context.Background(), l, c, netip.MustParsePrefix("10.128.0.2/24"), nil, nil)
+	require.NoError(t, err)
+	lhh := client.NewRequestHandler()
+	assert.Equal(t, NATUnknown, client.GetNATStatus().Type)
+
+	ack := func(from netip.Addr, observed netip.AddrPort) {
+		m := &NebulaMeta{
+			Type: NebulaMeta_HostUpdateNotificationAck,
+			Details: &NebulaMetaDetails{
+				VpnIp:              binary.BigEndian.Uint32(bip[:]),
+				ObservedIp4AndPort: NewIp4AndPortFromNetIP(observed.Addr(), observed.Port()),
+			},
+		}
+		b, err := m.Marshal()
+		require.NoError(t, err)
+		lhh.HandleRequest(netip.MustParseAddrPort("100.1.1.1:4242"), from, b, &testEncWriter{})
+	}
+
+	ack(lh1, myPublicAddr)
+	assert.Equal(t, NATUnknown, client.GetNATStatus().Type)
+
+	ack(lh2, myPublicAddr)
+	s := client.GetNATStatus()
+	assert.Equal(t, NATCone, s.Type)
+	if assert.Len(t, s.Observed, 2) {
+		assert.Equal(t, lh1, s.Observed[0].Lighthouse)
+		assert.Equal(t, myPublicAddr, s.Observed[0].Addr)
+	}
+
+	ack(lh2, netip.MustParseAddrPort("1.1.1.1:51821"))
+	assert.Equal(t, NATSymmetric, client.GetNATStatus().Type)
+
+	// Acks from hosts that are not lighthouses are ignored
+	ack(netip.MustParseAddr("10.128.0.4"), myPublicAddr)
+	assert.Len(t, client.GetNATStatus().Observed, 2)
+
+	// Stale observations are dropped
+	client.nat.Lock()
+	o := client.nat.observed[lh2]
+	o.Time = time.Now().Add(-time.Hour)
+	client.nat.observed[lh2] = o
+	client.nat.Unlock()
+	s = client.GetNATStatus()
+	assert.Equal(t, NATUnknown, s.Type)
+	assert.Len(t, s.Observed, 1)
+}
@@ -105,18 +105,30 @@ const (
 	NebulaControl_None                NebulaControl_MessageType = 0
 	NebulaControl_CreateRelayRequest  NebulaControl_MessageType = 1
 	NebulaControl_CreateRelayResponse NebulaControl_MessageType = 2
+	NebulaControl_RelayDraining       NebulaControl_MessageType = 3
+	NebulaControl_RelayMigrated       NebulaControl_MessageType = 4
+	NebulaControl_RelayTeardown       NebulaControl_MessageType = 5
+	NebulaControl_RelayTeardownAck    NebulaControl_MessageType = 6
 )
 
 var NebulaControl_MessageType_name = map[int32]string{
 	0: "None",
 	1: "CreateRelayRequest",
 	2: "CreateRelayResponse",
+	3: "RelayDraining",
+	4: "RelayMigrated",
+	5: "RelayTeardown",
+	6: "RelayTeardownAck",
 }
 
 var NebulaControl_MessageType_value = map[string]int32{
 	"None":                0,
 	"CreateRelayRequest":  1,
 	"CreateRelayResponse": 2,
+	"RelayDraining":       3,
+	"RelayMigrated":       4,
+	"RelayTeardown":       5,
+	"RelayTeardownAck":    6,
 }
 
 func (x NebulaControl_MessageType) String() string {
@@ -185,6 +197,11 @@ type NebulaMetaDetails struct {
 	Ip6AndPorts []*Ip6AndPort `protobuf:"bytes,4,rep,name=Ip6AndPorts,proto3" json:"Ip6AndPorts,omitempty"`
 	RelayVpnIp  []uint32      `protobuf:"varint,5,rep,packed,name=RelayVpnIp,proto3" json:"RelayVpnIp,omitempty"`
 	Counter     uint32        `protobuf:"varint,3,opt,name=counter,proto3" json:"counter,omitempty"`
+	// Set by a lighthouse in a HostUpdateNotificationAck to the address the update was received from
+	ObservedIp4AndPort *Ip4AndPort `protobuf:"bytes,6,opt,name=ObservedIp4AndPort,proto3" json:"ObservedIp4AndPort,omitempty"`
+	ObservedIp6AndPort *Ip6AndPort `protobuf:"bytes,7,opt,name=ObservedIp6AndPort,proto3" json:"ObservedIp6AndPort,omitempty"`
+	// Ip4AndPorts and Ip6AndPorts sealed with lighthouse.address_encryption, lighthouses relay it without opening it
+	EncryptedAddrs []byte `protobuf:"bytes,8,opt,name=EncryptedAddrs,proto3" json:"EncryptedAddrs,omitempty"`
 }
 
 func (m *NebulaMetaDetails) Reset()         { *m = NebulaMetaDetails{} }
@@ -255,6 +272,27 @@ func (m *NebulaMetaDetails) GetCounter() uint32 {
 	return 0
 }
 
+func (m *NebulaMetaDetails) GetObservedIp4AndPort() *Ip4AndPort {
+	if m != nil {
+		return m.ObservedIp4AndPort
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetObservedIp6AndPort() *Ip6AndPort {
+	if m != nil {
+		return m.ObservedIp6AndPort
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetEncryptedAddrs() []byte {
+	if m != nil {
+		return m.EncryptedAddrs
+	}
+	return nil
+}
+
 type Ip4AndPort struct {
 	Ip   uint32 `protobuf:"varint,1,opt,name=Ip,proto3" json:"Ip,omitempty"`
 	Port uint32 `protobuf:"varint,2,opt,name=Port,proto3" json:"Port,omitempty"`
@@ -477,6 +515,13 @@ type NebulaHandshakeDetails struct {
 	ResponderIndex uint32 `protobuf:"varint,3,opt,name=ResponderIndex,proto3" json:"ResponderIndex,omitempty"`
 	Cookie         uint64 `protobuf:"varint,4,opt,name=Cookie,proto3" json:"Cookie,omitempty"`
 	Time           uint64 `protobuf:"varint,5,opt,name=Time,proto3" json:"Time,omitempty"`
+	// Set if the sender is willing to send data without encryption, see auth_only in the example config
+	AuthOnly bool `protobuf:"varint,8,opt,name=AuthOnly,proto3" json:"AuthOnly,omitempty"`
+	// W3C traceparent of the initiator's handshake span, set if it has tracing enabled
+	TraceParent string `protobuf:"bytes,9,opt,name=TraceParent,proto3" json:"TraceParent,omitempty"`
+	// The sender's user certificate without its public key, set if it has pki.user.cert. It is recombined with the same
+	// static key as Cert, see pki.user in the example config
+	UserCert []byte `protobuf:"bytes,10,opt,name=UserCert,proto3" json:"UserCert,omitempty"`
 }
 
 func (m *NebulaHandshakeDetails) Reset()         { *m = NebulaHandshakeDetails{} }
@@ -547,12 +592,35 @@ func (m *NebulaHandshakeDetails) GetTime() uint64 {
 	return 0
 }
 
+func (m *NebulaHandshakeDetails) GetAuthOnly() bool {
+	if m != nil {
+		return m.AuthOnly
+	}
+	return false
+}
+
+func (m *NebulaHandshakeDetails) GetTraceParent() string {
+	if m != nil {
+		return m.TraceParent
+	}
+	return ""
+}
+
+func (m *NebulaHandshakeDetails) GetUserCert() []byte {
+	if m != nil {
+		return m.UserCert
+	}
+	return nil
+}
+
 type NebulaControl struct {
 	Type                NebulaControl_MessageType `protobuf:"varint,1,opt,name=Type,proto3,enum=nebula.NebulaControl_MessageType" json:"Type,omitempty"`
 	InitiatorRelayIndex uint32                    `protobuf:"varint,2,opt,name=InitiatorRelayIndex,proto3" json:"InitiatorRelayIndex,omitempty"`
 	ResponderRelayIndex uint32                    `protobuf:"varint,3,opt,name=ResponderRelayIndex,proto3" json:"ResponderRelayIndex,omitempty"`
 	RelayToIp           uint32                    `protobuf:"varint,4,opt,name=RelayToIp,proto3" json:"RelayToIp,omitempty"`
 	RelayFromIp         uint32                    `protobuf:"varint,5,opt,name=RelayFromIp,proto3" json:"RelayFromIp,omitempty"`
+	// W3C traceparent of the span that sent this message, set if the sender has tracing enabled
+	TraceParent string `protobuf:"bytes,6,opt,name=TraceParent,proto3" json:"TraceParent,omitempty"`
 }
 
 func (m *NebulaControl) Reset()         { *m = NebulaControl{} }
@@ -623,6 +691,13 @@ func (m *NebulaControl) GetRelayFromIp() uint32 {
 	return 0
 }
 
+func (m *NebulaControl) GetTraceParent() string {
+	if m != nil {
+		return m.TraceParent
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterEnum("nebula.NebulaMeta_MessageType", NebulaMeta_MessageType_name, NebulaMeta_MessageType_value)
 	proto.RegisterEnum("nebula.NebulaPing_MessageType", NebulaPing_MessageType_name, NebulaPing_MessageType_value)
@@ -640,52 +715,61 @@ func init() {
 func init() { proto.RegisterFile("nebula.proto", fileDescriptor_2d65afa7693df5ef) }
 
 var fileDescriptor_2d65afa7693df5ef = []byte{
-	// 707 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x54, 0x4d, 0x6f, 0xda, 0x4a,
-	0x14, 0xc5, 0xc6, 0x7c, 0x5d, 0x02, 0xf1, 0xbb, 0x79, 0x8f, 0x07, 0x4f, 0xaf, 0x16, 0xf5, 0xa2,
-	0x62, 0x45, 0x22, 0x92, 0x46, 0x5d, 0x36, 0xa5, 0xaa, 0x20, 0x4a, 0x22, 0x3a, 0x4a, 0x5b, 0xa9,
-	0x9b, 0x6a, 0x62, 0xa6, 0xc1, 0x02, 0x3c, 0x8e, 0x3d, 0x54, 0xe1, 0x5f, 0xf4, 0xc7, 0xe4, 0x47,
-	0x74, 0xd7, 0x2c, 0xbb, 0xac, 0x92, 0x65, 0x97, 0xfd, 0x03, 0xd5, 0x8c, 0xc1, 0x36, 0x84, 0x76,
-	0x37, 0xe7, 0xde, 0x73, 0x66, 0xce, 0x9c, 0xb9, 0x36, 0x6c, 0x79, 0xec, 0x62, 0x36, 0xa1, 0x6d,
-	0x3f, 0xe0, 0x82, 0x63, 0x3e, 0x42, 0xf6, 0x0f, 0x1d, 0xe0, 0x4c, 0x2d, 0x4f, 0x99, 0xa0, 0xd8,
-	0x01, 0xe3, 0x7c, 0xee, 0xb3, 0xba, 0xd6, 0xd4, 0x5a, 0xd5, 0x8e, 0xd5, 0x5e, 0x68, 0x12, 0x46,
-	0xfb, 0x94, 0x85, 0x21, 0xbd, 0x64, 0x92, 0x45, 0x14, 0x17, 0xf7, 0xa1, 0xf0, 0x92, 0x09, 0xea,
-	0x4e, 0xc2, 0xba, 0xde, 0xd4, 0x5a, 0xe5, 0x4e, 0xe3, 0xa1, 0x6c, 0x41, 0x20, 0x4b, 0xa6, 0xfd,
-	0x53, 0x83, 0x72, 0x6a, 0x2b, 0x2c, 0x82, 0x71, 0xc6, 0x3d, 0x66, 0x66, 0xb0, 0x02, 0xa5, 0x1e,
-	0x0f, 0xc5, 0xeb, 0x19, 0x0b, 0xe6, 0xa6, 0x86, 0x08, 0xd5, 0x18, 0x12, 0xe6, 0x4f, 0xe6, 0xa6,
-	0x8e, 0xff, 0x41, 0x4d, 0xd6, 0xde, 0xf8, 0x43, 0x2a, 0xd8, 0x19, 0x17, 0xee, 0x47, 0xd7, 0xa1,
-	0xc2, 0xe5, 0x9e, 0x99, 0xc5, 0x06, 0xfc, 0x23, 0x7b, 0xa7, 0xfc, 0x13, 0x1b, 0xae, 0xb4, 0x8c,
-	0x65, 0x6b, 0x30, 0xf3, 0x9c, 0xd1, 0x4a, 0x2b, 0x87, 0x55, 0x00, 0xd9, 0x7a, 0x37, 0xe2, 0x74,
-	0xea, 0x9a, 0x79, 0xdc, 0x81, 0xed, 0x04, 0x47, 0xc7, 0x16, 0xa4, 0xb3, 0x01, 0x15, 0xa3, 0xee,
-	0x88, 0x39, 0x63, 0xb3, 0x28, 0x9d, 0xc5, 0x30, 0xa2, 0x94, 0xf0, 0x11, 0x34, 0x36, 0x3b, 0x3b,
-	0x72, 0xc6, 0x26, 0xd8, 0x5f, 0x35, 0xf8, 0xeb, 0x41, 0x28, 0xf8, 0x37, 0xe4, 0xde, 0xfa, 0x5e,
-	0xdf, 0x57, 0xa9, 0x57, 0x48, 0x04, 0xf0, 0x00, 0xca, 0x7d, 0xff, 0xe0, 0xc8, 0x1b, 0x0e, 0x78,
-	0x20, 0x64, 0xb4, 0xd9, 0x56, 0xb9, 0x83, 0xcb, 0x68, 0x93, 0x16, 0x49, 0xd3, 0x22, 0xd5, 0x61,
-	0xac, 0x32, 0xd6, 0x55, 0x87, 0x29, 0x55, 0x4c, 0x43, 0x0b, 0x80, 0xb0, 0x09, 0x9d, 0x47, 0x36,
-	0x72, 0xcd, 0x6c, 0xab, 0x42, 0x52, 0x15, 0xac, 0x43, 0xc1, 0xe1, 0x33, 0x4f, 0xb0, 0xa0, 0x9e,
-	0x55, 0x1e, 0x97, 0xd0, 0xde, 0x03, 0x48, 0x8e, 0xc7, 0x2a, 0xe8, 0xf1, 0x35, 0xf4, 0xbe, 0x8f,
-	0x08, 0x86, 0xac, 0xab, 0xb9, 0xa8, 0x10, 0xb5, 0xb6, 0x9f, 0x4b, 0xc5, 0x61, 0x4a, 0xd1, 0x73,
-	0x95, 0xc2, 0x20, 0x7a, 0xcf, 0x95, 0xf8, 0x84, 0x2b, 0xbe, 0x41, 0xf4, 0x13, 0x1e, 0xef, 0x90,
-	0x4d, 0xed, 0x70, 0xbd, 0x1c, 0xd9, 0x81, 0xeb, 0x5d, 0xfe, 0x79, 0x64, 0x25, 0x63, 0xc3, 0xc8,
-	0x22, 0x18, 0xe7, 0xee, 0x94, 0x2d, 0xce, 0x51, 0x6b, 0xdb, 0x7e, 0x30, 0x90, 0x52, 0x6c, 0x66,
-	0xb0, 0x04, 0xb9, 0xe8, 0x79, 0x35, 0xfb, 0x03, 0x6c, 0x47, 0xfb, 0xf6, 0xa8, 0x37, 0x0c, 0x47,
-	0x74, 0xcc, 0xf0, 0x59, 0x32, 0xfd, 0x9a, 0x9a, 0xfe, 0x35, 0x07, 0x31, 0x73, 0xfd, 0x13, 0x90,
-	0x26, 0x7a, 0x53, 0xea, 0x28, 0x13, 0x5b, 0x44, 0xad, 0xed, 0x1b, 0x0d, 0x6a, 0x9b, 0x75, 0x92,
-	0xde, 0x65, 0x81, 0x50, 0xa7, 0x6c, 0x11, 0xb5, 0xc6, 0x27, 0x50, 0xed, 0x7b, 0xae, 0x70, 0xa9,
-	0xe0, 0x41, 0xdf, 0x1b, 0xb2, 0xeb, 0x45, 0xd2, 0x6b, 0x55, 0xc9, 0x23, 0x2c, 0xf4, 0xb9, 0x37,
-	0x64, 0x0b, 0x5e, 0x94, 0xe7, 0x5a, 0x15, 0x6b, 0x90, 0xef, 0x72, 0x3e, 0x76, 0x59, 0xdd, 0x50,
-	0xc9, 0x2c, 0x50, 0x9c, 0x57, 0x2e, 0xc9, 0xeb, 0xd8, 0x28, 0xe6, 0xcd, 0xc2, 0xb1, 0x51, 0x2c,
-	0x98, 0x45, 0xfb, 0x46, 0x87, 0x4a, 0x64, 0xbb, 0xcb, 0x3d, 0x11, 0xf0, 0x09, 0x3e, 0x5d, 0x79,
-	0x95, 0xc7, 0xab, 0x99, 0x2c, 0x48, 0x1b, 0x1e, 0x66, 0x0f, 0x76, 0x62, 0xeb, 0x6a, 0xfe, 0xd2,
-	0xb7, 0xda, 0xd4, 0x92, 0x8a, 0xf8, 0x12, 0x29, 0x45, 0x74, 0xbf, 0x4d, 0x2d, 0xfc, 0x1f, 0x4a,
-	0x0a, 0x9d, 0xf3, 0xbe, 0xaf, 0xee, 0x59, 0x21, 0x49, 0x01, 0x9b, 0x50, 0x56, 0xe0, 0x55, 0xc0,
-	0xa7, 0xea, 0x5b, 0x90, 0xfd, 0x74, 0xc9, 0xee, 0xfd, 0xee, 0xcf, 0x55, 0x03, 0xec, 0x06, 0x8c,
-	0x0a, 0xa6, 0xd8, 0x84, 0x5d, 0xcd, 0x58, 0x28, 0x4c, 0x0d, 0xff, 0x85, 0x9d, 0x95, 0xba, 0xb4,
-	0x14, 0x32, 0x53, 0x7f, 0xb1, 0xff, 0xe5, 0xce, 0xd2, 0x6e, 0xef, 0x2c, 0xed, 0xfb, 0x9d, 0xa5,
-	0x7d, 0xbe, 0xb7, 0x32, 0xb7, 0xf7, 0x56, 0xe6, 0xdb, 0xbd, 0x95, 0x79, 0xdf, 0xb8, 0x74, 0xc5,
-	0x68, 0x76, 0xd1, 0x76, 0xf8, 0x74, 0x37, 0x9c, 0x50, 0x67, 0x3c, 0xba, 0xda, 0x8d, 0x22, 0xbc,
-	0xc8, 0xab, 0x1f, 0xf8, 0xfe, 0xaf, 0x00, 0x00, 0x00, 0xff, 0xff, 0x17, 0x56, 0x28, 0x74, 0xd0,
-	0x05, 0x00, 0x00,
+	// 850 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x55, 0xcd, 0x6e, 0xdb, 0x46,
+	0x10, 0x16, 0x29, 0xea, 0x6f, 0x64, 0x29, 0xcc, 0x3a, 0x75, 0xe9, 0xa0, 0x15, 0x54, 0x1e, 0x0a,
+	0x9d, 0x9c, 0xc0, 0x4e, 0x8d, 0x1e, 0xeb, 0x28, 0x2d, 0xa4, 0x20, 0x76, 0xd4, 0x85, 0xd2, 0x02,
+	0xbd, 0x14, 0x6b, 0x72, 0x6a, 0x11, 0x92, 0x76, 0x99, 0xe5, 0x2a, 0x8d, 0x5e, 0xa2, 0xe8, 0xad,
+	0x6f, 0xd0, 0x67, 0xe9, 0xd1, 0xc7, 0x1e, 0x0b, 0xfb, 0xd8, 0x63, 0x1f, 0xa0, 0xc5, 0x2e, 0x25,
+	0x8a, 0x92, 0xd8, 0xdc, 0x76, 0xbe, 0xf9, 0x66, 0xe6, 0xd3, 0xb7, 0x9c, 0x15, 0x1c, 0x70, 0xbc,
+	0x5e, 0xcc, 0xd8, 0x49, 0x2c, 0x85, 0x12, 0xa4, 0x9a, 0x46, 0xfe, 0xdf, 0x36, 0xc0, 0x95, 0x39,
+	0x5e, 0xa2, 0x62, 0xe4, 0x14, 0x9c, 0xf1, 0x32, 0x46, 0xcf, 0xea, 0x5a, 0xbd, 0xf6, 0x69, 0xe7,
+	0x64, 0x55, 0xb3, 0x61, 0x9c, 0x5c, 0x62, 0x92, 0xb0, 0x1b, 0xd4, 0x2c, 0x6a, 0xb8, 0xe4, 0x0c,
+	0x6a, 0x2f, 0x50, 0xb1, 0x68, 0x96, 0x78, 0x76, 0xd7, 0xea, 0x35, 0x4f, 0x8f, 0xf7, 0xcb, 0x56,
+	0x04, 0xba, 0x66, 0xfa, 0xff, 0x58, 0xd0, 0xcc, 0xb5, 0x22, 0x75, 0x70, 0xae, 0x04, 0x47, 0xb7,
+	0x44, 0x5a, 0xd0, 0x18, 0x88, 0x44, 0x7d, 0xbb, 0x40, 0xb9, 0x74, 0x2d, 0x42, 0xa0, 0x9d, 0x85,
+	0x14, 0xe3, 0xd9, 0xd2, 0xb5, 0xc9, 0x63, 0x38, 0xd2, 0xd8, 0x9b, 0x38, 0x64, 0x0a, 0xaf, 0x84,
+	0x8a, 0x7e, 0x8a, 0x02, 0xa6, 0x22, 0xc1, 0xdd, 0x32, 0x39, 0x86, 0x8f, 0x74, 0xee, 0x52, 0xbc,
+	0xc3, 0x70, 0x2b, 0xe5, 0xac, 0x53, 0xa3, 0x05, 0x0f, 0x26, 0x5b, 0xa9, 0x0a, 0x69, 0x03, 0xe8,
+	0xd4, 0xf7, 0x13, 0xc1, 0xe6, 0x91, 0x5b, 0x25, 0x87, 0xf0, 0x60, 0x13, 0xa7, 0x63, 0x6b, 0x5a,
+	0xd9, 0x88, 0xa9, 0x49, 0x7f, 0x82, 0xc1, 0xd4, 0xad, 0x6b, 0x65, 0x59, 0x98, 0x52, 0x1a, 0xe4,
+	0x53, 0x38, 0x2e, 0x56, 0x76, 0x11, 0x4c, 0x5d, 0xf0, 0xff, 0xb5, 0xe1, 0xe1, 0x9e, 0x29, 0xe4,
+	0x11, 0x54, 0xbe, 0x8b, 0xf9, 0x30, 0x36, 0xae, 0xb7, 0x68, 0x1a, 0x90, 0x67, 0xd0, 0x1c, 0xc6,
+	0xcf, 0x2e, 0x78, 0x38, 0x12, 0x52, 0x69, 0x6b, 0xcb, 0xbd, 0xe6, 0x29, 0x59, 0x5b, 0xbb, 0x49,
+	0xd1, 0x3c, 0x2d, 0xad, 0x3a, 0xcf, 0xaa, 0x9c, 0xdd, 0xaa, 0xf3, 0x5c, 0x55, 0x46, 0x23, 0x1d,
+	0x00, 0x8a, 0x33, 0xb6, 0x4c, 0x65, 0x54, 0xba, 0xe5, 0x5e, 0x8b, 0xe6, 0x10, 0xe2, 0x41, 0x2d,
+	0x10, 0x0b, 0xae, 0x50, 0x7a, 0x65, 0xa3, 0x71, 0x1d, 0x92, 0xe7, 0x40, 0x5e, 0x5f, 0x27, 0x28,
+	0xdf, 0x61, 0xb8, 0x91, 0xe1, 0x55, 0xbb, 0xd6, 0xf6, 0xd8, 0x4c, 0x6c, 0x01, 0x7b, 0xbb, 0xc7,
+	0x5a, 0x94, 0x57, 0xdb, 0xed, 0x71, 0x5e, 0xd0, 0x63, 0x8d, 0x91, 0xcf, 0xa1, 0xfd, 0x35, 0x0f,
+	0xe4, 0x32, 0x56, 0x18, 0x5e, 0x84, 0xa1, 0x4c, 0xbc, 0x7a, 0xd7, 0xea, 0x1d, 0xd0, 0x1d, 0xd4,
+	0x7f, 0x0a, 0x90, 0x9b, 0xdc, 0x06, 0x3b, 0xb3, 0xdd, 0x1e, 0xc6, 0x84, 0x80, 0x63, 0x66, 0xdb,
+	0x06, 0x31, 0x67, 0xff, 0x2b, 0x80, 0xdc, 0x9c, 0x36, 0xd8, 0x83, 0xc8, 0x54, 0x38, 0xd4, 0x1e,
+	0x44, 0x3a, 0x7e, 0x25, 0x0c, 0xdf, 0xa1, 0xf6, 0x2b, 0x91, 0x75, 0x28, 0xe7, 0x3a, 0xbc, 0x5f,
+	0xaf, 0xd8, 0x28, 0xe2, 0x37, 0x1f, 0x5e, 0x31, 0xcd, 0x28, 0x58, 0x31, 0x02, 0xce, 0x38, 0x9a,
+	0xe3, 0x6a, 0x8e, 0x39, 0xfb, 0xfe, 0xde, 0x02, 0xe9, 0x62, 0xb7, 0x44, 0x1a, 0x50, 0x49, 0x3f,
+	0x47, 0xcb, 0xff, 0x11, 0x1e, 0xa4, 0x7d, 0x07, 0x8c, 0x87, 0xc9, 0x84, 0x4d, 0x91, 0x7c, 0xb9,
+	0xd9, 0x56, 0xcb, 0x38, 0xbc, 0xa3, 0x20, 0x63, 0xee, 0xae, 0xac, 0x16, 0x31, 0x98, 0xb3, 0xc0,
+	0x88, 0x38, 0xa0, 0xe6, 0xec, 0xff, 0x62, 0xc3, 0x51, 0x71, 0x9d, 0xa6, 0xf7, 0x51, 0x2a, 0x33,
+	0xe5, 0x80, 0x9a, 0xb3, 0xbe, 0xa5, 0x21, 0x8f, 0x54, 0xc4, 0x94, 0x90, 0x43, 0x1e, 0xe2, 0xfb,
+	0x95, 0xd3, 0x3b, 0xa8, 0xe6, 0x51, 0x4c, 0x62, 0xc1, 0x43, 0x5c, 0xf1, 0x52, 0x3f, 0x77, 0x50,
+	0x72, 0x04, 0xd5, 0xbe, 0x10, 0xd3, 0x08, 0x3d, 0xc7, 0x38, 0xb3, 0x8a, 0x32, 0xbf, 0x2a, 0x1b,
+	0xbf, 0xc8, 0x63, 0xa8, 0x5f, 0x2c, 0xd4, 0xe4, 0x35, 0x9f, 0x2d, 0xcd, 0xb7, 0x51, 0xa7, 0x59,
+	0x4c, 0xba, 0xd0, 0x1c, 0x4b, 0x16, 0xe0, 0x88, 0x49, 0xe4, 0xca, 0x6b, 0x74, 0xad, 0x5e, 0x83,
+	0xe6, 0x21, 0x5d, 0xfd, 0x26, 0x41, 0x69, 0x7e, 0x11, 0x98, 0x5f, 0x94, 0xc5, 0x2f, 0x9d, 0x7a,
+	0xd5, 0xad, 0xbd, 0x74, 0xea, 0x35, 0xb7, 0xee, 0xff, 0x5e, 0x86, 0x56, 0x6a, 0x48, 0x5f, 0x70,
+	0x25, 0xc5, 0x8c, 0x7c, 0xb1, 0x75, 0xdf, 0x9f, 0x6d, 0xbb, 0xbd, 0x22, 0x15, 0x5c, 0xf9, 0x53,
+	0x38, 0xcc, 0x4c, 0x31, 0x9b, 0x98, 0xf7, 0xab, 0x28, 0xa5, 0x2b, 0x32, 0x7b, 0x72, 0x15, 0xa9,
+	0x73, 0x45, 0x29, 0xf2, 0x09, 0x34, 0x4c, 0x34, 0x16, 0xc3, 0xd8, 0x38, 0xd8, 0xa2, 0x1b, 0x40,
+	0x9b, 0x62, 0x82, 0x6f, 0xa4, 0x98, 0x9b, 0x57, 0x41, 0xe7, 0xf3, 0xd0, 0xae, 0x6d, 0xd5, 0x3d,
+	0xdb, 0xfc, 0xdf, 0xfe, 0xf7, 0x99, 0x3f, 0x02, 0xd2, 0x97, 0xc8, 0x14, 0x9a, 0x86, 0x14, 0xdf,
+	0x2e, 0x30, 0x51, 0xae, 0x45, 0x3e, 0x86, 0xc3, 0x2d, 0x5c, 0xab, 0x4e, 0xd0, 0xb5, 0xc9, 0x43,
+	0x68, 0x19, 0xe8, 0x85, 0x64, 0x11, 0xd7, 0x5f, 0x7a, 0x39, 0x83, 0x2e, 0xa3, 0x1b, 0xc9, 0x14,
+	0x86, 0xae, 0x93, 0x41, 0x63, 0x64, 0x32, 0x14, 0x3f, 0xeb, 0xb7, 0xfd, 0x11, 0xb8, 0x5b, 0x90,
+	0x7e, 0x8a, 0xab, 0xcf, 0xcf, 0x7e, 0x38, 0xbe, 0x89, 0xd4, 0x64, 0x71, 0x7d, 0x12, 0x88, 0xf9,
+	0x93, 0x64, 0xc6, 0x82, 0xe9, 0xe4, 0xed, 0x93, 0xf4, 0x72, 0xfe, 0xb8, 0xeb, 0x58, 0xb7, 0x77,
+	0x1d, 0xeb, 0xaf, 0xbb, 0x8e, 0xf5, 0xeb, 0x7d, 0xa7, 0x74, 0x7b, 0xdf, 0x29, 0xfd, 0x79, 0xdf,
+	0x29, 0x5d, 0x57, 0xcd, 0x9f, 0xe7, 0xd9, 0x7f, 0x03, 0x00, 0x3e, 0xa9, 0x74, 0x6e, 0x4c, 0x07,
+	0x00, 0x00,
 }
 
 func (m *NebulaMeta) Marshal() (dAtA []byte, err error) {
@@ -748,21 +832,52 @@ func (m *NebulaMetaDetails) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.EncryptedAddrs) > 0 {
+		i -= len(m.EncryptedAddrs)
+		copy(dAtA[i:], m.EncryptedAddrs)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.EncryptedAddrs)))
+		i--
+		dAtA[i] = 0x42
+	}
+	if m.ObservedIp6AndPort != nil {
+		{
+			size, err := m.ObservedIp6AndPort.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintNebula(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x3a
+	}
+	if m.ObservedIp4AndPort != nil {
+		{
+			size, err := m.ObservedIp4AndPort.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintNebula(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x32
+	}
 	if len(m.RelayVpnIp) > 0 {
-		dAtA3 := make([]byte, len(m.RelayVpnIp)*10)
-		var j2 int
+		dAtA5 := make([]byte, len(m.RelayVpnIp)*10)
+		var j4 int
 		for _, num := range m.RelayVpnIp {
 			for num >= 1<<7 {
-				dAtA3[j2] = uint8(uint64(num)&0x7f | 0x80)
+				dAtA5[j4] = uint8(uint64(num)&0x7f | 0x80)
 				num >>= 7
-				j2++
+				j4++
 			}
-			dAtA3[j2] = uint8(num)
-			j2++
+			dAtA5[j4] = uint8(num)
+			j4++
 		}
-		i -= j2
-		copy(dAtA[i:], dAtA3[:j2])
-		i = encodeVarintNebula(dAtA, i, uint64(j2))
+		i -= j4
+		copy(dAtA[i:], dAtA5[:j4])
+		i = encodeVarintNebula(dAtA, i, uint64(j4))
 		i--
 		dAtA[i] = 0x2a
 	}
@@ -973,6 +1088,30 @@ func (m *NebulaHandshakeDetails) MarshalToSizedBuffer(dAtA []byte) (int, error)
 	_ = i
 	var l int
 	_ = l
+	if len(m.UserCert) > 0 {
+		i -= len(m.UserCert)
+		copy(dAtA[i:], m.UserCert)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.UserCert)))
+		i--
+		dAtA[i] = 0x52
+	}
+	if len(m.TraceParent) > 0 {
+		i -= len(m.TraceParent)
+		copy(dAtA[i:], m.TraceParent)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.TraceParent)))
+		i--
+		dAtA[i] = 0x4a
+	}
+	if m.AuthOnly {
+		i--
+		if m.AuthOnly {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x40
+	}
 	if m.Time != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.Time))
 		i--
@@ -1023,6 +1162,13 @@ func (m *NebulaControl) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.TraceParent) > 0 {
+		i -= len(m.TraceParent)
+		copy(dAtA[i:], m.TraceParent)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.TraceParent)))
+		i--
+		dAtA[i] = 0x32
+	}
 	if m.RelayFromIp != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.RelayFromIp))
 		i--
@@ -1109,6 +1255,18 @@ func (m *NebulaMetaDetails) Size() (n int) {
 		}
 		n += 1 + sovNebula(uint64(l)) + l
 	}
+	if m.ObservedIp4AndPort != nil {
+		l = m.ObservedIp4AndPort.Size()
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if m.ObservedIp6AndPort != nil {
+		l = m.ObservedIp6AndPort.Size()
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	l = len(m.EncryptedAddrs)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
 	return n
 }
 
@@ -1199,6 +1357,17 @@ func (m *NebulaHandshakeDetails) Size() (n int) {
 	if m.Time != 0 {
 		n += 1 + sovNebula(uint64(m.Time))
 	}
+	if m.AuthOnly {
+		n += 2
+	}
+	l = len(m.TraceParent)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	l = len(m.UserCert)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
 	return n
 }
 
@@ -1223,6 +1392,10 @@ func (m *NebulaControl) Size() (n int) {
 	if m.RelayFromIp != 0 {
 		n += 1 + sovNebula(uint64(m.RelayFromIp))
 	}
+	l = len(m.TraceParent)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
 	return n
 }
 
@@ -1548,6 +1721,112 @@ func (m *NebulaMetaDetails) Unmarshal(dAtA []byte) error {
 			} else {
 				return fmt.Errorf("proto: wrong wireType = %d for field RelayVpnIp", wireType)
 			}
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ObservedIp4AndPort", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.ObservedIp4AndPort == nil {
+				m.ObservedIp4AndPort = &Ip4AndPort{}
+			}
+			if err := m.ObservedIp4AndPort.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ObservedIp6AndPort", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.ObservedIp6AndPort == nil {
+				m.ObservedIp6AndPort = &Ip6AndPort{}
+			}
+			if err := m.ObservedIp6AndPort.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field EncryptedAddrs", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.EncryptedAddrs = append(m.EncryptedAddrs[:0], dAtA[iNdEx:postIndex]...)
+			if m.EncryptedAddrs == nil {
+				m.EncryptedAddrs = []byte{}
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -2111,6 +2390,92 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field AuthOnly", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.AuthOnly = bool(v != 0)
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TraceParent", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.TraceParent = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field UserCert", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.UserCert = append(m.UserCert[:0], dAtA[iNdEx:postIndex]...)
+			if m.UserCert == nil {
+				m.UserCert = []byte{}
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -2256,6 +2621,38 @@ func (m *NebulaControl) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TraceParent", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.TraceParent = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -0,0 +1,126 @@
+package nebula
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/noiseutil"
+)
+
+// NodeKey performs every operation that requires this node's static private key. The default implementation holds
+// the key in memory after reading it from pki.key, other implementations may keep the key in an HSM or PKCS#11 token
+// and never expose it. The handshake only ever uses the private key through this interface.
+type NodeKey interface {
+	// Curve returns the curve the key was generated on, it must match the curve of the certificate
+	Curve() cert.Curve
+
+	// Public returns the public key in the same encoding as NebulaCertificateDetails.PublicKey
+	Public() []byte
+
+	// DH performs a diffie-hellman exchange between the private key and peerPublic and returns the shared secret
+	DH(peerPublic []byte) ([]byte, error)
+}
+
+// NodeKeyLoader returns a NodeKey for a pki.key value using a registered uri scheme
+type NodeKeyLoader func(c *config.C, uri string) (NodeKey, error)
+
+var nodeKeyLoaders = struct {
+	sync.RWMutex
+	m map[string]NodeKeyLoader
+}{m: map[string]NodeKeyLoader{}}
+
+// RegisterNodeKeyLoader makes a NodeKey implementation available to pki.key values that start with `scheme:`, for
+// example registering `pkcs11` allows `pki.key: "pkcs11:token=nebula;object=node"`. This is intended to be called by
+// applications embedding nebula before Main.
+func RegisterNodeKeyLoader(scheme string, loader NodeKeyLoader) {
+	nodeKeyLoaders.Lock()
+	defer nodeKeyLoaders.Unlock()
+	nodeKeyLoaders.m[scheme] = loader
+}
+
+// nodeKeyLoaderFor returns the registered loader for a pki.key value, if any
+func nodeKeyLoaderFor(uri string) NodeKeyLoader {
+	scheme, _, ok := strings.Cut(uri, ":")
+	if !ok {
+		return nil
+	}
+
+	nodeKeyLoaders.RLock()
+	defer nodeKeyLoaders.RUnlock()
+	return nodeKeyLoaders.m[scheme]
+}
+
+// rawNodeKey is the default NodeKey, the private key is held in memory
+type rawNodeKey struct {
+	curve   cert.Curve
+	private []byte
+	public  []byte
+}
+
+func newRawNodeKey(curve cert.Curve, private, public []byte) (*rawNodeKey, error) {
+	if _, err := dhFuncForCurve(curve); err != nil {
+		return nil, err
+	}
+	return &rawNodeKey{curve: curve, private: private, public: public}, nil
+}
+
+func (k *rawNodeKey) Curve() cert.Curve {
+	return k.curve
+}
+
+func (k *rawNodeKey) Public() []byte {
+	return k.public
+}
+
+func (k *rawNodeKey) DH(peerPublic []byte) ([]byte, error) {
+	dhFunc, err := dhFuncForCurve(k.curve)
+	if err != nil {
+		return nil, err
+	}
+	return dhFunc.DH(k.private, peerPublic)
+}
+
+func dhFuncForCurve(curve cert.Curve) (noise.DHFunc, error) {
+	switch curve {
+	case cert.Curve_CURVE25519:
+		return noise.DH25519, nil
+	case cert.Curve_P256:
+		return noiseutil.DHP256, nil
+	default:
+		return nil, fmt.Errorf("invalid curve: %s", curve)
+	}
+}
+
+// nodeKeyDH is a noise.DHFunc that sends any DH operation on the static key to a NodeKey. Noise only hands the static
+// keypair back to us as raw bytes so it is given a random placeholder instead of the private key, the placeholder is
+// how the static key is recognized. Ephemeral keys are handled by the embedded DHFunc.
+type nodeKeyDH struct {
+	noise.DHFunc
+	key         NodeKey
+	placeholder []byte
+}
+
+func newNodeKeyDH(dhFunc noise.DHFunc, key NodeKey) (*nodeKeyDH, error) {
+	placeholder := make([]byte, 32)
+	if _, err := rand.Read(placeholder); err != nil {
+		return nil, err
+	}
+	return &nodeKeyDH{DHFunc: dhFunc, key: key, placeholder: placeholder}, nil
+}
+
+func (d *nodeKeyDH) DH(privkey, pubkey []byte) ([]byte, error) {
+	if bytes.Equal(privkey, d.placeholder) {
+		if d.key == nil {
+			return nil, errors.New("no node key loaded")
+		}
+		return d.key.DH(pubkey)
+	}
+	return d.DHFunc.DH(privkey, pubkey)
+}
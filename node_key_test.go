@@ -0,0 +1,131 @@
+package nebula
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockNodeKey stands in for an HSM backed key, the private key is only reachable through DH
+type mockNodeKey struct {
+	key     *rawNodeKey
+	dhCalls int
+}
+
+func (m *mockNodeKey) Curve() cert.Curve {
+	return m.key.Curve()
+}
+
+func (m *mockNodeKey) Public() []byte {
+	return m.key.Public()
+}
+
+func (m *mockNodeKey) DH(peerPublic []byte) ([]byte, error) {
+	m.dhCalls++
+	return m.key.DH(peerPublic)
+}
+
+func newTestNodeKey(t testing.TB) (*rawNodeKey, *cert.NebulaCertificate) {
+	kp, err := noise.DH25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err)
+
+	key, err := newRawNodeKey(cert.Curve_CURVE25519, kp.Private, kp.Public)
+	require.NoError(t, err)
+
+	crt := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Name:      "node",
+		Ips:       []*net.IPNet{{IP: net.IPv4(10, 1, 0, 1), Mask: net.CIDRMask(16, 32)}},
+		NotBefore: time.Now().Add(-time.Minute),
+		NotAfter:  time.Now().Add(time.Hour),
+		PublicKey: kp.Public,
+		Curve:     cert.Curve_CURVE25519,
+	}}
+	return key, crt
+}
+
+func TestNodeKey_Handshake(t *testing.T) {
+	l := test.NewLogger()
+
+	rawKey, myCert := newTestNodeKey(t)
+	mock := &mockNodeKey{key: rawKey}
+	myCs, err := newCertState(myCert, mock)
+	require.NoError(t, err)
+
+	theirKey, theirCert := newTestNodeKey(t)
+	theirCs, err := newCertState(theirCert, theirKey)
+	require.NoError(t, err)
+
+	me := NewConnectionState(l, "aes", myCs, true, noise.HandshakeIX, []byte{}, 0)
+	them := NewConnectionState(l, "aes", theirCs, false, noise.HandshakeIX, []byte{}, 0)
+	require.NotNil(t, me)
+	require.NotNil(t, them)
+
+	msg, _, _, err := me.H.WriteMessage(nil, nil)
+	require.NoError(t, err)
+	_, _, _, err = them.H.ReadMessage(nil, msg)
+	require.NoError(t, err)
+
+	msg, theirDKey, theirEKey, err := them.H.WriteMessage(nil, nil)
+	require.NoError(t, err)
+	_, myEKey, myDKey, err := me.H.ReadMessage(nil, msg)
+	require.NoError(t, err)
+
+	// IX uses our static key once as the initiator, for se
+	assert.Equal(t, 1, mock.dhCalls)
+	assert.Equal(t, theirCs.PublicKey, me.H.PeerStatic())
+	assert.Equal(t, myCs.PublicKey, them.H.PeerStatic())
+
+	ct, err := myEKey.Encrypt(nil, nil, []byte("hi"))
+	require.NoError(t, err)
+	pt, err := theirDKey.Decrypt(nil, nil, ct)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hi"), pt)
+
+	ct, err = theirEKey.Encrypt(nil, nil, []byte("hello"))
+	require.NoError(t, err)
+	pt, err = myDKey.Decrypt(nil, nil, ct)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), pt)
+}
+
+func TestNodeKey_Loader(t *testing.T) {
+	l := test.NewLogger()
+	rawKey, crt := newTestNodeKey(t)
+	pem, err := crt.MarshalToPEM()
+	require.NoError(t, err)
+
+	mock := &mockNodeKey{key: rawKey}
+	RegisterNodeKeyLoader("mock-hsm", func(c *config.C, uri string) (NodeKey, error) {
+		assert.Equal(t, "mock-hsm:token=nebula;object=node", uri)
+		return mock, nil
+	})
+
+	c := config.NewC(l)
+	c.Settings["pki"] = map[interface{}]interface{}{
+		"key":  "mock-hsm:token=nebula;object=node",
+		"cert": string(pem),
+	}
+
+	cs, err := newCertStateFromConfig(c)
+	require.NoError(t, err)
+	assert.Same(t, mock, cs.PrivateKey)
+
+	// A key that does not match the certificate is rejected
+	otherKey, _ := newTestNodeKey(t)
+	mock.key = otherKey
+	_, err = newCertStateFromConfig(c)
+	assert.EqualError(t, err, "private key is not a pair with public key in nebula cert")
+
+	// Unregistered schemes are treated as a path
+	c.Settings["pki"].(map[interface{}]interface{})["key"] = "not-registered:thing"
+	_, err = newCertStateFromConfig(c)
+	assert.ErrorContains(t, err, "unable to read pki.key file not-registered:thing")
+}
@@ -0,0 +1,185 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+)
+
+const defaultObserverInterval = 10 * time.Second
+
+var errObserverAmRelay = errors.New("relay.am_relay can not be used with observer.enabled, an observer never forwards traffic")
+
+// Observer is for monitoring nodes that join the mesh for visibility but must never carry application traffic. An
+// observer handshakes, talks to lighthouses, and sends and answers test packets like any other node, so tunnel,
+// reachability and latency metrics work, but every data packet read from the tun or received from a peer is dropped
+// regardless of the firewall rules and it never forwards for others as a relay. Since it originates no traffic of its
+// own the observer keeps tunnels up to its targets by sending each a test packet every interval. The tun is still
+// created unless tun.disabled is set.
+type Observer struct {
+	enabled  bool
+	interval atomic.Int64
+	targets  atomic.Pointer[[]netip.Addr]
+
+	metricDroppedIn  metrics.Counter
+	metricDroppedOut metrics.Counter
+	l                *logrus.Logger
+}
+
+// ObserverStatus is reported on the control socket, whether this node is an observer and the tunnels it keeps
+type ObserverStatus struct {
+	Enabled         bool             `json:"enabled"`
+	DroppedInbound  int64            `json:"droppedInbound"`
+	DroppedOutbound int64            `json:"droppedOutbound"`
+	Targets         []ObserverTarget `json:"targets"`
+}
+
+// ObserverTarget is a peer the observer keeps a tunnel with
+type ObserverTarget struct {
+	VpnIp netip.Addr `json:"vpnIp"`
+	// Up is true if there is an established tunnel with the target
+	Up bool `json:"up"`
+}
+
+func NewObserverFromConfig(l *logrus.Logger, c *config.C) (*Observer, error) {
+	o := &Observer{
+		enabled:          c.GetBool("observer.enabled", false),
+		metricDroppedIn:  metrics.GetOrRegisterCounter("observer.dropped.inbound", nil),
+		metricDroppedOut: metrics.GetOrRegisterCounter("observer.dropped.outbound", nil),
+		l:                l,
+	}
+
+	if o.enabled && c.GetBool("relay.am_relay", false) {
+		return nil, errObserverAmRelay
+	}
+
+	if err := o.reload(c, true); err != nil {
+		return nil, err
+	}
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := o.reload(c, false); err != nil {
+			l.WithError(err).Error("Failed to reload observer, keeping the old config")
+		}
+	})
+
+	if o.enabled {
+		l.WithField("targets", o.Targets()).
+			Info("Observer mode enabled, tunnels are kept up for monitoring but every data packet is dropped")
+	}
+
+	return o, nil
+}
+
+func (o *Observer) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("observer") {
+		return nil
+	}
+
+	if !initial && c.GetBool("observer.enabled", false) != o.enabled {
+		o.l.Warn("observer.enabled can not be changed on reload, restart nebula to apply it")
+	}
+
+	var targets []netip.Addr
+	for i, v := range c.GetStringSlice("observer.targets", []string{}) {
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return fmt.Errorf("observer.targets[%d] %q is not a valid vpn ip: %w", i, v, err)
+		}
+		targets = append(targets, addr.Unmap())
+	}
+
+	interval := c.GetDuration("observer.interval", defaultObserverInterval)
+	if interval < time.Second {
+		return fmt.Errorf("observer.interval must be at least 1s, got %v", interval)
+	}
+
+	o.targets.Store(&targets)
+	o.interval.Store(int64(interval))
+
+	if !initial {
+		o.l.WithField("targets", targets).WithField("interval", interval).Info("observer has changed")
+	}
+	return nil
+}
+
+// Targets returns the vpn ips the observer keeps tunnels with
+func (o *Observer) Targets() []netip.Addr {
+	if p := o.targets.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// Run sends a test packet to every target each interval until ctx is done. The test packet starts a handshake if there
+// is no tunnel and keeps an idle tunnel from timing out. Nothing is sent unless this node is an observer.
+func (o *Observer) Run(ctx context.Context, f *Interface) {
+	if o == nil || !o.enabled {
+		return
+	}
+
+	nb, out := make([]byte, 12, 12), make([]byte, mtu)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			for _, vpnIp := range o.Targets() {
+				f.SendMessageToVpnIp(header.Test, header.TestRequest, vpnIp, []byte(""), nb, out)
+			}
+			timer.Reset(time.Duration(o.interval.Load()))
+		}
+	}
+}
+
+// drop returns true and counts the drop if this node is an observer, every data packet is dropped. It is safe to call
+// on a nil Observer.
+func (o *Observer) drop(l *logrus.Logger, fwPacket *firewall.Packet, incoming bool) bool {
+	if o == nil || !o.enabled {
+		return false
+	}
+
+	if incoming {
+		o.metricDroppedIn.Inc(1)
+	} else {
+		o.metricDroppedOut.Inc(1)
+	}
+
+	if l.Level >= logrus.DebugLevel {
+		l.WithField("fwPacket", fwPacket).WithField("incoming", incoming).Debug("Observer dropped a data packet")
+	}
+	return true
+}
+
+// Enabled returns true if this node is an observer, it is safe to call on a nil Observer
+func (o *Observer) Enabled() bool {
+	return o != nil && o.enabled
+}
+
+// Status returns whether this node is an observer and which of its targets have a tunnel
+func (o *Observer) Status(hm *HostMap) ObserverStatus {
+	if !o.Enabled() {
+		return ObserverStatus{}
+	}
+
+	s := ObserverStatus{
+		Enabled:         true,
+		DroppedInbound:  o.metricDroppedIn.Count(),
+		DroppedOutbound: o.metricDroppedOut.Count(),
+	}
+	for _, vpnIp := range o.Targets() {
+		s.Targets = append(s.Targets, ObserverTarget{VpnIp: vpnIp, Up: hm.QueryVpnIp(vpnIp) != nil})
+	}
+	return s
+}
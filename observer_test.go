@@ -0,0 +1,85 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewObserverFromConfig(t *testing.T) {
+	l := test.NewLogger()
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("observer: {enabled: true}\nrelay: {am_relay: true}"))
+	_, err := NewObserverFromConfig(l, c)
+	assert.ErrorIs(t, err, errObserverAmRelay)
+
+	c = config.NewC(l)
+	require.NoError(t, c.LoadString("observer: {enabled: true, targets: [nope]}"))
+	_, err = NewObserverFromConfig(l, c)
+	assert.ErrorContains(t, err, `observer.targets[0] "nope" is not a valid vpn ip`)
+
+	c = config.NewC(l)
+	require.NoError(t, c.LoadString("observer: {enabled: true, interval: 10ms}"))
+	_, err = NewObserverFromConfig(l, c)
+	assert.ErrorContains(t, err, "observer.interval must be at least 1s")
+
+	c = config.NewC(l)
+	require.NoError(t, c.LoadString("observer: {enabled: true, targets: [10.128.0.2]}"))
+	o, err := NewObserverFromConfig(l, c)
+	require.NoError(t, err)
+	assert.True(t, o.Enabled())
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.128.0.2")}, o.Targets())
+	assert.Equal(t, int64(defaultObserverInterval), o.interval.Load())
+
+	t.Log("A bad reload keeps the old targets")
+	require.NoError(t, c.ReloadConfigString("observer: {enabled: true, targets: [10.128.0.2, bad]}"))
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.128.0.2")}, o.Targets())
+
+	require.NoError(t, c.ReloadConfigString("observer: {enabled: false, targets: [10.128.0.3], interval: 5s}"))
+	assert.True(t, o.Enabled(), "enabled does not change on reload")
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.128.0.3")}, o.Targets())
+}
+
+func TestObserver_drop(t *testing.T) {
+	l := test.NewLogger()
+	fp := &firewall.Packet{}
+
+	var o *Observer
+	assert.False(t, o.drop(l, fp, true))
+	assert.False(t, o.Enabled())
+	assert.Equal(t, ObserverStatus{}, o.Status(nil))
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("observer: {enabled: false}"))
+	o, err := NewObserverFromConfig(l, c)
+	require.NoError(t, err)
+	assert.False(t, o.drop(l, fp, true))
+
+	c = config.NewC(l)
+	require.NoError(t, c.LoadString("observer: {enabled: true, targets: [10.128.0.2, 10.128.0.3]}"))
+	o, err = NewObserverFromConfig(l, c)
+	require.NoError(t, err)
+
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	hm.unlockedAddHostInfo(&HostInfo{vpnIp: netip.MustParseAddr("10.128.0.2"), localIndexId: 1}, &Interface{})
+
+	before := o.Status(hm)
+	assert.True(t, o.drop(l, fp, true))
+	assert.True(t, o.drop(l, fp, false))
+	assert.True(t, o.drop(l, fp, false))
+
+	s := o.Status(hm)
+	assert.True(t, s.Enabled)
+	assert.Equal(t, before.DroppedInbound+1, s.DroppedInbound)
+	assert.Equal(t, before.DroppedOutbound+2, s.DroppedOutbound)
+	assert.Equal(t, []ObserverTarget{
+		{VpnIp: netip.MustParseAddr("10.128.0.2"), Up: true},
+		{VpnIp: netip.MustParseAddr("10.128.0.3"), Up: false},
+	}, s.Targets)
+}
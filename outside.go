@@ -12,6 +12,8 @@ import (
 	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/packetauth"
 	"github.com/slackhq/nebula/udp"
 	"golang.org/x/net/ipv4"
 	"google.golang.org/protobuf/proto"
@@ -27,6 +29,7 @@ func readOutsidePackets(f *Interface) udp.EncReader {
 		addr netip.AddrPort,
 		out []byte,
 		packet []byte,
+		ecn uint8,
 		header *header.H,
 		fwPacket *firewall.Packet,
 		lhh udp.LightHouseHandlerFunc,
@@ -34,11 +37,21 @@ func readOutsidePackets(f *Interface) udp.EncReader {
 		q int,
 		localCache firewall.ConntrackCache,
 	) {
-		f.readOutsidePackets(addr, nil, out, packet, header, fwPacket, lhh, nb, q, localCache)
+		f.rates.rx(q, len(packet))
+		if f.underlayDeny.denied(addr) {
+			return
+		}
+		if pc := f.capture.Load(); pc != nil {
+			pc.Write(time.Now(), addr, packet)
+		}
+		if f.queueControlPacket(addr, packet, ecn, q) {
+			return
+		}
+		f.readOutsidePackets(addr, nil, out, packet, ecn, header, fwPacket, lhh, nb, q, localCache)
 	}
 }
 
-func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []byte, packet []byte, h *header.H, fwPacket *firewall.Packet, lhf udp.LightHouseHandlerFunc, nb []byte, q int, localCache firewall.ConntrackCache) {
+func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []byte, packet []byte, ecn uint8, h *header.H, fwPacket *firewall.Packet, lhf udp.LightHouseHandlerFunc, nb []byte, q int, localCache firewall.ConntrackCache) {
 	err := h.Parse(packet)
 	if err != nil {
 		// TODO: best if we return this and let caller log
@@ -52,10 +65,9 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 
 	//l.Error("in packet ", header, packet[HeaderLen:])
 	if ip.IsValid() {
-		if f.myVpnNet.Contains(ip.Addr()) {
-			if f.l.Level >= logrus.DebugLevel {
-				f.l.WithField("udpAddr", ip).Debug("Refusing to process double encrypted packet")
-			}
+		// A dual stack socket may hand us an ipv4 source as v4 mapped ipv6
+		if f.myVpnNet.Contains(ip.Addr().Unmap()) {
+			f.doubleEncrypted.refuse(f, ip, h)
 			return
 		}
 	}
@@ -66,6 +78,18 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 		hostinfo = f.hostMap.QueryRelayIndex(h.RemoteIndex)
 	} else {
 		hostinfo = f.hostMap.QueryIndex(h.RemoteIndex)
+		if hostinfo == nil && h.Type == header.Message && h.Subtype == header.MessageNone {
+			// The peer may still be sending with the keys of a tunnel we just replaced
+			if hostinfo = f.hostMap.QueryRetiredIndex(h.RemoteIndex, time.Now()); hostinfo != nil {
+				f.readRetiredPacket(hostinfo, ip, via, h, out, packet, ecn, fwPacket, nb, q, localCache)
+				return
+			}
+		}
+
+		if hostinfo == nil && h.Type == header.Message && h.Subtype != header.MessageRelay && xxResendStage2(f, h.RemoteIndex) {
+			// The peer completed a noise XX handshake with us but its last message never arrived
+			return
+		}
 	}
 
 	var ci *ConnectionState
@@ -76,13 +100,21 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 	switch h.Type {
 	case header.Message:
 		// TODO handleEncrypted sends directly to addr on error. Handle this in the tunneling case.
-		if !f.handleEncrypted(ci, ip, h) {
+		if !f.handleEncrypted(hostinfo, ci, ip, h, q) {
 			return
 		}
 
 		switch h.Subtype {
-		case header.MessageNone:
-			if !f.decryptToTun(hostinfo, h.MessageCounter, out, packet, fwPacket, nb, q, localCache) {
+		case header.MessageNone, header.MessageAuthOnly, header.MessageAuthorized, header.MessagePadded:
+			if !f.decryptToTun(hostinfo, ip, via, h, out, packet, ecn, fwPacket, nb, q, localCache, false) {
+				return
+			}
+		case header.MessageKeepalive:
+			// A keepalive carries nothing, once authenticated it only records incoming traffic below
+			if _, err := f.decrypt(hostinfo, h.MessageCounter, out, packet, h, nb); err != nil {
+				if f.l.Level >= logrus.DebugLevel {
+					hostinfo.logger(f.l).WithError(err).WithField("udpAddr", ip).Debug("Failed to decrypt keepalive packet")
+				}
 				return
 			}
 		case header.MessageRelay:
@@ -93,8 +125,15 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 			// which will gracefully fail in the DecryptDanger call.
 			signedPayload := packet[:len(packet)-hostinfo.ConnectionState.dKey.Overhead()]
 			signatureValue := packet[len(packet)-hostinfo.ConnectionState.dKey.Overhead():]
+			held, ok := f.shedDecrypt()
+			if !ok {
+				return
+			}
 			out, err = hostinfo.ConnectionState.dKey.DecryptDanger(out, signedPayload, signatureValue, h.MessageCounter, nb)
+			// Released before a terminal relay recurses into readOutsidePackets for the inner packet
+			f.decryptLimit.release(held)
 			if err != nil {
+				hostinfo.errCounters.decryptFailures.Add(1)
 				return
 			}
 			// Successfully validated the thing. Get rid of the Relay header.
@@ -108,8 +147,8 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 			relay, ok := hostinfo.relayState.QueryRelayForByIdx(h.RemoteIndex)
 			if !ok {
 				// The only way this happens is if hostmap has an index to the correct HostInfo, but the HostInfo is missing
-				// its internal mapping. This should never happen.
-				hostinfo.logger(f.l).WithFields(logrus.Fields{"vpnIp": hostinfo.vpnIp, "remoteIndex": h.RemoteIndex}).Error("HostInfo missing remote relay index")
+				// its internal mapping. This should never happen but has been seen after relay restarts, try to repair it.
+				f.relayManager.handleMissingRelayIndex(f, hostinfo, h.RemoteIndex, signedPayload)
 				return
 			}
 
@@ -117,9 +156,13 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 			case TerminalType:
 				// If I am the target of this relay, process the unwrapped packet
 				// From this recursive point, all these variables are 'burned'. We shouldn't rely on them again.
-				f.readOutsidePackets(netip.AddrPort{}, &ViaSender{relayHI: hostinfo, remoteIdx: relay.RemoteIndex, relay: relay}, out[:0], signedPayload, h, fwPacket, lhf, nb, q, localCache)
+				f.readOutsidePackets(netip.AddrPort{}, &ViaSender{relayHI: hostinfo, remoteIdx: relay.RemoteIndex, relay: relay}, out[:0], signedPayload, ecn, h, fwPacket, lhf, nb, q, localCache)
 				return
 			case ForwardingType:
+				if !f.relayForwardScope.allowForward(hostinfo, relay.PeerIp) {
+					return
+				}
+
 				// Find the target HostInfo relay object
 				targetHI, targetRelay, err := f.hostMap.QueryVpnIpRelayFor(hostinfo.vpnIp, relay.PeerIp)
 				if err != nil {
@@ -147,7 +190,7 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 
 	case header.LightHouse:
 		f.messageMetrics.Rx(h.Type, h.Subtype, 1)
-		if !f.handleEncrypted(ci, ip, h) {
+		if !f.handleEncrypted(hostinfo, ci, ip, h, q) {
 			return
 		}
 
@@ -157,8 +200,7 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 				WithField("packet", packet).
 				Error("Failed to decrypt lighthouse packet")
 
-			//TODO: maybe after build 64 is out? 06/14/2018 - NB
-			//f.sendRecvError(net.Addr(addr), header.RemoteIndex)
+			f.maybeSendIndexCollisionRecvError(hostinfo, ip, h, q)
 			return
 		}
 
@@ -168,7 +210,7 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 
 	case header.Test:
 		f.messageMetrics.Rx(h.Type, h.Subtype, 1)
-		if !f.handleEncrypted(ci, ip, h) {
+		if !f.handleEncrypted(hostinfo, ci, ip, h, q) {
 			return
 		}
 
@@ -178,8 +220,7 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 				WithField("packet", packet).
 				Error("Failed to decrypt test packet")
 
-			//TODO: maybe after build 64 is out? 06/14/2018 - NB
-			//f.sendRecvError(net.Addr(addr), header.RemoteIndex)
+			f.maybeSendIndexCollisionRecvError(hostinfo, ip, h, q)
 			return
 		}
 
@@ -187,7 +228,11 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 			// This testRequest might be from TryPromoteBest, so we should roam
 			// to the new IP address before responding
 			f.handleHostRoaming(hostinfo, ip)
-			f.send(header.Test, header.TestReply, ci, hostinfo, d, nb, out)
+			// Reply from the socket this request arrived on so the routine does not touch another routine's socket
+			f.messageMetrics.Tx(header.Test, header.TestReply, 1)
+			f.sendNoMetrics(header.Test, header.TestReply, ci, hostinfo, netip.AddrPort{}, d, nb, out, q)
+		} else {
+			f.handleProbeReply(hostinfo, d, time.Now())
 		}
 
 		// Fallthrough to the bottom to record incoming traffic
@@ -207,7 +252,7 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 
 	case header.CloseTunnel:
 		f.messageMetrics.Rx(h.Type, h.Subtype, 1)
-		if !f.handleEncrypted(ci, ip, h) {
+		if !f.handleEncrypted(hostinfo, ci, ip, h, q) {
 			return
 		}
 
@@ -218,7 +263,7 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 		return
 
 	case header.Control:
-		if !f.handleEncrypted(ci, ip, h) {
+		if !f.handleEncrypted(hostinfo, ci, ip, h, q) {
 			return
 		}
 
@@ -264,11 +309,25 @@ func (f *Interface) sendCloseTunnel(h *HostInfo) {
 }
 
 func (f *Interface) handleHostRoaming(hostinfo *HostInfo, ip netip.AddrPort) {
+	// Remotes are always kept unmapped, see SetRemote, so an ipv4 address seen through a dual stack socket is not a roam.
+	// Moving between ipv4 and ipv6 is a roam like any other, the udp socket picks the family from the remote on every
+	// write.
+	ip = netip.AddrPortFrom(ip.Addr().Unmap(), ip.Port())
 	if ip.IsValid() && hostinfo.remote != ip {
 		if !f.lightHouse.GetRemoteAllowList().Allow(hostinfo.vpnIp, ip.Addr()) {
 			hostinfo.logger(f.l).WithField("newAddr", ip).Debug("lighthouse.remote_allow_list denied roaming")
 			return
 		}
+		if f.roamPin.suppress(hostinfo, ip, time.Now()) {
+			return
+		}
+		if f.latencyProbe.suppressRoam(hostinfo, ip, f.hostMap.PreferredRangesFor(hostinfo)) {
+			if f.l.Level >= logrus.DebugLevel {
+				hostinfo.logger(f.l).WithField("udpAddr", hostinfo.remote).WithField("newAddr", ip).
+					Debug("Suppressing roam away from the lowest latency remote")
+			}
+			return
+		}
 		if !hostinfo.lastRoam.IsZero() && ip == hostinfo.lastRoamRemote && time.Since(hostinfo.lastRoam) < RoamingSuppressSeconds*time.Second {
 			if f.l.Level >= logrus.DebugLevel {
 				hostinfo.logger(f.l).WithField("udpAddr", hostinfo.remote).WithField("newAddr", ip).
@@ -282,16 +341,21 @@ func (f *Interface) handleHostRoaming(hostinfo *HostInfo, ip netip.AddrPort) {
 		hostinfo.lastRoam = time.Now()
 		hostinfo.lastRoamRemote = hostinfo.remote
 		hostinfo.SetRemote(ip)
+		f.tunnelMetrics.roamed(hostinfo)
 	}
 
 }
 
-func (f *Interface) handleEncrypted(ci *ConnectionState, addr netip.AddrPort, h *header.H) bool {
+func (f *Interface) handleEncrypted(hostinfo *HostInfo, ci *ConnectionState, addr netip.AddrPort, h *header.H, q int) bool {
 	// If connectionstate exists and the replay protector allows, process packet
 	// Else, send recv errors for 300 seconds after a restart to allow fast reconnection.
 	if ci == nil || !ci.window.Check(f.l, h.MessageCounter) {
+		if hostinfo != nil {
+			hostinfo.errCounters.outOfWindow.Add(1)
+		}
+
 		if addr.IsValid() {
-			f.maybeSendRecvError(addr, h.RemoteIndex)
+			f.maybeSendRecvError(addr, h.RemoteIndex, q)
 			return false
 		} else {
 			return false
@@ -301,6 +365,21 @@ func (f *Interface) handleEncrypted(ci *ConnectionState, addr netip.AddrPort, h
 	return true
 }
 
+// deniedIPOptions returns true if tun.drop_ip_options is set and the already parsed packet carries ip options
+func (f *Interface) deniedIPOptions(packet []byte, fwPacket *firewall.Packet) bool {
+	//TODO: IPV6-WORK flag suspicious extension headers, such as type 0 routing headers, once newPacket parses ipv6
+	if !f.dropIPOptions.Load() || !iputil.HasIPv4Options(packet) {
+		return false
+	}
+
+	f.metricIPOptions.Inc(1)
+	if f.l.Level >= logrus.DebugLevel {
+		f.l.WithField("fwPacket", fwPacket).WithField("ihl", int(packet[0]&0x0f)<<2).
+			Debugln("dropping packet with ip options")
+	}
+	return true
+}
+
 // newPacket validates and parses the interesting bits for the firewall out of the ip and sub protocol headers
 func newPacket(data []byte, incoming bool, fp *firewall.Packet) error {
 	// Do we at least have an ipv4 header worth of data?
@@ -369,10 +448,12 @@ func (f *Interface) decrypt(hostinfo *HostInfo, mc uint64, out []byte, packet []
 	var err error
 	out, err = hostinfo.ConnectionState.dKey.DecryptDanger(out, packet[:header.Len], packet[header.Len:], mc, nb)
 	if err != nil {
+		hostinfo.errCounters.decryptFailures.Add(1)
 		return nil, err
 	}
 
 	if !hostinfo.ConnectionState.window.Update(f.l, mc) {
+		hostinfo.errCounters.outOfWindow.Add(1)
 		hostinfo.logger(f.l).WithField("header", h).
 			Debugln("dropping out of window packet")
 		return nil, errors.New("out of window packet")
@@ -381,63 +462,206 @@ func (f *Interface) decrypt(hostinfo *HostInfo, mc uint64, out []byte, packet []
 	return out, nil
 }
 
-func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out []byte, packet []byte, fwPacket *firewall.Packet, nb []byte, q int, localCache firewall.ConntrackCache) bool {
+// decryptToTun decrypts a data packet of hostinfo and writes it to the tun if the firewall allows it. retired is set for
+// the keys of a tunnel that was replaced, a packet that fails to decrypt with them is dropped silently.
+func (f *Interface) decryptToTun(hostinfo *HostInfo, ip netip.AddrPort, via *ViaSender, h *header.H, out []byte, packet []byte, ecn uint8, fwPacket *firewall.Packet, nb []byte, q int, localCache firewall.ConntrackCache, retired bool) bool {
 	var err error
 
-	out, err = hostinfo.ConnectionState.dKey.DecryptDanger(out, packet[:header.Len], packet[header.Len:], messageCounter, nb)
-	if err != nil {
-		hostinfo.logger(f.l).WithError(err).Error("Failed to decrypt packet")
-		//TODO: maybe after build 64 is out? 06/14/2018 - NB
-		//f.sendRecvError(hostinfo.remote, header.RemoteIndex)
+	held, ok := f.shedDecrypt()
+	if !ok {
 		return false
 	}
 
+	if h.Subtype == header.MessageAuthOnly {
+		out, err = f.authOnlyOpen(hostinfo, ip, h, out, packet, nb)
+		f.decryptLimit.release(held)
+		if err != nil {
+			hostinfo.errCounters.decryptFailures.Add(1)
+			if f.l.Level >= logrus.DebugLevel {
+				hostinfo.logger(f.l).WithError(err).WithField("udpAddr", ip).Debug("Refusing auth only packet")
+			}
+			return false
+		}
+	} else {
+		out, err = hostinfo.ConnectionState.dKey.DecryptDanger(out, packet[:header.Len], packet[header.Len:], h.MessageCounter, nb)
+		f.decryptLimit.release(held)
+		if err != nil {
+			hostinfo.errCounters.decryptFailures.Add(1)
+			if retired {
+				// A recv_error would tear down the tunnel that replaced this one
+				return false
+			}
+			hostinfo.logger(f.l).WithError(err).Error("Failed to decrypt packet")
+			f.maybeSendIndexCollisionRecvError(hostinfo, ip, h, q)
+			return false
+		}
+	}
+
+	// Padding wraps the payload of another subtype, see Padding
+	st := h.Subtype
+	if st == header.MessagePadded {
+		st, out, err = unpad(out)
+		if err != nil {
+			hostinfo.errCounters.parseErrors.Add(1)
+			if f.l.Level >= logrus.DebugLevel {
+				hostinfo.logger(f.l).WithError(err).WithField("udpAddr", ip).Debug("Refusing padded packet")
+			}
+			return false
+		}
+	}
+
+	// A packet authorization token rides in front of the inner packet, see PacketAuth
+	var token []byte
+	if st == header.MessageAuthorized {
+		if len(out) < packetauth.TokenLen {
+			hostinfo.errCounters.parseErrors.Add(1)
+			return false
+		}
+		token, out = out[:packetauth.TokenLen], out[packetauth.TokenLen:]
+	}
+
 	err = newPacket(out, true, fwPacket)
 	if err != nil {
-		hostinfo.logger(f.l).WithError(err).WithField("packet", out).
+		hostinfo.errCounters.parseErrors.Add(1)
+		hostinfo.logger(f.l).WithError(err).WithField("packet", innerPacket(out)).
 			Warnf("Error while validating inbound packet")
 		return false
 	}
 
-	if !hostinfo.ConnectionState.window.Update(f.l, messageCounter) {
+	if !f.packetAuth.allowInbound(hostinfo, token, fwPacket.LocalIP) {
+		return false
+	}
+
+	if f.deniedIPOptions(out, fwPacket) {
+		return false
+	}
+
+	if f.verifyChecksums.Load() {
+		if err = iputil.VerifyIPv4Checksums(out); err != nil {
+			hostinfo.errCounters.badChecksums.Add(1)
+			f.metricBadChecksum.Inc(1)
+			if f.l.Level >= logrus.DebugLevel {
+				hostinfo.logger(f.l).WithError(err).WithField("fwPacket", fwPacket).
+					Debugln("dropping inbound packet with a bad checksum")
+			}
+			return false
+		}
+	}
+
+	// Arrival times are only tracked when they are used, a packet is late once it was overtaken for max_packet_age
+	accepted, late := true, time.Duration(0)
+	maxAge := f.maxPacketAge.Load()
+	if maxAge > 0 {
+		accepted, late = hostinfo.ConnectionState.window.UpdateAt(f.l, h.MessageCounter, time.Now())
+	} else {
+		accepted = hostinfo.ConnectionState.window.Update(f.l, h.MessageCounter)
+	}
+	if !accepted {
+		hostinfo.errCounters.outOfWindow.Add(1)
 		hostinfo.logger(f.l).WithField("fwPacket", fwPacket).
 			Debugln("dropping out of window packet")
 		return false
 	}
 
-	dropReason := f.firewall.Drop(*fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache)
+	if f.tunnelPause.dropIncoming(hostinfo) {
+		// The packet is authentic, it still counts as traffic from the peer
+		return true
+	}
+
+	if maxAge > 0 && late > time.Duration(maxAge) {
+		hostinfo.errCounters.tooLate.Add(1)
+		f.metricTooLate.Inc(1)
+		if f.l.Level >= logrus.DebugLevel {
+			hostinfo.logger(f.l).WithField("fwPacket", fwPacket).WithField("late", late).
+				Debugln("dropping inbound packet that arrived too late")
+		}
+		return false
+	}
+
+	if f.routingLoop(hostinfo, fwPacket, via) {
+		return false
+	}
+
+	if f.observer.drop(f.l, fwPacket, true) {
+		return false
+	}
+
+	inboundPacket := f.multicastInbound(*fwPacket)
+	dropRule, dropReason := f.firewall.DropRule(inboundPacket, true, via != nil, hostinfo, f.pki.GetCAPool(), localCache)
 	if dropReason != nil {
 		// NOTE: We give `packet` as the `out` here since we already decrypted from it and we don't need it anymore
 		// This gives us a buffer to build the reject packet in
-		f.rejectOutside(out, hostinfo.ConnectionState, hostinfo, nb, packet, q)
+		f.rejectOutside(out, hostinfo.ConnectionState, hostinfo, dropRule, nb, packet, q)
+		hostinfo.errCounters.firewallDrops.Add(1)
+		f.dropWatch.notify(inboundPacket, true, hostinfo, dropRule, dropReason)
+		f.securityEvents.Load().firewallDrop(inboundPacket, true, hostinfo, dropRule, dropReason)
 		if f.l.Level >= logrus.DebugLevel {
 			hostinfo.logger(f.l).WithField("fwPacket", fwPacket).
 				WithField("reason", dropReason).
+				WithField("rule", dropRule).
 				Debugln("dropping inbound packet")
 		}
 		return false
 	}
 
+	f.rekey.observe(hostinfo, out)
+
+	if f.replyICMPEcho(out, fwPacket, hostinfo, nb, packet, q, localCache) {
+		return true
+	}
+
+	if !f.applyECN(out, ecn) {
+		if f.l.Level >= logrus.DebugLevel {
+			hostinfo.logger(f.l).WithField("fwPacket", fwPacket).
+				Debugln("dropping congestion experienced packet from non ECN capable transport")
+		}
+		return false
+	}
+
+	f.sampler.Load().sample(out, hostinfo, true, via != nil)
+
+	// The firewall has seen the overlay addresses, translate them for the local host
+	f.innerNAT.Inbound(out)
+
 	f.connectionManager.In(hostinfo.localIndexId)
-	_, err = f.readers[q].Write(out)
-	if err != nil {
-		f.l.WithError(err).Error("Failed to write to tun")
+	hostinfo.markData()
+	f.tunnelMetrics.rx(hostinfo, len(out))
+	if err = f.writeTun(q, out); err != nil {
+		hostinfo.errCounters.tunWriteErrors.Add(1)
 	}
 	return true
 }
 
-func (f *Interface) maybeSendRecvError(endpoint netip.AddrPort, index uint32) {
+// readRetiredPacket delivers a data packet sent with the keys of a tunnel that was replaced by a newer one. The retired
+// tunnel has its own replay window so old and new keys can not be used to replay each other's packets.
+func (f *Interface) readRetiredPacket(hostinfo *HostInfo, ip netip.AddrPort, via *ViaSender, h *header.H, out []byte, packet []byte, ecn uint8, fwPacket *firewall.Packet, nb []byte, q int, localCache firewall.ConntrackCache) {
+	// Do not answer with a recv_error, that would tear down the tunnel that replaced this one
+	if !hostinfo.ConnectionState.window.Check(f.l, h.MessageCounter) {
+		hostinfo.errCounters.outOfWindow.Add(1)
+		return
+	}
+
+	if f.decryptToTun(hostinfo, ip, via, h, out, packet, ecn, fwPacket, nb, q, localCache, true) {
+		f.metricPreviousKeyRx.Inc(1)
+	}
+
+	// The connection manager is no longer checking this index, don't leave the traffic decryptToTun recorded behind
+	f.connectionManager.getAndResetTrafficCheck(hostinfo.localIndexId)
+}
+
+func (f *Interface) maybeSendRecvError(endpoint netip.AddrPort, index uint32, q int) {
 	if f.sendRecvErrorConfig.ShouldSendRecvError(endpoint) {
-		f.sendRecvError(endpoint, index)
+		f.sendRecvError(endpoint, index, q)
 	}
 }
 
-func (f *Interface) sendRecvError(endpoint netip.AddrPort, index uint32) {
+// sendRecvError sends a recv_error on the socket owned by routine q, which is the one that received the offending packet
+func (f *Interface) sendRecvError(endpoint netip.AddrPort, index uint32, q int) {
 	f.messageMetrics.Tx(header.RecvError, 0, 1)
 
 	//TODO: this should be a signed message so we can trust that we should drop the index
 	b := header.Encode(make([]byte, header.Len), header.Version, header.RecvError, 0, index, 0)
-	f.outside.WriteTo(b, endpoint)
+	f.writer(q).WriteTo(b, endpoint)
 	if f.l.Level >= logrus.DebugLevel {
 		f.l.WithField("index", index).
 			WithField("udpAddr", endpoint).
@@ -445,6 +669,34 @@ func (f *Interface) sendRecvError(endpoint netip.AddrPort, index uint32) {
 	}
 }
 
+// maybeSendIndexCollisionRecvError is called when a packet matched one of our local indexes but failed to decrypt.
+// If the packet came from an address other than the current remote for the tunnel then it is most likely from a peer
+// holding a stale tunnel whose index we reused after a restart. A recv_error prompts that peer to rehandshake instead
+// of waiting for its tunnel to time out. Failures from the current remote are left alone, the tunnel is healthy.
+func (f *Interface) maybeSendIndexCollisionRecvError(hostinfo *HostInfo, addr netip.AddrPort, h *header.H, q int) {
+	if !f.indexCollisionRecvError.Load() || !addr.IsValid() || addr == hostinfo.remote {
+		return
+	}
+
+	if !f.sendRecvErrorConfig.ShouldSendRecvError(addr) {
+		return
+	}
+
+	// Only one recv_error per tunnel per second, a stale peer will be sending a burst of packets
+	now := time.Now().UnixNano()
+	last := hostinfo.lastIndexCollision.Load()
+	if now-last < int64(time.Second) || !hostinfo.lastIndexCollision.CompareAndSwap(last, now) {
+		return
+	}
+
+	f.metricIndexCollisionRecvError.Inc(1)
+	if f.l.Level >= logrus.DebugLevel {
+		hostinfo.logger(f.l).WithField("udpAddr", addr).WithField("index", h.RemoteIndex).
+			Debug("Sending recv_error for a packet that failed to decrypt on a possibly reused index")
+	}
+	f.sendRecvError(addr, h.RemoteIndex, q)
+}
+
 func (f *Interface) handleRecvError(addr netip.AddrPort, h *header.H) {
 	if f.l.Level >= logrus.DebugLevel {
 		f.l.WithField("index", h.RemoteIndex).
@@ -494,13 +746,22 @@ func (f *Interface) sendMeta(ci *ConnectionState, endpoint *net.UDPAddr, meta *N
 }
 */
 
-func RecombineCertAndValidate(h *noise.HandshakeState, rawCertBytes []byte, caPool *cert.NebulaCAPool) (*cert.NebulaCertificate, error) {
+// RecombineCertAndValidate rebuilds the peer certificate with the public key from the handshake and verifies it against
+// caPool. A certificate only passes when the CA named by Details.Issuer is in the pool so the issuer is the fingerprint of
+// the validating CA, the handshake records it on the HostInfo. The local clock may be off by up to skew.
+func RecombineCertAndValidate(h *noise.HandshakeState, rawCertBytes []byte, caPool *cert.NebulaCAPool, skew time.Duration) (*cert.NebulaCertificate, error) {
 	pk := h.PeerStatic()
 
 	if pk == nil {
 		return nil, errors.New("no peer static key was present")
 	}
 
+	return recombineCertAndValidate(pk, rawCertBytes, caPool, skew)
+}
+
+// recombineCertAndValidate puts the peer static key pk into a certificate that was sent without its public key and
+// validates the result
+func recombineCertAndValidate(pk []byte, rawCertBytes []byte, caPool *cert.NebulaCAPool, skew time.Duration) (*cert.NebulaCertificate, error) {
 	if rawCertBytes == nil {
 		return nil, errors.New("provided payload was empty")
 	}
@@ -523,9 +784,21 @@ func RecombineCertAndValidate(h *noise.HandshakeState, rawCertBytes []byte, caPo
 	}
 
 	c, _ := cert.UnmarshalNebulaCertificate(recombined)
-	isValid, err := c.Verify(time.Now(), caPool)
+	now := time.Now()
+	isValid, err := c.VerifyWithSkew(now, skew, caPool)
 	if err != nil {
-		return c, fmt.Errorf("certificate validation failed: %s", err)
+		switch {
+		case errors.Is(err, cert.ErrNotYetValid):
+			return c, fmt.Errorf("certificate validation failed: %w, it is valid from %s but the local time is %s, the clock on this host or the issuing host may be wrong",
+				err, c.Details.NotBefore.UTC().Format(time.RFC3339), now.UTC().Format(time.RFC3339))
+		case errors.Is(err, cert.ErrRootNotYetValid):
+			return c, fmt.Errorf("certificate validation failed: %w, the local time is %s, the clock on this host may be behind",
+				err, now.UTC().Format(time.RFC3339))
+		case errors.Is(err, cert.ErrExpired):
+			return c, fmt.Errorf("certificate validation failed: %w, it expired at %s and the local time is %s",
+				err, c.Details.NotAfter.UTC().Format(time.RFC3339), now.UTC().Format(time.RFC3339))
+		}
+		return c, fmt.Errorf("certificate validation failed: %w", err)
 	} else if !isValid {
 		// This case should never happen but here's to defensive programming!
 		return c, errors.New("certificate validation failed but did not return an error")
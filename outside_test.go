@@ -3,10 +3,17 @@ package nebula
 import (
 	"net"
 	"net/netip"
+	"sync"
 	"testing"
 
+	"github.com/flynn/noise"
+	"github.com/rcrowley/go-metrics"
 	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/ipv4"
 )
 
@@ -81,3 +88,113 @@ func Test_newPacket(t *testing.T) {
 	assert.Equal(t, p.RemotePort, uint16(6))
 	assert.Equal(t, p.LocalPort, uint16(5))
 }
+
+type recordingConn struct {
+	udp.NoopConn
+	sent []netip.AddrPort
+}
+
+func (c *recordingConn) WriteTo(_ []byte, addr netip.AddrPort) error {
+	c.sent = append(c.sent, addr)
+	return nil
+}
+
+func Test_maybeSendIndexCollisionRecvError(t *testing.T) {
+	conn := &recordingConn{}
+	f := &Interface{
+		outside:                       conn,
+		messageMetrics:                newMessageMetricsOnlyRecvError(),
+		metricIndexCollisionRecvError: metrics.NewCounter(),
+		l:                             test.NewLogger(),
+	}
+
+	hostinfo := &HostInfo{remote: netip.MustParseAddrPort("10.0.0.1:4242")}
+	stale := netip.MustParseAddrPort("10.0.0.2:4242")
+	h := &header.H{RemoteIndex: 10}
+
+	// Disabled by default
+	f.maybeSendIndexCollisionRecvError(hostinfo, stale, h, 0)
+	assert.Empty(t, conn.sent)
+
+	f.indexCollisionRecvError.Store(true)
+
+	// Failures from the current remote are not index collisions
+	f.maybeSendIndexCollisionRecvError(hostinfo, hostinfo.remote, h, 0)
+	assert.Empty(t, conn.sent)
+
+	f.maybeSendIndexCollisionRecvError(hostinfo, stale, h, 0)
+	assert.Equal(t, []netip.AddrPort{stale}, conn.sent)
+	assert.Equal(t, int64(1), f.metricIndexCollisionRecvError.Count())
+
+	// Rate limited
+	f.maybeSendIndexCollisionRecvError(hostinfo, stale, h, 0)
+	assert.Len(t, conn.sent, 1)
+
+	// send_recv_error is respected
+	hostinfo.lastIndexCollision.Store(0)
+	f.sendRecvErrorConfig = sendRecvErrorNever
+	f.maybeSendIndexCollisionRecvError(hostinfo, stale, h, 0)
+	assert.Len(t, conn.sent, 1)
+}
+
+func Test_readRetiredPacket_decryptFailure(t *testing.T) {
+	conn := &recordingConn{}
+	f := &Interface{
+		outside:                       conn,
+		messageMetrics:                newMessageMetricsOnlyRecvError(),
+		metricIndexCollisionRecvError: metrics.NewCounter(),
+		connectionManager:             &connectionManager{inLock: &sync.RWMutex{}, outLock: &sync.RWMutex{}},
+		l:                             test.NewLogger(),
+	}
+	f.indexCollisionRecvError.Store(true)
+
+	cs := &NebulaCipherState{c: noise.CipherChaChaPoly.Cipher([32]byte{1})}
+	hostinfo := &HostInfo{
+		remote:          netip.MustParseAddrPort("10.0.0.1:4242"),
+		ConnectionState: &ConnectionState{dKey: cs, window: NewBits(ReplayWindow)},
+	}
+
+	// A packet from another address that fails to decrypt with the retired keys is dropped without a recv_error
+	h := &header.H{Type: header.Message, RemoteIndex: 10, MessageCounter: 1}
+	packet, err := h.Encode(make([]byte, header.Len))
+	require.NoError(t, err)
+	packet = append(packet, make([]byte, 32)...)
+	f.readRetiredPacket(hostinfo, netip.MustParseAddrPort("10.0.0.2:4242"), nil, h, make([]byte, mtu), packet, 0, &firewall.Packet{}, make([]byte, 12), 0, nil)
+	assert.Empty(t, conn.sent)
+	assert.Zero(t, f.metricIndexCollisionRecvError.Count())
+	assert.Equal(t, uint64(1), hostinfo.errCounters.decryptFailures.Load())
+}
+
+func Test_deniedIPOptions(t *testing.T) {
+	f := &Interface{
+		metricIPOptions: metrics.NewCounter(),
+		l:               test.NewLogger(),
+	}
+
+	h := ipv4.Header{
+		Version:  4,
+		Len:      24,
+		TotalLen: 24 + 8,
+		Src:      net.IPv4(10, 0, 0, 1),
+		Dst:      net.IPv4(10, 0, 0, 2),
+		Options:  []byte{7, 4, 4, 0},
+		Protocol: firewall.ProtoUDP,
+	}
+	withOptions, _ := h.Marshal()
+	withOptions = append(withOptions, make([]byte, 8)...)
+
+	h.Len, h.TotalLen, h.Options = 20, 20+8, nil
+	plain, _ := h.Marshal()
+	plain = append(plain, make([]byte, 8)...)
+
+	fp := &firewall.Packet{}
+	assert.NoError(t, newPacket(withOptions, true, fp))
+
+	// Allowed by default
+	assert.False(t, f.deniedIPOptions(withOptions, fp))
+
+	f.dropIPOptions.Store(true)
+	assert.True(t, f.deniedIPOptions(withOptions, fp))
+	assert.False(t, f.deniedIPOptions(plain, fp))
+	assert.Equal(t, int64(1), f.metricIPOptions.Count())
+}
@@ -0,0 +1,125 @@
+package overlay
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	// defaultSourceRouteTable is the first routing table used for tun.source_routes, each entry gets its own table
+	defaultSourceRouteTable = 4242
+	// sourceRoutePriority is the rule priority of a host source route, shorter prefixes are evaluated after it
+	sourceRoutePriority = 4242
+)
+
+// SourceRoute sends traffic that arrives from the overlay with an inner source within Source out through Dev and/or
+// Via instead of following the main route table. It is installed as a policy routing rule pointing to its own table.
+type SourceRoute struct {
+	Source netip.Prefix
+	Via    netip.Addr
+	Dev    string
+	Table  int
+}
+
+// Priority returns the rule priority for the route. The kernel evaluates rules in priority order and takes the first
+// match so longer prefixes get a lower priority, giving longest prefix wins across overlapping sources.
+func (r SourceRoute) Priority() int {
+	return sourceRoutePriority + r.Source.Addr().BitLen() - r.Source.Bits()
+}
+
+func (r SourceRoute) String() string {
+	s := "from " + r.Source.String()
+	if r.Via.IsValid() {
+		s += " via " + r.Via.String()
+	}
+	if r.Dev != "" {
+		s += " dev " + r.Dev
+	}
+	return s + " table " + strconv.Itoa(r.Table)
+}
+
+func parseSourceRoutes(c *config.C) ([]SourceRoute, error) {
+	r := c.Get("tun.source_routes")
+	if r == nil {
+		return []SourceRoute{}, nil
+	}
+
+	rawRoutes, ok := r.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tun.source_routes is not an array")
+	}
+
+	routes := make([]SourceRoute, len(rawRoutes))
+	seen := map[netip.Prefix]int{}
+	tables := map[int]int{}
+	for i, r := range rawRoutes {
+		m, ok := r.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("entry %v in tun.source_routes is invalid", i+1)
+		}
+
+		rSource, ok := m["source"]
+		if !ok {
+			return nil, fmt.Errorf("entry %v.source in tun.source_routes is not present", i+1)
+		}
+
+		source, err := netip.ParsePrefix(fmt.Sprintf("%v", rSource))
+		if err != nil {
+			return nil, fmt.Errorf("entry %v.source in tun.source_routes failed to parse: %v", i+1, err)
+		}
+		source = source.Masked()
+
+		if j, ok := seen[source]; ok {
+			return nil, fmt.Errorf("entry %v.source in tun.source_routes duplicates entry %v: %v", i+1, j, source)
+		}
+		seen[source] = i + 1
+
+		sr := SourceRoute{Source: source, Table: defaultSourceRouteTable + i}
+
+		if rVia, ok := m["via"]; ok {
+			sr.Via, err = netip.ParseAddr(fmt.Sprintf("%v", rVia))
+			if err != nil {
+				return nil, fmt.Errorf("entry %v.via in tun.source_routes failed to parse address: %v", i+1, err)
+			}
+
+			if sr.Via.Is4() != source.Addr().Is4() {
+				return nil, fmt.Errorf("entry %v.via in tun.source_routes is not the same address family as the source: %v", i+1, sr.Via)
+			}
+		}
+
+		if rDev, ok := m["dev"]; ok {
+			sr.Dev, ok = rDev.(string)
+			if !ok || sr.Dev == "" {
+				return nil, fmt.Errorf("entry %v.dev in tun.source_routes is not a device name: %v", i+1, rDev)
+			}
+		}
+
+		if !sr.Via.IsValid() && sr.Dev == "" {
+			return nil, fmt.Errorf("entry %v in tun.source_routes needs a via, a dev, or both", i+1)
+		}
+
+		if rTable, ok := m["table"]; ok {
+			sr.Table, err = strconv.Atoi(fmt.Sprintf("%v", rTable))
+			if err != nil || sr.Table <= 0 {
+				return nil, fmt.Errorf("entry %v.table in tun.source_routes is not a positive integer: %v", i+1, rTable)
+			}
+		}
+
+		// 253 through 255 are the default, main, and local tables
+		if sr.Table >= 253 && sr.Table <= 255 {
+			return nil, fmt.Errorf("entry %v.table in tun.source_routes is a reserved table: %v", i+1, sr.Table)
+		}
+
+		if j, ok := tables[sr.Table]; ok {
+			return nil, fmt.Errorf("entry %v.table in tun.source_routes is already used by entry %v: %v", i+1, j, sr.Table)
+		}
+		tables[sr.Table] = i + 1
+
+		routes[i] = sr
+	}
+
+	return routes, nil
+}
@@ -0,0 +1,131 @@
+package overlay
+
+import (
+	"net/netip"
+	"sort"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseSourceRoutes(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	routes, err := parseSourceRoutes(c)
+	assert.Nil(t, err)
+	assert.Len(t, routes, 0)
+
+	set := func(v interface{}) {
+		c.Settings["tun"] = map[interface{}]interface{}{"source_routes": v}
+	}
+	entry := func(m map[interface{}]interface{}) {
+		set([]interface{}{m})
+	}
+
+	set("hi")
+	_, err = parseSourceRoutes(c)
+	assert.EqualError(t, err, "tun.source_routes is not an array")
+
+	set([]interface{}{"asdf"})
+	_, err = parseSourceRoutes(c)
+	assert.EqualError(t, err, "entry 1 in tun.source_routes is invalid")
+
+	entry(map[interface{}]interface{}{"via": "192.168.1.1"})
+	_, err = parseSourceRoutes(c)
+	assert.EqualError(t, err, "entry 1.source in tun.source_routes is not present")
+
+	entry(map[interface{}]interface{}{"source": "nope", "via": "192.168.1.1"})
+	_, err = parseSourceRoutes(c)
+	assert.EqualError(t, err, `entry 1.source in tun.source_routes failed to parse: netip.ParsePrefix("nope"): no '/'`)
+
+	entry(map[interface{}]interface{}{"source": "10.0.0.0/24"})
+	_, err = parseSourceRoutes(c)
+	assert.EqualError(t, err, "entry 1 in tun.source_routes needs a via, a dev, or both")
+
+	entry(map[interface{}]interface{}{"source": "10.0.0.0/24", "via": "nope"})
+	_, err = parseSourceRoutes(c)
+	assert.EqualError(t, err, `entry 1.via in tun.source_routes failed to parse address: ParseAddr("nope"): unable to parse IP`)
+
+	entry(map[interface{}]interface{}{"source": "10.0.0.0/24", "via": "fd00::1"})
+	_, err = parseSourceRoutes(c)
+	assert.EqualError(t, err, "entry 1.via in tun.source_routes is not the same address family as the source: fd00::1")
+
+	entry(map[interface{}]interface{}{"source": "10.0.0.0/24", "dev": 1})
+	_, err = parseSourceRoutes(c)
+	assert.EqualError(t, err, "entry 1.dev in tun.source_routes is not a device name: 1")
+
+	entry(map[interface{}]interface{}{"source": "10.0.0.0/24", "dev": "eth1", "table": "main"})
+	_, err = parseSourceRoutes(c)
+	assert.EqualError(t, err, "entry 1.table in tun.source_routes is not a positive integer: main")
+
+	entry(map[interface{}]interface{}{"source": "10.0.0.0/24", "dev": "eth1", "table": 254})
+	_, err = parseSourceRoutes(c)
+	assert.EqualError(t, err, "entry 1.table in tun.source_routes is a reserved table: 254")
+
+	set([]interface{}{
+		map[interface{}]interface{}{"source": "10.0.0.0/24", "dev": "eth1"},
+		map[interface{}]interface{}{"source": "10.0.0.1/24", "dev": "eth2"},
+	})
+	_, err = parseSourceRoutes(c)
+	assert.EqualError(t, err, "entry 2.source in tun.source_routes duplicates entry 1: 10.0.0.0/24")
+
+	set([]interface{}{
+		map[interface{}]interface{}{"source": "10.0.0.0/24", "dev": "eth1"},
+		map[interface{}]interface{}{"source": "10.0.1.0/24", "dev": "eth2", "table": defaultSourceRouteTable},
+	})
+	_, err = parseSourceRoutes(c)
+	assert.EqualError(t, err, "entry 2.table in tun.source_routes is already used by entry 1: 4242")
+
+	set([]interface{}{
+		map[interface{}]interface{}{"source": "10.0.0.0/16", "via": "192.168.1.1"},
+		map[interface{}]interface{}{"source": "10.0.1.0/24", "via": "192.168.2.1", "dev": "eth2"},
+		map[interface{}]interface{}{"source": "fd00::/64", "dev": "eth3", "table": 100},
+	})
+	routes, err = parseSourceRoutes(c)
+	require.NoError(t, err)
+	assert.Equal(t, []SourceRoute{
+		{Source: netip.MustParsePrefix("10.0.0.0/16"), Via: netip.MustParseAddr("192.168.1.1"), Table: 4242},
+		{Source: netip.MustParsePrefix("10.0.1.0/24"), Via: netip.MustParseAddr("192.168.2.1"), Dev: "eth2", Table: 4243},
+		{Source: netip.MustParsePrefix("fd00::/64"), Dev: "eth3", Table: 100},
+	}, routes)
+	assert.Equal(t, "from 10.0.1.0/24 via 192.168.2.1 dev eth2 table 4243", routes[1].String())
+}
+
+func TestSourceRoute_Priority(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["tun"] = map[interface{}]interface{}{"source_routes": []interface{}{
+		map[interface{}]interface{}{"source": "0.0.0.0/0", "dev": "default"},
+		map[interface{}]interface{}{"source": "10.0.0.0/8", "dev": "wide"},
+		map[interface{}]interface{}{"source": "10.1.2.3/32", "dev": "host"},
+		map[interface{}]interface{}{"source": "10.1.0.0/16", "dev": "narrow"},
+	}}
+	routes, err := parseSourceRoutes(c)
+	require.NoError(t, err)
+
+	// Evaluate the rules the way the kernel does, lowest priority first and the first match wins
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Priority() < routes[j].Priority()
+	})
+	match := func(src string) string {
+		addr := netip.MustParseAddr(src)
+		for _, r := range routes {
+			if r.Source.Contains(addr) {
+				return r.Dev
+			}
+		}
+		return ""
+	}
+
+	assert.Equal(t, "host", match("10.1.2.3"))
+	assert.Equal(t, "narrow", match("10.1.2.4"))
+	assert.Equal(t, "wide", match("10.2.0.1"))
+	assert.Equal(t, "default", match("192.168.0.1"))
+
+	assert.Equal(t, sourceRoutePriority, routes[0].Priority())
+	assert.Equal(t, sourceRoutePriority+32, routes[3].Priority())
+}
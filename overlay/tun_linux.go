@@ -37,6 +37,8 @@ type tun struct {
 	routeChan       chan struct{}
 	useSystemRoutes bool
 
+	sourceRoutes atomic.Pointer[[]SourceRoute]
+
 	l *logrus.Logger
 }
 
@@ -153,6 +155,19 @@ func (t *tun) reload(c *config.C, initial bool) error {
 		return err
 	}
 
+	if initial || c.HasChanged("tun.source_routes") {
+		sourceRoutes, err := parseSourceRoutes(c)
+		if err != nil {
+			return util.NewContextualError("Could not parse tun.source_routes", nil, err)
+		}
+
+		oldSourceRoutes := t.sourceRoutes.Swap(&sourceRoutes)
+		if !initial {
+			t.removeSourceRoutes(*oldSourceRoutes)
+			t.addSourceRoutes(true)
+		}
+	}
+
 	if !initial && !routeChange && !c.HasChanged("tun.mtu") {
 		return nil
 	}
@@ -345,6 +360,10 @@ func (t *tun) Activate() error {
 		return err
 	}
 
+	if err = t.addSourceRoutes(false); err != nil {
+		return err
+	}
+
 	// Run the interface
 	ifrf.Flags = ifrf.Flags | unix.IFF_UP | unix.IFF_RUNNING
 	if err = ioctl(t.ioctlFd, unix.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifrf))); err != nil {
@@ -463,6 +482,93 @@ func (t *tun) removeRoutes(routes []Route) {
 	}
 }
 
+// sourceRouteNetlink builds the policy rule and the route in its table for a source route. The rule only matches
+// packets coming out of the tun device so traffic originating on this host is unaffected.
+func (t *tun) sourceRouteNetlink(r SourceRoute) (*netlink.Rule, *netlink.Route, error) {
+	family := unix.AF_INET
+	if !r.Source.Addr().Is4() {
+		family = unix.AF_INET6
+	}
+
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Src = &net.IPNet{
+		IP:   r.Source.Addr().AsSlice(),
+		Mask: net.CIDRMask(r.Source.Bits(), r.Source.Addr().BitLen()),
+	}
+	rule.IifName = t.Device
+	rule.Table = r.Table
+	rule.Priority = r.Priority()
+
+	nr := &netlink.Route{
+		Family: family,
+		Dst: &net.IPNet{
+			IP:   make(net.IP, r.Source.Addr().BitLen()/8),
+			Mask: net.CIDRMask(0, r.Source.Addr().BitLen()),
+		},
+		Table: r.Table,
+	}
+
+	if r.Via.IsValid() {
+		nr.Gw = r.Via.AsSlice()
+	}
+
+	if r.Dev != "" {
+		link, err := netlink.LinkByName(r.Dev)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find device %s: %w", r.Dev, err)
+		}
+		nr.LinkIndex = link.Attrs().Index
+	}
+
+	return rule, nr, nil
+}
+
+func (t *tun) addSourceRoutes(logErrors bool) error {
+	for _, r := range *t.sourceRoutes.Load() {
+		rule, nr, err := t.sourceRouteNetlink(r)
+		if err == nil {
+			err = netlink.RouteReplace(nr)
+		}
+		if err == nil {
+			// Rules are not replaced in place, drop any leftover from a previous run first
+			_ = netlink.RuleDel(rule)
+			err = netlink.RuleAdd(rule)
+		}
+
+		if err != nil {
+			retErr := util.NewContextualError("Failed to add source route", map[string]interface{}{"sourceRoute": r}, err)
+			if logErrors {
+				retErr.Log(t.l)
+			} else {
+				return retErr
+			}
+		} else {
+			t.l.WithField("sourceRoute", r).Info("Added source route")
+		}
+	}
+
+	return nil
+}
+
+func (t *tun) removeSourceRoutes(routes []SourceRoute) {
+	for _, r := range routes {
+		rule, nr, err := t.sourceRouteNetlink(r)
+		if err == nil {
+			err = netlink.RuleDel(rule)
+		}
+		if err == nil {
+			err = netlink.RouteDel(nr)
+		}
+
+		if err != nil {
+			t.l.WithError(err).WithField("sourceRoute", r).Error("Failed to remove source route")
+		} else {
+			t.l.WithField("sourceRoute", r).Info("Removed source route")
+		}
+	}
+}
+
 func (t *tun) Cidr() netip.Prefix {
 	return t.cidr
 }
@@ -562,6 +668,11 @@ func (t *tun) Close() error {
 		close(t.routeChan)
 	}
 
+	// The rules outlive the device, clean them up while we still know them
+	if t.deviceIndex != 0 {
+		t.removeSourceRoutes(*t.sourceRoutes.Load())
+	}
+
 	if t.ReadWriteCloser != nil {
 		t.ReadWriteCloser.Close()
 	}
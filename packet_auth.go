@@ -0,0 +1,333 @@
+package nebula
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/packetauth"
+)
+
+// PacketAuth is per packet authorization on top of the tunnel: every data packet from a peer in one of the
+// packet_auth.require_groups has to carry a token from a policy server proving the peer may send to the destination of
+// the packet, see the packetauth package for the token format. Tokens are checked in decryptToTun before the firewall,
+// a packet without a valid token is dropped and counted in packet_auth.failed.
+//
+// A token rides in front of the inner packet in a header.MessageAuthorized packet, inside the encryption. We attach
+// the longest lived of our tokens in packet_auth.tokens that covers the destination to every data packet, the token files are
+// read again every packet_auth.refresh so a policy server can replace them before they expire.
+//
+// The cost per packet is TokenLen more bytes on the wire and through the AEAD, a copy of the packet on the sending side
+// and a cache lookup on the receiving side. The ed25519 signature of a token is only checked the first time it is seen,
+// counted in packet_auth.verified, the checked tokens are kept until they expire or make room for newer ones.
+type PacketAuth struct {
+	state atomic.Pointer[packetAuthState]
+	// tokenFiles is packet_auth.tokens, read again every refresh
+	tokenFiles atomic.Pointer[[]string]
+	refresh    atomic.Int64
+
+	metricFailed   metrics.Counter
+	metricVerified metrics.Counter
+
+	l *logrus.Logger
+}
+
+type packetAuthState struct {
+	issuers       []ed25519.PublicKey
+	requireGroups map[string]struct{}
+	// tokens are ours, to attach to the packets we send
+	tokens atomic.Pointer[[]*packetauth.Token]
+	// verified holds the tokens of peers with a good signature, keyed by the token
+	verified      sync.Map
+	verifiedCount atomic.Int64
+}
+
+const (
+	defaultPacketAuthRefresh = 30 * time.Second
+	// packetAuthMaxVerified bounds the tokens kept as verified, past it a new token takes the place of the one that
+	// expires first
+	packetAuthMaxVerified = 4096
+)
+
+// payloadBufs hold a payload rebuilt to be sent, with a token or padding added
+var payloadBufs = sync.Pool{New: func() any {
+	b := make([]byte, 0, mtu)
+	return &b
+}}
+
+func NewPacketAuthFromConfig(l *logrus.Logger, c *config.C) (*PacketAuth, error) {
+	pa := &PacketAuth{
+		metricFailed:   metrics.GetOrRegisterCounter("packet_auth.failed", nil),
+		metricVerified: metrics.GetOrRegisterCounter("packet_auth.verified", nil),
+		l:              l,
+	}
+
+	if err := pa.reload(c, true); err != nil {
+		return nil, err
+	}
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := pa.reload(c, false); err != nil {
+			l.WithError(err).Error("Failed to reload packet_auth, keeping the previous settings")
+		}
+	})
+
+	return pa, nil
+}
+
+func (pa *PacketAuth) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("packet_auth") {
+		return nil
+	}
+
+	refresh := c.GetDuration("packet_auth.refresh", defaultPacketAuthRefresh)
+	if refresh <= 0 {
+		return fmt.Errorf("packet_auth.refresh must be positive, got %v", refresh)
+	}
+
+	rawIssuers := c.GetStringSlice("packet_auth.issuers", []string{})
+	files := c.GetStringSlice("packet_auth.tokens", []string{})
+	groups := c.GetStringSlice("packet_auth.require_groups", []string{})
+	if len(rawIssuers) == 0 && len(files) == 0 {
+		if len(groups) > 0 {
+			return fmt.Errorf("packet_auth.require_groups needs packet_auth.issuers")
+		}
+		pa.state.Store(nil)
+		pa.tokenFiles.Store(&files)
+		return nil
+	}
+
+	st := &packetAuthState{requireGroups: map[string]struct{}{}}
+	for i, s := range rawIssuers {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return fmt.Errorf("packet_auth.issuers entry #%v is not a base64 ed25519 public key", i)
+		}
+		st.issuers = append(st.issuers, ed25519.PublicKey(b))
+	}
+	for _, g := range groups {
+		st.requireGroups[g] = struct{}{}
+	}
+
+	tokens, err := readPacketAuthTokens(files)
+	if err != nil {
+		return err
+	}
+	st.tokens.Store(&tokens)
+
+	pa.refresh.Store(int64(refresh))
+	pa.tokenFiles.Store(&files)
+	pa.state.Store(st)
+	pa.l.WithField("issuers", len(st.issuers)).WithField("requireGroups", groups).WithField("tokens", len(tokens)).
+		Info("packet_auth is enabled")
+	return nil
+}
+
+// readPacketAuthTokens reads the base64 token in each of files
+func readPacketAuthTokens(files []string) ([]*packetauth.Token, error) {
+	var tokens []*packetauth.Token
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("packet_auth.tokens: %w", err)
+		}
+
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+		if err != nil {
+			return nil, fmt.Errorf("packet_auth.tokens %s: %w", file, err)
+		}
+		t, err := packetauth.Parse(b)
+		if err != nil {
+			return nil, fmt.Errorf("packet_auth.tokens %s: %w", file, err)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+// Run reads the token files again and forgets expired tokens every packet_auth.refresh until ctx is done
+func (pa *PacketAuth) Run(ctx context.Context) {
+	timer := time.NewTimer(pa.refreshInterval())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-timer.C:
+			pa.refreshTokens(now)
+			timer.Reset(pa.refreshInterval())
+		}
+	}
+}
+
+func (pa *PacketAuth) refreshInterval() time.Duration {
+	if r := pa.refresh.Load(); r > 0 {
+		return time.Duration(r)
+	}
+	return defaultPacketAuthRefresh
+}
+
+func (pa *PacketAuth) refreshTokens(now time.Time) {
+	st := pa.state.Load()
+	if st == nil {
+		return
+	}
+
+	tokens, err := readPacketAuthTokens(*pa.tokenFiles.Load())
+	if err != nil {
+		pa.l.WithError(err).Error("Failed to read the packet auth tokens, keeping the previous ones")
+	} else {
+		st.tokens.Store(&tokens)
+	}
+
+	st.verified.Range(func(k, v any) bool {
+		if !now.Before(v.(*packetauth.Token).NotAfter) {
+			st.forget(k)
+		}
+		return true
+	})
+}
+
+// tokenFor returns the token to attach to the inner packet p, nil if we have none for its destination
+func (pa *PacketAuth) tokenFor(p []byte) []byte {
+	if pa == nil {
+		return nil
+	}
+	st := pa.state.Load()
+	if st == nil || len(p) < 20 || p[0]>>4 != 4 {
+		return nil
+	}
+
+	//TODO: IPV6-WORK
+	dst := netip.AddrFrom4([4]byte(p[16:20]))
+	now := time.Now()
+	var best *packetauth.Token
+	for _, t := range *st.tokens.Load() {
+		if t.Destination.Contains(dst) && t.ValidAt(now) && (best == nil || t.NotAfter.After(best.NotAfter)) {
+			best = t
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	return best.Raw[:]
+}
+
+// allowInbound returns true if a packet from hostinfo to dst may go on to the firewall, token is the token it carried,
+// nil if none
+func (pa *PacketAuth) allowInbound(hostinfo *HostInfo, token []byte, dst netip.Addr) bool {
+	if pa == nil {
+		return true
+	}
+	st := pa.state.Load()
+	if st == nil || len(st.issuers) == 0 {
+		// We only send tokens, any we receive are not checked
+		return true
+	}
+
+	if token == nil {
+		if !st.required(hostinfo) {
+			return true
+		}
+		return pa.fail(hostinfo, dst, "missing")
+	}
+
+	t, err := pa.verify(st, token)
+	switch {
+	case err != nil:
+		return pa.fail(hostinfo, dst, err.Error())
+	case t.Sender != hostinfo.vpnIp:
+		return pa.fail(hostinfo, dst, "issued to another sender")
+	case !t.Destination.Contains(dst):
+		return pa.fail(hostinfo, dst, "destination not covered")
+	case !t.ValidAt(time.Now()):
+		return pa.fail(hostinfo, dst, "expired")
+	}
+	return true
+}
+
+// verify returns token parsed, its signature is checked the first time it is seen
+func (pa *PacketAuth) verify(st *packetAuthState, token []byte) (*packetauth.Token, error) {
+	key := [packetauth.TokenLen]byte(token)
+	if v, ok := st.verified.Load(key); ok {
+		return v.(*packetauth.Token), nil
+	}
+
+	t, err := packetauth.Parse(token)
+	if err != nil {
+		return nil, err
+	}
+	pa.metricVerified.Inc(1)
+	if err := t.Verify(st.issuers); err != nil {
+		return nil, err
+	}
+
+	if st.verifiedCount.Load() >= packetAuthMaxVerified {
+		st.evictFirstExpiring()
+	}
+	if _, loaded := st.verified.LoadOrStore(key, t); !loaded {
+		st.verifiedCount.Add(1)
+	}
+	return t, nil
+}
+
+// evictFirstExpiring forgets the verified token that expires first to make room for a new one
+func (st *packetAuthState) evictFirstExpiring() {
+	var first any
+	var firstNotAfter time.Time
+	st.verified.Range(func(k, v any) bool {
+		notAfter := v.(*packetauth.Token).NotAfter
+		if first == nil || notAfter.Before(firstNotAfter) {
+			first, firstNotAfter = k, notAfter
+		}
+		return true
+	})
+	if first != nil {
+		st.forget(first)
+	}
+}
+
+// forget removes a verified token, it is safe to race with another forget of the same token
+func (st *packetAuthState) forget(k any) {
+	if _, loaded := st.verified.LoadAndDelete(k); loaded {
+		st.verifiedCount.Add(-1)
+	}
+}
+
+// required returns true if the packets of hostinfo have to carry a token
+func (st *packetAuthState) required(hostinfo *HostInfo) bool {
+	if len(st.requireGroups) == 0 {
+		return false
+	}
+
+	c := hostinfo.GetCert()
+	if c == nil {
+		return true
+	}
+	for _, g := range c.Details.Groups {
+		if _, ok := st.requireGroups[g]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (pa *PacketAuth) fail(hostinfo *HostInfo, dst netip.Addr, reason string) bool {
+	pa.metricFailed.Inc(1)
+	if pa.l.Level >= logrus.DebugLevel {
+		hostinfo.logger(pa.l).WithField("destination", dst).WithField("reason", reason).
+			Debug("Dropping packet that failed packet authorization")
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package nebula
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/packetauth"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketAuth(t *testing.T) {
+	l := test.NewLogger()
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	me := netip.MustParseAddr("10.128.0.1")
+	peer := netip.MustParseAddr("10.128.0.2")
+	now := time.Now()
+	mint := func(k ed25519.PrivateKey, sender netip.Addr, dst string, notAfter time.Time) []byte {
+		b, err := packetauth.Mint(k, sender, netip.MustParsePrefix(dst), now.Add(-time.Minute), notAfter)
+		require.NoError(t, err)
+		return b
+	}
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	writeToken := func(b []byte) {
+		require.NoError(t, os.WriteFile(tokenFile, []byte(base64.StdEncoding.EncodeToString(b)+"\n"), 0600))
+	}
+	mine := mint(key, me, "10.128.0.0/28", now.Add(time.Hour))
+	writeToken(mine)
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+packet_auth:
+  issuers: [`+base64.StdEncoding.EncodeToString(pub)+`]
+  require_groups: [secure]
+  tokens: [`+tokenFile+`]
+`))
+	pa, err := NewPacketAuthFromConfig(l, c)
+	require.NoError(t, err)
+
+	t.Log("Our token is attached to packets to the destinations it covers")
+	packet := func(dst string) []byte {
+		p := make([]byte, 20)
+		p[0] = 0x45
+		copy(p[16:], netip.MustParseAddr(dst).AsSlice())
+		return p
+	}
+	assert.Equal(t, mine, pa.tokenFor(packet("10.128.0.2")))
+	assert.Nil(t, pa.tokenFor(packet("10.128.0.20")))
+
+	t.Log("A new token file is picked up on refresh")
+	newer := mint(key, me, "10.128.0.0/24", now.Add(2*time.Hour))
+	writeToken(newer)
+	pa.refreshTokens(now)
+	assert.Equal(t, newer, pa.tokenFor(packet("10.128.0.20")))
+
+	hostinfo := func(groups ...string) *HostInfo {
+		return &HostInfo{vpnIp: peer, ConnectionState: &ConnectionState{
+			peerCert: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Groups: groups}},
+		}}
+	}
+	secure, other := hostinfo("secure", "web"), hostinfo("web")
+
+	t.Log("Peers in require_groups need a token, others do not")
+	failed := pa.metricFailed.Count()
+	assert.False(t, pa.allowInbound(secure, nil, me))
+	assert.True(t, pa.allowInbound(other, nil, me))
+	assert.Equal(t, failed+1, pa.metricFailed.Count())
+
+	t.Log("The signature of a token is only checked the first time")
+	good := mint(key, peer, "10.128.0.1/32", now.Add(time.Hour))
+	verified := pa.metricVerified.Count()
+	assert.True(t, pa.allowInbound(secure, good, me))
+	assert.True(t, pa.allowInbound(secure, good, me))
+	assert.Equal(t, verified+1, pa.metricVerified.Count())
+
+	t.Log("Bad tokens are refused, even from peers that do not need one")
+	failed = pa.metricFailed.Count()
+	assert.False(t, pa.allowInbound(other, mint(otherKey, peer, "10.128.0.1/32", now.Add(time.Hour)), me), "untrusted issuer")
+	assert.False(t, pa.allowInbound(secure, mint(key, me, "10.128.0.1/32", now.Add(time.Hour)), me), "another sender")
+	assert.False(t, pa.allowInbound(secure, good, netip.MustParseAddr("10.128.0.3")), "destination not covered")
+	expiring := mint(key, peer, "10.128.0.1/32", now.Add(time.Second))
+	assert.True(t, pa.allowInbound(secure, expiring, me))
+	assert.Equal(t, failed+3, pa.metricFailed.Count())
+
+	t.Log("Expired tokens are forgotten on refresh")
+	assert.Equal(t, int64(3), pa.state.Load().verifiedCount.Load())
+	pa.refreshTokens(now.Add(2 * time.Second))
+	assert.Equal(t, int64(2), pa.state.Load().verifiedCount.Load())
+
+	t.Log("Without packet_auth nothing is attached or checked")
+	require.NoError(t, c.ReloadConfigString("packet_auth: {}"))
+	assert.Nil(t, pa.tokenFor(packet("10.128.0.2")))
+	assert.True(t, pa.allowInbound(secure, nil, me))
+
+	var nilPA *PacketAuth
+	assert.Nil(t, nilPA.tokenFor(packet("10.128.0.2")))
+	assert.True(t, nilPA.allowInbound(secure, nil, me))
+
+	t.Log("require_groups needs issuers")
+	c = config.NewC(l)
+	require.NoError(t, c.LoadString("packet_auth: {require_groups: [secure]}"))
+	_, err = NewPacketAuthFromConfig(l, c)
+	assert.Error(t, err)
+}
+
+func TestPacketAuth_verifyFull(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	pa := &PacketAuth{metricVerified: metrics.NewCounter()}
+	st := &packetAuthState{issuers: []ed25519.PublicKey{pub}}
+
+	now := time.Now()
+	for i := 0; i < packetAuthMaxVerified; i++ {
+		k := [packetauth.TokenLen]byte{}
+		binary.BigEndian.PutUint32(k[:], uint32(i))
+		notAfter := now.Add(time.Hour + time.Duration(i)*time.Second)
+		if i == 100 {
+			notAfter = now.Add(time.Minute)
+		}
+		st.verified.Store(k, &packetauth.Token{NotAfter: notAfter})
+		st.verifiedCount.Add(1)
+	}
+
+	t.Log("A new token takes the place of the one that expires first")
+	token, err := packetauth.Mint(key, netip.MustParseAddr("10.128.0.2"), netip.MustParsePrefix("10.128.0.1/32"), now.Add(-time.Minute), now.Add(time.Hour))
+	require.NoError(t, err)
+	_, err = pa.verify(st, token)
+	require.NoError(t, err)
+	assert.Equal(t, int64(packetAuthMaxVerified), st.verifiedCount.Load())
+
+	_, ok := st.verified.Load([packetauth.TokenLen]byte(token))
+	assert.True(t, ok)
+	first := [packetauth.TokenLen]byte{}
+	binary.BigEndian.PutUint32(first[:], 100)
+	_, ok = st.verified.Load(first)
+	assert.False(t, ok)
+
+	_, err = pa.verify(st, token)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), pa.metricVerified.Count())
+}
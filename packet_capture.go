@@ -0,0 +1,248 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+)
+
+// Capture file layout, all integers are big endian:
+//
+//	magic (8 bytes) "NEBCAP" + uint16 version
+//
+// followed by any number of records:
+//
+//	timestamp (int64 unix nanoseconds)
+//	source ip (16 bytes, ipv4 addresses are stored mapped)
+//	source port (uint16)
+//	flags (uint8, bit 0 set if the source ip was ipv4)
+//	type (uint8), subtype (uint8), remote index (uint32) as parsed from the nebula header
+//	length (uint32)
+//	raw datagram (length bytes)
+//
+// Type, subtype, and remote index are informational only, replay always uses the raw datagram.
+const (
+	captureVersion       uint16 = 1
+	captureMagicLen             = 8
+	captureRecordHdrLen         = 8 + 16 + 2 + 1 + 1 + 1 + 4 + 4
+	captureFlagIs4       uint8  = 1
+	captureMaxRecordSize        = 65535
+)
+
+var captureMagic = [captureMagicLen]byte{'N', 'E', 'B', 'C', 'A', 'P', byte(captureVersion >> 8), byte(captureVersion)}
+
+var ErrInvalidCaptureFile = errors.New("invalid packet capture file")
+
+// CapturedPacket is a single raw inbound datagram, before any decryption has taken place
+type CapturedPacket struct {
+	Time        time.Time
+	Addr        netip.AddrPort
+	Type        header.MessageType
+	Subtype     header.MessageSubType
+	RemoteIndex uint32
+	Data        []byte
+}
+
+// packetCapture writes every inbound datagram seen by readOutsidePackets to a file
+type packetCapture struct {
+	sync.Mutex
+	path string
+	file *os.File
+	buf  []byte
+}
+
+func newPacketCapture(path string) (*packetCapture, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = file.Write(captureMagic[:])
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &packetCapture{path: path, file: file}, nil
+}
+
+// Write records a datagram. Each record is written with a single call so a capture is usable up to the last packet
+// seen before a crash.
+func (pc *packetCapture) Write(now time.Time, addr netip.AddrPort, packet []byte) {
+	if len(packet) > captureMaxRecordSize {
+		return
+	}
+
+	cp := CapturedPacket{Time: now, Addr: addr, Data: packet}
+	h := &header.H{}
+	if h.Parse(packet) == nil {
+		cp.Type = h.Type
+		cp.Subtype = h.Subtype
+		cp.RemoteIndex = h.RemoteIndex
+	}
+
+	pc.Lock()
+	defer pc.Unlock()
+	pc.buf = appendCapturedPacket(pc.buf[:0], &cp)
+	// Errors are ignored, capturing is a best effort debugging aid and must not impact the data path
+	_, _ = pc.file.Write(pc.buf)
+}
+
+func (pc *packetCapture) Close() error {
+	pc.Lock()
+	defer pc.Unlock()
+	return pc.file.Close()
+}
+
+func appendCapturedPacket(b []byte, cp *CapturedPacket) []byte {
+	var flags uint8
+	if cp.Addr.Addr().Is4() {
+		flags |= captureFlagIs4
+	}
+
+	ip := cp.Addr.Addr().As16()
+	b = binary.BigEndian.AppendUint64(b, uint64(cp.Time.UnixNano()))
+	b = append(b, ip[:]...)
+	b = binary.BigEndian.AppendUint16(b, cp.Addr.Port())
+	b = append(b, flags, byte(cp.Type), byte(cp.Subtype))
+	b = binary.BigEndian.AppendUint32(b, cp.RemoteIndex)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(cp.Data)))
+	return append(b, cp.Data...)
+}
+
+// PacketCaptureReader reads back a file produced by the capture mode, see `capture.path` in the example config
+type PacketCaptureReader struct {
+	r   io.Reader
+	hdr [captureRecordHdrLen]byte
+}
+
+// NewPacketCaptureReader validates the file header and returns a reader positioned at the first record
+func NewPacketCaptureReader(r io.Reader) (*PacketCaptureReader, error) {
+	var magic [captureMagicLen]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCaptureFile, err)
+	}
+
+	if magic != captureMagic {
+		return nil, fmt.Errorf("%w: unknown magic %x", ErrInvalidCaptureFile, magic)
+	}
+
+	return &PacketCaptureReader{r: r}, nil
+}
+
+// Next returns the next captured packet or io.EOF when the capture has been fully read
+func (pr *PacketCaptureReader) Next() (*CapturedPacket, error) {
+	_, err := io.ReadFull(pr.r, pr.hdr[:])
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// A capture that was cut off mid record, most likely the process died while writing
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	b := pr.hdr[:]
+	cp := &CapturedPacket{
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(b[0:8]))),
+	}
+
+	ip := netip.AddrFrom16([16]byte(b[8:24]))
+	if b[26]&captureFlagIs4 != 0 {
+		ip = ip.Unmap()
+	}
+	cp.Addr = netip.AddrPortFrom(ip, binary.BigEndian.Uint16(b[24:26]))
+	cp.Type = header.MessageType(b[27])
+	cp.Subtype = header.MessageSubType(b[28])
+	cp.RemoteIndex = binary.BigEndian.Uint32(b[29:33])
+
+	n := binary.BigEndian.Uint32(b[33:37])
+	if n > captureMaxRecordSize {
+		return nil, fmt.Errorf("%w: record length %d is too large", ErrInvalidCaptureFile, n)
+	}
+
+	cp.Data = make([]byte, n)
+	_, err = io.ReadFull(pr.r, cp.Data)
+	if err != nil {
+		return nil, io.EOF
+	}
+
+	return cp, nil
+}
+
+func (f *Interface) reloadPacketCapture(c *config.C) {
+	if !c.InitialLoad() && !c.HasChanged("capture.path") {
+		return
+	}
+
+	path := c.GetString("capture.path", "")
+	old := f.capture.Load()
+	if old != nil && old.path == path {
+		return
+	}
+
+	var pc *packetCapture
+	if path != "" {
+		var err error
+		pc, err = newPacketCapture(path)
+		if err != nil {
+			f.l.WithError(err).WithField("path", path).Error("Failed to start packet capture")
+			return
+		}
+	}
+
+	f.capture.Store(pc)
+	if old != nil {
+		if err := old.Close(); err != nil {
+			f.l.WithError(err).WithField("path", old.path).Error("Failed to close packet capture")
+		}
+	}
+
+	if pc != nil {
+		f.l.WithField("path", path).Warn("Capturing all inbound udp packets, this will impact performance")
+	} else if old != nil {
+		f.l.WithField("path", old.path).Info("Packet capture stopped")
+	}
+}
+
+// ReplayPacketCapture feeds every packet in a capture through readOutsidePackets as if it had just been received.
+// The number of replayed packets is returned. This is intended for debugging and regression tests.
+func (f *Interface) ReplayPacketCapture(r io.Reader) (int, error) {
+	pr, err := NewPacketCaptureReader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	var lhf udp.LightHouseHandlerFunc
+	if f.lightHouse != nil {
+		lhf = lhHandleRequest(f.lightHouse.NewRequestHandler(), f)
+	}
+
+	h := &header.H{}
+	fwPacket := &firewall.Packet{}
+	out := make([]byte, mtu)
+	nb := make([]byte, 12, 12)
+
+	count := 0
+	for {
+		cp, err := pr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return count, nil
+			}
+			return count, err
+		}
+
+		f.readOutsidePackets(cp.Addr, nil, out[:0], cp.Data, 0, h, fwPacket, lhf, nb, 0, nil)
+		count++
+	}
+}
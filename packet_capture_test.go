@@ -0,0 +1,99 @@
+package nebula
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketCapture_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nebula.cap")
+	pc, err := newPacketCapture(path)
+	require.NoError(t, err)
+
+	now := time.Unix(1700000000, 1234)
+	v4 := netip.MustParseAddrPort("1.2.3.4:4242")
+	v6 := netip.MustParseAddrPort("[fd00::1]:4243")
+
+	msg := header.Encode(make([]byte, header.Len), header.Version, header.Test, header.TestRequest, 99, 1)
+
+	pc.Write(now, v4, msg)
+	pc.Write(now.Add(time.Second), v6, []byte{1})
+	require.NoError(t, pc.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	pr, err := NewPacketCaptureReader(f)
+	require.NoError(t, err)
+
+	cp, err := pr.Next()
+	require.NoError(t, err)
+	assert.True(t, now.Equal(cp.Time))
+	assert.Equal(t, v4, cp.Addr)
+	assert.Equal(t, header.Test, cp.Type)
+	assert.Equal(t, header.TestRequest, cp.Subtype)
+	assert.Equal(t, uint32(99), cp.RemoteIndex)
+	assert.Equal(t, msg, cp.Data)
+
+	// Unparseable packets are still captured, without header details
+	cp, err = pr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, v6, cp.Addr)
+	assert.Equal(t, uint32(0), cp.RemoteIndex)
+	assert.Equal(t, []byte{1}, cp.Data)
+
+	_, err = pr.Next()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestPacketCapture_Truncated(t *testing.T) {
+	b := append([]byte{}, captureMagic[:]...)
+	b = appendCapturedPacket(b, &CapturedPacket{Addr: netip.MustParseAddrPort("1.2.3.4:1"), Data: []byte{1, 2, 3}})
+	b = appendCapturedPacket(b, &CapturedPacket{Addr: netip.MustParseAddrPort("1.2.3.4:1"), Data: []byte{4, 5, 6}})
+
+	pr, err := NewPacketCaptureReader(bytes.NewReader(b[:len(b)-2]))
+	require.NoError(t, err)
+
+	cp, err := pr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, cp.Data)
+
+	// A record cut short by a crash is treated as the end of the capture
+	_, err = pr.Next()
+	assert.ErrorIs(t, err, io.EOF)
+
+	_, err = NewPacketCaptureReader(bytes.NewReader([]byte("NOTACAPTURE")))
+	assert.ErrorIs(t, err, ErrInvalidCaptureFile)
+}
+
+func TestInterface_ReplayPacketCapture(t *testing.T) {
+	l := test.NewLogger()
+	vpnNet := netip.MustParsePrefix("172.1.1.1/24")
+	f := &Interface{
+		hostMap:  newHostMap(l, vpnNet),
+		myVpnNet: vpnNet,
+		l:        l,
+	}
+
+	msg := header.Encode(make([]byte, header.Len), header.Version, header.Test, header.TestRequest, 99, 1)
+
+	b := append([]byte{}, captureMagic[:]...)
+	// A hole punch and a double encrypted packet, neither require any more of the interface to be set up
+	b = appendCapturedPacket(b, &CapturedPacket{Addr: netip.MustParseAddrPort("1.2.3.4:1"), Data: []byte{1}})
+	b = appendCapturedPacket(b, &CapturedPacket{Addr: netip.MustParseAddrPort("172.1.1.2:1"), Data: msg})
+
+	n, err := f.ReplayPacketCapture(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
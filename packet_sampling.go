@@ -0,0 +1,306 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	defaultSamplingHeaderBytes = 128
+	// defaultSamplingEnterprise is the sFlow enterprise number the nebula flow record is sent under, collectors that do
+	// not know it skip the record and still decode the sampled header
+	defaultSamplingEnterprise = 20034
+	// samplingQueueLen is how many samples wait for the exporter before new samples are dropped
+	samplingQueueLen = 1024
+	// samplingMaxDatagram keeps exported datagrams below a typical underlay mtu
+	samplingMaxDatagram = 1400
+
+	sflowVersion            = 5
+	sflowAddrIPv4           = 1
+	sflowAddrIPv6           = 2
+	sflowFlowSample         = 1
+	sflowRawHeader          = 1
+	sflowHeaderProtoIPv4    = 11
+	sflowHeaderProtoIPv6    = 12
+	sflowNebulaRecord       = 1
+	sflowNebulaPathDirect   = 1
+	sflowNebulaPathRelay    = 2
+	sflowNebulaDirectionIn  = 1
+	sflowNebulaDirectionOut = 2
+)
+
+// packetSample is a copy of the start of one sampled inner packet
+type packetSample struct {
+	vpnIp    netip.Addr
+	relayed  bool
+	inbound  bool
+	frameLen int
+	pool     uint32
+	header   []byte
+}
+
+// packetSampler takes 1 in rate inner packets on average and exports them as sFlow v5 flow samples to a collector.
+// Sampling only costs a counter decrement on the data path, samples are queued and encoded by a separate goroutine.
+//
+// Every sample carries a raw header record with the first header_bytes of the inner packet and a nebula record, sent
+// under the sampling.enterprise sFlow enterprise number, with the peer vpn ip, the path (direct or relay) and the
+// direction of the packet.
+type packetSampler struct {
+	rate        uint32
+	headerBytes int
+	enterprise  uint32
+	collector   string
+	agent       netip.Addr
+	start       time.Time
+
+	// skip counts down to the next sample, interval is how many packets go by from the last sample to the next one
+	skip     atomic.Int64
+	interval atomic.Int64
+	pool     atomic.Uint32
+	drops    atomic.Uint32
+
+	samples chan packetSample
+	done    chan struct{}
+	conn    net.Conn
+
+	metricSampled metrics.Counter
+	metricDropped metrics.Counter
+	l             *logrus.Logger
+}
+
+func newPacketSampler(l *logrus.Logger, agent netip.Addr, rate uint32, headerBytes int, enterprise uint32, collector string) (*packetSampler, error) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &packetSampler{
+		rate:          rate,
+		headerBytes:   headerBytes,
+		enterprise:    enterprise,
+		collector:     collector,
+		agent:         agent,
+		start:         time.Now(),
+		samples:       make(chan packetSample, samplingQueueLen),
+		done:          make(chan struct{}),
+		conn:          conn,
+		metricSampled: metrics.GetOrRegisterCounter("sampling.sampled", nil),
+		metricDropped: metrics.GetOrRegisterCounter("sampling.dropped", nil),
+		l:             l,
+	}
+	skip := s.nextSkip()
+	s.interval.Store(skip)
+	s.skip.Store(skip)
+
+	go s.run()
+	return s, nil
+}
+
+// sample is called with every inner packet sent to or received from h. A nil sampler does nothing.
+func (s *packetSampler) sample(packet []byte, h *HostInfo, inbound, relayed bool) {
+	if s == nil || s.skip.Add(-1) != 0 {
+		return
+	}
+	s.take(packet, h, inbound, relayed)
+}
+
+func (s *packetSampler) take(packet []byte, h *HostInfo, inbound, relayed bool) {
+	// Packets that went by while skip was being reset took it below 0 and are part of the next interval
+	next := s.nextSkip()
+	seen := s.interval.Swap(next)
+	if s.skip.Add(next) <= 0 {
+		s.skip.Store(next)
+	}
+
+	n := min(len(packet), s.headerBytes)
+	ps := packetSample{
+		vpnIp:    h.vpnIp,
+		relayed:  relayed,
+		inbound:  inbound,
+		frameLen: len(packet),
+		pool:     s.pool.Add(uint32(seen)),
+		header:   append([]byte(nil), packet[:n]...),
+	}
+
+	select {
+	case s.samples <- ps:
+		s.metricSampled.Inc(1)
+	default:
+		s.drops.Add(1)
+		s.metricDropped.Inc(1)
+	}
+}
+
+// nextSkip randomizes the distance to the next sample around rate so periodic traffic can not hide from the sampler
+func (s *packetSampler) nextSkip() int64 {
+	if s.rate <= 1 {
+		return 1
+	}
+	return 1 + rand.Int64N(2*int64(s.rate)-1)
+}
+
+func (s *packetSampler) Close() {
+	close(s.done)
+}
+
+func (s *packetSampler) run() {
+	defer s.conn.Close()
+
+	var seq, sampleSeq uint32
+	buf := make([]byte, 0, samplingMaxDatagram+s.headerBytes+128)
+	records := make([]byte, 0, samplingMaxDatagram)
+
+	for {
+		var ps packetSample
+		select {
+		case <-s.done:
+			return
+		case ps = <-s.samples:
+		}
+
+		// Pack every waiting sample that fits in one datagram
+		records = records[:0]
+		count := uint32(0)
+		for {
+			sampleSeq++
+			count++
+			records = s.appendFlowSample(records, sampleSeq, &ps)
+			if len(records) >= samplingMaxDatagram-s.headerBytes-128 || len(s.samples) == 0 {
+				break
+			}
+			ps = <-s.samples
+		}
+
+		seq++
+		buf = s.appendDatagramHeader(buf[:0], seq, count)
+		buf = append(buf, records...)
+		if _, err := s.conn.Write(buf); err != nil && s.l.Level >= logrus.DebugLevel {
+			s.l.WithError(err).WithField("collector", s.collector).Debug("Failed to export packet samples")
+		}
+	}
+}
+
+func (s *packetSampler) appendDatagramHeader(b []byte, seq, count uint32) []byte {
+	b = binary.BigEndian.AppendUint32(b, sflowVersion)
+	b = appendSflowAddr(b, s.agent)
+	b = binary.BigEndian.AppendUint32(b, 0) // sub agent id
+	b = binary.BigEndian.AppendUint32(b, seq)
+	b = binary.BigEndian.AppendUint32(b, uint32(time.Since(s.start).Milliseconds()))
+	return binary.BigEndian.AppendUint32(b, count)
+}
+
+func (s *packetSampler) appendFlowSample(b []byte, seq uint32, ps *packetSample) []byte {
+	b = binary.BigEndian.AppendUint32(b, sflowFlowSample)
+	lenAt := len(b)
+	b = binary.BigEndian.AppendUint32(b, 0)
+
+	b = binary.BigEndian.AppendUint32(b, seq)
+	b = binary.BigEndian.AppendUint32(b, 0) // source id
+	b = binary.BigEndian.AppendUint32(b, s.rate)
+	b = binary.BigEndian.AppendUint32(b, ps.pool)
+	b = binary.BigEndian.AppendUint32(b, s.drops.Load())
+	b = binary.BigEndian.AppendUint32(b, 0) // input interface, unknown
+	b = binary.BigEndian.AppendUint32(b, 0) // output interface, unknown
+	b = binary.BigEndian.AppendUint32(b, 2) // records
+
+	// Sampled header
+	proto := uint32(sflowHeaderProtoIPv4)
+	if len(ps.header) > 0 && ps.header[0]>>4 == 6 {
+		proto = sflowHeaderProtoIPv6
+	}
+	padded := (len(ps.header) + 3) &^ 3
+	b = binary.BigEndian.AppendUint32(b, sflowRawHeader)
+	b = binary.BigEndian.AppendUint32(b, uint32(16+padded))
+	b = binary.BigEndian.AppendUint32(b, proto)
+	b = binary.BigEndian.AppendUint32(b, uint32(ps.frameLen))
+	b = binary.BigEndian.AppendUint32(b, 0) // stripped
+	b = binary.BigEndian.AppendUint32(b, uint32(len(ps.header)))
+	b = append(b, ps.header...)
+	b = append(b, make([]byte, padded-len(ps.header))...)
+
+	// Nebula metadata
+	path := uint32(sflowNebulaPathDirect)
+	if ps.relayed {
+		path = sflowNebulaPathRelay
+	}
+	direction := uint32(sflowNebulaDirectionOut)
+	if ps.inbound {
+		direction = sflowNebulaDirectionIn
+	}
+	b = binary.BigEndian.AppendUint32(b, s.enterprise<<12|sflowNebulaRecord)
+	recAt := len(b)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = appendSflowAddr(b, ps.vpnIp)
+	b = binary.BigEndian.AppendUint32(b, path)
+	b = binary.BigEndian.AppendUint32(b, direction)
+	binary.BigEndian.PutUint32(b[recAt:], uint32(len(b)-recAt-4))
+
+	binary.BigEndian.PutUint32(b[lenAt:], uint32(len(b)-lenAt-4))
+	return b
+}
+
+func appendSflowAddr(b []byte, addr netip.Addr) []byte {
+	if addr.Is4() {
+		b = binary.BigEndian.AppendUint32(b, sflowAddrIPv4)
+		ip := addr.As4()
+		return append(b, ip[:]...)
+	}
+	b = binary.BigEndian.AppendUint32(b, sflowAddrIPv6)
+	ip := addr.As16()
+	return append(b, ip[:]...)
+}
+
+func (f *Interface) reloadPacketSampling(c *config.C) {
+	if !c.InitialLoad() && !c.HasChanged("sampling") {
+		return
+	}
+
+	var s *packetSampler
+	rate := c.GetInt("sampling.rate", 0)
+	if rate > 0 {
+		var err error
+		s, err = f.newPacketSamplerFromConfig(c, rate)
+		if err != nil {
+			f.l.WithError(err).Error("Failed to start packet sampling")
+			return
+		}
+	}
+
+	if old := f.sampler.Swap(s); old != nil {
+		old.Close()
+	}
+
+	if s != nil {
+		f.l.WithField("rate", s.rate).WithField("collector", s.collector).Info("Sampling inner packets")
+	} else if !c.InitialLoad() {
+		f.l.Info("Packet sampling stopped")
+	}
+}
+
+func (f *Interface) newPacketSamplerFromConfig(c *config.C, rate int) (*packetSampler, error) {
+	collector := c.GetString("sampling.collector", "")
+	if collector == "" {
+		return nil, fmt.Errorf("sampling.collector must be provided")
+	}
+
+	headerBytes := c.GetInt("sampling.header_bytes", defaultSamplingHeaderBytes)
+	if headerBytes < 1 || headerBytes > mtu {
+		return nil, fmt.Errorf("sampling.header_bytes must be between 1 and %d", mtu)
+	}
+
+	enterprise := c.GetInt("sampling.enterprise", defaultSamplingEnterprise)
+	if enterprise < 1 || enterprise >= 1<<20 {
+		return nil, fmt.Errorf("sampling.enterprise must be between 1 and %d", 1<<20-1)
+	}
+
+	return newPacketSampler(f.l, f.myVpnNet.Addr(), uint32(rate), headerBytes, uint32(enterprise), collector)
+}
@@ -0,0 +1,161 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketSampler(t *testing.T) {
+	l := test.NewLogger()
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer collector.Close()
+
+	s, err := newPacketSampler(l, netip.MustParseAddr("10.128.0.1"), 1, 20, defaultSamplingEnterprise, collector.LocalAddr().String())
+	require.NoError(t, err)
+	defer s.Close()
+
+	packet := make([]byte, 60)
+	packet[0] = 0x45
+	for i := 1; i < len(packet); i++ {
+		packet[i] = byte(i)
+	}
+	h := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.2")}
+	s.sample(packet, h, true, true)
+
+	buf := make([]byte, 2000)
+	require.NoError(t, collector.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err := collector.Read(buf)
+	require.NoError(t, err)
+	b := buf[:n]
+	u32 := func() uint32 {
+		v := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		return v
+	}
+
+	// Datagram header
+	assert.Equal(t, uint32(sflowVersion), u32())
+	assert.Equal(t, uint32(sflowAddrIPv4), u32())
+	assert.Equal(t, []byte{10, 128, 0, 1}, b[:4])
+	b = b[4:]
+	u32() // sub agent
+	assert.Equal(t, uint32(1), u32())
+	u32() // uptime
+	assert.Equal(t, uint32(1), u32())
+
+	// Flow sample
+	assert.Equal(t, uint32(sflowFlowSample), u32())
+	assert.Equal(t, int(u32()), len(b))
+	assert.Equal(t, uint32(1), u32()) // sequence
+	u32()                             // source id
+	assert.Equal(t, uint32(1), u32()) // rate
+	assert.Equal(t, uint32(1), u32()) // pool
+	assert.Equal(t, uint32(0), u32()) // drops
+	u32()
+	u32()
+	assert.Equal(t, uint32(2), u32())
+
+	// Raw header, truncated to header_bytes
+	assert.Equal(t, uint32(sflowRawHeader), u32())
+	assert.Equal(t, uint32(16+20), u32())
+	assert.Equal(t, uint32(sflowHeaderProtoIPv4), u32())
+	assert.Equal(t, uint32(60), u32())
+	assert.Equal(t, uint32(0), u32())
+	assert.Equal(t, uint32(20), u32())
+	assert.Equal(t, packet[:20], b[:20])
+	b = b[20:]
+
+	// Nebula record
+	assert.Equal(t, uint32(defaultSamplingEnterprise<<12|sflowNebulaRecord), u32())
+	assert.Equal(t, uint32(16), u32())
+	assert.Equal(t, uint32(sflowAddrIPv4), u32())
+	assert.Equal(t, []byte{10, 128, 0, 2}, b[:4])
+	b = b[4:]
+	assert.Equal(t, uint32(sflowNebulaPathRelay), u32())
+	assert.Equal(t, uint32(sflowNebulaDirectionIn), u32())
+	assert.Empty(t, b)
+}
+
+func TestPacketSampler_pool(t *testing.T) {
+	s := &packetSampler{
+		rate:          100,
+		headerBytes:   20,
+		samples:       make(chan packetSample, 2),
+		metricSampled: metrics.NewCounter(),
+		metricDropped: metrics.NewCounter(),
+	}
+	s.interval.Store(3)
+	s.skip.Store(3)
+	h := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.2")}
+
+	// The pool counts the packets that went by, not the distance to the next sample
+	for i := 0; i < 3; i++ {
+		s.sample(make([]byte, 60), h, true, false)
+	}
+	require.Len(t, s.samples, 1)
+	assert.Equal(t, uint32(3), (<-s.samples).pool)
+
+	next := s.interval.Load()
+	for i := int64(0); i < next; i++ {
+		s.sample(make([]byte, 60), h, true, false)
+	}
+	require.Len(t, s.samples, 1)
+	assert.Equal(t, uint32(3+next), (<-s.samples).pool)
+}
+
+func TestPacketSampler_nextSkip(t *testing.T) {
+	s := &packetSampler{rate: 1}
+	assert.Equal(t, int64(1), s.nextSkip())
+
+	s.rate = 100
+	var total int64
+	for i := 0; i < 10000; i++ {
+		skip := s.nextSkip()
+		require.True(t, skip >= 1 && skip <= 199, skip)
+		total += skip
+	}
+	assert.InDelta(t, 100, total/10000, 10)
+}
+
+func TestInterface_reloadPacketSampling(t *testing.T) {
+	l := test.NewLogger()
+	f := &Interface{l: l, myVpnNet: netip.MustParsePrefix("10.128.0.1/24")}
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("sampling: {rate: 0}"))
+	f.reloadPacketSampling(c)
+	assert.Nil(t, f.sampler.Load())
+
+	for _, bad := range []string{
+		"sampling: {rate: 10}",
+		"sampling: {rate: 10, collector: '127.0.0.1:6343', header_bytes: 0}",
+		"sampling: {rate: 10, collector: '127.0.0.1:6343', enterprise: 0}",
+	} {
+		c = config.NewC(l)
+		require.NoError(t, c.LoadString(bad))
+		_, err := f.newPacketSamplerFromConfig(c, 10)
+		assert.Error(t, err, bad)
+	}
+
+	c = config.NewC(l)
+	require.NoError(t, c.LoadString("sampling: {rate: 10, collector: '127.0.0.1:6343'}"))
+	f.reloadPacketSampling(c)
+	s := f.sampler.Load()
+	require.NotNil(t, s)
+	assert.Equal(t, uint32(10), s.rate)
+	assert.Equal(t, defaultSamplingHeaderBytes, s.headerBytes)
+
+	// A nil sampler is safe to call from the data path
+	f.sampler.Swap(nil).Close()
+	f.sampler.Load().sample(nil, nil, false, false)
+}
@@ -0,0 +1,120 @@
+// Package packetauth is the token format of nebula per packet authorization. A policy server mints short lived tokens
+// with Mint, a sender attaches one to every data packet it sends to a destination the token covers, and the receiver
+// checks it before the firewall.
+//
+// A token is TokenLen bytes:
+//
+//	offset  size  field
+//	0       1     version, 1
+//	1       4     sender vpn ip
+//	5       4     destination vpn ip
+//	9       1     destination prefix length
+//	10      8     not before, unix seconds, big endian
+//	18      8     not after, unix seconds, big endian
+//	26      64    ed25519 signature of SigningContext followed by bytes 0 to 25
+//
+// A token says the sender may send to the destination prefix between not before and not after. It is not a secret,
+// a token is only accepted inside a tunnel with the sender whose certificate holds the sender vpn ip.
+package packetauth
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+const (
+	Version = 1
+	// TokenLen is the size of a token on the wire
+	TokenLen = signedLen + ed25519.SignatureSize
+
+	signedLen = 26
+)
+
+// SigningContext is prepended to the signed bytes so a token signature can not be mistaken for any other
+var SigningContext = []byte("nebula packet auth token v1")
+
+var (
+	ErrTokenLength    = errors.New("packet auth token has the wrong length")
+	ErrTokenVersion   = errors.New("packet auth token has an unknown version")
+	ErrTokenSignature = errors.New("packet auth token is not signed by a trusted issuer")
+)
+
+// Token is a parsed token, Raw is the token as it is sent
+type Token struct {
+	Sender      netip.Addr
+	Destination netip.Prefix
+	NotBefore   time.Time
+	NotAfter    time.Time
+	Raw         [TokenLen]byte
+}
+
+// Mint returns a token signed with key allowing sender to send to destination between notBefore and notAfter
+func Mint(key ed25519.PrivateKey, sender netip.Addr, destination netip.Prefix, notBefore, notAfter time.Time) ([]byte, error) {
+	//TODO: IPV6-WORK
+	if !sender.Is4() || !destination.Addr().Is4() {
+		return nil, fmt.Errorf("only ipv4 vpn ips are supported")
+	}
+	if !notAfter.After(notBefore) {
+		return nil, fmt.Errorf("notAfter must be after notBefore")
+	}
+
+	b := make([]byte, signedLen, TokenLen)
+	b[0] = Version
+	s := sender.As4()
+	copy(b[1:5], s[:])
+	d := destination.Masked().Addr().As4()
+	copy(b[5:9], d[:])
+	b[9] = byte(destination.Bits())
+	binary.BigEndian.PutUint64(b[10:18], uint64(notBefore.Unix()))
+	binary.BigEndian.PutUint64(b[18:26], uint64(notAfter.Unix()))
+
+	return append(b, ed25519.Sign(key, signingInput(b))...), nil
+}
+
+// Parse decodes b without checking the signature, see Verify
+func Parse(b []byte) (*Token, error) {
+	if len(b) != TokenLen {
+		return nil, ErrTokenLength
+	}
+	if b[0] != Version {
+		return nil, ErrTokenVersion
+	}
+
+	destination, err := netip.AddrFrom4([4]byte(b[5:9])).Prefix(int(b[9]))
+	if err != nil {
+		return nil, fmt.Errorf("packet auth token destination: %w", err)
+	}
+
+	t := &Token{
+		Sender:      netip.AddrFrom4([4]byte(b[1:5])),
+		Destination: destination,
+		NotBefore:   time.Unix(int64(binary.BigEndian.Uint64(b[10:18])), 0),
+		NotAfter:    time.Unix(int64(binary.BigEndian.Uint64(b[18:26])), 0),
+	}
+	copy(t.Raw[:], b)
+	return t, nil
+}
+
+// Verify returns nil if the token is signed by one of issuers
+func (t *Token) Verify(issuers []ed25519.PublicKey) error {
+	msg := signingInput(t.Raw[:signedLen])
+	for _, issuer := range issuers {
+		if ed25519.Verify(issuer, msg, t.Raw[signedLen:]) {
+			return nil
+		}
+	}
+	return ErrTokenSignature
+}
+
+// ValidAt returns true if now is within the validity of the token
+func (t *Token) ValidAt(now time.Time) bool {
+	return !now.Before(t.NotBefore) && now.Before(t.NotAfter)
+}
+
+func signingInput(signed []byte) []byte {
+	return append(append([]byte{}, SigningContext...), signed...)
+}
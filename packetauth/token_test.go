@@ -0,0 +1,55 @@
+package packetauth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToken(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	now := time.Unix(1700000000, 0)
+	b, err := Mint(key, netip.MustParseAddr("10.128.0.2"), netip.MustParsePrefix("10.128.0.9/24"), now, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Len(t, b, TokenLen)
+
+	tok, err := Parse(b)
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddr("10.128.0.2"), tok.Sender)
+	assert.Equal(t, netip.MustParsePrefix("10.128.0.0/24"), tok.Destination)
+	assert.Equal(t, now, tok.NotBefore)
+	assert.Equal(t, now.Add(time.Minute), tok.NotAfter)
+	assert.Equal(t, b, tok.Raw[:])
+
+	assert.NoError(t, tok.Verify([]ed25519.PublicKey{other, pub}))
+	assert.Equal(t, ErrTokenSignature, tok.Verify([]ed25519.PublicKey{other}))
+	assert.Equal(t, ErrTokenSignature, tok.Verify(nil))
+
+	assert.False(t, tok.ValidAt(now.Add(-time.Second)))
+	assert.True(t, tok.ValidAt(now))
+	assert.False(t, tok.ValidAt(now.Add(time.Minute)))
+
+	t.Log("Any change to the signed bytes breaks the signature")
+	b[9] = 16
+	tok, err = Parse(b)
+	require.NoError(t, err)
+	assert.Equal(t, ErrTokenSignature, tok.Verify([]ed25519.PublicKey{pub}))
+
+	_, err = Parse(b[:TokenLen-1])
+	assert.Equal(t, ErrTokenLength, err)
+	b[0] = 2
+	_, err = Parse(b)
+	assert.Equal(t, ErrTokenVersion, err)
+
+	_, err = Mint(key, netip.MustParseAddr("10.128.0.2"), netip.MustParsePrefix("10.128.0.0/24"), now, now)
+	assert.Error(t, err)
+}
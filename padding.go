@@ -0,0 +1,174 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+// Padding pads the data packets we send inside the encryption, so their size on the wire says less about the inner
+// traffic, keystrokes in an interactive session or the codec of a call. A padded packet is a header.MessagePadded
+// packet whose payload is the subtype it wraps, header.MessageNone or header.MessageAuthorized, the length of its
+// payload and the payload itself followed by zeros:
+//
+//	subtype(1) | length(2) | payload | padding
+//
+// With padding.mode buckets the payload is padded up to the smallest of padding.buckets it fits in, payloads larger
+// than every bucket are not padded. With padding.mode random 0 to padding.random_max bytes are added at random.
+//
+// Padding costs paddingPrefixLen bytes per packet plus the padding itself, counted in padding.bytes. Packets sent in
+// the clear on an auth only tunnel are not padded. Every node answers padded packets regardless of this setting.
+type Padding struct {
+	// state is nil when padding is off
+	state atomic.Pointer[paddingState]
+
+	metricBytes metrics.Counter
+	l           *logrus.Logger
+}
+
+type paddingState struct {
+	// buckets are ascending, empty in random mode
+	buckets   []int
+	randomMax int
+}
+
+const (
+	paddingPrefixLen = 3
+	// paddingMaxBucket keeps a padded packet within our buffers once the header and AEAD tag are added
+	paddingMaxBucket = mtu - header.Len - paddingPrefixLen - 16
+
+	defaultPaddingRandomMax = 64
+)
+
+var defaultPaddingBuckets = []int{128, 256, 512, 1024, 1300}
+
+var (
+	errPaddingShort   = errors.New("padded packet is too short")
+	errPaddingLength  = errors.New("padded packet length is past its end")
+	errPaddingSubtype = errors.New("padded packet wraps an unexpected subtype")
+)
+
+func NewPaddingFromConfig(l *logrus.Logger, c *config.C) (*Padding, error) {
+	pd := &Padding{
+		metricBytes: metrics.GetOrRegisterCounter("padding.bytes", nil),
+		l:           l,
+	}
+
+	if err := pd.reload(c, true); err != nil {
+		return nil, err
+	}
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := pd.reload(c, false); err != nil {
+			l.WithError(err).Error("Failed to reload padding, keeping the previous settings")
+		}
+	})
+
+	return pd, nil
+}
+
+func (pd *Padding) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("padding") {
+		return nil
+	}
+
+	mode := strings.ToLower(c.GetString("padding.mode", "off"))
+	var st *paddingState
+	switch mode {
+	case "off", "false":
+		// yaml reads an unquoted off as false
+	case "buckets":
+		st = &paddingState{}
+		for _, v := range c.GetStringSlice("padding.buckets", nil) {
+			b, err := strconv.Atoi(v)
+			if err != nil || b <= 0 || b > paddingMaxBucket {
+				return fmt.Errorf("padding.buckets entry %q must be a size between 1 and %v", v, paddingMaxBucket)
+			}
+			st.buckets = append(st.buckets, b)
+		}
+		if len(st.buckets) == 0 {
+			st.buckets = slices.Clone(defaultPaddingBuckets)
+		}
+		slices.Sort(st.buckets)
+	case "random":
+		st = &paddingState{randomMax: c.GetInt("padding.random_max", defaultPaddingRandomMax)}
+		if st.randomMax <= 0 || st.randomMax > paddingMaxBucket {
+			return fmt.Errorf("padding.random_max must be between 1 and %v, got %v", paddingMaxBucket, st.randomMax)
+		}
+	default:
+		return fmt.Errorf("padding.mode must be off, buckets or random, got %q", mode)
+	}
+
+	pd.state.Store(st)
+	if st != nil {
+		pd.l.WithField("mode", mode).WithField("buckets", st.buckets).WithField("randomMax", st.randomMax).
+			Info("padding is enabled")
+	} else if !initial {
+		pd.l.Info("padding is disabled")
+	}
+	return nil
+}
+
+func (pd *Padding) enabled() bool {
+	return pd != nil && pd.state.Load() != nil
+}
+
+// padLen returns how many bytes of padding to add to a payload of n bytes
+func (st *paddingState) padLen(n int) int {
+	if st.randomMax > 0 {
+		return rand.IntN(st.randomMax + 1)
+	}
+
+	i, _ := slices.BinarySearch(st.buckets, n)
+	if i == len(st.buckets) {
+		return 0
+	}
+	return st.buckets[i] - n
+}
+
+// pad appends the padded form of payload, of subtype st, to dst. ok is false if padding is off, dst is returned as is
+func (pd *Padding) pad(dst []byte, st header.MessageSubType, payload []byte) (out []byte, ok bool) {
+	if pd == nil {
+		return dst, false
+	}
+	s := pd.state.Load()
+	if s == nil {
+		return dst, false
+	}
+
+	n := s.padLen(len(payload))
+	dst = append(dst, byte(st), 0, 0)
+	binary.BigEndian.PutUint16(dst[len(dst)-2:], uint16(len(payload)))
+	dst = append(dst, payload...)
+	dst = slices.Grow(dst, n)[:len(dst)+n]
+	clear(dst[len(dst)-n:])
+	pd.metricBytes.Inc(int64(n + paddingPrefixLen))
+	return dst, true
+}
+
+// unpad returns the subtype and payload of the padded packet b
+func unpad(b []byte) (header.MessageSubType, []byte, error) {
+	if len(b) < paddingPrefixLen {
+		return 0, nil, errPaddingShort
+	}
+
+	st := header.MessageSubType(b[0])
+	if st != header.MessageNone && st != header.MessageAuthorized {
+		return 0, nil, errPaddingSubtype
+	}
+
+	n := int(binary.BigEndian.Uint16(b[1:paddingPrefixLen]))
+	if paddingPrefixLen+n > len(b) {
+		return 0, nil, errPaddingLength
+	}
+	return st, b[paddingPrefixLen : paddingPrefixLen+n], nil
+}
@@ -0,0 +1,69 @@
+package nebula
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPadding(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("padding: {mode: buckets, buckets: [256, 64, 1024]}"))
+	pd, err := NewPaddingFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Equal(t, []int{64, 256, 1024}, pd.state.Load().buckets)
+
+	roundTrip := func(st header.MessageSubType, n int) []byte {
+		payload := bytes.Repeat([]byte{0xaa}, n)
+		padded, ok := pd.pad(nil, st, payload)
+		require.True(t, ok)
+		gotSt, got, err := unpad(padded)
+		require.NoError(t, err)
+		assert.Equal(t, st, gotSt)
+		assert.Equal(t, payload, got)
+		return padded
+	}
+
+	t.Log("Payloads are padded to the smallest bucket they fit in")
+	for n, want := range map[int]int{0: 64, 1: 64, 64: 64, 65: 256, 256: 256, 1000: 1024, 1024: 1024, 1500: 1500} {
+		assert.Len(t, roundTrip(header.MessageNone, n), paddingPrefixLen+want, n)
+	}
+	roundTrip(header.MessageAuthorized, 100)
+
+	t.Log("Random padding stays under random_max")
+	require.NoError(t, c.ReloadConfigString("padding: {mode: random, random_max: 16}"))
+	for n := range 100 {
+		padded := roundTrip(header.MessageNone, n)
+		assert.LessOrEqual(t, len(padded), paddingPrefixLen+n+16)
+	}
+
+	t.Log("A bad padded packet is refused")
+	_, _, err = unpad([]byte{0, 0})
+	assert.Equal(t, errPaddingShort, err)
+	_, _, err = unpad([]byte{0, 0, 5, 1, 2})
+	assert.Equal(t, errPaddingLength, err)
+	_, _, err = unpad([]byte{byte(header.MessageKeepalive), 0, 0})
+	assert.Equal(t, errPaddingSubtype, err)
+
+	t.Log("Off pads nothing")
+	require.NoError(t, c.ReloadConfigString("padding: {mode: off}"))
+	assert.False(t, pd.enabled())
+	_, ok := pd.pad(nil, header.MessageNone, []byte{1})
+	assert.False(t, ok)
+	var nilPD *Padding
+	assert.False(t, nilPD.enabled())
+
+	t.Log("Bad settings are refused")
+	for _, s := range []string{"padding: {mode: always}", "padding: {mode: buckets, buckets: [0]}", "padding: {mode: random, random_max: -1}"} {
+		c = config.NewC(l)
+		require.NoError(t, c.LoadString(s))
+		_, err = NewPaddingFromConfig(l, c)
+		assert.Error(t, err, s)
+	}
+}
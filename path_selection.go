@@ -0,0 +1,359 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/gaissmai/bart"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// maxPathClasses is the number of classes that fit in the per dscp masks of pathClasses
+const maxPathClasses = 64
+
+const (
+	PathDirect = "direct"
+	PathRelay  = "relay"
+)
+
+// PathSelection steers data to a destination onto a path by the DSCP value of the inner packet, when the destination is
+// reachable both directly and through a relay. A class is a set of DSCP values, optionally limited to some destinations,
+// with the path its packets take. Packets of a relay class go through the first of the class relays with an established
+// path to the destination, or through any such relay, load shared by relay.load_share when it applies, if the class
+// lists none. Packets of a direct class, or of no class, take the usual path: direct when the tunnel has a remote,
+// through a relay otherwise. A relay class packet falls back to the usual path when none of its relays are
+// established, relays are only set up while the tunnel handshakes.
+type PathSelection struct {
+	classes atomic.Pointer[pathClasses]
+
+	metricSteered  metrics.Counter
+	metricFallback metrics.Counter
+	l              *logrus.Logger
+}
+
+type pathClasses struct {
+	list []*pathClass
+	// byDSCP has the bit of every class a dscp value is in, the lowest class that matches the destination wins
+	byDSCP [64]uint64
+}
+
+type pathClass struct {
+	name         string
+	dscp         []int
+	destinations []netip.Prefix
+	// dests is nil when the class applies to every destination
+	dests  *bart.Table[struct{}]
+	path   string
+	relays []netip.Addr
+
+	packets atomic.Uint64
+}
+
+// PathClassPolicy is a path selection class as it is configured and how many packets it steered onto a relay
+type PathClassPolicy struct {
+	Class        string         `json:"class"`
+	DSCP         []int          `json:"dscp"`
+	Destinations []netip.Prefix `json:"destinations,omitempty"`
+	Path         string         `json:"path"`
+	Relays       []netip.Addr   `json:"relays,omitempty"`
+	Steered      uint64         `json:"steered"`
+}
+
+// PathSelectionStatus is the path the packets of a class take to a destination right now
+type PathSelectionStatus struct {
+	Class string `json:"class"`
+	// Path is the configured path of the class, Current the one taken, they differ when a relay class falls back
+	Path    string `json:"path"`
+	Current string `json:"current"`
+	// Relay is the relay a relay class is steered through, not set when it takes the usual path
+	Relay netip.Addr `json:"relay,omitempty"`
+}
+
+func NewPathSelectionFromConfig(l *logrus.Logger, c *config.C) (*PathSelection, error) {
+	ps := &PathSelection{
+		metricSteered:  metrics.GetOrRegisterCounter("path_selection.steered", nil),
+		metricFallback: metrics.GetOrRegisterCounter("path_selection.fallback", nil),
+		l:              l,
+	}
+
+	err := ps.reload(c, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		err := ps.reload(c, false)
+		if err != nil {
+			l.WithError(err).Error("Failed to reload path_selection")
+		}
+	})
+
+	return ps, nil
+}
+
+func (ps *PathSelection) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("path_selection") {
+		return nil
+	}
+
+	pc, err := parsePathClasses(c)
+	if err != nil {
+		return err
+	}
+
+	ps.classes.Store(pc)
+	if !initial || pc != nil {
+		classes := 0
+		if pc != nil {
+			classes = len(pc.list)
+		}
+		ps.l.WithField("classes", classes).Info("Path selection classes configured")
+	}
+	return nil
+}
+
+func parsePathClasses(c *config.C) (*pathClasses, error) {
+	raw := c.Get("path_selection.classes")
+	if raw == nil {
+		return nil, nil
+	}
+
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, errors.New("path_selection.classes must be a list")
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	if len(list) > maxPathClasses {
+		return nil, fmt.Errorf("path_selection.classes has %d classes, at most %d are supported", len(list), maxPathClasses)
+	}
+
+	pc := &pathClasses{}
+	for i, v := range list {
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("path_selection.classes.%d must be a map with dscp and path", i)
+		}
+
+		class := &pathClass{name: fmt.Sprintf("%v", m["name"])}
+		if m["name"] == nil {
+			class.name = fmt.Sprintf("class%d", i)
+		}
+
+		dscp, ok := m["dscp"].([]interface{})
+		if !ok || len(dscp) == 0 {
+			return nil, fmt.Errorf("path_selection.classes.%d.dscp must be a non empty list", i)
+		}
+		for _, d := range dscp {
+			value, ok := d.(int)
+			if !ok || value < 0 || value > 63 {
+				return nil, fmt.Errorf("path_selection.classes.%d.dscp has %v, dscp values are 0 to 63", i, d)
+			}
+			pc.byDSCP[value] |= 1 << i
+			class.dscp = append(class.dscp, value)
+		}
+
+		class.path = fmt.Sprintf("%v", m["path"])
+		switch class.path {
+		case PathDirect, PathRelay:
+		default:
+			return nil, fmt.Errorf("path_selection.classes.%d.path must be direct or relay, got %q", i, class.path)
+		}
+
+		if m["destinations"] != nil {
+			dests, ok := m["destinations"].([]interface{})
+			if !ok || len(dests) == 0 {
+				return nil, fmt.Errorf("path_selection.classes.%d.destinations must be a non empty list", i)
+			}
+			class.dests = new(bart.Table[struct{}])
+			for _, d := range dests {
+				cidr, err := parsePathDestination(fmt.Sprintf("%v", d))
+				if err != nil {
+					return nil, fmt.Errorf("path_selection.classes.%d.destinations has %v: %w", i, d, err)
+				}
+				class.destinations = append(class.destinations, cidr)
+				class.dests.Insert(cidr, struct{}{})
+			}
+		}
+
+		if m["relays"] != nil {
+			if class.path != PathRelay {
+				return nil, fmt.Errorf("path_selection.classes.%d.relays is only used with the relay path", i)
+			}
+			relays, ok := m["relays"].([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("path_selection.classes.%d.relays must be a list", i)
+			}
+			for _, r := range relays {
+				relayIp, err := netip.ParseAddr(fmt.Sprintf("%v", r))
+				if err != nil {
+					return nil, fmt.Errorf("path_selection.classes.%d.relays has an invalid vpn ip: %v", i, r)
+				}
+				class.relays = append(class.relays, relayIp)
+			}
+		}
+
+		pc.list = append(pc.list, class)
+	}
+
+	return pc, nil
+}
+
+// parsePathDestination parses a vpn ip or CIDR
+func parsePathDestination(s string) (netip.Prefix, error) {
+	cidr, err := netip.ParsePrefix(s)
+	if err == nil {
+		return cidr.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, errors.New("not a vpn ip or CIDR")
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// innerDSCP returns the DSCP value of an inner ip packet
+func innerDSCP(p []byte) uint8 {
+	if len(p) < 2 {
+		return 0
+	}
+	if p[0]>>4 == 6 {
+		return (p[0]&0x0f)<<2 | p[1]>>6
+	}
+	return p[1] >> 2
+}
+
+// class returns the class of a packet with the dscp value to vpnIp, nil if it is in no class
+func (pc *pathClasses) class(vpnIp netip.Addr, dscp uint8) *pathClass {
+	for mask := pc.byDSCP[dscp&63]; mask != 0; mask &= mask - 1 {
+		class := pc.list[bits.TrailingZeros64(mask)]
+		if class.dests == nil {
+			return class
+		}
+		if _, ok := class.dests.Lookup(vpnIp); ok {
+			return class
+		}
+	}
+	return nil
+}
+
+// relayFor returns the relay to send the inner packet p of the flow fp to hostinfo through when its class is steered
+// onto a relay, nil if the packet takes the usual path. size is what is sent, for relay.load_share accounting. fp may
+// be nil. It is safe to call on a nil PathSelection.
+func (ps *PathSelection) relayFor(f *Interface, hostinfo *HostInfo, fp *firewall.Packet, p []byte, size int) (*HostInfo, *Relay) {
+	if ps == nil {
+		return nil, nil
+	}
+
+	pc := ps.classes.Load()
+	if pc == nil {
+		return nil, nil
+	}
+
+	class := pc.class(hostinfo.vpnIp, innerDSCP(p))
+	if class == nil || class.path != PathRelay {
+		return nil, nil
+	}
+
+	relayHostInfo, relay := class.relay(f, hostinfo, fp, size)
+	if relayHostInfo == nil {
+		ps.metricFallback.Inc(1)
+		return nil, nil
+	}
+
+	class.packets.Add(1)
+	ps.metricSteered.Inc(1)
+	return relayHostInfo, relay
+}
+
+// relay finds the established relay for the class to hostinfo, the first of the class relays or, if it lists none, the
+// relay.load_share pick or any relay. Draining relays are skipped.
+func (class *pathClass) relay(f *Interface, hostinfo *HostInfo, fp *firewall.Packet, size int) (*HostInfo, *Relay) {
+	candidates := class.relays
+	if len(candidates) == 0 {
+		if fp != nil {
+			if relayHostInfo, relay, ok := f.relayLoadShare.pick(f.hostMap, hostinfo, fp, size); ok {
+				return relayHostInfo, relay
+			}
+		}
+		candidates = relayShareCandidates(hostinfo)
+	}
+
+	for _, relayIp := range candidates {
+		relayHostInfo, relay, err := f.hostMap.QueryVpnIpRelayFor(hostinfo.vpnIp, relayIp)
+		if err != nil || relayHostInfo.relayDraining.Load() {
+			continue
+		}
+		return relayHostInfo, relay
+	}
+	return nil, nil
+}
+
+// GetPolicy returns the configured classes in order, nil if there are none. It is safe to call on a nil PathSelection.
+func (ps *PathSelection) GetPolicy() []PathClassPolicy {
+	if ps == nil {
+		return nil
+	}
+
+	pc := ps.classes.Load()
+	if pc == nil {
+		return nil
+	}
+
+	out := make([]PathClassPolicy, len(pc.list))
+	for i, class := range pc.list {
+		out[i] = PathClassPolicy{
+			Class:        class.name,
+			DSCP:         class.dscp,
+			Destinations: class.destinations,
+			Path:         class.path,
+			Relays:       class.relays,
+			Steered:      class.packets.Load(),
+		}
+	}
+	return out
+}
+
+// GetPaths returns the path the packets of each class that applies to hostinfo take right now, nil if there are no
+// classes. It is safe to call on a nil PathSelection.
+func (ps *PathSelection) GetPaths(f *Interface, hostinfo *HostInfo) []PathSelectionStatus {
+	if ps == nil {
+		return nil
+	}
+
+	pc := ps.classes.Load()
+	if pc == nil {
+		return nil
+	}
+
+	usual := PathDirect
+	if !hostinfo.remote.IsValid() {
+		usual = PathRelay
+	}
+
+	out := []PathSelectionStatus{}
+	for _, class := range pc.list {
+		if class.dests != nil {
+			if _, ok := class.dests.Lookup(hostinfo.vpnIp); !ok {
+				continue
+			}
+		}
+
+		s := PathSelectionStatus{Class: class.name, Path: class.path, Current: usual}
+		if class.path == PathRelay {
+			if relayHostInfo, _ := class.relay(f, hostinfo, nil, 0); relayHostInfo != nil {
+				s.Current = PathRelay
+				s.Relay = relayHostInfo.vpnIp
+			}
+		}
+		out = append(out, s)
+	}
+	return out
+}
@@ -0,0 +1,180 @@
+package nebula
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dscpPacket returns the start of an ipv4 packet marked with dscp
+func dscpPacket(dscp uint8) []byte {
+	p := make([]byte, 20)
+	p[0] = 0x45
+	p[1] = dscp<<2 | 1
+	return p
+}
+
+func TestInnerDSCP(t *testing.T) {
+	assert.Equal(t, uint8(46), innerDSCP(dscpPacket(46)))
+	assert.Equal(t, uint8(0), innerDSCP(dscpPacket(0)))
+	assert.Equal(t, uint8(0), innerDSCP([]byte{0x45}))
+
+	// The traffic class straddles the first two bytes of an ipv6 header
+	assert.Equal(t, uint8(46), innerDSCP([]byte{0x60 | 46>>2, (46&3)<<6 | 0x1f}))
+	assert.Equal(t, uint8(63), innerDSCP([]byte{0x6f, 0xc0}))
+}
+
+func TestPathSelection(t *testing.T) {
+	_, f, c, conn, newPeer := newRelayControlTest(t, `
+path_selection:
+  classes:
+    - {name: voice, dscp: [46], path: direct}
+    - {name: video, dscp: [34], path: relay, relays: [10.128.0.3, 10.128.0.2]}
+    - {name: lab, dscp: [8], path: relay, relays: [10.128.0.2], destinations: [10.128.0.8/29]}
+    - {name: bulk, dscp: [8, 10], path: relay}
+    - {name: backup, dscp: [12], path: relay, relays: [10.128.0.4]}
+`)
+	ps, err := NewPathSelectionFromConfig(f.l, c)
+	require.NoError(t, err)
+	f.pathSelection = ps
+	f.connectionManager.relayUsed = map[uint32]struct{}{}
+	f.connectionManager.relayUsedLock = &sync.RWMutex{}
+
+	relayA := newPeer(netip.MustParseAddr("10.128.0.2"), 1)
+	relayB := newPeer(netip.MustParseAddr("10.128.0.3"), 2)
+	lab := newPeer(netip.MustParseAddr("10.128.0.10"), 3)
+	other := newPeer(netip.MustParseAddr("10.128.0.20"), 4)
+
+	// lab is reachable directly and through both relays, other directly and through relayB
+	for i, r := range []*HostInfo{relayA, relayB} {
+		remote := uint32(100 + i)
+		_, err := AddRelay(f.l, r, f.hostMap, lab.vpnIp, &remote, TerminalType, Established)
+		require.NoError(t, err)
+		lab.relayState.InsertRelayTo(r.vpnIp)
+	}
+	remote := uint32(200)
+	_, err = AddRelay(f.l, relayB, f.hostMap, other.vpnIp, &remote, TerminalType, Established)
+	require.NoError(t, err)
+	other.relayState.InsertRelayTo(relayB.vpnIp)
+
+	tests := []struct {
+		name  string
+		to    *HostInfo
+		dscp  uint8
+		relay *HostInfo
+	}{
+		{"unmarked traffic is in no class", lab, 0, nil},
+		{"a direct class takes the direct path", lab, 46, nil},
+		{"the first established relay of the class", lab, 34, relayB},
+		{"a class limited to the destination", lab, 8, relayA},
+		{"the next class for a destination the first does not cover", other, 8, relayB},
+		{"any relay of the destination", other, 10, relayB},
+		{"a relay class without an established relay falls back", lab, 12, nil},
+	}
+
+	fallback := ps.metricFallback.Count()
+	for _, tt := range tests {
+		relayHostInfo, relay := ps.relayFor(f, tt.to, nil, dscpPacket(tt.dscp), 100)
+		if tt.relay == nil {
+			assert.Nil(t, relayHostInfo, tt.name)
+			continue
+		}
+		require.NotNil(t, relayHostInfo, tt.name)
+		assert.Equal(t, tt.relay.vpnIp, relayHostInfo.vpnIp, tt.name)
+		assert.Equal(t, tt.to.vpnIp, relay.PeerIp, tt.name)
+	}
+	assert.Equal(t, fallback+1, ps.metricFallback.Count())
+
+	t.Log("A draining relay is skipped")
+	relayB.relayDraining.Store(true)
+	relayHostInfo, _ := ps.relayFor(f, lab, nil, dscpPacket(34), 100)
+	require.NotNil(t, relayHostInfo)
+	assert.Equal(t, relayA.vpnIp, relayHostInfo.vpnIp)
+	relayHostInfo, _ = ps.relayFor(f, other, nil, dscpPacket(10), 100)
+	assert.Nil(t, relayHostInfo)
+	relayB.relayDraining.Store(false)
+
+	t.Log("Steered data goes through the relay, the rest directly")
+	p := append(dscpPacket(34), make([]byte, 100)...)
+	f.sendNoMetricsFlow(header.Message, 0, lab.ConnectionState, lab, netip.AddrPort{}, nil, p, make([]byte, 12), make([]byte, mtu), 0)
+	assert.Len(t, conn.sent[relayB.remote], 1)
+	assert.Empty(t, conn.sent[lab.remote])
+
+	p = append(dscpPacket(46), make([]byte, 100)...)
+	f.sendNoMetricsFlow(header.Message, 0, lab.ConnectionState, lab, netip.AddrPort{}, nil, p, make([]byte, 12), make([]byte, mtu), 0)
+	assert.Len(t, conn.sent[relayB.remote], 1)
+	assert.Len(t, conn.sent[lab.remote], 1)
+
+	t.Log("The policy and the current paths are reported")
+	policy := ps.GetPolicy()
+	require.Len(t, policy, 5)
+	assert.Equal(t, PathClassPolicy{
+		Class:        "lab",
+		DSCP:         []int{8},
+		Destinations: []netip.Prefix{netip.MustParsePrefix("10.128.0.8/29")},
+		Path:         PathRelay,
+		Relays:       []netip.Addr{relayA.vpnIp},
+		Steered:      1,
+	}, policy[2])
+	assert.Equal(t, uint64(3), policy[1].Steered)
+
+	assert.Equal(t, []PathSelectionStatus{
+		{Class: "voice", Path: PathDirect, Current: PathDirect},
+		{Class: "video", Path: PathRelay, Current: PathRelay, Relay: relayB.vpnIp},
+		{Class: "bulk", Path: PathRelay, Current: PathRelay, Relay: relayB.vpnIp},
+		{Class: "backup", Path: PathRelay, Current: PathDirect},
+	}, ps.GetPaths(f, other))
+
+	t.Log("Classes are reloadable")
+	require.NoError(t, c.ReloadConfigString("path_selection: {classes: [{dscp: [46], path: relay}]}"))
+	policy = ps.GetPolicy()
+	require.Len(t, policy, 1)
+	assert.Equal(t, "class0", policy[0].Class)
+
+	require.NoError(t, c.ReloadConfigString("path_selection: {}"))
+	assert.Nil(t, ps.GetPolicy())
+	relayHostInfo, _ = ps.relayFor(f, lab, nil, dscpPacket(34), 100)
+	assert.Nil(t, relayHostInfo)
+
+	var nilPS *PathSelection
+	relayHostInfo, _ = nilPS.relayFor(f, lab, nil, dscpPacket(34), 100)
+	assert.Nil(t, relayHostInfo)
+	assert.Nil(t, nilPS.GetPaths(f, lab))
+}
+
+func TestParsePathClasses(t *testing.T) {
+	l := test.NewLogger()
+	tests := []struct {
+		conf string
+		err  string
+	}{
+		{"classes: nope", "path_selection.classes must be a list"},
+		{"classes: [nope]", "path_selection.classes.0 must be a map with dscp and path"},
+		{"classes: [{path: relay}]", "path_selection.classes.0.dscp must be a non empty list"},
+		{"classes: [{dscp: [64], path: relay}]", "path_selection.classes.0.dscp has 64, dscp values are 0 to 63"},
+		{"classes: [{dscp: [46]}]", `path_selection.classes.0.path must be direct or relay, got "<nil>"`},
+		{"classes: [{dscp: [46], path: fast}]", `path_selection.classes.0.path must be direct or relay, got "fast"`},
+		{"classes: [{dscp: [46], path: relay, destinations: []}]", "path_selection.classes.0.destinations must be a non empty list"},
+		{"classes: [{dscp: [46], path: relay, destinations: [nope]}]", "path_selection.classes.0.destinations has nope: not a vpn ip or CIDR"},
+		{"classes: [{dscp: [46], path: direct, relays: [10.0.0.1]}]", "path_selection.classes.0.relays is only used with the relay path"},
+		{"classes: [{dscp: [46], path: relay, relays: [nope]}]", "path_selection.classes.0.relays has an invalid vpn ip: nope"},
+	}
+	for _, tt := range tests {
+		c := config.NewC(l)
+		require.NoError(t, c.LoadString("path_selection: {"+tt.conf+"}"))
+		_, err := parsePathClasses(c)
+		assert.EqualError(t, err, tt.err, tt.conf)
+	}
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("path_selection: {classes: []}"))
+	pc, err := parsePathClasses(c)
+	require.NoError(t, err)
+	assert.Nil(t, pc)
+}
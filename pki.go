@@ -1,6 +1,7 @@
 package nebula
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
@@ -8,16 +9,33 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/util"
 )
 
+// defaultClockSkew is how far a peer certificate may be outside its validity period before it is rejected, it covers
+// small differences between the clocks of the peers and the CA
+const defaultClockSkew = time.Minute
+
+var (
+	ErrCertKeyMismatch = errors.New("certificate public key does not match the private key in use")
+	ErrCertIPChanged   = errors.New("certificate vpn ip is different from the one in use")
+)
+
 type PKI struct {
-	cs     atomic.Pointer[CertState]
-	caPool atomic.Pointer[cert.NebulaCAPool]
-	l      *logrus.Logger
+	cs        atomic.Pointer[CertState]
+	caPool    atomic.Pointer[cert.NebulaCAPool]
+	clockSkew atomic.Int64
+	// expiredGrace is pki.expired_grace_period, how long after expiring a certificate is still accepted
+	expiredGrace atomic.Int64
+	certPolicy   atomic.Pointer[certPolicy]
+	userCert     atomic.Pointer[userCertState]
+
+	metricExpiredGrace metrics.Counter
+	l                  *logrus.Logger
 }
 
 type CertState struct {
@@ -25,11 +43,14 @@ type CertState struct {
 	RawCertificate      []byte
 	RawCertificateNoKey []byte
 	PublicKey           []byte
-	PrivateKey          []byte
+	PrivateKey          NodeKey
 }
 
 func NewPKIFromConfig(l *logrus.Logger, c *config.C) (*PKI, error) {
-	pki := &PKI{l: l}
+	pki := &PKI{
+		metricExpiredGrace: metrics.GetOrRegisterCounter("certificate.expired_grace.accepted", nil),
+		l:                  l,
+	}
 	err := pki.reload(c, true)
 	if err != nil {
 		return nil, err
@@ -53,7 +74,39 @@ func (p *PKI) GetCAPool() *cert.NebulaCAPool {
 	return p.caPool.Load()
 }
 
+// GetClockSkew returns how far the local clock is allowed to be off when validating peer certificates
+func (p *PKI) GetClockSkew() time.Duration {
+	return time.Duration(p.clockSkew.Load())
+}
+
+// GetExpiredGracePeriod returns how long after expiring a certificate is still accepted, zero unless
+// pki.expired_grace_period is set
+func (p *PKI) GetExpiredGracePeriod() time.Duration {
+	return time.Duration(p.expiredGrace.Load())
+}
+
 func (p *PKI) reload(c *config.C, initial bool) error {
+	skew := c.GetDuration("pki.clock_skew", defaultClockSkew)
+	if skew < 0 {
+		skew = 0
+	}
+	if !initial && skew != p.GetClockSkew() {
+		p.l.WithField("clockSkew", skew).Info("pki.clock_skew changed")
+	}
+	p.clockSkew.Store(int64(skew))
+
+	grace := c.GetDuration("pki.expired_grace_period", 0)
+	if grace < 0 {
+		grace = 0
+	}
+	if grace > 0 && (initial || grace != p.GetExpiredGracePeriod()) {
+		p.l.WithField("expiredGracePeriod", grace).
+			Warn("pki.expired_grace_period is set, expired certificates are accepted, remove it as soon as certificates are renewed")
+	} else if !initial && grace != p.GetExpiredGracePeriod() {
+		p.l.WithField("expiredGracePeriod", grace).Info("pki.expired_grace_period changed")
+	}
+	p.expiredGrace.Store(int64(grace))
+
 	err := p.reloadCert(c, initial)
 	if err != nil {
 		if initial {
@@ -70,6 +123,20 @@ func (p *PKI) reload(c *config.C, initial bool) error {
 		err.Log(p.l)
 	}
 
+	if err := p.reloadCertPolicy(c, initial); err != nil {
+		if initial {
+			return err
+		}
+		p.l.WithError(err).Error("Failed to reload pki.cert_policy, keeping the previous policy")
+	}
+
+	if err := p.reloadUserCert(c, initial); err != nil {
+		if initial {
+			return err
+		}
+		p.l.WithError(err).Error("Failed to reload pki.user, keeping the previous user certificate and CA")
+	}
+
 	return nil
 }
 
@@ -96,7 +163,11 @@ func (p *PKI) reloadCert(c *config.C, initial bool) *util.ContextualError {
 	}
 
 	p.cs.Store(cs)
-	if initial {
+	if notAfter := cs.Certificate.Details.NotAfter; notAfter.Before(time.Now()) {
+		p.l.WithField("cert", cs.Certificate).
+			WithField("expiredGracePeriod", p.GetExpiredGracePeriod()).
+			Warn("Our certificate is EXPIRED and only used because of pki.expired_grace_period, renew it now")
+	} else if initial {
 		p.l.WithField("cert", cs.Certificate).Debug("Client nebula certificate")
 	} else {
 		p.l.WithField("cert", cs.Certificate).Info("Client cert refreshed from disk")
@@ -104,6 +175,62 @@ func (p *PKI) reloadCert(c *config.C, initial bool) *util.ContextualError {
 	return nil
 }
 
+// CertLoadResult is returned when a certificate was swapped in with LoadCert
+type CertLoadResult struct {
+	OldFingerprint string    `json:"oldFingerprint"`
+	NewFingerprint string    `json:"newFingerprint"`
+	NotAfter       time.Time `json:"notAfter"`
+}
+
+// LoadCert replaces our certificate with the PEM encoded rawCert without touching the config. The certificate must be
+// valid for the loaded CA pool, carry the public key of the private key in use, and keep our vpn ip. New handshakes
+// use it right away, existing tunnels keep working and are re-handshaked by the connection manager as they are used.
+// A config reload reads pki.cert again and replaces a certificate loaded this way.
+func (p *PKI) LoadCert(rawCert []byte) (*CertLoadResult, error) {
+	nebulaCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawCert)
+	if err != nil {
+		return nil, fmt.Errorf("error while unmarshaling certificate: %w", err)
+	}
+
+	if len(nebulaCert.Details.Ips) == 0 {
+		return nil, fmt.Errorf("no IPs encoded in certificate")
+	}
+
+	if _, err = nebulaCert.Verify(time.Now(), p.GetCAPool()); err != nil {
+		return nil, fmt.Errorf("certificate is not valid for the loaded ca: %w", err)
+	}
+
+	old := p.cs.Load()
+	key := old.PrivateKey
+	if key.Curve() != nebulaCert.Details.Curve || !bytes.Equal(key.Public(), nebulaCert.Details.PublicKey) {
+		return nil, ErrCertKeyMismatch
+	}
+
+	//TODO: include check for mask equality as well
+	if oldIP, newIP := old.Certificate.Details.Ips[0], nebulaCert.Details.Ips[0]; oldIP.String() != newIP.String() {
+		return nil, fmt.Errorf("%w: %v is not %v", ErrCertIPChanged, newIP, oldIP)
+	}
+
+	cs, err := newCertState(nebulaCert, key)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &CertLoadResult{NotAfter: nebulaCert.Details.NotAfter}
+	res.OldFingerprint, _ = old.Certificate.Sha256Sum()
+	res.NewFingerprint, _ = nebulaCert.Sha256Sum()
+
+	if !p.cs.CompareAndSwap(old, cs) {
+		return nil, errors.New("certificate changed while loading, try again")
+	}
+
+	p.l.WithField("cert", cs.Certificate).
+		WithField("oldFingerprint", res.OldFingerprint).
+		WithField("newFingerprint", res.NewFingerprint).
+		Info("Client cert loaded")
+	return res, nil
+}
+
 func (p *PKI) reloadCAPool(c *config.C) *util.ContextualError {
 	caPool, err := loadCAPoolFromConfig(p.l, c)
 	if err != nil {
@@ -115,7 +242,7 @@ func (p *PKI) reloadCAPool(c *config.C) *util.ContextualError {
 	return nil
 }
 
-func newCertState(certificate *cert.NebulaCertificate, privateKey []byte) (*CertState, error) {
+func newCertState(certificate *cert.NebulaCertificate, privateKey NodeKey) (*CertState, error) {
 	// Marshal the certificate to ensure it is valid
 	rawCertificate, err := certificate.Marshal()
 	if err != nil {
@@ -150,20 +277,31 @@ func newCertStateFromConfig(c *config.C) (*CertState, error) {
 		return nil, errors.New("no pki.key path or PEM data provided")
 	}
 
-	if strings.Contains(privPathOrPEM, "-----BEGIN") {
-		pemPrivateKey = []byte(privPathOrPEM)
-		privPathOrPEM = "<inline>"
+	var key NodeKey
+	var rawKey []byte
+	var curve cert.Curve
+	if loader := nodeKeyLoaderFor(privPathOrPEM); loader != nil {
+		key, err = loader(c, privPathOrPEM)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading pki.key %s: %s", privPathOrPEM, err)
+		}
 
 	} else {
-		pemPrivateKey, err = os.ReadFile(privPathOrPEM)
-		if err != nil {
-			return nil, fmt.Errorf("unable to read pki.key file %s: %s", privPathOrPEM, err)
+		if strings.Contains(privPathOrPEM, "-----BEGIN") {
+			pemPrivateKey = []byte(privPathOrPEM)
+			privPathOrPEM = "<inline>"
+
+		} else {
+			pemPrivateKey, err = os.ReadFile(privPathOrPEM)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read pki.key file %s: %s", privPathOrPEM, err)
+			}
 		}
-	}
 
-	rawKey, _, curve, err := cert.UnmarshalPrivateKey(pemPrivateKey)
-	if err != nil {
-		return nil, fmt.Errorf("error while unmarshaling pki.key %s: %s", privPathOrPEM, err)
+		rawKey, _, curve, err = cert.UnmarshalPrivateKey(pemPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("error while unmarshaling pki.key %s: %s", privPathOrPEM, err)
+		}
 	}
 
 	var rawCert []byte
@@ -189,19 +327,38 @@ func newCertStateFromConfig(c *config.C) (*CertState, error) {
 		return nil, fmt.Errorf("error while unmarshaling pki.cert %s: %s", pubPathOrPEM, err)
 	}
 
-	if nebulaCert.Expired(time.Now()) {
-		return nil, fmt.Errorf("nebula certificate for this host is expired")
+	now := time.Now()
+	if nebulaCert.Details.NotBefore.After(now) {
+		return nil, fmt.Errorf("nebula certificate for this host is not yet valid")
+	}
+	if nebulaCert.Details.NotAfter.Before(now) {
+		// Only in an emergency, see pki.expired_grace_period. Peers give our certificate the same clock_skew on top.
+		grace := c.GetDuration("pki.expired_grace_period", 0)
+		skew := max(c.GetDuration("pki.clock_skew", defaultClockSkew), 0)
+		if grace <= 0 || now.Sub(nebulaCert.Details.NotAfter) > skew+grace {
+			return nil, fmt.Errorf("nebula certificate for this host is expired")
+		}
 	}
 
 	if len(nebulaCert.Details.Ips) == 0 {
 		return nil, fmt.Errorf("no IPs encoded in certificate")
 	}
 
-	if err = nebulaCert.VerifyPrivateKey(curve, rawKey); err != nil {
+	if key == nil {
+		if err = nebulaCert.VerifyPrivateKey(curve, rawKey); err != nil {
+			return nil, fmt.Errorf("private key is not a pair with public key in nebula cert")
+		}
+
+		key, err = newRawNodeKey(curve, rawKey, nebulaCert.Details.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+
+	} else if key.Curve() != nebulaCert.Details.Curve || !bytes.Equal(key.Public(), nebulaCert.Details.PublicKey) {
 		return nil, fmt.Errorf("private key is not a pair with public key in nebula cert")
 	}
 
-	return newCertState(nebulaCert, rawKey)
+	return newCertState(nebulaCert, key)
 }
 
 func loadCAPoolFromConfig(l *logrus.Logger, c *config.C) (*cert.NebulaCAPool, error) {
@@ -224,6 +381,10 @@ func loadCAPoolFromConfig(l *logrus.Logger, c *config.C) (*cert.NebulaCAPool, er
 	}
 
 	caPool, err := cert.NewCAPoolFromBytes(rawCA)
+	if err == nil || errors.Is(err, cert.ErrExpired) {
+		err = addRotatingInCAs(l, c, caPool, err)
+	}
+
 	if errors.Is(err, cert.ErrExpired) {
 		var expired int
 		for _, crt := range caPool.CAs {
@@ -248,3 +409,41 @@ func loadCAPoolFromConfig(l *logrus.Logger, c *config.C) (*cert.NebulaCAPool, er
 
 	return caPool, nil
 }
+
+// addRotatingInCAs trusts the CAs in pki.ca_rotating_in and marks them as rotating in. An ErrExpired from loading pki.ca
+// is passed in as caErr and returned if none of the rotating in CAs are expired either.
+func addRotatingInCAs(l *logrus.Logger, c *config.C, caPool *cert.NebulaCAPool, caErr error) error {
+	pathOrPEM := c.GetString("pki.ca_rotating_in", "")
+	if pathOrPEM == "" {
+		return caErr
+	}
+
+	raw := []byte(pathOrPEM)
+	if !strings.Contains(pathOrPEM, "-----BEGIN") {
+		var err error
+		raw, err = os.ReadFile(pathOrPEM)
+		if err != nil {
+			return fmt.Errorf("unable to read pki.ca_rotating_in file %s: %s", pathOrPEM, err)
+		}
+	}
+
+	next, err := cert.NewCAPoolFromBytes(raw)
+	if errors.Is(err, cert.ErrExpired) {
+		caErr = err
+	} else if err != nil {
+		return fmt.Errorf("error while adding pki.ca_rotating_in certificate to CA trust store: %s", err)
+	}
+
+	for fp, ca := range next.CAs {
+		if _, ok := caPool.CAs[fp]; ok {
+			// Already fully trusted through pki.ca, the rotation is done for this one
+			continue
+		}
+
+		caPool.CAs[fp] = ca
+		caPool.MarkRotatingIn(fp)
+		l.WithField("fingerprint", fp).WithField("name", ca.Details.Name).Info("Trusting rotating in CA")
+	}
+
+	return caErr
+}
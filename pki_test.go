@@ -0,0 +1,128 @@
+package nebula
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA is a CA valid for a day either side of now for signing test certificates
+type testCA struct {
+	t   testing.TB
+	key ed25519.PrivateKey
+	// fp is the fingerprint of the CA certificate and pem is how pki.ca holds it
+	fp  string
+	pem []byte
+}
+
+// newTestCA returns a new CA named name
+func newTestCA(t testing.TB, name string) *testCA {
+	caPub, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      name,
+			NotBefore: time.Now().Add(-24 * time.Hour),
+			NotAfter:  time.Now().Add(24 * time.Hour),
+			PublicKey: caPub,
+			IsCA:      true,
+		},
+	}
+	require.NoError(t, ca.Sign(cert.Curve_CURVE25519, caPriv))
+	fp, err := ca.Sha256Sum()
+	require.NoError(t, err)
+	b, err := ca.MarshalToPEM()
+	require.NoError(t, err)
+
+	return &testCA{t: t, key: caPriv, fp: fp, pem: b}
+}
+
+// pool returns a new pool trusting only ca
+func (ca *testCA) pool() *cert.NebulaCAPool {
+	caPool := cert.NewCAPool()
+	_, err := caPool.AddCACertificate(ca.pem)
+	require.NoError(ca.t, err)
+	return caPool
+}
+
+// sign returns the PEM of a copy of c signed by ca, expiring notAfter from now
+func (ca *testCA) sign(c *cert.NebulaCertificate, notAfter time.Duration) []byte {
+	c = c.Copy()
+	c.Details.Issuer = ca.fp
+	c.Details.NotBefore = time.Now().Add(-12 * time.Hour).Round(time.Second)
+	c.Details.NotAfter = time.Now().Add(notAfter).Round(time.Second)
+	require.NoError(ca.t, c.Sign(cert.Curve_CURVE25519, ca.key))
+	b, err := c.MarshalToPEM()
+	require.NoError(ca.t, err)
+	return b
+}
+
+func TestPKI_LoadCert(t *testing.T) {
+	l := test.NewLogger()
+	ca := newTestCA(t, "ca")
+	key, crt := newTestNodeKey(t)
+
+	current, _, err := cert.UnmarshalNebulaCertificateFromPEM(ca.sign(crt, time.Hour))
+	require.NoError(t, err)
+	cs, err := newCertState(current, key)
+	require.NoError(t, err)
+
+	p := &PKI{l: l}
+	p.caPool.Store(ca.pool())
+	p.cs.Store(cs)
+
+	// Not a certificate
+	_, err = p.LoadCert([]byte("nope"))
+	assert.Error(t, err)
+
+	// Someone else's key
+	_, other := newTestNodeKey(t)
+	_, err = p.LoadCert(ca.sign(other, 2*time.Hour))
+	assert.ErrorIs(t, err, ErrCertKeyMismatch)
+
+	// A different vpn ip
+	moved := crt.Copy()
+	moved.Details.Ips = []*net.IPNet{{IP: net.IPv4(10, 1, 0, 2), Mask: net.CIDRMask(16, 32)}}
+	_, err = p.LoadCert(ca.sign(moved, 2*time.Hour))
+	assert.ErrorIs(t, err, ErrCertIPChanged)
+
+	// Expired
+	_, err = p.LoadCert(ca.sign(crt, -time.Second))
+	assert.ErrorIs(t, err, cert.ErrExpired)
+
+	// Signed by a CA we do not trust
+	untrusted := crt.Copy()
+	_, otherCAPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	require.NoError(t, untrusted.Sign(cert.Curve_CURVE25519, otherCAPriv))
+	b, err := untrusted.MarshalToPEM()
+	require.NoError(t, err)
+	_, err = p.LoadCert(b)
+	assert.Error(t, err)
+
+	assert.Same(t, cs, p.GetCertState(), "a rejected certificate must not be swapped in")
+
+	// A renewal with the same key and ip
+	renewed := ca.sign(crt, 2*time.Hour)
+	res, err := p.LoadCert(renewed)
+	require.NoError(t, err)
+
+	oldFp, _ := current.Sha256Sum()
+	assert.Equal(t, oldFp, res.OldFingerprint)
+	assert.NotEqual(t, oldFp, res.NewFingerprint)
+
+	newCs := p.GetCertState()
+	assert.NotSame(t, cs, newCs)
+	assert.Equal(t, res.NotAfter, newCs.Certificate.Details.NotAfter)
+	assert.Equal(t, key, newCs.PrivateKey)
+	newFp, _ := newCs.Certificate.Sha256Sum()
+	assert.Equal(t, res.NewFingerprint, newFp)
+	assert.NotEmpty(t, newCs.RawCertificateNoKey)
+}
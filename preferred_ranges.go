@@ -0,0 +1,155 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// preferredRangeOverride gives the peers it matches their own preferred ranges, for example to reach one peer through
+// the datacenter range and another through a different one. A peer matches if its vpn ip is within hosts or its
+// certificate carries one of groups.
+type preferredRangeOverride struct {
+	hosts  []netip.Prefix
+	groups []string
+	ranges []netip.Prefix
+}
+
+func parsePreferredRangeOverrides(raw interface{}) ([]preferredRangeOverride, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	rs, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("preferred_range_overrides should be an array of overrides")
+	}
+
+	var overrides []preferredRangeOverride
+	for i, r := range rs {
+		m, ok := r.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("preferred_range_overrides entry #%v; should be a map with hosts or groups and ranges", i)
+		}
+
+		var o preferredRangeOverride
+		for _, s := range toStringSlice(m["hosts"]) {
+			cidr, err := parsePrefixOrAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("preferred_range_overrides entry #%v; hosts entry %q did not parse; %s", i, s, err)
+			}
+			o.hosts = append(o.hosts, cidr)
+		}
+
+		o.groups = toStringSlice(m["groups"])
+		if len(o.hosts) == 0 && len(o.groups) == 0 {
+			return nil, fmt.Errorf("preferred_range_overrides entry #%v; at least one of hosts or groups is required", i)
+		}
+
+		for _, s := range toStringSlice(m["ranges"]) {
+			cidr, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("preferred_range_overrides entry #%v; ranges entry %q did not parse; %s", i, s, err)
+			}
+			o.ranges = append(o.ranges, cidr)
+		}
+		if len(o.ranges) == 0 {
+			return nil, fmt.Errorf("preferred_range_overrides entry #%v; ranges is required", i)
+		}
+
+		overrides = append(overrides, o)
+	}
+
+	return overrides, nil
+}
+
+// toStringSlice converts a yaml list, or a single value, into a slice of strings
+func toStringSlice(v interface{}) []string {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		s := make([]string, 0, len(t))
+		for _, e := range t {
+			s = append(s, fmt.Sprintf("%v", e))
+		}
+		return s
+	default:
+		return []string{fmt.Sprintf("%v", t)}
+	}
+}
+
+// preferredRangesFor returns the preferred ranges that apply to the peer of h. override is the ranges of the first
+// override that lists the vpn ip of the peer, or failing that the first that matches one of its certificate groups.
+// preferredRanges is override followed by the global preferred_ranges, every address within it is preferred. Groups
+// are only known once a handshake completed, before then only overrides by vpn ip apply.
+func (hm *HostMap) preferredRangesFor(h *HostInfo) (override, preferredRanges []netip.Prefix) {
+	global := hm.GetPreferredRanges()
+
+	overrides := hm.preferredRangeOverrides.Load()
+	if overrides == nil || len(*overrides) == 0 || h == nil {
+		return nil, global
+	}
+
+	override = matchPreferredRangeOverride(*overrides, h)
+	if override == nil {
+		return nil, global
+	}
+
+	preferredRanges = slices.Clone(override)
+	for _, r := range global {
+		if !slices.Contains(preferredRanges, r) {
+			preferredRanges = append(preferredRanges, r)
+		}
+	}
+	return override, preferredRanges
+}
+
+func matchPreferredRangeOverride(overrides []preferredRangeOverride, h *HostInfo) []netip.Prefix {
+	for _, o := range overrides {
+		for _, p := range o.hosts {
+			if p.Contains(h.vpnIp) {
+				return o.ranges
+			}
+		}
+	}
+
+	c := h.GetCert()
+	if c == nil {
+		return nil
+	}
+
+	for _, o := range overrides {
+		for _, g := range o.groups {
+			if _, ok := c.Details.InvertedGroups[g]; ok {
+				return o.ranges
+			}
+		}
+	}
+	return nil
+}
+
+// PreferredRangesFor returns the preferred ranges to use with the remotes of h, any override for the peer followed by
+// the global preferred_ranges
+func (hm *HostMap) PreferredRangesFor(h *HostInfo) []netip.Prefix {
+	_, preferredRanges := hm.preferredRangesFor(h)
+	return preferredRanges
+}
+
+// preferredTier ranks ip for a peer, lower is better. Addresses within the override ranges of the peer rank first,
+// then those only within the global preferred_ranges, then everything else. Without an override the global
+// preferred_ranges rank first.
+func preferredTier(ip netip.Addr, override, preferredRanges []netip.Prefix) int {
+	if isPreferred(ip, override) {
+		return 0
+	}
+
+	if isPreferred(ip, preferredRanges) {
+		if len(override) == 0 {
+			return 0
+		}
+		return 1
+	}
+
+	return 2
+}
@@ -0,0 +1,140 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePreferredRangeOverrides(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	parse := func(s string) ([]preferredRangeOverride, error) {
+		require.NoError(t, c.LoadString(s))
+		return parsePreferredRangeOverrides(c.Get("preferred_range_overrides"))
+	}
+
+	o, err := parse("preferred_range_overrides: [{hosts: [10.128.0.2, 10.128.1.0/24], groups: [dc], ranges: [10.0.0.0/8]}]")
+	require.NoError(t, err)
+	assert.Equal(t, []preferredRangeOverride{{
+		hosts:  []netip.Prefix{netip.MustParsePrefix("10.128.0.2/32"), netip.MustParsePrefix("10.128.1.0/24")},
+		groups: []string{"dc"},
+		ranges: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}}, o)
+
+	_, err = parse("preferred_range_overrides: {hosts: [10.128.0.2]}")
+	assert.EqualError(t, err, "preferred_range_overrides should be an array of overrides")
+
+	_, err = parse("preferred_range_overrides: [{ranges: [10.0.0.0/8]}]")
+	assert.EqualError(t, err, "preferred_range_overrides entry #0; at least one of hosts or groups is required")
+
+	_, err = parse("preferred_range_overrides: [{groups: [dc]}]")
+	assert.EqualError(t, err, "preferred_range_overrides entry #0; ranges is required")
+
+	_, err = parse("preferred_range_overrides: [{hosts: [nope], ranges: [10.0.0.0/8]}]")
+	assert.ErrorContains(t, err, `preferred_range_overrides entry #0; hosts entry "nope" did not parse`)
+
+	_, err = parse("preferred_range_overrides: [{groups: [dc], ranges: [10.0.0.1]}]")
+	assert.ErrorContains(t, err, `preferred_range_overrides entry #0; ranges entry "10.0.0.1" did not parse`)
+}
+
+func TestHostMap_preferredRangesFor(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+preferred_ranges: [172.16.0.0/24]
+preferred_range_overrides:
+  - groups: [dc]
+    ranges: [10.1.0.0/16]
+  - hosts: [10.128.0.2]
+    ranges: [10.2.0.0/16, 172.16.0.0/24]
+`))
+	hm := NewHostMapFromConfig(l, netip.MustParsePrefix("10.128.0.1/24"), c)
+
+	dcCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{InvertedGroups: map[string]struct{}{"dc": {}}}}
+	byIp := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.2"), ConnectionState: &ConnectionState{peerCert: dcCert}}
+	byGroup := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.3"), ConnectionState: &ConnectionState{peerCert: dcCert}}
+	handshaking := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.3")}
+	other := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.4")}
+
+	t.Log("An override by vpn ip wins over one by group and global ranges are not repeated")
+	override, all := hm.preferredRangesFor(byIp)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.2.0.0/16"), netip.MustParsePrefix("172.16.0.0/24")}, override)
+	assert.Equal(t, override, all)
+
+	t.Log("An override by group is followed by the global ranges")
+	override, all = hm.preferredRangesFor(byGroup)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}, override)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16"), netip.MustParsePrefix("172.16.0.0/24")}, all)
+
+	t.Log("Without a certificate groups do not match")
+	override, all = hm.preferredRangesFor(handshaking)
+	assert.Nil(t, override)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("172.16.0.0/24")}, all)
+	assert.Equal(t, all, hm.PreferredRangesFor(other))
+
+	t.Log("Candidates in the override ranges are ordered first for that peer only")
+	rl := NewRemoteList(nil)
+	rl.unlockedSetV4(
+		netip.MustParseAddr("10.128.0.2"),
+		netip.MustParseAddr("10.128.0.3"),
+		[]*Ip4AndPort{
+			newIp4AndPortFromString("70.199.182.92:4242"),
+			newIp4AndPortFromString("10.1.0.5:4242"),
+			newIp4AndPortFromString("172.16.0.5:4242"),
+		},
+		func(netip.Addr, *Ip4AndPort) bool { return true },
+	)
+	assert.Equal(t, []netip.AddrPort{
+		netip.MustParseAddrPort("10.1.0.5:4242"),
+		netip.MustParseAddrPort("172.16.0.5:4242"),
+		netip.MustParseAddrPort("70.199.182.92:4242"),
+	}, rl.CopyAddrs(hm.PreferredRangesFor(byGroup)))
+	assert.Equal(t, []netip.AddrPort{
+		netip.MustParseAddrPort("172.16.0.5:4242"),
+		netip.MustParseAddrPort("70.199.182.92:4242"),
+		netip.MustParseAddrPort("10.1.0.5:4242"),
+	}, rl.CopyAddrs(hm.PreferredRangesFor(other)))
+
+	t.Log("Roaming prefers the override ranges over the global ones")
+	byGroup.remotes = rl
+	byGroup.remote = netip.MustParseAddrPort("172.16.0.5:4242")
+	assert.False(t, byGroup.SetRemoteIfPreferred(hm, netip.MustParseAddrPort("70.199.182.92:4242")))
+	assert.True(t, byGroup.SetRemoteIfPreferred(hm, netip.MustParseAddrPort("10.1.0.5:4242")))
+	assert.Equal(t, netip.MustParseAddrPort("10.1.0.5:4242"), byGroup.remote)
+
+	other.remote = netip.MustParseAddrPort("172.16.0.5:4242")
+	assert.False(t, other.SetRemoteIfPreferred(hm, netip.MustParseAddrPort("10.1.0.5:4242")))
+
+	t.Log("A bad reload keeps the old overrides")
+	require.NoError(t, c.ReloadConfigString(`
+preferred_ranges: [172.16.0.0/24]
+preferred_range_overrides: [{hosts: [10.128.0.3], ranges: [bad]}]
+`))
+	override, _ = hm.preferredRangesFor(byGroup)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}, override)
+
+	require.NoError(t, c.ReloadConfigString("preferred_ranges: [172.16.0.0/24]"))
+	override, _ = hm.preferredRangesFor(byGroup)
+	assert.Nil(t, override)
+}
+
+func TestPreferredTier(t *testing.T) {
+	override := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}
+	all := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16"), netip.MustParsePrefix("172.16.0.0/24")}
+	global := []netip.Prefix{netip.MustParsePrefix("172.16.0.0/24")}
+
+	assert.Equal(t, 0, preferredTier(netip.MustParseAddr("10.1.0.5"), override, all))
+	assert.Equal(t, 1, preferredTier(netip.MustParseAddr("172.16.0.5"), override, all))
+	assert.Equal(t, 2, preferredTier(netip.MustParseAddr("70.199.182.92"), override, all))
+
+	assert.Equal(t, 0, preferredTier(netip.MustParseAddr("172.16.0.5"), nil, global))
+	assert.Equal(t, 2, preferredTier(netip.MustParseAddr("10.1.0.5"), nil, global))
+	assert.Equal(t, 2, preferredTier(netip.Addr{}, nil, global))
+}
@@ -0,0 +1,158 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// probeLen is the size of a probe payload, the magic of the prober followed by a big endian uint64
+const probeLen = 4 + 8
+
+// probeMagic prefixes the payload of a test packet probe so its test reply can be handed to the prober that sent it. The
+// peer echoes the payload of a test request, which makes this work with peers of any version.
+type probeMagic [4]byte
+
+// payload returns a probe payload carrying v, usually a probe id
+func (m probeMagic) payload(v uint64) []byte {
+	p := make([]byte, probeLen)
+	copy(p, m[:])
+	binary.BigEndian.PutUint64(p[len(m):], v)
+	return p
+}
+
+// parse returns the value carried by a probe payload of m, ok is false if d is not one. Anything after the value is
+// padding left for the prober to check.
+func (m probeMagic) parse(d []byte) (v uint64, ok bool) {
+	if len(d) < probeLen || probeMagic(d[:len(m)]) != m {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(d[len(m):]), true
+}
+
+// probe is the probe state of a single target
+type probe struct {
+	// id is the outstanding probe, 0 once it has been answered
+	id        uint64
+	sent      time.Time
+	firstSent time.Time
+	lastReply time.Time
+	// rtt is from the last reply in time and srtt is smoothed over the recent ones
+	rtt  time.Duration
+	srtt time.Duration
+	// lost is how many probes in a row went unanswered, an outstanding probe is counted once the next one is sent
+	lost int
+	// up is true once a probe was answered in time and until failures probes in a row were lost
+	up bool
+}
+
+// probeSet keeps the probe state of every target of a prober so test replies can be matched to the probe they answer.
+// It is not safe for concurrent use, the prober locks around it.
+type probeSet[K comparable] struct {
+	nextID uint64
+	probes map[K]*probe
+}
+
+// send records a new probe to target and returns its id, an outstanding probe to target is counted as lost
+func (ps *probeSet[K]) send(target K, now time.Time, timers *probeTimers) uint64 {
+	if ps.probes == nil {
+		ps.probes = map[K]*probe{}
+	}
+
+	p, ok := ps.probes[target]
+	if !ok {
+		p = &probe{firstSent: now}
+		ps.probes[target] = p
+	}
+
+	if p.id != 0 {
+		p.lose(timers)
+	}
+
+	ps.nextID++
+	p.id = ps.nextID
+	p.sent = now
+	return p.id
+}
+
+// find returns the target of the outstanding probe id
+func (ps *probeSet[K]) find(id uint64) (K, bool) {
+	for target, p := range ps.probes {
+		if id != 0 && p.id == id {
+			return target, true
+		}
+	}
+
+	var zero K
+	return zero, false
+}
+
+// reply records a reply to probe id of target, ok is false if that is not the outstanding probe. A reply slower than the
+// timeout is still ours but the probe is lost.
+func (ps *probeSet[K]) reply(target K, id uint64, now time.Time, timers *probeTimers) (inTime bool, ok bool) {
+	p, found := ps.probes[target]
+	if !found || id == 0 || p.id != id {
+		return false, false
+	}
+
+	p.id = 0
+	rtt := now.Sub(p.sent)
+	if !timers.inTime(rtt) {
+		p.lose(timers)
+		return false, true
+	}
+
+	p.lastReply = now
+	p.rtt = rtt
+	if p.srtt == 0 {
+		p.srtt = rtt
+	} else {
+		p.srtt = (7*p.srtt + rtt) / 8
+	}
+	p.lost = 0
+	p.up = true
+	return true, true
+}
+
+// get returns the probe state of target, nil if it was never probed
+func (ps *probeSet[K]) get(target K) *probe {
+	return ps.probes[target]
+}
+
+// retain forgets every target keep returns false for
+func (ps *probeSet[K]) retain(keep func(K) bool) {
+	for target := range ps.probes {
+		if !keep(target) {
+			delete(ps.probes, target)
+		}
+	}
+}
+
+func (p *probe) lose(timers *probeTimers) {
+	p.lost++
+	if p.lost >= timers.failures {
+		p.up = false
+	}
+}
+
+// heardWithin returns true if target answered a probe in time within timers.downAfter of now
+func (p *probe) heardWithin(now time.Time, timers *probeTimers) bool {
+	return !p.lastReply.IsZero() && now.Sub(p.lastReply) <= timers.downAfter()
+}
+
+// handleProbeReply hands a test reply to the prober whose magic it carries, replies to other test requests are ignored
+func (f *Interface) handleProbeReply(hostinfo *HostInfo, d []byte, now time.Time) {
+	if len(d) < probeLen {
+		return
+	}
+
+	switch probeMagic(d[:4]) {
+	case healthProbeMagic:
+		f.health.handleReply(hostinfo, d, now)
+	case latencyProbeMagic:
+		f.latencyProbe.handleReply(hostinfo, d, now)
+	case tunnelQualityMagic:
+		f.tunnelQuality.handleReply(hostinfo, d, now)
+	case mtuProbeMagic:
+		f.mtuProbe.handleReply(hostinfo, d, now)
+	}
+}
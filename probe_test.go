@@ -0,0 +1,93 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeMagic(t *testing.T) {
+	p := healthProbeMagic.payload(42)
+	assert.Len(t, p, probeLen)
+
+	v, ok := healthProbeMagic.parse(p)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(42), v)
+
+	_, ok = latencyProbeMagic.parse(p)
+	assert.False(t, ok, "another prober's magic")
+	_, ok = healthProbeMagic.parse(p[:probeLen-1])
+	assert.False(t, ok, "too short")
+
+	v, ok = mtuProbeMagic.parse(append(mtuProbeMagic.payload(7), make([]byte, 100)...))
+	assert.True(t, ok, "padding is left to the prober")
+	assert.Equal(t, uint64(7), v)
+}
+
+func TestProbeSet(t *testing.T) {
+	timers := &probeTimers{interval: 10 * time.Second, timeout: time.Second, failures: 2}
+	a, b := netip.MustParseAddr("10.128.0.2"), netip.MustParseAddr("10.128.0.3")
+	now := time.Now()
+
+	var ps probeSet[netip.Addr]
+	assert.Nil(t, ps.get(a))
+
+	idA := ps.send(a, now, timers)
+	idB := ps.send(b, now, timers)
+	assert.NotEqual(t, idA, idB)
+
+	target, ok := ps.find(idB)
+	assert.True(t, ok)
+	assert.Equal(t, b, target)
+	_, ok = ps.find(0)
+	assert.False(t, ok)
+
+	// Only the outstanding probe of the target counts
+	_, ok = ps.reply(a, idB, now, timers)
+	assert.False(t, ok)
+
+	inTime, ok := ps.reply(a, idA, now.Add(100*time.Millisecond), timers)
+	assert.True(t, ok)
+	assert.True(t, inTime)
+	p := ps.get(a)
+	assert.True(t, p.up)
+	assert.Equal(t, 100*time.Millisecond, p.rtt)
+	assert.True(t, p.heardWithin(now.Add(timers.downAfter()), timers))
+	assert.False(t, p.heardWithin(now.Add(timers.downAfter()+time.Second), timers))
+
+	_, ok = ps.reply(a, idA, now, timers)
+	assert.False(t, ok, "answered twice")
+
+	t.Log("A late reply is still ours but the probe is lost")
+	now = now.Add(timers.interval)
+	idA = ps.send(a, now, timers)
+	inTime, ok = ps.reply(a, idA, now.Add(2*time.Second), timers)
+	assert.True(t, ok)
+	assert.False(t, inTime)
+	assert.Equal(t, 1, p.lost)
+	assert.True(t, p.up, "one lost probe is tolerated")
+	assert.Equal(t, 100*time.Millisecond, p.rtt)
+
+	t.Log("An unanswered probe is lost once the next one is sent")
+	now = now.Add(timers.interval)
+	ps.send(a, now, timers)
+	now = now.Add(timers.interval)
+	idA = ps.send(a, now, timers)
+	assert.Equal(t, 2, p.lost)
+	assert.False(t, p.up)
+
+	inTime, ok = ps.reply(a, idA, now.Add(300*time.Millisecond), timers)
+	require.True(t, ok)
+	assert.True(t, inTime)
+	assert.True(t, p.up)
+	assert.Zero(t, p.lost)
+	assert.Equal(t, 300*time.Millisecond, p.rtt)
+	assert.Equal(t, (7*100*time.Millisecond+300*time.Millisecond)/8, p.srtt)
+
+	ps.retain(func(vpnIp netip.Addr) bool { return vpnIp == a })
+	assert.NotNil(t, ps.get(a))
+	assert.Nil(t, ps.get(b))
+}
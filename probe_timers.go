@@ -0,0 +1,66 @@
+package nebula
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+)
+
+// The sane ranges for probe timers, shared by every test packet probe so they are validated the same way
+const (
+	minProbeInterval = time.Second
+	maxProbeInterval = time.Hour
+	minProbeTimeout  = 10 * time.Millisecond
+	maxProbeFailures = 100
+
+	// defaultProbeTimeout is the probe timeout unless the interval is shorter
+	defaultProbeTimeout = 5 * time.Second
+)
+
+// probeTimers are the timers of a test packet reachability probe, read from <prefix>interval, <prefix>timeout and
+// <prefix>failures. A probe is sent every interval, a reply that takes longer than timeout does not count, and a target
+// is unreachable once failures probes in a row went unanswered. A WAN deployment wants a longer timeout than a LAN one,
+// a flaky link a higher failures.
+type probeTimers struct {
+	interval time.Duration
+	timeout  time.Duration
+	failures int
+}
+
+func newProbeTimersFromConfig(c *config.C, prefix string, defaultInterval time.Duration, defaultFailures int) (*probeTimers, error) {
+	pt := &probeTimers{
+		interval: c.GetDuration(prefix+"interval", defaultInterval),
+		failures: c.GetInt(prefix+"failures", defaultFailures),
+	}
+
+	if pt.interval < minProbeInterval || pt.interval > maxProbeInterval {
+		return nil, fmt.Errorf("%sinterval must be between %v and %v, got %v", prefix, minProbeInterval, maxProbeInterval, pt.interval)
+	}
+
+	timeout := defaultProbeTimeout
+	if timeout > pt.interval {
+		timeout = pt.interval
+	}
+	pt.timeout = c.GetDuration(prefix+"timeout", timeout)
+	if pt.timeout < minProbeTimeout || pt.timeout > pt.interval {
+		return nil, fmt.Errorf("%stimeout must be between %v and %sinterval %v, got %v", prefix, minProbeTimeout, prefix, pt.interval, pt.timeout)
+	}
+
+	if pt.failures < 1 || pt.failures > maxProbeFailures {
+		return nil, fmt.Errorf("%sfailures must be between 1 and %d, got %d", prefix, maxProbeFailures, pt.failures)
+	}
+
+	return pt, nil
+}
+
+// inTime reports if a reply rtt after its probe was sent counts
+func (pt *probeTimers) inTime(rtt time.Duration) bool {
+	return rtt <= pt.timeout
+}
+
+// downAfter is how long after its last reply in time a target is unreachable, when failures more probes were sent and
+// the last of them timed out
+func (pt *probeTimers) downAfter() time.Duration {
+	return time.Duration(pt.failures)*pt.interval + pt.timeout
+}
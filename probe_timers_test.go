@@ -0,0 +1,47 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewProbeTimersFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	for _, tc := range []struct {
+		config string
+		want   *probeTimers
+		err    string
+	}{
+		{"", &probeTimers{interval: 10 * time.Second, timeout: 5 * time.Second, failures: 3}, ""},
+		{"{interval: 2s}", &probeTimers{interval: 2 * time.Second, timeout: 2 * time.Second, failures: 3}, ""},
+		{"{interval: 1m, timeout: 15s, failures: 5}", &probeTimers{interval: time.Minute, timeout: 15 * time.Second, failures: 5}, ""},
+		{"{interval: 500ms}", nil, "probe.interval must be between 1s and 1h0m0s, got 500ms"},
+		{"{interval: 2h}", nil, "probe.interval must be between 1s and 1h0m0s, got 2h0m0s"},
+		{"{timeout: 1ms}", nil, "probe.timeout must be between 10ms and probe.interval 10s, got 1ms"},
+		{"{timeout: 11s}", nil, "probe.timeout must be between 10ms and probe.interval 10s, got 11s"},
+		{"{failures: 0}", nil, "probe.failures must be between 1 and 100, got 0"},
+		{"{failures: 101}", nil, "probe.failures must be between 1 and 100, got 101"},
+	} {
+		c := config.NewC(l)
+		if tc.config != "" {
+			require.NoError(t, c.LoadString("probe: "+tc.config+"\n"))
+		}
+		pt, err := newProbeTimersFromConfig(c, "probe.", 10*time.Second, 3)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, tc.config)
+			continue
+		}
+		require.NoError(t, err, tc.config)
+		assert.Equal(t, tc.want, pt, tc.config)
+	}
+
+	pt := &probeTimers{interval: 10 * time.Second, timeout: 2 * time.Second, failures: 3}
+	assert.Equal(t, 32*time.Second, pt.downAfter())
+	assert.True(t, pt.inTime(2*time.Second))
+	assert.False(t, pt.inTime(2*time.Second+time.Nanosecond))
+}
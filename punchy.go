@@ -1,6 +1,7 @@
 package nebula
 
 import (
+	"fmt"
 	"sync/atomic"
 	"time"
 
@@ -8,12 +9,47 @@ import (
 	"github.com/slackhq/nebula/config"
 )
 
+// keepaliveType is the packet sent to keep the NAT state of a quiet tunnel alive
+type keepaliveType uint32
+
+const (
+	// keepalivePunch is a single unauthenticated byte, the peer drops it
+	keepalivePunch keepaliveType = iota + 1
+	// keepaliveTest is a test request, the peer answers it like any other test packet
+	keepaliveTest
+	// keepaliveNoop is an empty authenticated data packet, the peer counts it as traffic but does not answer it
+	keepaliveNoop
+)
+
+func (k keepaliveType) String() string {
+	switch k {
+	case keepalivePunch:
+		return "punch"
+	case keepaliveTest:
+		return "test"
+	case keepaliveNoop:
+		return "noop"
+	default:
+		return ""
+	}
+}
+
+func parseKeepaliveType(s string) (keepaliveType, error) {
+	for _, k := range []keepaliveType{keepalivePunch, keepaliveTest, keepaliveNoop} {
+		if s == k.String() {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown keepalive type %q, expected punch, test, or noop", s)
+}
+
 type Punchy struct {
 	punch           atomic.Bool
 	respond         atomic.Bool
 	delay           atomic.Int64
 	respondDelay    atomic.Int64
 	punchEverything atomic.Bool
+	keepalive       atomic.Uint32
 	l               *logrus.Logger
 }
 
@@ -87,6 +123,18 @@ func (p *Punchy) reload(c *config.C, initial bool) {
 			p.l.Infof("punchy.respond_delay changed to %s", p.GetRespondDelay())
 		}
 	}
+
+	if initial || c.HasChanged("punchy.keepalive") {
+		k, err := parseKeepaliveType(c.GetString("punchy.keepalive", keepalivePunch.String()))
+		if err != nil {
+			p.l.WithError(err).Warn("Invalid punchy.keepalive, using punch")
+			k = keepalivePunch
+		}
+		p.keepalive.Store(uint32(k))
+		if !initial {
+			p.l.Infof("punchy.keepalive changed to %s", k)
+		}
+	}
 }
 
 func (p *Punchy) GetPunch() bool {
@@ -108,3 +156,7 @@ func (p *Punchy) GetRespondDelay() time.Duration {
 func (p *Punchy) GetTargetEverything() bool {
 	return p.punchEverything.Load()
 }
+
+func (p *Punchy) GetKeepalive() keepaliveType {
+	return keepaliveType(p.keepalive.Load())
+}
@@ -74,4 +74,17 @@ punchy:
 	p.reload(c, false)
 	assert.Equal(t, newDelay, p.GetDelay())
 	assert.Equal(t, true, p.GetRespond())
+	assert.Equal(t, keepalivePunch, p.GetKeepalive())
+
+	assert.NoError(t, c.ReloadConfigString(`
+punchy:
+  keepalive: noop
+`))
+	assert.Equal(t, keepaliveNoop, p.GetKeepalive())
+
+	assert.NoError(t, c.ReloadConfigString(`
+punchy:
+  keepalive: icmp
+`))
+	assert.Equal(t, keepalivePunch, p.GetKeepalive(), "an unknown type falls back to punch")
 }
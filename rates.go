@@ -0,0 +1,352 @@
+package nebula
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	// ratesInterval is how often the counters are sampled
+	ratesInterval = time.Second
+
+	defaultRatesWindow = 10 * time.Second
+	minRatesWindow     = 2 * ratesInterval
+	maxRatesWindow     = 5 * time.Minute
+
+	ratesMetricPrefix = "rates."
+)
+
+// The counters of handshakes and drops the rates are derived from. A counter that was never registered, like the
+// messages.* ones without stats.message_metrics, counts as 0.
+const rateHandshakesInitiated = "handshake_manager.initiated"
+
+var rateHandshakesReceived = []string{
+	"messages.rx.handshake_ixpsk0",
+	"messages.rx.handshake_xxpsk0",
+}
+
+var rateDropCounters = []string{
+	"firewall.incoming.dropped.local_ip",
+	"firewall.incoming.dropped.remote_ip",
+	"firewall.incoming.dropped.no_rule",
+	"firewall.incoming.dropped.new_flow_rate",
+	"firewall.incoming.dropped.unsafe_route_source",
+	"firewall.outgoing.dropped.local_ip",
+	"firewall.outgoing.dropped.remote_ip",
+	"firewall.outgoing.dropped.no_rule",
+	"firewall.conntrack.dropped.full",
+	"udp.denied",
+	"relay.forward_scope.dropped",
+	"hostinfo.cached_packets.dropped",
+	"send.backoff.dropped",
+	"send_priority.dropped",
+	"tunnel_pause.incoming.dropped",
+	"tunnel_pause.outgoing.dropped",
+	"messages.rx.control_queue_full",
+	"messages.rx.decrypt_shed",
+	"network.packets.duplicate",
+	"network.packets.out_of_window",
+	"network.packets.too_late",
+	"network.packets.routing_loop",
+	"network.packets.ip_options",
+	"network.packets.double_encrypted",
+}
+
+// Rates estimates per second rates from counters that only ever go up, so an operator does not have to differentiate
+// them during an incident. Every second the counters are sampled and each rate is the difference between the newest and
+// the oldest sample within rates.window divided by the time between them. The rates are an estimate, a burst shows up
+// smoothed over the window and a rate is 0 until there are two samples. They are exported as the rates.* gauges and from
+// the control socket.
+//
+// Inbound is every packet a reader received from the underlay and outbound every packet a reader read from the tun
+// device, each counted by the routine that handled it so an imbalance between the readers shows up.
+type Rates struct {
+	window atomic.Int64
+
+	// readers counts the packets of each routine, only that routine writes to its own counters
+	readers  []readerCounters
+	registry metrics.Registry
+
+	// samples is only touched by sample, oldest first
+	samples []rateSample
+	status  atomic.Pointer[RatesStatus]
+	gauges  rateGauges
+
+	l *logrus.Logger
+}
+
+// readerCounters is padded to a cache line so the routines do not contend for one
+type readerCounters struct {
+	rxPackets atomic.Uint64
+	rxBytes   atomic.Uint64
+	txPackets atomic.Uint64
+	txBytes   atomic.Uint64
+	_         [32]byte
+}
+
+type rateSample struct {
+	at                  time.Time
+	readers             []ReaderRates
+	handshakesInitiated int64
+	handshakesReceived  int64
+	drops               int64
+}
+
+type rateGauges struct {
+	rxPackets           metrics.GaugeFloat64
+	rxBytes             metrics.GaugeFloat64
+	txPackets           metrics.GaugeFloat64
+	txBytes             metrics.GaugeFloat64
+	handshakesInitiated metrics.GaugeFloat64
+	handshakesReceived  metrics.GaugeFloat64
+	drops               metrics.GaugeFloat64
+	readers             []readerGauges
+}
+
+type readerGauges struct {
+	rxPackets metrics.GaugeFloat64
+	rxBytes   metrics.GaugeFloat64
+	txPackets metrics.GaugeFloat64
+	txBytes   metrics.GaugeFloat64
+}
+
+// RatesStatus is the per second rates over the last Window
+type RatesStatus struct {
+	// Window is the time between the samples the rates were computed from, shorter than rates.window until it filled
+	Window              time.Duration `json:"window"`
+	RxPackets           float64       `json:"rxPackets"`
+	RxBytes             float64       `json:"rxBytes"`
+	TxPackets           float64       `json:"txPackets"`
+	TxBytes             float64       `json:"txBytes"`
+	HandshakesInitiated float64       `json:"handshakesInitiated"`
+	HandshakesReceived  float64       `json:"handshakesReceived"`
+	Drops               float64       `json:"drops"`
+	Readers             []ReaderRates `json:"readers"`
+}
+
+// ReaderRates is the traffic of a single routine. In a sample the fields are totals, in RatesStatus per second rates.
+type ReaderRates struct {
+	Reader    int     `json:"reader"`
+	RxPackets float64 `json:"rxPackets"`
+	RxBytes   float64 `json:"rxBytes"`
+	TxPackets float64 `json:"txPackets"`
+	TxBytes   float64 `json:"txBytes"`
+}
+
+func NewRatesFromConfig(l *logrus.Logger, c *config.C, routines int) *Rates {
+	r := newRates(l, metrics.DefaultRegistry, routines)
+
+	r.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		r.reload(c, false)
+	})
+
+	return r
+}
+
+func newRates(l *logrus.Logger, registry metrics.Registry, routines int) *Rates {
+	routines = max(routines, 1)
+	r := &Rates{
+		readers:  make([]readerCounters, routines),
+		registry: registry,
+		l:        l,
+	}
+	r.window.Store(int64(defaultRatesWindow))
+
+	gauge := func(name string) metrics.GaugeFloat64 {
+		return metrics.GetOrRegisterGaugeFloat64(ratesMetricPrefix+name, registry)
+	}
+	r.gauges = rateGauges{
+		rxPackets:           gauge("rx.packets"),
+		rxBytes:             gauge("rx.bytes"),
+		txPackets:           gauge("tx.packets"),
+		txBytes:             gauge("tx.bytes"),
+		handshakesInitiated: gauge("handshakes.initiated"),
+		handshakesReceived:  gauge("handshakes.received"),
+		drops:               gauge("drops"),
+	}
+	for q := range routines {
+		r.gauges.readers = append(r.gauges.readers, readerGauges{
+			rxPackets: gauge(fmt.Sprintf("reader.%d.rx.packets", q)),
+			rxBytes:   gauge(fmt.Sprintf("reader.%d.rx.bytes", q)),
+			txPackets: gauge(fmt.Sprintf("reader.%d.tx.packets", q)),
+			txBytes:   gauge(fmt.Sprintf("reader.%d.tx.bytes", q)),
+		})
+	}
+
+	return r
+}
+
+func (r *Rates) reload(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("rates") {
+		return
+	}
+
+	window := c.GetDuration("rates.window", defaultRatesWindow)
+	if window < minRatesWindow || window > maxRatesWindow {
+		r.l.WithField("window", window).
+			Warnf("rates.window must be between %v and %v, using the default", minRatesWindow, maxRatesWindow)
+		window = defaultRatesWindow
+	}
+
+	r.window.Store(int64(window))
+	if !initial {
+		r.l.WithField("window", window).Info("rates.window has changed")
+	}
+}
+
+// rx counts a packet of n bytes received from the underlay by routine q, it is safe to call on a nil Rates
+func (r *Rates) rx(q int, n int) {
+	if r == nil || q < 0 || q >= len(r.readers) {
+		return
+	}
+	r.readers[q].rxPackets.Add(1)
+	r.readers[q].rxBytes.Add(uint64(n))
+}
+
+// tx counts a packet of n bytes read from the tun device by routine q, it is safe to call on a nil Rates
+func (r *Rates) tx(q int, n int) {
+	if r == nil || q < 0 || q >= len(r.readers) {
+		return
+	}
+	r.readers[q].txPackets.Add(1)
+	r.readers[q].txBytes.Add(uint64(n))
+}
+
+// Run samples the counters every second until ctx is done
+func (r *Rates) Run(ctx context.Context) {
+	if r == nil {
+		return
+	}
+
+	ticker := time.NewTicker(ratesInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.sample(now)
+		}
+	}
+}
+
+// sample takes a sample of the counters at now and updates the rates, it must only be called by one goroutine
+func (r *Rates) sample(now time.Time) {
+	s := rateSample{
+		at:                  now,
+		readers:             make([]ReaderRates, len(r.readers)),
+		handshakesInitiated: r.count(rateHandshakesInitiated),
+	}
+	for _, name := range rateHandshakesReceived {
+		s.handshakesReceived += r.count(name)
+	}
+	for _, name := range rateDropCounters {
+		s.drops += r.count(name)
+	}
+	for q := range r.readers {
+		s.readers[q] = ReaderRates{
+			Reader:    q,
+			RxPackets: float64(r.readers[q].rxPackets.Load()),
+			RxBytes:   float64(r.readers[q].rxBytes.Load()),
+			TxPackets: float64(r.readers[q].txPackets.Load()),
+			TxBytes:   float64(r.readers[q].txBytes.Load()),
+		}
+	}
+
+	// Keep the oldest sample that is still within the window, the newest sample is always kept
+	r.samples = append(r.samples, s)
+	window := time.Duration(r.window.Load())
+	drop := 0
+	for drop < len(r.samples)-1 && now.Sub(r.samples[drop].at) > window {
+		drop++
+	}
+	r.samples = append(r.samples[:0], r.samples[drop:]...)
+
+	status := r.rates(r.samples[0], s)
+	r.status.Store(&status)
+	r.updateGauges(status)
+}
+
+// count returns the value of the counter name, 0 if it was never registered
+func (r *Rates) count(name string) int64 {
+	if c, ok := r.registry.Get(name).(metrics.Counter); ok {
+		return c.Count()
+	}
+	return 0
+}
+
+// rates returns the per second rates between the samples oldest and newest
+func (r *Rates) rates(oldest, newest rateSample) RatesStatus {
+	status := RatesStatus{Window: newest.at.Sub(oldest.at), Readers: make([]ReaderRates, len(newest.readers))}
+	secs := status.Window.Seconds()
+	rate := func(newer, older float64) float64 {
+		// A counter can go down if it was unregistered in between, that is no traffic and not a negative rate
+		if secs <= 0 || newer < older {
+			return 0
+		}
+		return (newer - older) / secs
+	}
+
+	for q, n := range newest.readers {
+		o := oldest.readers[q]
+		rr := ReaderRates{
+			Reader:    q,
+			RxPackets: rate(n.RxPackets, o.RxPackets),
+			RxBytes:   rate(n.RxBytes, o.RxBytes),
+			TxPackets: rate(n.TxPackets, o.TxPackets),
+			TxBytes:   rate(n.TxBytes, o.TxBytes),
+		}
+		status.Readers[q] = rr
+		status.RxPackets += rr.RxPackets
+		status.RxBytes += rr.RxBytes
+		status.TxPackets += rr.TxPackets
+		status.TxBytes += rr.TxBytes
+	}
+
+	status.HandshakesInitiated = rate(float64(newest.handshakesInitiated), float64(oldest.handshakesInitiated))
+	status.HandshakesReceived = rate(float64(newest.handshakesReceived), float64(oldest.handshakesReceived))
+	status.Drops = rate(float64(newest.drops), float64(oldest.drops))
+	return status
+}
+
+func (r *Rates) updateGauges(status RatesStatus) {
+	r.gauges.rxPackets.Update(status.RxPackets)
+	r.gauges.rxBytes.Update(status.RxBytes)
+	r.gauges.txPackets.Update(status.TxPackets)
+	r.gauges.txBytes.Update(status.TxBytes)
+	r.gauges.handshakesInitiated.Update(status.HandshakesInitiated)
+	r.gauges.handshakesReceived.Update(status.HandshakesReceived)
+	r.gauges.drops.Update(status.Drops)
+	for q, rr := range status.Readers {
+		g := r.gauges.readers[q]
+		g.rxPackets.Update(rr.RxPackets)
+		g.rxBytes.Update(rr.RxBytes)
+		g.txPackets.Update(rr.TxPackets)
+		g.txBytes.Update(rr.TxBytes)
+	}
+}
+
+// Status returns the rates as of the last sample, all 0 until there is one
+func (r *Rates) Status() RatesStatus {
+	if r == nil {
+		return RatesStatus{Readers: []ReaderRates{}}
+	}
+
+	if s := r.status.Load(); s != nil {
+		return *s
+	}
+
+	status := RatesStatus{Readers: make([]ReaderRates, len(r.readers))}
+	for q := range status.Readers {
+		status.Readers[q].Reader = q
+	}
+	return status
+}
@@ -0,0 +1,91 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRates(t *testing.T) {
+	l := test.NewLogger()
+	registry := metrics.NewRegistry()
+	r := newRates(l, registry, 2)
+
+	initiated := metrics.GetOrRegisterCounter(rateHandshakesInitiated, registry)
+	noRule := metrics.GetOrRegisterCounter("firewall.incoming.dropped.no_rule", registry)
+	denied := metrics.GetOrRegisterCounter("udp.denied", registry)
+
+	t.Log("Nothing is known before the first sample")
+	s := r.Status()
+	assert.Zero(t, s.Window)
+	assert.Equal(t, []ReaderRates{{Reader: 0}, {Reader: 1}}, s.Readers)
+
+	now := time.Now()
+	r.sample(now)
+	assert.Zero(t, r.Status().Window, "a single sample has no rate")
+
+	for range 10 {
+		r.rx(0, 100)
+		r.tx(1, 50)
+	}
+	r.rx(1, 1000)
+	r.rx(2, 1000)
+	r.tx(-1, 1000)
+	initiated.Inc(4)
+	noRule.Inc(3)
+	denied.Inc(1)
+
+	now = now.Add(2 * time.Second)
+	r.sample(now)
+	s = r.Status()
+	assert.Equal(t, 2*time.Second, s.Window)
+	assert.Equal(t, 5.5, s.RxPackets)
+	assert.Equal(t, 1000.0, s.RxBytes)
+	assert.Equal(t, 5.0, s.TxPackets)
+	assert.Equal(t, 250.0, s.TxBytes)
+	assert.Equal(t, 2.0, s.HandshakesInitiated)
+	assert.Zero(t, s.HandshakesReceived, "an unregistered counter counts as 0")
+	assert.Equal(t, 2.0, s.Drops)
+	assert.Equal(t, []ReaderRates{
+		{Reader: 0, RxPackets: 5, RxBytes: 500},
+		{Reader: 1, RxPackets: 0.5, RxBytes: 500, TxPackets: 5, TxBytes: 250},
+	}, s.Readers)
+
+	assert.Equal(t, 5.5, registry.Get("rates.rx.packets").(metrics.GaugeFloat64).Value())
+	assert.Equal(t, 2.0, registry.Get("rates.drops").(metrics.GaugeFloat64).Value())
+	assert.Equal(t, 250.0, registry.Get("rates.reader.1.tx.bytes").(metrics.GaugeFloat64).Value())
+
+	t.Log("Samples older than the window are forgotten")
+	for range 10 {
+		now = now.Add(time.Second)
+		r.sample(now)
+	}
+	s = r.Status()
+	assert.Equal(t, 10*time.Second, s.Window)
+	assert.Zero(t, s.RxPackets)
+	assert.Zero(t, s.Drops)
+	assert.Len(t, r.samples, 11)
+}
+
+func TestRates_reload(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	r := NewRatesFromConfig(l, c, 1)
+	assert.Equal(t, int64(defaultRatesWindow), r.window.Load())
+
+	require.NoError(t, c.ReloadConfigString("rates: {window: 30s}"))
+	assert.Equal(t, int64(30*time.Second), r.window.Load())
+
+	require.NoError(t, c.ReloadConfigString("rates: {window: 1s}"))
+	assert.Equal(t, int64(defaultRatesWindow), r.window.Load(), "an invalid window uses the default")
+
+	var nilRates *Rates
+	nilRates.rx(0, 1)
+	nilRates.tx(0, 1)
+	assert.Empty(t, nilRates.Status().Readers)
+}
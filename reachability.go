@@ -0,0 +1,84 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+var errReachabilityNotPeer = errors.New("not a peer in our network")
+
+// Reachability is the outcome of Interface.IsReachable
+type Reachability struct {
+	VpnIp     netip.Addr `json:"vpnIp"`
+	Reachable bool       `json:"reachable"`
+	// Path is direct or relay when reachable
+	Path   string         `json:"path,omitempty"`
+	Remote netip.AddrPort `json:"remote,omitempty"`
+	Relays []netip.Addr   `json:"relays,omitempty"`
+	// RTT is the round trip time of the tunnel if it has been measured by tunnel_quality or latency_probe, 0 otherwise
+	RTT time.Duration `json:"rtt,omitempty"`
+	// Handshake is true if there was no tunnel and a handshake was started to reach the peer
+	Handshake bool          `json:"handshake"`
+	Duration  time.Duration `json:"duration"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// IsReachable reports whether there is an established tunnel, direct or through a relay, with vpnIp. No traffic is
+// sent if there is one. Otherwise if timeout is more than 0 a handshake is started and IsReachable waits up to
+// timeout for the tunnel to come up, the handshake continues in the background if it takes longer.
+func (f *Interface) IsReachable(vpnIp netip.Addr, timeout time.Duration) Reachability {
+	start := time.Now()
+	res := Reachability{VpnIp: vpnIp}
+	if !f.myVpnNet.Contains(vpnIp) || vpnIp == f.myVpnNet.Addr() {
+		res.Error = errReachabilityNotPeer.Error()
+		return res
+	}
+
+	hostinfo := f.hostMap.QueryVpnIp(vpnIp)
+	if hostinfo == nil && timeout > 0 {
+		res.Handshake = true
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		var err error
+		hostinfo, err = f.handshakeManager.WaitForTunnel(ctx, vpnIp)
+		if err != nil {
+			res.Error = err.Error()
+		}
+	}
+
+	res.Duration = time.Since(start)
+	if hostinfo == nil {
+		return res
+	}
+
+	res.Reachable = true
+	if hostinfo.remote.IsValid() {
+		res.Path = "direct"
+		res.Remote = hostinfo.remote
+	} else {
+		res.Path = "relay"
+		res.Relays = hostinfo.relayState.CopyRelayIps()
+	}
+
+	res.RTT = hostinfo.rtt()
+	return res
+}
+
+// rtt returns the round trip time of the tunnel, the smoothed rtt from tunnel_quality if it measured any or else the
+// latency probe result for the current remote. It is 0 if neither measured it.
+func (i *HostInfo) rtt() time.Duration {
+	if q := i.quality.status(); q != nil && q.RTTSamples > 0 {
+		return q.SRTT
+	}
+
+	for _, c := range i.latency.copy() {
+		if c.Remote == i.remote && c.Reachable {
+			return c.RTT
+		}
+	}
+	return 0
+}
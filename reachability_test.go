@@ -0,0 +1,39 @@
+package nebula
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/sshd"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReachable_readOnly(t *testing.T) {
+	l := test.NewLogger()
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	f := &Interface{l: l, hostMap: hm, myVpnNet: netip.MustParsePrefix("10.128.0.1/24")}
+	hm.unlockedAddHostInfo(&HostInfo{
+		vpnIp:           netip.MustParseAddr("10.128.0.2"),
+		remote:          netip.MustParseAddrPort("192.168.0.2:4242"),
+		localIndexId:    10,
+		ConnectionState: &ConnectionState{},
+	}, f)
+
+	ssh, err := sshd.NewSSHServer(l.WithField("subsystem", "sshd"))
+	require.NoError(t, err)
+	attachCommands(l, config.NewC(l), ssh, f)
+
+	// reachable -timeout starts a handshake, a read-only client of the management listener may not run it
+	out := &bytes.Buffer{}
+	err = ssh.Dispatch("reachable -timeout 1s 10.128.0.3", out, false)
+	assert.ErrorIs(t, err, sshd.ErrCommandNotPermitted)
+	assert.Contains(t, out.String(), "not permitted")
+
+	out.Reset()
+	require.NoError(t, ssh.Dispatch("reachable 10.128.0.2", out, true))
+	assert.Equal(t, "10.128.0.2 is reachable directly at 192.168.0.2:4242\n", out.String())
+}
@@ -0,0 +1,65 @@
+package nebula
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/udp"
+)
+
+// parseReaderAffinity reads listen.cpu_affinity, the cpu each udp reader routine is pinned to. Routine n uses the nth
+// entry, routines past the end of the list are not pinned.
+func parseReaderAffinity(l *logrus.Logger, c *config.C, routines int) ([]int, error) {
+	raw := c.Get("listen.cpu_affinity")
+	if raw == nil {
+		return nil, nil
+	}
+
+	rs, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("listen.cpu_affinity should be a list of cpu numbers")
+	}
+
+	cpus := make([]int, len(rs))
+	for i, r := range rs {
+		cpu, err := strconv.Atoi(fmt.Sprintf("%v", r))
+		if err != nil || cpu < 0 {
+			return nil, fmt.Errorf("listen.cpu_affinity entry #%v; %v is not a cpu number", i, r)
+		}
+		cpus[i] = cpu
+	}
+
+	if len(cpus) == 0 {
+		return nil, nil
+	}
+
+	if len(cpus) < routines {
+		l.WithField("cpus", cpus).WithField("routines", routines).
+			Warn("listen.cpu_affinity has fewer entries than routines, the remaining readers are not pinned")
+	}
+
+	pinned := min(len(cpus), routines)
+	if runtime.GOMAXPROCS(0) <= pinned {
+		l.WithField("gomaxprocs", runtime.GOMAXPROCS(0)).WithField("pinned", pinned).
+			Warn("GOMAXPROCS should be larger than the number of pinned udp readers or the tun readers will be starved")
+	}
+
+	return cpus, nil
+}
+
+// pinReader pins the calling thread, which must be locked, to the cpu configured for udp reader routine q
+func pinReader(l *logrus.Logger, cpus []int, q int) {
+	if q >= len(cpus) {
+		return
+	}
+
+	if err := udp.PinThread(cpus[q]); err != nil {
+		l.WithError(err).WithField("routine", q).WithField("cpu", cpus[q]).Warn("Failed to pin udp reader to cpu")
+		return
+	}
+
+	l.WithField("routine", q).WithField("cpu", cpus[q]).Info("Pinned udp reader to cpu")
+}
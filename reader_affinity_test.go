@@ -0,0 +1,41 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReaderAffinity(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	cpus, err := parseReaderAffinity(l, c, 2)
+	require.NoError(t, err)
+	assert.Nil(t, cpus)
+
+	require.NoError(t, c.LoadString("listen:\n  cpu_affinity: [2, 4]\n"))
+	cpus, err = parseReaderAffinity(l, c, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 4}, cpus)
+
+	require.NoError(t, c.ReloadConfigString("listen:\n  cpu_affinity: []\n"))
+	cpus, err = parseReaderAffinity(l, c, 2)
+	require.NoError(t, err)
+	assert.Nil(t, cpus)
+
+	require.NoError(t, c.ReloadConfigString("listen:\n  cpu_affinity: [0, -1]\n"))
+	_, err = parseReaderAffinity(l, c, 2)
+	assert.EqualError(t, err, "listen.cpu_affinity entry #1; -1 is not a cpu number")
+
+	require.NoError(t, c.ReloadConfigString("listen:\n  cpu_affinity: [0, one]\n"))
+	_, err = parseReaderAffinity(l, c, 2)
+	assert.Error(t, err)
+
+	require.NoError(t, c.ReloadConfigString("listen:\n  cpu_affinity: 3\n"))
+	_, err = parseReaderAffinity(l, c, 2)
+	assert.Error(t, err)
+}
@@ -0,0 +1,327 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	// maxRekeyClasses is the number of classes that fit in HostInfo.rekeyClasses
+	maxRekeyClasses = 8
+
+	minRekeyMaxAge = time.Minute
+
+	// rekeyRetry is how long a tunnel waits before trying again after a rekey handshake that did not replace it
+	rekeyRetry = 10 * time.Second
+)
+
+// Rekey replaces the keys of tunnels that carry sensitive traffic more often. A class is a set of DSCP values with a
+// max_age. Once the keys of a tunnel have carried a packet of a class, in either direction, the tunnel is rehandshaked
+// when its keys are older than the class max_age. The new handshake runs alongside the old tunnel, which carries
+// traffic until the new one replaces it, so nothing is dropped. A class packet on keys that are already too old starts
+// the rekey right away, that packet and the ones sent while the handshake is in flight still use the old keys.
+//
+// Every class shares the tunnel keys. A second key epoch just for flagged traffic would need a wire format change, a
+// negotiation both peers understand, and a replay window per epoch. Since a new epoch needs a fresh DH exchange for
+// forward secrecy it would be a handshake in all but name. Rekeying the whole tunnel gives flagged traffic the same
+// guarantee for the cost of also rekeying the bulk traffic on it, a single handshake every max_age. Traffic that must
+// never share keys with other traffic needs its own tunnel, which in nebula means its own host and vpn ip with the
+// traffic steered to it by routing.
+type Rekey struct {
+	classes atomic.Pointer[rekeyClasses]
+	hostMap *HostMap
+
+	// kick carries tunnels whose keys are too old for a class packet they just carried
+	kick chan *HostInfo
+
+	metricStarted metrics.Counter
+	l             *logrus.Logger
+}
+
+type rekeyClasses struct {
+	list []rekeyClass
+	// byDSCP maps a dscp value to the index of its class plus one, 0 if the value is in no class
+	byDSCP [64]uint8
+}
+
+type rekeyClass struct {
+	name   string
+	dscp   []int
+	maxAge time.Duration
+}
+
+// RekeyClassStatus is the state of a rekey class on a single tunnel
+type RekeyClassStatus struct {
+	Class  string        `json:"class"`
+	MaxAge time.Duration `json:"maxAge"`
+	// Carried is true if the current keys of the tunnel have carried the class, the tunnel is only rekeyed for
+	// classes it carried
+	Carried bool          `json:"carried"`
+	KeyAge  time.Duration `json:"keyAge"`
+}
+
+func NewRekeyFromConfig(l *logrus.Logger, c *config.C, hm *HostMap) (*Rekey, error) {
+	r := &Rekey{
+		hostMap:       hm,
+		kick:          make(chan *HostInfo, 64),
+		metricStarted: metrics.GetOrRegisterCounter("rekey.started", nil),
+		l:             l,
+	}
+
+	if err := r.reload(c, true); err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := r.reload(c, false); err != nil {
+			l.WithError(err).Error("Failed to reload rekey, keeping the previous classes")
+		}
+	})
+
+	return r, nil
+}
+
+func (r *Rekey) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("rekey") {
+		return nil
+	}
+
+	rc, err := parseRekeyClasses(c)
+	if err != nil {
+		return err
+	}
+
+	r.classes.Store(rc)
+
+	if !initial {
+		// Class indexes may have moved, tunnels learn the classes they carry again from the next packets
+		r.hostMap.RLock()
+		for _, hostinfo := range r.hostMap.Indexes {
+			hostinfo.rekeyClasses.Store(0)
+		}
+		r.hostMap.RUnlock()
+	}
+
+	if !initial || rc != nil {
+		classes := 0
+		if rc != nil {
+			classes = len(rc.list)
+		}
+		r.l.WithField("classes", classes).Info("Rekey classes configured")
+	}
+	return nil
+}
+
+func parseRekeyClasses(c *config.C) (*rekeyClasses, error) {
+	raw := c.Get("rekey.classes")
+	if raw == nil {
+		return nil, nil
+	}
+
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, errors.New("rekey.classes must be a list")
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	if len(list) > maxRekeyClasses {
+		return nil, fmt.Errorf("rekey.classes has %d classes, at most %d are supported", len(list), maxRekeyClasses)
+	}
+
+	rc := &rekeyClasses{}
+	for i, v := range list {
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("rekey.classes.%d must be a map with dscp and max_age", i)
+		}
+
+		class := rekeyClass{name: fmt.Sprintf("%v", m["name"])}
+		if m["name"] == nil {
+			class.name = fmt.Sprintf("class%d", i)
+		}
+
+		dscp, ok := m["dscp"].([]interface{})
+		if !ok || len(dscp) == 0 {
+			return nil, fmt.Errorf("rekey.classes.%d.dscp must be a non empty list", i)
+		}
+		for _, d := range dscp {
+			value, ok := d.(int)
+			if !ok || value < 0 || value > 63 {
+				return nil, fmt.Errorf("rekey.classes.%d.dscp has %v, dscp values are 0 to 63", i, d)
+			}
+			if owner := rc.byDSCP[value]; owner != 0 {
+				return nil, fmt.Errorf("rekey.classes.%d.dscp has %v which is already in rekey.classes.%d", i, d, owner-1)
+			}
+			rc.byDSCP[value] = uint8(i + 1)
+			class.dscp = append(class.dscp, value)
+		}
+
+		maxAge, err := time.ParseDuration(fmt.Sprintf("%v", m["max_age"]))
+		if err != nil {
+			return nil, fmt.Errorf("rekey.classes.%d.max_age must be a duration: %w", i, err)
+		}
+		if maxAge < minRekeyMaxAge {
+			return nil, fmt.Errorf("rekey.classes.%d.max_age must be at least %v", i, minRekeyMaxAge)
+		}
+		class.maxAge = maxAge
+
+		rc.list = append(rc.list, class)
+	}
+
+	return rc, nil
+}
+
+// observe records the class of packet as carried by the current keys of hostinfo and kicks off a rekey if the keys are
+// already too old for it. packet must be a valid ipv4 packet.
+func (r *Rekey) observe(hostinfo *HostInfo, packet []byte) {
+	if r == nil {
+		return
+	}
+
+	rc := r.classes.Load()
+	if rc == nil {
+		return
+	}
+
+	idx := rc.byDSCP[packet[1]>>2]
+	if idx == 0 {
+		return
+	}
+
+	bit := uint32(1) << (idx - 1)
+	for {
+		seen := hostinfo.rekeyClasses.Load()
+		if seen&bit != 0 || hostinfo.rekeyClasses.CompareAndSwap(seen, seen|bit) {
+			break
+		}
+	}
+
+	if time.Since(hostinfo.ConnectionState.keyCreated) < rc.list[idx-1].maxAge {
+		return
+	}
+
+	if hostinfo.rekeyKicked.CompareAndSwap(false, true) {
+		select {
+		case r.kick <- hostinfo:
+		default:
+			// The next tick finds it
+		}
+	}
+}
+
+// Run checks every tunnel once a second, and any tunnel kicked by a class packet right away, until ctx is done
+func (r *Rekey) Run(ctx context.Context, f *Interface) {
+	clockSource := time.NewTicker(time.Second)
+	defer clockSource.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case hostinfo := <-r.kick:
+			r.check(f, hostinfo, time.Now())
+
+		case now := <-clockSource.C:
+			if r.classes.Load() == nil {
+				continue
+			}
+
+			f.hostMap.RLock()
+			hosts := make([]*HostInfo, 0, len(f.hostMap.Hosts))
+			for _, hostinfo := range f.hostMap.Hosts {
+				hosts = append(hosts, hostinfo)
+			}
+			f.hostMap.RUnlock()
+
+			for _, hostinfo := range hosts {
+				r.check(f, hostinfo, now)
+			}
+		}
+	}
+}
+
+// check starts a handshake with the peer of hostinfo if its keys are older than the max_age of a class they carried
+func (r *Rekey) check(f *Interface, hostinfo *HostInfo, now time.Time) {
+	class, age, ok := r.due(hostinfo, now)
+	if !ok {
+		return
+	}
+
+	if now.Sub(time.Unix(0, hostinfo.lastRekey.Load())) < rekeyRetry {
+		return
+	}
+
+	// A handshake that is already running replaces the keys just the same
+	if f.handshakeManager.queryVpnIp(hostinfo.vpnIp) != nil {
+		return
+	}
+
+	hostinfo.lastRekey.Store(now.UnixNano())
+	hostinfo.logger(r.l).WithField("class", class.name).
+		WithField("keyAge", age).
+		WithField("maxAge", class.maxAge).
+		Info("Rekeying tunnel for a traffic class")
+
+	r.metricStarted.Inc(1)
+	f.handshakeManager.StartHandshake(hostinfo.vpnIp, nil)
+}
+
+// due returns the first class carried by the keys of hostinfo that they are too old for
+func (r *Rekey) due(hostinfo *HostInfo, now time.Time) (rekeyClass, time.Duration, bool) {
+	rc := r.classes.Load()
+	seen := hostinfo.rekeyClasses.Load()
+	if rc == nil || seen == 0 || hostinfo.ConnectionState == nil || hostinfo.ConnectionState.keyCreated.IsZero() {
+		return rekeyClass{}, 0, false
+	}
+
+	age := now.Sub(hostinfo.ConnectionState.keyCreated)
+	for i, class := range rc.list {
+		if seen&(1<<i) != 0 && age >= class.maxAge {
+			return class, age, true
+		}
+	}
+	return rekeyClass{}, 0, false
+}
+
+// GetClasses returns the state of each rekey class on hostinfo, nil if no classes are configured. It is safe to call on
+// a nil Rekey.
+func (r *Rekey) GetClasses(hostinfo *HostInfo) []RekeyClassStatus {
+	if r == nil {
+		return nil
+	}
+
+	rc := r.classes.Load()
+	if rc == nil {
+		return nil
+	}
+
+	age := hostinfo.keyAge(time.Now())
+	seen := hostinfo.rekeyClasses.Load()
+	out := make([]RekeyClassStatus, len(rc.list))
+	for i, class := range rc.list {
+		out[i] = RekeyClassStatus{
+			Class:   class.name,
+			MaxAge:  class.maxAge,
+			Carried: seen&(1<<i) != 0,
+			KeyAge:  age,
+		}
+	}
+	return out
+}
+
+// keyAge returns how long ago the keys of hostinfo were made, 0 if it has none
+func (h *HostInfo) keyAge(now time.Time) time.Duration {
+	if h.ConnectionState == nil || h.ConnectionState.keyCreated.IsZero() {
+		return 0
+	}
+	return now.Sub(h.ConnectionState.keyCreated)
+}
@@ -0,0 +1,126 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rekeyTestPacket returns the start of an ipv4 header with dscp set
+func rekeyTestPacket(dscp byte) []byte {
+	return []byte{0x45, dscp << 2}
+}
+
+func TestRekey(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["rekey"] = map[interface{}]interface{}{
+		"classes": []interface{}{
+			map[interface{}]interface{}{"name": "voice", "dscp": []interface{}{46}, "max_age": "5m"},
+			map[interface{}]interface{}{"dscp": []interface{}{10, 12}, "max_age": "1h"},
+		},
+	}
+	hm := newHostMap(l, netip.MustParsePrefix("172.1.1.1/24"))
+	r, err := NewRekeyFromConfig(l, c, hm)
+	require.NoError(t, err)
+	r.metricStarted = metrics.NewCounter()
+
+	hsm := NewHandshakeManager(l, hm, newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+	f := &Interface{hostMap: hm, handshakeManager: hsm, rekey: r, pki: &PKI{}, l: l}
+	f.pki.cs.Store(&CertState{Certificate: &cert.NebulaCertificate{}})
+	hsm.f = f
+
+	now := time.Now()
+	vpnIp := netip.MustParseAddr("172.1.1.2")
+	hostinfo := &HostInfo{vpnIp: vpnIp, localIndexId: 1, ConnectionState: &ConnectionState{keyCreated: now}}
+	hm.unlockedAddHostInfo(hostinfo, f)
+
+	t.Log("Traffic outside every class is not tracked")
+	r.observe(hostinfo, rekeyTestPacket(0))
+	assert.Zero(t, hostinfo.rekeyClasses.Load())
+
+	t.Log("Each class carried is recorded")
+	r.observe(hostinfo, rekeyTestPacket(12))
+	assert.Equal(t, uint32(0b10), hostinfo.rekeyClasses.Load())
+	assert.Equal(t, []RekeyClassStatus{
+		{Class: "voice", MaxAge: 5 * time.Minute},
+		{Class: "class1", MaxAge: time.Hour, Carried: true},
+	}, zeroKeyAge(r.GetClasses(hostinfo)))
+
+	t.Log("Keys are only replaced once they are too old for a class they carried")
+	r.check(f, hostinfo, now.Add(10*time.Minute))
+	assert.Nil(t, hsm.QueryVpnIp(vpnIp))
+
+	r.observe(hostinfo, rekeyTestPacket(46))
+	assert.Empty(t, r.kick, "the keys are still young enough")
+	r.check(f, hostinfo, now.Add(4*time.Minute))
+	assert.Nil(t, hsm.QueryVpnIp(vpnIp))
+
+	r.check(f, hostinfo, now.Add(5*time.Minute))
+	assert.NotNil(t, hsm.QueryVpnIp(vpnIp))
+	assert.Equal(t, int64(1), r.metricStarted.Count())
+
+	t.Log("A rekey that is in flight or just failed is not started again")
+	r.check(f, hostinfo, now.Add(5*time.Minute+time.Second))
+	hsm.DeleteHostInfo(hsm.QueryVpnIp(vpnIp))
+	r.check(f, hostinfo, now.Add(5*time.Minute+2*time.Second))
+	assert.Equal(t, int64(1), r.metricStarted.Count())
+	r.check(f, hostinfo, now.Add(5*time.Minute+rekeyRetry))
+	assert.Equal(t, int64(2), r.metricStarted.Count())
+
+	t.Log("A class packet on keys that are too old kicks the rekey once")
+	old := &HostInfo{vpnIp: netip.MustParseAddr("172.1.1.3"), ConnectionState: &ConnectionState{keyCreated: now.Add(-time.Hour)}}
+	r.observe(old, rekeyTestPacket(46))
+	r.observe(old, rekeyTestPacket(46))
+	require.Len(t, r.kick, 1)
+	assert.Same(t, old, <-r.kick)
+
+	t.Log("Reloading forgets the classes carried")
+	require.NoError(t, c.ReloadConfigString("rekey:\n  classes: []\n"))
+	assert.Zero(t, hostinfo.rekeyClasses.Load())
+	assert.Nil(t, r.GetClasses(hostinfo))
+	r.observe(hostinfo, rekeyTestPacket(46))
+
+	var nilRekey *Rekey
+	nilRekey.observe(hostinfo, rekeyTestPacket(46))
+	assert.Nil(t, nilRekey.GetClasses(hostinfo))
+}
+
+func zeroKeyAge(classes []RekeyClassStatus) []RekeyClassStatus {
+	for i := range classes {
+		classes[i].KeyAge = 0
+	}
+	return classes
+}
+
+func TestParseRekeyClasses(t *testing.T) {
+	l := test.NewLogger()
+	for _, tc := range []struct {
+		classes interface{}
+		err     string
+	}{
+		{"nope", "rekey.classes must be a list"},
+		{[]interface{}{"nope"}, "rekey.classes.0 must be a map with dscp and max_age"},
+		{[]interface{}{map[interface{}]interface{}{"max_age": "1h"}}, "rekey.classes.0.dscp must be a non empty list"},
+		{[]interface{}{map[interface{}]interface{}{"dscp": []interface{}{64}, "max_age": "1h"}}, "rekey.classes.0.dscp has 64, dscp values are 0 to 63"},
+		{[]interface{}{
+			map[interface{}]interface{}{"dscp": []interface{}{46}, "max_age": "1h"},
+			map[interface{}]interface{}{"dscp": []interface{}{46}, "max_age": "1h"},
+		}, "rekey.classes.1.dscp has 46 which is already in rekey.classes.0"},
+		{[]interface{}{map[interface{}]interface{}{"dscp": []interface{}{46}}}, `rekey.classes.0.max_age must be a duration: time: invalid duration "<nil>"`},
+		{[]interface{}{map[interface{}]interface{}{"dscp": []interface{}{46}, "max_age": "10s"}}, "rekey.classes.0.max_age must be at least 1m0s"},
+	} {
+		c := config.NewC(l)
+		c.Settings["rekey"] = map[interface{}]interface{}{"classes": tc.classes}
+		_, err := parseRekeyClasses(c)
+		assert.EqualError(t, err, tc.err)
+	}
+}
@@ -0,0 +1,184 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+)
+
+// Relay control messages are checked against the relay state machine, see relay_lifecycle.go, before they are handled.
+// A message that is malformed or does not fit the state of the relay it names, a buggy peer or a message that arrived
+// after the relay moved on, is dropped and counted in relay.control.rejected.<reason>. Every message received is
+// counted in relay.control.received.<type>.
+//
+// With relay.control_reject_action teardown, the default, a CreateRelayResponse for a relay we do not have, or for a
+// relay we have under another index, is answered with a RelayTeardown so the peer removes its half instead of keeping a
+// relay only it thinks is up. With drop nothing is sent back.
+
+// The reasons a relay control message is rejected
+const (
+	relayControlUnknownType  = "unknown_type"
+	relayControlMissingIndex = "missing_index"
+	relayControlBadIp        = "bad_ip"
+	relayControlFromMismatch = "from_mismatch"
+	relayControlUnknownRelay = "unknown_relay"
+	relayControlOutOfState   = "out_of_state"
+)
+
+var relayControlRejectReasons = []string{relayControlUnknownType, relayControlMissingIndex, relayControlBadIp,
+	relayControlFromMismatch, relayControlUnknownRelay, relayControlOutOfState}
+
+type relayControlMetrics struct {
+	received        map[NebulaControl_MessageType]metrics.Counter
+	receivedUnknown metrics.Counter
+	rejected        map[string]metrics.Counter
+}
+
+func newRelayControlMetrics() relayControlMetrics {
+	m := relayControlMetrics{
+		received:        map[NebulaControl_MessageType]metrics.Counter{},
+		receivedUnknown: metrics.GetOrRegisterCounter("relay.control.received.unknown", nil),
+		rejected:        map[string]metrics.Counter{},
+	}
+	for v := range NebulaControl_MessageType_name {
+		t := NebulaControl_MessageType(v)
+		m.received[t] = metrics.GetOrRegisterCounter("relay.control.received."+relayControlTypeName(t), nil)
+	}
+	for _, reason := range relayControlRejectReasons {
+		m.rejected[reason] = metrics.GetOrRegisterCounter("relay.control.rejected."+reason, nil)
+	}
+	return m
+}
+
+func (m relayControlMetrics) receivedFor(t NebulaControl_MessageType) metrics.Counter {
+	if c, ok := m.received[t]; ok {
+		return c
+	}
+	return m.receivedUnknown
+}
+
+// relayControlTypeName is the metric name of t, CreateRelayRequest is create_relay_request
+func relayControlTypeName(t NebulaControl_MessageType) string {
+	name := NebulaControl_MessageType_name[int32(t)]
+	var b strings.Builder
+	for i, r := range name {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (rm *relayManager) reloadControl(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("relay.control_reject_action") {
+		return nil
+	}
+
+	switch action := c.GetString("relay.control_reject_action", "teardown"); action {
+	case "teardown":
+		rm.controlRejectTeardown.Store(true)
+	case "drop":
+		rm.controlRejectTeardown.Store(false)
+	default:
+		return fmt.Errorf("relay.control_reject_action must be teardown or drop, got %q", action)
+	}
+	return nil
+}
+
+// validateControl returns why m from h does not fit the relay state machine, empty if it does
+func (rm *relayManager) validateControl(h *HostInfo, m *NebulaControl, myVpnIp netip.Addr) string {
+	switch m.Type {
+	case NebulaControl_CreateRelayRequest:
+		if m.InitiatorRelayIndex == 0 {
+			return relayControlMissingIndex
+		}
+		from, to := vpnIpFromUint32(m.RelayFromIp), vpnIpFromUint32(m.RelayToIp)
+		if m.RelayFromIp == 0 || m.RelayToIp == 0 || from == to {
+			return relayControlBadIp
+		}
+		if to != myVpnIp && from != h.vpnIp {
+			// Only the initiator of a relay can ask us to forward it
+			return relayControlFromMismatch
+		}
+
+	case NebulaControl_CreateRelayResponse:
+		if m.InitiatorRelayIndex == 0 || m.ResponderRelayIndex == 0 {
+			return relayControlMissingIndex
+		}
+		r, ok := h.relayState.QueryRelayForByIdx(m.InitiatorRelayIndex)
+		if !ok {
+			return relayControlUnknownRelay
+		}
+		if r.State == Disestablished || (r.State == Established && r.RemoteIndex != m.ResponderRelayIndex) {
+			// A late answer for a relay we are tearing down, or an answer for a relay already up with someone else
+			return relayControlOutOfState
+		}
+
+	case NebulaControl_RelayDraining:
+
+	case NebulaControl_RelayMigrated:
+		if m.RelayToIp == 0 {
+			return relayControlBadIp
+		}
+		if rm.drain.Load() == nil {
+			// Only a draining relay asks for migrations
+			return relayControlOutOfState
+		}
+
+	case NebulaControl_RelayTeardown:
+		if m.InitiatorRelayIndex == 0 && m.ResponderRelayIndex == 0 {
+			return relayControlMissingIndex
+		}
+
+	case NebulaControl_RelayTeardownAck:
+		if m.InitiatorRelayIndex == 0 {
+			return relayControlMissingIndex
+		}
+		r, ok := h.relayState.QueryRelayForByIdx(m.InitiatorRelayIndex)
+		if !ok || r.State != Disestablished {
+			// We are not tearing it down, a duplicate ack or one for a relay we gave up on
+			return relayControlOutOfState
+		}
+
+	default:
+		return relayControlUnknownType
+	}
+
+	return ""
+}
+
+// rejectControl counts and logs the rejected m from h and answers it with a RelayTeardown if that is corrective
+func (rm *relayManager) rejectControl(h *HostInfo, f *Interface, m *NebulaControl, reason string) {
+	rm.controlMetrics.rejected[reason].Inc(1)
+	h.logger(rm.l).WithField("type", m.Type).WithField("reason", reason).
+		WithField("initiatorRelayIndex", m.InitiatorRelayIndex).
+		WithField("responderRelayIndex", m.ResponderRelayIndex).
+		Info("Rejected relay control message")
+
+	if m.Type != NebulaControl_CreateRelayResponse || !rm.controlRejectTeardown.Load() ||
+		(reason != relayControlUnknownRelay && reason != relayControlOutOfState) {
+		return
+	}
+
+	// A relay we are tearing down already has its teardown on the way
+	if r, ok := h.relayState.QueryRelayForByIdx(m.InitiatorRelayIndex); !ok || r.State != Disestablished {
+		// The other end thinks the relay is up under its index, have it remove its half
+		rm.teardownUnknown(f, h, m.InitiatorRelayIndex, m.ResponderRelayIndex)
+	}
+}
+
+// vpnIpFromUint32 is the vpn ip a relay control message carries as v
+func vpnIpFromUint32(v uint32) netip.Addr {
+	//TODO: IPV6-WORK
+	b := [4]byte{}
+	binary.BigEndian.PutUint32(b[:], v)
+	return netip.AddrFrom4(b)
+}
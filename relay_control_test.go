@@ -0,0 +1,232 @@
+package nebula
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRelayControlTest(t *testing.T, conf string) (*relayManager, *Interface, *config.C, *controlConn, func(netip.Addr, uint32) *HostInfo) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(conf))
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	rm := NewRelayManager(context.Background(), l, hm, c)
+
+	conn := &controlConn{sent: map[netip.AddrPort][][]byte{}}
+	f := &Interface{
+		l:                 l,
+		hostMap:           hm,
+		relayManager:      rm,
+		myVpnNet:          hm.vpnCIDR,
+		sendBackoff:       NewSendBackoffFromConfig(l, c),
+		writers:           []udp.Conn{conn},
+		connectionManager: &connectionManager{out: map[uint32]struct{}{}, outLock: &sync.RWMutex{}},
+	}
+
+	cs := &NebulaCipherState{c: noise.CipherChaChaPoly.Cipher([32]byte{1})}
+	newPeer := func(vpnIp netip.Addr, idx uint32) *HostInfo {
+		h := &HostInfo{
+			vpnIp:           vpnIp,
+			localIndexId:    idx,
+			remote:          netip.AddrPortFrom(vpnIp, 4242),
+			ConnectionState: &ConnectionState{eKey: cs, dKey: cs},
+			relayState: RelayState{
+				relays:        map[netip.Addr]struct{}{},
+				relayForByIp:  map[netip.Addr]*Relay{},
+				relayForByIdx: map[uint32]*Relay{},
+			},
+		}
+		hm.unlockedAddHostInfo(h, f)
+		return h
+	}
+	return rm, f, c, conn, newPeer
+}
+
+func TestRelayManager_rejectControl(t *testing.T) {
+	rm, f, c, conn, newPeer := newRelayControlTest(t, "relay: {}")
+	assert.True(t, rm.controlRejectTeardown.Load())
+	a := newPeer(netip.MustParseAddr("10.128.0.2"), 1)
+	b := newPeer(netip.MustParseAddr("10.128.0.3"), 2)
+	me := vpnIpUint32(f.myVpnNet.Addr())
+
+	// sentTypes returns the types of the control messages sent to h since the last call
+	sentTypes := func(h *HostInfo) []NebulaControl_MessageType {
+		var types []NebulaControl_MessageType
+		for _, p := range conn.sent[h.remote] {
+			hdr := &header.H{}
+			require.NoError(t, hdr.Parse(p))
+			out, err := h.ConnectionState.dKey.DecryptDanger(nil, p[:header.Len], p[header.Len:], hdr.MessageCounter, make([]byte, 12))
+			require.NoError(t, err)
+			m := &NebulaControl{}
+			require.NoError(t, m.Unmarshal(out))
+			types = append(types, m.Type)
+		}
+		delete(conn.sent, h.remote)
+		return types
+	}
+	rejected := func(reason string) int64 {
+		return rm.controlMetrics.rejected[reason].Count()
+	}
+
+	tests := []struct {
+		name   string
+		m      *NebulaControl
+		reason string
+	}{
+		{"no type", &NebulaControl{InitiatorRelayIndex: 1}, relayControlUnknownType},
+		{"unknown type", &NebulaControl{Type: 42, InitiatorRelayIndex: 1}, relayControlUnknownType},
+		{"request without an index", &NebulaControl{Type: NebulaControl_CreateRelayRequest, RelayFromIp: vpnIpUint32(a.vpnIp), RelayToIp: me}, relayControlMissingIndex},
+		{"request without a target", &NebulaControl{Type: NebulaControl_CreateRelayRequest, InitiatorRelayIndex: 1, RelayFromIp: vpnIpUint32(a.vpnIp)}, relayControlBadIp},
+		{"request to itself", &NebulaControl{Type: NebulaControl_CreateRelayRequest, InitiatorRelayIndex: 1, RelayFromIp: me, RelayToIp: me}, relayControlBadIp},
+		{"forward for someone else", &NebulaControl{Type: NebulaControl_CreateRelayRequest, InitiatorRelayIndex: 1, RelayFromIp: vpnIpUint32(b.vpnIp), RelayToIp: vpnIpUint32(netip.MustParseAddr("10.128.0.4"))}, relayControlFromMismatch},
+		{"response without an index", &NebulaControl{Type: NebulaControl_CreateRelayResponse, InitiatorRelayIndex: 1}, relayControlMissingIndex},
+		{"migrated while not draining", &NebulaControl{Type: NebulaControl_RelayMigrated, RelayToIp: vpnIpUint32(b.vpnIp)}, relayControlOutOfState},
+		{"teardown without an index", &NebulaControl{Type: NebulaControl_RelayTeardown}, relayControlMissingIndex},
+		{"ack for a relay we do not have", &NebulaControl{Type: NebulaControl_RelayTeardownAck, InitiatorRelayIndex: 12345}, relayControlOutOfState},
+	}
+	for _, tt := range tests {
+		before := rejected(tt.reason)
+		rm.HandleControlMsg(a, tt.m, f)
+		assert.Equal(t, before+1, rejected(tt.reason), tt.name)
+		assert.Empty(t, sentTypes(a), tt.name)
+	}
+
+	t.Log("A response for a relay we do not have is answered with a teardown")
+	received := rm.controlMetrics.received[NebulaControl_CreateRelayResponse].Count()
+	unknown := rejected(relayControlUnknownRelay)
+	resp := &NebulaControl{Type: NebulaControl_CreateRelayResponse, InitiatorRelayIndex: 12345, ResponderRelayIndex: 77,
+		RelayFromIp: me, RelayToIp: vpnIpUint32(b.vpnIp)}
+	rm.HandleControlMsg(a, resp, f)
+	assert.Equal(t, received+1, rm.controlMetrics.received[NebulaControl_CreateRelayResponse].Count())
+	assert.Equal(t, unknown+1, rejected(relayControlUnknownRelay))
+	assert.Equal(t, []NebulaControl_MessageType{NebulaControl_RelayTeardown}, sentTypes(a))
+
+	t.Log("As is a response for a relay that is up under another index")
+	idx, err := AddRelay(rm.l, a, f.hostMap, b.vpnIp, nil, TerminalType, Requested)
+	require.NoError(t, err)
+	resp = &NebulaControl{Type: NebulaControl_CreateRelayResponse, InitiatorRelayIndex: idx, ResponderRelayIndex: 77,
+		RelayFromIp: me, RelayToIp: vpnIpUint32(b.vpnIp)}
+	rm.HandleControlMsg(a, resp, f)
+	r, ok := a.relayState.QueryRelayForByIdx(idx)
+	require.True(t, ok)
+	assert.Equal(t, Established, r.State)
+	rm.HandleControlMsg(a, resp, f)
+	assert.Empty(t, sentTypes(a), "a repeated response is fine")
+
+	outOfState := rejected(relayControlOutOfState)
+	rm.HandleControlMsg(a, &NebulaControl{Type: NebulaControl_CreateRelayResponse, InitiatorRelayIndex: idx, ResponderRelayIndex: 78}, f)
+	assert.Equal(t, outOfState+1, rejected(relayControlOutOfState))
+	assert.Equal(t, []NebulaControl_MessageType{NebulaControl_RelayTeardown}, sentTypes(a))
+	r, _ = a.relayState.QueryRelayForByIdx(idx)
+	assert.Equal(t, uint32(77), r.RemoteIndex, "our relay is left alone")
+
+	t.Log("A late response for a relay we are tearing down is dropped, its teardown is already on the way")
+	rm.teardownRelay(f, a, r)
+	sentTypes(a)
+	rm.HandleControlMsg(a, resp, f)
+	assert.Equal(t, outOfState+2, rejected(relayControlOutOfState))
+	assert.Empty(t, sentTypes(a))
+
+	t.Log("drop never answers")
+	require.NoError(t, c.ReloadConfigString("relay: {control_reject_action: drop}"))
+	assert.False(t, rm.controlRejectTeardown.Load())
+	resp = &NebulaControl{Type: NebulaControl_CreateRelayResponse, InitiatorRelayIndex: 12345, ResponderRelayIndex: 77}
+	rm.HandleControlMsg(a, resp, f)
+	assert.Equal(t, unknown+2, rejected(relayControlUnknownRelay))
+	assert.Empty(t, sentTypes(a))
+
+	t.Log("An invalid action keeps the previous one")
+	require.NoError(t, c.ReloadConfigString("relay: {control_reject_action: nope}"))
+	assert.False(t, rm.controlRejectTeardown.Load())
+}
+
+func TestRelayManager_fuzzControl(t *testing.T) {
+	rm, f, _, _, newPeer := newRelayControlTest(t, "relay: {am_relay: false}")
+	peers := []*HostInfo{
+		newPeer(netip.MustParseAddr("10.128.0.2"), 1),
+		newPeer(netip.MustParseAddr("10.128.0.3"), 2),
+		newPeer(netip.MustParseAddr("10.128.0.4"), 3),
+	}
+	for _, p := range peers[1:] {
+		remote := uint32(500) + p.localIndexId
+		_, err := AddRelay(rm.l, peers[0], f.hostMap, p.vpnIp, &remote, TerminalType, Established)
+		require.NoError(t, err)
+	}
+
+	seed := rand.Uint64()
+	t.Logf("seed %v", seed)
+	rng := rand.New(rand.NewPCG(seed, seed))
+
+	index := func() uint32 {
+		switch rng.IntN(4) {
+		case 0:
+			return 0
+		case 1:
+			idxs := peers[0].relayState.CopyRelayForIdxs()
+			if len(idxs) > 0 {
+				return idxs[rng.IntN(len(idxs))]
+			}
+		case 2:
+			return 500 + uint32(rng.IntN(5))
+		}
+		return rng.Uint32()
+	}
+	ip := func() uint32 {
+		switch rng.IntN(4) {
+		case 0:
+			return 0
+		case 1:
+			return vpnIpUint32(f.myVpnNet.Addr())
+		case 2:
+			return vpnIpUint32(peers[rng.IntN(len(peers))].vpnIp)
+		}
+		return rng.Uint32()
+	}
+
+	for i := 0; i < 2000; i++ {
+		h := peers[rng.IntN(len(peers))]
+		var m *NebulaControl
+		if rng.IntN(4) == 0 {
+			// Arbitrary bytes, whatever unmarshals is handled
+			b := make([]byte, rng.IntN(32))
+			for j := range b {
+				b[j] = byte(rng.Uint32())
+			}
+			m = &NebulaControl{}
+			if m.Unmarshal(b) != nil {
+				continue
+			}
+		} else {
+			m = &NebulaControl{
+				Type:                NebulaControl_MessageType(rng.IntN(9) - 1),
+				InitiatorRelayIndex: index(),
+				ResponderRelayIndex: index(),
+				RelayFromIp:         ip(),
+				RelayToIp:           ip(),
+			}
+		}
+		rm.HandleControlMsg(h, m, f)
+
+		// Every relay a peer has is in the hostmap under its index, and found by its ip
+		for _, p := range peers {
+			for _, r := range p.relayState.CopyAllRelayFor() {
+				_, ok := f.hostMap.Relays[r.LocalIndex]
+				require.True(t, ok, "seed %v, relay %v of %v is missing from the hostmap", seed, r.LocalIndex, p.vpnIp)
+				byIp, ok := p.relayState.QueryRelayForByIp(r.PeerIp)
+				require.True(t, ok, "seed %v", seed)
+				require.Equal(t, r.LocalIndex, byIp.LocalIndex, "seed %v", seed)
+			}
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package nebula
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/header"
+)
+
+const (
+	DefaultRelayDrainGrace = time.Minute
+	// relayDrainNotifyInterval is how often peers that still forward through a draining relay are reminded of it
+	relayDrainNotifyInterval = 5 * time.Second
+)
+
+var errRelayDrainNotARelay = errors.New("this host is not a relay, see relay.am_relay")
+
+// relayDrain tracks this relay being taken out of service. New forwards are refused and every peer we forward for is
+// told to move its relayed tunnels to another relay. A forward is migrated once its peer tells us it reaches the
+// target some other way, once both directions of a forward are migrated it is removed. When the grace period is over
+// whatever is left is removed and we stop forwarding. A drain lasts until nebula is restarted.
+type relayDrain struct {
+	started  time.Time
+	deadline time.Time
+
+	sync.Mutex
+	// forwards holds the forwards we had when the drain started, true once migrated
+	forwards map[relayDrainKey]bool
+	stopped  bool
+}
+
+// relayDrainKey is a forward from peer to target, which is kept on the HostInfo of peer
+type relayDrainKey struct {
+	peer   netip.Addr
+	target netip.Addr
+}
+
+// RelayDrainStatus is the progress of draining this relay
+type RelayDrainStatus struct {
+	Draining  bool      `json:"draining"`
+	Started   time.Time `json:"started,omitempty"`
+	Deadline  time.Time `json:"deadline,omitempty"`
+	Forwards  int       `json:"forwards"`
+	Migrated  int       `json:"migrated"`
+	Remaining int       `json:"remaining"`
+	// Stopped is set once the grace period is over and we no longer forward
+	Stopped bool `json:"stopped"`
+}
+
+// startDrain begins draining this relay, giving peers grace to move their tunnels before forwarding stops. Starting a
+// drain that is already running returns its status.
+func (rm *relayManager) startDrain(f *Interface, grace time.Duration) (RelayDrainStatus, error) {
+	if !rm.GetAmRelay() {
+		return RelayDrainStatus{}, errRelayDrainNotARelay
+	}
+
+	if grace <= 0 {
+		grace = DefaultRelayDrainGrace
+	}
+
+	now := time.Now()
+	d := &relayDrain{started: now, deadline: now.Add(grace), forwards: map[relayDrainKey]bool{}}
+	for _, k := range rm.copyForwards() {
+		d.forwards[k] = false
+	}
+
+	if !rm.drain.CompareAndSwap(nil, d) {
+		return rm.DrainStatus(), nil
+	}
+
+	rm.l.WithField("forwards", len(d.forwards)).WithField("grace", grace).
+		Warn("Draining relay, new forwards are refused and peers are asked to move to another relay")
+
+	rm.notifyDrain(f, d)
+	go rm.runDrain(rm.ctx, f, d)
+
+	return rm.DrainStatus(), nil
+}
+
+// runDrain reminds peers of the drain until the grace period is over then stops forwarding
+func (rm *relayManager) runDrain(ctx context.Context, f *Interface, d *relayDrain) {
+	clockSource := time.NewTicker(relayDrainNotifyInterval)
+	defer clockSource.Stop()
+
+	deadline := time.NewTimer(time.Until(d.deadline))
+	defer deadline.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-clockSource.C:
+			rm.notifyDrain(f, d)
+
+		case <-deadline.C:
+			rm.stopForwarding(d)
+			return
+		}
+	}
+}
+
+// copyForwards returns every forward we hold
+func (rm *relayManager) copyForwards() []relayDrainKey {
+	rm.hostmap.RLock()
+	defer rm.hostmap.RUnlock()
+
+	var out []relayDrainKey
+	for idx, hostinfo := range rm.hostmap.Relays {
+		if r, ok := hostinfo.relayState.QueryRelayForByIdx(idx); ok && r.Type == ForwardingType {
+			out = append(out, relayDrainKey{peer: hostinfo.vpnIp, target: r.PeerIp})
+		}
+	}
+	return out
+}
+
+// notifyDrain sends a RelayDraining message to every peer with a forward that was not migrated yet
+func (rm *relayManager) notifyDrain(f *Interface, d *relayDrain) {
+	peers := map[netip.Addr]struct{}{}
+	d.Lock()
+	for k, migrated := range d.forwards {
+		if !migrated {
+			peers[k.peer] = struct{}{}
+		}
+	}
+	d.Unlock()
+
+	msg, err := (&NebulaControl{Type: NebulaControl_RelayDraining}).Marshal()
+	if err != nil {
+		rm.l.WithError(err).Error("relayManager Failed to marshal Control RelayDraining message")
+		return
+	}
+
+	for vpnIp := range peers {
+		if hostinfo := rm.hostmap.QueryVpnIp(vpnIp); hostinfo != nil {
+			f.SendMessageToHostInfo(header.Control, 0, hostinfo, msg, make([]byte, 12), make([]byte, mtu))
+		}
+	}
+}
+
+// stopForwarding removes every forward left when the grace period is over
+func (rm *relayManager) stopForwarding(d *relayDrain) {
+	d.Lock()
+	d.stopped = true
+	remaining := 0
+	for _, migrated := range d.forwards {
+		if !migrated {
+			remaining++
+		}
+	}
+	d.Unlock()
+
+	removed := 0
+	for _, k := range rm.copyForwards() {
+		if rm.removeForward(k) {
+			removed++
+		}
+	}
+
+	rm.l.WithField("notMigrated", remaining).WithField("removed", removed).
+		Warn("Relay drain grace period is over, stopped forwarding")
+}
+
+// removeForward removes the forward from k.peer to k.target, returns false if there was none
+func (rm *relayManager) removeForward(k relayDrainKey) bool {
+	hostinfo := rm.hostmap.QueryVpnIp(k.peer)
+	if hostinfo == nil {
+		return false
+	}
+
+	r, ok := hostinfo.relayState.QueryRelayForByIp(k.target)
+	if !ok || r.Type != ForwardingType {
+		return false
+	}
+
+	hostinfo.relayState.RemoveRelay(r.LocalIndex)
+	rm.hostmap.RemoveRelay(r.LocalIndex)
+	return true
+}
+
+// handleRelayMigrated records that h no longer reaches the target of the message through us
+func (rm *relayManager) handleRelayMigrated(h *HostInfo, m *NebulaControl) {
+	d := rm.drain.Load()
+	if d == nil {
+		return
+	}
+
+	//TODO: IPV6-WORK
+	b := [4]byte{}
+	binary.BigEndian.PutUint32(b[:], m.RelayToIp)
+	k := relayDrainKey{peer: h.vpnIp, target: netip.AddrFrom4(b)}
+	reverse := relayDrainKey{peer: k.target, target: k.peer}
+
+	d.Lock()
+	migrated, ok := d.forwards[k]
+	if !ok || migrated {
+		d.Unlock()
+		return
+	}
+	d.forwards[k] = true
+	// The target still sends to the peer through us until it migrated as well, forwarding in either direction needs
+	// both halves
+	both := d.forwards[reverse]
+	d.Unlock()
+
+	rm.metricDrainMigrated.Inc(1)
+	h.logger(rm.l).WithField("relayTo", k.target).Info("Forward migrated off this draining relay")
+
+	if both {
+		rm.removeForward(k)
+		rm.removeForward(reverse)
+	}
+}
+
+// DrainStatus returns the progress of draining this relay
+func (rm *relayManager) DrainStatus() RelayDrainStatus {
+	d := rm.drain.Load()
+	if d == nil {
+		return RelayDrainStatus{}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	s := RelayDrainStatus{
+		Draining: true,
+		Started:  d.started,
+		Deadline: d.deadline,
+		Forwards: len(d.forwards),
+		Stopped:  d.stopped,
+	}
+	for _, migrated := range d.forwards {
+		if migrated {
+			s.Migrated++
+		}
+	}
+	s.Remaining = s.Forwards - s.Migrated
+	return s
+}
+
+// handleRelayDraining moves every tunnel we relay through h to another relay, h told us it is draining
+func (rm *relayManager) handleRelayDraining(h *HostInfo, f *Interface) {
+	if !h.relayDraining.Swap(true) {
+		h.logger(rm.l).Info("Relay is draining, moving relayed tunnels to another relay")
+	}
+
+	for _, r := range h.relayState.CopyAllRelayFor() {
+		if r.Type == TerminalType {
+			rm.migrateRelayed(f, h, r.PeerIp)
+		}
+	}
+}
+
+// migrateRelayed asks another relay for a path to target, the tunnel moves over in finishMigration once that relay
+// is established. Candidates are the relays the lighthouse told us about for target.
+func (rm *relayManager) migrateRelayed(f *Interface, draining *HostInfo, target netip.Addr) {
+	hostinfo := rm.hostmap.QueryVpnIp(target)
+	if hostinfo == nil || hostinfo.remote.IsValid() {
+		// We do not need the draining relay to reach target
+		rm.sendRelayMigrated(f, draining, target)
+		return
+	}
+
+	if hostinfo.remotes != nil {
+		// Pick up any relays the lighthouse told us about since the tunnel was made
+		hostinfo.remotes.Rebuild(rm.hostmap.PreferredRangesFor(hostinfo))
+	}
+
+	for _, relayIp := range relayShareCandidates(hostinfo) {
+		if relayIp == draining.vpnIp || relayIp == target || relayIp == f.myVpnNet.Addr() {
+			continue
+		}
+
+		relayHostInfo := rm.hostmap.QueryVpnIp(relayIp)
+		if relayHostInfo == nil || !relayHostInfo.remote.IsValid() {
+			// We can only use relays we have a direct tunnel to, the next reminder from the draining relay retries
+			f.Handshake(relayIp)
+			continue
+		}
+
+		if relayHostInfo.relayDraining.Load() {
+			continue
+		}
+
+		existing, ok := relayHostInfo.relayState.QueryRelayForByIp(target)
+		if ok && existing.State == Established {
+			rm.finishMigration(f, hostinfo, relayIp)
+			return
+		}
+
+		idx := uint32(0)
+		if ok {
+			idx = existing.LocalIndex
+		} else {
+			var err error
+			idx, err = AddRelay(rm.l, relayHostInfo, rm.hostmap, target, nil, TerminalType, Requested)
+			if err != nil {
+				hostinfo.logger(rm.l).WithField("relay", relayIp).WithError(err).Info("Failed to add relay to hostmap")
+				continue
+			}
+		}
+
+		//TODO: IPV6-WORK
+		myVpnIpB := f.myVpnNet.Addr().As4()
+		targetB := target.As4()
+		req := NebulaControl{
+			Type:                NebulaControl_CreateRelayRequest,
+			InitiatorRelayIndex: idx,
+			RelayFromIp:         binary.BigEndian.Uint32(myVpnIpB[:]),
+			RelayToIp:           binary.BigEndian.Uint32(targetB[:]),
+		}
+		msg, err := req.Marshal()
+		if err != nil {
+			hostinfo.logger(rm.l).WithError(err).Error("Failed to marshal Control message to create relay")
+			continue
+		}
+
+		f.SendMessageToHostInfo(header.Control, 0, relayHostInfo, msg, make([]byte, 12), make([]byte, mtu))
+		hostinfo.logger(rm.l).WithFields(logrus.Fields{
+			"relay":               relayIp,
+			"drainingRelay":       draining.vpnIp,
+			"initiatorRelayIndex": idx}).
+			Info("send CreateRelayRequest to move off a draining relay")
+	}
+}
+
+// finishMigration switches a relayed tunnel to via, which is established, and away from any draining relays. Tunnels
+// that are not using a draining relay are left alone.
+func (rm *relayManager) finishMigration(f *Interface, hostinfo *HostInfo, via netip.Addr) {
+	if hostinfo == nil || hostinfo.remote.IsValid() {
+		return
+	}
+
+	if viaHostInfo := rm.hostmap.QueryVpnIp(via); viaHostInfo == nil || viaHostInfo.relayDraining.Load() {
+		return
+	}
+
+	var draining []*HostInfo
+	for _, relayIp := range hostinfo.relayState.CopyRelayIps() {
+		if relayHostInfo := rm.hostmap.QueryVpnIp(relayIp); relayHostInfo != nil && relayHostInfo.relayDraining.Load() {
+			draining = append(draining, relayHostInfo)
+		}
+	}
+
+	if len(draining) == 0 {
+		return
+	}
+
+	// Add the new relay before removing the old ones so there is always a path
+	hostinfo.relayState.InsertRelayTo(via)
+	for _, relayHostInfo := range draining {
+		hostinfo.relayState.DeleteRelay(relayHostInfo.vpnIp)
+		rm.sendRelayMigrated(f, relayHostInfo, hostinfo.vpnIp)
+		hostinfo.logger(rm.l).WithField("relay", via).WithField("drainingRelay", relayHostInfo.vpnIp).
+			Info("Moved relayed tunnel off a draining relay")
+	}
+}
+
+// sendRelayMigrated tells a draining relay we no longer need it to reach target
+func (rm *relayManager) sendRelayMigrated(f *Interface, relayHostInfo *HostInfo, target netip.Addr) {
+	//TODO: IPV6-WORK
+	targetB := target.As4()
+	msg, err := (&NebulaControl{
+		Type:      NebulaControl_RelayMigrated,
+		RelayToIp: binary.BigEndian.Uint32(targetB[:]),
+	}).Marshal()
+	if err != nil {
+		rm.l.WithError(err).Error("relayManager Failed to marshal Control RelayMigrated message")
+		return
+	}
+
+	f.SendMessageToHostInfo(header.Control, 0, relayHostInfo, msg, make([]byte, 12), make([]byte, mtu))
+}
@@ -0,0 +1,95 @@
+package nebula
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelayManager_drain(t *testing.T) {
+	l := test.NewLogger()
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.128/24"))
+	rm := NewRelayManager(context.Background(), l, hm, config.NewC(l))
+
+	_, err := rm.startDrain(&Interface{}, time.Minute)
+	assert.Equal(t, errRelayDrainNotARelay, err)
+	assert.Equal(t, RelayDrainStatus{}, rm.DrainStatus())
+
+	newPeer := func(vpnIp netip.Addr, idx uint32) *HostInfo {
+		h := &HostInfo{
+			vpnIp:        vpnIp,
+			localIndexId: idx,
+			relayState: RelayState{
+				relays:        map[netip.Addr]struct{}{},
+				relayForByIp:  map[netip.Addr]*Relay{},
+				relayForByIdx: map[uint32]*Relay{},
+			},
+		}
+		hm.unlockedAddHostInfo(h, &Interface{})
+		return h
+	}
+	me := newPeer(netip.MustParseAddr("10.128.0.1"), 1)
+	them := newPeer(netip.MustParseAddr("10.128.0.2"), 2)
+	other := newPeer(netip.MustParseAddr("10.128.0.3"), 3)
+
+	_, err = AddRelay(l, me, hm, them.vpnIp, nil, ForwardingType, Established)
+	require.NoError(t, err)
+	_, err = AddRelay(l, them, hm, me.vpnIp, nil, ForwardingType, Established)
+	require.NoError(t, err)
+	_, err = AddRelay(l, other, hm, me.vpnIp, nil, ForwardingType, Established)
+	require.NoError(t, err)
+
+	now := time.Now()
+	d := &relayDrain{started: now, deadline: now.Add(time.Minute), forwards: map[relayDrainKey]bool{}}
+	for _, k := range rm.copyForwards() {
+		d.forwards[k] = false
+	}
+	rm.drain.Store(d)
+
+	migrated := func(h *HostInfo, target netip.Addr) {
+		b := target.As4()
+		rm.handleRelayMigrated(h, &NebulaControl{Type: NebulaControl_RelayMigrated, RelayToIp: binary.BigEndian.Uint32(b[:])})
+	}
+
+	status := rm.DrainStatus()
+	assert.True(t, status.Draining)
+	assert.Equal(t, 3, status.Forwards)
+	assert.Equal(t, 3, status.Remaining)
+
+	// One half of a forward migrating keeps it around for the other direction
+	migrated(me, them.vpnIp)
+	assert.Equal(t, 1, rm.DrainStatus().Migrated)
+	_, ok := me.relayState.QueryRelayForByIp(them.vpnIp)
+	assert.True(t, ok)
+
+	// Repeats and unknown forwards are ignored
+	migrated(me, them.vpnIp)
+	migrated(me, other.vpnIp)
+	assert.Equal(t, 1, rm.DrainStatus().Migrated)
+
+	// Once both halves migrated the forward is removed
+	migrated(them, me.vpnIp)
+	status = rm.DrainStatus()
+	assert.Equal(t, 2, status.Migrated)
+	assert.Equal(t, 1, status.Remaining)
+	_, ok = me.relayState.QueryRelayForByIp(them.vpnIp)
+	assert.False(t, ok)
+	_, ok = them.relayState.QueryRelayForByIp(me.vpnIp)
+	assert.False(t, ok)
+	assert.Len(t, hm.Relays, 1)
+
+	// The grace period being over removes what is left
+	rm.stopForwarding(d)
+	status = rm.DrainStatus()
+	assert.True(t, status.Stopped)
+	assert.Equal(t, 1, status.Remaining)
+	assert.Empty(t, hm.Relays)
+	assert.Empty(t, other.relayState.CopyAllRelayFor())
+}
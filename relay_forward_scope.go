@@ -0,0 +1,159 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/gaissmai/bart"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// relayForwardScopeLogInterval limits how often refused forwards are logged, a peer retries them for every packet
+const relayForwardScopeLogInterval = 10 * time.Second
+
+// RelayForwardScope limits which destinations a peer may reach through us when we are a relay. Without it a peer can
+// be relayed to any host we have a tunnel with. Peers that are not listed are not limited.
+// See relay.forward_scope in the example config.
+type RelayForwardScope struct {
+	// scopes maps peer vpn ips to the destinations they may be relayed to
+	scopes atomic.Pointer[bart.Table[*bart.Table[struct{}]]]
+
+	// logged holds when a refused forward was last logged, in unix nanoseconds
+	logged atomic.Int64
+
+	metric metrics.Counter
+	l      *logrus.Logger
+}
+
+func NewRelayForwardScopeFromConfig(l *logrus.Logger, c *config.C) (*RelayForwardScope, error) {
+	rfs := &RelayForwardScope{
+		metric: metrics.GetOrRegisterCounter("relay.forward_scope.dropped", nil),
+		l:      l,
+	}
+
+	err := rfs.reload(c, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		err := rfs.reload(c, false)
+		if err != nil {
+			l.WithError(err).Error("Failed to reload relay.forward_scope")
+		}
+	})
+
+	return rfs, nil
+}
+
+func (rfs *RelayForwardScope) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("relay.forward_scope") {
+		return nil
+	}
+
+	scopes, err := newRelayForwardScopesFromConfig(c.Get("relay.forward_scope"))
+	if err != nil {
+		return err
+	}
+
+	rfs.scopes.Store(scopes)
+	if !initial {
+		rfs.l.Info("relay.forward_scope changed")
+	}
+	return nil
+}
+
+func parseRelayForwardScopePrefix(raw any) (netip.Prefix, bool) {
+	s := fmt.Sprintf("%v", raw)
+	if cidr, err := netip.ParsePrefix(s); err == nil {
+		return cidr.Masked(), true
+	}
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	return netip.Prefix{}, false
+}
+
+func newRelayForwardScopesFromConfig(raw any) (*bart.Table[*bart.Table[struct{}]], error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	rawMap, ok := raw.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("config `relay.forward_scope` has invalid type: %T", raw)
+	}
+
+	scopes := new(bart.Table[*bart.Table[struct{}]])
+	for rawKey, rawValue := range rawMap {
+		peers, ok := parseRelayForwardScopePrefix(rawKey)
+		if !ok {
+			return nil, fmt.Errorf("config `relay.forward_scope` has invalid peer: %v", rawKey)
+		}
+
+		// A peer with no destinations may not be relayed anywhere
+		allowed := new(bart.Table[struct{}])
+		if rawValue != nil {
+			rawList, ok := rawValue.([]any)
+			if !ok {
+				return nil, fmt.Errorf("config `relay.forward_scope.%v` has invalid type: %T", rawKey, rawValue)
+			}
+
+			for _, rawDest := range rawList {
+				dest, ok := parseRelayForwardScopePrefix(rawDest)
+				if !ok {
+					return nil, fmt.Errorf("config `relay.forward_scope.%v` has invalid destination: %v", rawKey, rawDest)
+				}
+				allowed.Insert(dest, struct{}{})
+			}
+		}
+
+		scopes.Insert(peers, allowed)
+	}
+
+	return scopes, nil
+}
+
+// allowed reports if from may be relayed to to, the most specific entry for from decides
+func (rfs *RelayForwardScope) allowed(from, to netip.Addr) bool {
+	if rfs == nil {
+		return true
+	}
+
+	scopes := rfs.scopes.Load()
+	if scopes == nil {
+		return true
+	}
+
+	allowed, ok := scopes.Lookup(from)
+	if !ok {
+		return true
+	}
+
+	_, ok = allowed.Lookup(to)
+	return ok
+}
+
+// allowForward checks a packet, or a request to set up a relay, hostinfo sent us to forward to the relay target to.
+// Forwards outside of the peer's scope are counted and logged, the caller must drop them. It is safe to call on a nil
+// RelayForwardScope.
+func (rfs *RelayForwardScope) allowForward(hostinfo *HostInfo, to netip.Addr) bool {
+	if rfs.allowed(hostinfo.vpnIp, to) {
+		return true
+	}
+
+	rfs.metric.Inc(1)
+
+	now := time.Now().UnixNano()
+	last := rfs.logged.Load()
+	if now-last >= int64(relayForwardScopeLogInterval) && rfs.logged.CompareAndSwap(last, now) {
+		hostinfo.logger(rfs.l).WithField("relayTo", to).
+			Warn("Refusing to relay to a destination outside of the peer's relay.forward_scope")
+	}
+
+	return false
+}
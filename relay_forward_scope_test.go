@@ -0,0 +1,112 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRelayForwardScopeFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	rfs, err := NewRelayForwardScopeFromConfig(l, c)
+	require.NoError(t, err)
+	assert.True(t, rfs.allowed(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")), "no scopes")
+
+	require.NoError(t, c.LoadString("relay:\n  forward_scope:\n    10.0.0.1: [10.0.0.2, 10.0.1.0/24]\n    10.0.2.0/24: []\n    10.0.2.5: [10.0.0.2]\n"))
+	rfs, err = NewRelayForwardScopeFromConfig(l, c)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		from, to string
+		allowed  bool
+	}{
+		{"10.0.0.1", "10.0.0.2", true},
+		{"10.0.0.1", "10.0.1.200", true},
+		{"10.0.0.1", "10.0.0.3", false},
+		{"10.0.2.4", "10.0.0.2", false},
+		{"10.0.2.5", "10.0.0.2", true},
+		{"10.0.2.5", "10.0.0.3", false},
+		{"10.0.3.1", "10.0.0.3", true},
+	} {
+		assert.Equal(t, tc.allowed, rfs.allowed(netip.MustParseAddr(tc.from), netip.MustParseAddr(tc.to)), tc.from+" to "+tc.to)
+	}
+
+	for _, tc := range []struct {
+		scope string
+		err   string
+	}{
+		{"nope", "config `relay.forward_scope` has invalid type: string"},
+		{"{nope: []}", "config `relay.forward_scope` has invalid peer: nope"},
+		{"{10.0.0.1: 10.0.0.2}", "config `relay.forward_scope.10.0.0.1` has invalid type: string"},
+		{"{10.0.0.1: [nope]}", "config `relay.forward_scope.10.0.0.1` has invalid destination: nope"},
+	} {
+		c := config.NewC(l)
+		require.NoError(t, c.LoadString("relay:\n  forward_scope: "+tc.scope+"\n"))
+		_, err := NewRelayForwardScopeFromConfig(l, c)
+		assert.EqualError(t, err, tc.err, tc.scope)
+	}
+}
+
+func TestRelayForwardScope_allowForward(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("relay:\n  forward_scope:\n    10.0.0.1: [10.0.0.2]\n"))
+	rfs, err := NewRelayForwardScopeFromConfig(l, c)
+	require.NoError(t, err)
+	rfs.metric = metrics.NewCounter()
+
+	peer := &HostInfo{vpnIp: netip.MustParseAddr("10.0.0.1")}
+	assert.True(t, rfs.allowForward(peer, netip.MustParseAddr("10.0.0.2")))
+	assert.False(t, rfs.allowForward(peer, netip.MustParseAddr("10.0.0.3")))
+	assert.False(t, rfs.allowForward(peer, netip.MustParseAddr("10.0.0.4")))
+	assert.Equal(t, int64(2), rfs.metric.Count())
+
+	t.Log("Reloading without the scope allows the forward again")
+	require.NoError(t, c.ReloadConfigString("relay:\n  am_relay: true\n"))
+	assert.True(t, rfs.allowForward(peer, netip.MustParseAddr("10.0.0.3")))
+
+	var nilScope *RelayForwardScope
+	assert.True(t, nilScope.allowForward(peer, netip.MustParseAddr("10.0.0.3")))
+}
+
+func TestRelayManager_handleCreateRelayRequest_forwardScope(t *testing.T) {
+	rm, f, c, conn, newPeer := newRelayControlTest(t, "relay: {am_relay: true, forward_scope: {10.128.0.2: [10.128.0.3]}}")
+	rfs, err := NewRelayForwardScopeFromConfig(f.l, c)
+	require.NoError(t, err)
+	rfs.metric = metrics.NewCounter()
+	f.relayForwardScope = rfs
+
+	from := newPeer(netip.MustParseAddr("10.128.0.2"), 1)
+	allowed := newPeer(netip.MustParseAddr("10.128.0.3"), 2)
+	refused := newPeer(netip.MustParseAddr("10.128.0.4"), 3)
+
+	request := func(to *HostInfo) {
+		rm.handleCreateRelayRequest(from, f, &NebulaControl{
+			Type:                NebulaControl_CreateRelayRequest,
+			InitiatorRelayIndex: 100,
+			RelayFromIp:         vpnIpUint32(from.vpnIp),
+			RelayToIp:           vpnIpUint32(to.vpnIp),
+		})
+	}
+
+	t.Log("A request to a destination outside of the scope sets nothing up")
+	request(refused)
+	assert.Empty(t, conn.sent[refused.remote])
+	_, ok := from.relayState.QueryRelayForByIp(refused.vpnIp)
+	assert.False(t, ok)
+	_, ok = refused.relayState.QueryRelayForByIp(from.vpnIp)
+	assert.False(t, ok)
+	assert.Equal(t, int64(1), rfs.metric.Count())
+
+	request(allowed)
+	assert.Len(t, conn.sent[allowed.remote], 1)
+	_, ok = from.relayState.QueryRelayForByIp(allowed.vpnIp)
+	assert.True(t, ok)
+}
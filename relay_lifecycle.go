@@ -0,0 +1,266 @@
+package nebula
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+// The lifecycle of a relay on each of its ends:
+//
+//	Requested/PeerRequested -> Established    a CreateRelayRequest was answered with a CreateRelayResponse
+//	Requested/PeerRequested -> Disestablished no answer after relay.setup_retries requests sent again
+//	Established -> Disestablished             we tore it down, a RelayTeardown was sent
+//	Disestablished -> removed                 the RelayTeardownAck arrived, or relay.setup_retries teardowns went unanswered
+//	any -> removed                            the peer sent a RelayTeardown
+//
+// Each wait is relay.setup_timeout. A teardown removes the relay on the other end, a forwarding relay tears down the
+// other half of the forward as well. Either end of a relay that finds the other end has no state for it, the "HostInfo
+// missing remote relay index" case, sends a teardown so the half that is left is removed and set up again instead of
+// staying up on one end only.
+
+const (
+	// relayLifecycleInterval is how often relays that are waiting on their peer are checked
+	relayLifecycleInterval = time.Second
+
+	defaultRelaySetupTimeout = 5 * time.Second
+	defaultRelaySetupRetries = 3
+)
+
+func (rm *relayManager) reloadLifecycle(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("relay.setup_timeout") && !c.HasChanged("relay.setup_retries") {
+		return nil
+	}
+
+	timeout := c.GetDuration("relay.setup_timeout", defaultRelaySetupTimeout)
+	if timeout <= 0 {
+		return fmt.Errorf("relay.setup_timeout must be positive, got %v", timeout)
+	}
+
+	retries := c.GetInt("relay.setup_retries", defaultRelaySetupRetries)
+	if retries < 0 {
+		return fmt.Errorf("relay.setup_retries must not be negative, got %d", retries)
+	}
+
+	rm.setupTimeout.Store(int64(timeout))
+	rm.setupRetries.Store(int64(retries))
+	return nil
+}
+
+// Run checks the relays waiting on their peer until ctx is done
+func (rm *relayManager) Run(ctx context.Context, f *Interface) {
+	ticker := time.NewTicker(relayLifecycleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			rm.expireRelays(f, now)
+		}
+	}
+}
+
+// expireRelays sends again the requests and teardowns that were not answered within relay.setup_timeout and gives up on
+// the relays that used up relay.setup_retries
+func (rm *relayManager) expireRelays(f *Interface, now time.Time) {
+	type waiting struct {
+		hostinfo *HostInfo
+		relay    *Relay
+	}
+
+	timeout := time.Duration(rm.setupTimeout.Load())
+	var expired []waiting
+	rm.hostmap.RLock()
+	for _, hostinfo := range rm.hostmap.Indexes {
+		for _, r := range hostinfo.relayState.CopyAllRelayFor() {
+			if r.State != Established && now.Sub(r.Sent) > timeout {
+				expired = append(expired, waiting{hostinfo, r})
+			}
+		}
+	}
+	rm.hostmap.RUnlock()
+
+	retries := int(rm.setupRetries.Load())
+	for _, w := range expired {
+		r := w.relay
+		logMsg := w.hostinfo.logger(rm.l).WithField("relayTo", r.PeerIp).WithField("localIndex", r.LocalIndex).
+			WithField("type", relayTypeString(r.Type)).WithField("attempts", r.Attempts)
+
+		if r.Attempts >= retries {
+			if r.State == Disestablished {
+				rm.metricTeardownTimeout.Inc(1)
+				logMsg.Info("No answer to the relay teardown, removing the relay")
+				rm.removeRelay(w.hostinfo, r)
+			} else {
+				rm.metricSetupTimeout.Inc(1)
+				logMsg.WithField("state", relayStateString(r.State)).Warn("Relay setup timed out, tearing it down")
+				rm.teardownRelay(f, w.hostinfo, r)
+			}
+			continue
+		}
+
+		r, ok := w.hostinfo.relayState.UpdateRelay(r.LocalIndex, func(r *Relay) {
+			r.Sent = now
+			r.Attempts++
+		})
+		if !ok {
+			continue
+		}
+
+		switch r.State {
+		case Requested:
+			from, to := rm.relayEnds(f, w.hostinfo, r)
+			rm.sendRelayControl(f, w.hostinfo, &NebulaControl{
+				Type:                NebulaControl_CreateRelayRequest,
+				InitiatorRelayIndex: r.LocalIndex,
+				RelayFromIp:         vpnIpUint32(from),
+				RelayToIp:           vpnIpUint32(to),
+			})
+			logMsg.Info("Re-send CreateRelay request")
+		case Disestablished:
+			rm.sendTeardown(f, w.hostinfo, r)
+		}
+		// A PeerRequested relay waits on the other half of the forward, the request for it is sent from there
+	}
+}
+
+// teardownRelay stops using r on hostinfo and tells the other end to remove it, a forwarding relay takes the other half
+// of the forward down with it
+func (rm *relayManager) teardownRelay(f *Interface, hostinfo *HostInfo, r *Relay) {
+	now := time.Now()
+	r, ok := hostinfo.relayState.UpdateRelay(r.LocalIndex, func(r *Relay) {
+		r.State = Disestablished
+		r.Since = now
+		r.Sent = now
+		r.Attempts = 0
+	})
+	if !ok {
+		return
+	}
+
+	rm.sendTeardown(f, hostinfo, r)
+	if r.Type == ForwardingType {
+		rm.teardownOtherHalf(f, hostinfo, r)
+	}
+}
+
+// teardownOtherHalf tears down the half of the forward through us that is not r
+func (rm *relayManager) teardownOtherHalf(f *Interface, hostinfo *HostInfo, r *Relay) {
+	peer := rm.hostmap.QueryVpnIp(r.PeerIp)
+	if peer == nil {
+		return
+	}
+
+	other, ok := peer.relayState.QueryRelayForByIp(hostinfo.vpnIp)
+	if ok && other.Type == ForwardingType && other.State != Disestablished {
+		rm.teardownRelay(f, peer, other)
+	}
+}
+
+func (rm *relayManager) sendTeardown(f *Interface, hostinfo *HostInfo, r *Relay) {
+	rm.metricTeardownSent.Inc(1)
+	from, to := rm.relayEnds(f, hostinfo, r)
+	rm.sendRelayControl(f, hostinfo, &NebulaControl{
+		Type:                NebulaControl_RelayTeardown,
+		InitiatorRelayIndex: r.LocalIndex,
+		ResponderRelayIndex: r.RemoteIndex,
+		RelayFromIp:         vpnIpUint32(from),
+		RelayToIp:           vpnIpUint32(to),
+	})
+	hostinfo.logger(rm.l).WithField("relayTo", r.PeerIp).WithField("localIndex", r.LocalIndex).
+		WithField("remoteIndex", r.RemoteIndex).Info("send RelayTeardown")
+}
+
+// handleRelayTeardown removes the relay the other end of h tore down and acknowledges it. The relay is found by our
+// index if the sender knew it, otherwise by the sender's index.
+func (rm *relayManager) handleRelayTeardown(h *HostInfo, f *Interface, m *NebulaControl) {
+	rm.metricTeardownReceived.Inc(1)
+
+	var r *Relay
+	if m.ResponderRelayIndex != 0 {
+		r, _ = h.relayState.QueryRelayForByIdx(m.ResponderRelayIndex)
+	} else if m.InitiatorRelayIndex != 0 {
+		for _, c := range h.relayState.CopyAllRelayFor() {
+			if c.RemoteIndex == m.InitiatorRelayIndex {
+				r = c
+				break
+			}
+		}
+	}
+
+	if r != nil && (r.RemoteIndex == 0 || r.RemoteIndex == m.InitiatorRelayIndex) {
+		h.logger(rm.l).WithField("relayTo", r.PeerIp).WithField("localIndex", r.LocalIndex).
+			WithField("state", relayStateString(r.State)).Info("Relay torn down by the peer")
+		rm.removeRelay(h, r)
+		if r.Type == ForwardingType {
+			rm.teardownOtherHalf(f, h, r)
+		}
+	}
+
+	// Acknowledged even if we had nothing to remove so the sender stops asking
+	rm.sendRelayControl(f, h, &NebulaControl{
+		Type:                NebulaControl_RelayTeardownAck,
+		InitiatorRelayIndex: m.InitiatorRelayIndex,
+		ResponderRelayIndex: m.ResponderRelayIndex,
+	})
+}
+
+// handleRelayTeardownAck removes the relay we tore down once the other end of h removed it
+func (rm *relayManager) handleRelayTeardownAck(h *HostInfo, m *NebulaControl) {
+	r, ok := h.relayState.QueryRelayForByIdx(m.InitiatorRelayIndex)
+	if !ok || r.State != Disestablished {
+		return
+	}
+
+	h.logger(rm.l).WithField("relayTo", r.PeerIp).WithField("localIndex", r.LocalIndex).Debug("Relay teardown acknowledged")
+	rm.removeRelay(h, r)
+}
+
+// teardownUnknown tells the other end of h to remove its half of a relay we have no state for, remoteIndex is our index
+// for it as the other end knows it
+func (rm *relayManager) teardownUnknown(f *Interface, h *HostInfo, localIndex, remoteIndex uint32) {
+	rm.metricTeardownSent.Inc(1)
+	rm.sendRelayControl(f, h, &NebulaControl{
+		Type:                NebulaControl_RelayTeardown,
+		InitiatorRelayIndex: localIndex,
+		ResponderRelayIndex: remoteIndex,
+	})
+	h.logger(rm.l).WithField("localIndex", localIndex).WithField("remoteIndex", remoteIndex).
+		Info("send RelayTeardown for a relay we do not know")
+}
+
+func (rm *relayManager) removeRelay(hostinfo *HostInfo, r *Relay) {
+	hostinfo.relayState.RemoveRelay(r.LocalIndex)
+	rm.hostmap.RemoveRelay(r.LocalIndex)
+}
+
+// relayEnds returns the vpn ips the relay r on hostinfo carries traffic between
+func (rm *relayManager) relayEnds(f *Interface, hostinfo *HostInfo, r *Relay) (netip.Addr, netip.Addr) {
+	if r.Type == ForwardingType {
+		return r.PeerIp, hostinfo.vpnIp
+	}
+	return f.myVpnNet.Addr(), r.PeerIp
+}
+
+func (rm *relayManager) sendRelayControl(f *Interface, hostinfo *HostInfo, m *NebulaControl) {
+	msg, err := m.Marshal()
+	if err != nil {
+		hostinfo.logger(rm.l).WithError(err).WithField("type", m.Type).Error("relayManager Failed to marshal Control message")
+		return
+	}
+	f.SendMessageToHostInfo(header.Control, 0, hostinfo, msg, make([]byte, 12), make([]byte, mtu))
+}
+
+// vpnIpUint32 is how relay control messages carry a vpn ip
+func vpnIpUint32(vpnIp netip.Addr) uint32 {
+	//TODO: IPV6-WORK
+	b := vpnIp.As4()
+	return binary.BigEndian.Uint32(b[:])
+}
@@ -0,0 +1,188 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// controlConn keeps the packets written to it by remote
+type controlConn struct {
+	udp.NoopConn
+	sent map[netip.AddrPort][][]byte
+}
+
+func (c *controlConn) WriteTo(b []byte, addr netip.AddrPort) error {
+	c.sent[addr] = append(c.sent[addr], append([]byte{}, b...))
+	return nil
+}
+
+func TestRelayManager_lifecycle(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("relay: {am_relay: true, setup_timeout: 1s, setup_retries: 1}"))
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	rm := NewRelayManager(context.Background(), l, hm, c)
+	assert.Equal(t, int64(time.Second), rm.setupTimeout.Load())
+	assert.Equal(t, int64(1), rm.setupRetries.Load())
+
+	conn := &controlConn{sent: map[netip.AddrPort][][]byte{}}
+	f := &Interface{
+		l:                 l,
+		hostMap:           hm,
+		relayManager:      rm,
+		myVpnNet:          hm.vpnCIDR,
+		sendBackoff:       NewSendBackoffFromConfig(l, c),
+		writers:           []udp.Conn{conn},
+		connectionManager: &connectionManager{out: map[uint32]struct{}{}, outLock: &sync.RWMutex{}},
+	}
+
+	cs := &NebulaCipherState{c: noise.CipherChaChaPoly.Cipher([32]byte{1})}
+	newPeer := func(vpnIp netip.Addr, idx uint32) *HostInfo {
+		h := &HostInfo{
+			vpnIp:           vpnIp,
+			localIndexId:    idx,
+			remote:          netip.AddrPortFrom(vpnIp, 4242),
+			ConnectionState: &ConnectionState{eKey: cs, dKey: cs},
+			relayState: RelayState{
+				relays:        map[netip.Addr]struct{}{},
+				relayForByIp:  map[netip.Addr]*Relay{},
+				relayForByIdx: map[uint32]*Relay{},
+			},
+		}
+		hm.unlockedAddHostInfo(h, f)
+		return h
+	}
+	a := newPeer(netip.MustParseAddr("10.128.0.2"), 1)
+	b := newPeer(netip.MustParseAddr("10.128.0.3"), 2)
+
+	// sent returns the control messages sent to h since the last call
+	sent := func(h *HostInfo) []*NebulaControl {
+		var msgs []*NebulaControl
+		for _, p := range conn.sent[h.remote] {
+			hdr := &header.H{}
+			require.NoError(t, hdr.Parse(p))
+			require.Equal(t, header.Control, hdr.Type)
+			out, err := cs.DecryptDanger(nil, p[:header.Len], p[header.Len:], hdr.MessageCounter, make([]byte, 12))
+			require.NoError(t, err)
+			m := &NebulaControl{}
+			require.NoError(t, m.Unmarshal(out))
+			msgs = append(msgs, m)
+		}
+		delete(conn.sent, h.remote)
+		return msgs
+	}
+	relay := func(h *HostInfo, idx uint32) *Relay {
+		r, ok := h.relayState.QueryRelayForByIdx(idx)
+		if !ok {
+			return nil
+		}
+		return r
+	}
+
+	t.Log("An unanswered request is sent again until the retries are used up")
+	idx, err := AddRelay(l, a, hm, b.vpnIp, nil, TerminalType, Requested)
+	require.NoError(t, err)
+	start := time.Now()
+	rm.expireRelays(f, start)
+	assert.Empty(t, sent(a))
+
+	rm.expireRelays(f, start.Add(2*time.Second))
+	msgs := sent(a)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, NebulaControl_CreateRelayRequest, msgs[0].Type)
+	assert.Equal(t, idx, msgs[0].InitiatorRelayIndex)
+	assert.Equal(t, vpnIpUint32(b.vpnIp), msgs[0].RelayToIp)
+	assert.Equal(t, 1, relay(a, idx).Attempts)
+
+	t.Log("Then the relay is torn down")
+	timeouts := rm.metricSetupTimeout.Count()
+	rm.expireRelays(f, start.Add(4*time.Second))
+	assert.Equal(t, timeouts+1, rm.metricSetupTimeout.Count())
+	assert.Equal(t, Disestablished, relay(a, idx).State)
+	msgs = sent(a)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, NebulaControl_RelayTeardown, msgs[0].Type)
+	assert.Equal(t, idx, msgs[0].InitiatorRelayIndex)
+
+	t.Log("A late response does not bring it back")
+	_, err = rm.EstablishRelay(a, &NebulaControl{InitiatorRelayIndex: idx, ResponderRelayIndex: 77})
+	assert.Equal(t, errRelayDisestablished, err)
+
+	t.Log("The ack removes it")
+	rm.handleRelayTeardownAck(a, &NebulaControl{Type: NebulaControl_RelayTeardownAck, InitiatorRelayIndex: idx})
+	assert.Nil(t, relay(a, idx))
+	_, ok := hm.Relays[idx]
+	assert.False(t, ok)
+
+	t.Log("A relay can be set up again once it is gone")
+	idx, err = AddRelay(l, a, hm, b.vpnIp, nil, TerminalType, Requested)
+	require.NoError(t, err)
+	_, err = rm.EstablishRelay(a, &NebulaControl{InitiatorRelayIndex: idx, ResponderRelayIndex: 77})
+	require.NoError(t, err)
+	assert.Equal(t, Established, relay(a, idx).State)
+
+	t.Log("An unanswered teardown is given up on")
+	rm.teardownRelay(f, a, relay(a, idx))
+	sent(a)
+	teardownTimeouts := rm.metricTeardownTimeout.Count()
+	rm.expireRelays(f, time.Now().Add(2*time.Second))
+	assert.Len(t, sent(a), 1)
+	rm.expireRelays(f, time.Now().Add(4*time.Second))
+	assert.Empty(t, sent(a))
+	assert.Nil(t, relay(a, idx))
+	assert.Equal(t, teardownTimeouts+1, rm.metricTeardownTimeout.Count())
+
+	t.Log("A teardown of a forward removes both halves")
+	aRemote, bRemote := uint32(100), uint32(200)
+	aIdx, err := AddRelay(l, a, hm, b.vpnIp, &aRemote, ForwardingType, Established)
+	require.NoError(t, err)
+	bIdx, err := AddRelay(l, b, hm, a.vpnIp, &bRemote, ForwardingType, Established)
+	require.NoError(t, err)
+
+	received := rm.metricTeardownReceived.Count()
+	rm.handleRelayTeardown(a, f, &NebulaControl{Type: NebulaControl_RelayTeardown, InitiatorRelayIndex: aRemote, ResponderRelayIndex: aIdx})
+	assert.Equal(t, received+1, rm.metricTeardownReceived.Count())
+	assert.Nil(t, relay(a, aIdx))
+	assert.Equal(t, Disestablished, relay(b, bIdx).State)
+
+	msgs = sent(a)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, NebulaControl_RelayTeardownAck, msgs[0].Type)
+	assert.Equal(t, aRemote, msgs[0].InitiatorRelayIndex)
+	assert.Equal(t, aIdx, msgs[0].ResponderRelayIndex)
+
+	msgs = sent(b)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, NebulaControl_RelayTeardown, msgs[0].Type)
+	assert.Equal(t, bIdx, msgs[0].InitiatorRelayIndex)
+	assert.Equal(t, bRemote, msgs[0].ResponderRelayIndex)
+	assert.Equal(t, vpnIpUint32(a.vpnIp), msgs[0].RelayFromIp)
+	assert.Equal(t, vpnIpUint32(b.vpnIp), msgs[0].RelayToIp)
+
+	rm.handleRelayTeardownAck(b, &NebulaControl{Type: NebulaControl_RelayTeardownAck, InitiatorRelayIndex: bIdx, ResponderRelayIndex: bRemote})
+	assert.Nil(t, relay(b, bIdx))
+
+	t.Log("A teardown from an end that does not know our index finds the relay by its own")
+	idx, err = AddRelay(l, a, hm, b.vpnIp, &aRemote, TerminalType, Established)
+	require.NoError(t, err)
+	rm.handleRelayTeardown(a, f, &NebulaControl{Type: NebulaControl_RelayTeardown, InitiatorRelayIndex: aRemote})
+	assert.Nil(t, relay(a, idx))
+	require.Len(t, sent(a), 1)
+
+	t.Log("A teardown for a relay we do not have is still acknowledged")
+	rm.handleRelayTeardown(a, f, &NebulaControl{Type: NebulaControl_RelayTeardown, InitiatorRelayIndex: 5, ResponderRelayIndex: 6})
+	msgs = sent(a)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, NebulaControl_RelayTeardownAck, msgs[0].Type)
+}
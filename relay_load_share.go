@@ -0,0 +1,303 @@
+package nebula
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gaissmai/bart"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// RelayLoadShare spreads the traffic to relayed destinations across every relay with an established path to them.
+// Each inner flow is hashed onto one relay so a flow never gets reordered by taking different paths, relays are picked
+// with weighted rendezvous hashing so losing a relay only moves the flows that were using it.
+// See relay.load_share in the example config.
+type RelayLoadShare struct {
+	rules atomic.Pointer[bart.Table[*relayShareRule]]
+	l     *logrus.Logger
+}
+
+// relayShareRule holds the weights for the relays of a destination, relays that are not listed have a weight of 1
+type relayShareRule struct {
+	weights map[netip.Addr]int
+}
+
+func (r *relayShareRule) weight(relayIp netip.Addr) int {
+	if w, ok := r.weights[relayIp]; ok {
+		return w
+	}
+	return 1
+}
+
+// RelayUtilization is what has been sent to a load shared destination through one relay
+type RelayUtilization struct {
+	Relay       netip.Addr `json:"relay"`
+	Weight      int        `json:"weight"`
+	Established bool       `json:"established"`
+	Packets     uint64     `json:"packets"`
+	Bytes       uint64     `json:"bytes"`
+}
+
+// relayShareStats counts what was sent through each relay, it lives on the HostInfo of the destination
+type relayShareStats struct {
+	counters sync.Map // netip.Addr -> *relayShareCounter
+}
+
+type relayShareCounter struct {
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+}
+
+func (s *relayShareStats) add(relayIp netip.Addr, size int) {
+	v, ok := s.counters.Load(relayIp)
+	if !ok {
+		v, _ = s.counters.LoadOrStore(relayIp, &relayShareCounter{})
+	}
+	c := v.(*relayShareCounter)
+	c.packets.Add(1)
+	c.bytes.Add(uint64(size))
+}
+
+func NewRelayLoadShareFromConfig(l *logrus.Logger, c *config.C) (*RelayLoadShare, error) {
+	rls := &RelayLoadShare{l: l}
+
+	err := rls.reload(c, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		err := rls.reload(c, false)
+		if err != nil {
+			l.WithError(err).Error("Failed to reload relay.load_share")
+		}
+	})
+
+	return rls, nil
+}
+
+func (rls *RelayLoadShare) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("relay.load_share") {
+		return nil
+	}
+
+	rules, err := newRelayShareRulesFromConfig(c.Get("relay.load_share"))
+	if err != nil {
+		return err
+	}
+
+	rls.rules.Store(rules)
+	if !initial {
+		rls.l.Info("relay.load_share changed")
+	}
+	return nil
+}
+
+func newRelayShareRulesFromConfig(raw any) (*bart.Table[*relayShareRule], error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	rawMap, ok := raw.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("config `relay.load_share` has invalid type: %T", raw)
+	}
+
+	rules := new(bart.Table[*relayShareRule])
+	for rawKey, rawValue := range rawMap {
+		rawCIDR := fmt.Sprintf("%v", rawKey)
+		cidr, err := netip.ParsePrefix(rawCIDR)
+		if err != nil {
+			addr, aErr := netip.ParseAddr(rawCIDR)
+			if aErr != nil {
+				return nil, fmt.Errorf("config `relay.load_share` has invalid destination: %s", rawCIDR)
+			}
+			cidr = netip.PrefixFrom(addr, addr.BitLen())
+		}
+
+		rule := &relayShareRule{weights: map[netip.Addr]int{}}
+		if rawValue != nil {
+			rawWeights, ok := rawValue.(map[any]any)
+			if !ok {
+				return nil, fmt.Errorf("config `relay.load_share.%s` has invalid type: %T", rawCIDR, rawValue)
+			}
+
+			for rawRelay, rawWeight := range rawWeights {
+				relayIp, err := netip.ParseAddr(fmt.Sprintf("%v", rawRelay))
+				if err != nil {
+					return nil, fmt.Errorf("config `relay.load_share.%s` has invalid relay: %v", rawCIDR, rawRelay)
+				}
+
+				weight, err := strconv.Atoi(fmt.Sprintf("%v", rawWeight))
+				if err != nil || weight < 0 {
+					return nil, fmt.Errorf("config `relay.load_share.%s.%s` has invalid weight: %v", rawCIDR, relayIp, rawWeight)
+				}
+				rule.weights[relayIp] = weight
+			}
+		}
+
+		rules.Insert(cidr.Masked(), rule)
+	}
+
+	return rules, nil
+}
+
+// rule returns the load share rule for the destination, or nil if its traffic is not load shared
+func (rls *RelayLoadShare) rule(vpnIp netip.Addr) *relayShareRule {
+	if rls == nil {
+		return nil
+	}
+
+	rules := rls.rules.Load()
+	if rules == nil {
+		return nil
+	}
+
+	rule, _ := rules.Lookup(vpnIp)
+	return rule
+}
+
+// pick chooses the relay to send a size byte packet of the flow fp to hostinfo through and accounts for it. false is
+// returned when the destination is not load shared or there is no established relay with a weight, the caller should
+// fall back to any relay.
+func (rls *RelayLoadShare) pick(hm *HostMap, hostinfo *HostInfo, fp *firewall.Packet, size int) (*HostInfo, *Relay, bool) {
+	rule := rls.rule(hostinfo.vpnIp)
+	if rule == nil {
+		return nil, nil, false
+	}
+
+	flow := relayFlowHash(fp)
+	var (
+		bestScore      float64
+		bestHostInfo   *HostInfo
+		bestRelay      *Relay
+		bestRelayVpnIp netip.Addr
+	)
+
+	for _, relayIp := range relayShareCandidates(hostinfo) {
+		w := rule.weight(relayIp)
+		if w <= 0 {
+			continue
+		}
+
+		relayHostInfo, relay, err := hm.QueryVpnIpRelayFor(hostinfo.vpnIp, relayIp)
+		if err != nil || relayHostInfo.relayDraining.Load() {
+			continue
+		}
+
+		score := relayShareScore(flow, relayIp, w)
+		if bestHostInfo == nil || score > bestScore {
+			bestScore, bestHostInfo, bestRelay, bestRelayVpnIp = score, relayHostInfo, relay, relayIp
+		}
+	}
+
+	if bestHostInfo == nil {
+		return nil, nil, false
+	}
+
+	hostinfo.relayShare.add(bestRelayVpnIp, size)
+	return bestHostInfo, bestRelay, true
+}
+
+// relayShareCandidates is every relay we know of for hostinfo, the ones the tunnel was established through and the ones
+// the lighthouse told us about which may have an established path from the handshake.
+func relayShareCandidates(hostinfo *HostInfo) []netip.Addr {
+	relays := hostinfo.relayState.CopyRelayIps()
+	if hostinfo.remotes != nil {
+		for _, relayIp := range hostinfo.remotes.CopyRelays() {
+			found := false
+			for _, r := range relays {
+				if r == relayIp {
+					found = true
+					break
+				}
+			}
+			if !found {
+				relays = append(relays, relayIp)
+			}
+		}
+	}
+	return relays
+}
+
+// relayFlowHash hashes the inner 5-tuple so every packet of a flow lands on the same relay
+func relayFlowHash(fp *firewall.Packet) uint64 {
+	h := fnv.New64a()
+	b := fp.LocalIP.As16()
+	h.Write(b[:])
+	b = fp.RemoteIP.As16()
+	h.Write(b[:])
+	h.Write([]byte{byte(fp.LocalPort >> 8), byte(fp.LocalPort), byte(fp.RemotePort >> 8), byte(fp.RemotePort), fp.Protocol})
+	return mix64(h.Sum64())
+}
+
+// relayShareScore is the weighted rendezvous hash score of a relay for a flow, the relay with the highest score wins.
+// Each relay wins a share of the flows proportional to its weight.
+func relayShareScore(flow uint64, relayIp netip.Addr, weight int) float64 {
+	h := fnv.New64a()
+	b := relayIp.As16()
+	h.Write(b[:])
+
+	// Map the hash onto (0, 1) so the log is always defined
+	u := (float64(mix64(flow^mix64(h.Sum64()))>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(u)
+}
+
+// mix64 is the splitmix64 finalizer, fnv alone does not spread small input differences into the high bits
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// GetRelayUtilization returns what has been sent to a load shared destination through each of its relays, nil if the
+// destination is not load shared
+func (rls *RelayLoadShare) GetRelayUtilization(hm *HostMap, hostinfo *HostInfo) []RelayUtilization {
+	rule := rls.rule(hostinfo.vpnIp)
+	if rule == nil {
+		return nil
+	}
+
+	seen := map[netip.Addr]struct{}{}
+	var out []RelayUtilization
+	addRelay := func(relayIp netip.Addr) {
+		if _, ok := seen[relayIp]; ok {
+			return
+		}
+		seen[relayIp] = struct{}{}
+
+		u := RelayUtilization{Relay: relayIp, Weight: rule.weight(relayIp)}
+		_, _, err := hm.QueryVpnIpRelayFor(hostinfo.vpnIp, relayIp)
+		u.Established = err == nil
+		if v, ok := hostinfo.relayShare.counters.Load(relayIp); ok {
+			c := v.(*relayShareCounter)
+			u.Packets = c.packets.Load()
+			u.Bytes = c.bytes.Load()
+		}
+		out = append(out, u)
+	}
+
+	for _, relayIp := range relayShareCandidates(hostinfo) {
+		addRelay(relayIp)
+	}
+	hostinfo.relayShare.counters.Range(func(k, _ any) bool {
+		addRelay(k.(netip.Addr))
+		return true
+	})
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Relay.Less(out[j].Relay)
+	})
+	return out
+}
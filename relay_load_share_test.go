@@ -0,0 +1,176 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRelayLoadShareFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	rls, err := NewRelayLoadShareFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Nil(t, rls.rule(netip.MustParseAddr("10.0.0.1")))
+
+	c.Settings["relay"] = map[interface{}]interface{}{"load_share": map[interface{}]interface{}{
+		"10.0.0.1":    map[interface{}]interface{}{"10.0.0.100": 2, "10.0.0.101": 0},
+		"10.0.1.0/24": nil,
+	}}
+	rls, err = NewRelayLoadShareFromConfig(l, c)
+	require.NoError(t, err)
+
+	rule := rls.rule(netip.MustParseAddr("10.0.0.1"))
+	require.NotNil(t, rule)
+	assert.Equal(t, 2, rule.weight(netip.MustParseAddr("10.0.0.100")))
+	assert.Equal(t, 0, rule.weight(netip.MustParseAddr("10.0.0.101")))
+	assert.Equal(t, 1, rule.weight(netip.MustParseAddr("10.0.0.102")))
+	assert.NotNil(t, rls.rule(netip.MustParseAddr("10.0.1.5")))
+	assert.Nil(t, rls.rule(netip.MustParseAddr("10.0.0.2")))
+
+	c.Settings["relay"] = map[interface{}]interface{}{"load_share": map[interface{}]interface{}{"nope": nil}}
+	_, err = NewRelayLoadShareFromConfig(l, c)
+	assert.EqualError(t, err, "config `relay.load_share` has invalid destination: nope")
+
+	c.Settings["relay"] = map[interface{}]interface{}{"load_share": map[interface{}]interface{}{
+		"10.0.0.1": map[interface{}]interface{}{"10.0.0.100": -1},
+	}}
+	_, err = NewRelayLoadShareFromConfig(l, c)
+	assert.EqualError(t, err, "config `relay.load_share.10.0.0.1.10.0.0.100` has invalid weight: -1")
+
+	c.Settings["relay"] = map[interface{}]interface{}{"load_share": []interface{}{"10.0.0.1"}}
+	_, err = NewRelayLoadShareFromConfig(l, c)
+	assert.EqualError(t, err, "config `relay.load_share` has invalid type: []interface {}")
+}
+
+func TestRelayShareScore(t *testing.T) {
+	r1 := netip.MustParseAddr("10.0.0.100")
+	r2 := netip.MustParseAddr("10.0.0.101")
+	r3 := netip.MustParseAddr("10.0.0.102")
+
+	pick := func(flow uint64, weights map[netip.Addr]int) netip.Addr {
+		var best netip.Addr
+		var bestScore float64
+		for relayIp, w := range weights {
+			score := relayShareScore(flow, relayIp, w)
+			if !best.IsValid() || score > bestScore {
+				best, bestScore = relayIp, score
+			}
+		}
+		return best
+	}
+
+	const flows = 30000
+	counts := map[netip.Addr]int{}
+	chosen := make([]netip.Addr, flows)
+	for i := 0; i < flows; i++ {
+		fp := &firewall.Packet{
+			LocalIP:    netip.MustParseAddr("10.1.0.1"),
+			RemoteIP:   netip.MustParseAddr("10.1.0.2"),
+			LocalPort:  uint16(i),
+			RemotePort: 443,
+			Protocol:   firewall.ProtoTCP,
+		}
+		chosen[i] = pick(relayFlowHash(fp), map[netip.Addr]int{r1: 2, r2: 1, r3: 1})
+		counts[chosen[i]]++
+	}
+
+	// Flows are spread in proportion to the weights
+	assert.InDelta(t, flows/2, counts[r1], flows*0.02)
+	assert.InDelta(t, flows/4, counts[r2], flows*0.02)
+	assert.InDelta(t, flows/4, counts[r3], flows*0.02)
+
+	// Losing a relay only moves the flows that were on it
+	for i := 0; i < flows; i++ {
+		fp := &firewall.Packet{
+			LocalIP:    netip.MustParseAddr("10.1.0.1"),
+			RemoteIP:   netip.MustParseAddr("10.1.0.2"),
+			LocalPort:  uint16(i),
+			RemotePort: 443,
+			Protocol:   firewall.ProtoTCP,
+		}
+		now := pick(relayFlowHash(fp), map[netip.Addr]int{r1: 2, r2: 1})
+		if chosen[i] != r3 {
+			assert.Equal(t, chosen[i], now)
+		}
+	}
+}
+
+func TestRelayLoadShare_pick(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	them := netip.MustParseAddr("10.128.0.2")
+	relay1 := netip.MustParseAddr("10.128.0.100")
+	relay2 := netip.MustParseAddr("10.128.0.101")
+	c.Settings["relay"] = map[interface{}]interface{}{"load_share": map[interface{}]interface{}{
+		them.String(): map[interface{}]interface{}{relay2.String(): 0},
+	}}
+	rls, err := NewRelayLoadShareFromConfig(l, c)
+	require.NoError(t, err)
+
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	newRelay := func(vpnIp netip.Addr, state int) *HostInfo {
+		h := &HostInfo{
+			vpnIp:        vpnIp,
+			localIndexId: uint32(vpnIp.As4()[3]),
+			relayState: RelayState{
+				relays:        map[netip.Addr]struct{}{},
+				relayForByIp:  map[netip.Addr]*Relay{},
+				relayForByIdx: map[uint32]*Relay{},
+			},
+		}
+		h.relayState.InsertRelay(them, 1, &Relay{Type: TerminalType, State: state, PeerIp: them})
+		hm.unlockedAddHostInfo(h, &Interface{})
+		return h
+	}
+	relay1HostInfo := newRelay(relay1, Established)
+	newRelay(relay2, Established)
+
+	hostinfo := &HostInfo{
+		vpnIp:   them,
+		remotes: NewRemoteList(nil),
+		relayState: RelayState{
+			relays: map[netip.Addr]struct{}{relay1: {}},
+		},
+	}
+	// relay2 is only known from the lighthouse
+	hostinfo.remotes.Lock()
+	hostinfo.remotes.unlockedSetRelay(relay1, them, []netip.Addr{relay2})
+	hostinfo.remotes.unlockedCollect()
+	hostinfo.remotes.Unlock()
+
+	fp := &firewall.Packet{LocalIP: netip.MustParseAddr("10.128.0.1"), RemoteIP: them, LocalPort: 1, RemotePort: 2}
+	relayHostInfo, relay, ok := rls.pick(hm, hostinfo, fp, 100)
+	require.True(t, ok)
+	assert.Equal(t, relay1HostInfo, relayHostInfo)
+	assert.Equal(t, them, relay.PeerIp)
+
+	// relay2 has a weight of 0 so it is not used while relay1 is up
+	_, _, ok = rls.pick(hm, hostinfo, &firewall.Packet{LocalPort: 3}, 50)
+	require.True(t, ok)
+	assert.Equal(t, []RelayUtilization{
+		{Relay: relay1, Weight: 1, Established: true, Packets: 2, Bytes: 150},
+		{Relay: relay2, Weight: 0, Established: true},
+	}, rls.GetRelayUtilization(hm, hostinfo))
+
+	// Without an established relay the caller falls back to the normal relay selection
+	relay1HostInfo.relayState.relayForByIp[them].State = Requested
+	_, _, ok = rls.pick(hm, hostinfo, fp, 100)
+	assert.False(t, ok)
+
+	// Destinations that are not load shared are left alone
+	other := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.3"), remotes: NewRemoteList(nil)}
+	_, _, ok = rls.pick(hm, other, fp, 100)
+	assert.False(t, ok)
+	assert.Nil(t, rls.GetRelayUtilization(hm, other))
+
+	var nilShare *RelayLoadShare
+	_, _, ok = nilShare.pick(hm, hostinfo, fp, 100)
+	assert.False(t, ok)
+}
@@ -4,27 +4,75 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"net/netip"
 	"sync/atomic"
+	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
 )
 
+var (
+	errRelayUnknown        = errors.New("unknown relay")
+	errRelayDisestablished = errors.New("relay is being torn down")
+)
+
+const (
+	// relayRepairInterval is the minimum time between attempts to repair a missing relay index on a relay tunnel
+	relayRepairInterval = time.Second
+	// relayRepairMaxAttempts is the number of repairs attempted before the tunnel to the relay is torn down
+	relayRepairMaxAttempts = 3
+)
+
 type relayManager struct {
+	ctx     context.Context
 	l       *logrus.Logger
 	hostmap *HostMap
 	amRelay atomic.Bool
+
+	// drain is set once this relay started draining, see relay_drain.go
+	drain atomic.Pointer[relayDrain]
+
+	// setupTimeout and setupRetries are relay.setup_timeout and relay.setup_retries, see relay_lifecycle.go
+	setupTimeout atomic.Int64
+	setupRetries atomic.Int64
+
+	// controlRejectTeardown is relay.control_reject_action teardown, see relay_control.go
+	controlRejectTeardown atomic.Bool
+	controlMetrics        relayControlMetrics
+
+	metricMissingIndex     metrics.Counter
+	metricTeardown         metrics.Counter
+	metricDrainMigrated    metrics.Counter
+	metricSetupTimeout     metrics.Counter
+	metricTeardownSent     metrics.Counter
+	metricTeardownReceived metrics.Counter
+	metricTeardownTimeout  metrics.Counter
 }
 
 func NewRelayManager(ctx context.Context, l *logrus.Logger, hostmap *HostMap, c *config.C) *relayManager {
 	rm := &relayManager{
-		l:       l,
-		hostmap: hostmap,
+		ctx:                 ctx,
+		l:                   l,
+		hostmap:             hostmap,
+		metricMissingIndex:  metrics.GetOrRegisterCounter("relay.missing_index", nil),
+		metricTeardown:      metrics.GetOrRegisterCounter("relay.missing_index.teardown", nil),
+		metricDrainMigrated: metrics.GetOrRegisterCounter("relay.drain.migrated", nil),
+
+		metricSetupTimeout:     metrics.GetOrRegisterCounter("relay.setup.timeout", nil),
+		metricTeardownSent:     metrics.GetOrRegisterCounter("relay.teardown.sent", nil),
+		metricTeardownReceived: metrics.GetOrRegisterCounter("relay.teardown.received", nil),
+		metricTeardownTimeout:  metrics.GetOrRegisterCounter("relay.teardown.timeout", nil),
+		controlMetrics:         newRelayControlMetrics(),
+	}
+	rm.controlRejectTeardown.Store(true)
+	rm.setupTimeout.Store(int64(defaultRelaySetupTimeout))
+	rm.setupRetries.Store(defaultRelaySetupRetries)
+	if err := rm.reload(c, true); err != nil {
+		l.WithError(err).Error("Failed to load relay_manager, using the defaults")
 	}
-	rm.reload(c, true)
 	c.RegisterReloadCallback(func(c *config.C) {
 		err := rm.reload(c, false)
 		if err != nil {
@@ -38,7 +86,10 @@ func (rm *relayManager) reload(c *config.C, initial bool) error {
 	if initial || c.HasChanged("relay.am_relay") {
 		rm.setAmRelay(c.GetBool("relay.am_relay", false))
 	}
-	return nil
+	if err := rm.reloadControl(c, initial); err != nil {
+		return err
+	}
+	return rm.reloadLifecycle(c, initial)
 }
 
 func (rm *relayManager) GetAmRelay() bool {
@@ -55,7 +106,7 @@ func AddRelay(l *logrus.Logger, relayHostInfo *HostInfo, hm *HostMap, vpnIp neti
 	hm.Lock()
 	defer hm.Unlock()
 	for i := 0; i < 32; i++ {
-		index, err := generateIndex(l)
+		index, err := hm.generateIndex(l)
 		if err != nil {
 			return 0, err
 		}
@@ -68,11 +119,14 @@ func AddRelay(l *logrus.Logger, relayHostInfo *HostInfo, hm *HostMap, vpnIp neti
 			hm.unlockedMakePrimary(relayHostInfo)
 
 			hm.Relays[index] = relayHostInfo
+			now := time.Now()
 			newRelay := Relay{
 				Type:       relayType,
 				State:      state,
 				LocalIndex: index,
 				PeerIp:     vpnIp,
+				Since:      now,
+				Sent:       now,
 			}
 
 			if remoteIdx != nil {
@@ -89,25 +143,131 @@ func AddRelay(l *logrus.Logger, relayHostInfo *HostInfo, hm *HostMap, vpnIp neti
 
 // EstablishRelay updates a Requested Relay to become an Established Relay, which can pass traffic.
 func (rm *relayManager) EstablishRelay(relayHostInfo *HostInfo, m *NebulaControl) (*Relay, error) {
+	if r, ok := relayHostInfo.relayState.QueryRelayForByIdx(m.InitiatorRelayIndex); ok && r.State == Disestablished {
+		// A late answer does not bring back a relay we are tearing down
+		return nil, errRelayDisestablished
+	}
+
 	relay, ok := relayHostInfo.relayState.CompleteRelayByIdx(m.InitiatorRelayIndex, m.ResponderRelayIndex)
 	if !ok {
 		rm.l.WithFields(logrus.Fields{"relay": relayHostInfo.vpnIp,
 			"initiatorRelayIndex": m.InitiatorRelayIndex,
 			"relayFrom":           m.RelayFromIp,
 			"relayTo":             m.RelayToIp}).Info("relayManager failed to update relay")
-		return nil, fmt.Errorf("unknown relay")
+		return nil, errRelayUnknown
 	}
 
+	relayHostInfo.relayRepairAttempts.Store(0)
 	return relay, nil
 }
 
+// handleMissingRelayIndex is called when a relay packet arrived on an index the hostmap points at relayHostInfo but
+// relayHostInfo has no relay state for. This has been seen after a relay restarts and leaves the relay wedged, so we
+// try to rebuild the mapping under the same index the relay is still using. If we are the terminal end the peer is
+// found through the index in the inner header, then a CreateRelayRequest is sent which the relay will answer since
+// it already knows the index. Repairs are rate limited and if they keep failing the tunnel to the relay is closed so
+// it can be rebuilt from scratch.
+func (rm *relayManager) handleMissingRelayIndex(f *Interface, relayHostInfo *HostInfo, idx uint32, payload []byte) {
+	rm.metricMissingIndex.Inc(1)
+	logMsg := relayHostInfo.logger(rm.l).WithField("relayIndex", idx)
+
+	now := time.Now().UnixNano()
+	last := relayHostInfo.lastRelayRepair.Load()
+	if now-last < int64(relayRepairInterval) || !relayHostInfo.lastRelayRepair.CompareAndSwap(last, now) {
+		return
+	}
+
+	attempts := relayHostInfo.relayRepairAttempts.Add(1)
+	if attempts > relayRepairMaxAttempts {
+		logMsg.WithField("attempts", attempts-1).Error("Failed to repair missing relay index, closing the tunnel to the relay")
+		rm.metricTeardown.Inc(1)
+		relayHostInfo.relayRepairAttempts.Store(0)
+		rm.hostmap.RemoveRelay(idx)
+		f.sendCloseTunnel(relayHostInfo)
+		f.closeTunnel(relayHostInfo)
+		return
+	}
+
+	peer, ok := rm.relayPeerFromPayload(relayHostInfo, payload)
+	if !ok {
+		// The other end is sending on a relay only it thinks is up, have it remove its half so it is set up again
+		logMsg.WithField("attempts", attempts).Error("HostInfo missing remote relay index, unable to determine the relay peer")
+		rm.hostmap.RemoveRelay(idx)
+		rm.teardownUnknown(f, relayHostInfo, idx, 0)
+		return
+	}
+
+	relayHostInfo.relayState.InsertRelay(peer, idx, &Relay{
+		Type:       TerminalType,
+		State:      Requested,
+		LocalIndex: idx,
+		PeerIp:     peer,
+		Since:      time.Now(),
+		Sent:       time.Now(),
+	})
+
+	//TODO: IPV6-WORK
+	myVpnIpB := f.myVpnNet.Addr().As4()
+	peerB := peer.As4()
+
+	req := NebulaControl{
+		Type:                NebulaControl_CreateRelayRequest,
+		InitiatorRelayIndex: idx,
+		RelayFromIp:         binary.BigEndian.Uint32(myVpnIpB[:]),
+		RelayToIp:           binary.BigEndian.Uint32(peerB[:]),
+	}
+	msg, err := req.Marshal()
+	if err != nil {
+		logMsg.WithError(err).Error("relayManager Failed to marshal Control message to repair relay")
+		return
+	}
+
+	f.SendMessageToHostInfo(header.Control, 0, relayHostInfo, msg, make([]byte, 12), make([]byte, mtu))
+	logMsg.WithFields(logrus.Fields{"relayTo": peer, "attempts": attempts}).
+		Warn("HostInfo missing remote relay index, sent CreateRelayRequest to repair it")
+}
+
+// relayPeerFromPayload finds the vpn ip of the peer on the other side of a relay by the tunnel index in the relayed
+// packet. This only works when we are the terminal end of the relay and the tunnel to the peer is via relayHostInfo.
+func (rm *relayManager) relayPeerFromPayload(relayHostInfo *HostInfo, payload []byte) (netip.Addr, bool) {
+	h := &header.H{}
+	if err := h.Parse(payload); err != nil || h.RemoteIndex == 0 {
+		return netip.Addr{}, false
+	}
+
+	peerHostInfo := rm.hostmap.QueryIndex(h.RemoteIndex)
+	if peerHostInfo == nil || peerHostInfo == relayHostInfo {
+		return netip.Addr{}, false
+	}
+
+	for _, relayIp := range peerHostInfo.relayState.CopyRelayIps() {
+		if relayIp == relayHostInfo.vpnIp {
+			return peerHostInfo.vpnIp, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
 func (rm *relayManager) HandleControlMsg(h *HostInfo, m *NebulaControl, f *Interface) {
+	rm.controlMetrics.receivedFor(m.Type).Inc(1)
+	if reason := rm.validateControl(h, m, f.myVpnNet.Addr()); reason != "" {
+		rm.rejectControl(h, f, m, reason)
+		return
+	}
 
 	switch m.Type {
 	case NebulaControl_CreateRelayRequest:
 		rm.handleCreateRelayRequest(h, f, m)
 	case NebulaControl_CreateRelayResponse:
 		rm.handleCreateRelayResponse(h, f, m)
+	case NebulaControl_RelayDraining:
+		rm.handleRelayDraining(h, f)
+	case NebulaControl_RelayMigrated:
+		rm.handleRelayMigrated(h, m)
+	case NebulaControl_RelayTeardown:
+		rm.handleRelayTeardown(h, f, m)
+	case NebulaControl_RelayTeardownAck:
+		rm.handleRelayTeardownAck(h, m)
 	}
 
 }
@@ -129,10 +289,16 @@ func (rm *relayManager) handleCreateRelayResponse(h *HostInfo, f *Interface, m *
 	relay, err := rm.EstablishRelay(h, m)
 	if err != nil {
 		rm.l.WithError(err).Error("Failed to update relay for relayTo")
+		if errors.Is(err, errRelayUnknown) {
+			// The relay went away after the message was validated
+			rm.rejectControl(h, f, m, relayControlUnknownRelay)
+		}
 		return
 	}
 	// Do I need to complete the relays now?
 	if relay.Type == TerminalType {
+		// If the tunnel to the peer was relayed through a draining relay it can move to this one now
+		rm.finishMigration(f, rm.hostmap.QueryVpnIp(relay.PeerIp), h.vpnIp)
 		return
 	}
 	// I'm the middle man. Let the initiator know that the I've established the relay they requested.
@@ -149,7 +315,14 @@ func (rm *relayManager) handleCreateRelayResponse(h *HostInfo, f *Interface, m *
 	if peerRelay.State == PeerRequested {
 		//TODO: IPV6-WORK
 		b = peerHostInfo.vpnIp.As4()
-		peerRelay.State = Established
+		peerRelay, ok = peerHostInfo.relayState.UpdateRelay(peerRelay.LocalIndex, func(r *Relay) {
+			r.State = Established
+			r.Since = time.Now()
+			r.Attempts = 0
+		})
+		if !ok {
+			return
+		}
 		resp := NebulaControl{
 			Type:                NebulaControl_CreateRelayResponse,
 			ResponderRelayIndex: peerRelay.LocalIndex,
@@ -198,6 +371,10 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 	}
 	// Is the target of the relay me?
 	if target == f.myVpnNet.Addr() {
+		// The span joins the trace of the handshake being relayed, it ends in error on every return that does not answer
+		sp := f.tracer.start("relay.accept", spanKindServer, m.TraceParent, attr("relay", h.vpnIp), attr("relay_from", from))
+		defer sp.finish(errRelayNotAccepted)
+
 		existingRelay, ok := h.relayState.QueryRelayForByIp(from)
 		if ok {
 			switch existingRelay.State {
@@ -215,6 +392,10 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 						"existingRemoteIndex": existingRelay.RemoteIndex}).Error("Existing relay mismatch with CreateRelayRequest")
 					return
 				}
+			case Disestablished:
+				// The request is answered once the teardown is over and the relay can be set up from scratch
+				logMsg.Info("Ignoring CreateRelayRequest for a relay being torn down")
+				return
 			}
 		} else {
 			_, err := AddRelay(rm.l, h, f.hostMap, from, &m.InitiatorRelayIndex, TerminalType, Established)
@@ -255,11 +436,21 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 				"responderRelayIndex": resp.ResponderRelayIndex,
 				"vpnIp":               h.vpnIp}).
 				Info("send CreateRelayResponse")
+			sp.finish(nil)
 		}
+		rm.finishMigration(f, rm.hostmap.QueryVpnIp(from), h.vpnIp)
 		return
 	} else {
 		// the target is not me. Create a relay to the target, from me.
-		if !rm.GetAmRelay() {
+		if !rm.GetAmRelay() || f.observer.Enabled() {
+			return
+		}
+		if rm.drain.Load() != nil {
+			logMsg.Info("Refusing to forward a relay while draining")
+			return
+		}
+		// Packets would be dropped on the way anyway, don't set up the forward or a tunnel to the target for them
+		if !f.relayForwardScope.allowForward(h, target) {
 			return
 		}
 		peer := rm.hostmap.QueryVpnIp(target)
@@ -277,6 +468,11 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 		var index uint32
 		var err error
 		targetRelay, ok := peer.relayState.QueryRelayForByIp(from)
+		if existing, found := h.relayState.QueryRelayForByIp(target); (ok && targetRelay.State == Disestablished) ||
+			(found && existing.State == Disestablished) {
+			logMsg.Info("Ignoring CreateRelayRequest for a relay being torn down")
+			return
+		}
 		if ok {
 			index = targetRelay.LocalIndex
 			if targetRelay.State == Requested {
@@ -295,14 +491,17 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 			fromB := h.vpnIp.As4()
 			targetB := target.As4()
 
-			// Send a CreateRelayRequest to the peer.
+			// Send a CreateRelayRequest to the peer, carrying the trace of the handshake being relayed on to it
+			sp := f.tracer.start("relay.forward", spanKindServer, m.TraceParent, attr("relay_from", h.vpnIp), attr("relay_to", target))
 			req := NebulaControl{
 				Type:                NebulaControl_CreateRelayRequest,
 				InitiatorRelayIndex: index,
 				RelayFromIp:         binary.BigEndian.Uint32(fromB[:]),
 				RelayToIp:           binary.BigEndian.Uint32(targetB[:]),
+				TraceParent:         sp.traceParent(),
 			}
 			msg, err := req.Marshal()
+			sp.finish(err)
 			if err != nil {
 				logMsg.
 					WithError(err).Error("relayManager Failed to marshal Control message to create relay")
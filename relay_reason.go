@@ -0,0 +1,86 @@
+package nebula
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// RelayReasonCode is why a tunnel was established through a relay instead of directly
+type RelayReasonCode string
+
+const (
+	// RelayReasonNoAddrs means we had no underlay address for the peer to try, or all of them were blocked
+	RelayReasonNoAddrs RelayReasonCode = "no_direct_addrs"
+	// RelayReasonSendFailed means every direct handshake failed to leave this host, usually a local firewall or a missing
+	// route, see RelayReason.LastSendError
+	RelayReasonSendFailed RelayReasonCode = "direct_send_failed"
+	// RelayReasonSymmetricNAT means direct handshakes went out but our lighthouses classify us as behind a symmetric NAT,
+	// hole punching is unlikely to ever work
+	RelayReasonSymmetricNAT RelayReasonCode = "symmetric_nat"
+	// RelayReasonTimeout means direct handshakes went out but the relay answered first, the hole punch did not get
+	// through in time or something between us and the peer drops the traffic
+	RelayReasonTimeout RelayReasonCode = "direct_timeout"
+	// RelayReasonPeerInitiated means the peer started the handshake through a relay, we did not try anything directly
+	RelayReasonPeerInitiated RelayReasonCode = "peer_initiated"
+)
+
+// RelayReason is recorded when a handshake completes through a relay, it is reported on the control socket and logged
+// with the completed handshake
+type RelayReason struct {
+	Reason RelayReasonCode `json:"reason"`
+	// Attempted holds the underlay addresses we sent a handshake to directly before the relay answered
+	Attempted []netip.AddrPort `json:"attempted"`
+	// Attempts is how many times the handshake was sent
+	Attempts int64 `json:"attempts"`
+	// SendErrors counts direct handshake sends that failed locally, LastSendError is the most recent error
+	SendErrors    int    `json:"sendErrors"`
+	LastSendError string `json:"lastSendError,omitempty"`
+	// NATType is what our lighthouses made of our NAT when the handshake completed
+	NATType NATType `json:"natType"`
+}
+
+// directAttempts tracks the direct handshake sends of an outbound handshake, it lives on the HandshakeHostInfo
+type directAttempts struct {
+	attempted     []netip.AddrPort
+	sendErrors    int
+	lastSendError error
+}
+
+// sent records the outcome of a direct handshake send to addr
+func (d *directAttempts) sent(addr netip.AddrPort, err error) {
+	if err != nil {
+		d.sendErrors++
+		d.lastSendError = err
+		return
+	}
+
+	if !slices.Contains(d.attempted, addr) {
+		d.attempted = append(d.attempted, addr)
+	}
+}
+
+// relayReason explains why the handshake completed through a relay, hh must be locked
+func (hh *HandshakeHostInfo) relayReason(natType NATType) *RelayReason {
+	r := &RelayReason{
+		Attempted:  slices.Clone(hh.direct.attempted),
+		Attempts:   hh.counter,
+		SendErrors: hh.direct.sendErrors,
+		NATType:    natType,
+	}
+	if hh.direct.lastSendError != nil {
+		r.LastSendError = hh.direct.lastSendError.Error()
+	}
+
+	switch {
+	case len(r.Attempted) == 0 && r.SendErrors > 0:
+		r.Reason = RelayReasonSendFailed
+	case len(r.Attempted) == 0:
+		r.Reason = RelayReasonNoAddrs
+	case natType == NATSymmetric:
+		r.Reason = RelayReasonSymmetricNAT
+	default:
+		r.Reason = RelayReasonTimeout
+	}
+
+	return r
+}
@@ -0,0 +1,45 @@
+package nebula
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshakeHostInfo_relayReason(t *testing.T) {
+	addr1 := netip.MustParseAddrPort("192.0.2.1:4242")
+	addr2 := netip.MustParseAddrPort("198.51.100.1:4242")
+
+	hh := &HandshakeHostInfo{counter: 3}
+	r := hh.relayReason(NATCone)
+	assert.Equal(t, RelayReasonNoAddrs, r.Reason)
+	assert.EqualValues(t, 3, r.Attempts)
+	assert.Equal(t, NATCone, r.NATType)
+
+	// Every send failing locally points at our side
+	hh.direct.sent(addr1, errors.New("operation not permitted"))
+	hh.direct.sent(addr1, errors.New("operation not permitted"))
+	r = hh.relayReason(NATCone)
+	assert.Equal(t, RelayReasonSendFailed, r.Reason)
+	assert.Equal(t, 2, r.SendErrors)
+	assert.Equal(t, "operation not permitted", r.LastSendError)
+	assert.Empty(t, r.Attempted)
+
+	// Once something went out the peer never answering directly is the reason, addresses are only listed once
+	hh.direct.sent(addr1, nil)
+	hh.direct.sent(addr2, nil)
+	hh.direct.sent(addr1, nil)
+	r = hh.relayReason(NATCone)
+	assert.Equal(t, RelayReasonTimeout, r.Reason)
+	assert.Equal(t, []netip.AddrPort{addr1, addr2}, r.Attempted)
+	assert.Equal(t, 2, r.SendErrors)
+
+	r = hh.relayReason(NATSymmetric)
+	assert.Equal(t, RelayReasonSymmetricNAT, r.Reason)
+
+	// The reason is a copy
+	r.Attempted[0] = netip.AddrPort{}
+	assert.Equal(t, addr1, hh.direct.attempted[0])
+}
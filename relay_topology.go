@@ -0,0 +1,131 @@
+package nebula
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// RelayTopology is this node's view of the relay mesh as a graph. Every relay entry in our hostmap is an edge, the
+// relay tunnels we have with relays and the forwards we carry for others. Combining the output of several nodes gives
+// a map of the whole relay mesh, LocalIndex and RemoteIndex of an edge match the swapped indexes on the Tunnel peer.
+type RelayTopology struct {
+	VpnIp netip.Addr          `json:"vpnIp"`
+	Nodes []RelayTopologyNode `json:"nodes"`
+	Edges []RelayTopologyEdge `json:"edges"`
+}
+
+// RelayTopologyNode is a vpn ip that appears in at least one edge
+type RelayTopologyNode struct {
+	VpnIp netip.Addr `json:"vpnIp"`
+	// Roles is any of self, relay (we reach a peer through it), relayed (we reach it through a relay), and forwarded (we
+	// relay traffic to or from it)
+	Roles []string `json:"roles"`
+}
+
+// RelayTopologyEdge is a single relay, traffic flows between From and To through Via
+type RelayTopologyEdge struct {
+	// Type is terminal if we are an end of the relay or forwarding if we are the relay
+	Type  string `json:"type"`
+	State string `json:"state"`
+	// StateSeconds is how long the relay has been in State
+	StateSeconds int64 `json:"stateSeconds"`
+	// Attempts is how many times the request or teardown of a relay that is not established was sent again
+	Attempts int        `json:"attempts,omitempty"`
+	From     netip.Addr `json:"from"`
+	To       netip.Addr `json:"to"`
+	Via      netip.Addr `json:"via"`
+	// Tunnel is the peer of the tunnel the relay is carried on, the indexes are only meaningful on this tunnel
+	Tunnel      netip.Addr `json:"tunnel"`
+	LocalIndex  uint32     `json:"localIndex"`
+	RemoteIndex uint32     `json:"remoteIndex"`
+}
+
+const (
+	relayRoleSelf      = "self"
+	relayRoleRelay     = "relay"
+	relayRoleRelayed   = "relayed"
+	relayRoleForwarded = "forwarded"
+)
+
+func relayTypeString(t int) string {
+	switch t {
+	case ForwardingType:
+		return "forwarding"
+	case TerminalType:
+		return "terminal"
+	default:
+		return "unknown"
+	}
+}
+
+func relayStateString(s int) string {
+	switch s {
+	case Requested:
+		return "requested"
+	case PeerRequested:
+		return "peer_requested"
+	case Established:
+		return "established"
+	case Disestablished:
+		return "disestablished"
+	default:
+		return "unknown"
+	}
+}
+
+// relayTopology snapshots the relay state of every tunnel in hm. The hostmap is locked for the duration so tunnels and
+// relays can not come and go half way through.
+func relayTopology(hm *HostMap, self netip.Addr) RelayTopology {
+	t := RelayTopology{VpnIp: self, Edges: []RelayTopologyEdge{}}
+	roles := map[netip.Addr][]string{self: {relayRoleSelf}}
+	addRole := func(vpnIp netip.Addr, role string) {
+		if !slices.Contains(roles[vpnIp], role) {
+			roles[vpnIp] = append(roles[vpnIp], role)
+		}
+	}
+
+	now := time.Now()
+	hm.RLock()
+	for _, hi := range hm.Indexes {
+		hi.relayState.RLock()
+		for _, r := range hi.relayState.relayForByIdx {
+			e := RelayTopologyEdge{
+				Type:         relayTypeString(r.Type),
+				State:        relayStateString(r.State),
+				StateSeconds: int64(now.Sub(r.Since).Seconds()),
+				Attempts:     r.Attempts,
+				Tunnel:       hi.vpnIp,
+				LocalIndex:   r.LocalIndex,
+				RemoteIndex:  r.RemoteIndex,
+			}
+
+			if r.Type == ForwardingType {
+				e.From, e.To, e.Via = hi.vpnIp, r.PeerIp, self
+				addRole(hi.vpnIp, relayRoleForwarded)
+				addRole(r.PeerIp, relayRoleForwarded)
+			} else {
+				e.From, e.To, e.Via = self, r.PeerIp, hi.vpnIp
+				addRole(hi.vpnIp, relayRoleRelay)
+				addRole(r.PeerIp, relayRoleRelayed)
+			}
+			t.Edges = append(t.Edges, e)
+		}
+		hi.relayState.RUnlock()
+	}
+	hm.RUnlock()
+
+	slices.SortFunc(t.Edges, func(a, b RelayTopologyEdge) int {
+		if c := a.Tunnel.Compare(b.Tunnel); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.LocalIndex, b.LocalIndex)
+	})
+
+	for vpnIp, r := range roles {
+		t.Nodes = append(t.Nodes, RelayTopologyNode{VpnIp: vpnIp, Roles: r})
+	}
+	slices.SortFunc(t.Nodes, func(a, b RelayTopologyNode) int { return a.VpnIp.Compare(b.VpnIp) })
+	return t
+}
@@ -0,0 +1,64 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelayTopology(t *testing.T) {
+	l := test.NewLogger()
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	self := netip.MustParseAddr("10.128.0.1")
+
+	newPeer := func(vpnIp netip.Addr, idx uint32) *HostInfo {
+		h := &HostInfo{
+			vpnIp:        vpnIp,
+			localIndexId: idx,
+			relayState: RelayState{
+				relays:        map[netip.Addr]struct{}{},
+				relayForByIp:  map[netip.Addr]*Relay{},
+				relayForByIdx: map[uint32]*Relay{},
+			},
+		}
+		hm.unlockedAddHostInfo(h, &Interface{})
+		return h
+	}
+
+	assert.Equal(t, RelayTopology{
+		VpnIp: self,
+		Nodes: []RelayTopologyNode{{VpnIp: self, Roles: []string{relayRoleSelf}}},
+		Edges: []RelayTopologyEdge{},
+	}, relayTopology(hm, self))
+
+	relay := newPeer(netip.MustParseAddr("10.128.0.2"), 2)
+	target := netip.MustParseAddr("10.128.0.3")
+	a := newPeer(netip.MustParseAddr("10.128.0.4"), 4)
+	b := newPeer(netip.MustParseAddr("10.128.0.5"), 5)
+
+	remoteIdx := uint32(99)
+	termIdx, err := AddRelay(l, relay, hm, target, &remoteIdx, TerminalType, Established)
+	require.NoError(t, err)
+	aIdx, err := AddRelay(l, a, hm, b.vpnIp, nil, ForwardingType, Requested)
+	require.NoError(t, err)
+	bIdx, err := AddRelay(l, b, hm, a.vpnIp, nil, ForwardingType, PeerRequested)
+	require.NoError(t, err)
+
+	topo := relayTopology(hm, self)
+	assert.Equal(t, []RelayTopologyNode{
+		{VpnIp: self, Roles: []string{relayRoleSelf}},
+		{VpnIp: relay.vpnIp, Roles: []string{relayRoleRelay}},
+		{VpnIp: target, Roles: []string{relayRoleRelayed}},
+		{VpnIp: a.vpnIp, Roles: []string{relayRoleForwarded}},
+		{VpnIp: b.vpnIp, Roles: []string{relayRoleForwarded}},
+	}, topo.Nodes)
+
+	assert.Equal(t, []RelayTopologyEdge{
+		{Type: "terminal", State: "established", From: self, To: target, Via: relay.vpnIp, Tunnel: relay.vpnIp, LocalIndex: termIdx, RemoteIndex: 99},
+		{Type: "forwarding", State: "requested", From: a.vpnIp, To: b.vpnIp, Via: self, Tunnel: a.vpnIp, LocalIndex: aIdx},
+		{Type: "forwarding", State: "peer_requested", From: b.vpnIp, To: a.vpnIp, Via: self, Tunnel: b.vpnIp, LocalIndex: bIdx},
+	}, topo.Edges)
+}
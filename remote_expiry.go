@@ -0,0 +1,94 @@
+package nebula
+
+import (
+	"context"
+	"maps"
+	"net/netip"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	minRemoteExpiryCheck = time.Second
+	maxRemoteExpiryCheck = 30 * time.Second
+)
+
+// RunRemoteExpiry drops learned and reported remotes that have not been refreshed within lighthouse.remote_ttl until
+// ctx is done. Closing a tunnel only forgets the remotes of a host once its last tunnel is gone, without a ttl a tunnel
+// that lingers on a bad path keeps addresses around that TryPromoteBest could roam to long after they stopped working.
+// The address a tunnel is currently using is never dropped.
+func (lh *LightHouse) RunRemoteExpiry(ctx context.Context, hm *HostMap) {
+	active := func(vpnIp netip.Addr) netip.AddrPort {
+		if h := hm.QueryVpnIp(vpnIp); h != nil {
+			return h.remote
+		}
+		return netip.AddrPort{}
+	}
+
+	timer := time.NewTimer(lh.remoteExpiryCheck())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-timer.C:
+			lh.expireRemotes(now, active)
+			timer.Reset(lh.remoteExpiryCheck())
+		}
+	}
+}
+
+// remoteExpiryCheck is how long to wait between expiry checks, often enough that a remote outlives the ttl by at most
+// a quarter of it. The ttl is checked even when disabled to pick up a reload.
+func (lh *LightHouse) remoteExpiryCheck() time.Duration {
+	ttl := time.Duration(lh.remoteTTL.Load())
+	if ttl <= 0 {
+		return maxRemoteExpiryCheck
+	}
+	return min(max(ttl/4, minRemoteExpiryCheck), maxRemoteExpiryCheck)
+}
+
+// expireRemotes drops every remote older than lighthouse.remote_ttl as of now, except for the address active returns
+// for the host. Lighthouses do not expire anything, their cache is kept fresh by host updates.
+func (lh *LightHouse) expireRemotes(now time.Time, active func(netip.Addr) netip.AddrPort) int {
+	ttl := time.Duration(lh.remoteTTL.Load())
+	if ttl <= 0 || lh.amLighthouse {
+		return 0
+	}
+
+	lh.RLock()
+	lists := maps.Clone(lh.addrMap)
+	lh.RUnlock()
+
+	cutoff := now.Add(-ttl)
+	me := lh.myVpnNet.Addr()
+	expired := 0
+	for vpnIp, rl := range lists {
+		keep := active(vpnIp)
+		rl.Lock()
+		n := rl.unlockedExpire(cutoff, keep, me)
+		rl.Unlock()
+
+		if n > 0 && lh.l.Level >= logrus.DebugLevel {
+			lh.l.WithField("vpnIp", vpnIp).WithField("expired", n).Debug("Expired stale remotes")
+		}
+		expired += n
+	}
+
+	lh.metricExpiredRemotes.Inc(int64(expired))
+	return expired
+}
+
+// RemoteCandidates lists the remotes known for vpnIp with their age, without querying the lighthouses
+func (lh *LightHouse) RemoteCandidates(vpnIp netip.Addr) []RemoteCandidate {
+	lh.RLock()
+	rl := lh.addrMap[vpnIp]
+	lh.RUnlock()
+
+	if rl == nil {
+		return nil
+	}
+	return rl.CopyCandidates(time.Now())
+}
@@ -0,0 +1,106 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLightHouse_expireRemotes(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"hosts":      []interface{}{"10.128.0.2"},
+		"remote_ttl": "1m",
+	}
+	c.Settings["static_host_map"] = map[interface{}]interface{}{
+		"10.128.0.2": []interface{}{"1.1.1.2:4242"},
+		"10.128.0.3": []interface{}{"1.1.1.3:4242"},
+	}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, netip.MustParsePrefix("10.128.0.1/16"), nil, nil)
+	require.NoError(t, err)
+
+	lhIp := netip.MustParseAddr("10.128.0.2")
+	peer := netip.MustParseAddr("10.128.0.100")
+	static := netip.MustParseAddr("10.128.0.3")
+	learned := netip.MustParseAddrPort("2.2.2.2:4242")
+	inUse := netip.MustParseAddrPort("[::ffff:3.3.3.3]:4242")
+	fresh := netip.MustParseAddrPort("[2001::1]:4242")
+	always := func(netip.Addr, *Ip4AndPort) bool { return true }
+	alwaysV6 := func(netip.Addr, *Ip6AndPort) bool { return true }
+
+	rl := lh.QueryCache(peer)
+	rl.LearnRemote(peer, learned)
+	rl.Lock()
+	rl.unlockedSetV4(lhIp, peer, []*Ip4AndPort{newIp4AndPortFromString("3.3.3.3:4242"), newIp4AndPortFromString("4.4.4.4:4242")}, always)
+	rl.unlockedSetV6(lhIp, peer, []*Ip6AndPort{NewIp6AndPortFromNetIP(fresh.Addr(), fresh.Port())}, alwaysV6)
+	rl.Unlock()
+
+	now := time.Now()
+	active := func(vpnIp netip.Addr) netip.AddrPort {
+		if vpnIp == peer {
+			return inUse
+		}
+		return netip.AddrPort{}
+	}
+
+	t.Log("Nothing is old enough yet")
+	assert.Equal(t, 0, lh.expireRemotes(now, active))
+	assert.Len(t, lh.RemoteCandidates(peer), 4)
+
+	t.Log("Stale candidates are dropped but the address in use is kept")
+	rl.Lock()
+	rl.cache[peer].v4.learnedAt = now.Add(-2 * time.Minute)
+	rl.cache[lhIp].v4.reportedAt = now.Add(-2 * time.Minute)
+	rl.Unlock()
+
+	before := lh.metricExpiredRemotes.Count()
+	assert.Equal(t, 2, lh.expireRemotes(now, active))
+	assert.Equal(t, before+2, lh.metricExpiredRemotes.Count())
+
+	cs := rl.CopyCandidates(now)
+	require.Len(t, cs, 2)
+	assert.Equal(t, fresh, cs[0].Addr)
+	assert.Equal(t, netip.MustParseAddrPort("3.3.3.3:4242"), cs[1].Addr)
+	assert.Equal(t, lhIp, cs[1].Owner)
+	assert.False(t, cs[1].Learned)
+	assert.Equal(t, 2*time.Minute, cs[1].Age)
+	assert.Equal(t, []netip.AddrPort{fresh, netip.MustParseAddrPort("3.3.3.3:4242")}, rl.CopyAddrs(nil))
+
+	t.Log("Once the v6 address ages out only static remotes and the address in use are left")
+	assert.Equal(t, 1, lh.expireRemotes(now.Add(time.Hour), active))
+	cs = lh.RemoteCandidates(static)
+	require.Len(t, cs, 1)
+	assert.Equal(t, netip.MustParseAddrPort("1.1.1.3:4242"), cs[0].Addr)
+	assert.Equal(t, time.Duration(0), cs[0].Age)
+	assert.Len(t, lh.RemoteCandidates(peer), 1, "only the address in use survives")
+
+	t.Log("A ttl of 0 disables expiry")
+	require.NoError(t, c.ReloadConfigString(`
+lighthouse:
+  hosts: ["10.128.0.2"]
+  remote_ttl: 0s
+static_host_map:
+  "10.128.0.2": ["1.1.1.2:4242"]
+  "10.128.0.3": ["1.1.1.3:4242"]
+`))
+	rl.LearnRemote(peer, learned)
+	assert.Equal(t, 0, lh.expireRemotes(now.Add(time.Hour), func(netip.Addr) netip.AddrPort { return netip.AddrPort{} }))
+	assert.Equal(t, maxRemoteExpiryCheck, lh.remoteExpiryCheck())
+}
+
+func TestLightHouse_remoteExpiryCheck(t *testing.T) {
+	lh := &LightHouse{}
+	lh.remoteTTL.Store(int64(time.Minute))
+	assert.Equal(t, 15*time.Second, lh.remoteExpiryCheck())
+	lh.remoteTTL.Store(int64(time.Second))
+	assert.Equal(t, minRemoteExpiryCheck, lh.remoteExpiryCheck())
+	lh.remoteTTL.Store(int64(time.Hour))
+	assert.Equal(t, maxRemoteExpiryCheck, lh.remoteExpiryCheck())
+}
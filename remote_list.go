@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"net/netip"
+	"slices"
 	"sort"
 	"strconv"
 	"sync"
@@ -40,6 +41,9 @@ type cache struct {
 	v4    *cacheV4
 	v6    *cacheV6
 	relay *cacheRelay
+
+	// encrypted holds the addresses the owner sealed with lighthouse.address_encryption, only a lighthouse stores it
+	encrypted []byte
 }
 
 type cacheRelay struct {
@@ -50,12 +54,28 @@ type cacheRelay struct {
 type cacheV4 struct {
 	learned  *Ip4AndPort
 	reported []*Ip4AndPort
+
+	// When learned and reported were last set, used to expire stale entries with lighthouse.remote_ttl
+	learnedAt  time.Time
+	reportedAt time.Time
 }
 
 // cacheV4 stores learned and reported ipv6 records under cache
 type cacheV6 struct {
 	learned  *Ip6AndPort
 	reported []*Ip6AndPort
+
+	learnedAt  time.Time
+	reportedAt time.Time
+}
+
+// RemoteCandidate is a learned or reported address for a host and how long ago it was last set. Static and calculated
+// remotes have no age since they never expire.
+type RemoteCandidate struct {
+	Addr    netip.AddrPort `json:"addr"`
+	Owner   netip.Addr     `json:"owner"`
+	Learned bool           `json:"learned"`
+	Age     time.Duration  `json:"age"`
 }
 
 type hostnamePort struct {
@@ -265,6 +285,14 @@ func (r *RemoteList) CopyAddrs(preferredRanges []netip.Prefix) []netip.AddrPort
 	return c
 }
 
+// CopyRelays locks and makes a copy of the relays we know of for this host
+func (r *RemoteList) CopyRelays() []netip.Addr {
+	r.RLock()
+	defer r.RUnlock()
+
+	return slices.Clone(r.relays)
+}
+
 // LearnRemote locks and sets the learned slot for the owner vpn ip to the provided addr
 // Currently this is only needed when HostInfo.SetRemote is called as that should cover both handshaking and roaming.
 // It will mark the deduplicated address list as dirty, so do not call it unless new information is available
@@ -272,8 +300,8 @@ func (r *RemoteList) CopyAddrs(preferredRanges []netip.Prefix) []netip.AddrPort
 func (r *RemoteList) LearnRemote(ownerVpnIp netip.Addr, remote netip.AddrPort) {
 	r.Lock()
 	defer r.Unlock()
-	if remote.Addr().Is4() {
-		r.unlockedSetLearnedV4(ownerVpnIp, NewIp4AndPortFromNetIP(remote.Addr(), remote.Port()))
+	if remote.Addr().Unmap().Is4() {
+		r.unlockedSetLearnedV4(ownerVpnIp, NewIp4AndPortFromNetIP(remote.Addr().Unmap(), remote.Port()))
 	} else {
 		r.unlockedSetLearnedV6(ownerVpnIp, NewIp6AndPortFromNetIP(remote.Addr(), remote.Port()))
 	}
@@ -332,6 +360,49 @@ func (r *RemoteList) CopyCache() *CacheMap {
 	return &cm
 }
 
+// CopyCandidates locks and lists every learned and reported address in the cache with its age as of now.
+// This may contain duplicates and blocked addresses
+func (r *RemoteList) CopyCandidates(now time.Time) []RemoteCandidate {
+	r.RLock()
+	defer r.RUnlock()
+
+	age := func(t time.Time) time.Duration {
+		if t.IsZero() {
+			return 0
+		}
+		return now.Sub(t)
+	}
+
+	var cs []RemoteCandidate
+	for owner, mc := range r.cache {
+		if mc.v4 != nil {
+			if mc.v4.learned != nil {
+				cs = append(cs, RemoteCandidate{Addr: AddrPortFromIp4AndPort(mc.v4.learned), Owner: owner, Learned: true, Age: age(mc.v4.learnedAt)})
+			}
+			for _, a := range mc.v4.reported {
+				cs = append(cs, RemoteCandidate{Addr: AddrPortFromIp4AndPort(a), Owner: owner, Age: age(mc.v4.reportedAt)})
+			}
+		}
+
+		if mc.v6 != nil {
+			if mc.v6.learned != nil {
+				cs = append(cs, RemoteCandidate{Addr: AddrPortFromIp6AndPort(mc.v6.learned), Owner: owner, Learned: true, Age: age(mc.v6.learnedAt)})
+			}
+			for _, a := range mc.v6.reported {
+				cs = append(cs, RemoteCandidate{Addr: AddrPortFromIp6AndPort(a), Owner: owner, Age: age(mc.v6.reportedAt)})
+			}
+		}
+	}
+
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].Age != cs[j].Age {
+			return cs[i].Age < cs[j].Age
+		}
+		return cs[i].Addr.Compare(cs[j].Addr) < 0
+	})
+	return cs
+}
+
 // BlockRemote locks and records the address as bad, it will be excluded from the deduplicated address list
 func (r *RemoteList) BlockRemote(bad netip.AddrPort) {
 	if !bad.IsValid() {
@@ -389,6 +460,64 @@ func (r *RemoteList) Rebuild(preferredRanges []netip.Prefix) {
 	r.unlockedSort(preferredRanges)
 }
 
+// unlockedExpire assumes you have the write lock and drops the learned and reported addresses that were last set before
+// cutoff. keep, the address the tunnel is currently using, and everything owned by skipOwner, our own static and
+// calculated remotes, are never dropped. It returns how many addresses were dropped and marks the deduplicated address
+// list as dirty if there were any.
+func (r *RemoteList) unlockedExpire(cutoff time.Time, keep netip.AddrPort, skipOwner netip.Addr) int {
+	keep = netip.AddrPortFrom(keep.Addr().Unmap(), keep.Port())
+	expired := 0
+
+	for owner, c := range r.cache {
+		if owner == skipOwner {
+			continue
+		}
+
+		if c.v4 != nil {
+			if c.v4.learned != nil && c.v4.learnedAt.Before(cutoff) && AddrPortFromIp4AndPort(c.v4.learned) != keep {
+				c.v4.learned = nil
+				expired++
+			}
+
+			if len(c.v4.reported) > 0 && c.v4.reportedAt.Before(cutoff) {
+				reported := c.v4.reported[:0]
+				for _, v := range c.v4.reported {
+					if AddrPortFromIp4AndPort(v) == keep {
+						reported = append(reported, v)
+					} else {
+						expired++
+					}
+				}
+				c.v4.reported = reported
+			}
+		}
+
+		if c.v6 != nil {
+			if c.v6.learned != nil && c.v6.learnedAt.Before(cutoff) && AddrPortFromIp6AndPort(c.v6.learned) != keep {
+				c.v6.learned = nil
+				expired++
+			}
+
+			if len(c.v6.reported) > 0 && c.v6.reportedAt.Before(cutoff) {
+				reported := c.v6.reported[:0]
+				for _, v := range c.v6.reported {
+					if AddrPortFromIp6AndPort(v) == keep {
+						reported = append(reported, v)
+					} else {
+						expired++
+					}
+				}
+				c.v6.reported = reported
+			}
+		}
+	}
+
+	if expired > 0 {
+		r.shouldRebuild = true
+	}
+	return expired
+}
+
 // unlockedIsBad assumes you have the write lock and checks if the remote matches any entry in the blocked address list
 func (r *RemoteList) unlockedIsBad(remote netip.AddrPort) bool {
 	for _, v := range r.badRemotes {
@@ -403,7 +532,9 @@ func (r *RemoteList) unlockedIsBad(remote netip.AddrPort) bool {
 // deduplicated address list as dirty
 func (r *RemoteList) unlockedSetLearnedV4(ownerVpnIp netip.Addr, to *Ip4AndPort) {
 	r.shouldRebuild = true
-	r.unlockedGetOrMakeV4(ownerVpnIp).learned = to
+	c := r.unlockedGetOrMakeV4(ownerVpnIp)
+	c.learned = to
+	c.learnedAt = time.Now()
 }
 
 // unlockedSetV4 assumes you have the write lock and resets the reported list of ips for this owner to the list provided
@@ -411,6 +542,7 @@ func (r *RemoteList) unlockedSetLearnedV4(ownerVpnIp netip.Addr, to *Ip4AndPort)
 func (r *RemoteList) unlockedSetV4(ownerVpnIp, vpnIp netip.Addr, to []*Ip4AndPort, check checkFuncV4) {
 	r.shouldRebuild = true
 	c := r.unlockedGetOrMakeV4(ownerVpnIp)
+	c.reportedAt = time.Now()
 
 	// Reset the slice
 	c.reported = c.reported[:0]
@@ -434,6 +566,24 @@ func (r *RemoteList) unlockedSetRelay(ownerVpnIp, vpnIp netip.Addr, to []netip.A
 	c.relay = append(c.relay, to[:minInt(len(to), MaxRemotes)]...)
 }
 
+// unlockedSetEncrypted assumes you have the write lock and replaces the sealed addresses for this owner. The blob is
+// copied since it usually points into a packet buffer.
+func (r *RemoteList) unlockedSetEncrypted(ownerVpnIp netip.Addr, to []byte) {
+	am := r.cache[ownerVpnIp]
+	if am == nil {
+		if len(to) == 0 {
+			return
+		}
+		am = &cache{}
+		r.cache[ownerVpnIp] = am
+	}
+
+	am.encrypted = append(am.encrypted[:0], to...)
+	if len(am.encrypted) == 0 {
+		am.encrypted = nil
+	}
+}
+
 // unlockedPrependV4 assumes you have the write lock and prepends the address in the reported list for this owner
 // This is only useful for establishing static hosts
 func (r *RemoteList) unlockedPrependV4(ownerVpnIp netip.Addr, to *Ip4AndPort) {
@@ -451,7 +601,9 @@ func (r *RemoteList) unlockedPrependV4(ownerVpnIp netip.Addr, to *Ip4AndPort) {
 // deduplicated address list as dirty
 func (r *RemoteList) unlockedSetLearnedV6(ownerVpnIp netip.Addr, to *Ip6AndPort) {
 	r.shouldRebuild = true
-	r.unlockedGetOrMakeV6(ownerVpnIp).learned = to
+	c := r.unlockedGetOrMakeV6(ownerVpnIp)
+	c.learned = to
+	c.learnedAt = time.Now()
 }
 
 // unlockedSetV6 assumes you have the write lock and resets the reported list of ips for this owner to the list provided
@@ -459,6 +611,7 @@ func (r *RemoteList) unlockedSetLearnedV6(ownerVpnIp netip.Addr, to *Ip6AndPort)
 func (r *RemoteList) unlockedSetV6(ownerVpnIp, vpnIp netip.Addr, to []*Ip6AndPort, check checkFuncV6) {
 	r.shouldRebuild = true
 	c := r.unlockedGetOrMakeV6(ownerVpnIp)
+	c.reportedAt = time.Now()
 
 	// Reset the slice
 	c.reported = c.reported[:0]
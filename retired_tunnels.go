@@ -0,0 +1,60 @@
+package nebula
+
+import (
+	"time"
+)
+
+// retiredTunnelGrace is how long a tunnel that was replaced by a newer tunnel to the same vpn ip keeps decrypting. A
+// rehandshake gives the new tunnel new keys and a new index, packets the peer sent with the old keys just before it
+// switched are still in flight and would otherwise be dropped as soon as the old tunnel is removed.
+const retiredTunnelGrace = 10 * time.Second
+
+// retiredTunnel is a removed tunnel whose index and keys are still accepted for data packets until the unix nano time
+type retiredTunnel struct {
+	hostinfo *HostInfo
+	until    int64
+}
+
+// unlockedRetire keeps hostinfo reachable by its local index for retiredTunnelGrace if another tunnel to the same vpn
+// ip replaces it. Must be called before hostinfo is unlinked. hm must be locked.
+func (hm *HostMap) unlockedRetire(hostinfo *HostInfo, now time.Time) {
+	if hostinfo.next == nil && hostinfo.prev == nil {
+		// This is the last tunnel to the vpn ip, nothing replaced it
+		return
+	}
+
+	if hostinfo.ConnectionState == nil || hostinfo.ConnectionState.dKey == nil {
+		return
+	}
+
+	if hm.retired == nil {
+		hm.retired = map[uint32]retiredTunnel{}
+	}
+
+	nowNano := now.UnixNano()
+	for index, rt := range hm.retired {
+		if rt.until <= nowNano {
+			delete(hm.retired, index)
+		}
+	}
+
+	hm.retired[hostinfo.localIndexId] = retiredTunnel{hostinfo: hostinfo, until: now.Add(retiredTunnelGrace).UnixNano()}
+}
+
+// QueryRetiredIndex returns a recently replaced tunnel by its local index. It is only returned while a tunnel to the
+// same vpn ip still exists, the retired tunnel must only be used to decrypt data packets with its own keys and window.
+func (hm *HostMap) QueryRetiredIndex(index uint32, now time.Time) *HostInfo {
+	hm.RLock()
+	defer hm.RUnlock()
+
+	rt, ok := hm.retired[index]
+	if !ok || rt.until <= now.UnixNano() {
+		return nil
+	}
+
+	if _, ok := hm.Hosts[rt.hostinfo.vpnIp]; !ok {
+		return nil
+	}
+
+	return rt.hostinfo
+}
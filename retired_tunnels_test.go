@@ -0,0 +1,51 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostMap_QueryRetiredIndex(t *testing.T) {
+	l := test.NewLogger()
+	hm := newHostMap(l, netip.MustParsePrefix("10.0.0.1/24"))
+	f := &Interface{}
+
+	vpnIp := netip.MustParseAddr("10.0.0.2")
+	established := func(index uint32) *HostInfo {
+		return &HostInfo{vpnIp: vpnIp, localIndexId: index, ConnectionState: &ConnectionState{dKey: &NebulaCipherState{}}}
+	}
+
+	old := established(1)
+	hm.unlockedAddHostInfo(old, f)
+	current := established(2)
+	hm.unlockedAddHostInfo(current, f)
+
+	// The old tunnel was replaced, its index keeps working for a while
+	now := time.Now()
+	hm.DeleteHostInfo(old)
+	assert.Nil(t, hm.QueryIndex(1))
+	assert.Equal(t, old, hm.QueryRetiredIndex(1, now))
+	assert.Nil(t, hm.QueryRetiredIndex(2, now))
+	assert.Nil(t, hm.QueryRetiredIndex(1, now.Add(retiredTunnelGrace+time.Second)))
+
+	// Once there is no tunnel to the vpn ip a retired tunnel is not used
+	hm.DeleteHostInfo(current)
+	assert.Nil(t, hm.QueryRetiredIndex(1, now))
+	assert.NotContains(t, hm.retired, uint32(2), "the last tunnel was not replaced")
+
+	// Expired entries are cleaned up as new tunnels retire
+	hm.unlockedAddHostInfo(established(3), f)
+	hm.unlockedAddHostInfo(established(4), f)
+	hm.unlockedRetire(hm.Indexes[3], now.Add(retiredTunnelGrace+time.Second))
+	assert.NotContains(t, hm.retired, uint32(1))
+	assert.Contains(t, hm.retired, uint32(3))
+
+	// Tunnels that never finished a handshake have nothing to decrypt with
+	hm.unlockedAddHostInfo(&HostInfo{vpnIp: vpnIp, localIndexId: 5}, f)
+	hm.DeleteHostInfo(hm.Indexes[5])
+	assert.NotContains(t, hm.retired, uint32(5))
+}
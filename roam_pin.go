@@ -0,0 +1,137 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/gaissmai/bart"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// roamPinWarnInterval limits how often a refused roam is logged for a single tunnel
+const roamPinWarnInterval = 10 * time.Second
+
+// RoamPin holds the peers that must never roam. A tunnel to a pinned peer keeps the remote it was established with,
+// authenticated packets from any other underlay address are still delivered but the tunnel is not moved and the
+// mismatch is logged as a potential spoof. This is stricter than lighthouse.remote_allow_list which only limits where
+// a peer may roam to. See roam_pin in the example config.
+type RoamPin struct {
+	rules   atomic.Pointer[roamPinRules]
+	hostMap *HostMap
+
+	metricSuppressed metrics.Counter
+	l                *logrus.Logger
+}
+
+type roamPinRules struct {
+	hosts  *bart.Table[struct{}]
+	groups []string
+}
+
+func NewRoamPinFromConfig(l *logrus.Logger, c *config.C, hostMap *HostMap) (*RoamPin, error) {
+	rp := &RoamPin{
+		hostMap:          hostMap,
+		metricSuppressed: metrics.GetOrRegisterCounter("roam_pin.suppressed", nil),
+		l:                l,
+	}
+
+	err := rp.reload(c, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		err := rp.reload(c, false)
+		if err != nil {
+			l.WithError(err).Error("Failed to reload roam_pin")
+		}
+	})
+
+	return rp, nil
+}
+
+func (rp *RoamPin) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("roam_pin") {
+		return nil
+	}
+
+	rules := &roamPinRules{
+		hosts:  new(bart.Table[struct{}]),
+		groups: c.GetStringSlice("roam_pin.groups", []string{}),
+	}
+
+	for i, s := range c.GetStringSlice("roam_pin.hosts", []string{}) {
+		cidr, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, aErr := netip.ParseAddr(s)
+			if aErr != nil {
+				return fmt.Errorf("roam_pin.hosts entry #%v; %s", i, err)
+			}
+			cidr = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		rules.hosts.Insert(cidr.Masked(), struct{}{})
+	}
+
+	rp.rules.Store(rules)
+
+	if !initial {
+		// Existing tunnels pick up the change right away
+		rp.hostMap.RLock()
+		for _, hostinfo := range rp.hostMap.Indexes {
+			hostinfo.roamPinned.Store(rp.pinned(hostinfo))
+		}
+		rp.hostMap.RUnlock()
+		rp.l.Info("roam_pin changed")
+	}
+	return nil
+}
+
+// pinned returns true if the peer of hostinfo is listed by vpn ip or carries one of the pinned groups
+func (rp *RoamPin) pinned(hostinfo *HostInfo) bool {
+	if rp == nil {
+		return false
+	}
+
+	rules := rp.rules.Load()
+	if rules == nil {
+		return false
+	}
+
+	if _, ok := rules.hosts.Lookup(hostinfo.vpnIp); ok {
+		return true
+	}
+
+	if len(rules.groups) > 0 {
+		if c := hostinfo.GetCert(); c != nil {
+			for _, g := range rules.groups {
+				if _, ok := c.Details.InvertedGroups[g]; ok {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// suppress returns true if hostinfo must not roam to addr. Tunnels that have no direct remote yet, for example when
+// established through a relay, are allowed to learn one.
+func (rp *RoamPin) suppress(hostinfo *HostInfo, addr netip.AddrPort, now time.Time) bool {
+	if rp == nil || !hostinfo.roamPinned.Load() || !hostinfo.remote.IsValid() {
+		return false
+	}
+
+	rp.metricSuppressed.Inc(1)
+
+	last := hostinfo.lastRoamPinWarn.Load()
+	if now.UnixNano()-last >= int64(roamPinWarnInterval) && hostinfo.lastRoamPinWarn.CompareAndSwap(last, now.UnixNano()) {
+		hostinfo.logger(rp.l).WithField("udpAddr", hostinfo.remote).WithField("newAddr", addr).
+			Warn("Refusing to roam a pinned peer, the packet may be spoofed or replayed")
+	}
+
+	return true
+}
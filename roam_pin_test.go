@@ -0,0 +1,86 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRoamPinFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+
+	rp, err := NewRoamPinFromConfig(l, c, hm)
+	require.NoError(t, err)
+	assert.False(t, rp.pinned(&HostInfo{vpnIp: netip.MustParseAddr("10.128.0.2")}))
+
+	c.Settings["roam_pin"] = map[interface{}]interface{}{
+		"hosts":  []interface{}{"10.128.0.2", "10.128.1.0/24"},
+		"groups": []interface{}{"infra"},
+	}
+	rp, err = NewRoamPinFromConfig(l, c, hm)
+	require.NoError(t, err)
+
+	assert.True(t, rp.pinned(&HostInfo{vpnIp: netip.MustParseAddr("10.128.0.2")}))
+	assert.True(t, rp.pinned(&HostInfo{vpnIp: netip.MustParseAddr("10.128.1.9")}))
+	assert.False(t, rp.pinned(&HostInfo{vpnIp: netip.MustParseAddr("10.128.0.3")}))
+
+	grouped := &HostInfo{
+		vpnIp: netip.MustParseAddr("10.128.0.3"),
+		ConnectionState: &ConnectionState{peerCert: &cert.NebulaCertificate{
+			Details: cert.NebulaCertificateDetails{InvertedGroups: map[string]struct{}{"infra": {}}},
+		}},
+	}
+	assert.True(t, rp.pinned(grouped))
+
+	c.Settings["roam_pin"] = map[interface{}]interface{}{"hosts": []interface{}{"nope"}}
+	_, err = NewRoamPinFromConfig(l, c, hm)
+	assert.EqualError(t, err, `roam_pin.hosts entry #0; netip.ParsePrefix("nope"): no '/'`)
+
+	var nilPin *RoamPin
+	assert.False(t, nilPin.pinned(grouped))
+}
+
+func TestRoamPin_suppress(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["roam_pin"] = map[interface{}]interface{}{"hosts": []interface{}{"10.128.0.2"}}
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	rp, err := NewRoamPinFromConfig(l, c, hm)
+	require.NoError(t, err)
+	f := &Interface{roamPin: rp}
+
+	pinned := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.2"), localIndexId: 1, remote: netip.MustParseAddrPort("1.1.1.1:4242")}
+	hm.unlockedAddHostInfo(pinned, f)
+	other := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.3"), localIndexId: 2, remote: netip.MustParseAddrPort("1.1.1.2:4242")}
+	hm.unlockedAddHostInfo(other, f)
+
+	assert.True(t, pinned.roamPinned.Load())
+	assert.False(t, other.roamPinned.Load())
+
+	now := time.Now()
+	newAddr := netip.MustParseAddrPort("2.2.2.2:4242")
+	before := rp.metricSuppressed.Count()
+	assert.True(t, rp.suppress(pinned, newAddr, now))
+	assert.True(t, rp.suppress(pinned, newAddr, now))
+	assert.False(t, rp.suppress(other, newAddr, now))
+	assert.Equal(t, before+2, rp.metricSuppressed.Count())
+	assert.Equal(t, now.UnixNano(), pinned.lastRoamPinWarn.Load())
+
+	// A relayed tunnel may still learn its first direct remote
+	relayed := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.2")}
+	relayed.roamPinned.Store(true)
+	assert.False(t, rp.suppress(relayed, newAddr, now))
+
+	// A reload updates the existing tunnels
+	require.NoError(t, c.ReloadConfigString("roam_pin:\n  hosts: [10.128.0.3]"))
+	assert.False(t, pinned.roamPinned.Load())
+	assert.True(t, other.roamPinned.Load())
+}
@@ -0,0 +1,47 @@
+package nebula
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// routingLoopLogInterval limits how often a routing loop is logged, a looping packet is seen again until its ttl runs out
+const routingLoopLogInterval = 10 * time.Second
+
+func routingLoopDrop(c *config.C) (bool, error) {
+	switch a := c.GetString("tun.routing_loop_action", "drop"); a {
+	case "drop":
+		return true, nil
+	case "log":
+		return false, nil
+	default:
+		return false, fmt.Errorf("tun.routing_loop_action must be drop or log, got %q", a)
+	}
+}
+
+// routingLoop checks a packet received from hostinfo for our own vpn ip as the inner source. We never send such a packet
+// to a peer for it to send back, seeing one means the overlay and the real network route the vpn network to each other.
+// Returns true if the packet must be dropped.
+func (f *Interface) routingLoop(hostinfo *HostInfo, fwPacket *firewall.Packet, via *ViaSender) bool {
+	if fwPacket.RemoteIP != f.myVpnNet.Addr() {
+		return false
+	}
+
+	f.metricRoutingLoop.Inc(1)
+	drop := f.routingLoopDrop.Load()
+
+	// routingLoopLogged holds when a loop was last logged, in unix nanoseconds
+	now := time.Now().UnixNano()
+	last := f.routingLoopLogged.Load()
+	if now-last >= int64(routingLoopLogInterval) && f.routingLoopLogged.CompareAndSwap(last, now) {
+		hostinfo.logger(f.l).WithField("fwPacket", fwPacket).
+			WithField("relayed", via != nil).
+			WithField("dropped", drop).
+			Warn("Received a packet from our own vpn ip through a tunnel, this is likely a routing loop")
+	}
+
+	return drop
+}
@@ -0,0 +1,144 @@
+package nebula
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/udp"
+)
+
+// aeadTagLen is the size of the authentication tag appended by both supported ciphers
+const aeadTagLen = 16
+
+// RuntimeInfo is a summary of the effective runtime parameters of a running nebula, it is rebuilt on every config
+// reload
+type RuntimeInfo struct {
+	Version string       `json:"version"`
+	TunName string       `json:"tunName"`
+	VpnCidr netip.Prefix `json:"vpnCidr"`
+	// MTU is the MTU of the tun device as the kernel has it, tun.mtu if the device can not be looked up, before it is
+	// activated or when the os owns it like on mobile
+	MTU         int              `json:"mtu"`
+	ListenAddrs []netip.AddrPort `json:"listenAddrs"`
+	Cipher      string           `json:"cipher"`
+	// Overhead is the number of bytes added to every tunneled packet, the nebula header, AEAD tag, and the outer
+	// udp and ip headers
+	Overhead        int      `json:"overhead"`
+	Routines        int      `json:"routines"`
+	AmLighthouse    bool     `json:"amLighthouse"`
+	AmRelay         bool     `json:"amRelay"`
+	Observer        bool     `json:"observer"`
+	UseRelays       bool     `json:"useRelays"`
+	CertFingerprint string   `json:"certFingerprint"`
+	CAFingerprints  []string `json:"caFingerprints"`
+}
+
+// RuntimeInfo returns the effective runtime parameters as of the last config load, the MTU is read from the tun device
+func (f *Interface) RuntimeInfo() RuntimeInfo {
+	ri := f.runtimeInfo.Load()
+	if ri == nil {
+		return RuntimeInfo{}
+	}
+
+	out := *ri
+	if iface, err := net.InterfaceByName(ri.TunName); err == nil {
+		out.MTU = iface.MTU
+	}
+	out.ListenAddrs = append([]netip.AddrPort(nil), ri.ListenAddrs...)
+	out.CAFingerprints = append([]string(nil), ri.CAFingerprints...)
+	return out
+}
+
+func (f *Interface) reloadRuntimeInfo(c *config.C) {
+	ri := &RuntimeInfo{
+		Version:  f.version,
+		TunName:  f.inside.Name(),
+		VpnCidr:  f.myVpnNet,
+		MTU:      c.GetInt("tun.mtu", overlay.DefaultMTU),
+		Cipher:   f.cipher,
+		Routines: f.routines,
+		Overhead: header.Len + aeadTagLen + 8,
+	}
+
+	ipOverhead := 20
+	for _, w := range f.writers {
+		if w == nil {
+			continue
+		}
+
+		addr, err := w.LocalAddr()
+		if err != nil {
+			f.l.WithError(err).Warn("Failed to get udp listen address for runtime info")
+			continue
+		}
+
+		ri.ListenAddrs = append(ri.ListenAddrs, addr)
+		if addr.Addr().Is6() && !addr.Addr().Is4In6() {
+			ipOverhead = 40
+		}
+	}
+	ri.Overhead += ipOverhead
+
+	if f.lightHouse != nil {
+		ri.AmLighthouse = f.lightHouse.amLighthouse
+	}
+
+	if f.relayManager != nil {
+		ri.AmRelay = f.relayManager.GetAmRelay()
+	}
+
+	ri.Observer = f.observer.Enabled()
+
+	if f.handshakeManager != nil {
+		ri.UseRelays = f.handshakeManager.config.useRelays
+	}
+
+	if cs := f.pki.GetCertState(); cs != nil && cs.Certificate != nil {
+		fp, err := cs.Certificate.Sha256Sum()
+		if err != nil {
+			f.l.WithError(err).Warn("Failed to fingerprint certificate for runtime info")
+		}
+		ri.CertFingerprint = fp
+	}
+
+	if pool := f.pki.GetCAPool(); pool != nil {
+		for fp := range pool.CAs {
+			ri.CAFingerprints = append(ri.CAFingerprints, fp)
+		}
+		sort.Strings(ri.CAFingerprints)
+	}
+
+	f.runtimeInfo.Store(ri)
+}
+
+// UDPSocketStats are the effective kernel buffer sizes and drop counts of an outside socket
+type UDPSocketStats struct {
+	Routine   int            `json:"routine"`
+	LocalAddr netip.AddrPort `json:"localAddr"`
+	udp.SocketStats
+}
+
+// UDPSocketStats returns the stats of each outside socket that can report them
+func (f *Interface) UDPSocketStats() []UDPSocketStats {
+	var out []UDPSocketStats
+	for i, w := range f.writers {
+		sc, ok := underlay(w).(udp.StatsConn)
+		if !ok {
+			continue
+		}
+
+		stats, err := sc.SocketStats()
+		if err != nil {
+			f.l.WithError(err).WithField("routine", i).Warn("Failed to get udp socket stats")
+			continue
+		}
+
+		addr, _ := w.LocalAddr()
+		out = append(out, UDPSocketStats{Routine: i, LocalAddr: addr, SocketStats: stats})
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+package nebula
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+type localAddrConn struct {
+	udp.NoopConn
+	addr netip.AddrPort
+}
+
+func (c localAddrConn) LocalAddr() (netip.AddrPort, error) {
+	return c.addr, nil
+}
+
+// namedTun is a tun device that goes by the name of an existing interface
+type namedTun struct {
+	test.NoopTun
+	name string
+}
+
+func (t namedTun) Name() string {
+	return t.name
+}
+
+func TestInterface_RuntimeInfo(t *testing.T) {
+	l := test.NewLogger()
+	f := &Interface{
+		inside:       &test.NoopTun{},
+		myVpnNet:     netip.MustParsePrefix("10.1.0.1/16"),
+		cipher:       "aes",
+		routines:     2,
+		version:      "1.2.3",
+		pki:          &PKI{},
+		relayManager: &relayManager{},
+		writers: []udp.Conn{
+			localAddrConn{addr: netip.MustParseAddrPort("192.168.0.1:4242")},
+			localAddrConn{addr: netip.MustParseAddrPort("192.168.0.1:4242")},
+		},
+		l: l,
+	}
+	f.relayManager.setAmRelay(true)
+
+	crt := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "me"}}
+	f.pki.cs.Store(&CertState{Certificate: crt})
+	pool := cert.NewCAPool()
+	pool.CAs["bbbb"] = &cert.NebulaCertificate{}
+	pool.CAs["aaaa"] = &cert.NebulaCertificate{}
+	f.pki.caPool.Store(pool)
+
+	// Nothing loaded yet
+	assert.Equal(t, RuntimeInfo{}, f.RuntimeInfo())
+
+	c := config.NewC(l)
+	c.Settings["tun"] = map[interface{}]interface{}{"mtu": 1400}
+	f.reloadRuntimeInfo(c)
+
+	fp, err := crt.Sha256Sum()
+	assert.NoError(t, err)
+
+	ri := f.RuntimeInfo()
+	assert.Equal(t, "1.2.3", ri.Version)
+	assert.Equal(t, "noop", ri.TunName)
+	assert.Equal(t, netip.MustParsePrefix("10.1.0.1/16"), ri.VpnCidr)
+	assert.Equal(t, 1400, ri.MTU)
+	assert.Len(t, ri.ListenAddrs, 2)
+	assert.Equal(t, "aes", ri.Cipher)
+	assert.Equal(t, 16+16+8+20, ri.Overhead)
+	assert.Equal(t, 2, ri.Routines)
+	assert.True(t, ri.AmRelay)
+	assert.Equal(t, fp, ri.CertFingerprint)
+	assert.Equal(t, []string{"aaaa", "bbbb"}, ri.CAFingerprints)
+
+	// Callers get a copy
+	ri.CAFingerprints[0] = "cccc"
+	assert.Equal(t, "aaaa", f.RuntimeInfo().CAFingerprints[0])
+
+	// Reload picks up changes
+	f.writers = []udp.Conn{localAddrConn{addr: netip.MustParseAddrPort("[fd00::1]:4242")}}
+	c.Settings["tun"] = map[interface{}]interface{}{"mtu": 1280}
+	f.reloadRuntimeInfo(c)
+	ri = f.RuntimeInfo()
+	assert.Equal(t, 1280, ri.MTU)
+	assert.Equal(t, 16+16+8+40, ri.Overhead)
+
+	// The mtu of a device that exists is the one the kernel has, not tun.mtu
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no lo interface")
+	}
+	f.inside = namedTun{name: "lo"}
+	f.reloadRuntimeInfo(c)
+	assert.Equal(t, lo.MTU, f.RuntimeInfo().MTU)
+}
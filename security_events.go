@@ -0,0 +1,575 @@
+package nebula
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// The security events, each is sent with its name as the syslog MSGID
+const (
+	securityEventHandshakeRejected = "handshake_rejected"
+	securityEventCertRevoked       = "cert_revoked"
+	securityEventCertExpiring      = "cert_expiring"
+	securityEventCertExpired       = "cert_expired"
+	securityEventDuplicateVpnIp    = "duplicate_vpn_ip"
+	securityEventFirewallDrop      = "firewall_drop"
+	securityEventSpoofedSource     = "spoofed_source"
+)
+
+// The syslog severities of RFC 5424
+const (
+	syslogEmergency = iota
+	syslogAlert
+	syslogCritical
+	syslogError
+	syslogWarning
+	syslogNotice
+	syslogInformational
+	syslogDebug
+)
+
+const (
+	// defaultSecurityEventsEnterprise is the private enterprise number RFC 5612 reserves for documentation, it names the
+	// structured data element of the events until security_events.enterprise is set to the number of the organization
+	defaultSecurityEventsEnterprise = 32473
+	defaultSecurityEventsRate       = 100
+	defaultSecurityEventsDropSample = 100
+	defaultSecurityEventsCertExpiry = 30 * 24 * time.Hour
+	// securityEventsQueueLen is how many events wait for the sender before new events are dropped
+	securityEventsQueueLen = 1024
+	// securityEventsCertCheckInterval is how often our certificate is checked against security_events.cert_expiry
+	securityEventsCertCheckInterval = time.Hour
+	securityEventsDialTimeout       = 5 * time.Second
+	// securityEventsRedialInterval keeps a down tcp or tls destination from being dialed for every event
+	securityEventsRedialInterval = 5 * time.Second
+	securityEventsWriteTimeout   = 5 * time.Second
+)
+
+var syslogSeverities = map[string]int{
+	"emerg":   syslogEmergency,
+	"alert":   syslogAlert,
+	"crit":    syslogCritical,
+	"err":     syslogError,
+	"warning": syslogWarning,
+	"notice":  syslogNotice,
+	"info":    syslogInformational,
+	"debug":   syslogDebug,
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7, "uucp": 8, "cron": 9,
+	"authpriv": 10, "ftp": 11, "ntp": 12, "audit": 13, "alert": 14, "clock": 15, "local0": 16, "local1": 17,
+	"local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// defaultSecurityEventSeverities is the severity each event is sent with unless security_events.severities overrides it
+var defaultSecurityEventSeverities = map[string]int{
+	securityEventHandshakeRejected: syslogWarning,
+	securityEventCertRevoked:       syslogError,
+	securityEventCertExpiring:      syslogWarning,
+	securityEventCertExpired:       syslogError,
+	securityEventDuplicateVpnIp:    syslogError,
+	securityEventFirewallDrop:      syslogNotice,
+	securityEventSpoofedSource:     syslogWarning,
+}
+
+// securityEvent is one event waiting to be sent, params are the fields of its structured data element in order
+type securityEvent struct {
+	time   time.Time
+	name   string
+	msg    string
+	params []string
+}
+
+// syslogFormat holds what every RFC 5424 message from this node has in common
+type syslogFormat struct {
+	facility   int
+	severities map[string]int
+	hostname   string
+	appName    string
+	procID     string
+	sdID       string
+	version    string
+}
+
+// format appends ev to b as an RFC 5424 message, without any transport framing
+func (sf *syslogFormat) format(b []byte, ev *securityEvent) []byte {
+	b = append(b, '<')
+	b = strconv.AppendInt(b, int64(sf.facility*8+sf.severities[ev.name]), 10)
+	b = append(b, ">1 "...)
+	b = ev.time.UTC().AppendFormat(b, "2006-01-02T15:04:05.000000Z07:00")
+	b = append(b, ' ')
+	b = append(b, sf.hostname...)
+	b = append(b, ' ')
+	b = append(b, sf.appName...)
+	b = append(b, ' ')
+	b = append(b, sf.procID...)
+	b = append(b, ' ')
+	b = append(b, ev.name...)
+	b = append(b, ' ')
+
+	b = append(b, '[')
+	b = append(b, sf.sdID...)
+	for i := 0; i+1 < len(ev.params); i += 2 {
+		b = appendSyslogParam(b, ev.params[i], ev.params[i+1])
+	}
+	b = append(b, "][origin"...)
+	b = appendSyslogParam(b, "software", "nebula")
+	if sf.version != "" {
+		b = appendSyslogParam(b, "swVersion", sf.version)
+	}
+	b = append(b, ']')
+
+	if ev.msg != "" {
+		b = append(b, " \xef\xbb\xbf"...)
+		b = append(b, ev.msg...)
+	}
+	return b
+}
+
+// appendSyslogParam appends a structured data parameter, escaping the characters RFC 5424 requires in the value
+func appendSyslogParam(b []byte, name, value string) []byte {
+	b = append(b, ' ')
+	b = append(b, name...)
+	b = append(b, `="`...)
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"', '\\', ']':
+			b = append(b, '\\')
+		}
+		b = append(b, value[i])
+	}
+	return append(b, '"')
+}
+
+// syslogHeaderField makes s a valid RFC 5424 header field, printable ascii of at most max bytes or - if it is empty
+func syslogHeaderField(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, s)
+	if len(s) > max {
+		s = s[:max]
+	}
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// securityEventLog sends a curated stream of security events to a syslog destination as RFC 5424 messages, separate
+// from the logrus output: rejected handshakes, revoked certificates, our certificate nearing or past its expiry,
+// duplicate vpn ips, spoofed inner sources and a sample of the other firewall drops. Events are queued and sent by a
+// separate goroutine, at most rate are sent per second and events that do not fit the queue are dropped and counted.
+//
+// Over udp every message is a datagram (RFC 5426), over tcp and tls messages are framed with octet counting
+// (RFC 6587, RFC 5425). A stream that fails is redialed with the next event, events are not buffered while it is down.
+type securityEventLog struct {
+	network    string
+	address    string
+	tls        *tls.Config
+	format     syslogFormat
+	rate       int
+	dropSample uint64
+	certExpiry time.Duration
+	pki        *PKI
+
+	dropSeen atomic.Uint64
+
+	sync.Mutex
+	windowStart time.Time
+	windowCount int
+
+	events chan securityEvent
+	done   chan struct{}
+
+	metricSent       metrics.Counter
+	metricDropped    metrics.Counter
+	metricSuppressed metrics.Counter
+	metricFailed     metrics.Counter
+	l                *logrus.Logger
+}
+
+func (f *Interface) reloadSecurityEvents(c *config.C) {
+	if !c.InitialLoad() && !c.HasChanged("security_events") {
+		return
+	}
+
+	var s *securityEventLog
+	if c.GetBool("security_events.enabled", false) {
+		var err error
+		s, err = newSecurityEventLogFromConfig(f.l, c, f.pki, f.version)
+		if err != nil {
+			f.l.WithError(err).Error("Failed to start security events")
+			return
+		}
+	}
+
+	if old := f.securityEvents.Swap(s); old != nil {
+		old.Close()
+	}
+
+	if s != nil {
+		go s.run()
+		f.l.WithField("network", s.network).WithField("address", s.address).Info("Sending security events")
+	} else if !c.InitialLoad() {
+		f.l.Info("Security events stopped")
+	}
+}
+
+func newSecurityEventLogFromConfig(l *logrus.Logger, c *config.C, pki *PKI, version string) (*securityEventLog, error) {
+	s := &securityEventLog{
+		network:          c.GetString("security_events.protocol", "udp"),
+		address:          c.GetString("security_events.address", ""),
+		pki:              pki,
+		events:           make(chan securityEvent, securityEventsQueueLen),
+		done:             make(chan struct{}),
+		metricSent:       metrics.GetOrRegisterCounter("security_events.sent", nil),
+		metricDropped:    metrics.GetOrRegisterCounter("security_events.dropped", nil),
+		metricSuppressed: metrics.GetOrRegisterCounter("security_events.suppressed", nil),
+		metricFailed:     metrics.GetOrRegisterCounter("security_events.failed", nil),
+		l:                l,
+	}
+
+	if s.address == "" {
+		return nil, fmt.Errorf("security_events.address must be provided")
+	}
+	host, _, err := net.SplitHostPort(s.address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid security_events.address: %s", err)
+	}
+
+	switch s.network {
+	case "udp", "tcp":
+	case "tls":
+		s.tls, err = securityEventsTLSFromConfig(c, host)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("security_events.protocol must be udp, tcp or tls, got %q", s.network)
+	}
+
+	s.rate = c.GetInt("security_events.rate", defaultSecurityEventsRate)
+	if s.rate < 1 {
+		return nil, fmt.Errorf("security_events.rate must be at least 1")
+	}
+
+	dropSample := c.GetInt("security_events.firewall_drop_sample", defaultSecurityEventsDropSample)
+	if dropSample < 0 {
+		return nil, fmt.Errorf("security_events.firewall_drop_sample must not be negative")
+	}
+	s.dropSample = uint64(dropSample)
+
+	s.certExpiry = c.GetDuration("security_events.cert_expiry", defaultSecurityEventsCertExpiry)
+	if s.certExpiry < 0 {
+		return nil, fmt.Errorf("security_events.cert_expiry must not be negative")
+	}
+
+	facility := c.GetString("security_events.facility", "authpriv")
+	f, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("security_events.facility %q is not a syslog facility", facility)
+	}
+
+	enterprise := c.GetInt("security_events.enterprise", defaultSecurityEventsEnterprise)
+	if enterprise < 1 {
+		return nil, fmt.Errorf("security_events.enterprise must be a private enterprise number")
+	}
+
+	severities := make(map[string]int, len(defaultSecurityEventSeverities))
+	for name, sev := range defaultSecurityEventSeverities {
+		severities[name] = sev
+	}
+	for name, v := range c.GetMap("security_events.severities", map[interface{}]interface{}{}) {
+		name := fmt.Sprint(name)
+		if _, ok := severities[name]; !ok {
+			return nil, fmt.Errorf("security_events.severities: unknown event %q", name)
+		}
+		sev, ok := syslogSeverities[fmt.Sprint(v)]
+		if !ok {
+			return nil, fmt.Errorf("security_events.severities.%s: %q is not a syslog severity", name, fmt.Sprint(v))
+		}
+		severities[name] = sev
+	}
+
+	hostname := c.GetString("security_events.hostname", "")
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+
+	s.format = syslogFormat{
+		facility:   f,
+		severities: severities,
+		hostname:   syslogHeaderField(hostname, 255),
+		appName:    syslogHeaderField(c.GetString("security_events.app_name", "nebula"), 48),
+		procID:     strconv.Itoa(os.Getpid()),
+		sdID:       "nebula@" + strconv.Itoa(enterprise),
+		version:    version,
+	}
+	return s, nil
+}
+
+func securityEventsTLSFromConfig(c *config.C, host string) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName: c.GetString("security_events.tls.server_name", host),
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if ca := c.GetString("security_events.tls.ca", ""); ca != "" {
+		caPEM, err := readPEMOrFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading security_events.tls.ca: %s", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("security_events.tls.ca does not contain any PEM certificates")
+		}
+	}
+
+	certFile, keyFile := c.GetString("security_events.tls.cert", ""), c.GetString("security_events.tls.key", "")
+	if certFile != "" || keyFile != "" {
+		certPEM, err := readPEMOrFile(certFile)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading security_events.tls.cert: %s", err)
+		}
+		keyPEM, err := readPEMOrFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading security_events.tls.key: %s", err)
+		}
+		clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("security_events.tls.cert and security_events.tls.key are not a valid key pair: %s", err)
+		}
+		tc.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tc, nil
+}
+
+func (s *securityEventLog) Close() {
+	close(s.done)
+}
+
+// emit queues an event without ever blocking the caller, params are name and value pairs
+func (s *securityEventLog) emit(name, msg string, now time.Time, params ...string) {
+	s.Lock()
+	if now.Sub(s.windowStart) >= time.Second {
+		s.windowStart = now
+		s.windowCount = 0
+	}
+	if s.windowCount >= s.rate {
+		s.Unlock()
+		s.metricSuppressed.Inc(1)
+		return
+	}
+	s.windowCount++
+	s.Unlock()
+
+	select {
+	case s.events <- securityEvent{time: now, name: name, msg: msg, params: params}:
+	default:
+		s.metricDropped.Inc(1)
+	}
+}
+
+// handshakeRejected reports a handshake refused because of the certificate of the peer, as cert_revoked if it is on
+// the blocklist. remoteCert may be nil if the certificate could not be read. A nil log does nothing.
+func (s *securityEventLog) handshakeRejected(addr netip.AddrPort, stage int, remoteCert *cert.NebulaCertificate, err error) {
+	if s == nil {
+		return
+	}
+
+	name, msg := securityEventHandshakeRejected, "Handshake rejected"
+	if errors.Is(err, cert.ErrBlockListed) {
+		name, msg = securityEventCertRevoked, "Handshake with a revoked certificate rejected"
+	}
+
+	params := []string{"udpAddr", addr.String(), "stage", strconv.Itoa(stage), "reason", fmt.Sprint(err)}
+	s.emit(name, msg, time.Now(), append(params, securityEventCertParams(remoteCert)...)...)
+}
+
+// tunnelRevoked reports a tunnel closed because the certificate of the peer was added to the blocklist
+func (s *securityEventLog) tunnelRevoked(h *HostInfo, remoteCert *cert.NebulaCertificate) {
+	if s == nil {
+		return
+	}
+
+	params := []string{"udpAddr", h.remote.String(), "localIndex", strconv.FormatUint(uint64(h.localIndexId), 10)}
+	s.emit(securityEventCertRevoked, "Tunnel with a revoked certificate closed", time.Now(), append(params, securityEventCertParams(remoteCert)...)...)
+}
+
+// duplicateVpnIp reports two nodes presenting certificates for vpnIp
+func (s *securityEventLog) duplicateVpnIp(vpnIp netip.Addr, existing *HostInfo, existingCert, remoteCert *cert.NebulaCertificate, addr netip.AddrPort, rejected bool) {
+	if s == nil {
+		return
+	}
+
+	existingFp, _ := existingCert.Sha256Sum()
+	newFp, _ := remoteCert.Sha256Sum()
+	s.emit(securityEventDuplicateVpnIp, "Two nodes present certificates for the same vpn ip", time.Now(),
+		"vpnIp", vpnIp.String(),
+		"existingFingerprint", existingFp,
+		"existingCertName", existingCert.Details.Name,
+		"existingUdpAddr", existing.remote.String(),
+		"newFingerprint", newFp,
+		"newCertName", remoteCert.Details.Name,
+		"newUdpAddr", addr.String(),
+		"rejected", strconv.FormatBool(rejected),
+	)
+}
+
+// firewallDrop reports a packet the firewall dropped. Packets whose inner source is not in the certificate of the
+// peer are always reported as spoofed_source, 1 in firewall_drop_sample of the other drops are reported.
+func (s *securityEventLog) firewallDrop(fp firewall.Packet, incoming bool, h *HostInfo, rule string, reason error) {
+	if s == nil {
+		return
+	}
+
+	name, msg := securityEventSpoofedSource, "Packet with a source outside the peer certificate dropped"
+	if !errors.Is(reason, ErrInvalidRemoteIP) {
+		if s.dropSample == 0 || s.dropSeen.Add(1)%s.dropSample != 0 {
+			return
+		}
+		name, msg = securityEventFirewallDrop, "Packet dropped by the firewall"
+	}
+
+	s.emit(name, msg, time.Now(),
+		"vpnIp", h.vpnIp.String(),
+		"direction", flowDirection(incoming),
+		"protocol", firewallProtoName(fp.Protocol),
+		"localIp", fp.LocalIP.String(),
+		"localPort", strconv.Itoa(int(fp.LocalPort)),
+		"remoteIp", fp.RemoteIP.String(),
+		"remotePort", strconv.Itoa(int(fp.RemotePort)),
+		"rule", rule,
+		"reason", reason.Error(),
+	)
+}
+
+// checkCert reports our certificate if it is expired or expires within cert_expiry of now
+func (s *securityEventLog) checkCert(now time.Time) {
+	if s.certExpiry == 0 || s.pki == nil {
+		return
+	}
+
+	c := s.pki.GetCertState().Certificate
+	ttl := c.Details.NotAfter.Sub(now)
+	if ttl > s.certExpiry {
+		return
+	}
+
+	name, msg := securityEventCertExpiring, "Our certificate expires soon"
+	if ttl <= 0 {
+		name, msg = securityEventCertExpired, "Our certificate is expired"
+	}
+	params := []string{"notAfter", c.Details.NotAfter.UTC().Format(time.RFC3339), "ttlSeconds", strconv.FormatInt(int64(ttl/time.Second), 10)}
+	s.emit(name, msg, now, append(params, securityEventCertParams(c)...)...)
+}
+
+func securityEventCertParams(c *cert.NebulaCertificate) []string {
+	if c == nil {
+		return nil
+	}
+
+	fingerprint, _ := c.Sha256Sum()
+	params := []string{"certName", c.Details.Name, "fingerprint", fingerprint, "issuer", c.Details.Issuer}
+	if len(c.Details.Ips) > 0 {
+		params = append(params, "certVpnIp", c.Details.Ips[0].IP.String())
+	}
+	return params
+}
+
+func (s *securityEventLog) run() {
+	var conn net.Conn
+	var lastDial time.Time
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(securityEventsCertCheckInterval)
+	defer ticker.Stop()
+	s.checkCert(time.Now())
+
+	var buf []byte
+	for {
+		var ev securityEvent
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.checkCert(now)
+			continue
+		case ev = <-s.events:
+		}
+
+		if conn == nil {
+			if time.Since(lastDial) < securityEventsRedialInterval {
+				s.metricFailed.Inc(1)
+				continue
+			}
+			lastDial = time.Now()
+
+			var err error
+			conn, err = s.dial()
+			if err != nil {
+				s.metricFailed.Inc(1)
+				s.l.WithError(err).WithField("address", s.address).Warn("Failed to connect to the security events destination")
+				continue
+			}
+		}
+
+		buf = s.frame(buf[:0], &ev)
+		_ = conn.SetWriteDeadline(time.Now().Add(securityEventsWriteTimeout))
+		if _, err := conn.Write(buf); err != nil {
+			s.metricFailed.Inc(1)
+			if s.network != "udp" {
+				s.l.WithError(err).WithField("address", s.address).Warn("Failed to send a security event, reconnecting")
+				conn.Close()
+				conn = nil
+			}
+			continue
+		}
+		s.metricSent.Inc(1)
+	}
+}
+
+// frame appends ev as it is written to the destination, tcp and tls streams are octet counted
+func (s *securityEventLog) frame(b []byte, ev *securityEvent) []byte {
+	if s.network == "udp" {
+		return s.format.format(b, ev)
+	}
+
+	msg := s.format.format(nil, ev)
+	b = strconv.AppendInt(b, int64(len(msg)), 10)
+	b = append(b, ' ')
+	return append(b, msg...)
+}
+
+func (s *securityEventLog) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: securityEventsDialTimeout}
+	if s.tls != nil {
+		return tls.DialWithDialer(d, "tcp", s.address, s.tls)
+	}
+	return d.Dial(s.network, s.address)
+}
@@ -0,0 +1,195 @@
+package nebula
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyslogFormat(t *testing.T) {
+	sf := &syslogFormat{
+		facility:   syslogFacilities["authpriv"],
+		severities: defaultSecurityEventSeverities,
+		hostname:   "gw1",
+		appName:    "nebula",
+		procID:     "42",
+		sdID:       "nebula@32473",
+		version:    "1.9.0",
+	}
+	ev := &securityEvent{
+		time:   time.Date(2024, 5, 1, 12, 30, 15, 123456789, time.FixedZone("CEST", 2*60*60)),
+		name:   securityEventHandshakeRejected,
+		msg:    "Handshake rejected",
+		params: []string{"udpAddr", "192.168.0.2:4242", "reason", `bad "cert" [x] \ y`},
+	}
+
+	assert.Equal(t,
+		`<84>1 2024-05-01T10:30:15.123456Z gw1 nebula 42 handshake_rejected `+
+			`[nebula@32473 udpAddr="192.168.0.2:4242" reason="bad \"cert\" [x\] \\ y"][origin software="nebula" swVersion="1.9.0"]`+
+			" \xef\xbb\xbfHandshake rejected",
+		string(sf.format(nil, ev)),
+	)
+
+	t.Log("The priority is the facility and the severity of the event")
+	sf.facility = syslogFacilities["local7"]
+	sf.version = ""
+	ev.name = securityEventFirewallDrop
+	ev.params = nil
+	ev.msg = ""
+	assert.Equal(t, `<189>1 2024-05-01T10:30:15.123456Z gw1 nebula 42 firewall_drop [nebula@32473][origin software="nebula"]`, string(sf.format(nil, ev)))
+
+	t.Log("Header fields are printable ascii")
+	assert.Equal(t, "-", syslogHeaderField("", 10))
+	assert.Equal(t, "-", syslogHeaderField(" \t", 10))
+	assert.Equal(t, "hostname", syslogHeaderField("host name\n", 10))
+	assert.Equal(t, "abc", syslogHeaderField("abcdef", 3))
+	assert.Equal(t, "hst", syslogHeaderField("hΩst", 10))
+}
+
+func TestNewSecurityEventLogFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	tests := []struct {
+		conf string
+		err  string
+	}{
+		{"{}", "security_events.address must be provided"},
+		{"{address: nope}", "invalid security_events.address: address nope: missing port in address"},
+		{"{address: '127.0.0.1:514', protocol: quic}", `security_events.protocol must be udp, tcp or tls, got "quic"`},
+		{"{address: '127.0.0.1:514', protocol: tls, tls: {ca: nope}}", "error while loading security_events.tls.ca: open nope: no such file or directory"},
+		{"{address: '127.0.0.1:514', rate: 0}", "security_events.rate must be at least 1"},
+		{"{address: '127.0.0.1:514', firewall_drop_sample: -1}", "security_events.firewall_drop_sample must not be negative"},
+		{"{address: '127.0.0.1:514', facility: nope}", `security_events.facility "nope" is not a syslog facility`},
+		{"{address: '127.0.0.1:514', enterprise: 0}", "security_events.enterprise must be a private enterprise number"},
+		{"{address: '127.0.0.1:514', severities: {nope: err}}", `security_events.severities: unknown event "nope"`},
+		{"{address: '127.0.0.1:514', severities: {firewall_drop: loud}}", `security_events.severities.firewall_drop: "loud" is not a syslog severity`},
+	}
+	for _, tt := range tests {
+		c := config.NewC(l)
+		require.NoError(t, c.LoadString("security_events: "+tt.conf))
+		_, err := newSecurityEventLogFromConfig(l, c, nil, "")
+		assert.EqualError(t, err, tt.err, tt.conf)
+	}
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("security_events: {address: '127.0.0.1:514', protocol: tls, hostname: 'my host', enterprise: 1234, severities: {firewall_drop: info}}"))
+	s, err := newSecurityEventLogFromConfig(l, c, nil, "")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", s.tls.ServerName)
+	assert.Equal(t, "myhost", s.format.hostname)
+	assert.Equal(t, "nebula@1234", s.format.sdID)
+	assert.Equal(t, syslogInformational, s.format.severities[securityEventFirewallDrop])
+	assert.Equal(t, syslogWarning, s.format.severities[securityEventHandshakeRejected])
+	assert.Equal(t, syslogNotice, defaultSecurityEventSeverities[securityEventFirewallDrop], "the defaults are left alone")
+}
+
+func TestSecurityEventLog_tcp(t *testing.T) {
+	l := test.NewLogger()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(fmt.Sprintf("security_events: {address: '%s', protocol: tcp, rate: 3, firewall_drop_sample: 2}", ln.Addr())))
+	s, err := newSecurityEventLogFromConfig(l, c, nil, "")
+	require.NoError(t, err)
+	go s.run()
+	defer s.Close()
+
+	h := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.2")}
+	fp := firewall.Packet{
+		LocalIP:    netip.MustParseAddr("10.128.0.1"),
+		RemoteIP:   netip.MustParseAddr("10.128.0.9"),
+		LocalPort:  22,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	revoked := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "host2"}}
+
+	s.handshakeRejected(netip.MustParseAddrPort("192.168.0.2:4242"), 1, revoked, fmt.Errorf("certificate validation failed: %w", cert.ErrBlockListed))
+	s.firewallDrop(fp, true, h, FirewallRuleNoMatch, ErrNoMatchingRule)
+	s.firewallDrop(fp, true, h, FirewallRuleNoMatch, ErrNoMatchingRule)
+	s.firewallDrop(fp, true, h, FirewallRuleRemoteIP, ErrInvalidRemoteIP)
+
+	suppressed := s.metricSuppressed.Count()
+	s.firewallDrop(fp, true, h, FirewallRuleRemoteIP, ErrInvalidRemoteIP)
+	assert.Equal(t, suppressed+1, s.metricSuppressed.Count(), "only 3 events are sent per second")
+
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	r := bufio.NewReader(conn)
+
+	// read returns the next octet counted message
+	read := func() string {
+		n, err := r.ReadString(' ')
+		require.NoError(t, err)
+		size, err := strconv.Atoi(strings.TrimSpace(n))
+		require.NoError(t, err)
+		msg := make([]byte, size)
+		_, err = io.ReadFull(r, msg)
+		require.NoError(t, err)
+		return string(msg)
+	}
+
+	fingerprint, _ := revoked.Sha256Sum()
+	msg := read()
+	assert.True(t, strings.HasPrefix(msg, "<83>1 "), msg)
+	assert.Contains(t, msg, " cert_revoked [nebula@32473 udpAddr=\"192.168.0.2:4242\" stage=\"1\" ")
+	assert.Contains(t, msg, ` certName="host2" fingerprint="`+fingerprint+`" issuer=""]`)
+
+	msg = read()
+	assert.True(t, strings.HasPrefix(msg, "<85>1 "), msg)
+	assert.Contains(t, msg, ` firewall_drop [nebula@32473 vpnIp="10.128.0.2" direction="inbound" protocol="tcp" localIp="10.128.0.1" localPort="22" remoteIp="10.128.0.9" remotePort="40000" rule="no matching allow rule" reason="no matching rule in firewall table"]`)
+
+	msg = read()
+	assert.True(t, strings.HasPrefix(msg, "<84>1 "), msg)
+	assert.Contains(t, msg, ` spoofed_source [nebula@32473 vpnIp="10.128.0.2" `)
+}
+
+func TestSecurityEventLog_udp(t *testing.T) {
+	l := test.NewLogger()
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer collector.Close()
+
+	pki := &PKI{}
+	pki.cs.Store(&CertState{Certificate: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Name:     "me",
+		NotAfter: time.Now().Add(24 * time.Hour),
+	}}})
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(fmt.Sprintf("security_events: {address: '%s', facility: audit}", collector.LocalAddr())))
+	s, err := newSecurityEventLogFromConfig(l, c, pki, "")
+	require.NoError(t, err)
+	go s.run()
+	defer s.Close()
+
+	require.NoError(t, collector.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 2000)
+	n, err := collector.Read(buf)
+	require.NoError(t, err)
+	msg := string(buf[:n])
+	assert.True(t, strings.HasPrefix(msg, "<108>1 "), "our certificate expires within cert_expiry: "+msg)
+	assert.Contains(t, msg, " cert_expiring [nebula@32473 notAfter=")
+	assert.Contains(t, msg, ` certName="me" `)
+
+	t.Log("A nil log does nothing")
+	var nilLog *securityEventLog
+	nilLog.firewallDrop(firewall.Packet{}, true, &HostInfo{}, "", ErrInvalidRemoteIP)
+	nilLog.handshakeRejected(netip.AddrPort{}, 1, nil, nil)
+}
@@ -0,0 +1,169 @@
+package nebula
+
+import (
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	defaultSendBackoffMin = 100 * time.Millisecond
+	defaultSendBackoffMax = 10 * time.Second
+)
+
+// SendBackoff pauses sending on a tunnel after the underlay socket refused a packet for it, for example when the
+// network is down or the kernel is out of buffers. Each failure in a row doubles the pause from send_backoff.min up to
+// send_backoff.max and the first successful send resets it. Packets for a paused tunnel are dropped before they are
+// encrypted. Transient errors like EAGAIN only drop the one packet.
+type SendBackoff struct {
+	min atomic.Int64
+	max atomic.Int64
+
+	metricTransient metrics.Counter
+	metricFailed    metrics.Counter
+	metricDropped   metrics.Counter
+	l               *logrus.Logger
+}
+
+// sendBackoffState is the per tunnel state, it lives on the HostInfo
+type sendBackoffState struct {
+	// failures is the number of failed sends in a row, until is the unix nano time sends resume
+	failures atomic.Uint32
+	until    atomic.Int64
+	lastErr  atomic.Pointer[string]
+}
+
+// SendBackoffStatus is reported on the control socket for a tunnel with a failing underlay
+type SendBackoffStatus struct {
+	Failures  uint32    `json:"failures"`
+	Until     time.Time `json:"until"`
+	LastError string    `json:"lastError"`
+}
+
+func NewSendBackoffFromConfig(l *logrus.Logger, c *config.C) *SendBackoff {
+	sb := &SendBackoff{
+		metricTransient: metrics.GetOrRegisterCounter("send.failed.transient", nil),
+		metricFailed:    metrics.GetOrRegisterCounter("send.failed", nil),
+		metricDropped:   metrics.GetOrRegisterCounter("send.backoff.dropped", nil),
+		l:               l,
+	}
+
+	sb.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		sb.reload(c, false)
+	})
+
+	return sb
+}
+
+func (sb *SendBackoff) reload(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("send_backoff") {
+		return
+	}
+
+	min := c.GetDuration("send_backoff.min", defaultSendBackoffMin)
+	max := c.GetDuration("send_backoff.max", defaultSendBackoffMax)
+	if min > 0 && max < min {
+		sb.l.WithField("min", min).WithField("max", max).Warn("send_backoff.max is lower than send_backoff.min, using min")
+		max = min
+	}
+
+	sb.min.Store(int64(min))
+	sb.max.Store(int64(max))
+
+	if !initial {
+		sb.l.WithField("min", min).WithField("max", max).Info("send_backoff changed")
+	}
+}
+
+// paused returns true if sends on hostinfo are backed off, counting the packet as dropped
+func (sb *SendBackoff) paused(hostinfo *HostInfo) bool {
+	// Nearly every send takes this path, stay away from the clock unless something failed
+	if sb == nil || hostinfo.sendBackoff.failures.Load() == 0 {
+		return false
+	}
+
+	if time.Now().UnixNano() >= hostinfo.sendBackoff.until.Load() {
+		return false
+	}
+
+	sb.metricDropped.Inc(1)
+	return true
+}
+
+// result records the outcome of a send on hostinfo
+func (sb *SendBackoff) result(hostinfo *HostInfo, addr netip.AddrPort, err error) {
+	if sb == nil {
+		return
+	}
+
+	s := &hostinfo.sendBackoff
+	if err == nil {
+		if n := s.failures.Load(); n != 0 && s.failures.CompareAndSwap(n, 0) {
+			s.until.Store(0)
+			hostinfo.logger(sb.l).WithField("udpAddr", addr).WithField("failures", n).Info("Sends recovered")
+		}
+		return
+	}
+
+	if isTransientSendError(err) {
+		sb.metricTransient.Inc(1)
+		hostinfo.logger(sb.l).WithError(err).WithField("udpAddr", addr).Debug("Dropped outgoing packet, socket is busy")
+		return
+	}
+
+	sb.metricFailed.Inc(1)
+	msg := err.Error()
+	s.lastErr.Store(&msg)
+
+	min := time.Duration(sb.min.Load())
+	if min <= 0 {
+		// Backoff is disabled, keep the old behavior of logging every failure
+		hostinfo.logger(sb.l).WithError(err).WithField("udpAddr", addr).Error("Failed to write outgoing packet")
+		return
+	}
+
+	n := s.failures.Add(1)
+	d := min
+	max := time.Duration(sb.max.Load())
+	for i := uint32(1); i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	s.until.Store(time.Now().Add(d).UnixNano())
+
+	if n == 1 {
+		hostinfo.logger(sb.l).WithError(err).WithField("udpAddr", addr).WithField("backoff", d).
+			Error("Failed to write outgoing packet, pausing sends")
+	} else {
+		hostinfo.logger(sb.l).WithError(err).WithField("udpAddr", addr).WithField("backoff", d).
+			WithField("failures", n).Debug("Failed to write outgoing packet, pausing sends")
+	}
+}
+
+// status returns the backoff state of hostinfo or nil if its sends are not failing
+func (s *sendBackoffState) status() *SendBackoffStatus {
+	n := s.failures.Load()
+	if n == 0 {
+		return nil
+	}
+
+	st := &SendBackoffStatus{Failures: n, Until: time.Unix(0, s.until.Load())}
+	if e := s.lastErr.Load(); e != nil {
+		st.LastError = *e
+	}
+	return st
+}
+
+// isTransientSendError returns true for errors where the socket was only momentarily unable to take the packet
+func isTransientSendError(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EWOULDBLOCK) || errors.Is(err, syscall.EINTR)
+}
@@ -0,0 +1,128 @@
+package nebula
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingConn counts writes and fails them with err
+type failingConn struct {
+	udp.NoopConn
+	err    error
+	writes []netip.AddrPort
+}
+
+func (c *failingConn) WriteTo(_ []byte, addr netip.AddrPort) error {
+	c.writes = append(c.writes, addr)
+	return c.err
+}
+
+func TestSendBackoff_sendNoMetrics(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	sb := NewSendBackoffFromConfig(l, c)
+	conn := &failingConn{}
+	f := &Interface{
+		l:                 l,
+		sendBackoff:       sb,
+		writers:           []udp.Conn{conn},
+		connectionManager: &connectionManager{out: map[uint32]struct{}{}, outLock: &sync.RWMutex{}},
+	}
+
+	cs := &NebulaCipherState{c: noise.CipherChaChaPoly.Cipher([32]byte{1})}
+	remote := netip.MustParseAddrPort("10.0.0.2:4242")
+	hostinfo := &HostInfo{remote: remote, ConnectionState: &ConnectionState{eKey: cs, dKey: cs}}
+
+	send := func(t header.MessageType, to netip.AddrPort) {
+		f.sendNoMetrics(t, 0, hostinfo.ConnectionState, hostinfo, to, []byte("hi"), make([]byte, 12), make([]byte, mtu), 0)
+	}
+
+	// A working socket never touches the backoff
+	send(header.Message, netip.AddrPort{})
+	assert.Len(t, conn.writes, 1)
+	assert.Nil(t, hostinfo.sendBackoff.status())
+
+	// A failure pauses the tunnel
+	conn.err = &net.OpError{Op: "sendto", Err: syscall.ENETUNREACH}
+	failed := sb.metricFailed.Count()
+	dropped := sb.metricDropped.Count()
+	send(header.Message, netip.AddrPort{})
+	assert.Len(t, conn.writes, 2)
+	assert.Equal(t, failed+1, sb.metricFailed.Count())
+	status := hostinfo.sendBackoff.status()
+	require.NotNil(t, status)
+	assert.Equal(t, uint32(1), status.Failures)
+	assert.Equal(t, "sendto: network is unreachable", status.LastError)
+
+	send(header.Message, netip.AddrPort{})
+	send(header.Message, remote)
+	assert.Len(t, conn.writes, 2)
+	assert.Equal(t, dropped+2, sb.metricDropped.Count())
+
+	// Closing the tunnel is still attempted
+	send(header.CloseTunnel, netip.AddrPort{})
+	assert.Len(t, conn.writes, 3)
+	assert.Equal(t, uint32(2), hostinfo.sendBackoff.status().Failures)
+
+	// Other candidate remotes are neither held back nor counted
+	other := netip.MustParseAddrPort("10.0.0.3:4242")
+	send(header.Test, other)
+	assert.Equal(t, other, conn.writes[3])
+	assert.Equal(t, uint32(2), hostinfo.sendBackoff.status().Failures)
+
+	// Once the pause is over a successful send clears it
+	hostinfo.sendBackoff.until.Store(0)
+	conn.err = nil
+	send(header.Message, netip.AddrPort{})
+	assert.Len(t, conn.writes, 5)
+	assert.Nil(t, hostinfo.sendBackoff.status())
+
+	// A busy socket only drops the packet
+	conn.err = &net.OpError{Op: "sendto", Err: syscall.EAGAIN}
+	transient := sb.metricTransient.Count()
+	send(header.Message, netip.AddrPort{})
+	send(header.Message, netip.AddrPort{})
+	assert.Len(t, conn.writes, 7)
+	assert.Equal(t, transient+2, sb.metricTransient.Count())
+	assert.Nil(t, hostinfo.sendBackoff.status())
+}
+
+func TestSendBackoff_result(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["send_backoff"] = map[interface{}]interface{}{"min": "1s", "max": "4s"}
+	sb := NewSendBackoffFromConfig(l, c)
+	hostinfo := &HostInfo{}
+	err := &net.OpError{Op: "sendto", Err: syscall.ENOBUFS}
+
+	// The pause doubles with every failure up to max
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		before := time.Now()
+		sb.result(hostinfo, netip.AddrPort{}, err)
+		until := time.Unix(0, hostinfo.sendBackoff.until.Load())
+		assert.WithinRange(t, until, before.Add(want), time.Now().Add(want))
+		assert.True(t, sb.paused(hostinfo))
+	}
+
+	// Disabled backoff never pauses
+	require.NoError(t, c.ReloadConfigString("send_backoff:\n  min: 0"))
+	hostinfo = &HostInfo{}
+	sb.result(hostinfo, netip.AddrPort{}, err)
+	assert.False(t, sb.paused(hostinfo))
+
+	var nilBackoff *SendBackoff
+	nilBackoff.result(hostinfo, netip.AddrPort{}, err)
+	assert.False(t, nilBackoff.paused(hostinfo))
+}
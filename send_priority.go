@@ -0,0 +1,553 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	// maxSendClasses is the number of priority classes including the default class
+	maxSendClasses = 8
+
+	defaultSendQueueLen = 256
+
+	// sendPriorityRetryMin and sendPriorityRetryMax bound how long the drain routine waits for a busy socket
+	sendPriorityRetryMin = 100 * time.Microsecond
+	sendPriorityRetryMax = 10 * time.Millisecond
+
+	// defaultWREDMaxProbability and defaultWREDWeight are the classic RED values
+	defaultWREDMaxProbability = 0.1
+	defaultWREDWeight         = 0.002
+	// wredIdleSlot is about the time it takes to send a packet, while the queues are empty the wred averages decay as if
+	// a packet found the queue empty every slot
+	wredIdleSlot = 10 * time.Microsecond
+)
+
+// SendPriority queues outgoing packets in priority classes while the underlay socket is backed up. Peers are mapped
+// to a class by the groups in their certificate, the first class in send_priority.classes with a matching group wins
+// and peers matching none go to the default class, which is always the lowest.
+//
+// Nothing is queued while the socket takes packets. Packets are written without waiting for room in the socket send
+// buffer, on linux, so a full buffer fails the write with EAGAIN, or ENOBUFS when the kernel is out of buffers. The
+// packet, and every packet sent by that routine after it, is then queued until the queues are empty again. On
+// platforms where writes always block nothing is ever queued. A drain routine started for the backlog sends with
+// blocking writes in rounds, highest class first, each class sending up to its weight in packets per round.
+// Higher classes are served first and get a larger share without starving lower classes. A packet that does not fit in
+// its class queue is dropped. Queued packets are already encrypted, queueing only reorders packets between peers.
+//
+// With send_priority.wred a class queue drops packets at random before it is full, so that many TCP flows sharing the
+// backlog back off at different times instead of all at once when the queue overflows. See wredProfile.
+type SendPriority struct {
+	enabled  atomic.Bool
+	queueLen atomic.Int64
+	classes  atomic.Pointer[sendClasses]
+
+	queues      []*sendQueue
+	dropped     [maxSendClasses]atomic.Uint64
+	wredDropped [maxSendClasses]atomic.Uint64
+	// rand returns a random number in [0, 1) for the wred drop decision
+	rand func() float64
+
+	metricQueued      metrics.Counter
+	metricDropped     metrics.Counter
+	metricWREDDropped metrics.Counter
+	l                 *logrus.Logger
+}
+
+// sendClasses is the class configuration, the last entry is the default class
+type sendClasses []sendClass
+
+type sendClass struct {
+	name   string
+	groups []string
+	weight int
+	// wred is nil unless send_priority.wred is enabled
+	wred *wredProfile
+}
+
+// wredProfile is the weighted random early detection of a class queue. avg is a moving average of the queue length,
+// updated with weight on every packet queued. Below min no packet is dropped, from min to max a packet is dropped with
+// a probability rising linearly from 0 to maxProbability, and at max or above every packet is dropped. The moving
+// average lets a short burst through while a queue that stays long starts dropping early. A socket that is congested
+// empties and refills the queues many times a second, the average carries over from one backlog to the next and only
+// decays with the time the queues were empty, see wredIdleSlot.
+type wredProfile struct {
+	min            float64
+	max            float64
+	maxProbability float64
+	weight         float64
+}
+
+// sendQueue holds the backlog of one routine
+type sendQueue struct {
+	sync.Mutex
+	classes [maxSendClasses][]queuedPacket
+	// depth is the number of queued packets, including the one being written by the drain routine
+	depth    atomic.Int64
+	perClass [maxSendClasses]atomic.Int64
+	draining bool
+	// idleSince is when the queues last ran empty
+	idleSince time.Time
+	// avg is the wred moving average of each class queue, avgBits mirrors it for Status
+	avg     [maxSendClasses]float64
+	avgBits [maxSendClasses]atomic.Uint64
+
+	// cur is the class being served in the current round and credit what it may still send
+	cur    int
+	credit int
+}
+
+type queuedPacket struct {
+	hostinfo *HostInfo
+	b        []byte
+	addr     netip.AddrPort
+	ecn      uint8
+}
+
+// SendQueueStatus is the backlog of one priority class across all routines
+type SendQueueStatus struct {
+	Class   string   `json:"class"`
+	Groups  []string `json:"groups,omitempty"`
+	Weight  int      `json:"weight"`
+	Depth   int64    `json:"depth"`
+	Dropped uint64   `json:"dropped"`
+	// Occupancy is Depth as a share of the queues of every routine, 0 to 1
+	Occupancy float64 `json:"occupancy"`
+	// AvgDepth is the sum of the wred moving averages of the class queues and WREDDropped the packets wred dropped
+	AvgDepth    float64 `json:"avgDepth"`
+	WREDDropped uint64  `json:"wredDropped"`
+}
+
+func NewSendPriorityFromConfig(l *logrus.Logger, c *config.C, routines int) (*SendPriority, error) {
+	sp := &SendPriority{
+		queues:            make([]*sendQueue, routines),
+		rand:              rand.Float64,
+		metricQueued:      metrics.GetOrRegisterCounter("send_priority.queued", nil),
+		metricDropped:     metrics.GetOrRegisterCounter("send_priority.dropped", nil),
+		metricWREDDropped: metrics.GetOrRegisterCounter("send_priority.wred.dropped", nil),
+		l:                 l,
+	}
+	for i := range sp.queues {
+		sp.queues[i] = &sendQueue{}
+	}
+
+	if err := sp.reload(c, true); err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := sp.reload(c, false); err != nil {
+			l.WithError(err).Error("Failed to reload send_priority, keeping the previous classes")
+		}
+	})
+
+	return sp, nil
+}
+
+func (sp *SendPriority) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("send_priority") {
+		return nil
+	}
+
+	queueLen := c.GetInt("send_priority.queue_len", defaultSendQueueLen)
+	if queueLen < 1 {
+		return fmt.Errorf("send_priority.queue_len must be at least 1")
+	}
+
+	classes, err := parseSendClasses(c, queueLen)
+	if err != nil {
+		return err
+	}
+
+	sp.classes.Store(&classes)
+	sp.queueLen.Store(int64(queueLen))
+	sp.enabled.Store(c.GetBool("send_priority.enabled", false))
+
+	if !initial || sp.enabled.Load() {
+		sp.l.WithField("enabled", sp.enabled.Load()).
+			WithField("classes", len(classes)).
+			WithField("queueLen", queueLen).
+			WithField("wred", classes[len(classes)-1].wred != nil).
+			Info("Send priority configured")
+	}
+	return nil
+}
+
+func parseSendClasses(c *config.C, queueLen int) (sendClasses, error) {
+	wred, err := parseWREDProfile(c, queueLen)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := c.Get("send_priority.classes")
+	var list []interface{}
+	if raw != nil {
+		var ok bool
+		if list, ok = raw.([]interface{}); !ok {
+			return nil, errors.New("send_priority.classes must be a list")
+		}
+	}
+
+	if len(list) >= maxSendClasses {
+		return nil, fmt.Errorf("send_priority.classes has %d classes, at most %d are supported", len(list), maxSendClasses-1)
+	}
+
+	classes := make(sendClasses, 0, len(list)+1)
+	for i, v := range list {
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("send_priority.classes.%d must be a map with groups and weight", i)
+		}
+
+		sc := sendClass{name: fmt.Sprintf("%v", m["name"]), weight: 1}
+		if m["name"] == nil {
+			sc.name = fmt.Sprintf("class%d", i)
+		}
+
+		groups, ok := m["groups"].([]interface{})
+		if !ok || len(groups) == 0 {
+			return nil, fmt.Errorf("send_priority.classes.%d.groups must be a non empty list", i)
+		}
+		for _, g := range groups {
+			sc.groups = append(sc.groups, fmt.Sprintf("%v", g))
+		}
+
+		if w, ok := m["weight"]; ok {
+			weight, ok := w.(int)
+			if !ok || weight < 1 {
+				return nil, fmt.Errorf("send_priority.classes.%d.weight must be a positive integer", i)
+			}
+			sc.weight = weight
+		}
+
+		sc.wred = wred
+		if raw, ok := m["wred"]; ok && wred != nil {
+			sc.wred, err = wred.override(raw, queueLen, fmt.Sprintf("send_priority.classes.%d.wred", i))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		classes = append(classes, sc)
+	}
+
+	weight := c.GetInt("send_priority.default_weight", 1)
+	if weight < 1 {
+		return nil, errors.New("send_priority.default_weight must be a positive integer")
+	}
+
+	return append(classes, sendClass{name: "default", weight: weight, wred: wred}), nil
+}
+
+// parseWREDProfile returns the send_priority.wred profile of the default class, and of every class that does not
+// override it, nil if wred is not enabled
+func parseWREDProfile(c *config.C, queueLen int) (*wredProfile, error) {
+	if !c.GetBool("send_priority.wred.enabled", false) {
+		return nil, nil
+	}
+
+	w := &wredProfile{
+		min:            float64(c.GetInt("send_priority.wred.min_threshold", queueLen/4)),
+		max:            float64(c.GetInt("send_priority.wred.max_threshold", queueLen*3/4)),
+		maxProbability: c.GetFloat64("send_priority.wred.max_probability", defaultWREDMaxProbability),
+		weight:         c.GetFloat64("send_priority.wred.weight", defaultWREDWeight),
+	}
+	if w.weight <= 0 || w.weight > 1 {
+		return nil, fmt.Errorf("send_priority.wred.weight must be greater than 0 and at most 1, got %v", w.weight)
+	}
+	return w, w.validate(queueLen, "send_priority.wred")
+}
+
+// override returns a copy of w with the thresholds and probability set in the class wred map raw
+func (w *wredProfile) override(raw interface{}, queueLen int, name string) (*wredProfile, error) {
+	m, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a map", name)
+	}
+
+	o := *w
+	for k, v := range m {
+		var err error
+		switch k {
+		case "min_threshold":
+			o.min, err = wredNumber(v)
+		case "max_threshold":
+			o.max, err = wredNumber(v)
+		case "max_probability":
+			o.maxProbability, err = wredNumber(v)
+		default:
+			err = errors.New("only min_threshold, max_threshold and max_probability can be set per class")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s.%v: %w", name, k, err)
+		}
+	}
+	return &o, o.validate(queueLen, name)
+}
+
+func wredNumber(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+func (w *wredProfile) validate(queueLen int, name string) error {
+	if w.min < 0 || w.min >= w.max || w.max > float64(queueLen) {
+		return fmt.Errorf("%s thresholds must be 0 <= min_threshold < max_threshold <= queue_len %d, got %v and %v",
+			name, queueLen, w.min, w.max)
+	}
+	if w.maxProbability <= 0 || w.maxProbability > 1 {
+		return fmt.Errorf("%s.max_probability must be greater than 0 and at most 1, got %v", name, w.maxProbability)
+	}
+	return nil
+}
+
+// probability returns the chance a packet is dropped with the moving average queue length avg
+func (w *wredProfile) probability(avg float64) float64 {
+	switch {
+	case avg < w.min:
+		return 0
+	case avg >= w.max:
+		return 1
+	}
+	return w.maxProbability * (avg - w.min) / (w.max - w.min)
+}
+
+// drop updates the moving average *avg with the current queue length and returns true if the packet about to be
+// queued should be dropped, r is a random number in [0, 1)
+func (w *wredProfile) drop(avg *float64, queueLen int, r float64) bool {
+	*avg += w.weight * (float64(queueLen) - *avg)
+	p := w.probability(*avg)
+	return p >= 1 || r < p
+}
+
+// classOf returns the index of the class hostinfo belongs to
+func (sc sendClasses) classOf(hostinfo *HostInfo) int {
+	def := len(sc) - 1
+	peerCert := hostinfo.GetCert()
+	if peerCert == nil {
+		return def
+	}
+
+	for i, class := range sc[:def] {
+		for _, g := range class.groups {
+			if _, ok := peerCert.Details.InvertedGroups[g]; ok {
+				return i
+			}
+		}
+	}
+	return def
+}
+
+// writeTo writes b to addr on the socket of routine q, or queues a copy if the socket is backed up. A queued packet
+// reports nil, the outcome of its write is recorded by the drain routine.
+func (sp *SendPriority) writeTo(f *Interface, hostinfo *HostInfo, q int, b []byte, addr netip.AddrPort, ecn uint8) error {
+	if sp == nil || !sp.enabled.Load() || q >= len(sp.queues) {
+		return f.writeTo(q, hostinfo, b, addr, ecn)
+	}
+
+	s := sp.queues[q]
+	if s.depth.Load() == 0 {
+		err := f.writeToDontWait(q, hostinfo, b, addr, ecn)
+		if err == nil || !isSendCongestion(err) {
+			return err
+		}
+	}
+
+	sp.enqueue(f, q, queuedPacket{hostinfo: hostinfo, b: append([]byte(nil), b...), addr: addr, ecn: ecn})
+	return nil
+}
+
+func (sp *SendPriority) enqueue(f *Interface, q int, p queuedPacket) {
+	classes := *sp.classes.Load()
+	class := classes.classOf(p.hostinfo)
+	// The default class stays the lowest even if a reload removed classes while packets were queued
+	if class == len(classes)-1 {
+		class = maxSendClasses - 1
+	}
+
+	s := sp.queues[q]
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.draining {
+		s.decay(classes, time.Since(s.idleSince))
+	}
+
+	if sc := classes.at(class); sc != nil && sc.wred != nil {
+		drop := sc.wred.drop(&s.avg[class], len(s.classes[class]), sp.rand())
+		s.avgBits[class].Store(math.Float64bits(s.avg[class]))
+		if drop {
+			sp.wredDropped[class].Add(1)
+			sp.metricWREDDropped.Inc(1)
+			return
+		}
+	}
+
+	if int64(len(s.classes[class])) >= sp.queueLen.Load() {
+		sp.dropped[class].Add(1)
+		sp.metricDropped.Inc(1)
+		return
+	}
+
+	s.classes[class] = append(s.classes[class], p)
+	s.perClass[class].Add(1)
+	s.depth.Add(1)
+	sp.metricQueued.Inc(1)
+
+	if !s.draining {
+		// Every backlog starts a fresh round with the highest class
+		s.draining = true
+		s.cur, s.credit = maxSendClasses-1, 0
+		go sp.drain(f, q, s)
+	}
+}
+
+// decay ages the wred averages by the idle time the queues were empty for, as RED does for an idle queue
+func (s *sendQueue) decay(classes sendClasses, idle time.Duration) {
+	for i := range s.avg {
+		if s.avg[i] == 0 {
+			continue
+		}
+
+		sc := classes.at(i)
+		if sc == nil || sc.wred == nil {
+			s.avg[i] = 0
+		} else {
+			s.avg[i] *= math.Pow(1-sc.wred.weight, float64(idle/wredIdleSlot))
+		}
+		s.avgBits[i].Store(math.Float64bits(s.avg[i]))
+	}
+}
+
+// at returns the class of the queue at class index i, nil if a reload removed it
+func (sc sendClasses) at(i int) *sendClass {
+	if i == maxSendClasses-1 {
+		return &sc[len(sc)-1]
+	}
+	if i < len(sc)-1 {
+		return &sc[i]
+	}
+	return nil
+}
+
+// weight returns the weight of the queue at class index i
+func (sp *SendPriority) weight(i int) int {
+	if sc := sp.classes.Load().at(i); sc != nil {
+		return sc.weight
+	}
+	// The class was removed by a reload, drain what is left at the lowest weight
+	return 1
+}
+
+// next returns the packet to send next, following the weighted rounds. The packet stays queued until done is called.
+func (s *sendQueue) next(sp *SendPriority) (queuedPacket, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	// One pass over every class is enough to find a packet, a second allows for starting a new round
+	for i := 0; i < 2*maxSendClasses; i++ {
+		if s.credit > 0 && len(s.classes[s.cur]) > 0 {
+			return s.classes[s.cur][0], true
+		}
+
+		s.cur = (s.cur + 1) % maxSendClasses
+		s.credit = sp.weight(s.cur)
+	}
+
+	s.draining = false
+	s.idleSince = time.Now()
+	return queuedPacket{}, false
+}
+
+// done removes the packet returned by next
+func (s *sendQueue) done() {
+	s.Lock()
+	s.classes[s.cur][0] = queuedPacket{}
+	s.classes[s.cur] = s.classes[s.cur][1:]
+	s.perClass[s.cur].Add(-1)
+	s.depth.Add(-1)
+	s.credit--
+	s.Unlock()
+}
+
+// drain sends the backlog of routine q, it returns once the queues are empty
+func (sp *SendPriority) drain(f *Interface, q int, s *sendQueue) {
+	wait := sendPriorityRetryMin
+	for !f.closed.Load() {
+		p, ok := s.next(sp)
+		if !ok {
+			return
+		}
+
+		err := f.writeTo(q, p.hostinfo, p.b, p.addr, p.ecn)
+		if err != nil && isSendCongestion(err) {
+			// Still backed up, try the same packet again shortly
+			time.Sleep(wait)
+			wait = min(wait*2, sendPriorityRetryMax)
+			continue
+		}
+
+		wait = sendPriorityRetryMin
+		s.done()
+
+		if p.addr == p.hostinfo.remote {
+			f.sendBackoff.result(p.hostinfo, p.addr, err)
+		} else if err != nil {
+			p.hostinfo.logger(f.l).WithError(err).
+				WithField("udpAddr", p.addr).Error("Failed to write outgoing packet")
+		}
+	}
+}
+
+// Status returns the backlog of every configured class, the default class is last
+func (sp *SendPriority) Status() []SendQueueStatus {
+	if sp == nil {
+		return nil
+	}
+
+	classes := *sp.classes.Load()
+	st := make([]SendQueueStatus, len(classes))
+	for i, class := range classes {
+		qi := i
+		if i == len(classes)-1 {
+			qi = maxSendClasses - 1
+		}
+
+		st[i] = SendQueueStatus{
+			Class:       class.name,
+			Groups:      class.groups,
+			Weight:      class.weight,
+			Dropped:     sp.dropped[qi].Load(),
+			WREDDropped: sp.wredDropped[qi].Load(),
+		}
+		for _, s := range sp.queues {
+			st[i].Depth += s.perClass[qi].Load()
+			st[i].AvgDepth += math.Float64frombits(s.avgBits[qi].Load())
+		}
+		if capacity := sp.queueLen.Load() * int64(len(sp.queues)); capacity > 0 {
+			st[i].Occupancy = float64(st[i].Depth) / float64(capacity)
+		}
+	}
+	return st
+}
+
+// isSendCongestion returns true for errors that mean the socket, or the kernel behind it, has no room for the packet
+func isSendCongestion(err error) bool {
+	return isTransientSendError(err) || errors.Is(err, syscall.ENOBUFS)
+}
@@ -0,0 +1,411 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// busyConn fails writes with EAGAIN while busy is set and records the payload of every write that went through
+type busyConn struct {
+	udp.NoopConn
+	busy atomic.Bool
+
+	sync.Mutex
+	written []string
+}
+
+func (c *busyConn) WriteTo(b []byte, _ netip.AddrPort) error {
+	if c.busy.Load() {
+		return syscall.EAGAIN
+	}
+
+	c.Lock()
+	c.written = append(c.written, string(b))
+	c.Unlock()
+	return nil
+}
+
+func (c *busyConn) writes() []string {
+	c.Lock()
+	defer c.Unlock()
+	return append([]string(nil), c.written...)
+}
+
+func newGroupHostInfo(remote string, groups ...string) *HostInfo {
+	ig := map[string]struct{}{}
+	for _, g := range groups {
+		ig[g] = struct{}{}
+	}
+
+	return &HostInfo{
+		remote:          netip.MustParseAddrPort(remote),
+		ConnectionState: &ConnectionState{peerCert: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Groups: groups, InvertedGroups: ig}}},
+	}
+}
+
+func TestSendPriority_config(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	sp, err := NewSendPriorityFromConfig(l, c, 1)
+	require.NoError(t, err)
+	assert.False(t, sp.enabled.Load())
+	assert.Equal(t, []SendQueueStatus{{Class: "default", Weight: 1}}, sp.Status())
+
+	require.NoError(t, c.ReloadConfigString(`
+send_priority:
+  enabled: true
+  classes:
+    - name: voice
+      groups: ["voip"]
+      weight: 8
+    - groups: ["ops", "admin"]
+  default_weight: 2
+`))
+	assert.True(t, sp.enabled.Load())
+	assert.Equal(t, []SendQueueStatus{
+		{Class: "voice", Groups: []string{"voip"}, Weight: 8},
+		{Class: "class1", Groups: []string{"ops", "admin"}, Weight: 1},
+		{Class: "default", Weight: 2},
+	}, sp.Status())
+
+	classes := *sp.classes.Load()
+	assert.Equal(t, 0, classes.classOf(newGroupHostInfo("10.0.0.1:4242", "admin", "voip")))
+	assert.Equal(t, 1, classes.classOf(newGroupHostInfo("10.0.0.1:4242", "admin")))
+	assert.Equal(t, 2, classes.classOf(newGroupHostInfo("10.0.0.1:4242", "web")))
+	assert.Equal(t, 2, classes.classOf(&HostInfo{}))
+
+	// A bad reload keeps the old classes
+	require.NoError(t, c.ReloadConfigString("send_priority:\n  enabled: true\n  classes:\n    - weight: 2\n"))
+	assert.Len(t, sp.Status(), 3)
+
+	for _, bad := range []string{
+		"send_priority:\n  classes: nope\n",
+		"send_priority:\n  classes:\n    - groups: [a]\n      weight: 0\n",
+		"send_priority:\n  default_weight: -1\n",
+		"send_priority:\n  queue_len: 0\n",
+		"send_priority:\n  classes: [{groups: [a]}, {groups: [a]}, {groups: [a]}, {groups: [a]}, {groups: [a]}, {groups: [a]}, {groups: [a]}, {groups: [a]}]\n",
+	} {
+		c = config.NewC(l)
+		require.NoError(t, c.LoadString(bad))
+		_, err = NewSendPriorityFromConfig(l, c, 1)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestSendPriority_writeTo(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+send_priority:
+  enabled: true
+  queue_len: 4
+  classes:
+    - name: voice
+      groups: ["voip"]
+      weight: 2
+`))
+	sp, err := NewSendPriorityFromConfig(l, c, 1)
+	require.NoError(t, err)
+
+	conn := &busyConn{}
+	f := &Interface{l: l, writers: []udp.Conn{conn}}
+	voice := newGroupHostInfo("10.0.0.2:4242", "voip")
+	other := newGroupHostInfo("10.0.0.3:4242", "web")
+
+	// Not congested, written straight away
+	require.NoError(t, sp.writeTo(f, other, 0, []byte("direct"), other.remote, ecnNotECT))
+	assert.Equal(t, []string{"direct"}, conn.writes())
+
+	// The socket fills up, the first packet is queued and holds up the rest
+	conn.busy.Store(true)
+	for _, p := range []string{"v1", "v2", "v3", "v4"} {
+		require.NoError(t, sp.writeTo(f, voice, 0, []byte(p), voice.remote, ecnNotECT))
+	}
+	for _, p := range []string{"d1", "d2", "d3", "d4", "d5"} {
+		require.NoError(t, sp.writeTo(f, other, 0, []byte(p), other.remote, ecnNotECT))
+	}
+
+	st := sp.Status()
+	assert.EqualValues(t, 4, st[0].Depth)
+	assert.EqualValues(t, 4, st[1].Depth)
+	// d5 did not fit behind d1 through d4
+	assert.EqualValues(t, 1, st[1].Dropped)
+	assert.EqualValues(t, 0, st[0].Dropped)
+
+	conn.busy.Store(false)
+	assert.Eventually(t, func() bool { return sp.queues[0].depth.Load() == 0 }, time.Second, time.Millisecond)
+
+	// The voice class sends 2 for every 1 of the default class
+	assert.Equal(t, []string{"direct", "v1", "v2", "d1", "v3", "v4", "d2", "d3", "d4"}, conn.writes())
+
+	// Back to direct writes once the backlog is gone
+	require.NoError(t, sp.writeTo(f, other, 0, []byte("direct"), other.remote, ecnNotECT))
+	assert.Equal(t, "direct", conn.writes()[9])
+
+	// Disabled drops on a busy socket as before
+	require.NoError(t, c.ReloadConfigString("send_priority:\n  enabled: false\n"))
+	conn.busy.Store(true)
+	assert.ErrorIs(t, sp.writeTo(f, other, 0, []byte("nope"), other.remote, ecnNotECT), syscall.EAGAIN)
+	assert.EqualValues(t, 0, sp.queues[0].depth.Load())
+}
+
+// congestedRemote returns an address on a local subnet that nothing answers for. Packets to it wait for neighbor
+// resolution and stay charged to the send buffer of the socket, which fills a small buffer after a few packets. The test
+// is skipped if the host has no such subnet.
+func congestedRemote(t *testing.T) netip.AddrPort {
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&(net.FlagLoopback|net.FlagPointToPoint) != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			ones, _ := ipNet.Mask.Size()
+			if ones > 28 {
+				continue
+			}
+			// The last usable address of the subnet, less a few to stay clear of a gateway there
+			prefix := netip.PrefixFrom(netip.AddrFrom4([4]byte(ipNet.IP.To4())), ones).Masked()
+			last := binary.BigEndian.Uint32(prefix.Addr().AsSlice()) | (1<<(32-ones) - 1)
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], last-3)
+			if addr := netip.AddrFrom4(b); addr != netip.AddrFrom4([4]byte(ipNet.IP.To4())) {
+				return netip.AddrPortFrom(addr, 4242)
+			}
+		}
+	}
+	t.Skip("no local ipv4 subnet to congest a socket with")
+	return netip.AddrPort{}
+}
+
+func TestSendPriority_realSocket(t *testing.T) {
+	l := test.NewLogger()
+	conn, err := udp.NewListener(l, netip.MustParseAddr("0.0.0.0"), 0, false, 64)
+	require.NoError(t, err)
+	defer conn.Close()
+	if _, ok := conn.(udp.DontWaitWriter); !ok {
+		t.Skip("udp writes always block on this platform")
+	}
+	remote := congestedRemote(t)
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("listen: {write_buffer: 1}\nsend_priority: {enabled: true, queue_len: 16}"))
+	conn.ReloadConfig(c)
+	sp, err := NewSendPriorityFromConfig(l, c, 1)
+	require.NoError(t, err)
+
+	f := &Interface{l: l, outside: conn, writers: []udp.Conn{conn}}
+	defer f.closed.Store(true)
+	hostinfo := &HostInfo{remote: remote}
+
+	// The first packets fit in the send buffer, once it is full writes return instead of blocking and queue
+	p := make([]byte, 1200)
+	queued := sp.metricQueued.Count()
+	for i := 0; i < 64 && sp.metricQueued.Count() == queued; i++ {
+		done := make(chan error, 1)
+		go func() { done <- sp.writeTo(f, hostinfo, 0, p, remote, ecnNotECT) }()
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("writeTo blocked on a full send buffer")
+		}
+	}
+	if sp.metricQueued.Count() == queued {
+		t.Skipf("%v answered, the send buffer never filled", remote.Addr())
+	}
+
+	assert.Greater(t, sp.Status()[0].Depth, int64(0))
+	assert.Greater(t, sp.queues[0].depth.Load(), int64(0), "the drain routine waits for room in the send buffer")
+}
+
+func TestSendPriority_wred(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+send_priority:
+  enabled: true
+  queue_len: 8
+  wred:
+    enabled: true
+    weight: 1
+  classes:
+    - name: bulk
+      groups: ["backup"]
+      wred: {min_threshold: 1, max_threshold: 4, max_probability: 0.5}
+`))
+	sp, err := NewSendPriorityFromConfig(l, c, 1)
+	require.NoError(t, err)
+
+	classes := *sp.classes.Load()
+	assert.Equal(t, &wredProfile{min: 1, max: 4, maxProbability: 0.5, weight: 1}, classes[0].wred)
+	assert.Equal(t, &wredProfile{min: 2, max: 6, maxProbability: defaultWREDMaxProbability, weight: 1}, classes[1].wred)
+
+	conn := &busyConn{}
+	conn.busy.Store(true)
+	f := &Interface{l: l, writers: []udp.Conn{conn}}
+	bulk := newGroupHostInfo("10.0.0.2:4242", "backup")
+	other := newGroupHostInfo("10.0.0.3:4242", "web")
+
+	// With a weight of 1 the average is the queue length, a random 0.3 drops once the probability is above it
+	sp.rand = func() float64 { return 0.3 }
+	for range 8 {
+		require.NoError(t, sp.writeTo(f, bulk, 0, []byte("b"), bulk.remote, ecnNotECT))
+		require.NoError(t, sp.writeTo(f, other, 0, []byte("d"), other.remote, ecnNotECT))
+	}
+
+	st := sp.Status()
+	// bulk queues at lengths 0 to 2, drops at 3 with a probability of 1/3 and from then on at 4 and above
+	assert.EqualValues(t, 3, st[0].Depth)
+	assert.EqualValues(t, 5, st[0].WREDDropped)
+	assert.EqualValues(t, 3, st[0].AvgDepth)
+	assert.InDelta(t, 3.0/8, st[0].Occupancy, 0.001)
+	// The default class has a probability of at most 0.1 below 6 and drops every packet at 6
+	assert.EqualValues(t, 6, st[1].Depth)
+	assert.EqualValues(t, 2, st[1].WREDDropped)
+	assert.Zero(t, st[1].Dropped, "wred drops before the queue is full")
+
+	conn.busy.Store(false)
+	assert.Eventually(t, func() bool { return sp.queues[0].depth.Load() == 0 }, time.Second, time.Millisecond)
+
+	for _, bad := range []string{
+		"send_priority:\n  wred: {enabled: true, min_threshold: 10, max_threshold: 5}\n",
+		"send_priority:\n  wred: {enabled: true, max_threshold: 300}\n",
+		"send_priority:\n  wred: {enabled: true, max_probability: 0}\n",
+		"send_priority:\n  wred: {enabled: true, weight: 2}\n",
+		"send_priority:\n  wred: {enabled: true}\n  classes: [{groups: [a], wred: {min: 1}}]\n",
+		"send_priority:\n  wred: {enabled: true}\n  classes: [{groups: [a], wred: {max_probability: nope}}]\n",
+	} {
+		c = config.NewC(l)
+		require.NoError(t, c.LoadString(bad))
+		_, err = NewSendPriorityFromConfig(l, c, 1)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestSendPriority_wredRealSocket(t *testing.T) {
+	l := test.NewLogger()
+	conn, err := udp.NewListener(l, netip.MustParseAddr("0.0.0.0"), 0, false, 64)
+	require.NoError(t, err)
+	defer conn.Close()
+	if _, ok := conn.(udp.DontWaitWriter); !ok {
+		t.Skip("udp writes always block on this platform")
+	}
+	remote := congestedRemote(t)
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+listen: {write_buffer: 1}
+send_priority:
+  enabled: true
+  queue_len: 32
+  wred: {enabled: true, min_threshold: 4, max_threshold: 16, max_probability: 0.5, weight: 0.5}
+`))
+	conn.ReloadConfig(c)
+	sp, err := NewSendPriorityFromConfig(l, c, 1)
+	require.NoError(t, err)
+	sp.rand = rand.New(rand.NewPCG(1, 2)).Float64
+
+	f := &Interface{l: l, outside: conn, writers: []udp.Conn{conn}}
+	defer f.closed.Store(true)
+	hostinfo := &HostInfo{remote: remote}
+
+	p := make([]byte, 1200)
+	for range 200 {
+		require.NoError(t, sp.writeTo(f, hostinfo, 0, p, remote, ecnNotECT))
+	}
+	if sp.queues[0].depth.Load() == 0 {
+		t.Skipf("%v answered, the send buffer never filled", remote.Addr())
+	}
+
+	st := sp.Status()[0]
+	assert.Greater(t, st.WREDDropped, uint64(0))
+	assert.Zero(t, st.Dropped, "wred drops before the queue is full")
+	assert.Less(t, st.Depth, int64(32))
+	assert.Greater(t, st.AvgDepth, 4.0)
+}
+
+func TestSendQueue_decay(t *testing.T) {
+	classes := sendClasses{
+		{name: "bulk", wred: &wredProfile{min: 1, max: 4, maxProbability: 0.5, weight: 0.5}},
+		{name: "default"},
+	}
+	s := &sendQueue{}
+	s.avg[0], s.avg[maxSendClasses-1] = 8, 3
+
+	s.decay(classes, 0)
+	assert.Equal(t, 8.0, s.avg[0], "back to back backlogs keep the average")
+	assert.Zero(t, s.avg[maxSendClasses-1], "no wred, no average")
+
+	s.decay(classes, 2*wredIdleSlot)
+	assert.Equal(t, 2.0, s.avg[0], "every idle slot is an empty queue seen")
+	assert.Equal(t, 2.0, math.Float64frombits(s.avgBits[0].Load()))
+
+	s.decay(classes, time.Hour)
+	assert.Zero(t, s.avg[0])
+}
+
+// TestWREDProfile_curve simulates the drops at a steady average queue length along the whole curve
+func TestWREDProfile_curve(t *testing.T) {
+	w := &wredProfile{min: 50, max: 150, maxProbability: 0.2, weight: 1}
+	r := rand.New(rand.NewPCG(1, 2))
+
+	const packets = 100000
+	prev := -1.0
+	for avg := 0; avg <= 200; avg += 10 {
+		expected := w.probability(float64(avg))
+		switch {
+		case avg < 50:
+			assert.Zero(t, expected, avg)
+		case avg >= 150:
+			assert.Equal(t, 1.0, expected, avg)
+		default:
+			assert.InDelta(t, 0.2*float64(avg-50)/100, expected, 1e-9, avg)
+		}
+		assert.GreaterOrEqual(t, expected, prev, "the probability never falls as the queue grows")
+		prev = expected
+
+		drops := 0
+		for range packets {
+			a := float64(avg)
+			if w.drop(&a, avg, r.Float64()) {
+				drops++
+			}
+		}
+		assert.InDelta(t, expected, float64(drops)/packets, 0.01, avg)
+	}
+
+	t.Log("The moving average lets a burst through")
+	w.weight = defaultWREDWeight
+	avg, drops := 0.0, 0
+	for range 100 {
+		if w.drop(&avg, 140, r.Float64()) {
+			drops++
+		}
+	}
+	assert.Zero(t, drops)
+	assert.Less(t, avg, 50.0)
+}
@@ -0,0 +1,345 @@
+package nebula
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/flynn/noise"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/udp"
+	"github.com/slackhq/nebula/util"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// segmentIndexShift puts the segment id in the top byte of every local index, allowing 256 segments
+	segmentIndexShift = 24
+	segmentIndexMask  = 1<<segmentIndexShift - 1
+	maxSegments       = 1 << (32 - segmentIndexShift)
+)
+
+// SharedListener runs several overlay segments in one process on one udp listener. Each segment is a complete nebula
+// with its own config, tun device, certificate, firewall, lighthouses and hostmap, only the udp sockets are shared.
+//
+// The first segment started opens the sockets with its listen and routines config, the listen config of later
+// segments is ignored. Every segment must use the same routines and cipher.
+//
+// Packets read from the sockets are dispatched to a segment without decrypting them:
+//   - Every local index a segment hands out carries the segment id in its top byte. Peers put our index in the header
+//     of every packet they send, so everything on an existing tunnel, including relayed packets and the second stage
+//     of a handshake we started, goes to the segment that owns the index.
+//   - The first stage of a handshake has no index yet. It carries the peer certificate in clear, it goes to the first
+//     segment whose CA pool has the issuer of that certificate. Segments should not trust the same CA, a warning is
+//     logged if they do.
+//
+// Packets no segment claims are dropped and counted in udp.shared.unroutable.
+type SharedListener struct {
+	l  *logrus.Logger
+	mu sync.Mutex
+
+	conns    []udp.Conn
+	routines int
+	cipher   string
+	// owner is the segment whose listen config applies to the sockets
+	owner *listenerSegment
+
+	// segments is indexed by segment id, entries are nil for ids not in use
+	segments atomic.Pointer[[]*listenerSegment]
+
+	metricUnroutable metrics.Counter
+}
+
+// listenerSegment is one overlay on a SharedListener
+type listenerSegment struct {
+	sl     *SharedListener
+	id     uint32
+	pki    *PKI
+	cipher string
+	l      *logrus.Logger
+
+	// readers holds the packet reader of the segment interface for each routine, packets are dropped until it is set
+	readers []atomic.Pointer[segmentReader]
+	done    chan struct{}
+	once    sync.Once
+}
+
+type segmentReader struct {
+	r     udp.EncReader
+	lhf   udp.LightHouseHandlerFunc
+	cache *firewall.ConntrackCacheTicker
+}
+
+// segmentConn is the udp.Conn a segment interface uses for one routine, writes go straight to the shared socket
+type segmentConn struct {
+	udp.Conn
+	seg *listenerSegment
+}
+
+func NewSharedListener(l *logrus.Logger) *SharedListener {
+	sl := &SharedListener{
+		l:                l,
+		metricUnroutable: metrics.GetOrRegisterCounter("udp.shared.unroutable", nil),
+	}
+	sl.segments.Store(&[]*listenerSegment{})
+	return sl
+}
+
+// Main starts an overlay segment on the shared listener, it is otherwise the same as Main
+func (sl *SharedListener) Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logger, deviceFactory overlay.DeviceFactory) (*Control, error) {
+	return startNebula(sl, c, configTest, buildVersion, logger, deviceFactory)
+}
+
+// join adds a segment, opening the sockets if this is the first one
+func (sl *SharedListener) join(l *logrus.Logger, c *config.C, routines int, pki *PKI) (*listenerSegment, []udp.Conn, error) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	cipher := c.GetString("cipher", "aes")
+	if sl.conns == nil {
+		cpus, err := parseReaderAffinity(l, c, routines)
+		if err != nil {
+			return nil, nil, util.NewContextualError("Failed to load listen.cpu_affinity", nil, err)
+		}
+
+		conns, err := openListeners(l, c, routines)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sl.conns, sl.routines, sl.cipher = conns, routines, cipher
+		for q, conn := range conns {
+			go sl.listen(conn, q, cpus)
+		}
+
+	} else {
+		if routines != sl.routines {
+			return nil, nil, fmt.Errorf("routines is %d but the shared listener runs %d", routines, sl.routines)
+		}
+		if cipher != sl.cipher {
+			return nil, nil, fmt.Errorf("cipher is %s but the shared listener uses %s", cipher, sl.cipher)
+		}
+		if c.IsSet("listen") {
+			l.Warn("listen is ignored, this segment uses the udp listener of the first segment")
+		}
+	}
+
+	old := *sl.segments.Load()
+	id := len(old)
+	for i, s := range old {
+		if s == nil {
+			id = i
+			break
+		}
+	}
+	if id >= maxSegments {
+		return nil, nil, fmt.Errorf("a shared listener supports at most %d segments", maxSegments)
+	}
+
+	for _, s := range old {
+		if s == nil {
+			continue
+		}
+		for fp := range pki.GetCAPool().CAs {
+			if _, ok := s.pki.GetCAPool().CAs[fp]; ok {
+				l.WithField("fingerprint", fp).WithField("segment", s.id).
+					Warn("Another segment trusts the same CA, new handshakes signed by it go to the segment with the lowest id")
+			}
+		}
+	}
+
+	seg := &listenerSegment{
+		sl:      sl,
+		id:      uint32(id),
+		pki:     pki,
+		cipher:  cipher,
+		l:       l,
+		readers: make([]atomic.Pointer[segmentReader], routines),
+		done:    make(chan struct{}),
+	}
+
+	segs := make([]*listenerSegment, len(old), len(old)+1)
+	copy(segs, old)
+	if id == len(segs) {
+		segs = append(segs, seg)
+	} else {
+		segs[id] = seg
+	}
+	sl.segments.Store(&segs)
+
+	if sl.owner == nil {
+		sl.owner = seg
+	}
+
+	conns := make([]udp.Conn, routines)
+	for q := range conns {
+		conns[q] = &segmentConn{Conn: sl.conns[q], seg: seg}
+	}
+
+	l.WithField("segment", seg.id).Info("Joined the shared udp listener")
+	return seg, conns, nil
+}
+
+// leave removes the segment, the sockets are closed once no segment is left
+func (s *listenerSegment) leave() {
+	s.once.Do(func() {
+		sl := s.sl
+		sl.mu.Lock()
+		defer sl.mu.Unlock()
+
+		old := *sl.segments.Load()
+		segs := make([]*listenerSegment, len(old))
+		copy(segs, old)
+		segs[s.id] = nil
+
+		remaining := 0
+		for _, o := range segs {
+			if o != nil {
+				remaining++
+			}
+		}
+		if remaining == 0 {
+			segs = segs[:0]
+		}
+		sl.segments.Store(&segs)
+		close(s.done)
+
+		if sl.owner == s {
+			sl.owner = nil
+		}
+
+		if remaining == 0 {
+			for _, c := range sl.conns {
+				if err := c.Close(); err != nil {
+					sl.l.WithError(err).Error("Error while closing udp socket")
+				}
+			}
+			sl.conns = nil
+		}
+	})
+}
+
+// listen reads packets for routine q and hands them to the segment they belong to
+func (sl *SharedListener) listen(conn udp.Conn, q int, cpus []int) {
+	runtime.LockOSThread()
+	pinReader(sl.l, cpus, q)
+
+	conn.ListenOut(func(addr netip.AddrPort, out []byte, packet []byte, ecn uint8, h *header.H, fwPacket *firewall.Packet, _ udp.LightHouseHandlerFunc, nb []byte, q int, _ firewall.ConntrackCache) {
+		if len(packet) < header.Len {
+			// Hole punches, every segment ignores them
+			return
+		}
+
+		seg := sl.route(packet)
+		if seg == nil {
+			sl.metricUnroutable.Inc(1)
+			return
+		}
+
+		r := seg.readers[q].Load()
+		if r == nil {
+			// The segment is not running yet
+			return
+		}
+
+		r.r(addr, out, packet, ecn, h, fwPacket, r.lhf, nb, q, r.cache.Get(seg.l))
+	}, nil, nil, q)
+}
+
+// route returns the segment packet belongs to or nil
+func (sl *SharedListener) route(packet []byte) *listenerSegment {
+	var h header.H
+	if err := h.Parse(packet); err != nil {
+		return nil
+	}
+
+	segs := *sl.segments.Load()
+	if h.Type == header.Handshake && h.RemoteIndex == 0 {
+		for _, s := range segs {
+			if s != nil && s.trustsHandshake(packet) {
+				return s
+			}
+		}
+		return nil
+	}
+
+	if id := int(h.RemoteIndex >> segmentIndexShift); id < len(segs) {
+		return segs[id]
+	}
+	return nil
+}
+
+// trustsHandshake returns true if the certificate in a first stage handshake packet was issued by a CA this segment
+// trusts. The certificate is not validated here, that is left to the handshake.
+func (s *listenerSegment) trustsHandshake(packet []byte) bool {
+	ci := NewConnectionState(s.l, s.cipher, s.pki.GetCertState(), false, noise.HandshakeIX, []byte{}, 0)
+	if ci == nil {
+		return false
+	}
+
+	// The first message of IX carries the initiator keys and payload in clear, reading it does no DH
+	msg, _, _, err := ci.H.ReadMessage(nil, packet[header.Len:])
+	if err != nil {
+		return false
+	}
+
+	hs := &NebulaHandshake{}
+	if err := hs.Unmarshal(msg); err != nil || hs.Details == nil {
+		return false
+	}
+
+	r := &cert.RawNebulaCertificate{}
+	if err := proto.Unmarshal(hs.Details.Cert, r); err != nil || r.Details == nil {
+		return false
+	}
+
+	_, ok := s.pki.GetCAPool().CAs[hex.EncodeToString(r.Details.Issuer)]
+	return ok
+}
+
+func (c *segmentConn) ListenOut(r udp.EncReader, lhf udp.LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int) {
+	if q >= len(c.seg.readers) {
+		c.seg.l.WithField("routine", q).Error("No shared udp socket for this routine")
+		return
+	}
+
+	c.seg.readers[q].Store(&segmentReader{r: r, lhf: lhf, cache: cache})
+	<-c.seg.done
+}
+
+// ReloadConfig only applies the listen config of the segment that opened the sockets
+func (c *segmentConn) ReloadConfig(cfg *config.C) {
+	c.seg.sl.mu.Lock()
+	owner := c.seg.sl.owner == c.seg
+	c.seg.sl.mu.Unlock()
+
+	if owner {
+		c.Conn.ReloadConfig(cfg)
+	}
+}
+
+// Close leaves the shared listener, the sockets stay open while other segments use them
+func (c *segmentConn) Close() error {
+	c.seg.leave()
+	return nil
+}
+
+// underlay returns the udp socket c reads and writes, for a segment of a SharedListener that is the shared socket
+func underlay(c udp.Conn) udp.Conn {
+	if tc, ok := c.(*transportConn); ok {
+		c = tc.Conn
+	}
+	if sc, ok := c.(*segmentConn); ok {
+		return sc.Conn
+	}
+	return c
+}
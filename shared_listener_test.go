@@ -0,0 +1,56 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostMap_generateIndexSegment(t *testing.T) {
+	l := test.NewLogger()
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+
+	hm.segment = &listenerSegment{id: 3}
+	for i := 0; i < 100; i++ {
+		index, err := hm.generateIndex(l)
+		require.NoError(t, err)
+		assert.EqualValues(t, 3, index>>segmentIndexShift)
+	}
+
+	// Segment 0 still never hands out index 0
+	hm.segment = &listenerSegment{id: 0}
+	for i := 0; i < 100; i++ {
+		index, err := hm.generateIndex(l)
+		require.NoError(t, err)
+		assert.EqualValues(t, 0, index>>segmentIndexShift)
+		assert.NotZero(t, index)
+	}
+}
+
+func TestSharedListener_route(t *testing.T) {
+	sl := NewSharedListener(test.NewLogger())
+	a := &listenerSegment{id: 0}
+	b := &listenerSegment{id: 2}
+	sl.segments.Store(&[]*listenerSegment{a, nil, b})
+
+	packet := func(t header.MessageType, st header.MessageSubType, index uint32) []byte {
+		return header.Encode(make([]byte, header.Len), header.Version, t, st, index, 1)
+	}
+
+	assert.Equal(t, a, sl.route(packet(header.Message, header.MessageNone, 0x00abcdef)))
+	assert.Equal(t, b, sl.route(packet(header.Message, header.MessageNone, 0x02abcdef)))
+	assert.Equal(t, b, sl.route(packet(header.Message, header.MessageRelay, 0x02abcdef)))
+	assert.Equal(t, b, sl.route(packet(header.Handshake, header.HandshakeIXPSK0, 0x02abcdef)))
+	assert.Equal(t, b, sl.route(packet(header.CloseTunnel, 0, 0x02000001)))
+
+	// Ids nobody has are dropped
+	assert.Nil(t, sl.route(packet(header.Message, header.MessageNone, 0x01abcdef)))
+	assert.Nil(t, sl.route(packet(header.Message, header.MessageNone, 0x03abcdef)))
+
+	// As is anything that is not a nebula packet
+	assert.Nil(t, sl.route([]byte("definitely not a nebula packet")))
+}
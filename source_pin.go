@@ -0,0 +1,291 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/gaissmai/bart"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/udp"
+)
+
+// sourcePinWarnInterval limits how often an unavailable pinned source is logged
+const sourcePinWarnInterval = 10 * time.Second
+
+// SourcePin chooses the local address packets to a peer are sent from, for hosts with more than one underlay address.
+// Without a pin the kernel picks the source from the route to the remote, which may not be the address the peer or a
+// NAT in between knows us by. The first entry of listen.source_pins that matches the peer and the address family of the
+// remote is used. Pins are only honored on Linux, if the pinned address is not assigned to this host the kernel chooses
+// the source as usual.
+type SourcePin struct {
+	rules   atomic.Pointer[[]sourcePinRule]
+	hostMap *HostMap
+
+	lastWarn          atomic.Int64
+	metricUnavailable metrics.Counter
+	l                 *logrus.Logger
+}
+
+type sourcePinRule struct {
+	source netip.Addr
+	// hosts and groups select the peers, a rule with neither matches every peer
+	hosts  *bart.Table[struct{}]
+	groups []string
+}
+
+// sourcePinAddrs are the sources pinned for a tunnel, one for each address family
+type sourcePinAddrs struct {
+	v4 netip.Addr
+	v6 netip.Addr
+}
+
+func NewSourcePinFromConfig(l *logrus.Logger, c *config.C, hostMap *HostMap) (*SourcePin, error) {
+	sp := &SourcePin{
+		hostMap:           hostMap,
+		metricUnavailable: metrics.GetOrRegisterCounter("listen.source_pins.unavailable", nil),
+		l:                 l,
+	}
+
+	err := sp.reload(c, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		err := sp.reload(c, false)
+		if err != nil {
+			l.WithError(err).Error("Failed to reload listen.source_pins, keeping the previous pins")
+		}
+	})
+
+	return sp, nil
+}
+
+func (sp *SourcePin) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("listen.source_pins") {
+		return nil
+	}
+
+	rules, err := parseSourcePinRules(c.Get("listen.source_pins"))
+	if err != nil {
+		return err
+	}
+
+	if len(rules) > 0 && runtime.GOOS != "linux" && runtime.GOOS != "android" {
+		sp.l.Warn("listen.source_pins is only supported on Linux, the source address is chosen by the kernel")
+	}
+
+	sp.rules.Store(&rules)
+
+	if !initial {
+		// Existing tunnels pick up the change right away
+		sp.hostMap.RLock()
+		for _, hostinfo := range sp.hostMap.Indexes {
+			sp.update(hostinfo)
+		}
+		sp.hostMap.RUnlock()
+	}
+
+	if !initial || len(rules) > 0 {
+		sp.l.WithField("pins", len(rules)).Info("Source address pins loaded")
+	}
+	return nil
+}
+
+func parseSourcePinRules(raw interface{}) ([]sourcePinRule, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	rs, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("listen.source_pins should be an array of pins")
+	}
+
+	var rules []sourcePinRule
+	for i, r := range rs {
+		m, ok := r.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("listen.source_pins entry #%v; should be a map with source and optionally hosts and groups", i)
+		}
+
+		source, err := netip.ParseAddr(fmt.Sprintf("%v", m["source"]))
+		if err != nil {
+			return nil, fmt.Errorf("listen.source_pins entry #%v; source did not parse; %s", i, err)
+		}
+
+		rule := sourcePinRule{source: source.Unmap()}
+		if !rule.source.IsGlobalUnicast() && !rule.source.IsLoopback() {
+			return nil, fmt.Errorf("listen.source_pins entry #%v; source %v is not a unicast address", i, source)
+		}
+
+		hosts, err := sourcePinStrings(m["hosts"])
+		if err != nil {
+			return nil, fmt.Errorf("listen.source_pins entry #%v; hosts %s", i, err)
+		}
+		if len(hosts) > 0 {
+			rule.hosts = new(bart.Table[struct{}])
+		}
+		for j, s := range hosts {
+			cidr, err := netip.ParsePrefix(s)
+			if err != nil {
+				addr, aErr := netip.ParseAddr(s)
+				if aErr != nil {
+					return nil, fmt.Errorf("listen.source_pins entry #%v; hosts entry #%v; %s", i, j, err)
+				}
+				cidr = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			rule.hosts.Insert(cidr.Masked(), struct{}{})
+		}
+
+		rule.groups, err = sourcePinStrings(m["groups"])
+		if err != nil {
+			return nil, fmt.Errorf("listen.source_pins entry #%v; groups %s", i, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func sourcePinStrings(raw interface{}) ([]string, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	rs, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("should be an array of strings")
+	}
+
+	out := make([]string, len(rs))
+	for i, v := range rs {
+		out[i] = fmt.Sprintf("%v", v)
+	}
+	return out, nil
+}
+
+// update stores the sources pinned for the peer of hostinfo, it is safe to call on a nil SourcePin
+func (sp *SourcePin) update(hostinfo *HostInfo) {
+	if sp == nil {
+		return
+	}
+	hostinfo.sourcePin.Store(sp.pinned(hostinfo))
+}
+
+// pinned returns the first matching source of each address family for the peer of hostinfo, nil if there are none.
+// Peers are matched by group once their certificate is known, a handshake we initiate only matches by vpn ip.
+func (sp *SourcePin) pinned(hostinfo *HostInfo) *sourcePinAddrs {
+	rules := sp.rules.Load()
+	if rules == nil || len(*rules) == 0 {
+		return nil
+	}
+
+	var addrs sourcePinAddrs
+	for _, r := range *rules {
+		if r.source.Is4() && addrs.v4.IsValid() || r.source.Is6() && addrs.v6.IsValid() {
+			continue
+		}
+
+		if !r.matches(hostinfo) {
+			continue
+		}
+
+		if r.source.Is4() {
+			addrs.v4 = r.source
+		} else {
+			addrs.v6 = r.source
+		}
+	}
+
+	if !addrs.v4.IsValid() && !addrs.v6.IsValid() {
+		return nil
+	}
+	return &addrs
+}
+
+func (r *sourcePinRule) matches(hostinfo *HostInfo) bool {
+	if r.hosts == nil && len(r.groups) == 0 {
+		return true
+	}
+
+	if r.hosts != nil {
+		if _, ok := r.hosts.Lookup(hostinfo.vpnIp); ok {
+			return true
+		}
+	}
+
+	if len(r.groups) > 0 {
+		if c := hostinfo.GetCert(); c != nil {
+			for _, g := range r.groups {
+				if _, ok := c.Details.InvertedGroups[g]; ok {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// unavailable records a send that could not use the pinned source and was sent with the source chosen by the kernel
+// instead, it is safe to call on a nil SourcePin
+func (sp *SourcePin) unavailable(hostinfo *HostInfo, err error) {
+	if sp == nil {
+		return
+	}
+
+	sp.metricUnavailable.Inc(1)
+
+	now := time.Now().UnixNano()
+	last := sp.lastWarn.Load()
+	if now-last >= int64(sourcePinWarnInterval) && sp.lastWarn.CompareAndSwap(last, now) {
+		hostinfo.logger(sp.l).WithError(err).
+			Warn("The pinned source address is not available, letting the kernel choose")
+	}
+}
+
+// source returns the source address pinned for sends to addr, invalid if the kernel should choose
+func (i *HostInfo) source(addr netip.AddrPort) netip.Addr {
+	p := i.sourcePin.Load()
+	if p == nil {
+		return netip.Addr{}
+	}
+
+	if addr.Addr().Unmap().Is4() {
+		return p.v4
+	}
+	return p.v6
+}
+
+// writeFrom sends b to addr from the source pinned for hostinfo. It returns false if nothing was sent because there is
+// no pin or the socket can not set the source, and false with an error wrapping udp.ErrSourceUnavailable if the kernel
+// refused the source.
+func (f *Interface) writeFrom(conn udp.Conn, hostinfo *HostInfo, b []byte, addr netip.AddrPort, ecn uint8) (bool, error) {
+	if hostinfo == nil {
+		return false, nil
+	}
+
+	src := hostinfo.source(addr)
+	if !src.IsValid() {
+		return false, nil
+	}
+
+	w, ok := underlay(conn).(udp.SourceWriter)
+	if !ok {
+		return false, nil
+	}
+
+	err := w.WriteToFrom(b, addr, src, ecn)
+	if errors.Is(err, udp.ErrSourceUnavailable) {
+		return false, err
+	}
+	return true, err
+}
@@ -0,0 +1,147 @@
+package nebula
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSourcePinFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+
+	sp, err := NewSourcePinFromConfig(l, c, hm)
+	require.NoError(t, err)
+	assert.Nil(t, sp.pinned(&HostInfo{vpnIp: netip.MustParseAddr("10.128.0.2")}))
+
+	c.Settings["listen"] = map[interface{}]interface{}{
+		"source_pins": []interface{}{
+			map[interface{}]interface{}{"source": "192.0.2.1", "hosts": []interface{}{"10.128.0.2", "10.128.1.0/24"}},
+			map[interface{}]interface{}{"source": "192.0.2.2", "groups": []interface{}{"infra"}},
+			map[interface{}]interface{}{"source": "2001:db8::1", "hosts": []interface{}{"10.128.0.2"}},
+			map[interface{}]interface{}{"source": "192.0.2.3"},
+		},
+	}
+	sp, err = NewSourcePinFromConfig(l, c, hm)
+	require.NoError(t, err)
+
+	v4, v6 := netip.MustParseAddrPort("198.51.100.1:4242"), netip.MustParseAddrPort("[2001:db8::2]:4242")
+	sources := func(hostinfo *HostInfo) []netip.Addr {
+		sp.update(hostinfo)
+		return []netip.Addr{hostinfo.source(v4), hostinfo.source(v6)}
+	}
+
+	t.Log("The first matching entry of each family wins")
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+		sources(&HostInfo{vpnIp: netip.MustParseAddr("10.128.0.2")}))
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1"), {}},
+		sources(&HostInfo{vpnIp: netip.MustParseAddr("10.128.1.9")}))
+
+	t.Log("Groups match once the certificate is known")
+	grouped := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.3")}
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.3"), {}}, sources(grouped))
+	grouped.ConnectionState = &ConnectionState{peerCert: &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{InvertedGroups: map[string]struct{}{"infra": {}}},
+	}}
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.2"), {}}, sources(grouped))
+
+	t.Log("v4 mapped remotes use the ipv4 source")
+	assert.Equal(t, netip.MustParseAddr("192.0.2.2"), grouped.source(netip.MustParseAddrPort("[::ffff:198.51.100.1]:4242")))
+
+	t.Log("Reloading updates existing tunnels")
+	existing := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.4"), localIndexId: 1}
+	hm.unlockedAddHostInfo(existing, &Interface{sourcePin: sp, l: l})
+	assert.Equal(t, netip.MustParseAddr("192.0.2.3"), existing.source(v4))
+	require.NoError(t, c.ReloadConfigString("listen:\n  source_pins:\n    - source: 2001:db8::9\n"))
+	assert.Equal(t, []netip.Addr{{}, netip.MustParseAddr("2001:db8::9")}, []netip.Addr{existing.source(v4), existing.source(v6)})
+	require.NoError(t, c.ReloadConfigString("listen:\n  port: 0\n"))
+	assert.Nil(t, existing.sourcePin.Load())
+
+	t.Log("Bad entries are rejected")
+	for _, tc := range []struct {
+		pins interface{}
+		err  string
+	}{
+		{"192.0.2.1", "listen.source_pins should be an array of pins"},
+		{[]interface{}{"192.0.2.1"}, "listen.source_pins entry #0; should be a map with source and optionally hosts and groups"},
+		{[]interface{}{map[interface{}]interface{}{"source": "nope"}}, `listen.source_pins entry #0; source did not parse; ParseAddr("nope"): unable to parse IP`},
+		{[]interface{}{map[interface{}]interface{}{"source": "0.0.0.0"}}, "listen.source_pins entry #0; source 0.0.0.0 is not a unicast address"},
+		{[]interface{}{map[interface{}]interface{}{"source": "192.0.2.1", "hosts": []interface{}{"nope"}}}, `listen.source_pins entry #0; hosts entry #0; netip.ParsePrefix("nope"): no '/'`},
+	} {
+		c.Settings["listen"] = map[interface{}]interface{}{"source_pins": tc.pins}
+		_, err = NewSourcePinFromConfig(l, c, hm)
+		assert.EqualError(t, err, tc.err)
+	}
+
+	var nilPin *SourcePin
+	nilPin.update(grouped)
+	nilPin.unavailable(grouped, nil)
+}
+
+func TestInterface_writeTo_sourcePin(t *testing.T) {
+	l := test.NewLogger()
+	conn, err := udp.NewListener(l, netip.MustParseAddr("0.0.0.0"), 0, false, 64)
+	require.NoError(t, err)
+	defer conn.Close()
+	if _, ok := conn.(udp.SourceWriter); !ok {
+		t.Skip("the udp listener can not choose the source address on this platform")
+	}
+
+	// Every address in 127.0.0.0/8 is assigned to lo, which makes it a multi-address host
+	recv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer recv.Close()
+	dst := recv.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	read := func() netip.Addr {
+		b := make([]byte, 16)
+		require.NoError(t, recv.SetReadDeadline(time.Now().Add(time.Second)))
+		_, from, err := recv.ReadFromUDPAddrPort(b)
+		require.NoError(t, err)
+		return from.Addr().Unmap()
+	}
+
+	c := config.NewC(l)
+	c.Settings["listen"] = map[interface{}]interface{}{
+		"source_pins": []interface{}{
+			map[interface{}]interface{}{"source": "192.0.2.1", "hosts": []interface{}{"10.128.0.3"}},
+			map[interface{}]interface{}{"source": "127.0.0.2"},
+		},
+	}
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	sp, err := NewSourcePinFromConfig(l, c, hm)
+	require.NoError(t, err)
+	f := &Interface{outside: conn, sourcePin: sp, l: l}
+
+	pinned := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.2"), remote: dst}
+	sp.update(pinned)
+	require.NoError(t, f.writeTo(0, pinned, []byte("hi"), dst, ecnNotECT))
+	assert.Equal(t, netip.MustParseAddr("127.0.0.2"), read())
+
+	t.Log("Sends without a tunnel let the kernel choose")
+	require.NoError(t, f.writeTo(0, nil, []byte("hi"), dst, ecnNotECT))
+	assert.Equal(t, netip.MustParseAddr("127.0.0.1"), read())
+
+	t.Log("A source that is not ours falls back to the kernel choice")
+	unavailable := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.3"), remote: dst}
+	sp.update(unavailable)
+	before := sp.metricUnavailable.Count()
+	require.NoError(t, f.writeTo(0, unavailable, []byte("hi"), dst, ecnNotECT))
+	assert.Equal(t, netip.MustParseAddr("127.0.0.1"), read())
+	assert.Equal(t, before+1, sp.metricUnavailable.Count())
+
+	t.Log("The pinned source is reported on the control socket")
+	chi := copyHostInfo(pinned, nil)
+	require.NotNil(t, chi.Source)
+	assert.Equal(t, netip.MustParseAddr("127.0.0.2"), *chi.Source)
+	assert.Nil(t, copyHostInfo(&HostInfo{remote: dst}, nil).Source)
+}
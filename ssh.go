@@ -2,10 +2,12 @@ package nebula
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/netip"
 	"os"
@@ -15,9 +17,11 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/sshd"
 )
@@ -50,11 +54,78 @@ type sshCreateTunnelFlags struct {
 	Address string
 }
 
+type sshListPendingHandshakesFlags struct {
+	Json   bool
+	Pretty bool
+}
+
+type sshClearPendingHandshakesFlags struct {
+	OlderThan time.Duration
+	All       bool
+}
+
+type sshRehandshakeFlags struct {
+	Json    bool
+	Pretty  bool
+	Timeout time.Duration
+}
+
+type sshTunnelMetricsEnableFlags struct {
+	For time.Duration
+}
+
+type sshReachableFlags struct {
+	Json    bool
+	Pretty  bool
+	Timeout time.Duration
+}
+
 type sshDeviceInfoFlags struct {
 	Json   bool
 	Pretty bool
 }
 
+type sshTunnelCountsFlags struct {
+	Json   bool
+	Pretty bool
+}
+
+type sshInfoFlags struct {
+	Json   bool
+	Pretty bool
+}
+
+type sshRelayDrainFlags struct {
+	Json   bool
+	Pretty bool
+	Grace  time.Duration
+	Status bool
+}
+
+type sshTestFirewallFlags struct {
+	Json       bool
+	Pretty     bool
+	Out        bool
+	Relay      bool
+	Proto      string
+	Local      string
+	LocalPort  uint
+	RemotePort uint
+	Fragment   bool
+	Name       string
+	Groups     string
+	Attributes string
+	CA         string
+	Ips        string
+	Subnets    string
+}
+
+type sshWatchDropsFlags struct {
+	Rate     int
+	Count    int
+	Duration time.Duration
+}
+
 func wireSSHReload(l *logrus.Logger, ssh *sshd.SSHServer, c *config.C) {
 	c.RegisterReloadCallback(func(c *config.C) {
 		if c.GetBool("sshd.enabled", false) {
@@ -223,6 +294,39 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		},
 	})
 
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "list-pending-handshakes",
+		ShortDescription: "List the handshakes we started that have not completed, oldest first",
+		Help:             "Shows how many attempts were made, how long ago the handshake started, and the remotes the last attempt went to.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshListPendingHandshakesFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshListPendingHandshakes(f, fs, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "clear-pending-handshakes",
+		ShortDescription: "Gives up on pending handshakes with the provided vpn ips, or all of them with -all",
+		Help:             "Only handshakes started more than -older-than ago are cleared, the same as if they had timed out. Traffic for a cleared vpn ip starts a new handshake.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshClearPendingHandshakesFlags{}
+			fl.DurationVar(&s.OlderThan, "older-than", 0, "only clear handshakes started more than this long ago")
+			fl.BoolVar(&s.All, "all", false, "consider every pending handshake instead of the provided vpn ips")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshClearPendingHandshakes(f, fs, a, w)
+		},
+		Mutating: true,
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "list-lighthouse-addrmap",
 		ShortDescription: "List all lighthouse map entries",
@@ -244,12 +348,14 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
 			return sshReload(c, w)
 		},
+		Mutating: true,
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "start-cpu-profile",
 		ShortDescription: "Starts a cpu profile and write output to the provided file, ex: `cpu-profile.pb.gz`",
 		Callback:         sshStartCpuProfile,
+		Mutating:         true,
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
@@ -259,24 +365,28 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 			pprof.StopCPUProfile()
 			return w.WriteLine("If a CPU profile was running it is now stopped")
 		},
+		Mutating: true,
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "save-heap-profile",
 		ShortDescription: "Saves a heap profile to the provided path, ex: `heap-profile.pb.gz`",
 		Callback:         sshGetHeapProfile,
+		Mutating:         true,
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "mutex-profile-fraction",
 		ShortDescription: "Gets or sets runtime.SetMutexProfileFraction",
 		Callback:         sshMutexProfileFraction,
+		Mutating:         true,
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "save-mutex-profile",
 		ShortDescription: "Saves a mutex profile to the provided path, ex: `mutex-profile.pb.gz`",
 		Callback:         sshGetMutexProfile,
+		Mutating:         true,
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
@@ -285,6 +395,7 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
 			return sshLogLevel(l, fs, a, w)
 		},
+		Mutating: true,
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
@@ -293,6 +404,7 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
 			return sshLogFormat(l, fs, a, w)
 		},
+		Mutating: true,
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
@@ -319,191 +431,608 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
-		Name:             "print-cert",
-		ShortDescription: "Prints the current certificate being used or the certificate for the provided vpn ip",
+		Name:             "tunnel-counts",
+		ShortDescription: "Prints the current number of tunnels, pending handshakes, and relays along with the configured maximum",
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
-			s := sshPrintCertFlags{}
+			s := sshTunnelCountsFlags{}
 			fl.BoolVar(&s.Json, "json", false, "outputs as json")
 			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
-			fl.BoolVar(&s.Raw, "raw", false, "raw prints the PEM encoded certificate, not compatible with -json or -pretty")
 			return fl, &s
 		},
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
-			return sshPrintCert(f, fs, a, w)
+			return sshTunnelCounts(f, fs, w)
 		},
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
-		Name:             "print-tunnel",
-		ShortDescription: "Prints json details about a tunnel for the provided vpn ip",
+		Name:             "ca-tunnels",
+		ShortDescription: "Prints each trusted CA, whether it is rotating in, and the tunnels it authenticated",
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
-			s := sshPrintTunnelFlags{}
-			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json")
+			s := sshTunnelCountsFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
 			return fl, &s
 		},
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
-			return sshPrintTunnel(f, fs, a, w)
+			return sshCATunnels(f, fs, w)
 		},
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
-		Name:             "print-relays",
-		ShortDescription: "Prints json details about all relay info",
+		Name:             "info",
+		ShortDescription: "Prints the effective runtime parameters: tun name, mtu, listen addresses, cipher, overhead, relay mode, and certificate fingerprints",
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
-			s := sshPrintTunnelFlags{}
-			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json")
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
 			return fl, &s
 		},
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
-			return sshPrintRelays(f, fs, a, w)
+			return sshInfo(f, fs, w)
 		},
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
-		Name:             "change-remote",
-		ShortDescription: "Changes the remote address used in the tunnel for the provided vpn ip",
+		Name:             "udp-stats",
+		ShortDescription: "Prints the effective buffer sizes and kernel drop counts of the udp listen sockets",
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
-			s := sshChangeRemoteFlags{}
-			fl.StringVar(&s.Address, "address", "", "The new remote address, ip:port")
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
 			return fl, &s
 		},
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
-			return sshChangeRemote(f, fs, a, w)
+			return sshUDPStats(f, fs, w)
 		},
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
-		Name:             "close-tunnel",
-		ShortDescription: "Closes a tunnel for the provided vpn ip",
+		Name:             "lighthouse-order",
+		ShortDescription: "Prints the lighthouses in the order host queries are sent to them, with their round trip time",
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
-			s := sshCloseTunnelFlags{}
-			fl.BoolVar(&s.LocalOnly, "local-only", false, "Disables notifying the remote that the tunnel is shutting down")
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
 			return fl, &s
 		},
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
-			return sshCloseTunnel(f, fs, a, w)
+			return sshLighthouseOrder(f, fs, w)
 		},
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
-		Name:             "create-tunnel",
-		ShortDescription: "Creates a tunnel for the provided vpn ip and address",
-		Help:             "The lighthouses will be queried for real addresses but you can provide one as well.",
+		Name:             "remote-candidates",
+		ShortDescription: "Prints the learned and reported remotes for the provided vpn ip and their age",
+		Help:             "Remotes older than lighthouse.remote_ttl are dropped unless the tunnel is using them. Static remotes have no age.",
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
-			s := sshCreateTunnelFlags{}
-			fl.StringVar(&s.Address, "address", "", "Optionally provide a real remote address, ip:port ")
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
 			return fl, &s
 		},
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
-			return sshCreateTunnel(f, fs, a, w)
+			return sshRemoteCandidates(f, fs, a, w)
 		},
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
-		Name:             "query-lighthouse",
-		ShortDescription: "Query the lighthouses for the provided vpn ip",
-		Help:             "This command is asynchronous. Only currently known udp ips will be printed.",
+		Name:             "expired-certs",
+		ShortDescription: "Prints our certificate and the peer certificates in use that are expired, see pki.expired_grace_period",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
-			return sshQueryLighthouse(f, fs, a, w)
+			return sshExpiredCerts(f, fs, w)
 		},
 	})
-}
 
-func sshListHostMap(hl controlHostLister, a interface{}, w sshd.StringWriter) error {
-	fs, ok := a.(*sshListHostMapFlags)
-	if !ok {
-		//TODO: error
-		return nil
-	}
-
-	var hm []ControlHostInfo
-	if fs.ByIndex {
-		hm = listHostMapIndexes(hl)
-	} else {
-		hm = listHostMapHosts(hl)
-	}
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "send-queues",
+		ShortDescription: "Prints the backlog of each send_priority class",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshSendQueues(f, fs, w)
+		},
+	})
 
-	sort.Slice(hm, func(i, j int) bool {
-		return hm[i].VpnIp.Compare(hm[j].VpnIp) < 0
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "nat-type",
+		ShortDescription: "Prints the kind of NAT we appear to be behind and the addresses our lighthouses see us at",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshNATType(f, fs, w)
+		},
 	})
 
-	if fs.Json || fs.Pretty {
-		js := json.NewEncoder(w.GetWriter())
-		if fs.Pretty {
-			js.SetIndent("", "    ")
-		}
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "firewall-rules",
+		ShortDescription: "Prints the firewall rules as they are enforced",
+		Help:             "Every default is resolved, the local cidr of each rule is the one it actually allows. This is the firewall installed by the last successful reload, not the config file.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshFirewallRules(f, fs, w)
+		},
+	})
 
-		err := js.Encode(hm)
-		if err != nil {
-			//TODO
-			return nil
-		}
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "test-firewall",
+		ShortDescription: "Reports whether the firewall would allow a packet with a simulated peer and the rule responsible",
+		Help:             "Takes the vpn ip of the peer. The packet is evaluated as the first of a new flow by the same checks live traffic goes through, nothing is sent and no state is changed. The new flow limit and the conntrack size are not applied.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshTestFirewallFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			fl.BoolVar(&s.Out, "out", false, "evaluates an outbound packet instead of an inbound one")
+			fl.BoolVar(&s.Relay, "relay", false, "the inbound packet arrived through a relay")
+			fl.StringVar(&s.Proto, "proto", "tcp", "tcp, udp or icmp")
+			fl.StringVar(&s.Local, "local", "", "the local ip of the packet, our vpn ip if empty")
+			fl.UintVar(&s.LocalPort, "local-port", 0, "the local port of the packet, the destination port of an inbound packet")
+			fl.UintVar(&s.RemotePort, "remote-port", 0, "the remote port of the packet, the destination port of an outbound packet")
+			fl.BoolVar(&s.Fragment, "fragment", false, "the packet is a fragment")
+			fl.StringVar(&s.Name, "name", "", "the name in the peer certificate")
+			fl.StringVar(&s.Groups, "groups", "", "comma separated groups in the peer certificate")
+			fl.StringVar(&s.Attributes, "attributes", "", "comma separated key=value attributes in the peer certificate")
+			fl.StringVar(&s.CA, "ca", "", "the name or fingerprint of the CA of the peer certificate, our CA if empty")
+			fl.StringVar(&s.Ips, "ips", "", "comma separated vpn ips in cidr form in the peer certificate, the peer vpn ip in our network if empty")
+			fl.StringVar(&s.Subnets, "subnets", "", "comma separated subnets in the peer certificate")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshTestFirewall(f, fs, a, w)
+		},
+	})
 
-	} else {
-		for _, v := range hm {
-			err := w.WriteLine(fmt.Sprintf("%s: %s", v.VpnIp, v.RemoteAddrs))
-			if err != nil {
-				return err
-			}
-		}
-	}
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "observer",
+		ShortDescription: "Prints whether this node is an observer and which of its targets have a tunnel",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshObserver(f, fs, w)
+		},
+	})
 
-	return nil
-}
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "tunnel-metrics",
+		ShortDescription: "Prints the per tunnel metrics of the watched peers",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshTunnelMetrics(f, fs, w)
+		},
+	})
 
-func sshListLighthouseMap(lightHouse *LightHouse, a interface{}, w sshd.StringWriter) error {
-	fs, ok := a.(*sshListHostMapFlags)
-	if !ok {
-		//TODO: error
-		return nil
-	}
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "rates",
+		ShortDescription: "Prints the per second rates of packets, bytes, handshakes and drops",
+		Help:             "The rates are estimated from samples taken every second over rates.window, 10s by default. Inbound is received from the underlay and outbound read from the tun device, per reader routine and in total.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshRates(f, fs, w)
+		},
+	})
 
-	type lighthouseInfo struct {
-		VpnIp string    `json:"vpnIp"`
-		Addrs *CacheMap `json:"addrs"`
-	}
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "tunnel-metrics-enable",
+		ShortDescription: "Exports metrics labeled by vpn ip for the provided peers for a limited time",
+		Help:             "At most tunnel_metrics.max_peers are watched at once and for no longer than tunnel_metrics.max_duration. Enabling a watched peer again extends its watch.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshTunnelMetricsEnableFlags{}
+			fl.DurationVar(&s.For, "for", defaultTunnelMetricsDuration, "how long to watch the peers for")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshTunnelMetricsEnable(f, fs, a, w)
+		},
+		Mutating: true,
+	})
 
-	lightHouse.RLock()
-	addrMap := make([]lighthouseInfo, len(lightHouse.addrMap))
-	x := 0
-	for k, v := range lightHouse.addrMap {
-		addrMap[x] = lighthouseInfo{
-			VpnIp: k.String(),
-			Addrs: v.CopyCache(),
-		}
-		x++
-	}
-	lightHouse.RUnlock()
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "tunnel-metrics-disable",
+		ShortDescription: "Stops exporting per tunnel metrics for the provided peers, or for every peer if none are provided",
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshTunnelMetricsDisable(f, a, w)
+		},
+		Mutating: true,
+	})
 
-	sort.Slice(addrMap, func(i, j int) bool {
-		return strings.Compare(addrMap[i].VpnIp, addrMap[j].VpnIp) < 0
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "underlay",
+		ShortDescription: "Prints the local underlay addresses and when they last changed",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshUnderlay(f, fs, w)
+		},
 	})
 
-	if fs.Json || fs.Pretty {
-		js := json.NewEncoder(w.GetWriter())
-		if fs.Pretty {
-			js.SetIndent("", "    ")
-		}
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "watch-drops",
+		ShortDescription: "Streams firewall drops as json lines until the client disconnects",
+		Help:             "Use a non interactive session to stop watching on disconnect, ie: ssh nebula watch-drops",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshWatchDropsFlags{}
+			fl.IntVar(&s.Rate, "rate", defaultDropWatcherRate, "the most drops to print per second, the rest are counted as missed")
+			fl.IntVar(&s.Count, "count", 0, "stop after this many drops, 0 is unlimited")
+			fl.DurationVar(&s.Duration, "duration", 0, "stop after this long, 0 is unlimited")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshWatchDrops(f, fs, w)
+		},
+	})
 
-		err := js.Encode(addrMap)
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "print-cert",
+		ShortDescription: "Prints the current certificate being used or the certificate for the provided vpn ip",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshPrintCertFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			fl.BoolVar(&s.Raw, "raw", false, "raw prints the PEM encoded certificate, not compatible with -json or -pretty")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshPrintCert(f, fs, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "print-tunnel",
+		ShortDescription: "Prints json details about a tunnel for the provided vpn ip",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshPrintTunnelFlags{}
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshPrintTunnel(f, fs, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "print-relays",
+		ShortDescription: "Prints json details about all relay info",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshPrintTunnelFlags{}
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshPrintRelays(f, fs, a, w)
+		},
+	})
+
+	if keyExportBuilt {
+		ssh.RegisterCommand(&sshd.Command{
+			Name:             "export-keys",
+			ShortDescription: "Prints the session keys of a tunnel, anyone holding them can decrypt its traffic",
+			Help:             "Only available in binaries built with key export and only works with key_export.dangerous set",
+			Flags: func() (*flag.FlagSet, interface{}) {
+				fl := flag.NewFlagSet("", flag.ContinueOnError)
+				s := sshPrintTunnelFlags{}
+				fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json")
+				return fl, &s
+			},
+			Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+				return sshExportKeys(f, fs, a, w)
+			},
+			// Not state changing, but the keys must never reach a read-only caller of the management listener
+			Mutating: true,
+		})
+	}
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "relay-topology",
+		ShortDescription: "Prints every relay as json nodes and edges for building a relay mesh map",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshPrintTunnelFlags{}
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshRelayTopology(f, fs, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "relay-share",
+		ShortDescription: "Prints how traffic to a load shared relayed vpn ip is spread across its relays",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshRelayShare(f, fs, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "rekey-classes",
+		ShortDescription: "Prints the rekey classes carried by the keys of a tunnel and how old the keys are",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshRekeyClasses(f, fs, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "path-selection",
+		ShortDescription: "Prints the dscp path selection classes, or the path each class takes to a vpn ip",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshPathSelection(f, fs, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "relay-drain",
+		ShortDescription: "Stops forwarding new relays and moves peers to other relays before forwarding stops",
+		Help:             "Peers move their relayed tunnels to other relays they know of. A drain lasts until nebula is restarted.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshRelayDrainFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			fl.DurationVar(&s.Grace, "grace", DefaultRelayDrainGrace, "how long peers have to move before forwarding stops")
+			fl.BoolVar(&s.Status, "status", false, "only print the progress, do not start draining")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshRelayDrain(f, fs, a, w)
+		},
+		Mutating: true,
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "change-remote",
+		ShortDescription: "Changes the remote address used in the tunnel for the provided vpn ip",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshChangeRemoteFlags{}
+			fl.StringVar(&s.Address, "address", "", "The new remote address, ip:port")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshChangeRemote(f, fs, a, w)
+		},
+		Mutating: true,
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "close-tunnel",
+		ShortDescription: "Closes a tunnel for the provided vpn ip",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshCloseTunnelFlags{}
+			fl.BoolVar(&s.LocalOnly, "local-only", false, "Disables notifying the remote that the tunnel is shutting down")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshCloseTunnel(f, fs, a, w)
+		},
+		Mutating: true,
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "pause-tunnel",
+		ShortDescription: "Drops the data to and from the provided vpn ip without closing the tunnel",
+		Help:             "The tunnel keeps its keys and keepalives so resume-tunnel restores the data flow without a handshake.",
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshPauseTunnel(f, fs, a, w)
+		},
+		Mutating: true,
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "resume-tunnel",
+		ShortDescription: "Lets the data of a tunnel stopped with pause-tunnel flow again",
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshResumeTunnel(f, fs, a, w)
+		},
+		Mutating: true,
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "create-tunnel",
+		ShortDescription: "Creates a tunnel for the provided vpn ip and address",
+		Help:             "The lighthouses will be queried for real addresses but you can provide one as well.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshCreateTunnelFlags{}
+			fl.StringVar(&s.Address, "address", "", "Optionally provide a real remote address, ip:port ")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshCreateTunnel(f, fs, a, w)
+		},
+		Mutating: true,
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "reachable",
+		ShortDescription: "Reports whether there is an established tunnel with the provided vpn ip",
+		Help:             "No traffic is sent if there is a tunnel. With -timeout a handshake is started if there is none and the command waits up to timeout for it.",
+		// A handshake started with -timeout changes the node state
+		Mutating: true,
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshReachableFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			fl.DurationVar(&s.Timeout, "timeout", 0, "how long to wait for a handshake if there is no tunnel, 0 does not start one")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshReachable(f, fs, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "rehandshake",
+		ShortDescription: "Starts a fresh handshake with the provided vpn ip and waits for the outcome",
+		Help:             "The existing tunnel keeps carrying traffic until the new one replaces it. Useful when the peer is known to have changed networks.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshRehandshakeFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			fl.DurationVar(&s.Timeout, "timeout", 30*time.Second, "how long to wait for the handshake, it continues in the background")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshRehandshake(f, fs, a, w)
+		},
+		Mutating: true,
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "load-cert",
+		ShortDescription: "Replaces our certificate with the PEM certificate at the provided path",
+		Help:             "The certificate must be valid for the loaded CA, match our private key, and keep our vpn ip. Tunnels stay up and are re-handshaked with the new certificate. A reload reads pki.cert again, update it as well to keep the new certificate.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshInfoFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshLoadCert(f, fs, a, w)
+		},
+		Mutating: true,
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "query-lighthouse",
+		ShortDescription: "Query the lighthouses for the provided vpn ip",
+		Help:             "This command is asynchronous. Only currently known udp ips will be printed.",
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshQueryLighthouse(f, fs, a, w)
+		},
+	})
+}
+
+func sshListHostMap(hl controlHostLister, a interface{}, w sshd.StringWriter) error {
+	fs, ok := a.(*sshListHostMapFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	var hm []ControlHostInfo
+	if fs.ByIndex {
+		hm = listHostMapIndexes(hl)
+	} else {
+		hm = listHostMapHosts(hl)
+	}
+
+	sort.Slice(hm, func(i, j int) bool {
+		return hm[i].VpnIp.Compare(hm[j].VpnIp) < 0
+	})
+
+	if fs.Json || fs.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if fs.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		err := js.Encode(hm)
 		if err != nil {
 			//TODO
 			return nil
 		}
 
 	} else {
-		for _, v := range addrMap {
-			b, err := json.Marshal(v.Addrs)
-			if err != nil {
-				return err
+		for _, v := range hm {
+			line := fmt.Sprintf("%s: %s", v.VpnIp, v.RemoteAddrs)
+			if v.AuthOnly {
+				line += " (auth only, not encrypted)"
 			}
-			err = w.WriteLine(fmt.Sprintf("%s: %s", v.VpnIp, string(b)))
+			if v.RoamingDisabled {
+				line += " (roaming disabled)"
+			}
+			if v.Paused {
+				line += " (paused)"
+			}
+			if v.SendBackoff != nil {
+				line += fmt.Sprintf(" (sends paused after %v failures: %s)", v.SendBackoff.Failures, v.SendBackoff.LastError)
+			}
+			if errs := v.Errors.String(); errs != "" {
+				line += " errors: " + errs
+			}
+			err := w.WriteLine(line)
 			if err != nil {
 				return err
 			}
@@ -513,433 +1042,1525 @@ func sshListLighthouseMap(lightHouse *LightHouse, a interface{}, w sshd.StringWr
 	return nil
 }
 
-func sshStartCpuProfile(fs interface{}, a []string, w sshd.StringWriter) error {
-	if len(a) == 0 {
-		err := w.WriteLine("No path to write profile provided")
-		return err
+func sshListLighthouseMap(lightHouse *LightHouse, a interface{}, w sshd.StringWriter) error {
+	fs, ok := a.(*sshListHostMapFlags)
+	if !ok {
+		//TODO: error
+		return nil
 	}
 
-	file, err := os.Create(a[0])
-	if err != nil {
-		err = w.WriteLine(fmt.Sprintf("Unable to create profile file: %s", err))
-		return err
+	type lighthouseInfo struct {
+		VpnIp string    `json:"vpnIp"`
+		Addrs *CacheMap `json:"addrs"`
+	}
+
+	lightHouse.RLock()
+	addrMap := make([]lighthouseInfo, len(lightHouse.addrMap))
+	x := 0
+	for k, v := range lightHouse.addrMap {
+		addrMap[x] = lighthouseInfo{
+			VpnIp: k.String(),
+			Addrs: v.CopyCache(),
+		}
+		x++
+	}
+	lightHouse.RUnlock()
+
+	sort.Slice(addrMap, func(i, j int) bool {
+		return strings.Compare(addrMap[i].VpnIp, addrMap[j].VpnIp) < 0
+	})
+
+	if fs.Json || fs.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if fs.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		err := js.Encode(addrMap)
+		if err != nil {
+			//TODO
+			return nil
+		}
+
+	} else {
+		for _, v := range addrMap {
+			b, err := json.Marshal(v.Addrs)
+			if err != nil {
+				return err
+			}
+			err = w.WriteLine(fmt.Sprintf("%s: %s", v.VpnIp, string(b)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func sshStartCpuProfile(fs interface{}, a []string, w sshd.StringWriter) error {
+	if len(a) == 0 {
+		err := w.WriteLine("No path to write profile provided")
+		return err
+	}
+
+	file, err := os.Create(a[0])
+	if err != nil {
+		err = w.WriteLine(fmt.Sprintf("Unable to create profile file: %s", err))
+		return err
+	}
+
+	err = pprof.StartCPUProfile(file)
+	if err != nil {
+		err = w.WriteLine(fmt.Sprintf("Unable to start cpu profile: %s", err))
+		return err
+	}
+
+	err = w.WriteLine(fmt.Sprintf("Started cpu profile, issue stop-cpu-profile to write the output to %s", a))
+	return err
+}
+
+func sshVersion(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	return w.WriteLine(fmt.Sprintf("%s", ifce.version))
+}
+
+func sshQueryLighthouse(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
+	}
+
+	vpnIp, err := netip.ParseAddr(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	if !vpnIp.IsValid() {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	var cm *CacheMap
+	rl := ifce.lightHouse.Query(vpnIp)
+	if rl != nil {
+		cm = rl.CopyCache()
+	}
+	return json.NewEncoder(w.GetWriter()).Encode(cm)
+}
+
+func sshCloseTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshCloseTunnelFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
+	}
+
+	vpnIp, err := netip.ParseAddr(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	if !vpnIp.IsValid() {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	hostInfo := ifce.hostMap.QueryVpnIp(vpnIp)
+	if hostInfo == nil {
+		return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
+	}
+
+	if !flags.LocalOnly {
+		ifce.send(
+			header.CloseTunnel,
+			0,
+			hostInfo.ConnectionState,
+			hostInfo,
+			[]byte{},
+			make([]byte, 12, 12),
+			make([]byte, mtu),
+		)
+	}
+
+	ifce.closeTunnel(hostInfo)
+	return w.WriteLine("Closed")
+}
+
+func sshPauseTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
+	}
+
+	vpnIp, err := netip.ParseAddr(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	if err := ifce.tunnelPause.Pause(vpnIp); err != nil {
+		return w.WriteLine(err.Error())
+	}
+	return w.WriteLine("Paused")
+}
+
+func sshResumeTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
+	}
+
+	vpnIp, err := netip.ParseAddr(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	if err := ifce.tunnelPause.Resume(vpnIp); err != nil {
+		return w.WriteLine(err.Error())
+	}
+	return w.WriteLine("Resumed")
+}
+
+func sshCreateTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshCreateTunnelFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
+	}
+
+	vpnIp, err := netip.ParseAddr(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	if !vpnIp.IsValid() {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	hostInfo := ifce.hostMap.QueryVpnIp(vpnIp)
+	if hostInfo != nil {
+		return w.WriteLine(fmt.Sprintf("Tunnel already exists"))
+	}
+
+	hostInfo = ifce.handshakeManager.QueryVpnIp(vpnIp)
+	if hostInfo != nil {
+		return w.WriteLine(fmt.Sprintf("Tunnel already handshaking"))
+	}
+
+	var addr netip.AddrPort
+	if flags.Address != "" {
+		addr, err = netip.ParseAddrPort(flags.Address)
+		if err != nil {
+			return w.WriteLine("Address could not be parsed")
+		}
+	}
+
+	hostInfo = ifce.handshakeManager.StartHandshake(vpnIp, nil)
+	if hostInfo == nil {
+		return w.WriteLine("Tunnel limit reached")
+	}
+
+	if addr.IsValid() {
+		hostInfo.SetRemote(addr)
+	}
+
+	return w.WriteLine("Created")
+}
+
+func sshChangeRemote(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshChangeRemoteFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
+	}
+
+	if flags.Address == "" {
+		return w.WriteLine("No address was provided")
+	}
+
+	addr, err := netip.ParseAddrPort(flags.Address)
+	if err != nil {
+		return w.WriteLine("Address could not be parsed")
+	}
+
+	vpnIp, err := netip.ParseAddr(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	if !vpnIp.IsValid() {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	hostInfo := ifce.hostMap.QueryVpnIp(vpnIp)
+	if hostInfo == nil {
+		return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
+	}
+
+	hostInfo.SetRemote(addr)
+	return w.WriteLine("Changed")
+}
+
+func sshGetHeapProfile(fs interface{}, a []string, w sshd.StringWriter) error {
+	if len(a) == 0 {
+		return w.WriteLine("No path to write profile provided")
+	}
+
+	file, err := os.Create(a[0])
+	if err != nil {
+		err = w.WriteLine(fmt.Sprintf("Unable to create profile file: %s", err))
+		return err
+	}
+
+	err = pprof.WriteHeapProfile(file)
+	if err != nil {
+		err = w.WriteLine(fmt.Sprintf("Unable to write profile: %s", err))
+		return err
+	}
+
+	err = w.WriteLine(fmt.Sprintf("Mem profile created at %s", a))
+	return err
+}
+
+func sshMutexProfileFraction(fs interface{}, a []string, w sshd.StringWriter) error {
+	if len(a) == 0 {
+		rate := runtime.SetMutexProfileFraction(-1)
+		return w.WriteLine(fmt.Sprintf("Current value: %d", rate))
+	}
+
+	newRate, err := strconv.Atoi(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("Invalid argument: %s", a[0]))
+	}
+
+	oldRate := runtime.SetMutexProfileFraction(newRate)
+	return w.WriteLine(fmt.Sprintf("New value: %d. Old value: %d", newRate, oldRate))
+}
+
+func sshGetMutexProfile(fs interface{}, a []string, w sshd.StringWriter) error {
+	if len(a) == 0 {
+		return w.WriteLine("No path to write profile provided")
+	}
+
+	file, err := os.Create(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("Unable to create profile file: %s", err))
+	}
+	defer file.Close()
+
+	mutexProfile := pprof.Lookup("mutex")
+	if mutexProfile == nil {
+		return w.WriteLine("Unable to get pprof.Lookup(\"mutex\")")
+	}
+
+	err = mutexProfile.WriteTo(file, 0)
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("Unable to write profile: %s", err))
+	}
+
+	return w.WriteLine(fmt.Sprintf("Mutex profile created at %s", a))
+}
+
+func sshLogLevel(l *logrus.Logger, fs interface{}, a []string, w sshd.StringWriter) error {
+	if len(a) == 0 {
+		return w.WriteLine(fmt.Sprintf("Log level is: %s", l.Level))
+	}
+
+	level, err := logrus.ParseLevel(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("Unknown log level %s. Possible log levels: %s", a, logrus.AllLevels))
+	}
+
+	l.SetLevel(level)
+	return w.WriteLine(fmt.Sprintf("Log level is: %s", l.Level))
+}
+
+func sshLogFormat(l *logrus.Logger, fs interface{}, a []string, w sshd.StringWriter) error {
+	if len(a) == 0 {
+		return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(l.Formatter)))
+	}
+
+	logFormat := strings.ToLower(a[0])
+	switch logFormat {
+	case "text":
+		l.Formatter = &logrus.TextFormatter{}
+	case "json":
+		l.Formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format `%s`. possible formats: %s", logFormat, []string{"text", "json"})
+	}
+
+	return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(l.Formatter)))
+}
+
+func sshPrintCert(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	args, ok := fs.(*sshPrintCertFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	cert := ifce.pki.GetCertState().Certificate
+	if len(a) > 0 {
+		vpnIp, err := netip.ParseAddr(a[0])
+		if err != nil {
+			return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+		}
+
+		if !vpnIp.IsValid() {
+			return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+		}
+
+		hostInfo := ifce.hostMap.QueryVpnIp(vpnIp)
+		if hostInfo == nil {
+			return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
+		}
+
+		cert = hostInfo.GetCert()
+	}
+
+	if args.Json || args.Pretty {
+		b, err := cert.MarshalJSON()
+		if err != nil {
+			//TODO: handle it
+			return nil
+		}
+
+		if args.Pretty {
+			buf := new(bytes.Buffer)
+			err := json.Indent(buf, b, "", "    ")
+			b = buf.Bytes()
+			if err != nil {
+				//TODO: handle it
+				return nil
+			}
+		}
+
+		return w.WriteBytes(b)
+	}
+
+	if args.Raw {
+		b, err := cert.MarshalToPEM()
+		if err != nil {
+			//TODO: handle it
+			return nil
+		}
+
+		return w.WriteBytes(b)
+	}
+
+	return w.WriteLine(cert.String())
+}
+
+func sshPrintRelays(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	args, ok := fs.(*sshPrintTunnelFlags)
+	if !ok {
+		//TODO: error
+		w.WriteLine(fmt.Sprintf("sshPrintRelays failed to convert args type"))
+		return nil
+	}
+
+	relays := map[uint32]*HostInfo{}
+	ifce.hostMap.Lock()
+	for k, v := range ifce.hostMap.Relays {
+		relays[k] = v
+	}
+	ifce.hostMap.Unlock()
+
+	type RelayFor struct {
+		Error          error
+		Type           string
+		State          string
+		PeerIp         netip.Addr
+		LocalIndex     uint32
+		RemoteIndex    uint32
+		RelayedThrough []netip.Addr
+	}
+
+	type RelayOutput struct {
+		NebulaIp    netip.Addr
+		RelayForIps []RelayFor
+	}
+
+	type CmdOutput struct {
+		Relays []*RelayOutput
+	}
+
+	co := CmdOutput{}
+
+	enc := json.NewEncoder(w.GetWriter())
+
+	if args.Pretty {
+		enc.SetIndent("", "    ")
+	}
+
+	for k, v := range relays {
+		ro := RelayOutput{NebulaIp: v.vpnIp}
+		co.Relays = append(co.Relays, &ro)
+		relayHI := ifce.hostMap.QueryVpnIp(v.vpnIp)
+		if relayHI == nil {
+			ro.RelayForIps = append(ro.RelayForIps, RelayFor{Error: errors.New("could not find hostinfo")})
+			continue
+		}
+		for _, vpnIp := range relayHI.relayState.CopyRelayForIps() {
+			rf := RelayFor{Error: nil}
+			r, ok := relayHI.relayState.GetRelayForByIp(vpnIp)
+			if ok {
+				t := ""
+				switch r.Type {
+				case ForwardingType:
+					t = "forwarding"
+				case TerminalType:
+					t = "terminal"
+				default:
+					t = "unknown"
+				}
+
+				s := ""
+				switch r.State {
+				case Requested:
+					s = "requested"
+				case Established:
+					s = "established"
+				case Disestablished:
+					s = "disestablished"
+				default:
+					s = "unknown"
+				}
+
+				rf.LocalIndex = r.LocalIndex
+				rf.RemoteIndex = r.RemoteIndex
+				rf.PeerIp = r.PeerIp
+				rf.Type = t
+				rf.State = s
+				if rf.LocalIndex != k {
+					rf.Error = fmt.Errorf("hostmap LocalIndex '%v' does not match RelayState LocalIndex", k)
+				}
+			}
+			relayedHI := ifce.hostMap.QueryVpnIp(vpnIp)
+			if relayedHI != nil {
+				rf.RelayedThrough = append(rf.RelayedThrough, relayedHI.relayState.CopyRelayIps()...)
+			}
+
+			ro.RelayForIps = append(ro.RelayForIps, rf)
+		}
+	}
+	err := enc.Encode(co)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func sshExportKeys(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	args, ok := fs.(*sshPrintTunnelFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshPrintTunnelFlags but was %+v", fs)
+	}
+
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
+	}
+
+	vpnIp, err := netip.ParseAddr(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	keys, err := ifce.exportTunnelKeys(vpnIp)
+	if err != nil {
+		return w.WriteLine(err.Error())
+	}
+
+	enc := json.NewEncoder(w.GetWriter())
+	if args.Pretty {
+		enc.SetIndent("", "    ")
+	}
+
+	return enc.Encode(keys)
+}
+
+func sshRelayTopology(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	args, ok := fs.(*sshPrintTunnelFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshPrintTunnelFlags but was %+v", fs)
+	}
+
+	enc := json.NewEncoder(w.GetWriter())
+	if args.Pretty {
+		enc.SetIndent("", "    ")
+	}
+
+	return enc.Encode(relayTopology(ifce.hostMap, ifce.myVpnNet.Addr()))
+}
+
+func sshPrintTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	args, ok := fs.(*sshPrintTunnelFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
+	}
+
+	vpnIp, err := netip.ParseAddr(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	if !vpnIp.IsValid() {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	hostInfo := ifce.hostMap.QueryVpnIp(vpnIp)
+	if hostInfo == nil {
+		return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
+	}
+
+	enc := json.NewEncoder(w.GetWriter())
+	if args.Pretty {
+		enc.SetIndent("", "    ")
+	}
+
+	return enc.Encode(copyHostInfo(hostInfo, ifce.hostMap.PreferredRangesFor(hostInfo)))
+}
+
+func sshDeviceInfo(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+
+	data := struct {
+		Name string `json:"name"`
+		Cidr string `json:"cidr"`
+	}{
+		Name: ifce.inside.Name(),
+		Cidr: ifce.inside.Cidr().String(),
+	}
+
+	flags, ok := fs.(*sshDeviceInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshDeviceInfoFlags but was %+v", fs)
+	}
+
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(data)
+	} else {
+		return w.WriteLine(fmt.Sprintf("name=%v cidr=%v", data.Name, data.Cidr))
+	}
+}
+
+func sshReload(c *config.C, w sshd.StringWriter) error {
+	err := w.WriteLine("Reloading config")
+	c.ReloadConfig()
+	return err
+}
+
+func sshTunnelCounts(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshTunnelCountsFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshTunnelCountsFlags but was %+v", fs)
+	}
+
+	tc := ifce.handshakeManager.TunnelCounts()
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(tc)
+	}
+
+	return w.WriteLine(fmt.Sprintf("tunnels=%v pending=%v relays=%v max=%v", tc.Tunnels, tc.Pending, tc.Relays, tc.Max))
+}
+
+func sshCATunnels(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshTunnelCountsFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshTunnelCountsFlags but was %+v", fs)
+	}
+
+	cas := caTunnels(ifce.hostMap, ifce.pki.GetCAPool())
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(cas)
+	}
+
+	for _, ct := range cas {
+		line := fmt.Sprintf("%s %s: tunnels=%v", ct.Fingerprint, ct.Name, ct.Tunnels)
+		if ct.RotatingIn {
+			line += " (rotating in)"
+		}
+		if !ct.Trusted {
+			line += " (no longer trusted)"
+		}
+		if err := w.WriteLine(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sshInfo(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
+	}
+
+	ri := ifce.RuntimeInfo()
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(ri)
+	}
+
+	lines := []string{
+		fmt.Sprintf("version: %s", ri.Version),
+		fmt.Sprintf("tun: %s mtu=%v vpnCidr=%v", ri.TunName, ri.MTU, ri.VpnCidr),
+		fmt.Sprintf("listen: %v routines=%v", ri.ListenAddrs, ri.Routines),
+		fmt.Sprintf("cipher: %s overhead=%v", ri.Cipher, ri.Overhead),
+		fmt.Sprintf("lighthouse: %v amRelay=%v useRelays=%v", ri.AmLighthouse, ri.AmRelay, ri.UseRelays),
+		fmt.Sprintf("cert: %s", ri.CertFingerprint),
+		fmt.Sprintf("ca: %v", ri.CAFingerprints),
+	}
+	for _, line := range lines {
+		if err := w.WriteLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sshUDPStats(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
+	}
+
+	stats := ifce.UDPSocketStats()
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(stats)
+	}
+
+	if len(stats) == 0 {
+		return w.WriteLine("udp socket stats are not supported on this platform")
+	}
+
+	for _, s := range stats {
+		drops := "unknown"
+		if s.Drops != nil {
+			drops = fmt.Sprintf("%v", *s.Drops)
+		}
+
+		err := w.WriteLine(fmt.Sprintf("%v: %v recvBuffer=%v sendBuffer=%v drops=%s", s.Routine, s.LocalAddr, s.RecvBuffer, s.SendBuffer, drops))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sshExpiredCerts(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
+	}
+
+	ec := ifce.pki.expiredCerts(ifce.hostMap, time.Now())
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(ec)
+	}
+
+	if err := w.WriteLine(fmt.Sprintf("pki.expired_grace_period: %v", ec.GracePeriod)); err != nil {
+		return err
+	}
+
+	certs := ec.Peers
+	if ec.Own != nil {
+		certs = append([]ExpiredCert{*ec.Own}, certs...)
+	}
+	for i, c := range certs {
+		line := fmt.Sprintf("%s %s %s: expired %v ago at %v", c.VpnIp, c.CertName, c.Fingerprint, c.ExpiredFor.Round(time.Second), c.NotAfter)
+		if i == 0 && ec.Own != nil {
+			line = "own certificate " + line
+		}
+		if !c.InGrace {
+			line += " (past the grace period)"
+		}
+		if err := w.WriteLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sshLighthouseOrder(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
+	}
+
+	order := ifce.lightHouse.selection.order(ifce.lightHouse.GetLighthouses(), time.Now())
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(order)
+	}
+
+	for _, s := range order {
+		line := fmt.Sprintf("tier %d: %s weight %d", s.Tier, s.VpnIp, s.Weight)
+		if s.RTT > 0 {
+			line += fmt.Sprintf(" rtt %v", s.RTT.Round(time.Microsecond))
+		}
+		if !s.Reachable {
+			line += " (not answering)"
+		}
+		if err := w.WriteLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sshRemoteCandidates(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
+	}
+
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
+	}
+
+	vpnIp, err := netip.ParseAddr(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	cs := ifce.lightHouse.RemoteCandidates(vpnIp)
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(cs)
+	}
+
+	for _, c := range cs {
+		kind := "reported"
+		if c.Learned {
+			kind = "learned"
+		}
+		line := fmt.Sprintf("%s %s by %s", c.Addr, kind, c.Owner)
+		if c.Age > 0 {
+			line += fmt.Sprintf(" %v ago", c.Age.Round(time.Second))
+		}
+		if err := w.WriteLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sshSendQueues(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
+	}
+
+	st := ifce.sendPriority.Status()
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(st)
+	}
+
+	if !ifce.sendPriority.enabled.Load() {
+		if err := w.WriteLine("send_priority is disabled"); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range st {
+		err := w.WriteLine(fmt.Sprintf("%s: weight=%v depth=%v occupancy=%.1f%% avg_depth=%.1f dropped=%v wred_dropped=%v groups=%v",
+			s.Class, s.Weight, s.Depth, s.Occupancy*100, s.AvgDepth, s.Dropped, s.WREDDropped, s.Groups))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sshNATType(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
+	}
+
+	status := ifce.lightHouse.GetNATStatus()
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(status)
+	}
+
+	err := w.WriteLine(fmt.Sprintf("nat type: %s", status.Type))
+	if err != nil {
+		return err
+	}
+
+	for _, o := range status.Observed {
+		err = w.WriteLine(fmt.Sprintf("%v sees us at %v", o.Lighthouse, o.Addr))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sshTunnelMetrics(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
+	}
+
+	status := ifce.tunnelMetrics.Status()
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(status)
+	}
+
+	if len(status) == 0 {
+		return w.WriteLine("No peers are watched")
+	}
+
+	for _, s := range status {
+		line := fmt.Sprintf("%s until %s tx %d packets %d bytes rx %d packets %d bytes roams %d",
+			s.VpnIp, s.Until.Format(time.RFC3339), s.TxPackets, s.TxBytes, s.RxPackets, s.RxBytes, s.Roams)
+		if s.Up {
+			line += fmt.Sprintf(" drops %d", s.Drops)
+		} else {
+			line += " no tunnel"
+		}
+		if s.RTT > 0 {
+			line += fmt.Sprintf(" rtt %v", s.RTT.Round(time.Microsecond))
+		}
+		if err := w.WriteLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sshRates(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
+	}
+
+	status := ifce.rates.Status()
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(status)
+	}
+
+	if status.Window == 0 {
+		return w.WriteLine("No rates yet, they are sampled every second")
 	}
 
-	err = pprof.StartCPUProfile(file)
-	if err != nil {
-		err = w.WriteLine(fmt.Sprintf("Unable to start cpu profile: %s", err))
-		return err
+	lines := []string{
+		fmt.Sprintf("per second over the last %v", status.Window.Round(time.Millisecond)),
+		fmt.Sprintf("in %.1f packets %.1f bytes out %.1f packets %.1f bytes",
+			status.RxPackets, status.RxBytes, status.TxPackets, status.TxBytes),
+		fmt.Sprintf("handshakes initiated %.1f received %.1f drops %.1f",
+			status.HandshakesInitiated, status.HandshakesReceived, status.Drops),
+	}
+	for _, rr := range status.Readers {
+		lines = append(lines, fmt.Sprintf("reader %d in %.1f packets %.1f bytes out %.1f packets %.1f bytes",
+			rr.Reader, rr.RxPackets, rr.RxBytes, rr.TxPackets, rr.TxBytes))
 	}
 
-	err = w.WriteLine(fmt.Sprintf("Started cpu profile, issue stop-cpu-profile to write the output to %s", a))
-	return err
+	for _, line := range lines {
+		if err := w.WriteLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func sshVersion(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
-	return w.WriteLine(fmt.Sprintf("%s", ifce.version))
+// sshParseVpnIps parses every argument as a vpn ip
+func sshParseVpnIps(a []string) ([]netip.Addr, error) {
+	vpnIps := make([]netip.Addr, 0, len(a))
+	for _, s := range a {
+		vpnIp, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("The provided vpn ip could not be parsed: %s", s)
+		}
+		vpnIps = append(vpnIps, vpnIp)
+	}
+	return vpnIps, nil
 }
 
-func sshQueryLighthouse(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+func sshTunnelMetricsEnable(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshTunnelMetricsEnableFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshTunnelMetricsEnableFlags but was %+v", fs)
+	}
+
 	if len(a) == 0 {
 		return w.WriteLine("No vpn ip was provided")
 	}
 
-	vpnIp, err := netip.ParseAddr(a[0])
+	vpnIps, err := sshParseVpnIps(a)
 	if err != nil {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
-	}
-
-	if !vpnIp.IsValid() {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+		return w.WriteLine(err.Error())
 	}
 
-	var cm *CacheMap
-	rl := ifce.lightHouse.Query(vpnIp)
-	if rl != nil {
-		cm = rl.CopyCache()
+	if err = ifce.tunnelMetrics.Enable(vpnIps, flags.For, time.Now()); err != nil {
+		return w.WriteLine(err.Error())
 	}
-	return json.NewEncoder(w.GetWriter()).Encode(cm)
+	return w.WriteLine(fmt.Sprintf("Per tunnel metrics enabled for %v", vpnIps))
 }
 
-func sshCloseTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
-	flags, ok := fs.(*sshCloseTunnelFlags)
-	if !ok {
-		//TODO: error
-		return nil
+func sshTunnelMetricsDisable(ifce *Interface, a []string, w sshd.StringWriter) error {
+	vpnIps, err := sshParseVpnIps(a)
+	if err != nil {
+		return w.WriteLine(err.Error())
 	}
 
-	if len(a) == 0 {
-		return w.WriteLine("No vpn ip was provided")
+	ifce.tunnelMetrics.Disable(vpnIps)
+	if len(vpnIps) == 0 {
+		return w.WriteLine("Per tunnel metrics disabled for every peer")
 	}
+	return w.WriteLine(fmt.Sprintf("Per tunnel metrics disabled for %v", vpnIps))
+}
 
-	vpnIp, err := netip.ParseAddr(a[0])
-	if err != nil {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+func sshFirewallRules(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
 	}
 
-	if !vpnIp.IsValid() {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
-	}
+	rs := ifce.firewall.Ruleset()
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
 
-	hostInfo := ifce.hostMap.QueryVpnIp(vpnIp)
-	if hostInfo == nil {
-		return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
+		return js.Encode(rs)
 	}
 
-	if !flags.LocalOnly {
-		ifce.send(
-			header.CloseTunnel,
-			0,
-			hostInfo.ConnectionState,
-			hostInfo,
-			[]byte{},
-			make([]byte, 12, 12),
-			make([]byte, mtu),
-		)
+	err := w.WriteLine(fmt.Sprintf("rules version: %d, hash: %s, inbound action: %s, outbound action: %s",
+		rs.RulesVersion, rs.RulesHash, rs.InboundAction, rs.OutboundAction))
+	if err != nil {
+		return err
 	}
 
-	ifce.closeTunnel(hostInfo)
-	return w.WriteLine("Closed")
+	for _, r := range append(rs.Outbound, rs.Inbound...) {
+		if err = w.WriteLine(r.String()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func sshCreateTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
-	flags, ok := fs.(*sshCreateTunnelFlags)
+func sshTestFirewall(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshTestFirewallFlags)
 	if !ok {
-		//TODO: error
-		return nil
+		return fmt.Errorf("internal error: expected flags to be sshTestFirewallFlags but was %+v", fs)
 	}
 
 	if len(a) == 0 {
 		return w.WriteLine("No vpn ip was provided")
 	}
 
-	vpnIp, err := netip.ParseAddr(a[0])
+	fp, peer, err := sshTestFirewallPacket(ifce, flags, a[0])
 	if err != nil {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+		return w.WriteLine(err.Error())
 	}
 
-	if !vpnIp.IsValid() {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	res, err := ifce.TestFirewall(fp, !flags.Out, flags.Relay, peer)
+	if err != nil {
+		return w.WriteLine(err.Error())
 	}
 
-	hostInfo := ifce.hostMap.QueryVpnIp(vpnIp)
-	if hostInfo != nil {
-		return w.WriteLine(fmt.Sprintf("Tunnel already exists"))
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(res)
 	}
 
-	hostInfo = ifce.handshakeManager.QueryVpnIp(vpnIp)
-	if hostInfo != nil {
-		return w.WriteLine(fmt.Sprintf("Tunnel already handshaking"))
+	local, remote := netip.AddrPortFrom(fp.LocalIP, fp.LocalPort), netip.AddrPortFrom(fp.RemoteIP, fp.RemotePort)
+	line := fmt.Sprintf("%s %v -> %v", firewallProtoName(fp.Protocol), remote, local)
+	if flags.Out {
+		line = fmt.Sprintf("%s %v -> %v", firewallProtoName(fp.Protocol), local, remote)
 	}
+	if res.Allowed {
+		return w.WriteLine(fmt.Sprintf("%s allowed by %s", line, res.Rule))
+	}
+	return w.WriteLine(fmt.Sprintf("%s dropped by %s: %s", line, res.Rule, res.Error))
+}
 
-	var addr netip.AddrPort
-	if flags.Address != "" {
-		addr, err = netip.ParseAddrPort(flags.Address)
-		if err != nil {
-			return w.WriteLine("Address could not be parsed")
+// sshTestFirewallPacket builds the packet and peer described by the test-firewall flags for the peer vpn ip remote
+func sshTestFirewallPacket(ifce *Interface, flags *sshTestFirewallFlags, remote string) (firewall.Packet, FirewallTestPeer, error) {
+	fp := firewall.Packet{LocalIP: ifce.myVpnNet.Addr(), Fragment: flags.Fragment}
+	peer := FirewallTestPeer{Name: flags.Name, CA: flags.CA}
+
+	var err error
+	if fp.RemoteIP, err = netip.ParseAddr(remote); err != nil {
+		return fp, peer, fmt.Errorf("The provided vpn ip could not be parsed: %s", remote)
+	}
+	if flags.Local != "" {
+		if fp.LocalIP, err = netip.ParseAddr(flags.Local); err != nil {
+			return fp, peer, fmt.Errorf("The provided local ip could not be parsed: %s", flags.Local)
 		}
 	}
+	if flags.LocalPort > 65535 || flags.RemotePort > 65535 {
+		return fp, peer, fmt.Errorf("Ports must be between 0 and 65535")
+	}
+	fp.LocalPort, fp.RemotePort = uint16(flags.LocalPort), uint16(flags.RemotePort)
 
-	hostInfo = ifce.handshakeManager.StartHandshake(vpnIp, nil)
-	if addr.IsValid() {
-		hostInfo.SetRemote(addr)
+	switch flags.Proto {
+	case "tcp":
+		fp.Protocol = firewall.ProtoTCP
+	case "udp":
+		fp.Protocol = firewall.ProtoUDP
+	case "icmp":
+		fp.Protocol = firewall.ProtoICMP
+	default:
+		return fp, peer, fmt.Errorf("The protocol must be tcp, udp or icmp: %s", flags.Proto)
 	}
 
-	return w.WriteLine("Created")
+	if flags.Groups != "" {
+		peer.Groups = strings.Split(flags.Groups, ",")
+	}
+	if flags.Attributes != "" {
+		peer.Attributes = map[string]string{}
+		for _, kv := range strings.Split(flags.Attributes, ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				return fp, peer, fmt.Errorf("Attributes must be key=value: %s", kv)
+			}
+			peer.Attributes[k] = v
+		}
+	}
+	if peer.Ips, err = sshParsePrefixes(flags.Ips); err != nil {
+		return fp, peer, err
+	}
+	if peer.Subnets, err = sshParsePrefixes(flags.Subnets); err != nil {
+		return fp, peer, err
+	}
+	return fp, peer, nil
 }
 
-func sshChangeRemote(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
-	flags, ok := fs.(*sshChangeRemoteFlags)
-	if !ok {
-		//TODO: error
-		return nil
+func sshParsePrefixes(s string) ([]netip.Prefix, error) {
+	if s == "" {
+		return nil, nil
 	}
 
-	if len(a) == 0 {
-		return w.WriteLine("No vpn ip was provided")
+	var out []netip.Prefix
+	for _, v := range strings.Split(s, ",") {
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("The provided cidr could not be parsed: %s", v)
+		}
+		out = append(out, p)
 	}
+	return out, nil
+}
 
-	if flags.Address == "" {
-		return w.WriteLine("No address was provided")
+func sshObserver(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
 	}
 
-	addr, err := netip.ParseAddrPort(flags.Address)
-	if err != nil {
-		return w.WriteLine("Address could not be parsed")
+	status := ifce.observer.Status(ifce.hostMap)
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(status)
 	}
 
-	vpnIp, err := netip.ParseAddr(a[0])
+	if !status.Enabled {
+		return w.WriteLine("This node is not an observer")
+	}
+
+	err := w.WriteLine(fmt.Sprintf("observer, dropped inbound: %d, dropped outbound: %d", status.DroppedInbound, status.DroppedOutbound))
 	if err != nil {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+		return err
 	}
 
-	if !vpnIp.IsValid() {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	for _, t := range status.Targets {
+		state := "down"
+		if t.Up {
+			state = "up"
+		}
+		if err = w.WriteLine(fmt.Sprintf("%s %s", t.VpnIp, state)); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	hostInfo := ifce.hostMap.QueryVpnIp(vpnIp)
-	if hostInfo == nil {
-		return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
+func sshUnderlay(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
 	}
 
-	hostInfo.SetRemote(addr)
-	return w.WriteLine("Changed")
-}
+	status := ifce.underlayWatch.Status()
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
 
-func sshGetHeapProfile(fs interface{}, a []string, w sshd.StringWriter) error {
-	if len(a) == 0 {
-		return w.WriteLine("No path to write profile provided")
+		return js.Encode(status)
 	}
 
-	file, err := os.Create(a[0])
-	if err != nil {
-		err = w.WriteLine(fmt.Sprintf("Unable to create profile file: %s", err))
-		return err
+	if !status.Enabled {
+		return w.WriteLine("underlay_watch is disabled")
 	}
 
-	err = pprof.WriteHeapProfile(file)
+	lastChange := "never"
+	if !status.LastChange.IsZero() {
+		lastChange = fmt.Sprintf("%v ago", time.Since(status.LastChange).Round(time.Second))
+	}
+	err := w.WriteLine(fmt.Sprintf("last change: %s, changes: %d, rebinds: %d", lastChange, status.Changes, status.Rebinds))
 	if err != nil {
-		err = w.WriteLine(fmt.Sprintf("Unable to write profile: %s", err))
 		return err
 	}
 
-	err = w.WriteLine(fmt.Sprintf("Mem profile created at %s", a))
-	return err
+	for _, addr := range status.Addrs {
+		err = w.WriteLine(addr.String())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func sshMutexProfileFraction(fs interface{}, a []string, w sshd.StringWriter) error {
-	if len(a) == 0 {
-		rate := runtime.SetMutexProfileFraction(-1)
-		return w.WriteLine(fmt.Sprintf("Current value: %d", rate))
+func sshListPendingHandshakes(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshListPendingHandshakesFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshListPendingHandshakesFlags but was %+v", fs)
 	}
 
-	newRate, err := strconv.Atoi(a[0])
-	if err != nil {
-		return w.WriteLine(fmt.Sprintf("Invalid argument: %s", a[0]))
+	pending := ifce.handshakeManager.ListPending()
+
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(pending)
 	}
 
-	oldRate := runtime.SetMutexProfileFraction(newRate)
-	return w.WriteLine(fmt.Sprintf("New value: %d. Old value: %d", newRate, oldRate))
+	if len(pending) == 0 {
+		return w.WriteLine("No pending handshakes")
+	}
+
+	for _, p := range pending {
+		line := fmt.Sprintf("%v: attempts=%v age=%v lastRemotes=%v", p.VpnIp, p.Attempts, p.Age.Round(time.Millisecond), p.LastRemotes)
+		if len(p.Relays) > 0 {
+			line += fmt.Sprintf(" relays=%v", p.Relays)
+		}
+		if err := w.WriteLine(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func sshGetMutexProfile(fs interface{}, a []string, w sshd.StringWriter) error {
-	if len(a) == 0 {
-		return w.WriteLine("No path to write profile provided")
+func sshClearPendingHandshakes(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshClearPendingHandshakesFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshClearPendingHandshakesFlags but was %+v", fs)
 	}
 
-	file, err := os.Create(a[0])
-	if err != nil {
-		return w.WriteLine(fmt.Sprintf("Unable to create profile file: %s", err))
+	if flags.All == (len(a) > 0) {
+		return w.WriteLine("Provide either vpn ips or -all")
 	}
-	defer file.Close()
 
-	mutexProfile := pprof.Lookup("mutex")
-	if mutexProfile == nil {
-		return w.WriteLine("Unable to get pprof.Lookup(\"mutex\")")
+	vpnIps := make([]netip.Addr, 0, len(a))
+	for _, rawIp := range a {
+		vpnIp, err := netip.ParseAddr(rawIp)
+		if err != nil {
+			return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", rawIp))
+		}
+		vpnIps = append(vpnIps, vpnIp)
 	}
 
-	err = mutexProfile.WriteTo(file, 0)
-	if err != nil {
-		return w.WriteLine(fmt.Sprintf("Unable to write profile: %s", err))
+	cleared := ifce.handshakeManager.ClearPending(vpnIps, flags.OlderThan)
+	if len(cleared) == 0 {
+		return w.WriteLine("No pending handshakes were cleared")
 	}
 
-	return w.WriteLine(fmt.Sprintf("Mutex profile created at %s", a))
+	return w.WriteLine(fmt.Sprintf("Cleared %v pending handshakes: %v", len(cleared), cleared))
 }
 
-func sshLogLevel(l *logrus.Logger, fs interface{}, a []string, w sshd.StringWriter) error {
+func sshRehandshake(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshRehandshakeFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshRehandshakeFlags but was %+v", fs)
+	}
+
 	if len(a) == 0 {
-		return w.WriteLine(fmt.Sprintf("Log level is: %s", l.Level))
+		return w.WriteLine("No vpn ip was provided")
 	}
 
-	level, err := logrus.ParseLevel(a[0])
+	vpnIp, err := netip.ParseAddr(a[0])
 	if err != nil {
-		return w.WriteLine(fmt.Sprintf("Unknown log level %s. Possible log levels: %s", a, logrus.AllLevels))
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
 	}
 
-	l.SetLevel(level)
-	return w.WriteLine(fmt.Sprintf("Log level is: %s", l.Level))
-}
+	if !ifce.myVpnNet.Contains(vpnIp) || vpnIp == ifce.myVpnNet.Addr() {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip is not a peer in our network: %s", a[0]))
+	}
 
-func sshLogFormat(l *logrus.Logger, fs interface{}, a []string, w sshd.StringWriter) error {
-	if len(a) == 0 {
-		return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(l.Formatter)))
+	ctx, cancel := context.WithTimeout(context.Background(), flags.Timeout)
+	defer cancel()
+	res := ifce.rehandshake(ctx, vpnIp)
+
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(res)
 	}
 
-	logFormat := strings.ToLower(a[0])
-	switch logFormat {
-	case "text":
-		l.Formatter = &logrus.TextFormatter{}
-	case "json":
-		l.Formatter = &logrus.JSONFormatter{}
+	switch {
+	case !res.Established:
+		return w.WriteLine(fmt.Sprintf("Handshake with %v failed after %v: %s", vpnIp, res.Duration, res.Error))
+	case res.Path == "direct":
+		return w.WriteLine(fmt.Sprintf("Established direct tunnel with %v at %v in %v", vpnIp, res.Remote, res.Duration))
 	default:
-		return fmt.Errorf("unknown log format `%s`. possible formats: %s", logFormat, []string{"text", "json"})
+		return w.WriteLine(fmt.Sprintf("Established tunnel with %v via relays %v in %v", vpnIp, res.Relays, res.Duration))
 	}
-
-	return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(l.Formatter)))
 }
 
-func sshPrintCert(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
-	args, ok := fs.(*sshPrintCertFlags)
-	if !ok {
-		//TODO: error
-		return nil
+func sshReachable(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshReachableFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshReachableFlags but was %+v", fs)
+	}
+
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
+	}
+
+	vpnIp, err := netip.ParseAddr(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
 	}
 
-	cert := ifce.pki.GetCertState().Certificate
-	if len(a) > 0 {
-		vpnIp, err := netip.ParseAddr(a[0])
-		if err != nil {
-			return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
-		}
+	res := ifce.IsReachable(vpnIp, flags.Timeout)
 
-		if !vpnIp.IsValid() {
-			return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
 		}
 
-		hostInfo := ifce.hostMap.QueryVpnIp(vpnIp)
-		if hostInfo == nil {
-			return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
+		return js.Encode(res)
+	}
+
+	if !res.Reachable {
+		if res.Error != "" {
+			return w.WriteLine(fmt.Sprintf("%v is not reachable: %s", vpnIp, res.Error))
 		}
+		return w.WriteLine(fmt.Sprintf("%v is not reachable", vpnIp))
+	}
 
-		cert = hostInfo.GetCert()
+	line := fmt.Sprintf("%v is reachable via relays %v", vpnIp, res.Relays)
+	if res.Path == "direct" {
+		line = fmt.Sprintf("%v is reachable directly at %v", vpnIp, res.Remote)
+	}
+	if res.RTT > 0 {
+		line += fmt.Sprintf(" rtt %v", res.RTT.Round(time.Microsecond))
 	}
+	return w.WriteLine(line)
+}
 
-	if args.Json || args.Pretty {
-		b, err := cert.MarshalJSON()
-		if err != nil {
-			//TODO: handle it
-			return nil
-		}
+func sshLoadCert(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
+	}
 
-		if args.Pretty {
-			buf := new(bytes.Buffer)
-			err := json.Indent(buf, b, "", "    ")
-			b = buf.Bytes()
-			if err != nil {
-				//TODO: handle it
-				return nil
-			}
-		}
+	if len(a) == 0 {
+		return w.WriteLine("No certificate path was provided")
+	}
 
-		return w.WriteBytes(b)
+	rawCert, err := os.ReadFile(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("Could not read the certificate: %s", err))
 	}
 
-	if args.Raw {
-		b, err := cert.MarshalToPEM()
-		if err != nil {
-			//TODO: handle it
-			return nil
+	res, err := ifce.pki.LoadCert(rawCert)
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("Certificate was not loaded: %s", err))
+	}
+
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
 		}
 
-		return w.WriteBytes(b)
+		return js.Encode(res)
 	}
 
-	return w.WriteLine(cert.String())
+	return w.WriteLine(fmt.Sprintf("Loaded certificate %s, replacing %s, valid until %v", res.NewFingerprint, res.OldFingerprint, res.NotAfter))
 }
 
-func sshPrintRelays(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
-	args, ok := fs.(*sshPrintTunnelFlags)
+func sshRelayDrain(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshRelayDrainFlags)
 	if !ok {
-		//TODO: error
-		w.WriteLine(fmt.Sprintf("sshPrintRelays failed to convert args type"))
-		return nil
+		return fmt.Errorf("internal error: expected flags to be sshRelayDrainFlags but was %+v", fs)
 	}
 
-	relays := map[uint32]*HostInfo{}
-	ifce.hostMap.Lock()
-	for k, v := range ifce.hostMap.Relays {
-		relays[k] = v
+	status := ifce.relayManager.DrainStatus()
+	if !flags.Status {
+		var err error
+		status, err = ifce.relayManager.startDrain(ifce, flags.Grace)
+		if err != nil {
+			return w.WriteLine(err.Error())
+		}
 	}
-	ifce.hostMap.Unlock()
 
-	type RelayFor struct {
-		Error          error
-		Type           string
-		State          string
-		PeerIp         netip.Addr
-		LocalIndex     uint32
-		RemoteIndex    uint32
-		RelayedThrough []netip.Addr
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(status)
 	}
 
-	type RelayOutput struct {
-		NebulaIp    netip.Addr
-		RelayForIps []RelayFor
+	switch {
+	case !status.Draining:
+		return w.WriteLine("Not draining")
+	case status.Stopped:
+		return w.WriteLine(fmt.Sprintf("Drained, %v of %v forwards migrated, forwarding stopped at %v",
+			status.Migrated, status.Forwards, status.Deadline.Format(time.RFC3339)))
+	default:
+		return w.WriteLine(fmt.Sprintf("Draining, %v of %v forwards migrated, %v remaining, forwarding stops at %v",
+			status.Migrated, status.Forwards, status.Remaining, status.Deadline.Format(time.RFC3339)))
 	}
+}
 
-	type CmdOutput struct {
-		Relays []*RelayOutput
+func sshRelayShare(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
 	}
 
-	co := CmdOutput{}
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
+	}
 
-	enc := json.NewEncoder(w.GetWriter())
+	vpnIp, err := netip.ParseAddr(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
 
-	if args.Pretty {
-		enc.SetIndent("", "    ")
+	hostInfo := ifce.hostMap.QueryVpnIp(vpnIp)
+	if hostInfo == nil {
+		return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
 	}
 
-	for k, v := range relays {
-		ro := RelayOutput{NebulaIp: v.vpnIp}
-		co.Relays = append(co.Relays, &ro)
-		relayHI := ifce.hostMap.QueryVpnIp(v.vpnIp)
-		if relayHI == nil {
-			ro.RelayForIps = append(ro.RelayForIps, RelayFor{Error: errors.New("could not find hostinfo")})
-			continue
+	utilization := ifce.relayLoadShare.GetRelayUtilization(ifce.hostMap, hostInfo)
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
 		}
-		for _, vpnIp := range relayHI.relayState.CopyRelayForIps() {
-			rf := RelayFor{Error: nil}
-			r, ok := relayHI.relayState.GetRelayForByIp(vpnIp)
-			if ok {
-				t := ""
-				switch r.Type {
-				case ForwardingType:
-					t = "forwarding"
-				case TerminalType:
-					t = "terminal"
-				default:
-					t = "unknown"
-				}
 
-				s := ""
-				switch r.State {
-				case Requested:
-					s = "requested"
-				case Established:
-					s = "established"
-				default:
-					s = "unknown"
-				}
+		return js.Encode(utilization)
+	}
 
-				rf.LocalIndex = r.LocalIndex
-				rf.RemoteIndex = r.RemoteIndex
-				rf.PeerIp = r.PeerIp
-				rf.Type = t
-				rf.State = s
-				if rf.LocalIndex != k {
-					rf.Error = fmt.Errorf("hostmap LocalIndex '%v' does not match RelayState LocalIndex", k)
-				}
-			}
-			relayedHI := ifce.hostMap.QueryVpnIp(vpnIp)
-			if relayedHI != nil {
-				rf.RelayedThrough = append(rf.RelayedThrough, relayedHI.relayState.CopyRelayIps()...)
-			}
+	if utilization == nil {
+		return w.WriteLine(fmt.Sprintf("Traffic to %v is not load shared, see relay.load_share", vpnIp))
+	}
 
-			ro.RelayForIps = append(ro.RelayForIps, rf)
+	for _, u := range utilization {
+		state := "established"
+		if !u.Established {
+			state = "not established"
+		}
+		err = w.WriteLine(fmt.Sprintf("%v: weight %v, %s, %v packets, %v bytes", u.Relay, u.Weight, state, u.Packets, u.Bytes))
+		if err != nil {
+			return err
 		}
 	}
-	err := enc.Encode(co)
-	if err != nil {
-		return err
-	}
+
 	return nil
 }
 
-func sshPrintTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
-	args, ok := fs.(*sshPrintTunnelFlags)
+func sshRekeyClasses(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
 	if !ok {
-		//TODO: error
-		return nil
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
 	}
 
 	if len(a) == 0 {
@@ -951,36 +2572,83 @@ func sshPrintTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWr
 		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
 	}
 
-	if !vpnIp.IsValid() {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
-	}
-
 	hostInfo := ifce.hostMap.QueryVpnIp(vpnIp)
 	if hostInfo == nil {
 		return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
 	}
 
-	enc := json.NewEncoder(w.GetWriter())
-	if args.Pretty {
-		enc.SetIndent("", "    ")
-	}
+	classes := ifce.rekey.GetClasses(hostInfo)
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
 
-	return enc.Encode(copyHostInfo(hostInfo, ifce.hostMap.GetPreferredRanges()))
-}
+		return js.Encode(classes)
+	}
 
-func sshDeviceInfo(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	if classes == nil {
+		return w.WriteLine("No rekey classes are configured, see rekey.classes")
+	}
 
-	data := struct {
-		Name string `json:"name"`
-		Cidr string `json:"cidr"`
-	}{
-		Name: ifce.inside.Name(),
-		Cidr: ifce.inside.Cidr().String(),
+	for _, c := range classes {
+		state := "not carried"
+		if c.Carried {
+			state = "carried"
+		}
+		err = w.WriteLine(fmt.Sprintf("%v: %s, key age %v, max age %v", c.Class, state, c.KeyAge.Truncate(time.Second), c.MaxAge))
+		if err != nil {
+			return err
+		}
 	}
 
-	flags, ok := fs.(*sshDeviceInfoFlags)
+	return nil
+}
+
+func sshPathSelection(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshInfoFlags)
 	if !ok {
-		return fmt.Errorf("internal error: expected flags to be sshDeviceInfoFlags but was %+v", fs)
+		return fmt.Errorf("internal error: expected flags to be sshInfoFlags but was %+v", fs)
+	}
+
+	var out interface{}
+	var lines []string
+	if len(a) == 0 {
+		policy := ifce.pathSelection.GetPolicy()
+		out = policy
+		for _, p := range policy {
+			line := fmt.Sprintf("%v: dscp %v, path %v", p.Class, p.DSCP, p.Path)
+			if len(p.Relays) > 0 {
+				line += fmt.Sprintf(" through %v", p.Relays)
+			}
+			if len(p.Destinations) > 0 {
+				line += fmt.Sprintf(", to %v", p.Destinations)
+			}
+			lines = append(lines, line+fmt.Sprintf(", %v packets steered", p.Steered))
+		}
+	} else {
+		vpnIp, err := netip.ParseAddr(a[0])
+		if err != nil {
+			return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+		}
+
+		hostInfo := ifce.hostMap.QueryVpnIp(vpnIp)
+		if hostInfo == nil {
+			return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
+		}
+
+		paths := ifce.pathSelection.GetPaths(ifce, hostInfo)
+		out = paths
+		for _, p := range paths {
+			line := fmt.Sprintf("%v: %v", p.Class, p.Current)
+			if p.Relay.IsValid() {
+				line += fmt.Sprintf(" through %v", p.Relay)
+			}
+			if p.Current != p.Path {
+				line += fmt.Sprintf(", wants %v", p.Path)
+			}
+			lines = append(lines, line)
+		}
 	}
 
 	if flags.Json || flags.Pretty {
@@ -989,14 +2657,66 @@ func sshDeviceInfo(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
 			js.SetIndent("", "    ")
 		}
 
-		return js.Encode(data)
-	} else {
-		return w.WriteLine(fmt.Sprintf("name=%v cidr=%v", data.Name, data.Cidr))
+		return js.Encode(out)
+	}
+
+	if len(lines) == 0 {
+		if ifce.pathSelection.GetPolicy() == nil {
+			return w.WriteLine("No path selection classes are configured, see path_selection.classes")
+		}
+		return w.WriteLine(fmt.Sprintf("No path selection class applies to %v", a[0]))
+	}
+
+	for _, line := range lines {
+		if err := w.WriteLine(line); err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
-func sshReload(c *config.C, w sshd.StringWriter) error {
-	err := w.WriteLine("Reloading config")
-	c.ReloadConfig()
-	return err
+func sshWatchDrops(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshWatchDropsFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshWatchDropsFlags but was %+v", fs)
+	}
+
+	events, stop, err := ifce.dropWatch.watch(flags.Rate)
+	if err != nil {
+		return w.WriteLine(err.Error())
+	}
+	defer stop()
+
+	// Nothing else reads from a non interactive session, a read returning means the client has gone away
+	done := make(chan struct{})
+	if r, ok := w.GetWriter().(io.Reader); ok {
+		go func() {
+			_, _ = io.Copy(io.Discard, r)
+			close(done)
+		}()
+	}
+
+	var timeout <-chan time.Time
+	if flags.Duration > 0 {
+		t := time.NewTimer(flags.Duration)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	js := json.NewEncoder(w.GetWriter())
+	for n := 0; flags.Count <= 0 || n < flags.Count; n++ {
+		select {
+		case ev := <-events:
+			if err := js.Encode(ev); err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		case <-timeout:
+			return nil
+		}
+	}
+
+	return nil
 }
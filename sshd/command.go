@@ -7,6 +7,7 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/anmitsu/go-shlex"
 	"github.com/armon/go-radix"
 )
 
@@ -29,8 +30,13 @@ type Command struct {
 	Help             string
 	Flags            CommandFlags
 	Callback         CommandCallback
+	// Mutating marks commands that change the state of the node, they are refused to read-only callers of Dispatch
+	Mutating bool
 }
 
+// ErrCommandNotPermitted is returned by Dispatch when a mutating command is run by a read-only caller
+var ErrCommandNotPermitted = errors.New("command is not permitted for read-only callers")
+
 func execCommand(c *Command, args []string, w StringWriter) error {
 	var (
 		fl *flag.FlagSet
@@ -54,6 +60,44 @@ func execCommand(c *Command, args []string, w StringWriter) error {
 	return c.Callback(fs, args, w)
 }
 
+// dispatchCommand parses line and runs the command it names, mutating commands are refused unless allowMutating is set
+func dispatchCommand(commands *radix.Tree, line string, w StringWriter, allowMutating bool) error {
+	args, err := shlex.Split(line, true)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		dumpCommands(commands, w)
+		return nil
+	}
+
+	c, err := lookupCommand(commands, args[0])
+	if err != nil {
+		return err
+	}
+
+	if c == nil {
+		err := w.WriteLine(fmt.Sprintf("did not understand: %s", line))
+		//TODO: log error
+		_ = err
+
+		dumpCommands(commands, w)
+		return nil
+	}
+
+	if checkHelpArgs(args) {
+		return dispatchCommand(commands, fmt.Sprintf("%s %s", "help", c.Name), w, allowMutating)
+	}
+
+	if c.Mutating && !allowMutating {
+		_ = w.WriteLine(fmt.Sprintf("%s changes the node state and is not permitted for read-only callers", c.Name))
+		return ErrCommandNotPermitted
+	}
+
+	return execCommand(c, args[1:], w)
+}
+
 func dumpCommands(c *radix.Tree, w StringWriter) {
 	err := w.WriteLine("Available commands:")
 	if err != nil {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 
@@ -149,6 +150,12 @@ func (s *SSHServer) RegisterCommand(c *Command) {
 	s.commands.Insert(c.Name, c)
 }
 
+// Dispatch runs the command in line and writes its output to w, the same as typing line into an ssh session.
+// Commands marked Mutating are refused with ErrCommandNotPermitted unless allowMutating is set.
+func (s *SSHServer) Dispatch(line string, w io.Writer, allowMutating bool) error {
+	return dispatchCommand(s.commands, line, &stringWriter{w}, allowMutating)
+}
+
 // Run begins listening and accepting connections
 func (s *SSHServer) Run(addr string) error {
 	var err error
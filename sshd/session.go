@@ -1,11 +1,9 @@
 package sshd
 
 import (
-	"fmt"
 	"sort"
 	"strings"
 
-	"github.com/anmitsu/go-shlex"
 	"github.com/armon/go-radix"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
@@ -87,7 +85,7 @@ func (s *session) handleRequests(in <-chan *ssh.Request, channel ssh.Channel) {
 			}
 
 			req.Reply(true, nil)
-			s.dispatchCommand(payload.Value, &stringWriter{channel})
+			dispatchCommand(s.commands, payload.Value, &stringWriter{channel}, true)
 
 			//TODO: Fix error handling and report the proper status back
 			status := struct{ Status uint32 }{uint32(0)}
@@ -141,49 +139,10 @@ func (s *session) handleInput(channel ssh.Channel) {
 			break
 		}
 
-		s.dispatchCommand(line, w)
+		dispatchCommand(s.commands, line, w, true)
 	}
 }
 
-func (s *session) dispatchCommand(line string, w StringWriter) {
-	args, err := shlex.Split(line, true)
-	if err != nil {
-		//todo: LOG IT
-		return
-	}
-
-	if len(args) == 0 {
-		dumpCommands(s.commands, w)
-		return
-	}
-
-	c, err := lookupCommand(s.commands, args[0])
-	if err != nil {
-		//TODO: handle the error
-		return
-	}
-
-	if c == nil {
-		err := w.WriteLine(fmt.Sprintf("did not understand: %s", line))
-		//TODO: log error
-		_ = err
-
-		dumpCommands(s.commands, w)
-		return
-	}
-
-	if checkHelpArgs(args) {
-		s.dispatchCommand(fmt.Sprintf("%s %s", "help", c.Name), w)
-		return
-	}
-
-	err = execCommand(c, args[1:], w)
-	if err != nil {
-		//TODO: log the error
-	}
-	return
-}
-
 func (s *session) Close() {
 	s.c.Close()
 	s.exitChan <- true
@@ -22,7 +22,7 @@ import (
 // startStats initializes stats from config. On success, if any further work
 // is needed to serve stats, it returns a func to handle that work. If no
 // work is needed, it'll return nil. On failure, it returns nil, error.
-func startStats(l *logrus.Logger, c *config.C, buildVersion string, configTest bool) (func(), error) {
+func startStats(l *logrus.Logger, c *config.C, buildVersion string, configTest bool, tm *TunnelMetrics) (func(), error) {
 	mType := c.GetString("stats.type", "")
 	if mType == "" || mType == "none" {
 		return nil, nil
@@ -42,7 +42,7 @@ func startStats(l *logrus.Logger, c *config.C, buildVersion string, configTest b
 		}
 	case "prometheus":
 		var err error
-		startFn, err = startPrometheusStats(l, interval, c, buildVersion, configTest)
+		startFn, err = startPrometheusStats(l, interval, c, buildVersion, configTest, tm)
 		if err != nil {
 			return nil, err
 		}
@@ -79,7 +79,7 @@ func startGraphiteStats(l *logrus.Logger, i time.Duration, c *config.C, configTe
 	return nil
 }
 
-func startPrometheusStats(l *logrus.Logger, i time.Duration, c *config.C, buildVersion string, configTest bool) (func(), error) {
+func startPrometheusStats(l *logrus.Logger, i time.Duration, c *config.C, buildVersion string, configTest bool, tm *TunnelMetrics) (func(), error) {
 	namespace := c.GetString("stats.namespace", "")
 	subsystem := c.GetString("stats.subsystem", "")
 
@@ -114,6 +114,11 @@ func startPrometheusStats(l *logrus.Logger, i time.Duration, c *config.C, buildV
 	pr.MustRegister(g)
 	g.Set(1)
 
+	// Per tunnel metrics carry a vpn_ip label and only exist while a peer is watched, see TunnelMetrics
+	if tm != nil {
+		pr.MustRegister(tm.collector(namespace, subsystem))
+	}
+
 	var startFn func()
 	if !configTest {
 		startFn = func() {
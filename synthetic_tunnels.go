@@ -0,0 +1,357 @@
+//go:build synthetic_tunnels
+// +build synthetic_tunnels
+
+package nebula
+
+// This file contains a driver for load and integration testing that fills the hostmap with tunnels to peers that do
+// not exist and feeds their traffic through the receive path. It is only built with the synthetic_tunnels tag and
+// must never be part of a release build.
+//
+// Run the tests and benchmarks with:
+//
+//	go test -tags synthetic_tunnels -run SyntheticTunnels .
+//	go test -tags synthetic_tunnels -run '^$' -bench SyntheticTunnels -benchmem .
+//
+// or `make synthetic` and `make bench-synthetic`. For capacity testing build a test against a node with tun.disabled set,
+// add the tunnels with Add and drive them with Run at the wanted rate while watching the process, Loss and Reorder
+// exercise the replay window.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/noiseutil"
+	"github.com/slackhq/nebula/udp"
+)
+
+// syntheticRemoteBase is the start of the underlay addresses given to synthetic peers, 198.18.0.0/15 is reserved for
+// benchmarking
+var syntheticRemoteBase = netip.MustParseAddr("198.18.0.1")
+
+// maxSyntheticPayload leaves room for the nebula header, the ip and udp headers, and the AEAD tag in an mtu sized packet
+const maxSyntheticPayload = mtu - header.Len - 28 - 16
+
+// SyntheticTunnelOptions configures the synthetic peers and the traffic they send
+type SyntheticTunnelOptions struct {
+	// Network is where the vpn ips of the synthetic peers are taken from, in order. It must be inside our vpn network
+	// and not used by real peers, a synthetic tunnel replaces the primary tunnel of its vpn ip.
+	Network netip.Prefix
+	// Groups are put in the certificate of every synthetic peer for the inbound firewall
+	Groups []string
+	// Port is the destination port of the generated udp packets, the source port is 4242
+	Port uint16
+	// PayloadSize is the size of the udp payload of every packet
+	PayloadSize int
+	// Loss is the fraction of packets dropped before they are received
+	Loss float64
+	// Reorder is the fraction of packets held back and received after the packet following them
+	Reorder float64
+	// Seed makes the loss and reorder decisions repeatable
+	Seed int64
+}
+
+// SyntheticTunnelStats counts the packets generated by SyntheticTunnels
+type SyntheticTunnelStats struct {
+	Tunnels   int    `json:"tunnels"`
+	Generated uint64 `json:"generated"`
+	Received  uint64 `json:"received"`
+	Lost      uint64 `json:"lost"`
+	Reordered uint64 `json:"reordered"`
+}
+
+// SyntheticTunnels drives tunnels to synthetic peers. The tunnels are added straight to the hostmap without a handshake
+// and are not watched by the connection manager, they stay up until Close. Packets are encrypted with the keys of each
+// tunnel and handed to readOutsidePackets on routine 0 as if they were read from the udp socket, the node must be
+// started. A SyntheticTunnels is not safe for concurrent use.
+type SyntheticTunnels struct {
+	f     *Interface
+	opts  SyntheticTunnelOptions
+	peers []*syntheticPeer
+	next  int
+	rng   *mathrand.Rand
+	stats SyntheticTunnelStats
+
+	// held is a packet waiting to be received out of order from heldFrom
+	held     []byte
+	heldFrom netip.AddrPort
+
+	h        *header.H
+	fwPacket *firewall.Packet
+	out      []byte
+	nb       []byte
+	buf      []byte
+	heldBuf  []byte
+	lhf      udp.LightHouseHandlerFunc
+}
+
+type syntheticPeer struct {
+	hostinfo *HostInfo
+	counter  uint64
+	// plaintext is the inner packet this peer sends
+	plaintext []byte
+}
+
+// NewSyntheticTunnels prepares a driver for synthetic tunnels, add tunnels with Add
+func (c *Control) NewSyntheticTunnels(opts SyntheticTunnelOptions) (*SyntheticTunnels, error) {
+	f := c.f
+	if !opts.Network.IsValid() || !f.myVpnNet.Contains(opts.Network.Addr()) {
+		return nil, fmt.Errorf("synthetic network %v must be inside our vpn network %v", opts.Network, f.myVpnNet)
+	}
+	if opts.Loss < 0 || opts.Loss >= 1 || opts.Reorder < 0 || opts.Reorder >= 1 {
+		return nil, errors.New("synthetic loss and reorder must be at least 0 and below 1")
+	}
+	if opts.PayloadSize < 0 || opts.PayloadSize > maxSyntheticPayload {
+		return nil, fmt.Errorf("synthetic payload size must be between 0 and %d", maxSyntheticPayload)
+	}
+
+	var lhf udp.LightHouseHandlerFunc
+	if f.lightHouse != nil {
+		lhf = lhHandleRequest(f.lightHouse.NewRequestHandler(), f)
+	}
+
+	return &SyntheticTunnels{
+		f:        f,
+		opts:     opts,
+		rng:      mathrand.New(mathrand.NewSource(opts.Seed)),
+		h:        &header.H{},
+		fwPacket: &firewall.Packet{},
+		out:      make([]byte, mtu),
+		nb:       make([]byte, 12, 12),
+		buf:      make([]byte, mtu),
+		heldBuf:  make([]byte, mtu),
+		lhf:      lhf,
+	}, nil
+}
+
+// Add creates n more synthetic tunnels, taking the next vpn ips from the synthetic network
+func (s *SyntheticTunnels) Add(n int) error {
+	f := s.f
+	vpnIp := s.opts.Network.Addr()
+	if len(s.peers) > 0 {
+		vpnIp = s.peers[len(s.peers)-1].hostinfo.vpnIp
+	}
+
+	for i := 0; i < n; i++ {
+		vpnIp = vpnIp.Next()
+		if vpnIp == f.myVpnNet.Addr() {
+			vpnIp = vpnIp.Next()
+		}
+		if !s.opts.Network.Contains(vpnIp) {
+			return fmt.Errorf("synthetic network %v is full after %d tunnels", s.opts.Network, len(s.peers))
+		}
+
+		peer, err := s.newPeer(vpnIp, len(s.peers))
+		if err != nil {
+			return err
+		}
+
+		f.hostMap.Lock()
+		for {
+			if _, ok := f.hostMap.Indexes[peer.hostinfo.localIndexId]; !ok {
+				break
+			}
+			if peer.hostinfo.localIndexId, err = generateIndex(f.l); err != nil {
+				f.hostMap.Unlock()
+				return err
+			}
+		}
+		f.hostMap.unlockedAddHostInfo(peer.hostinfo, f)
+		f.hostMap.Unlock()
+
+		s.peers = append(s.peers, peer)
+	}
+
+	s.stats.Tunnels = len(s.peers)
+	return nil
+}
+
+func (s *SyntheticTunnels) newPeer(vpnIp netip.Addr, i int) (*syntheticPeer, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+
+	var cs *NebulaCipherState
+	if s.f.cipher == "chachapoly" {
+		cs = &NebulaCipherState{c: noise.CipherChaChaPoly.Cipher(key)}
+	} else {
+		cs = &NebulaCipherState{c: noiseutil.CipherAESGCM.Cipher(key)}
+	}
+
+	localIndex, err := generateIndex(s.f.l)
+	if err != nil {
+		return nil, err
+	}
+	remoteIndex, err := generateIndex(s.f.l)
+	if err != nil {
+		return nil, err
+	}
+
+	peerCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Name:           fmt.Sprintf("synthetic-%d", i),
+		Ips:            []*net.IPNet{{IP: vpnIp.AsSlice(), Mask: net.CIDRMask(s.f.myVpnNet.Bits(), vpnIp.BitLen())}},
+		Groups:         s.opts.Groups,
+		InvertedGroups: map[string]struct{}{},
+		NotBefore:      time.Now().Add(-time.Minute),
+		NotAfter:       time.Now().Add(24 * time.Hour),
+	}}
+	for _, g := range s.opts.Groups {
+		peerCert.Details.InvertedGroups[g] = struct{}{}
+	}
+
+	window := NewBits(ReplayWindow)
+	window.Update(s.f.l, 0)
+
+	hostinfo := &HostInfo{
+		ConnectionState: &ConnectionState{
+			eKey:     cs,
+			dKey:     cs,
+			myCert:   s.f.pki.GetCertState().Certificate,
+			peerCert: peerCert,
+			window:   window,
+		},
+		localIndexId:    localIndex,
+		remoteIndexId:   remoteIndex,
+		vpnIp:           vpnIp,
+		HandshakePacket: make(map[uint8][]byte, 0),
+		relayState: RelayState{
+			relays:        map[netip.Addr]struct{}{},
+			relayForByIp:  map[netip.Addr]*Relay{},
+			relayForByIdx: map[uint32]*Relay{},
+		},
+	}
+	hostinfo.ConnectionState.messageCounter.Add(2)
+
+	var remote [4]byte
+	binary.BigEndian.PutUint32(remote[:], binary.BigEndian.Uint32(syntheticRemoteBase.AsSlice())+uint32(i))
+	// The lighthouse never hears of synthetic peers, keep their remote list out of its cache
+	hostinfo.remotes = NewRemoteList(nil)
+	hostinfo.SetRemote(netip.AddrPortFrom(netip.AddrFrom4(remote), 4242))
+	hostinfo.CreateRemoteCIDR(peerCert)
+
+	plaintext, err := s.packetFrom(vpnIp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Counters 1 and 2 are used by the handshake
+	return &syntheticPeer{hostinfo: hostinfo, counter: 2, plaintext: plaintext}, nil
+}
+
+// packetFrom builds the udp packet sent by the synthetic peer at vpnIp
+func (s *SyntheticTunnels) packetFrom(vpnIp netip.Addr) ([]byte, error) {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    vpnIp.AsSlice(),
+		DstIP:    s.f.myVpnNet.Addr().AsSlice(),
+	}
+	udpLayer := &layers.UDP{SrcPort: 4242, DstPort: layers.UDPPort(s.opts.Port)}
+	if err := udpLayer.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, err
+	}
+
+	b := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(b, opts, ip, udpLayer, gopacket.Payload(make([]byte, s.opts.PayloadSize)))
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Send generates n packets, one from each synthetic peer in turn, and receives them subject to loss and reordering
+func (s *SyntheticTunnels) Send(n int) {
+	if len(s.peers) == 0 {
+		return
+	}
+
+	for i := 0; i < n; i++ {
+		peer := s.peers[s.next]
+		s.next = (s.next + 1) % len(s.peers)
+
+		peer.counter++
+		packet := header.Encode(s.buf, header.Version, header.Message, header.MessageNone, peer.hostinfo.localIndexId, peer.counter)
+		packet, _ = peer.hostinfo.ConnectionState.eKey.EncryptDanger(packet, packet, peer.plaintext, peer.counter, s.nb)
+		s.stats.Generated++
+
+		if s.opts.Loss > 0 && s.rng.Float64() < s.opts.Loss {
+			s.stats.Lost++
+			continue
+		}
+
+		if s.held == nil && s.opts.Reorder > 0 && s.rng.Float64() < s.opts.Reorder {
+			s.held = append(s.heldBuf[:0], packet...)
+			s.heldFrom = peer.hostinfo.remote
+			s.stats.Reordered++
+			continue
+		}
+
+		s.receive(peer.hostinfo.remote, packet)
+		if s.held != nil {
+			s.receive(s.heldFrom, s.held)
+			s.held = nil
+		}
+	}
+}
+
+func (s *SyntheticTunnels) receive(remote netip.AddrPort, packet []byte) {
+	s.f.readOutsidePackets(remote, nil, s.out[:0], packet, 0, s.h, s.fwPacket, s.lhf, s.nb, 0, nil)
+	s.stats.Received++
+}
+
+// Run calls Send at rate packets per second until ctx is done, a rate of 0 sends as fast as possible. Packets that would
+// be due after the deadline of ctx are never sent.
+func (s *SyntheticTunnels) Run(ctx context.Context, rate int) {
+	start := time.Now()
+	deadline, hasDeadline := ctx.Deadline()
+	var sent uint64
+	for ctx.Err() == nil {
+		if rate <= 0 {
+			s.Send(64)
+			continue
+		}
+
+		now := time.Now()
+		if hasDeadline && now.After(deadline) {
+			now = deadline
+		}
+		due := uint64(now.Sub(start).Seconds() * float64(rate))
+		if due > sent {
+			s.Send(int(due - sent))
+			sent = due
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Stats returns what was generated so far
+func (s *SyntheticTunnels) Stats() SyntheticTunnelStats {
+	return s.stats
+}
+
+// Close removes every synthetic tunnel from the hostmap
+func (s *SyntheticTunnels) Close() {
+	for _, peer := range s.peers {
+		s.f.hostMap.DeleteHostInfo(peer.hostinfo)
+		s.f.connectionManager.getAndResetTrafficCheck(peer.hostinfo.localIndexId)
+	}
+	s.peers = nil
+	s.next = 0
+	s.held = nil
+	s.stats.Tunnels = 0
+}
@@ -0,0 +1,137 @@
+//go:build synthetic_tunnels
+// +build synthetic_tunnels
+
+package nebula
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	syntheticTunnelsNode     *Control
+	syntheticTunnelsNodeOnce sync.Once
+)
+
+// getSyntheticTunnelsNode returns a node with a disabled tun that accepts any inbound traffic. It is shared by the tests
+// and stays up, a node with a disabled tun exits the process when stopped.
+func getSyntheticTunnelsNode(t testing.TB) *Control {
+	syntheticTunnelsNodeOnce.Do(func() {
+		syntheticTunnelsNode = newSyntheticTunnelsNode(t)
+	})
+	require.NotNil(t, syntheticTunnelsNode)
+	return syntheticTunnelsNode
+}
+
+func newSyntheticTunnelsNode(t testing.TB) *Control {
+	l := test.NewLogger()
+	ca := newTestCA(t, "ca")
+	key, crt := newTestNodeKey(t)
+
+	c := config.NewC(l)
+	c.Settings = map[interface{}]interface{}{
+		"pki": map[interface{}]interface{}{
+			"ca":   string(ca.pem),
+			"cert": string(ca.sign(crt, 0x7fffffff)),
+			"key":  string(cert.MarshalX25519PrivateKey(key.private)),
+		},
+		"tun":    map[interface{}]interface{}{"disabled": true},
+		"listen": map[interface{}]interface{}{"host": "127.0.0.1", "port": 0},
+		"firewall": map[interface{}]interface{}{
+			"outbound": []interface{}{map[interface{}]interface{}{"proto": "any", "port": "any", "host": "any"}},
+			"inbound":  []interface{}{map[interface{}]interface{}{"proto": "any", "port": "any", "host": "any"}},
+		},
+	}
+
+	control, err := Main(c, false, "synthetic", l, nil)
+	require.NoError(t, err)
+	control.Start()
+	return control
+}
+
+func TestSyntheticTunnels(t *testing.T) {
+	control := getSyntheticTunnelsNode(t)
+
+	_, err := control.NewSyntheticTunnels(SyntheticTunnelOptions{Network: netip.MustParsePrefix("192.168.0.0/24")})
+	assert.Error(t, err, "outside of our vpn network")
+
+	s, err := control.NewSyntheticTunnels(SyntheticTunnelOptions{
+		Network:     netip.MustParsePrefix("10.1.0.0/24"),
+		Port:        80,
+		PayloadSize: 100,
+		Loss:        0.1,
+		Reorder:     0.1,
+		Seed:        1,
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Add(200))
+	assert.Len(t, control.ListHostmapHosts(false), 200)
+
+	s.Send(10000)
+	st := s.Stats()
+	assert.Equal(t, 200, st.Tunnels)
+	assert.EqualValues(t, 10000, st.Generated)
+	assert.Equal(t, st.Generated, st.Received+st.Lost)
+	assert.InDelta(t, 1000, st.Lost, 150)
+	assert.InDelta(t, 900, st.Reordered, 150)
+
+	// Lost and reordered packets are within the replay window, every packet received made it through
+	for _, peer := range s.peers {
+		assert.NotEqual(t, netip.MustParseAddr("10.1.0.1"), peer.hostinfo.vpnIp, "our own vpn ip is skipped")
+		assert.Equal(t, TunnelErrors{}, peer.hostinfo.errCounters.copy())
+		assert.True(t, peer.hostinfo.dataSeen.Load())
+	}
+
+	// The same seed loses the same packets
+	again, err := control.NewSyntheticTunnels(SyntheticTunnelOptions{
+		Network: netip.MustParsePrefix("10.1.1.0/24"), Port: 80, PayloadSize: 100, Loss: 0.1, Reorder: 0.1, Seed: 1,
+	})
+	require.NoError(t, err)
+	require.NoError(t, again.Add(200))
+	again.Send(10000)
+	assert.Equal(t, st, again.Stats())
+
+	// Run paces the packets
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	again.Run(ctx, 1000)
+	// Never ahead of the rate, 200 packets at most
+	assert.Greater(t, again.Stats().Generated, uint64(10000))
+	assert.LessOrEqual(t, again.Stats().Generated, uint64(10200))
+
+	s.Close()
+	again.Close()
+	assert.Empty(t, control.ListHostmapHosts(false))
+}
+
+func BenchmarkSyntheticTunnels(b *testing.B) {
+	control := getSyntheticTunnelsNode(b)
+
+	for _, tunnels := range []int{10, 1000, 10000} {
+		b.Run(fmt.Sprintf("tunnels=%d", tunnels), func(b *testing.B) {
+			s, err := control.NewSyntheticTunnels(SyntheticTunnelOptions{
+				Network:     netip.MustParsePrefix("10.1.0.0/16"),
+				Port:        80,
+				PayloadSize: 1200,
+			})
+			require.NoError(b, err)
+			require.NoError(b, s.Add(tunnels))
+			defer s.Close()
+
+			b.SetBytes(1200)
+			b.ReportAllocs()
+			b.ResetTimer()
+			s.Send(b.N)
+		})
+	}
+}
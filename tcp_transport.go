@@ -0,0 +1,638 @@
+package nebula
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gaissmai/bart"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+)
+
+const (
+	defaultTCPFallbackAfter = 5
+	defaultTCPIdleTimeout   = 5 * time.Minute
+	// defaultTCPMaxConnections bounds the accepted connections, each holds a goroutine and mtu sized buffers
+	defaultTCPMaxConnections    = 256
+	defaultTCPHandshakeTimeout  = 5 * time.Second
+	tcpHandshakeTimeoutInterval = time.Second
+	tcpDialTimeout              = 5 * time.Second
+	tcpWriteTimeout             = 5 * time.Second
+	// tcpFrameHeader is the length prefix of every packet on a tcp connection, it keeps the datagram boundaries
+	tcpFrameHeader = 2
+)
+
+// transportType is the transport the packets of a tunnel were last sent on
+type transportType uint32
+
+const (
+	transportUDP transportType = iota
+	transportTCP
+)
+
+func (t transportType) String() string {
+	if t == transportTCP {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// TCPTransport carries nebula packets over tcp to peers that can not be reached over udp, for networks that block or
+// heavily rate limit udp. Every packet is sent as a frame, a 2 byte big endian length followed by the packet, so the
+// datagram boundaries the rest of nebula relies on are preserved and the noise handshake and encryption are unchanged.
+//
+// A tcp connection is keyed by the underlay address of the peer, every packet to an address with a connection is sent
+// on it instead of udp. We dial the udp address of a peer, on the same port, when a handshake went unanswered for
+// fallback_after attempts or when the address is listed in remotes. Connections we accept are keyed by the address they
+// came from, the tunnel roams to it like it would to any other address and our replies follow. A connection idle for
+// idle_timeout is closed and sends to the address go back to udp.
+//
+// Anyone who can reach the port can connect, so at most max_connections connections are accepted and one that has no
+// tunnel at its address after handshake_timeout, because it never carried a handshake or a packet of an existing tunnel,
+// is closed.
+type TCPTransport struct {
+	listen           bool
+	fallbackAfter    atomic.Int64
+	idleTimeout      atomic.Int64
+	maxConnections   atomic.Int64
+	handshakeTimeout atomic.Int64
+	remotes          atomic.Pointer[bart.Table[struct{}]]
+
+	sync.RWMutex
+	peers map[netip.AddrPort]*tcpPeer
+	// count is the number of peers, sends skip the map while it is 0
+	count atomic.Int64
+	// accepted is the number of peers that connected to us
+	accepted atomic.Int64
+
+	listener *net.TCPListener
+	reader   atomic.Pointer[tcpReader]
+
+	metricDials      metrics.Counter
+	metricDialErrors metrics.Counter
+	metricAccepted   metrics.Counter
+	metricRejected   metrics.Counter
+	metricNoTunnel   metrics.Counter
+	metricClosed     metrics.Counter
+	metricTx         metrics.Counter
+	metricRx         metrics.Counter
+	l                *logrus.Logger
+}
+
+// tcpReader is where packets read from tcp connections are handed to. Every connection reads on its own goroutine
+// with buffers of its own, a lighthouse handler keeps buffers too so each connection gets one from newLhf.
+type tcpReader struct {
+	r      udp.EncReader
+	newLhf func() udp.LightHouseHandlerFunc
+	// remotes returns the underlay address of every tunnel, handshaking ones included
+	remotes func() map[netip.AddrPort]struct{}
+}
+
+type tcpPeer struct {
+	addr   netip.AddrPort
+	dialed bool
+
+	// conn is nil while dialing, pending is the last packet sent to the peer while dialing
+	sync.Mutex
+	conn    net.Conn
+	pending []byte
+
+	lastUsed atomic.Int64
+	closed   atomic.Bool
+	// since is when an accepted connection was accepted, tunnel is set once a tunnel was found at its address
+	since  int64
+	tunnel atomic.Bool
+}
+
+// transportConn is the udp.Conn of a routine when the tcp transport is enabled, packets to an address with a tcp
+// connection are sent on it and everything else goes to the udp socket
+type transportConn struct {
+	udp.Conn
+	t *TCPTransport
+}
+
+// NewTCPTransportFromConfig returns nil unless transport.tcp.enabled is set
+func NewTCPTransportFromConfig(l *logrus.Logger, c *config.C) (*TCPTransport, error) {
+	if !c.GetBool("transport.tcp.enabled", false) {
+		return nil, nil
+	}
+
+	t := &TCPTransport{
+		listen:           c.GetBool("transport.tcp.listen", true),
+		peers:            map[netip.AddrPort]*tcpPeer{},
+		metricDials:      metrics.GetOrRegisterCounter("transport.tcp.dials", nil),
+		metricDialErrors: metrics.GetOrRegisterCounter("transport.tcp.dial_errors", nil),
+		metricAccepted:   metrics.GetOrRegisterCounter("transport.tcp.accepted", nil),
+		metricRejected:   metrics.GetOrRegisterCounter("transport.tcp.rejected", nil),
+		metricNoTunnel:   metrics.GetOrRegisterCounter("transport.tcp.no_tunnel", nil),
+		metricClosed:     metrics.GetOrRegisterCounter("transport.tcp.closed", nil),
+		metricTx:         metrics.GetOrRegisterCounter("transport.tcp.tx.packets", nil),
+		metricRx:         metrics.GetOrRegisterCounter("transport.tcp.rx.packets", nil),
+		l:                l,
+	}
+
+	if err := t.reload(c, true); err != nil {
+		return nil, err
+	}
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := t.reload(c, false); err != nil {
+			l.WithError(err).Error("Failed to reload transport.tcp, keeping the previous config")
+		}
+	})
+
+	return t, nil
+}
+
+func (t *TCPTransport) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("transport.tcp") {
+		return nil
+	}
+
+	if !initial && !c.GetBool("transport.tcp.enabled", false) {
+		t.l.Warn("transport.tcp.enabled can not be changed on reload, restart nebula to apply it")
+	}
+
+	fallbackAfter := c.GetInt("transport.tcp.fallback_after", defaultTCPFallbackAfter)
+	if fallbackAfter < 0 {
+		return fmt.Errorf("transport.tcp.fallback_after can not be negative, got %v", fallbackAfter)
+	}
+
+	idleTimeout := c.GetDuration("transport.tcp.idle_timeout", defaultTCPIdleTimeout)
+	if idleTimeout < time.Second {
+		return fmt.Errorf("transport.tcp.idle_timeout must be at least 1s, got %v", idleTimeout)
+	}
+
+	maxConnections := c.GetInt("transport.tcp.max_connections", defaultTCPMaxConnections)
+	if maxConnections < 1 {
+		return fmt.Errorf("transport.tcp.max_connections must be at least 1, got %v", maxConnections)
+	}
+
+	handshakeTimeout := c.GetDuration("transport.tcp.handshake_timeout", defaultTCPHandshakeTimeout)
+	if handshakeTimeout < time.Second {
+		return fmt.Errorf("transport.tcp.handshake_timeout must be at least 1s, got %v", handshakeTimeout)
+	}
+
+	remotes := new(bart.Table[struct{}])
+	for i, s := range c.GetStringSlice("transport.tcp.remotes", []string{}) {
+		cidr, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, aErr := netip.ParseAddr(s)
+			if aErr != nil {
+				return fmt.Errorf("transport.tcp.remotes entry #%v; %s", i, err)
+			}
+			cidr = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		remotes.Insert(cidr.Masked(), struct{}{})
+	}
+
+	t.fallbackAfter.Store(int64(fallbackAfter))
+	t.idleTimeout.Store(int64(idleTimeout))
+	t.maxConnections.Store(int64(maxConnections))
+	t.handshakeTimeout.Store(int64(handshakeTimeout))
+	t.remotes.Store(remotes)
+
+	if !initial {
+		t.l.WithField("fallbackAfter", fallbackAfter).WithField("idleTimeout", idleTimeout).
+			WithField("maxConnections", maxConnections).WithField("handshakeTimeout", handshakeTimeout).
+			Info("transport.tcp has changed")
+	}
+	return nil
+}
+
+// wrap returns the udp.Conn routine q uses, it is c unless the tcp transport is enabled
+func (t *TCPTransport) wrap(c udp.Conn) udp.Conn {
+	if t == nil {
+		return c
+	}
+	return &transportConn{Conn: c, t: t}
+}
+
+// setInterface hands the packets read from tcp connections to f, it is safe to call on a nil TCPTransport
+func (t *TCPTransport) setInterface(f *Interface) {
+	if t == nil {
+		return
+	}
+
+	t.reader.Store(&tcpReader{
+		r: readOutsidePackets(f),
+		newLhf: func() udp.LightHouseHandlerFunc {
+			return lhHandleRequest(f.lightHouse.NewRequestHandler(), f)
+		},
+		remotes: f.tunnelRemotes,
+	})
+}
+
+// Listen accepts tcp connections on the local address of the udp socket, the tcp port has the same number
+func (t *TCPTransport) Listen(local netip.AddrPort) error {
+	if t == nil || !t.listen {
+		return nil
+	}
+
+	ln, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(local))
+	if err != nil {
+		return err
+	}
+
+	t.listener = ln
+	t.l.WithField("addr", local).Info("Accepting nebula packets over tcp")
+	return nil
+}
+
+// Run accepts tcp connections and closes idle ones, and accepted ones without a tunnel, until ctx is done
+func (t *TCPTransport) Run(ctx context.Context) {
+	if t == nil {
+		return
+	}
+
+	if t.listener != nil {
+		go t.accept()
+	}
+
+	timer := time.NewTimer(time.Duration(t.idleTimeout.Load()) / 4)
+	defer timer.Stop()
+	tunnels := time.NewTicker(tcpHandshakeTimeoutInterval)
+	defer tunnels.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			t.close()
+			return
+		case now := <-timer.C:
+			t.expire(now)
+			timer.Reset(time.Duration(t.idleTimeout.Load()) / 4)
+		case now := <-tunnels.C:
+			t.expireNoTunnel(now)
+		}
+	}
+}
+
+func (t *TCPTransport) accept() {
+	for {
+		conn, err := t.listener.AcceptTCP()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				t.l.WithError(err).Error("Failed to accept a tcp connection, no longer accepting nebula packets over tcp")
+			}
+			return
+		}
+
+		addr := conn.RemoteAddr().(*net.TCPAddr).AddrPort()
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		if t.accepted.Load() >= t.maxConnections.Load() {
+			conn.Close()
+			t.metricRejected.Inc(1)
+			if t.l.Level >= logrus.DebugLevel {
+				t.l.WithField("udpAddr", addr).Debug("Refused a tcp connection, transport.tcp.max_connections reached")
+			}
+			continue
+		}
+		_ = conn.SetNoDelay(true)
+
+		now := time.Now().UnixNano()
+		p := &tcpPeer{addr: addr, conn: conn, since: now}
+		p.lastUsed.Store(now)
+		if !t.add(p) {
+			conn.Close()
+			continue
+		}
+
+		t.metricAccepted.Inc(1)
+		if t.l.Level >= logrus.DebugLevel {
+			t.l.WithField("udpAddr", addr).Debug("Accepted a tcp connection")
+		}
+		go t.read(p)
+	}
+}
+
+// add stores p, it returns false if the address already has a connection
+func (t *TCPTransport) add(p *tcpPeer) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.peers[p.addr]; ok {
+		return false
+	}
+	t.peers[p.addr] = p
+	t.count.Add(1)
+	if !p.dialed {
+		t.accepted.Add(1)
+	}
+	return true
+}
+
+// remove forgets p and closes its connection, later sends to its address use udp
+func (t *TCPTransport) remove(p *tcpPeer, reason string) {
+	if !p.closed.CompareAndSwap(false, true) {
+		return
+	}
+
+	t.Lock()
+	if t.peers[p.addr] == p {
+		delete(t.peers, p.addr)
+		t.count.Add(-1)
+		if !p.dialed {
+			t.accepted.Add(-1)
+		}
+	}
+	t.Unlock()
+
+	p.Lock()
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.pending = nil
+	p.Unlock()
+
+	t.metricClosed.Inc(1)
+	t.l.WithField("udpAddr", p.addr).WithField("dialed", p.dialed).WithField("reason", reason).
+		Info("Closed a tcp connection, sends to the address use udp again")
+}
+
+func (t *TCPTransport) lookup(addr netip.AddrPort) *tcpPeer {
+	if t.count.Load() == 0 {
+		return nil
+	}
+
+	t.RLock()
+	p := t.peers[addr]
+	t.RUnlock()
+	return p
+}
+
+// carries returns true if packets to addr are sent over tcp, because it has a connection or is listed in remotes. It is
+// safe to call on a nil TCPTransport.
+func (t *TCPTransport) carries(addr netip.AddrPort) bool {
+	if t == nil {
+		return false
+	}
+	if t.lookup(addr) != nil {
+		return true
+	}
+	_, ok := t.remotes.Load().Lookup(addr.Addr().Unmap())
+	return ok
+}
+
+// fallback returns true if a handshake that has been tried attempts times should be sent over tcp
+func (t *TCPTransport) fallback(attempts int64) bool {
+	if t == nil {
+		return false
+	}
+	after := t.fallbackAfter.Load()
+	return after > 0 && attempts >= after
+}
+
+// dial connects to addr over tcp in the background unless there is a connection already. Packets sent to addr while
+// dialing are held, the latest is sent once connected.
+func (t *TCPTransport) dial(addr netip.AddrPort) {
+	if t == nil || !addr.IsValid() || t.lookup(addr) != nil {
+		return
+	}
+
+	p := &tcpPeer{addr: addr, dialed: true}
+	p.lastUsed.Store(time.Now().UnixNano())
+	if !t.add(p) {
+		return
+	}
+
+	t.metricDials.Inc(1)
+	go func() {
+		conn, err := net.DialTimeout("tcp", addr.String(), tcpDialTimeout)
+		if err != nil {
+			t.metricDialErrors.Inc(1)
+			if t.l.Level >= logrus.DebugLevel {
+				t.l.WithField("udpAddr", addr).WithError(err).Debug("Failed to dial over tcp")
+			}
+			// Quietly forget the attempt, the next handshake retry dials again
+			p.closed.Store(true)
+			t.Lock()
+			if t.peers[addr] == p {
+				delete(t.peers, addr)
+				t.count.Add(-1)
+			}
+			t.Unlock()
+			return
+		}
+		_ = conn.(*net.TCPConn).SetNoDelay(true)
+
+		p.Lock()
+		if p.closed.Load() {
+			p.Unlock()
+			conn.Close()
+			return
+		}
+		p.conn = conn
+		pending := p.pending
+		p.pending = nil
+		p.Unlock()
+
+		t.l.WithField("udpAddr", addr).Info("Connected over tcp, sends to the address no longer use udp")
+		if pending != nil {
+			_ = t.write(p, pending)
+		}
+		t.read(p)
+	}()
+}
+
+// writeTo sends b to addr over tcp, it returns false if addr has no tcp connection and is not listed in remotes
+func (t *TCPTransport) writeTo(b []byte, addr netip.AddrPort) (bool, error) {
+	p := t.lookup(addr)
+	if p == nil {
+		if _, ok := t.remotes.Load().Lookup(addr.Addr().Unmap()); !ok {
+			return false, nil
+		}
+
+		t.dial(addr)
+		if p = t.lookup(addr); p == nil {
+			return false, nil
+		}
+	}
+
+	return true, t.write(p, b)
+}
+
+func (t *TCPTransport) write(p *tcpPeer, b []byte) error {
+	if len(b) > 0xffff {
+		return fmt.Errorf("packet of %d bytes is too large for tcp", len(b))
+	}
+
+	p.Lock()
+	if p.conn == nil {
+		// Still dialing, hold on to the latest packet
+		p.pending = append(p.pending[:0], b...)
+		p.Unlock()
+		return nil
+	}
+
+	var hdr [tcpFrameHeader]byte
+	binary.BigEndian.PutUint16(hdr[:], uint16(len(b)))
+	_ = p.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	bufs := net.Buffers{hdr[:], b}
+	_, err := bufs.WriteTo(p.conn)
+	p.Unlock()
+
+	if err != nil {
+		t.remove(p, err.Error())
+		return &net.OpError{Op: "write", Net: "tcp", Err: err}
+	}
+
+	p.lastUsed.Store(time.Now().UnixNano())
+	t.metricTx.Inc(1)
+	return nil
+}
+
+// read hands every packet on the connection of p to the packet reader until the connection is closed. Replies go out
+// on routine 0.
+func (t *TCPTransport) read(p *tcpPeer) {
+	br := bufio.NewReaderSize(p.conn, udp.MTU+tcpFrameHeader)
+	packet := make([]byte, udp.MTU)
+	out := make([]byte, mtu)
+	h := &header.H{}
+	fwPacket := &firewall.Packet{}
+	nb := make([]byte, 12, 12)
+	var hdr [tcpFrameHeader]byte
+	var lhf udp.LightHouseHandlerFunc
+
+	for {
+		_, err := io.ReadFull(br, hdr[:])
+		if err == nil {
+			n := int(binary.BigEndian.Uint16(hdr[:]))
+			if n > len(packet) {
+				err = fmt.Errorf("frame of %d bytes is larger than the mtu", n)
+			} else if _, err = io.ReadFull(br, packet[:n]); err == nil {
+				p.lastUsed.Store(time.Now().UnixNano())
+				t.metricRx.Inc(1)
+				if r := t.reader.Load(); r != nil {
+					if lhf == nil && r.newLhf != nil {
+						lhf = r.newLhf()
+					}
+					r.r(p.addr, out, packet[:n], 0, h, fwPacket, lhf, nb, 0, nil)
+				}
+				continue
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			err = errors.New("closed by the peer")
+		}
+		t.remove(p, err.Error())
+		return
+	}
+}
+
+// expire closes the connections that have been idle for idle_timeout
+func (t *TCPTransport) expire(now time.Time) {
+	idle := t.idleTimeout.Load()
+
+	var expired []*tcpPeer
+	t.RLock()
+	for _, p := range t.peers {
+		if now.UnixNano()-p.lastUsed.Load() >= idle {
+			expired = append(expired, p)
+		}
+	}
+	t.RUnlock()
+
+	for _, p := range expired {
+		t.remove(p, "idle")
+	}
+}
+
+// expireNoTunnel closes the accepted connections that have been open for handshake_timeout without a tunnel at their
+// address. A connection that carried a handshake, or a packet that roamed an existing tunnel to it, has one.
+func (t *TCPTransport) expireNoTunnel(now time.Time) {
+	timeout := t.handshakeTimeout.Load()
+
+	var check []*tcpPeer
+	t.RLock()
+	for _, p := range t.peers {
+		if !p.dialed && !p.tunnel.Load() && now.UnixNano()-p.since >= timeout {
+			check = append(check, p)
+		}
+	}
+	t.RUnlock()
+
+	if len(check) == 0 {
+		return
+	}
+
+	var remotes map[netip.AddrPort]struct{}
+	if r := t.reader.Load(); r != nil && r.remotes != nil {
+		remotes = r.remotes()
+	}
+
+	for _, p := range check {
+		if _, ok := remotes[p.addr]; ok {
+			p.tunnel.Store(true)
+			continue
+		}
+		t.metricNoTunnel.Inc(1)
+		t.remove(p, "no tunnel after handshake_timeout")
+	}
+}
+
+func (t *TCPTransport) close() {
+	if t.listener != nil {
+		t.listener.Close()
+	}
+
+	t.RLock()
+	peers := make([]*tcpPeer, 0, len(t.peers))
+	for _, p := range t.peers {
+		peers = append(peers, p)
+	}
+	t.RUnlock()
+
+	for _, p := range peers {
+		t.remove(p, "shutting down")
+	}
+}
+
+// WriteTo sends b over tcp if addr has a tcp connection, over udp otherwise
+func (c *transportConn) WriteTo(b []byte, addr netip.AddrPort) error {
+	if sent, err := c.t.writeTo(b, addr); sent {
+		return err
+	}
+	return c.Conn.WriteTo(b, addr)
+}
+
+// tunnelRemotes returns the underlay address of every tunnel, handshaking ones included
+func (f *Interface) tunnelRemotes() map[netip.AddrPort]struct{} {
+	remotes := map[netip.AddrPort]struct{}{}
+	add := func(h *HostInfo) {
+		if h.remote.IsValid() {
+			remotes[h.remote] = struct{}{}
+		}
+	}
+	f.hostMap.ForEachIndex(add)
+	f.handshakeManager.ForEachIndex(add)
+	return remotes
+}
+
+// transportName returns the transport the last packet sent to the peer went over, empty if there is no direct remote
+func (i *HostInfo) transportName() string {
+	if !i.remote.IsValid() {
+		return ""
+	}
+	return transportType(i.transport.Load()).String()
+}
+
+// setTransport records the transport a packet to the peer was sent on
+func (i *HostInfo) setTransport(t transportType) {
+	if transportType(i.transport.Load()) != t {
+		i.transport.Store(uint32(t))
+	}
+}
@@ -0,0 +1,214 @@
+package nebula
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tcpTestPacket struct {
+	addr netip.AddrPort
+	b    string
+}
+
+// newTestTCPTransport returns a transport that delivers every packet it reads to the returned channel
+func newTestTCPTransport(t *testing.T, settings map[interface{}]interface{}) (*TCPTransport, chan tcpTestPacket) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	settings["enabled"] = true
+	c.Settings["transport"] = map[interface{}]interface{}{"tcp": settings}
+
+	tt, err := NewTCPTransportFromConfig(l, c)
+	require.NoError(t, err)
+
+	packets := make(chan tcpTestPacket, 10)
+	tt.reader.Store(&tcpReader{r: func(addr netip.AddrPort, _, packet []byte, _ uint8, _ *header.H, _ *firewall.Packet, _ udp.LightHouseHandlerFunc, _ []byte, _ int, _ firewall.ConntrackCache) {
+		packets <- tcpTestPacket{addr: addr, b: string(packet)}
+	}})
+	return tt, packets
+}
+
+func readTCPTestPacket(t *testing.T, packets chan tcpTestPacket) tcpTestPacket {
+	select {
+	case p := <-packets:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet arrived over tcp")
+		return tcpTestPacket{}
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, serverPackets := newTestTCPTransport(t, map[interface{}]interface{}{})
+	require.NoError(t, server.Listen(netip.MustParseAddrPort("127.0.0.1:0")))
+	go server.Run(ctx)
+	serverAddr := server.listener.Addr().(interface{ AddrPort() netip.AddrPort }).AddrPort()
+	serverConn := server.wrap(&udp.NoopConn{})
+
+	client, clientPackets := newTestTCPTransport(t, map[interface{}]interface{}{"listen": false, "fallback_after": 3})
+	clientConn := client.wrap(&udp.NoopConn{})
+
+	t.Log("Without a connection packets go to udp")
+	assert.False(t, client.carries(serverAddr))
+	require.NoError(t, clientConn.WriteTo([]byte("udp"), serverAddr))
+	assert.Empty(t, serverPackets)
+
+	t.Log("The fallback starts after fallback_after handshake attempts")
+	assert.False(t, client.fallback(2))
+	assert.True(t, client.fallback(3))
+	var nilTransport *TCPTransport
+	assert.False(t, nilTransport.fallback(10))
+	assert.False(t, nilTransport.carries(serverAddr))
+
+	t.Log("A packet sent while dialing is delivered once connected")
+	client.dial(serverAddr)
+	assert.True(t, client.carries(serverAddr))
+	require.NoError(t, clientConn.WriteTo([]byte("hello"), serverAddr))
+	p := readTCPTestPacket(t, serverPackets)
+	assert.Equal(t, "hello", p.b)
+	clientAddr := p.addr
+
+	t.Log("Datagram boundaries are kept")
+	big := make([]byte, 9000)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	require.NoError(t, clientConn.WriteTo([]byte("a"), serverAddr))
+	require.NoError(t, clientConn.WriteTo(big, serverAddr))
+	require.NoError(t, clientConn.WriteTo([]byte("b"), serverAddr))
+	assert.Equal(t, "a", readTCPTestPacket(t, serverPackets).b)
+	assert.Equal(t, string(big), readTCPTestPacket(t, serverPackets).b)
+	assert.Equal(t, "b", readTCPTestPacket(t, serverPackets).b)
+
+	t.Log("Replies to the address a connection came from go back on it")
+	assert.True(t, server.carries(clientAddr))
+	require.NoError(t, serverConn.WriteTo([]byte("reply"), clientAddr))
+	p = readTCPTestPacket(t, clientPackets)
+	assert.Equal(t, tcpTestPacket{addr: serverAddr, b: "reply"}, p)
+
+	t.Log("Idle connections are closed on both ends and sends go back to udp")
+	client.expire(time.Now().Add(defaultTCPIdleTimeout))
+	assert.False(t, client.carries(serverAddr))
+	assert.Eventually(t, func() bool { return !server.carries(clientAddr) }, 5*time.Second, 10*time.Millisecond)
+
+	t.Log("Addresses in remotes are dialed on the first send")
+	remote, _ := newTestTCPTransport(t, map[interface{}]interface{}{"listen": false, "remotes": []interface{}{"127.0.0.0/8"}})
+	remoteConn := remote.wrap(&udp.NoopConn{})
+	assert.True(t, remote.carries(serverAddr))
+	require.NoError(t, remoteConn.WriteTo([]byte("remotes"), serverAddr))
+	assert.Equal(t, "remotes", readTCPTestPacket(t, serverPackets).b)
+	remote.close()
+
+	t.Log("A failed dial is forgotten")
+	down, _ := newTestTCPTransport(t, map[interface{}]interface{}{"listen": false})
+	cancel()
+	assert.Eventually(t, func() bool { return server.count.Load() == 0 }, 5*time.Second, 10*time.Millisecond)
+	down.dial(serverAddr)
+	assert.Eventually(t, func() bool { return !down.carries(serverAddr) }, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestTCPTransport_accepted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, serverPackets := newTestTCPTransport(t, map[interface{}]interface{}{"max_connections": 2})
+	var lighthouseHandlers atomic.Int32
+	var tunnelAt atomic.Pointer[netip.AddrPort]
+	tunnelAt.Store(&netip.AddrPort{})
+	r := server.reader.Load()
+	server.reader.Store(&tcpReader{
+		r:       r.r,
+		newLhf:  func() udp.LightHouseHandlerFunc { lighthouseHandlers.Add(1); return nil },
+		remotes: func() map[netip.AddrPort]struct{} { return map[netip.AddrPort]struct{}{*tunnelAt.Load(): {}} },
+	})
+	require.NoError(t, server.Listen(netip.MustParseAddrPort("127.0.0.1:0")))
+	go server.Run(ctx)
+	serverAddr := server.listener.Addr().(interface{ AddrPort() netip.AddrPort }).AddrPort()
+
+	connect := func() netip.AddrPort {
+		client, _ := newTestTCPTransport(t, map[interface{}]interface{}{"listen": false})
+		client.dial(serverAddr)
+		require.NoError(t, client.wrap(&udp.NoopConn{}).WriteTo([]byte("hello"), serverAddr))
+		return readTCPTestPacket(t, serverPackets).addr
+	}
+
+	a, b := connect(), connect()
+	assert.EqualValues(t, 2, lighthouseHandlers.Load(), "every connection has a lighthouse handler of its own")
+
+	t.Log("Connections past max_connections are refused")
+	rejected := server.metricRejected.Count()
+	conn, err := net.Dial("tcp", serverAddr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, rejected+1, server.metricRejected.Count())
+	assert.EqualValues(t, 2, server.accepted.Load())
+
+	t.Log("A connection without a tunnel at its address is closed after handshake_timeout")
+	tunnelAt.Store(&a)
+	server.expireNoTunnel(time.Now())
+	assert.True(t, server.carries(a))
+	assert.True(t, server.carries(b), "not yet")
+	server.expireNoTunnel(time.Now().Add(defaultTCPHandshakeTimeout))
+	assert.True(t, server.carries(a))
+	assert.False(t, server.carries(b))
+	assert.EqualValues(t, 1, server.accepted.Load())
+
+	t.Log("Once a tunnel was found the connection stays")
+	tunnelAt.Store(&netip.AddrPort{})
+	server.expireNoTunnel(time.Now().Add(time.Hour))
+	assert.True(t, server.carries(a))
+}
+
+func TestNewTCPTransportFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	tt, err := NewTCPTransportFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Nil(t, tt)
+	conn := &udp.NoopConn{}
+	assert.Same(t, conn, tt.wrap(conn))
+
+	c.Settings["transport"] = map[interface{}]interface{}{"tcp": map[interface{}]interface{}{"enabled": true}}
+	tt, err = NewTCPTransportFromConfig(l, c)
+	require.NoError(t, err)
+	assert.True(t, tt.listen)
+	assert.Equal(t, int64(defaultTCPFallbackAfter), tt.fallbackAfter.Load())
+	assert.Equal(t, int64(defaultTCPIdleTimeout), tt.idleTimeout.Load())
+	assert.Equal(t, int64(defaultTCPMaxConnections), tt.maxConnections.Load())
+	assert.Equal(t, int64(defaultTCPHandshakeTimeout), tt.handshakeTimeout.Load())
+
+	require.NoError(t, c.ReloadConfigString("transport:\n  tcp:\n    enabled: true\n    fallback_after: 0\n    idle_timeout: 1m\n"))
+	assert.False(t, tt.fallback(100))
+	assert.Equal(t, int64(time.Minute), tt.idleTimeout.Load())
+
+	c.Settings["transport"] = map[interface{}]interface{}{"tcp": map[interface{}]interface{}{"enabled": true, "remotes": []interface{}{"nope"}}}
+	_, err = NewTCPTransportFromConfig(l, c)
+	assert.EqualError(t, err, `transport.tcp.remotes entry #0; netip.ParsePrefix("nope"): no '/'`)
+
+	c.Settings["transport"] = map[interface{}]interface{}{"tcp": map[interface{}]interface{}{"enabled": true, "max_connections": 0}}
+	_, err = NewTCPTransportFromConfig(l, c)
+	assert.EqualError(t, err, "transport.tcp.max_connections must be at least 1, got 0")
+
+	c.Settings["transport"] = map[interface{}]interface{}{"tcp": map[interface{}]interface{}{"enabled": true, "handshake_timeout": "10ms"}}
+	_, err = NewTCPTransportFromConfig(l, c)
+	assert.EqualError(t, err, "transport.tcp.handshake_timeout must be at least 1s, got 10ms")
+}
@@ -0,0 +1,460 @@
+package nebula
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	defaultTracingEndpoint      = "http://127.0.0.1:4318/v1/traces"
+	defaultTracingServiceName   = "nebula"
+	defaultTracingFlushInterval = 5 * time.Second
+	defaultTracingQueueLen      = 2048
+	defaultTracingTimeout       = 10 * time.Second
+
+	// tracingBatchLen is the most spans sent in a single export
+	tracingBatchLen = 512
+)
+
+var (
+	errHandshakeTimedOut   = errors.New("handshake timed out")
+	errHandshakeAbandoned  = errors.New("handshake abandoned")
+	errHandshakeIncomplete = errors.New("handshake not answered")
+	errRelayNotAccepted    = errors.New("relay not accepted")
+)
+
+// OTLP span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// Tracer exports spans for handshakes and relay setup to an OpenTelemetry collector with OTLP over http, encoded as
+// json. Spans are only made for control plane events, never per packet, and a disabled Tracer makes none at all.
+// Finished spans are queued and exported in batches every flush_interval, a span that does not fit in the queue is
+// dropped. The trace is carried to the peer in the handshake and relay control messages as a W3C traceparent so the
+// spans of every node involved in setting up a tunnel end up in the same trace.
+type Tracer struct {
+	config atomic.Pointer[tracerConfig]
+	spans  chan *span
+	client *http.Client
+
+	vpnIp   string
+	version string
+
+	metricExported metrics.Counter
+	metricDropped  metrics.Counter
+	metricFailed   metrics.Counter
+	l              *logrus.Logger
+}
+
+type tracerConfig struct {
+	endpoint      string
+	headers       map[string]string
+	serviceName   string
+	flushInterval time.Duration
+}
+
+// span is a single unit of work in a trace. All methods are safe to call on a nil span, which is what a disabled
+// Tracer returns.
+type span struct {
+	tracer  *Tracer
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	attrs   []spanAttr
+
+	sync.Mutex
+	end    time.Time
+	events []spanEvent
+	err    string
+	ended  bool
+}
+
+type spanAttr struct {
+	key   string
+	value string
+}
+
+type spanEvent struct {
+	at    time.Time
+	name  string
+	attrs []spanAttr
+}
+
+// attr builds a span attribute, the value is formatted with fmt
+func attr(key string, value interface{}) spanAttr {
+	return spanAttr{key: key, value: fmt.Sprint(value)}
+}
+
+func NewTracerFromConfig(l *logrus.Logger, c *config.C, vpnIp string, version string) (*Tracer, error) {
+	t := &Tracer{
+		spans:          make(chan *span, defaultTracingQueueLen),
+		client:         &http.Client{Timeout: defaultTracingTimeout},
+		vpnIp:          vpnIp,
+		version:        version,
+		metricExported: metrics.GetOrRegisterCounter("tracing.exported", nil),
+		metricDropped:  metrics.GetOrRegisterCounter("tracing.dropped", nil),
+		metricFailed:   metrics.GetOrRegisterCounter("tracing.failed", nil),
+		l:              l,
+	}
+
+	if err := t.reload(c, true); err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := t.reload(c, false); err != nil {
+			l.WithError(err).Error("Failed to reload tracing, keeping the previous config")
+		}
+	})
+
+	return t, nil
+}
+
+func (t *Tracer) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("tracing") {
+		return nil
+	}
+
+	if !c.GetBool("tracing.enabled", false) {
+		if !initial && t.config.Load() != nil {
+			t.l.Info("Tracing disabled")
+		}
+		t.config.Store(nil)
+		return nil
+	}
+
+	tc := &tracerConfig{
+		endpoint:      c.GetString("tracing.endpoint", defaultTracingEndpoint),
+		headers:       map[string]string{},
+		serviceName:   c.GetString("tracing.service_name", defaultTracingServiceName),
+		flushInterval: c.GetDuration("tracing.flush_interval", defaultTracingFlushInterval),
+	}
+
+	u, err := url.Parse(tc.endpoint)
+	if err != nil {
+		return fmt.Errorf("tracing.endpoint is not a url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("tracing.endpoint must be an http or https url, got %q", tc.endpoint)
+	}
+
+	if tc.flushInterval <= 0 {
+		return errors.New("tracing.flush_interval must be positive")
+	}
+
+	for k, v := range c.GetMap("tracing.headers", map[interface{}]interface{}{}) {
+		tc.headers[fmt.Sprint(k)] = fmt.Sprint(v)
+	}
+
+	t.config.Store(tc)
+	t.l.WithField("endpoint", tc.endpoint).
+		WithField("serviceName", tc.serviceName).
+		WithField("flushInterval", tc.flushInterval).
+		Info("Tracing enabled")
+	return nil
+}
+
+// start begins a span, as a child of the span in the W3C traceparent if it is valid and in a new trace otherwise.
+// Returns nil if tracing is disabled.
+func (t *Tracer) start(name string, kind int, traceParent string, attrs ...spanAttr) *span {
+	if t == nil || t.config.Load() == nil {
+		return nil
+	}
+
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: attrs}
+	if traceID, parent, ok := parseTraceParent(traceParent); ok {
+		s.traceID = traceID
+		s.parent = parent
+	} else if _, err := rand.Read(s.traceID[:]); err != nil {
+		return nil
+	}
+
+	if _, err := rand.Read(s.id[:]); err != nil {
+		return nil
+	}
+	return s
+}
+
+// parseTraceParent reads the trace and parent span ids from a W3C traceparent, version 00 only
+func parseTraceParent(tp string) ([16]byte, [8]byte, bool) {
+	var traceID [16]byte
+	var parent [8]byte
+	if len(tp) != 55 || tp[:3] != "00-" || tp[35] != '-' || tp[52] != '-' {
+		return traceID, parent, false
+	}
+
+	if _, err := hex.Decode(traceID[:], []byte(tp[3:35])); err != nil {
+		return traceID, parent, false
+	}
+	if _, err := hex.Decode(parent[:], []byte(tp[36:52])); err != nil {
+		return traceID, parent, false
+	}
+	if traceID == [16]byte{} || parent == [8]byte{} {
+		return traceID, parent, false
+	}
+	return traceID, parent, true
+}
+
+// traceParent returns the W3C traceparent that makes a span on another node a child of s, empty if s is nil
+func (s *span) traceParent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.id[:]) + "-01"
+}
+
+// event records something that happened during s
+func (s *span) event(name string, attrs ...spanAttr) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	if !s.ended {
+		s.events = append(s.events, spanEvent{at: time.Now(), name: name, attrs: attrs})
+	}
+	s.Unlock()
+}
+
+// finish ends s successfully, or with an error status if err is not nil, and queues it for export. Only the first call
+// has any effect.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.Unlock()
+
+	select {
+	case s.tracer.spans <- s:
+	default:
+		s.tracer.metricDropped.Inc(1)
+	}
+}
+
+// Run exports queued spans every flush_interval, or as soon as a full batch is queued, until ctx is done
+func (t *Tracer) Run(ctx context.Context) {
+	if t == nil {
+		return
+	}
+
+	interval := defaultTracingFlushInterval
+	if tc := t.config.Load(); tc != nil {
+		interval = tc.flushInterval
+	}
+	clockSource := time.NewTicker(interval)
+	defer clockSource.Stop()
+
+	batch := make([]*span, 0, tracingBatchLen)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < tracingBatchLen {
+				continue
+			}
+
+		case <-clockSource.C:
+			if tc := t.config.Load(); tc != nil && tc.flushInterval != interval {
+				interval = tc.flushInterval
+				clockSource.Reset(interval)
+			}
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		t.export(ctx, batch)
+		batch = batch[:0]
+	}
+}
+
+// export sends batch to the collector, the spans are lost if it fails
+func (t *Tracer) export(ctx context.Context, batch []*span) {
+	tc := t.config.Load()
+	if tc == nil {
+		// Tracing was disabled since these spans were finished
+		return
+	}
+
+	body, err := json.Marshal(t.encode(tc, batch))
+	if err != nil {
+		t.metricFailed.Inc(int64(len(batch)))
+		t.l.WithError(err).Error("Failed to encode spans")
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tc.endpoint, bytes.NewReader(body))
+	if err != nil {
+		t.metricFailed.Inc(int64(len(batch)))
+		t.l.WithError(err).Error("Failed to build the span export request")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range tc.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("collector returned %s", resp.Status)
+		}
+	}
+	if err != nil {
+		t.metricFailed.Inc(int64(len(batch)))
+		t.l.WithError(err).WithField("endpoint", tc.endpoint).WithField("spans", len(batch)).
+			Warn("Failed to export spans")
+		return
+	}
+
+	t.metricExported.Inc(int64(len(batch)))
+}
+
+// The OTLP json encoding, see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr  `json:"attributes,omitempty"`
+	Events            []otlpEvent `json:"events,omitempty"`
+	Status            otlpStatus  `json:"status"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string     `json:"timeUnixNano"`
+	Name         string     `json:"name"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+}
+
+// otlpStatus codes are 1 for ok and 2 for error
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpAttrs(attrs []spanAttr) []otlpAttr {
+	if len(attrs) == 0 {
+		return nil
+	}
+	out := make([]otlpAttr, len(attrs))
+	for i, a := range attrs {
+		out[i] = otlpAttr{Key: a.key, Value: otlpValue{StringValue: a.value}}
+	}
+	return out
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (t *Tracer) encode(tc *tracerConfig, batch []*span) otlpTraces {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		s.Lock()
+		os := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.id[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: otlpTime(s.start),
+			EndTimeUnixNano:   otlpTime(s.end),
+			Attributes:        otlpAttrs(s.attrs),
+			Status:            otlpStatus{Code: 1},
+		}
+		if s.parent != [8]byte{} {
+			os.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != "" {
+			os.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		for _, e := range s.events {
+			os.Events = append(os.Events, otlpEvent{TimeUnixNano: otlpTime(e.at), Name: e.name, Attributes: otlpAttrs(e.attrs)})
+		}
+		s.Unlock()
+		spans[i] = os
+	}
+
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttrs([]spanAttr{
+			attr("service.name", tc.serviceName),
+			attr("service.version", t.version),
+			attr("nebula.vpn_ip", t.vpnIp),
+		})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/slackhq/nebula", Version: t.version},
+			Spans: spans,
+		}},
+	}}}
+}
@@ -0,0 +1,158 @@
+package nebula
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracer(t *testing.T) {
+	exports := make(chan otlpTraces, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-Api-Key"))
+		var traces otlpTraces
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&traces))
+		exports <- traces
+	}))
+	defer srv.Close()
+
+	l := test.NewLogger()
+	c := config.NewC(l)
+	tr, err := NewTracerFromConfig(l, c, "10.1.0.1", "1.2.3")
+	require.NoError(t, err)
+
+	t.Log("A disabled tracer makes no spans")
+	var nilSpan *span
+	assert.Nil(t, tr.start("handshake", spanKindClient, ""))
+	assert.Empty(t, nilSpan.traceParent())
+	nilSpan.event("nothing")
+	nilSpan.finish(nil)
+
+	var nilTracer *Tracer
+	assert.Nil(t, nilTracer.start("handshake", spanKindClient, ""))
+
+	require.NoError(t, c.ReloadConfigString("tracing:\n  enabled: true\n  endpoint: "+srv.URL+"\n  flush_interval: 10ms\n  headers:\n    x-api-key: secret\n"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tr.Run(ctx)
+
+	t.Log("A span started from a traceparent joins its trace")
+	parent := tr.start("handshake", spanKindClient, "", attr("nebula.peer_vpn_ip", "10.1.0.2"))
+	require.NotNil(t, parent)
+	child := tr.start("handshake.respond", spanKindServer, parent.traceParent())
+	child.event("stage 1 received")
+	child.finish(errHandshakeIncomplete)
+	child.finish(nil)
+	parent.event("stage 1 sent", attr("attempt", 1))
+	parent.finish(nil)
+
+	var spans []otlpSpan
+	for len(spans) < 2 {
+		select {
+		case traces := <-exports:
+			require.Len(t, traces.ResourceSpans, 1)
+			rs := traces.ResourceSpans[0]
+			assert.Equal(t, otlpAttrs([]spanAttr{
+				attr("service.name", "nebula"),
+				attr("service.version", "1.2.3"),
+				attr("nebula.vpn_ip", "10.1.0.1"),
+			}), rs.Resource.Attributes)
+			require.Len(t, rs.ScopeSpans, 1)
+			spans = append(spans, rs.ScopeSpans[0].Spans...)
+		case <-time.After(5 * time.Second):
+			t.Fatal("spans were not exported")
+		}
+	}
+	require.Len(t, spans, 2, "a span is only exported once")
+
+	c0, p0 := spans[0], spans[1]
+	assert.Equal(t, "handshake.respond", c0.Name)
+	assert.Equal(t, spanKindServer, c0.Kind)
+	assert.Equal(t, p0.TraceID, c0.TraceID)
+	assert.Equal(t, p0.SpanID, c0.ParentSpanID)
+	assert.Equal(t, otlpStatus{Code: 2, Message: "handshake not answered"}, c0.Status)
+	require.Len(t, c0.Events, 1)
+	assert.Equal(t, "stage 1 received", c0.Events[0].Name)
+
+	assert.Equal(t, "handshake", p0.Name)
+	assert.Empty(t, p0.ParentSpanID)
+	assert.Equal(t, otlpStatus{Code: 1}, p0.Status)
+	assert.Equal(t, otlpAttrs([]spanAttr{attr("nebula.peer_vpn_ip", "10.1.0.2")}), p0.Attributes)
+	require.Len(t, p0.Events, 1)
+	assert.Equal(t, otlpAttrs([]spanAttr{attr("attempt", 1)}), p0.Events[0].Attributes)
+	assert.NotEqual(t, "0", p0.EndTimeUnixNano)
+
+	t.Log("Events after the end are ignored")
+	parent.event("late")
+	assert.Len(t, parent.events, 1)
+
+	t.Log("Disabling stops new spans")
+	require.NoError(t, c.ReloadConfigString("tracing:\n  enabled: false\n"))
+	assert.Nil(t, tr.start("handshake", spanKindClient, ""))
+}
+
+func TestTracer_reload(t *testing.T) {
+	l := test.NewLogger()
+	for _, tc := range []struct {
+		config string
+		err    string
+	}{
+		{"tracing:\n  enabled: true\n  endpoint: udp://127.0.0.1:4318\n", `tracing.endpoint must be an http or https url, got "udp://127.0.0.1:4318"`},
+		{"tracing:\n  enabled: true\n  flush_interval: 0s\n", "tracing.flush_interval must be positive"},
+	} {
+		c := config.NewC(l)
+		require.NoError(t, c.LoadString(tc.config))
+		_, err := NewTracerFromConfig(l, c, "10.1.0.1", "")
+		assert.EqualError(t, err, tc.err)
+	}
+}
+
+func TestParseTraceParent(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["tracing"] = map[interface{}]interface{}{"enabled": true}
+	tr, err := NewTracerFromConfig(l, c, "10.1.0.1", "")
+	require.NoError(t, err)
+
+	s := tr.start("handshake", spanKindClient, "")
+	traceID, parent, ok := parseTraceParent(s.traceParent())
+	assert.True(t, ok)
+	assert.Equal(t, s.traceID, traceID)
+	assert.Equal(t, s.id, parent)
+
+	for _, tp := range []string{
+		"",
+		"nope",
+		"01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c_b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319z-b7ad6b7169203331-01",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+	} {
+		_, _, ok := parseTraceParent(tp)
+		assert.False(t, ok, tp)
+	}
+
+	t.Log("A bad traceparent starts a new trace")
+	s = tr.start("handshake.respond", spanKindServer, "nope")
+	require.NotNil(t, s)
+	assert.NotEqual(t, [16]byte{}, s.traceID)
+	assert.Equal(t, [8]byte{}, s.parent)
+
+	t.Log("A full queue drops the span")
+	tr.spans = make(chan *span)
+	before := tr.metricDropped.Count()
+	s.finish(errors.New("boom"))
+	assert.Equal(t, before+1, tr.metricDropped.Count())
+}
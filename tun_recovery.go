@@ -0,0 +1,231 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	defaultTunRecoveryFailures = 50
+	defaultTunRecoveryInterval = 10 * time.Second
+)
+
+// TunRecovery notices when the tun device stops taking packets, for example when it was set down by another process,
+// instead of logging every failed write while the node silently drops everything it receives. Once tun.recovery.failures
+// writes failed in a row the tun is down: the health endpoint reports it, handshakes from peers we do not already have a
+// tunnel with are refused, and with tun.recovery.reactivate the device is activated again every interval. The tun is up
+// again as soon as a write succeeds.
+type TunRecovery struct {
+	failures   atomic.Int64
+	reactivate atomic.Bool
+	interval   atomic.Int64
+
+	// streak is the number of writes that failed in a row
+	streak atomic.Int64
+	down   atomic.Bool
+	// since is the unix nano time the tun went down
+	since atomic.Int64
+
+	health *HealthCheck
+
+	metricWriteErrors metrics.Counter
+	metricDown        metrics.Counter
+	metricRecovered   metrics.Counter
+	metricRefused     metrics.Counter
+	l                 *logrus.Logger
+}
+
+// TunRecoveryStatus is reported on the control socket
+type TunRecoveryStatus struct {
+	Down  bool      `json:"down"`
+	Since time.Time `json:"since"`
+	// Streak is the number of tun writes that failed in a row
+	Streak      int64 `json:"streak"`
+	WriteErrors int64 `json:"writeErrors"`
+	Recoveries  int64 `json:"recoveries"`
+}
+
+func NewTunRecoveryFromConfig(l *logrus.Logger, c *config.C, health *HealthCheck) *TunRecovery {
+	tr := &TunRecovery{
+		health:            health,
+		metricWriteErrors: metrics.GetOrRegisterCounter("tun.write_errors", nil),
+		metricDown:        metrics.GetOrRegisterCounter("tun.down", nil),
+		metricRecovered:   metrics.GetOrRegisterCounter("tun.recovered", nil),
+		metricRefused:     metrics.GetOrRegisterCounter("tun.refused_handshakes", nil),
+		l:                 l,
+	}
+
+	tr.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		tr.reload(c, false)
+	})
+
+	return tr
+}
+
+func (tr *TunRecovery) reload(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("tun.recovery") {
+		return
+	}
+
+	failures := c.GetInt("tun.recovery.failures", defaultTunRecoveryFailures)
+	if failures < 0 {
+		tr.l.WithField("failures", failures).Warn("tun.recovery.failures can not be negative, using the default")
+		failures = defaultTunRecoveryFailures
+	}
+
+	interval := c.GetDuration("tun.recovery.interval", defaultTunRecoveryInterval)
+	if interval < time.Second {
+		tr.l.WithField("interval", interval).Warn("tun.recovery.interval must be at least 1s, using the default")
+		interval = defaultTunRecoveryInterval
+	}
+
+	tr.failures.Store(int64(failures))
+	tr.interval.Store(int64(interval))
+	tr.reactivate.Store(c.GetBool("tun.recovery.reactivate", false))
+
+	if failures == 0 && tr.down.Load() {
+		tr.up("tun.recovery is disabled")
+	}
+
+	if !initial {
+		tr.l.WithField("failures", failures).
+			WithField("interval", interval).
+			WithField("reactivate", tr.reactivate.Load()).
+			Info("tun.recovery has changed")
+	}
+}
+
+// result records the outcome of a tun write, it returns true if a failure should be logged. Failures are only logged
+// until the tun is down, the transition itself is logged once. It is safe to call on a nil TunRecovery.
+func (tr *TunRecovery) result(err error) bool {
+	if tr == nil {
+		return err != nil
+	}
+
+	if err == nil {
+		// Avoid a write to the shared counter on every packet
+		if tr.streak.Load() != 0 {
+			tr.streak.Store(0)
+		}
+		if tr.down.Load() {
+			tr.up("a tun write succeeded")
+		}
+		return false
+	}
+
+	tr.metricWriteErrors.Inc(1)
+	streak := tr.streak.Add(1)
+	if failures := tr.failures.Load(); failures > 0 && streak >= failures {
+		if tr.down.CompareAndSwap(false, true) {
+			tr.since.Store(time.Now().UnixNano())
+			tr.metricDown.Inc(1)
+			tr.health.markTunFailing(true)
+			tr.l.WithError(err).WithField("failures", streak).
+				Error("The tun device is down, refusing new tunnels until a write succeeds")
+		}
+		return false
+	}
+
+	return !tr.down.Load()
+}
+
+// up marks the tun as working again
+func (tr *TunRecovery) up(reason string) {
+	if !tr.down.CompareAndSwap(true, false) {
+		return
+	}
+
+	tr.streak.Store(0)
+	tr.metricRecovered.Inc(1)
+	tr.health.markTunFailing(false)
+	tr.l.WithField("reason", reason).
+		WithField("downFor", time.Since(time.Unix(0, tr.since.Load()))).
+		Info("The tun device recovered")
+}
+
+// Down returns true while the tun device is failing writes, it is safe to call on a nil TunRecovery
+func (tr *TunRecovery) Down() bool {
+	return tr != nil && tr.down.Load()
+}
+
+// refuse returns true if a handshake from vpnIp should be refused because the tun is down. Peers with a tunnel can
+// still re-handshake, their traffic is how we find out the tun works again.
+func (tr *TunRecovery) refuse(hm *HostMap, vpnIp netip.Addr) bool {
+	if !tr.Down() || hm.QueryVpnIp(vpnIp) != nil {
+		return false
+	}
+
+	tr.metricRefused.Inc(1)
+	if tr.l.Level >= logrus.DebugLevel {
+		tr.l.WithField("vpnIp", vpnIp).Debug("Refusing handshake while the tun device is down")
+	}
+	return true
+}
+
+// Run activates the tun device again every interval while it is down, if tun.recovery.reactivate is set. This brings
+// back a device that was set down or lost its addresses or routes, a device that was deleted needs a restart.
+func (tr *TunRecovery) Run(ctx context.Context, f *Interface) {
+	if tr == nil {
+		return
+	}
+
+	timer := time.NewTimer(time.Duration(tr.interval.Load()))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			if tr.Down() && tr.reactivate.Load() {
+				tr.reactivateTun(f)
+			}
+			timer.Reset(time.Duration(tr.interval.Load()))
+		}
+	}
+}
+
+func (tr *TunRecovery) reactivateTun(f *Interface) {
+	tr.l.WithField("interface", f.inside.Name()).Info("Activating the tun device again")
+	if err := f.inside.Activate(); err != nil {
+		tr.l.WithError(err).Error("Failed to activate the tun device again")
+		return
+	}
+
+	// Give the next write a fresh start, it decides whether the tun is back
+	tr.streak.Store(0)
+}
+
+// Status returns the tun write health, it is safe to call on a nil TunRecovery
+func (tr *TunRecovery) Status() TunRecoveryStatus {
+	if tr == nil {
+		return TunRecoveryStatus{}
+	}
+
+	s := TunRecoveryStatus{
+		Down:        tr.down.Load(),
+		Streak:      tr.streak.Load(),
+		WriteErrors: tr.metricWriteErrors.Count(),
+		Recoveries:  tr.metricRecovered.Count(),
+	}
+	if s.Down {
+		s.Since = time.Unix(0, tr.since.Load())
+	}
+	return s
+}
+
+// writeTun writes an inner packet to the tun queue of routine q, the result is tracked by tun.recovery
+func (f *Interface) writeTun(q int, b []byte) error {
+	_, err := f.readers[q].Write(b)
+	if f.tunRecovery.result(err) {
+		f.l.WithError(err).Error("Failed to write to tun")
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package nebula
+
+import (
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingTun fails every write while err is set
+type failingTun struct {
+	test.NoopTun
+	err         error
+	writes      int
+	activations int
+}
+
+func (t *failingTun) Write(b []byte) (int, error) {
+	t.writes++
+	if t.err != nil {
+		return 0, t.err
+	}
+	return len(b), nil
+}
+
+func (t *failingTun) Activate() error {
+	t.activations++
+	t.err = nil
+	return nil
+}
+
+func TestTunRecovery(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["health"] = map[interface{}]interface{}{"listen": "127.0.0.1:8090", "min_lighthouses": 0}
+	c.Settings["tun"] = map[interface{}]interface{}{"recovery": map[interface{}]interface{}{"failures": 3}}
+	hc, err := NewHealthCheckFromConfig(l, c)
+	require.NoError(t, err)
+	hc.markTunUp(true)
+
+	tun := &failingTun{err: errors.New("input/output error")}
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	f := &Interface{
+		inside:      tun,
+		readers:     []io.ReadWriteCloser{tun},
+		hostMap:     hm,
+		tunRecovery: NewTunRecoveryFromConfig(l, c, hc),
+		l:           l,
+	}
+	tr := f.tunRecovery
+	crt := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{NotAfter: time.Now().Add(time.Hour)}}
+	peer := netip.MustParseAddr("10.128.0.2")
+	newPeer := netip.MustParseAddr("10.128.0.3")
+	hm.unlockedAddHostInfo(&HostInfo{vpnIp: peer}, f)
+
+	before := tr.Status()
+
+	t.Log("A few failed writes are not enough to mark the tun down")
+	for i := 0; i < 2; i++ {
+		assert.Error(t, f.writeTun(0, []byte{1}))
+	}
+	assert.False(t, tr.Down())
+	assert.True(t, hc.status(crt, nil, time.Now()).Ready)
+	assert.False(t, tr.refuse(hm, newPeer))
+
+	t.Log("A success in between starts over")
+	tun.err = nil
+	assert.NoError(t, f.writeTun(0, []byte{1}))
+	tun.err = errors.New("input/output error")
+	for i := 0; i < 2; i++ {
+		assert.Error(t, f.writeTun(0, []byte{1}))
+	}
+	assert.False(t, tr.Down())
+
+	t.Log("Persistent failures mark the tun down, fail the health check and refuse new peers")
+	assert.Error(t, f.writeTun(0, []byte{1}))
+	assert.Error(t, f.writeTun(0, []byte{1}))
+	s := tr.Status()
+	assert.True(t, s.Down)
+	assert.False(t, s.Since.IsZero())
+	assert.Equal(t, before.WriteErrors+6, s.WriteErrors)
+	hs := hc.status(crt, nil, time.Now())
+	assert.False(t, hs.Ready)
+	assert.Equal(t, "tun device is failing writes", hs.Tun.Message)
+	assert.True(t, tr.refuse(hm, newPeer))
+	assert.False(t, tr.refuse(hm, peer), "peers with a tunnel can still re-handshake")
+
+	t.Log("Reactivation is off by default")
+	assert.False(t, tr.reactivate.Load())
+
+	t.Log("With reactivate the device is activated again and the next successful write recovers")
+	require.NoError(t, c.ReloadConfigString("health:\n  listen: 127.0.0.1:8090\n  min_lighthouses: 0\ntun:\n  recovery:\n    failures: 3\n    reactivate: true\n"))
+	assert.True(t, tr.reactivate.Load())
+	tr.reactivateTun(f)
+	assert.Equal(t, 1, tun.activations)
+	assert.True(t, tr.Down(), "only a write shows the tun works again")
+	assert.NoError(t, f.writeTun(0, []byte{1}))
+	s = tr.Status()
+	assert.False(t, s.Down)
+	assert.Equal(t, before.Recoveries+1, s.Recoveries)
+	assert.True(t, hc.status(crt, nil, time.Now()).Ready)
+	assert.False(t, tr.refuse(hm, newPeer))
+
+	t.Log("failures 0 never marks the tun down")
+	require.NoError(t, c.ReloadConfigString("tun:\n  recovery:\n    failures: 0\n"))
+	tun.err = errors.New("input/output error")
+	for i := 0; i < 10; i++ {
+		assert.Error(t, f.writeTun(0, []byte{1}))
+	}
+	assert.False(t, tr.Down())
+}
@@ -0,0 +1,71 @@
+package nebula
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// tunnelErrors counts the packets a tunnel failed to deliver, they are cumulative for the life of the HostInfo and
+// start over when the tunnel is re-handshaked
+type tunnelErrors struct {
+	decryptFailures atomic.Uint64
+	outOfWindow     atomic.Uint64
+	parseErrors     atomic.Uint64
+	badChecksums    atomic.Uint64
+	firewallDrops   atomic.Uint64
+	tunWriteErrors  atomic.Uint64
+	tooLate         atomic.Uint64
+}
+
+// TunnelErrors is a point in time copy of the error counters of a tunnel
+type TunnelErrors struct {
+	// DecryptFailures are packets that hit this tunnel's index but failed to decrypt or authenticate
+	DecryptFailures uint64 `json:"decryptFailures"`
+	// OutOfWindow are replayed packets or packets too far behind the replay window
+	OutOfWindow uint64 `json:"outOfWindow"`
+	// ParseErrors are decrypted packets that were not a valid inner ip packet
+	ParseErrors uint64 `json:"parseErrors"`
+	// BadChecksums are decrypted packets with a bad inner checksum, only counted with tun.verify_checksums
+	BadChecksums uint64 `json:"badChecksums"`
+	// FirewallDrops are inner packets, in either direction, that the firewall rejected
+	FirewallDrops uint64 `json:"firewallDrops"`
+	// TunWriteErrors are inner packets that could not be written to the tun device
+	TunWriteErrors uint64 `json:"tunWriteErrors"`
+	// TooLate are inner packets dropped because they arrived later than tun.max_packet_age
+	TooLate uint64 `json:"tooLate"`
+}
+
+func (e *tunnelErrors) copy() TunnelErrors {
+	return TunnelErrors{
+		DecryptFailures: e.decryptFailures.Load(),
+		OutOfWindow:     e.outOfWindow.Load(),
+		ParseErrors:     e.parseErrors.Load(),
+		BadChecksums:    e.badChecksums.Load(),
+		FirewallDrops:   e.firewallDrops.Load(),
+		TunWriteErrors:  e.tunWriteErrors.Load(),
+		TooLate:         e.tooLate.Load(),
+	}
+}
+
+// String lists the non zero counters, it is empty if the tunnel has seen no errors
+func (e TunnelErrors) String() string {
+	var parts []string
+	for _, c := range []struct {
+		name  string
+		count uint64
+	}{
+		{"decrypt", e.DecryptFailures},
+		{"window", e.OutOfWindow},
+		{"parse", e.ParseErrors},
+		{"checksum", e.BadChecksums},
+		{"firewall", e.FirewallDrops},
+		{"tun_write", e.TunWriteErrors},
+		{"too_late", e.TooLate},
+	} {
+		if c.count > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", c.name, c.count))
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,23 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnelErrors_String(t *testing.T) {
+	var e tunnelErrors
+	assert.Equal(t, "", e.copy().String())
+
+	e.decryptFailures.Add(3)
+	e.tunWriteErrors.Add(1)
+	assert.Equal(t, TunnelErrors{DecryptFailures: 3, TunWriteErrors: 1}, e.copy())
+	assert.Equal(t, "decrypt=3 tun_write=1", e.copy().String())
+
+	e.badChecksums.Add(2)
+	assert.Equal(t, "decrypt=3 checksum=2 tun_write=1", e.copy().String())
+
+	e.tooLate.Add(4)
+	assert.Equal(t, "decrypt=3 checksum=2 tun_write=1 too_late=4", e.copy().String())
+}
@@ -0,0 +1,130 @@
+package nebula
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// TunnelIdleTimeout tears down tunnels that have not carried any inner (tun) traffic for a configured duration.
+// Keepalives, test packets, and lighthouse messages do not reset the idle timer.
+type TunnelIdleTimeout struct {
+	timeout     atomic.Int64
+	sendClose   atomic.Bool
+	exemptCIDRs atomic.Pointer[[]netip.Prefix]
+	l           *logrus.Logger
+}
+
+func NewTunnelIdleTimeoutFromConfig(l *logrus.Logger, c *config.C) *TunnelIdleTimeout {
+	ti := &TunnelIdleTimeout{l: l}
+
+	ti.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		ti.reload(c, false)
+	})
+
+	return ti
+}
+
+func (ti *TunnelIdleTimeout) reload(c *config.C, initial bool) {
+	if initial || c.HasChanged("tunnels.idle_timeout") {
+		ti.timeout.Store(int64(c.GetDuration("tunnels.idle_timeout", 0)))
+		if !initial {
+			ti.l.Infof("tunnels.idle_timeout changed to %v", ti.GetTimeout())
+		}
+	}
+
+	if initial || c.HasChanged("tunnels.idle_send_close") {
+		ti.sendClose.Store(c.GetBool("tunnels.idle_send_close", true))
+		if !initial {
+			ti.l.Infof("tunnels.idle_send_close changed to %v", ti.sendClose.Load())
+		}
+	}
+
+	if initial || c.HasChanged("tunnels.idle_exempt") {
+		var exempt []netip.Prefix
+		for _, raw := range c.GetStringSlice("tunnels.idle_exempt", []string{}) {
+			prefix, err := netip.ParsePrefix(raw)
+			if err != nil {
+				ti.l.WithError(err).WithField("range", raw).Warn("Failed to parse tunnels.idle_exempt, ignoring")
+				continue
+			}
+			exempt = append(exempt, prefix)
+		}
+
+		ti.exemptCIDRs.Store(&exempt)
+		if !initial {
+			ti.l.WithField("idleExempt", exempt).Info("tunnels.idle_exempt changed")
+		}
+	}
+}
+
+// GetTimeout returns the idle timeout, 0 means tunnels are never closed for being idle
+func (ti *TunnelIdleTimeout) GetTimeout() time.Duration {
+	if ti == nil {
+		return 0
+	}
+	return time.Duration(ti.timeout.Load())
+}
+
+// GetSendClose returns true if a close tunnel message is sent when a tunnel is closed for being idle
+func (ti *TunnelIdleTimeout) GetSendClose() bool {
+	if ti == nil {
+		return false
+	}
+	return ti.sendClose.Load()
+}
+
+func (ti *TunnelIdleTimeout) isExempt(vpnIp netip.Addr) bool {
+	for _, prefix := range *ti.exemptCIDRs.Load() {
+		if prefix.Contains(vpnIp) {
+			return true
+		}
+	}
+	return false
+}
+
+// markData records that inner traffic passed through this tunnel. It is called on the data path so only a flag is
+// set, the connection manager turns it into a timestamp on its next check.
+func (i *HostInfo) markData() {
+	if !i.dataSeen.Load() {
+		i.dataSeen.Store(true)
+	}
+}
+
+// IdleTime returns how long it has been since this tunnel carried inner traffic, at the resolution of the
+// connection manager check interval
+func (i *HostInfo) IdleTime(now time.Time) time.Duration {
+	if i.dataSeen.Load() {
+		return 0
+	}
+
+	idle := now.Sub(time.Unix(0, i.lastData.Load()))
+	if idle < 0 {
+		return 0
+	}
+	return idle
+}
+
+// checkIdle folds any recently seen inner traffic into the idle timer and returns true if the tunnel has been idle
+// for longer than tunnels.idle_timeout
+func (n *connectionManager) checkIdle(hostinfo *HostInfo, now time.Time) bool {
+	if hostinfo.dataSeen.Swap(false) {
+		hostinfo.lastData.Store(now.UnixNano())
+	}
+
+	timeout := n.tunnelIdle.GetTimeout()
+	if timeout <= 0 || hostinfo.IdleTime(now) < timeout {
+		return false
+	}
+
+	// Lighthouse tunnels never carry inner traffic and tunnels used by relays carry it for others
+	if n.intf.lightHouse.IsLighthouseIP(hostinfo.vpnIp) || len(hostinfo.relayState.CopyRelayForIdxs()) > 0 {
+		return false
+	}
+
+	return !n.tunnelIdle.isExempt(hostinfo.vpnIp)
+}
@@ -0,0 +1,203 @@
+package nebula
+
+import (
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// TunnelLimit caps the number of tunnels this node will maintain, established and pending handshakes both count.
+// Relays this node is forwarding for are tracked separately and do not count against the limit. Tunnels to our
+// lighthouses and relays are always allowed, they may take the count past the limit. A refused peer is not sent a
+// reject reason, its handshake is dropped and the reason is only logged locally.
+type TunnelLimit struct {
+	max       atomic.Int64
+	evictIdle atomic.Bool
+
+	metricRejected metrics.Counter
+	metricEvicted  metrics.Counter
+	l              *logrus.Logger
+}
+
+// TunnelCounts is a point in time view of the tunnel usage on this node
+type TunnelCounts struct {
+	Tunnels int `json:"tunnels"`
+	Pending int `json:"pending"`
+	Relays  int `json:"relays"`
+	Max     int `json:"max"`
+}
+
+func NewTunnelLimitFromConfig(l *logrus.Logger, c *config.C) *TunnelLimit {
+	tl := &TunnelLimit{
+		metricRejected: metrics.GetOrRegisterCounter("tunnels.rejected", nil),
+		metricEvicted:  metrics.GetOrRegisterCounter("tunnels.evicted", nil),
+		l:              l,
+	}
+
+	tl.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		tl.reload(c, false)
+	})
+
+	return tl
+}
+
+func (tl *TunnelLimit) reload(c *config.C, initial bool) {
+	if initial || c.HasChanged("tunnels.max") {
+		max := c.GetInt("tunnels.max", 0)
+		if max < 0 {
+			max = 0
+		}
+		tl.max.Store(int64(max))
+		if !initial {
+			tl.l.Infof("tunnels.max changed to %v", max)
+		}
+	}
+
+	if initial || c.HasChanged("tunnels.evict_idle") {
+		tl.evictIdle.Store(c.GetBool("tunnels.evict_idle", false))
+		if !initial {
+			tl.l.Infof("tunnels.evict_idle changed to %v", tl.evictIdle.Load())
+		}
+	}
+}
+
+// GetMax returns the maximum number of tunnels, 0 means unlimited
+func (tl *TunnelLimit) GetMax() int {
+	if tl == nil {
+		return 0
+	}
+	return int(tl.max.Load())
+}
+
+func (tl *TunnelLimit) GetEvictIdle() bool {
+	if tl == nil {
+		return false
+	}
+	return tl.evictIdle.Load()
+}
+
+// TunnelCounts returns the current tunnel usage
+func (hm *HandshakeManager) TunnelCounts() TunnelCounts {
+	hm.mainHostMap.RLock()
+	tc := TunnelCounts{
+		Tunnels: len(hm.mainHostMap.Hosts),
+		Relays:  len(hm.mainHostMap.Relays),
+	}
+	hm.mainHostMap.RUnlock()
+
+	hm.RLock()
+	tc.Pending = len(hm.vpnIps)
+	hm.RUnlock()
+
+	tc.Max = hm.config.tunnelLimit.GetMax()
+	return tc
+}
+
+// allowNewTunnel returns true if a tunnel to vpnIp may be created without exceeding tunnels.max. If tunnels.evict_idle
+// is set then the least recently used idle tunnel will be closed to make room. This is only a first check, the slot is
+// taken under the handshake manager lock by StartHandshake or CheckAndComplete which check again.
+func (hm *HandshakeManager) allowNewTunnel(vpnIp netip.Addr, initiator bool) bool {
+	hm.mainHostMap.RLock()
+	hm.RLock()
+	count, ok := hm.unlockedHasTunnelSlot(vpnIp)
+	hm.RUnlock()
+	hm.mainHostMap.RUnlock()
+	if ok {
+		return true
+	}
+
+	if hm.config.tunnelLimit.GetEvictIdle() && hm.evictIdleTunnel() {
+		return true
+	}
+
+	hm.rejectTunnel(vpnIp, initiator, count)
+	return false
+}
+
+// unlockedHasTunnelSlot returns true if a tunnel to vpnIp fits within tunnels.max, along with the number of tunnels
+// counted. Rehandshakes with a vpn ip we already have a tunnel or pending handshake for, and tunnels to our lighthouses
+// and relays, are always allowed. Must be called with hm and hm.mainHostMap locked.
+func (hm *HandshakeManager) unlockedHasTunnelSlot(vpnIp netip.Addr) (int, bool) {
+	max := hm.config.tunnelLimit.GetMax()
+	if max == 0 {
+		return 0, true
+	}
+
+	count := len(hm.mainHostMap.Hosts) + len(hm.vpnIps)
+	if count < max {
+		return count, true
+	}
+
+	if _, ok := hm.mainHostMap.Hosts[vpnIp]; ok {
+		return count, true
+	}
+
+	if _, ok := hm.vpnIps[vpnIp]; ok {
+		return count, true
+	}
+
+	// Without its lighthouses and relays a node can not reach anyone, they are never refused
+	if hm.lightHouse.IsLighthouseIP(vpnIp) || slices.Contains(hm.lightHouse.GetRelaysForMe(), vpnIp) {
+		return count, true
+	}
+
+	return count, false
+}
+
+// rejectTunnel records that a tunnel to vpnIp was refused because of tunnels.max. The peer is not told why.
+func (hm *HandshakeManager) rejectTunnel(vpnIp netip.Addr, initiator bool, count int) {
+	hm.config.tunnelLimit.metricRejected.Inc(1)
+	hm.l.WithField("vpnIp", vpnIp).
+		WithField("initiator", initiator).
+		WithField("tunnels", count).
+		WithField("maxTunnels", hm.config.tunnelLimit.GetMax()).
+		WithField("reason", "tunnel limit reached").
+		Warn("Refusing to create tunnel")
+}
+
+// evictIdleTunnel closes the least recently used tunnel that has not seen traffic for at least one connection check
+// interval. Lighthouses and tunnels carrying relays are never evicted. Returns true if a tunnel was closed.
+func (hm *HandshakeManager) evictIdleTunnel() bool {
+	if hm.f == nil {
+		return false
+	}
+
+	idleBefore := time.Now().Add(-hm.f.connectionManager.checkInterval).UnixNano()
+
+	var victim *HostInfo
+	hm.mainHostMap.RLock()
+	for vpnIp, hostinfo := range hm.mainHostMap.Hosts {
+		lastUsed := hostinfo.lastUsed.Load()
+		if lastUsed > idleBefore || hm.lightHouse.IsLighthouseIP(vpnIp) {
+			continue
+		}
+
+		if len(hostinfo.relayState.CopyRelayForIdxs()) > 0 {
+			continue
+		}
+
+		if victim == nil || lastUsed < victim.lastUsed.Load() {
+			victim = hostinfo
+		}
+	}
+	hm.mainHostMap.RUnlock()
+
+	if victim == nil {
+		return false
+	}
+
+	hm.config.tunnelLimit.metricEvicted.Inc(1)
+	victim.logger(hm.l).
+		WithField("lastUsed", time.Unix(0, victim.lastUsed.Load())).
+		Info("Evicting idle tunnel to stay within tunnels.max")
+
+	hm.f.sendCloseTunnel(victim)
+	hm.f.closeTunnel(victim)
+	return true
+}
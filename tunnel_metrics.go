@@ -0,0 +1,325 @@
+package nebula
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	defaultTunnelMetricsMaxPeers    = 10
+	defaultTunnelMetricsMaxDuration = time.Hour
+	defaultTunnelMetricsDuration    = 10 * time.Minute
+)
+
+// TunnelMetrics exports detailed metrics labeled by vpn ip for a few peers at a time. A series per peer would blow up
+// the cardinality of the metrics backend if it was always on, so peers are watched on demand from the control socket
+// and stop being watched on their own once their duration is up. At most tunnel_metrics.max_peers are watched at once
+// and for no longer than tunnel_metrics.max_duration. The series are produced at scrape time, a peer that is no longer
+// watched disappears from the next scrape. Only the prometheus stats backend exports them, they are always available
+// from the control socket.
+type TunnelMetrics struct {
+	maxPeers    atomic.Int64
+	maxDuration atomic.Int64
+
+	// watches is copy on write, it is read for every data packet and nil while nothing is watched
+	watches atomic.Pointer[map[netip.Addr]*tunnelWatch]
+	// writeLock serializes changes to watches
+	writeLock sync.Mutex
+
+	hostMap *HostMap
+	l       *logrus.Logger
+}
+
+// tunnelWatch counts the traffic of a watched peer across tunnel changes, the counters start when the watch does
+type tunnelWatch struct {
+	since     time.Time
+	until     atomic.Int64
+	txBytes   atomic.Uint64
+	txPackets atomic.Uint64
+	rxBytes   atomic.Uint64
+	rxPackets atomic.Uint64
+	roams     atomic.Uint64
+}
+
+// TunnelMetricsStatus is the current metrics of a watched peer
+type TunnelMetricsStatus struct {
+	VpnIp     netip.Addr `json:"vpnIp"`
+	Since     time.Time  `json:"since"`
+	Until     time.Time  `json:"until"`
+	TxBytes   uint64     `json:"txBytes"`
+	TxPackets uint64     `json:"txPackets"`
+	RxBytes   uint64     `json:"rxBytes"`
+	RxPackets uint64     `json:"rxPackets"`
+	Roams     uint64     `json:"roams"`
+	// Up is true if there is a tunnel with the peer, Drops and RTT are only known while there is
+	Up bool `json:"up"`
+	// Drops are the packets the current tunnel failed to deliver, see TunnelErrors
+	Drops uint64 `json:"drops"`
+	// RTT is the round trip time of the current tunnel if tunnel_quality or latency_probe measured it
+	RTT time.Duration `json:"rtt"`
+}
+
+func NewTunnelMetricsFromConfig(l *logrus.Logger, c *config.C, hm *HostMap) *TunnelMetrics {
+	tm := &TunnelMetrics{hostMap: hm, l: l}
+
+	tm.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		tm.reload(c, false)
+	})
+
+	return tm
+}
+
+func (tm *TunnelMetrics) reload(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("tunnel_metrics") {
+		return
+	}
+
+	maxPeers := c.GetInt("tunnel_metrics.max_peers", defaultTunnelMetricsMaxPeers)
+	if maxPeers < 0 {
+		tm.l.WithField("maxPeers", maxPeers).Warn("tunnel_metrics.max_peers can not be negative, using the default")
+		maxPeers = defaultTunnelMetricsMaxPeers
+	}
+
+	maxDuration := c.GetDuration("tunnel_metrics.max_duration", defaultTunnelMetricsMaxDuration)
+	if maxDuration < time.Second {
+		tm.l.WithField("maxDuration", maxDuration).Warn("tunnel_metrics.max_duration must be at least 1s, using the default")
+		maxDuration = defaultTunnelMetricsMaxDuration
+	}
+
+	tm.maxPeers.Store(int64(maxPeers))
+	tm.maxDuration.Store(int64(maxDuration))
+
+	if !initial {
+		tm.l.WithField("maxPeers", maxPeers).WithField("maxDuration", maxDuration).
+			Info("tunnel_metrics has changed, peers already watched keep their duration")
+	}
+}
+
+// Enable watches vpnIps for d, or the default of 10 minutes if d is 0. d is capped to tunnel_metrics.max_duration.
+// Enabling a peer that is already watched extends its watch and keeps its counters. Nothing is enabled if the peers
+// would not fit within tunnel_metrics.max_peers.
+func (tm *TunnelMetrics) Enable(vpnIps []netip.Addr, d time.Duration, now time.Time) error {
+	if d <= 0 {
+		d = defaultTunnelMetricsDuration
+	}
+	d = min(d, time.Duration(tm.maxDuration.Load()))
+
+	tm.writeLock.Lock()
+	defer tm.writeLock.Unlock()
+
+	watches := map[netip.Addr]*tunnelWatch{}
+	if p := tm.watches.Load(); p != nil {
+		watches = maps.Clone(*p)
+	}
+
+	for _, vpnIp := range vpnIps {
+		if _, ok := watches[vpnIp]; !ok {
+			watches[vpnIp] = &tunnelWatch{since: now}
+		}
+	}
+
+	if maxPeers := int(tm.maxPeers.Load()); len(watches) > maxPeers {
+		return fmt.Errorf("at most %d peers can be watched at once, see tunnel_metrics.max_peers", maxPeers)
+	}
+
+	until := now.Add(d)
+	for _, vpnIp := range vpnIps {
+		watches[vpnIp].until.Store(until.UnixNano())
+	}
+	tm.watches.Store(&watches)
+
+	tm.l.WithField("vpnIps", vpnIps).WithField("until", until).Info("Per tunnel metrics enabled")
+	return nil
+}
+
+// Disable stops watching vpnIps, or every peer if vpnIps is empty. Their series are gone from the next scrape.
+func (tm *TunnelMetrics) Disable(vpnIps []netip.Addr) {
+	tm.writeLock.Lock()
+	defer tm.writeLock.Unlock()
+	tm.unlockedDisable(func(vpnIp netip.Addr, _ *tunnelWatch) bool {
+		return len(vpnIps) == 0 || slices.Contains(vpnIps, vpnIp)
+	}, "requested")
+}
+
+// expire stops watching every peer whose duration is up as of now
+func (tm *TunnelMetrics) expire(now time.Time) {
+	tm.writeLock.Lock()
+	defer tm.writeLock.Unlock()
+	tm.unlockedDisable(func(_ netip.Addr, w *tunnelWatch) bool {
+		return now.UnixNano() >= w.until.Load()
+	}, "expired")
+}
+
+func (tm *TunnelMetrics) unlockedDisable(match func(netip.Addr, *tunnelWatch) bool, reason string) {
+	p := tm.watches.Load()
+	if p == nil {
+		return
+	}
+
+	watches := maps.Clone(*p)
+	var disabled []netip.Addr
+	for vpnIp, w := range watches {
+		if match(vpnIp, w) {
+			delete(watches, vpnIp)
+			disabled = append(disabled, vpnIp)
+		}
+	}
+
+	if len(disabled) == 0 {
+		return
+	}
+
+	if len(watches) == 0 {
+		tm.watches.Store(nil)
+	} else {
+		tm.watches.Store(&watches)
+	}
+
+	tm.l.WithField("vpnIps", disabled).WithField("reason", reason).Info("Per tunnel metrics disabled")
+}
+
+// Run stops watching peers once their duration is up until ctx is done
+func (tm *TunnelMetrics) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			tm.expire(now)
+		}
+	}
+}
+
+// watch returns the watch for vpnIp or nil if it is not watched, it is safe to call on a nil TunnelMetrics
+func (tm *TunnelMetrics) watch(vpnIp netip.Addr) *tunnelWatch {
+	if tm == nil {
+		return nil
+	}
+
+	p := tm.watches.Load()
+	if p == nil {
+		return nil
+	}
+	return (*p)[vpnIp]
+}
+
+// tx counts a data packet of n bytes sent to the peer of hostinfo
+func (tm *TunnelMetrics) tx(hostinfo *HostInfo, n int) {
+	if w := tm.watch(hostinfo.vpnIp); w != nil {
+		w.txPackets.Add(1)
+		w.txBytes.Add(uint64(n))
+	}
+}
+
+// rx counts a data packet of n bytes received from the peer of hostinfo
+func (tm *TunnelMetrics) rx(hostinfo *HostInfo, n int) {
+	if w := tm.watch(hostinfo.vpnIp); w != nil {
+		w.rxPackets.Add(1)
+		w.rxBytes.Add(uint64(n))
+	}
+}
+
+// roamed counts a change of remote for the peer of hostinfo
+func (tm *TunnelMetrics) roamed(hostinfo *HostInfo) {
+	if w := tm.watch(hostinfo.vpnIp); w != nil {
+		w.roams.Add(1)
+	}
+}
+
+// Status returns the metrics of every watched peer sorted by vpn ip
+func (tm *TunnelMetrics) Status() []TunnelMetricsStatus {
+	out := []TunnelMetricsStatus{}
+	if tm == nil {
+		return out
+	}
+
+	p := tm.watches.Load()
+	if p == nil {
+		return out
+	}
+
+	for vpnIp, w := range *p {
+		s := TunnelMetricsStatus{
+			VpnIp:     vpnIp,
+			Since:     w.since,
+			Until:     time.Unix(0, w.until.Load()),
+			TxBytes:   w.txBytes.Load(),
+			TxPackets: w.txPackets.Load(),
+			RxBytes:   w.rxBytes.Load(),
+			RxPackets: w.rxPackets.Load(),
+			Roams:     w.roams.Load(),
+		}
+
+		if hostinfo := tm.hostMap.QueryVpnIp(vpnIp); hostinfo != nil {
+			s.Up = true
+			s.RTT = hostinfo.rtt()
+			e := hostinfo.errCounters.copy()
+			s.Drops = e.DecryptFailures + e.OutOfWindow + e.ParseErrors + e.BadChecksums + e.FirewallDrops +
+				e.TunWriteErrors + e.TooLate
+		}
+		out = append(out, s)
+	}
+
+	slices.SortFunc(out, func(a, b TunnelMetricsStatus) int { return a.VpnIp.Compare(b.VpnIp) })
+	return out
+}
+
+// collector returns a prometheus collector that exports the watched peers labeled by vpn_ip
+func (tm *TunnelMetrics) collector(namespace, subsystem string) prometheus.Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "tunnel_"+name), help, []string{"vpn_ip"}, nil)
+	}
+
+	return &tunnelMetricsCollector{
+		tm:        tm,
+		txBytes:   desc("tx_bytes_total", "Data bytes sent to a watched peer since it was watched"),
+		txPackets: desc("tx_packets_total", "Data packets sent to a watched peer since it was watched"),
+		rxBytes:   desc("rx_bytes_total", "Data bytes received from a watched peer since it was watched"),
+		rxPackets: desc("rx_packets_total", "Data packets received from a watched peer since it was watched"),
+		roams:     desc("roams_total", "Remote changes of a watched peer since it was watched"),
+		drops:     desc("drops", "Packets the current tunnel with a watched peer failed to deliver"),
+		rtt:       desc("rtt_seconds", "Round trip time of the current tunnel with a watched peer, if measured"),
+	}
+}
+
+type tunnelMetricsCollector struct {
+	tm                                                        *TunnelMetrics
+	txBytes, txPackets, rxBytes, rxPackets, roams, drops, rtt *prometheus.Desc
+}
+
+func (c *tunnelMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.txBytes, c.txPackets, c.rxBytes, c.rxPackets, c.roams, c.drops, c.rtt} {
+		ch <- d
+	}
+}
+
+func (c *tunnelMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.tm.Status() {
+		vpnIp := s.VpnIp.String()
+		ch <- prometheus.MustNewConstMetric(c.txBytes, prometheus.CounterValue, float64(s.TxBytes), vpnIp)
+		ch <- prometheus.MustNewConstMetric(c.txPackets, prometheus.CounterValue, float64(s.TxPackets), vpnIp)
+		ch <- prometheus.MustNewConstMetric(c.rxBytes, prometheus.CounterValue, float64(s.RxBytes), vpnIp)
+		ch <- prometheus.MustNewConstMetric(c.rxPackets, prometheus.CounterValue, float64(s.RxPackets), vpnIp)
+		ch <- prometheus.MustNewConstMetric(c.roams, prometheus.CounterValue, float64(s.Roams), vpnIp)
+		if s.Up {
+			ch <- prometheus.MustNewConstMetric(c.drops, prometheus.GaugeValue, float64(s.Drops), vpnIp)
+		}
+		if s.RTT > 0 {
+			ch <- prometheus.MustNewConstMetric(c.rtt, prometheus.GaugeValue, s.RTT.Seconds(), vpnIp)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelMetrics(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["tunnel_metrics"] = map[interface{}]interface{}{
+		"max_peers":    2,
+		"max_duration": "30m",
+	}
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	tm := NewTunnelMetricsFromConfig(l, c, hm)
+
+	a := netip.MustParseAddr("10.128.0.2")
+	b := netip.MustParseAddr("10.128.0.3")
+	hiA := &HostInfo{vpnIp: a}
+	hiB := &HostInfo{vpnIp: b}
+	now := time.Now()
+
+	t.Log("Nothing is counted until a peer is watched")
+	tm.tx(hiA, 100)
+	tm.rx(hiA, 100)
+	assert.Empty(t, tm.Status())
+
+	t.Log("Durations are capped to max_duration")
+	require.NoError(t, tm.Enable([]netip.Addr{a}, 2*time.Hour, now))
+	tm.tx(hiA, 100)
+	tm.tx(hiA, 50)
+	tm.rx(hiA, 10)
+	tm.roamed(hiA)
+	tm.tx(hiB, 1000)
+
+	s := tm.Status()
+	require.Len(t, s, 1)
+	assert.Equal(t, a, s[0].VpnIp)
+	assert.Equal(t, now.Add(30*time.Minute).UnixNano(), s[0].Until.UnixNano())
+	assert.Equal(t, uint64(150), s[0].TxBytes)
+	assert.Equal(t, uint64(2), s[0].TxPackets)
+	assert.Equal(t, uint64(10), s[0].RxBytes)
+	assert.Equal(t, uint64(1), s[0].RxPackets)
+	assert.Equal(t, uint64(1), s[0].Roams)
+	assert.False(t, s[0].Up)
+
+	t.Log("Watching more than max_peers enables nothing")
+	c3 := netip.MustParseAddr("10.128.0.4")
+	require.Error(t, tm.Enable([]netip.Addr{b, c3}, 0, now))
+	assert.Len(t, tm.Status(), 1)
+
+	t.Log("Enabling again extends the watch and keeps the counters")
+	require.NoError(t, tm.Enable([]netip.Addr{a, b}, 0, now.Add(time.Minute)))
+	s = tm.Status()
+	require.Len(t, s, 2)
+	assert.Equal(t, now.Add(time.Minute+defaultTunnelMetricsDuration).UnixNano(), s[0].Until.UnixNano())
+	assert.Equal(t, uint64(150), s[0].TxBytes)
+	assert.Equal(t, now.Add(time.Minute), s[1].Since)
+
+	t.Log("Peers expire once their duration is up")
+	tm.expire(now.Add(time.Minute + defaultTunnelMetricsDuration - time.Second))
+	assert.Len(t, tm.Status(), 2)
+	tm.expire(now.Add(time.Minute + defaultTunnelMetricsDuration))
+	assert.Empty(t, tm.Status())
+	assert.Nil(t, tm.watches.Load())
+
+	t.Log("Disable with no vpn ips stops every watch")
+	require.NoError(t, tm.Enable([]netip.Addr{a, b}, 0, now))
+	tm.Disable([]netip.Addr{b})
+	s = tm.Status()
+	require.Len(t, s, 1)
+	assert.Equal(t, a, s[0].VpnIp)
+	assert.Equal(t, uint64(0), s[0].TxBytes, "a new watch starts counting from 0")
+	tm.Disable(nil)
+	assert.Empty(t, tm.Status())
+
+	t.Log("A nil TunnelMetrics counts nothing")
+	var nilTm *TunnelMetrics
+	nilTm.tx(hiA, 1)
+	nilTm.rx(hiA, 1)
+	nilTm.roamed(hiA)
+	assert.Empty(t, nilTm.Status())
+}
+
+func TestTunnelMetrics_collector(t *testing.T) {
+	l := test.NewLogger()
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	tm := NewTunnelMetricsFromConfig(l, config.NewC(l), hm)
+
+	a := netip.MustParseAddr("10.128.0.2")
+	hiA := &HostInfo{vpnIp: a}
+	hm.unlockedAddHostInfo(hiA, &Interface{l: l})
+
+	pr := prometheus.NewRegistry()
+	pr.MustRegister(tm.collector("nebula", ""))
+
+	gather := func() map[string]float64 {
+		out := map[string]float64{}
+		mfs, err := pr.Gather()
+		require.NoError(t, err)
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				require.Len(t, m.Label, 1)
+				assert.Equal(t, "vpn_ip", m.Label[0].GetName())
+				assert.Equal(t, a.String(), m.Label[0].GetValue())
+				if m.Counter != nil {
+					out[mf.GetName()] = m.Counter.GetValue()
+				} else {
+					out[mf.GetName()] = m.Gauge.GetValue()
+				}
+			}
+		}
+		return out
+	}
+
+	assert.Empty(t, gather())
+
+	require.NoError(t, tm.Enable([]netip.Addr{a}, time.Minute, time.Now()))
+	tm.tx(hiA, 100)
+	tm.rx(hiA, 40)
+	hiA.errCounters.decryptFailures.Add(3)
+
+	assert.Equal(t, map[string]float64{
+		"nebula_tunnel_tx_bytes_total":   100,
+		"nebula_tunnel_tx_packets_total": 1,
+		"nebula_tunnel_rx_bytes_total":   40,
+		"nebula_tunnel_rx_packets_total": 1,
+		"nebula_tunnel_roams_total":      0,
+		"nebula_tunnel_drops":            3,
+	}, gather())
+
+	t.Log("The series are gone once the peer is no longer watched")
+	tm.Disable(nil)
+	assert.Empty(t, gather())
+}
@@ -0,0 +1,128 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// TunnelPause stops the data to and from a peer without closing its tunnel, to isolate a suspect peer for a while
+// without paying for a handshake when it is resumed. Only inner packets are dropped, the tunnel keeps its keys and
+// its keepalives, test packets and lighthouse messages so the connection manager does not close it. Inbound packets
+// are dropped once they are authenticated, they still count as traffic from the peer.
+//
+// A pause is kept by vpn ip until it is resumed or nebula restarts, a new tunnel with a paused peer starts paused.
+type TunnelPause struct {
+	sync.Mutex
+	// paused is when each paused peer was paused
+	paused  map[netip.Addr]time.Time
+	hostMap *HostMap
+
+	metricIncoming metrics.Counter
+	metricOutgoing metrics.Counter
+
+	l *logrus.Logger
+}
+
+func NewTunnelPause(l *logrus.Logger, hostMap *HostMap) *TunnelPause {
+	return &TunnelPause{
+		paused:         map[netip.Addr]time.Time{},
+		hostMap:        hostMap,
+		metricIncoming: metrics.GetOrRegisterCounter("tunnel_pause.incoming.dropped", nil),
+		metricOutgoing: metrics.GetOrRegisterCounter("tunnel_pause.outgoing.dropped", nil),
+		l:              l,
+	}
+}
+
+// Pause stops the data of the tunnel with vpnIp, there has to be a tunnel
+func (p *TunnelPause) Pause(vpnIp netip.Addr) error {
+	if p.hostMap.QueryVpnIp(vpnIp) == nil {
+		return fmt.Errorf("could not find tunnel for vpn ip: %v", vpnIp)
+	}
+
+	p.Lock()
+	if _, ok := p.paused[vpnIp]; ok {
+		p.Unlock()
+		return fmt.Errorf("the tunnel with %v is already paused", vpnIp)
+	}
+	p.paused[vpnIp] = time.Now()
+	p.Unlock()
+
+	p.update(vpnIp)
+	p.l.WithField("vpnIp", vpnIp).Info("Tunnel paused")
+	return nil
+}
+
+// Resume lets the data of the tunnel with vpnIp flow again
+func (p *TunnelPause) Resume(vpnIp netip.Addr) error {
+	p.Lock()
+	since, ok := p.paused[vpnIp]
+	if !ok {
+		p.Unlock()
+		return fmt.Errorf("the tunnel with %v is not paused", vpnIp)
+	}
+	delete(p.paused, vpnIp)
+	p.Unlock()
+
+	p.update(vpnIp)
+	p.l.WithField("vpnIp", vpnIp).WithField("pausedFor", time.Since(since).Round(time.Second)).Info("Tunnel resumed")
+	return nil
+}
+
+// update sets the paused flag of every tunnel with vpnIp. The host map is locked before p here as it is when a tunnel is
+// added, whichever of a pause and a resume updates last reads the final state.
+func (p *TunnelPause) update(vpnIp netip.Addr) {
+	p.hostMap.RLock()
+	defer p.hostMap.RUnlock()
+
+	paused := p.isPaused(vpnIp)
+	for hostinfo := p.hostMap.Hosts[vpnIp]; hostinfo != nil; hostinfo = hostinfo.next {
+		hostinfo.paused.Store(paused)
+	}
+}
+
+// isPaused returns true if vpnIp is paused, it is safe to call on a nil TunnelPause
+func (p *TunnelPause) isPaused(vpnIp netip.Addr) bool {
+	if p == nil {
+		return false
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	_, ok := p.paused[vpnIp]
+	return ok
+}
+
+// Paused returns when each paused peer was paused
+func (p *TunnelPause) Paused() map[netip.Addr]time.Time {
+	p.Lock()
+	defer p.Unlock()
+
+	paused := make(map[netip.Addr]time.Time, len(p.paused))
+	for vpnIp, since := range p.paused {
+		paused[vpnIp] = since
+	}
+	return paused
+}
+
+// dropIncoming returns true if an inbound packet of hostinfo has to be dropped because the tunnel is paused
+func (p *TunnelPause) dropIncoming(hostinfo *HostInfo) bool {
+	if !hostinfo.paused.Load() {
+		return false
+	}
+	p.metricIncoming.Inc(1)
+	return true
+}
+
+// dropOutgoing returns true if an outbound packet of hostinfo has to be dropped because the tunnel is paused
+func (p *TunnelPause) dropOutgoing(hostinfo *HostInfo) bool {
+	if !hostinfo.paused.Load() {
+		return false
+	}
+	p.metricOutgoing.Inc(1)
+	return true
+}
@@ -0,0 +1,55 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelPause(t *testing.T) {
+	l := test.NewLogger()
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.1/24"))
+	p := NewTunnelPause(l, hm)
+	f := &Interface{tunnelPause: p}
+
+	vpnIp := netip.MustParseAddr("10.128.0.2")
+	assert.EqualError(t, p.Pause(vpnIp), "could not find tunnel for vpn ip: 10.128.0.2")
+
+	first := &HostInfo{vpnIp: vpnIp, localIndexId: 1}
+	hm.unlockedAddHostInfo(first, f)
+	other := &HostInfo{vpnIp: netip.MustParseAddr("10.128.0.3"), localIndexId: 2}
+	hm.unlockedAddHostInfo(other, f)
+	assert.False(t, first.paused.Load())
+
+	require.NoError(t, p.Pause(vpnIp))
+	assert.EqualError(t, p.Pause(vpnIp), "the tunnel with 10.128.0.2 is already paused")
+	assert.True(t, first.paused.Load())
+	assert.False(t, other.paused.Load())
+	assert.Contains(t, p.Paused(), vpnIp)
+
+	before := p.metricOutgoing.Count()
+	assert.True(t, p.dropOutgoing(first))
+	assert.False(t, p.dropOutgoing(other))
+	assert.Equal(t, before+1, p.metricOutgoing.Count())
+	before = p.metricIncoming.Count()
+	assert.True(t, p.dropIncoming(first))
+	assert.False(t, p.dropIncoming(other))
+	assert.Equal(t, before+1, p.metricIncoming.Count())
+
+	t.Log("A new tunnel with a paused peer starts paused")
+	second := &HostInfo{vpnIp: vpnIp, localIndexId: 3}
+	hm.unlockedAddHostInfo(second, f)
+	assert.True(t, second.paused.Load())
+
+	require.NoError(t, p.Resume(vpnIp))
+	assert.EqualError(t, p.Resume(vpnIp), "the tunnel with 10.128.0.2 is not paused")
+	assert.False(t, first.paused.Load())
+	assert.False(t, second.paused.Load())
+	assert.Empty(t, p.Paused())
+
+	var nilP *TunnelPause
+	assert.False(t, nilP.isPaused(vpnIp))
+}
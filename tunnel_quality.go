@@ -0,0 +1,299 @@
+package nebula
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+const (
+	defaultTunnelQualityProbeInterval = 30 * time.Second
+	defaultTunnelQualitySmoothing     = time.Minute
+
+	// tunnelQualityMinSample is the shortest interval a loss sample is taken over
+	tunnelQualityMinSample = time.Second
+	// tunnelQualityMaxRTT is the oldest probe we accept a reply for, anything older was held up somewhere
+	tunnelQualityMaxRTT = time.Minute
+)
+
+// tunnelQualityMagic prefixes the payload of an rtt probe, followed by the big endian unix nano time the probe was sent.
+// The probe carries its own send time so any test request can be one without keeping track of it.
+var tunnelQualityMagic = probeMagic{'q', 'l', 't', 'y'}
+
+// TunnelQuality keeps a passive loss estimate and a smoothed round trip time for every tunnel.
+//
+// Loss is derived from the replay window. A message counter is counted as lost when it leaves the window without ever
+// arriving, so packets reordered by less than the window (ReplayWindow counters) are never counted. The downside is
+// that loss is only known once a window worth of newer packets arrived, on a tunnel carrying 10 packets a second a lost
+// packet shows up roughly 100 seconds later. Each sample is the share of counters lost since the previous sample and
+// is folded into an exponentially weighted moving average with a time constant of tunnel_quality.smoothing. Samples
+// with no traffic are skipped so an idle tunnel keeps its last estimate. Counters the peer never sent, for example
+// when it dropped packets before encrypting them, are not distinguishable from loss.
+//
+// The round trip time comes from test packets. The test packets the connection manager already sends to check a
+// tunnel are timestamped and busy tunnels, which are never tested, get one probe every tunnel_quality.probe_interval.
+// The peer echoes the payload so this works with peers of any version. The smoothed rtt and its variance follow
+// RFC 6298. Processing delay on the peer and queueing on either side are included in the measurement.
+type TunnelQuality struct {
+	enabled       atomic.Bool
+	probeInterval atomic.Int64
+	smoothing     atomic.Int64
+
+	metricTx metrics.Counter
+	l        *logrus.Logger
+}
+
+// tunnelQualityState is the per tunnel state, it lives on the HostInfo
+type tunnelQualityState struct {
+	sync.Mutex
+
+	// sampled is when the window counts were last sampled and received/lost are the counts at that time
+	sampled   time.Time
+	received  uint64
+	lost      uint64
+	loss      float64
+	lossValid bool
+
+	lastProbe  time.Time
+	srtt       time.Duration
+	rttVar     time.Duration
+	rttSamples uint64
+	lastRTT    time.Time
+}
+
+// TunnelQualityStatus is reported on the control socket for every tunnel once something has been measured
+type TunnelQualityStatus struct {
+	// Loss is the smoothed share of packets lost between 0 and 1, only valid if Received or Lost is not 0
+	Loss     float64 `json:"loss"`
+	Received uint64  `json:"received"`
+	Lost     uint64  `json:"lost"`
+
+	SRTT       time.Duration `json:"srtt"`
+	RTTVar     time.Duration `json:"rttVar"`
+	RTTSamples uint64        `json:"rttSamples"`
+	LastRTT    time.Time     `json:"lastRtt"`
+}
+
+func NewTunnelQualityFromConfig(l *logrus.Logger, c *config.C) *TunnelQuality {
+	tq := &TunnelQuality{
+		metricTx: metrics.GetOrRegisterCounter("tunnel_quality.tx", nil),
+		l:        l,
+	}
+
+	tq.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		tq.reload(c, false)
+	})
+
+	return tq
+}
+
+func (tq *TunnelQuality) reload(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("tunnel_quality") {
+		return
+	}
+
+	probeInterval := c.GetDuration("tunnel_quality.probe_interval", defaultTunnelQualityProbeInterval)
+	if probeInterval < 0 {
+		probeInterval = 0
+	}
+
+	smoothing := c.GetDuration("tunnel_quality.smoothing", defaultTunnelQualitySmoothing)
+	if smoothing < tunnelQualityMinSample {
+		tq.l.WithField("smoothing", smoothing).Warn("tunnel_quality.smoothing must be at least 1s, using the default")
+		smoothing = defaultTunnelQualitySmoothing
+	}
+
+	tq.probeInterval.Store(int64(probeInterval))
+	tq.smoothing.Store(int64(smoothing))
+	tq.enabled.Store(c.GetBool("tunnel_quality.enabled", false))
+
+	if !initial || tq.enabled.Load() {
+		tq.l.WithField("enabled", tq.enabled.Load()).
+			WithField("probeInterval", probeInterval).
+			WithField("smoothing", smoothing).
+			Info("Tunnel quality estimation configured")
+	}
+}
+
+// check samples the loss estimate of hostinfo and sends it an rtt probe if one is due. The connection manager calls
+// this on every traffic check of a live tunnel.
+func (tq *TunnelQuality) check(f *Interface, hostinfo *HostInfo, now time.Time, nb, out []byte) {
+	if tq == nil || !tq.enabled.Load() || hostinfo.ConnectionState == nil {
+		return
+	}
+
+	tq.sample(hostinfo, now)
+
+	interval := time.Duration(tq.probeInterval.Load())
+	if interval <= 0 {
+		return
+	}
+
+	s := &hostinfo.quality
+	s.Lock()
+	due := now.Sub(s.lastProbe) >= interval
+	s.Unlock()
+
+	if due {
+		f.SendMessageToHostInfo(header.Test, header.TestRequest, hostinfo, tq.testPayload(hostinfo, now), nb, out)
+	}
+}
+
+// testPayload returns the payload for a test request to hostinfo, timestamped if estimation is enabled
+func (tq *TunnelQuality) testPayload(hostinfo *HostInfo, now time.Time) []byte {
+	if tq == nil || !tq.enabled.Load() {
+		return []byte("")
+	}
+
+	s := &hostinfo.quality
+	s.Lock()
+	s.lastProbe = now
+	s.Unlock()
+
+	tq.metricTx.Inc(1)
+	return tunnelQualityMagic.payload(uint64(now.UnixNano()))
+}
+
+// sample folds the loss seen by the replay window since the previous sample into the estimate
+func (tq *TunnelQuality) sample(hostinfo *HostInfo, now time.Time) {
+	received, lost := hostinfo.ConnectionState.window.counts()
+
+	s := &hostinfo.quality
+	s.Lock()
+	defer s.Unlock()
+
+	if s.sampled.IsZero() {
+		s.sampled, s.received, s.lost = now, received, lost
+		return
+	}
+
+	dt := now.Sub(s.sampled)
+	if dt < tunnelQualityMinSample {
+		return
+	}
+
+	dReceived, dLost := received-s.received, lost-s.lost
+	s.sampled, s.received, s.lost = now, received, lost
+	if dReceived+dLost == 0 {
+		// Nothing happened, keep the estimate we have
+		return
+	}
+
+	x := float64(dLost) / float64(dReceived+dLost)
+	if !s.lossValid {
+		s.loss = x
+		s.lossValid = true
+		return
+	}
+
+	alpha := 1 - math.Exp(-dt.Seconds()/time.Duration(tq.smoothing.Load()).Seconds())
+	s.loss += alpha * (x - s.loss)
+}
+
+// handleReply records the rtt for a test reply to one of our probes, returns false if the reply was not a probe
+func (tq *TunnelQuality) handleReply(hostinfo *HostInfo, d []byte, now time.Time) bool {
+	v, ok := tunnelQualityMagic.parse(d)
+	if tq == nil || !ok || len(d) != probeLen {
+		return false
+	}
+
+	rtt := now.Sub(time.Unix(0, int64(v)))
+	if rtt < 0 || rtt > tunnelQualityMaxRTT {
+		return true
+	}
+
+	hostinfo.quality.observeRTT(rtt, now)
+	return true
+}
+
+// observeRTT updates the smoothed rtt as described in RFC 6298
+func (s *tunnelQualityState) observeRTT(rtt time.Duration, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.rttSamples == 0 {
+		s.srtt = rtt
+		s.rttVar = rtt / 2
+	} else {
+		delta := s.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		s.rttVar = (3*s.rttVar + delta) / 4
+		s.srtt = (7*s.srtt + rtt) / 8
+	}
+
+	s.rttSamples++
+	s.lastRTT = now
+}
+
+// status returns the estimates for the tunnel or nil if nothing has been measured yet
+func (s *tunnelQualityState) status() *TunnelQualityStatus {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.lossValid && s.rttSamples == 0 {
+		return nil
+	}
+
+	return &TunnelQualityStatus{
+		Loss:       s.loss,
+		Received:   s.received,
+		Lost:       s.lost,
+		SRTT:       s.srtt,
+		RTTVar:     s.rttVar,
+		RTTSamples: s.rttSamples,
+		LastRTT:    s.lastRTT,
+	}
+}
+
+// newTunnelQualityEmitter returns a func that updates the per tunnel loss and rtt gauges, gauges for tunnels that are
+// gone are unregistered
+func newTunnelQualityEmitter(hm *HostMap, tq *TunnelQuality) func() {
+	reported := map[string]struct{}{}
+
+	return func() {
+		seen := map[string]struct{}{}
+		if tq != nil && tq.enabled.Load() {
+			hm.RLock()
+			hosts := make([]*HostInfo, 0, len(hm.Hosts))
+			for _, h := range hm.Hosts {
+				hosts = append(hosts, h)
+			}
+			hm.RUnlock()
+
+			for _, h := range hosts {
+				st := h.quality.status()
+				if st == nil {
+					continue
+				}
+
+				name := tunnelQualityMetricName(h)
+				metrics.GetOrRegisterGauge(name+".loss_ppm", nil).Update(int64(st.Loss * 1e6))
+				metrics.GetOrRegisterGauge(name+".srtt_us", nil).Update(st.SRTT.Microseconds())
+				seen[name] = struct{}{}
+			}
+		}
+
+		for name := range reported {
+			if _, ok := seen[name]; !ok {
+				metrics.Unregister(name + ".loss_ppm")
+				metrics.Unregister(name + ".srtt_us")
+			}
+		}
+		reported = seen
+	}
+}
+
+func tunnelQualityMetricName(h *HostInfo) string {
+	return fmt.Sprintf("tunnels.%s", strings.NewReplacer(".", "_", ":", "_").Replace(h.vpnIp.String()))
+}
@@ -0,0 +1,143 @@
+package nebula
+
+import (
+	"math"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelQuality_loss(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("tunnel_quality:\n  enabled: true\n  smoothing: 10s\n"))
+	tq := NewTunnelQualityFromConfig(l, c)
+
+	hostinfo := &HostInfo{ConnectionState: &ConnectionState{window: NewBits(ReplayWindow)}}
+	w := hostinfo.ConnectionState.window
+	now := time.Now()
+
+	// The first sample only sets the baseline
+	tq.sample(hostinfo, now)
+	assert.Nil(t, hostinfo.quality.status())
+
+	// 100 counters with every 10th one missing, the window has to move past them before they count
+	for i := uint64(1); i <= 100+ReplayWindow; i++ {
+		if i <= 100 && i%10 == 0 {
+			continue
+		}
+		w.Update(l, i)
+	}
+	now = now.Add(5 * time.Second)
+	tq.sample(hostinfo, now)
+	st := hostinfo.quality.status()
+	require.NotNil(t, st)
+	assert.EqualValues(t, 10, st.Lost)
+	assert.EqualValues(t, 90+ReplayWindow, st.Received)
+	assert.InDelta(t, 10.0/float64(100+ReplayWindow), st.Loss, 1e-9)
+
+	// Samples closer together than a second are skipped
+	w.Update(l, 200+ReplayWindow)
+	tq.sample(hostinfo, now.Add(500*time.Millisecond))
+	assert.EqualValues(t, 10, hostinfo.quality.status().Lost)
+
+	// A clean sample pulls the average down by how much time passed relative to the smoothing
+	loss := st.Loss
+	for i := uint64(101 + ReplayWindow); i <= 300+2*ReplayWindow; i++ {
+		w.Update(l, i)
+	}
+	now = now.Add(10 * time.Second)
+	tq.sample(hostinfo, now)
+	st = hostinfo.quality.status()
+	assert.InDelta(t, loss*math.Exp(-1), st.Loss, 1e-9)
+
+	// An idle tunnel keeps its estimate
+	now = now.Add(time.Minute)
+	tq.sample(hostinfo, now)
+	assert.Equal(t, st.Loss, hostinfo.quality.status().Loss)
+}
+
+func TestTunnelQuality_rtt(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	tq := NewTunnelQualityFromConfig(l, c)
+	hostinfo := &HostInfo{}
+	now := time.Now()
+
+	// Disabled sends the usual empty test payload
+	assert.Equal(t, []byte(""), tq.testPayload(hostinfo, now))
+	assert.False(t, tq.handleReply(hostinfo, []byte(""), now))
+
+	require.NoError(t, c.ReloadConfigString("tunnel_quality:\n  enabled: true\n"))
+	p := tq.testPayload(hostinfo, now)
+	assert.Len(t, p, probeLen)
+	assert.Equal(t, now, hostinfo.quality.lastProbe)
+
+	// Replies that are not ours are left for someone else
+	assert.False(t, tq.handleReply(hostinfo, []byte("something else"), now))
+	assert.False(t, tq.handleReply(hostinfo, append([]byte("nope"), p[4:]...), now))
+
+	assert.True(t, tq.handleReply(hostinfo, p, now.Add(100*time.Millisecond)))
+	st := hostinfo.quality.status()
+	require.NotNil(t, st)
+	assert.Equal(t, 100*time.Millisecond, st.SRTT)
+	assert.Equal(t, 50*time.Millisecond, st.RTTVar)
+	assert.EqualValues(t, 1, st.RTTSamples)
+
+	// Later samples are smoothed
+	assert.True(t, tq.handleReply(hostinfo, p, now.Add(180*time.Millisecond)))
+	st = hostinfo.quality.status()
+	assert.Equal(t, 110*time.Millisecond, st.SRTT)
+	assert.Equal(t, 57500*time.Microsecond, st.RTTVar)
+	assert.EqualValues(t, 2, st.RTTSamples)
+
+	// Replies from the future or too far in the past are ours but ignored
+	assert.True(t, tq.handleReply(hostinfo, p, now.Add(-time.Second)))
+	assert.True(t, tq.handleReply(hostinfo, p, now.Add(2*tunnelQualityMaxRTT)))
+	assert.EqualValues(t, 2, hostinfo.quality.status().RTTSamples)
+}
+
+func TestTunnelQuality_check(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("tunnel_quality:\n  enabled: true\n  probe_interval: 10s\n"))
+	tq := NewTunnelQualityFromConfig(l, c)
+	conn := &failingConn{}
+	f := &Interface{
+		l:                 l,
+		tunnelQuality:     tq,
+		writers:           []udp.Conn{conn},
+		connectionManager: &connectionManager{out: map[uint32]struct{}{}, outLock: &sync.RWMutex{}},
+	}
+
+	cs := &NebulaCipherState{c: noise.CipherChaChaPoly.Cipher([32]byte{1})}
+	hostinfo := &HostInfo{
+		remote:          netip.MustParseAddrPort("10.0.0.2:4242"),
+		ConnectionState: &ConnectionState{eKey: cs, dKey: cs, window: NewBits(ReplayWindow)},
+	}
+
+	now := time.Now()
+	nb, out := make([]byte, 12), make([]byte, mtu)
+	tq.check(f, hostinfo, now, nb, out)
+	assert.Len(t, conn.writes, 1)
+
+	// Not due yet
+	tq.check(f, hostinfo, now.Add(5*time.Second), nb, out)
+	assert.Len(t, conn.writes, 1)
+
+	tq.check(f, hostinfo, now.Add(10*time.Second), nb, out)
+	assert.Len(t, conn.writes, 2)
+
+	// A probe interval of 0 only samples
+	require.NoError(t, c.ReloadConfigString("tunnel_quality:\n  enabled: true\n  probe_interval: 0s\n"))
+	tq.check(f, hostinfo, now.Add(time.Hour), nb, out)
+	assert.Len(t, conn.writes, 2)
+}
@@ -0,0 +1,9 @@
+//go:build !linux || android
+// +build !linux android
+
+package udp
+
+// PinThread is only supported on Linux
+func PinThread(cpu int) error {
+	return errAffinityUnsupported
+}
@@ -0,0 +1,14 @@
+//go:build !android
+// +build !android
+
+package udp
+
+import "golang.org/x/sys/unix"
+
+// PinThread restricts the calling OS thread to cpu, the caller must hold runtime.LockOSThread for this to stick to
+// the goroutine
+func PinThread(cpu int) error {
+	var set unix.CPUSet
+	set.Set(cpu)
+	return unix.SchedSetaffinity(0, &set)
+}
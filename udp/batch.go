@@ -0,0 +1,65 @@
+package udp
+
+import "github.com/rcrowley/go-metrics"
+
+// batchGrowAfter is how many full reads in a row it takes to double the batch size
+const batchGrowAfter = 2
+
+// adaptiveBatch sizes each read from the kernel. Full reads in a row mean packets are queueing up so the batch grows
+// to save syscalls, a partial read means the queue was drained so the batch shrinks to keep the per read latency low.
+// The size always stays within min and max, a min equal to max gives the old fixed batch size.
+type adaptiveBatch struct {
+	min   int
+	max   int
+	size  int
+	full  int
+	gauge metrics.Gauge
+}
+
+func newAdaptiveBatch(min, max int, gauge metrics.Gauge) *adaptiveBatch {
+	// Start small, an idle socket has nothing queued
+	b := &adaptiveBatch{max: max, gauge: gauge}
+	b.setMin(min)
+	return b
+}
+
+// setMin changes the lower bound, values outside of 1 and max are clamped
+func (b *adaptiveBatch) setMin(min int) {
+	if min < 1 {
+		min = 1
+	}
+	if min > b.max {
+		min = b.max
+	}
+
+	b.min = min
+	b.full = 0
+	if b.size < min {
+		b.set(min)
+	}
+}
+
+// update records that the last read returned n packets and returns the size to use for the next read
+func (b *adaptiveBatch) update(n int) int {
+	if n >= b.size {
+		b.full++
+		if b.full >= batchGrowAfter && b.size < b.max {
+			b.full = 0
+			b.set(min(b.size*2, b.max))
+		}
+		return b.size
+	}
+
+	b.full = 0
+	if b.size > b.min {
+		b.set(max(b.size/2, b.min))
+	}
+	return b.size
+}
+
+func (b *adaptiveBatch) set(size int) {
+	b.size = size
+	if b.gauge != nil {
+		b.gauge.Update(int64(size))
+	}
+}
@@ -0,0 +1,49 @@
+package udp
+
+import (
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdaptiveBatch(t *testing.T) {
+	gauge := metrics.NewGauge()
+	b := newAdaptiveBatch(1, 64, gauge)
+	assert.Equal(t, 1, b.size)
+	assert.Equal(t, int64(1), gauge.Value())
+
+	// Full reads in a row double the size up to max
+	for _, want := range []int{1, 2, 2, 4, 4, 8, 8, 16, 16, 32, 32, 64, 64, 64} {
+		assert.Equal(t, want, b.update(b.size))
+	}
+	assert.Equal(t, int64(64), gauge.Value())
+
+	// A single full read in between partial reads does not grow
+	assert.Equal(t, 32, b.update(10))
+	assert.Equal(t, 32, b.update(32))
+	assert.Equal(t, 16, b.update(1))
+
+	// Partial reads halve the size down to min
+	for _, want := range []int{8, 4, 2, 1, 1} {
+		assert.Equal(t, want, b.update(0))
+	}
+	assert.Equal(t, int64(1), gauge.Value())
+
+	// Raising min raises the size with it
+	b.setMin(8)
+	assert.Equal(t, 8, b.size)
+	assert.Equal(t, 8, b.update(1))
+
+	// min is clamped
+	b.setMin(100)
+	assert.Equal(t, 64, b.min)
+	assert.Equal(t, 64, b.update(1))
+	b.setMin(0)
+	assert.Equal(t, 1, b.min)
+
+	// min equal to max is a fixed batch size
+	b = newAdaptiveBatch(64, 64, nil)
+	assert.Equal(t, 64, b.update(1))
+	assert.Equal(t, 64, b.update(64))
+}
@@ -1,8 +1,10 @@
 package udp
 
 import (
+	"errors"
 	"net/netip"
 
+	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/header"
@@ -14,6 +16,7 @@ type EncReader func(
 	addr netip.AddrPort,
 	out []byte,
 	packet []byte,
+	ecn uint8,
 	header *header.H,
 	fwPacket *firewall.Packet,
 	lhh LightHouseHandlerFunc,
@@ -22,6 +25,41 @@ type EncReader func(
 	localCache firewall.ConntrackCache,
 )
 
+// ECNWriter is implemented by a Conn that can set the ECN codepoint of the outer ip header on a per packet basis
+type ECNWriter interface {
+	WriteToECN(b []byte, addr netip.AddrPort, ecn uint8) error
+}
+
+// SourceWriter is implemented by a Conn that can choose the source address of the outer ip header on a per packet
+// basis, for hosts with more than one underlay address
+type SourceWriter interface {
+	WriteToFrom(b []byte, addr netip.AddrPort, src netip.Addr, ecn uint8) error
+}
+
+// DontWaitWriter is implemented by a Conn that can send without waiting for room in the socket send buffer, a write
+// that would block fails with EAGAIN instead. src is optional as in WriteToFrom, the zero Addr lets the kernel choose.
+type DontWaitWriter interface {
+	WriteToDontWait(b []byte, addr netip.AddrPort, src netip.Addr, ecn uint8) error
+}
+
+// ErrSourceUnavailable is returned by WriteToFrom when the source address may not be assigned to this host, an unreachable
+// remote can be reported the same way
+var ErrSourceUnavailable = errors.New("the source address is not available on this host")
+
+// SocketStats are the effective kernel settings and counters for a udp socket
+type SocketStats struct {
+	// RecvBuffer and SendBuffer are the sizes reported by the kernel, linux reports double the requested size
+	RecvBuffer int `json:"recvBuffer"`
+	SendBuffer int `json:"sendBuffer"`
+	// Drops is the number of packets the kernel dropped for this socket, nil if the platform does not report it
+	Drops *uint32 `json:"drops,omitempty"`
+}
+
+// StatsConn is implemented by a Conn that can report its SocketStats
+type StatsConn interface {
+	SocketStats() (SocketStats, error)
+}
+
 type Conn interface {
 	Rebind() error
 	LocalAddr() (netip.AddrPort, error)
@@ -31,6 +69,32 @@ type Conn interface {
 	Close() error
 }
 
+// errDontFragmentUnsupported is returned on platforms that can not set the don't fragment bit on outgoing packets
+var errDontFragmentUnsupported = errors.New("not supported on this platform")
+
+// errAffinityUnsupported is returned by PinThread on platforms without sched_setaffinity
+var errAffinityUnsupported = errors.New("cpu affinity is not supported on this platform")
+
+// reloadDontFragment applies listen.dont_fragment with set. Nothing is done on the initial load unless it is enabled so
+// the platform default is left alone.
+func reloadDontFragment(l *logrus.Logger, c *config.C, set func(bool) error) {
+	if !c.InitialLoad() && !c.HasChanged("listen.dont_fragment") {
+		return
+	}
+
+	on := c.GetBool("listen.dont_fragment", false)
+	if c.InitialLoad() && !on {
+		return
+	}
+
+	if err := set(on); err != nil {
+		l.WithError(err).Warn("Failed to set listen.dont_fragment, the kernel may fragment outgoing packets")
+		return
+	}
+
+	l.WithField("dontFragment", on).Info("listen.dont_fragment was set")
+}
+
 type NoopConn struct{}
 
 func (NoopConn) Rebind() error {
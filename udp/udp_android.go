@@ -43,3 +43,27 @@ func NewListenConfig(multi bool) net.ListenConfig {
 func (u *GenericConn) Rebind() error {
 	return nil
 }
+
+// setDontFragment sets IP_PMTUDISC_DO so the DF bit is set on every outgoing packet and sends larger than the path mtu
+// fail instead of being fragmented. When off the socket is returned to the linux default.
+func setDontFragment(fd uintptr, on bool) error {
+	v4, v6 := unix.IP_PMTUDISC_WANT, unix.IPV6_PMTUDISC_WANT
+	if on {
+		v4, v6 = unix.IP_PMTUDISC_DO, unix.IPV6_PMTUDISC_DO
+	}
+
+	// ipv6 sockets also send ipv4 traffic to v4 mapped addresses, those use IP_MTU_DISCOVER
+	if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, v4); err != nil {
+		return err
+	}
+
+	sa, err := unix.Getsockname(int(fd))
+	if err != nil {
+		return err
+	}
+
+	if _, ok := sa.(*unix.SockaddrInet6); ok {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, v6)
+	}
+	return nil
+}
@@ -56,3 +56,30 @@ func (u *GenericConn) Rebind() error {
 		}
 	})
 }
+
+// setDontFragment sets IP_DONTFRAG and IPV6_DONTFRAG so sends larger than the path mtu fail instead of being
+// fragmented. ipv4 traffic on a dual stack ipv6 socket is only covered if the kernel accepts IP_DONTFRAG there too.
+func setDontFragment(fd uintptr, on bool) error {
+	v := 0
+	if on {
+		v = 1
+	}
+
+	sa, err := unix.Getsockname(int(fd))
+	if err != nil {
+		return err
+	}
+
+	if _, ok := sa.(*unix.SockaddrInet6); ok {
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, v); err != nil {
+			return err
+		}
+
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_DONTFRAG, v); err != nil {
+			return fmt.Errorf("ipv4 on a dual stack socket: %w", err)
+		}
+		return nil
+	}
+
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_DONTFRAG, v)
+}
@@ -60,7 +60,23 @@ func (u *GenericConn) LocalAddr() (netip.AddrPort, error) {
 }
 
 func (u *GenericConn) ReloadConfig(c *config.C) {
-	// TODO
+	reloadDontFragment(u.l, c, u.setDontFragment)
+}
+
+func (u *GenericConn) setDontFragment(on bool) error {
+	rc, err := u.UDPConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var setErr error
+	err = rc.Control(func(fd uintptr) {
+		setErr = setDontFragment(fd, on)
+	})
+	if err != nil {
+		return err
+	}
+	return setErr
 }
 
 func NewUDPStatsEmitter(udpConns []Conn) func() {
@@ -91,6 +107,7 @@ func (u *GenericConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *f
 			netip.AddrPortFrom(rua.Addr().Unmap(), rua.Port()),
 			plaintext[:0],
 			buffer[:n],
+			0,
 			h,
 			fwPacket,
 			lhf,
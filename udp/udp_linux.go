@@ -5,9 +5,12 @@ package udp
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
@@ -21,11 +24,23 @@ import (
 
 //TODO: make it support reload as best you can!
 
+// controlLen is large enough to hold a single IP_TOS or IPV6_TCLASS control message
+var controlLen = unix.CmsgSpace(4)
+
+// sendControlLen is large enough to hold the pktinfo and ecn control messages sendmsg sets
+var sendControlLen = unix.CmsgSpace(unix.SizeofInet6Pktinfo) + unix.CmsgSpace(4)
+
 type StdConn struct {
 	sysFd int
 	isV4  bool
 	l     *logrus.Logger
 	batch int
+
+	// batchMin is the smallest read batch, see listen.batch_min
+	batchMin atomic.Int64
+
+	// oobs holds the control message buffers of sendmsg, a writer can be used by more than one routine
+	oobs sync.Pool
 }
 
 func maybeIPV4(ip net.IP) (net.IP, bool) {
@@ -79,7 +94,9 @@ func NewListener(l *logrus.Logger, ip netip.Addr, port int, multi bool, batch in
 	//v, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_INCOMING_CPU)
 	//l.Println(v, err)
 
-	return &StdConn{sysFd: fd, isV4: ip.Is4(), l: l, batch: batch}, err
+	u := &StdConn{sysFd: fd, isV4: ip.Is4(), l: l, batch: batch}
+	u.batchMin.Store(int64(batch))
+	return u, err
 }
 
 func (u *StdConn) Rebind() error {
@@ -87,11 +104,21 @@ func (u *StdConn) Rebind() error {
 }
 
 func (u *StdConn) SetRecvBuffer(n int) error {
-	return unix.SetsockoptInt(u.sysFd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, n)
+	err := unix.SetsockoptInt(u.sysFd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, n)
+	if errors.Is(err, unix.EPERM) {
+		// Without CAP_NET_ADMIN we can still ask, the kernel will clamp to net.core.rmem_max
+		err = unix.SetsockoptInt(u.sysFd, unix.SOL_SOCKET, unix.SO_RCVBUF, n)
+	}
+	return err
 }
 
 func (u *StdConn) SetSendBuffer(n int) error {
-	return unix.SetsockoptInt(u.sysFd, unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, n)
+	err := unix.SetsockoptInt(u.sysFd, unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, n)
+	if errors.Is(err, unix.EPERM) {
+		// Without CAP_NET_ADMIN we can still ask, the kernel will clamp to net.core.wmem_max
+		err = unix.SetsockoptInt(u.sysFd, unix.SOL_SOCKET, unix.SO_SNDBUF, n)
+	}
+	return err
 }
 
 func (u *StdConn) GetRecvBuffer() (int, error) {
@@ -127,22 +154,27 @@ func (u *StdConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firew
 	var ip netip.Addr
 	nb := make([]byte, 12, 12)
 
-	//TODO: should we track this?
-	//metric := metrics.GetOrRegisterHistogram("test.batch_read", nil, metrics.NewExpDecaySample(1028, 0.015))
-	msgs, buffers, names := u.PrepareRawMessages(u.batch)
+	msgs, buffers, names, controls := u.PrepareRawMessages(u.batch)
 	read := u.ReadMulti
 	if u.batch == 1 {
 		read = u.ReadSingle
 	}
 
+	batch := newAdaptiveBatch(int(u.batchMin.Load()), u.batch, metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.batch", q), nil))
+	size := batch.size
+
 	for {
-		n, err := read(msgs)
+		n, err := read(msgs[:size])
 		if err != nil {
 			u.l.WithError(err).Debug("udp socket is closed, exiting read loop")
 			return
 		}
 
-		//metric.Update(int64(n))
+		if m := int(u.batchMin.Load()); m != batch.min {
+			batch.setMin(m)
+		}
+		size = batch.update(n)
+
 		for i := 0; i < n; i++ {
 			if u.isV4 {
 				ip, _ = netip.AddrFromSlice(names[i][4:8])
@@ -151,10 +183,19 @@ func (u *StdConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firew
 				ip, _ = netip.AddrFromSlice(names[i][8:24])
 				//TODO: IPV6-WORK what is not ok?
 			}
+			var ecn uint8
+			if msgs[i].Hdr.Controllen > 0 {
+				ecn = parseECN(controls[i][:msgs[i].Hdr.Controllen])
+			}
+			// The kernel sets the length to 0 for a packet without control messages, restore it for the next read even
+			// then or listen.ecn enabled on reload would never get a control message through
+			msgs[i].resetControl(controls[i])
+
 			r(
 				netip.AddrPortFrom(ip.Unmap(), binary.BigEndian.Uint16(names[i][2:4])),
 				plaintext[:0],
 				buffers[i][:msgs[i].Len],
+				ecn,
 				h,
 				fwPacket,
 				lhf,
@@ -272,36 +313,275 @@ func (u *StdConn) writeTo4(b []byte, ip netip.AddrPort) error {
 	}
 }
 
-func (u *StdConn) ReloadConfig(c *config.C) {
-	b := c.GetInt("listen.read_buffer", 0)
-	if b > 0 {
-		err := u.SetRecvBuffer(b)
-		if err == nil {
-			s, err := u.GetRecvBuffer()
-			if err == nil {
-				u.l.WithField("size", s).Info("listen.read_buffer was set")
-			} else {
-				u.l.WithError(err).Warn("Failed to get listen.read_buffer")
-			}
+// WriteToECN sends b with the ECN bits of the outer ip header set to ecn
+func (u *StdConn) WriteToECN(b []byte, ip netip.AddrPort, ecn uint8) error {
+	if ecn == 0 {
+		return u.WriteTo(b, ip)
+	}
+
+	var sa unix.Sockaddr
+	var oob []byte
+	if u.isV4 {
+		if !ip.Addr().Is4() {
+			return fmt.Errorf("Listener is IPv4, but writing to IPv6 remote")
+		}
+		sa = &unix.SockaddrInet4{Port: int(ip.Port()), Addr: ip.Addr().As4()}
+		oob = ecnControlMessage(unix.IPPROTO_IP, unix.IP_TOS, ecn)
+
+	} else {
+		sa = &unix.SockaddrInet6{Port: int(ip.Port()), Addr: ip.Addr().As16()}
+		if ip.Addr().Is4() {
+			// v4 mapped destinations are sent through the ipv4 stack which only looks at ipv4 control messages
+			oob = ecnControlMessage(unix.IPPROTO_IP, unix.IP_TOS, ecn)
 		} else {
-			u.l.WithError(err).Error("Failed to set listen.read_buffer")
+			oob = ecnControlMessage(unix.IPPROTO_IPV6, unix.IPV6_TCLASS, ecn)
 		}
 	}
 
-	b = c.GetInt("listen.write_buffer", 0)
-	if b > 0 {
-		err := u.SetSendBuffer(b)
-		if err == nil {
-			s, err := u.GetSendBuffer()
-			if err == nil {
-				u.l.WithField("size", s).Info("listen.write_buffer was set")
-			} else {
-				u.l.WithError(err).Warn("Failed to get listen.write_buffer")
+	_, err := unix.SendmsgN(u.sysFd, b, oob, sa, 0)
+	if err != nil {
+		return &net.OpError{Op: "sendmsg", Err: err}
+	}
+
+	return nil
+}
+
+// WriteToFrom sends b from the local address src with the ECN bits of the outer ip header set to ecn. The source is set
+// with an IP_PKTINFO or IPV6_PKTINFO control message, it must be assigned to this host. src must be the same family as
+// the destination, ipv4 for v4 mapped destinations on an ipv6 socket.
+func (u *StdConn) WriteToFrom(b []byte, ip netip.AddrPort, src netip.Addr, ecn uint8) error {
+	return u.sendmsg(b, ip, src, ecn, 0)
+}
+
+// WriteToDontWait sends b like WriteToFrom with MSG_DONTWAIT, a full send buffer fails the write with EAGAIN instead of
+// blocking. The source is only set if src is valid.
+func (u *StdConn) WriteToDontWait(b []byte, ip netip.AddrPort, src netip.Addr, ecn uint8) error {
+	return u.sendmsg(b, ip, src, ecn, unix.MSG_DONTWAIT)
+}
+
+// sendmsg sends b to ip with the control messages for src, unless it is the zero Addr, and ecn, unless it is 0
+func (u *StdConn) sendmsg(b []byte, ip netip.AddrPort, src netip.Addr, ecn uint8, flags int) error {
+	var sa unix.Sockaddr
+	if u.isV4 {
+		if !ip.Addr().Is4() {
+			return fmt.Errorf("Listener is IPv4, but writing to IPv6 remote")
+		}
+		sa = &unix.SockaddrInet4{Port: int(ip.Port()), Addr: ip.Addr().As4()}
+	} else {
+		sa = &unix.SockaddrInet6{Port: int(ip.Port()), Addr: ip.Addr().As16()}
+	}
+
+	oobp, _ := u.oobs.Get().(*[]byte)
+	if oobp == nil {
+		oob := make([]byte, 0, sendControlLen)
+		oobp = &oob
+	}
+	defer u.oobs.Put(oobp)
+
+	oob := (*oobp)[:0]
+	src = src.Unmap()
+	if ip.Addr().Unmap().Is4() {
+		// v4 mapped destinations are sent through the ipv4 stack which only looks at ipv4 control messages
+		if src.IsValid() {
+			if !src.Is4() {
+				return fmt.Errorf("source %v can not be used for the ipv4 remote %v", src, ip)
 			}
-		} else {
-			u.l.WithError(err).Error("Failed to set listen.write_buffer")
+			oob = appendPktinfo4ControlMessage(oob, src)
+		}
+		if ecn != 0 {
+			oob = appendECNControlMessage(oob, unix.IPPROTO_IP, unix.IP_TOS, ecn)
+		}
+	} else {
+		if src.IsValid() {
+			if !src.Is6() {
+				return fmt.Errorf("source %v can not be used for the ipv6 remote %v", src, ip)
+			}
+			oob = appendPktinfo6ControlMessage(oob, src)
+		}
+		if ecn != 0 {
+			oob = appendECNControlMessage(oob, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, ecn)
+		}
+	}
+
+	_, err := unix.SendmsgN(u.sysFd, b, oob, sa, flags)
+	if err != nil {
+		// The kernel refuses a source that is not one of our addresses, ipv4 reports it as an unreachable network. The
+		// caller can tell by sending again without a source.
+		if src.IsValid() && (errors.Is(err, unix.ENETUNREACH) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EADDRNOTAVAIL)) {
+			return &net.OpError{Op: "sendmsg", Err: fmt.Errorf("%w: %v: %w", ErrSourceUnavailable, src, err)}
 		}
+		return &net.OpError{Op: "sendmsg", Err: err}
 	}
+
+	return nil
+}
+
+// appendControlMessage appends a zeroed control message with room for dataLen bytes of data to b and returns the data
+func appendControlMessage(b []byte, level, typ int, dataLen int) ([]byte, []byte) {
+	n := len(b)
+	b = append(b, make([]byte, unix.CmsgSpace(dataLen))...)
+	clear(b[n:])
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[n]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(unix.CmsgLen(dataLen))
+	data := n + unix.CmsgLen(0)
+	return b, b[data : data+dataLen]
+}
+
+func appendPktinfo4ControlMessage(b []byte, src netip.Addr) []byte {
+	b, data := appendControlMessage(b, unix.IPPROTO_IP, unix.IP_PKTINFO, unix.SizeofInet4Pktinfo)
+	info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+	info.Spec_dst = src.As4()
+	return b
+}
+
+func appendPktinfo6ControlMessage(b []byte, src netip.Addr) []byte {
+	b, data := appendControlMessage(b, unix.IPPROTO_IPV6, unix.IPV6_PKTINFO, unix.SizeofInet6Pktinfo)
+	info := (*unix.Inet6Pktinfo)(unsafe.Pointer(&data[0]))
+	info.Addr = src.As16()
+	return b
+}
+
+func appendECNControlMessage(b []byte, level, typ int, ecn uint8) []byte {
+	b, data := appendControlMessage(b, level, typ, 4)
+	binary.NativeEndian.PutUint32(data, uint32(ecn))
+	return b
+}
+
+func ecnControlMessage(level, typ int, ecn uint8) []byte {
+	return appendECNControlMessage(nil, level, typ, ecn)
+}
+
+// parseECN returns the ECN bits from an IP_TOS or IPV6_TCLASS control message, if present
+func parseECN(oob []byte) uint8 {
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+
+	for _, cmsg := range cmsgs {
+		switch {
+		case cmsg.Header.Level == unix.IPPROTO_IP && cmsg.Header.Type == unix.IP_TOS && len(cmsg.Data) >= 1:
+			return cmsg.Data[0] & 0x03
+		case cmsg.Header.Level == unix.IPPROTO_IPV6 && cmsg.Header.Type == unix.IPV6_TCLASS && len(cmsg.Data) >= 4:
+			return uint8(binary.NativeEndian.Uint32(cmsg.Data)) & 0x03
+		}
+	}
+
+	return 0
+}
+
+func (u *StdConn) setRecvECN(enable bool) error {
+	v := 0
+	if enable {
+		v = 1
+	}
+
+	// ipv6 sockets also receive ipv4 traffic as v4 mapped addresses, those report IP_TOS
+	if err := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IP, unix.IP_RECVTOS, v); err != nil {
+		return err
+	}
+
+	if !u.isV4 {
+		return unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, v)
+	}
+
+	return nil
+}
+
+// setDontFragment sets the DF bit on every outgoing ipv4 packet and refuses to fragment ipv6 packets locally. Sends
+// larger than the path mtu the kernel has learned from frag-needed messages fail with EMSGSIZE. When off the socket is
+// returned to the linux default, which sets DF but fragments locally once a smaller path mtu is known.
+func (u *StdConn) setDontFragment(on bool) error {
+	v4, v6 := unix.IP_PMTUDISC_WANT, unix.IPV6_PMTUDISC_WANT
+	if on {
+		v4, v6 = unix.IP_PMTUDISC_DO, unix.IPV6_PMTUDISC_DO
+	}
+
+	// ipv6 sockets also send ipv4 traffic to v4 mapped addresses, those use IP_MTU_DISCOVER
+	if err := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, v4); err != nil {
+		return err
+	}
+
+	if !u.isV4 {
+		return unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, v6)
+	}
+
+	return nil
+}
+
+func (u *StdConn) ReloadConfig(c *config.C) {
+	if c.InitialLoad() || c.HasChanged("listen.ecn") {
+		err := u.setRecvECN(c.GetBool("listen.ecn", false))
+		if err != nil {
+			u.l.WithError(err).Error("Failed to set listen.ecn")
+		}
+	}
+
+	reloadDontFragment(u.l, c, u.setDontFragment)
+
+	if c.InitialLoad() || c.HasChanged("listen.batch_min") {
+		m := c.GetInt("listen.batch_min", u.batch)
+		if m < 1 || m > u.batch {
+			u.l.WithField("batch_min", m).WithField("batch", u.batch).Warn("listen.batch_min must be between 1 and listen.batch")
+			m = max(1, min(m, u.batch))
+		}
+		u.batchMin.Store(int64(m))
+	}
+
+	u.reloadBuffer("listen.read_buffer", "net.core.rmem_max", c.GetInt("listen.read_buffer", 0), u.SetRecvBuffer, u.GetRecvBuffer)
+	u.reloadBuffer("listen.write_buffer", "net.core.wmem_max", c.GetInt("listen.write_buffer", 0), u.SetSendBuffer, u.GetSendBuffer)
+}
+
+// reloadBuffer sets a socket buffer and verifies the size the kernel granted, the kernel doubles the requested size
+// to account for bookkeeping so anything less than double was clamped
+func (u *StdConn) reloadBuffer(key, sysctl string, want int, set func(int) error, get func() (int, error)) {
+	if want <= 0 {
+		return
+	}
+
+	err := set(want)
+	if err != nil {
+		u.l.WithError(err).Errorf("Failed to set %s", key)
+		return
+	}
+
+	got, err := get()
+	if err != nil {
+		u.l.WithError(err).Warnf("Failed to get %s", key)
+		return
+	}
+
+	if got/2 < want {
+		u.l.WithField("requested", want).WithField("size", got).
+			Warnf("%s was clamped by the kernel, raise %s or run with CAP_NET_ADMIN", key, sysctl)
+		return
+	}
+
+	u.l.WithField("size", got).Infof("%s was set", key)
+}
+
+// SocketStats returns the effective buffer sizes and the kernel drop count for this socket
+func (u *StdConn) SocketStats() (SocketStats, error) {
+	var err error
+	var stats SocketStats
+	if stats.RecvBuffer, err = u.GetRecvBuffer(); err != nil {
+		return stats, err
+	}
+
+	if stats.SendBuffer, err = u.GetSendBuffer(); err != nil {
+		return stats, err
+	}
+
+	// SO_MEMINFO is not available on older kernels, drops are left unset
+	var meminfo [unix.SK_MEMINFO_VARS]uint32
+	if err := u.getMemInfo(&meminfo); err == nil {
+		drops := meminfo[unix.SK_MEMINFO_DROPS]
+		stats.Drops = &drops
+	}
+
+	return stats, nil
 }
 
 func (u *StdConn) getMemInfo(meminfo *[unix.SK_MEMINFO_VARS]uint32) error {
@@ -30,14 +30,16 @@ type rawMessage struct {
 	Len uint32
 }
 
-func (u *StdConn) PrepareRawMessages(n int) ([]rawMessage, [][]byte, [][]byte) {
+func (u *StdConn) PrepareRawMessages(n int) ([]rawMessage, [][]byte, [][]byte, [][]byte) {
 	msgs := make([]rawMessage, n)
 	buffers := make([][]byte, n)
 	names := make([][]byte, n)
+	controls := make([][]byte, n)
 
 	for i := range msgs {
 		buffers[i] = make([]byte, MTU)
 		names[i] = make([]byte, unix.SizeofSockaddrInet6)
+		controls[i] = make([]byte, controlLen)
 
 		//TODO: this is still silly, no need for an array
 		vs := []iovec{
@@ -49,7 +51,15 @@ func (u *StdConn) PrepareRawMessages(n int) ([]rawMessage, [][]byte, [][]byte) {
 
 		msgs[i].Hdr.Name = &names[i][0]
 		msgs[i].Hdr.Namelen = uint32(len(names[i]))
+
+		msgs[i].Hdr.Control = &controls[i][0]
+		msgs[i].Hdr.Controllen = uint32(len(controls[i]))
 	}
 
-	return msgs, buffers, names
+	return msgs, buffers, names, controls
+}
+
+// resetControl restores the control buffer length, the kernel overwrites it with the length actually used on receive
+func (r *rawMessage) resetControl(control []byte) {
+	r.Hdr.Controllen = uint32(len(control))
 }
@@ -0,0 +1,434 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package udp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestStdConn_SocketStats(t *testing.T) {
+	l := test.NewLogger()
+	conn, err := NewListener(l, netip.MustParseAddr("127.0.0.1"), 0, false, 64)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Small enough to fit under the default net.core.rmem_max and wmem_max without CAP_NET_ADMIN
+	c := config.NewC(l)
+	c.Settings["listen"] = map[interface{}]interface{}{
+		"read_buffer":  65536,
+		"write_buffer": 65536,
+	}
+	conn.ReloadConfig(c)
+
+	stats, err := conn.(StatsConn).SocketStats()
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, stats.RecvBuffer, 2*65536)
+	assert.GreaterOrEqual(t, stats.SendBuffer, 2*65536)
+	if assert.NotNil(t, stats.Drops) {
+		assert.Equal(t, uint32(0), *stats.Drops)
+	}
+}
+
+func TestStdConn_DontFragment(t *testing.T) {
+	l := test.NewLogger()
+	conn, err := NewListener(l, netip.MustParseAddr("::"), 0, false, 64)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fd := conn.(*StdConn).sysFd
+	getopt := func(level, opt int) int {
+		v, err := unix.GetsockoptInt(fd, level, opt)
+		require.NoError(t, err)
+		return v
+	}
+
+	c := config.NewC(l)
+	c.Settings["listen"] = map[interface{}]interface{}{"dont_fragment": true}
+	conn.ReloadConfig(c)
+	assert.Equal(t, unix.IP_PMTUDISC_DO, getopt(unix.IPPROTO_IP, unix.IP_MTU_DISCOVER))
+	assert.Equal(t, unix.IPV6_PMTUDISC_DO, getopt(unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER))
+
+	require.NoError(t, c.ReloadConfigString("listen:\n  dont_fragment: false"))
+	conn.ReloadConfig(c)
+	assert.Equal(t, unix.IP_PMTUDISC_WANT, getopt(unix.IPPROTO_IP, unix.IP_MTU_DISCOVER))
+	assert.Equal(t, unix.IPV6_PMTUDISC_WANT, getopt(unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER))
+}
+
+func TestStdConn_ListenOut_ecnReload(t *testing.T) {
+	l := test.NewLogger()
+	for _, batch := range []int{1, 64} {
+		conn, err := NewListener(l, netip.MustParseAddr("127.0.0.1"), 0, false, batch)
+		require.NoError(t, err)
+		u := conn.(*StdConn)
+		// The read loop exits once the socket goes quiet
+		tv := unix.NsecToTimeval(int64(200 * time.Millisecond))
+		require.NoError(t, unix.SetsockoptTimeval(u.sysFd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv))
+
+		c := config.NewC(l)
+		require.NoError(t, c.LoadString("listen: {ecn: false}"))
+		conn.ReloadConfig(c)
+
+		received := make(chan uint8, 10)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			conn.ListenOut(func(_ netip.AddrPort, _ []byte, _ []byte, ecn uint8, _ *header.H, _ *firewall.Packet, _ LightHouseHandlerFunc, _ []byte, _ int, _ firewall.ConntrackCache) {
+				received <- ecn
+			}, nil, firewall.NewConntrackCacheTicker(0), 0)
+		}()
+
+		addr, err := conn.LocalAddr()
+		require.NoError(t, err)
+		s, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(addr))
+		require.NoError(t, err)
+		sc, err := s.SyscallConn()
+		require.NoError(t, err)
+		require.NoError(t, sc.Control(func(fd uintptr) {
+			require.NoError(t, unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, 2))
+		}))
+
+		read := func() uint8 {
+			_, err := s.Write([]byte("hi"))
+			require.NoError(t, err)
+			select {
+			case ecn := <-received:
+				return ecn
+			case <-time.After(time.Second):
+				t.Fatal("no packet was read")
+				return 0
+			}
+		}
+
+		assert.Equal(t, uint8(0), read(), batch)
+
+		t.Log("Enabling listen.ecn takes effect after packets without control messages were read")
+		require.NoError(t, c.ReloadConfigString("listen: {ecn: true}"))
+		conn.ReloadConfig(c)
+		assert.Equal(t, uint8(2), read(), batch)
+
+		s.Close()
+		<-done
+		conn.Close()
+	}
+}
+
+func TestStdConn_WriteToFrom(t *testing.T) {
+	l := test.NewLogger()
+
+	// Every address in 127.0.0.0/8 is assigned to lo, which makes it a multi-address host
+	recv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer recv.Close()
+	dst := recv.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	read := func() netip.Addr {
+		b := make([]byte, 16)
+		require.NoError(t, recv.SetReadDeadline(time.Now().Add(time.Second)))
+		n, from, err := recv.ReadFromUDPAddrPort(b)
+		require.NoError(t, err)
+		assert.Equal(t, "hi", string(b[:n]))
+		return from.Addr().Unmap()
+	}
+
+	for _, host := range []string{"0.0.0.0", "::"} {
+		conn, err := NewListener(l, netip.MustParseAddr(host), 0, false, 64)
+		if err != nil && host == "::" {
+			t.Log("Skipping the ipv6 socket, ipv6 is not available")
+			continue
+		}
+		require.NoError(t, err)
+		w := conn.(SourceWriter)
+
+		for _, src := range []string{"127.0.0.2", "127.0.0.3"} {
+			require.NoError(t, w.WriteToFrom([]byte("hi"), dst, netip.MustParseAddr(src), 0), host)
+			assert.Equal(t, netip.MustParseAddr(src), read(), host)
+		}
+
+		t.Log("ECN can be set along with the source")
+		require.NoError(t, w.WriteToFrom([]byte("hi"), dst, netip.MustParseAddr("127.0.0.2"), 2), host)
+		assert.Equal(t, netip.MustParseAddr("127.0.0.2"), read(), host)
+
+		t.Log("A source that is not ours is refused")
+		err = w.WriteToFrom([]byte("hi"), dst, netip.MustParseAddr("192.0.2.1"), 0)
+		assert.ErrorIs(t, err, ErrSourceUnavailable, host)
+
+		t.Log("The source must match the family of the remote")
+		assert.Error(t, w.WriteToFrom([]byte("hi"), dst, netip.MustParseAddr("::1"), 0), host)
+
+		conn.Close()
+	}
+}
+
+func TestSendControlMessages(t *testing.T) {
+	oob := make([]byte, 0, sendControlLen)
+	for _, src := range []string{"127.0.0.2", "fd00::2"} {
+		addr := netip.MustParseAddr(src)
+		b := oob[:0]
+		if addr.Is4() {
+			b = appendPktinfo4ControlMessage(b, addr)
+			b = appendECNControlMessage(b, unix.IPPROTO_IP, unix.IP_TOS, 2)
+		} else {
+			b = appendPktinfo6ControlMessage(b, addr)
+			b = appendECNControlMessage(b, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, 2)
+		}
+		assert.Equal(t, &oob[:1][0], &b[0], "the buffer is reused, %v", src)
+
+		cmsgs, err := unix.ParseSocketControlMessage(b)
+		require.NoError(t, err)
+		require.Len(t, cmsgs, 2)
+		if addr.Is4() {
+			assert.Equal(t, int32(unix.IP_PKTINFO), cmsgs[0].Header.Type)
+			assert.Equal(t, addr.AsSlice(), cmsgs[0].Data[4:8], "spec_dst")
+		} else {
+			assert.Equal(t, int32(unix.IPV6_PKTINFO), cmsgs[0].Header.Type)
+			assert.Equal(t, addr.AsSlice(), cmsgs[0].Data[:16])
+		}
+		assert.Equal(t, uint8(2), parseECN(b[len(b)-unix.CmsgSpace(4):]))
+	}
+}
+
+func TestPinThread(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var allowed unix.CPUSet
+	require.NoError(t, unix.SchedGetaffinity(0, &allowed))
+	defer unix.SchedSetaffinity(0, &allowed)
+
+	cpu := allowedCPUs(t)[0]
+	require.NoError(t, PinThread(cpu))
+
+	var set unix.CPUSet
+	require.NoError(t, unix.SchedGetaffinity(0, &set))
+	assert.Equal(t, 1, set.Count())
+	assert.True(t, set.IsSet(cpu))
+
+	assert.Error(t, PinThread(100000))
+}
+
+// allowedCPUs returns the cpus this process may run on, in order
+func allowedCPUs(tb testing.TB) []int {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		tb.Fatal(err)
+	}
+
+	var cpus []int
+	for i := 0; i < len(set)*64; i++ {
+		if set.IsSet(i) {
+			cpus = append(cpus, i)
+		}
+	}
+	return cpus
+}
+
+// BenchmarkAdaptiveBatch reads bursts of packets with a fixed and an adaptive batch size. syscalls/pkt shows the
+// throughput side, fewer is better under load. first-pkt-ns is how long the read holding the first packet of a burst
+// took, the kernel copies the whole batch before returning so large batches delay the first packet.
+//
+//	go test -run XXX -bench AdaptiveBatch ./udp
+func BenchmarkAdaptiveBatch(b *testing.B) {
+	const batch = 64
+	l := test.NewLogger()
+	payload := make([]byte, 1200)
+
+	for _, burst := range []int{1, 8, 64, 512} {
+		for _, mode := range []struct {
+			name string
+			min  int
+		}{{"fixed", batch}, {"adaptive", 1}} {
+			b.Run(fmt.Sprintf("burst=%d/%s", burst, mode.name), func(b *testing.B) {
+				c, err := NewListener(l, netip.MustParseAddr("127.0.0.1"), 0, false, batch)
+				require.NoError(b, err)
+				defer c.Close()
+				u := c.(*StdConn)
+				require.NoError(b, u.SetRecvBuffer(4*1024*1024))
+
+				addr, err := c.LocalAddr()
+				require.NoError(b, err)
+				s, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(addr))
+				require.NoError(b, err)
+				defer s.Close()
+
+				msgs, _, _, _ := u.PrepareRawMessages(batch)
+				ab := newAdaptiveBatch(mode.min, batch, nil)
+				size := ab.size
+				var syscalls int
+				var first time.Duration
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					for j := 0; j < burst; j++ {
+						_, err := s.Write(payload)
+						if err != nil {
+							b.Fatal(err)
+						}
+					}
+
+					for got := 0; got < burst; {
+						start := time.Now()
+						n, err := u.ReadMulti(msgs[:size])
+						if err != nil {
+							b.Fatal(err)
+						}
+						if got == 0 {
+							first += time.Since(start)
+						}
+						syscalls++
+						got += n
+						size = ab.update(n)
+					}
+				}
+
+				b.ReportMetric(float64(syscalls)/float64(b.N*burst), "syscalls/pkt")
+				b.ReportMetric(float64(first.Nanoseconds())/float64(b.N), "first-pkt-ns")
+			})
+		}
+	}
+}
+
+// paddedCounter keeps each routine's counter on its own cache line
+type paddedCounter struct {
+	atomic.Uint64
+	_ [56]byte
+}
+
+// BenchmarkReusePortScaling measures inbound packet rate with one SO_REUSEPORT socket per reader routine. The number
+// of routines follows GOMAXPROCS so scaling can be compared with:
+//
+//	go test -run XXX -bench ReusePortScaling -cpu 4,8,16 ./udp
+func BenchmarkReusePortScaling(b *testing.B) {
+	benchmarkReusePort(b, false)
+}
+
+// BenchmarkReusePortPinned is BenchmarkReusePortScaling with reader n pinned to the nth cpu the process may run on,
+// as listen.cpu_affinity does. The difference is small on a single socket machine, on a NUMA machine restrict the
+// process to the node the nic is attached to and compare rx_pkts/s and cache misses against the unpinned run:
+//
+//	numactl --cpunodebind=0 perf stat -e cache-misses,LLC-load-misses go test -run XXX -bench 'ReusePort(Scaling|Pinned)' -cpu 8 ./udp
+func BenchmarkReusePortPinned(b *testing.B) {
+	benchmarkReusePort(b, true)
+}
+
+func benchmarkReusePort(b *testing.B, pin bool) {
+	routines := runtime.GOMAXPROCS(0)
+	cpus := allowedCPUs(b)
+	l := test.NewLogger()
+
+	conns := make([]*StdConn, routines)
+	port := 0
+	for i := range conns {
+		c, err := NewListener(l, netip.MustParseAddr("127.0.0.1"), port, true, 64)
+		if err != nil {
+			b.Fatal(err)
+		}
+		conns[i] = c.(*StdConn)
+		defer c.Close()
+
+		// Readers exit once the senders have stopped and the sockets go quiet
+		tv := unix.NsecToTimeval(int64(200 * time.Millisecond))
+		if err := unix.SetsockoptTimeval(conns[i].sysFd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			b.Fatal(err)
+		}
+
+		if port == 0 {
+			addr, err := c.LocalAddr()
+			if err != nil {
+				b.Fatal(err)
+			}
+			port = int(addr.Port())
+		}
+	}
+
+	// Stand in for the per packet decryption cost in readOutsidePackets
+	block, _ := aes.NewCipher(make([]byte, 32))
+	aead, _ := cipher.NewGCM(block)
+	nonce := make([]byte, aead.NonceSize())
+
+	received := make([]paddedCounter, routines)
+	var readers sync.WaitGroup
+	for i, c := range conns {
+		readers.Add(1)
+		go func(c *StdConn, q int) {
+			defer readers.Done()
+			runtime.LockOSThread()
+			if pin {
+				if err := PinThread(cpus[q%len(cpus)]); err != nil {
+					b.Error(err)
+				}
+			}
+			c.ListenOut(func(_ netip.AddrPort, out []byte, packet []byte, _ uint8, _ *header.H, _ *firewall.Packet, _ LightHouseHandlerFunc, _ []byte, q int, _ firewall.ConntrackCache) {
+				aead.Seal(out[:0], nonce, packet, nil)
+				received[q].Add(1)
+			}, nil, nil, q)
+		}(c, i)
+	}
+
+	// Many source ports so the kernel has plenty of flows to hash across the sockets
+	senders := make([]*net.UDPConn, routines*4)
+	for i := range senders {
+		s, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(port))))
+		if err != nil {
+			b.Fatal(err)
+		}
+		senders[i] = s
+		defer s.Close()
+	}
+
+	packet := make([]byte, 1300)
+	perSender := b.N/len(senders) + 1
+
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for _, s := range senders {
+		wg.Add(1)
+		go func(s *net.UDPConn) {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				_, _ = s.Write(packet)
+			}
+		}(s)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	readers.Wait()
+
+	var total, busiest uint64
+	for i := range received {
+		n := received[i].Load()
+		total += n
+		if n > busiest {
+			busiest = n
+		}
+	}
+
+	sent := uint64(perSender * len(senders))
+	b.ReportMetric(float64(total)/elapsed.Seconds(), "rx_pkts/s")
+	b.ReportMetric(100*float64(sent-total)/float64(sent), "loss_%")
+	if total > 0 {
+		b.ReportMetric(float64(busiest)/float64(total)*float64(routines), "imbalance")
+	}
+}
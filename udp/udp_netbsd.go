@@ -45,3 +45,21 @@ func NewListenConfig(multi bool) net.ListenConfig {
 func (u *GenericConn) Rebind() error {
 	return nil
 }
+
+// setDontFragment sets IPV6_DONTFRAG on ipv6 sockets, there is no way to set DF on ipv4 packets from a udp socket here
+func setDontFragment(fd uintptr, on bool) error {
+	sa, err := unix.Getsockname(int(fd))
+	if err != nil {
+		return err
+	}
+
+	if _, ok := sa.(*unix.SockaddrInet6); !ok {
+		return errDontFragmentUnsupported
+	}
+
+	v := 0
+	if on {
+		v = 1
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, v)
+}
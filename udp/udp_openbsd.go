@@ -0,0 +1,28 @@
+//go:build !e2e_testing
+// +build !e2e_testing
+
+package udp
+
+// Everything else OpenBSD needs is in udp_bsd and udp_generic
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment sets IPV6_DONTFRAG on ipv6 sockets, there is no way to set DF on ipv4 packets from a udp socket here
+func setDontFragment(fd uintptr, on bool) error {
+	sa, err := unix.Getsockname(int(fd))
+	if err != nil {
+		return err
+	}
+
+	if _, ok := sa.(*unix.SockaddrInet6); !ok {
+		return errDontFragmentUnsupported
+	}
+
+	v := 0
+	if on {
+		v = 1
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, v)
+}
@@ -137,6 +137,7 @@ func (u *RIOConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firew
 			netip.AddrPortFrom(netip.AddrFrom16(rua.Addr).Unmap(), (rua.Port>>8)|((rua.Port&0xff)<<8)),
 			plaintext[:0],
 			buffer[:n],
+			0,
 			h,
 			fwPacket,
 			lhf,
@@ -313,7 +314,11 @@ func (u *RIOConn) Rebind() error {
 	return nil
 }
 
-func (u *RIOConn) ReloadConfig(*config.C) {}
+func (u *RIOConn) ReloadConfig(c *config.C) {
+	reloadDontFragment(u.l, c, func(on bool) error {
+		return setDontFragment(uintptr(u.sock), on)
+	})
+}
 
 func (u *RIOConn) Close() error {
 	if !u.isOpen.CompareAndSwap(true, false) {
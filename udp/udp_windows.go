@@ -10,6 +10,7 @@ import (
 	"syscall"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows"
 )
 
 func NewListener(l *logrus.Logger, ip netip.Addr, port int, multi bool, batch int) (Conn, error) {
@@ -45,3 +46,33 @@ func NewListenConfig(multi bool) net.ListenConfig {
 func (u *GenericConn) Rebind() error {
 	return nil
 }
+
+// The x/sys/windows package does not define these, see ws2ipdef.h
+const (
+	ipDontFragment = 14 // IP_DONTFRAGMENT
+	ipv6DontFrag   = 14 // IPV6_DONTFRAG
+)
+
+// setDontFragment sets IP_DONTFRAGMENT, and IPV6_DONTFRAG on ipv6 sockets, so sends larger than the path mtu fail
+// instead of being fragmented
+func setDontFragment(fd uintptr, on bool) error {
+	v := 0
+	if on {
+		v = 1
+	}
+
+	h := windows.Handle(fd)
+	sa, err := windows.Getsockname(h)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := sa.(*windows.SockaddrInet6); ok {
+		if err := windows.SetsockoptInt(h, windows.IPPROTO_IPV6, ipv6DontFrag, v); err != nil {
+			return err
+		}
+	}
+
+	// Dual stack ipv6 sockets take IP_DONTFRAGMENT for ipv4 traffic
+	return windows.SetsockoptInt(h, windows.IPPROTO_IP, ipDontFragment, v)
+}
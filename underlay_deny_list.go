@@ -0,0 +1,94 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/gaissmai/bart"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// UnderlayDenyList drops every packet from listed underlay sources as soon as it is read, before the header is parsed
+// or anything is decrypted. It is meant for incident response against a source flooding us with junk or handshakes and
+// can be changed with a reload. Unlike lighthouse.remote_allow_list it does not look at the overlay at all, a peer
+// behind a denied address can not reach us from there. See listen.deny_list in the example config.
+type UnderlayDenyList struct {
+	// cidrs is nil when the list is empty so the common case is a single load
+	cidrs atomic.Pointer[bart.Table[struct{}]]
+
+	metricDropped metrics.Counter
+	l             *logrus.Logger
+}
+
+func NewUnderlayDenyListFromConfig(l *logrus.Logger, c *config.C) (*UnderlayDenyList, error) {
+	dl := &UnderlayDenyList{
+		metricDropped: metrics.GetOrRegisterCounter("udp.denied", nil),
+		l:             l,
+	}
+
+	err := dl.reload(c, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		err := dl.reload(c, false)
+		if err != nil {
+			l.WithError(err).Error("Failed to reload listen.deny_list, keeping the previous list")
+		}
+	})
+
+	return dl, nil
+}
+
+func (dl *UnderlayDenyList) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("listen.deny_list") {
+		return nil
+	}
+
+	raw := c.GetStringSlice("listen.deny_list", []string{})
+	cidrs := new(bart.Table[struct{}])
+	for i, s := range raw {
+		cidr, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, aErr := netip.ParseAddr(s)
+			if aErr != nil {
+				return fmt.Errorf("listen.deny_list entry #%v; %s", i, err)
+			}
+			cidr = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		cidrs.Insert(cidr.Masked(), struct{}{})
+	}
+
+	if cidrs.Size() == 0 {
+		cidrs = nil
+	}
+	dl.cidrs.Store(cidrs)
+
+	if !initial || cidrs != nil {
+		dl.l.WithField("entries", len(raw)).Info("listen.deny_list loaded")
+	}
+	return nil
+}
+
+// denied returns true and counts the drop if packets from addr must be dropped
+func (dl *UnderlayDenyList) denied(addr netip.AddrPort) bool {
+	if dl == nil {
+		return false
+	}
+
+	cidrs := dl.cidrs.Load()
+	if cidrs == nil {
+		return false
+	}
+
+	if _, ok := cidrs.Lookup(addr.Addr().Unmap()); !ok {
+		return false
+	}
+
+	dl.metricDropped.Inc(1)
+	return true
+}
@@ -0,0 +1,50 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnderlayDenyList(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	dl, err := NewUnderlayDenyListFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Nil(t, dl.cidrs.Load())
+	assert.False(t, dl.denied(netip.MustParseAddrPort("192.0.2.1:4242")))
+
+	require.NoError(t, c.ReloadConfigString("listen:\n  deny_list: [192.0.2.1, 198.51.100.0/24, \"2001:db8::/32\"]\n"))
+	before := dl.metricDropped.Count()
+	assert.True(t, dl.denied(netip.MustParseAddrPort("192.0.2.1:4242")))
+	assert.False(t, dl.denied(netip.MustParseAddrPort("192.0.2.2:4242")))
+	assert.True(t, dl.denied(netip.MustParseAddrPort("198.51.100.77:1")))
+	assert.True(t, dl.denied(netip.MustParseAddrPort("[2001:db8::1]:4242")))
+	assert.False(t, dl.denied(netip.MustParseAddrPort("[2001:db9::1]:4242")))
+	assert.EqualValues(t, 3, dl.metricDropped.Count()-before)
+
+	// Sockets listening on :: report ipv4 sources as mapped addresses
+	assert.True(t, dl.denied(netip.MustParseAddrPort("[::ffff:192.0.2.1]:4242")))
+
+	// A bad entry on reload keeps the previous list
+	require.NoError(t, c.ReloadConfigString("listen:\n  deny_list: [nope]\n"))
+	assert.True(t, dl.denied(netip.MustParseAddrPort("192.0.2.1:4242")))
+
+	require.NoError(t, c.ReloadConfigString("listen:\n  deny_list: []\n"))
+	assert.Nil(t, dl.cidrs.Load())
+	assert.False(t, dl.denied(netip.MustParseAddrPort("192.0.2.1:4242")))
+
+	// And fails on start
+	c = config.NewC(l)
+	require.NoError(t, c.LoadString("listen:\n  deny_list: [nope]\n"))
+	_, err = NewUnderlayDenyListFromConfig(l, c)
+	assert.EqualError(t, err, `listen.deny_list entry #0; netip.ParsePrefix("nope"): no '/'`)
+
+	// nil is safe
+	assert.False(t, (*UnderlayDenyList)(nil).denied(netip.MustParseAddrPort("192.0.2.1:4242")))
+}
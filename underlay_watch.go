@@ -0,0 +1,301 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+const (
+	defaultUnderlayWatchInterval = 5 * time.Second
+	defaultUnderlayWatchSettle   = time.Second
+	defaultUnderlayWatchHoldDown = 10 * time.Second
+)
+
+// UnderlayWatch notices when the local underlay addresses change, for example when a laptop moves to another wifi
+// network, and recovers the tunnels right away instead of waiting for them to time out. Addresses are polled every
+// interval, on Linux a netlink subscription also wakes the watch as soon as an address is added or removed. Once the
+// addresses have been stable for settle the udp socket is rebound, the lighthouses are sent our new addresses and every
+// tunnel is sent a test packet so the remote roams to our new address. Reactions are at least hold_down apart, a burst
+// of changes while a link comes up is handled once.
+type UnderlayWatch struct {
+	enabled  atomic.Bool
+	interval atomic.Int64
+	settle   atomic.Int64
+	holdDown atomic.Int64
+
+	// notify wakes Run when the platform reports an address change
+	notify chan struct{}
+
+	sync.Mutex
+	// seeded is false until the first set of addresses was observed, the first set is not a change
+	seeded     bool
+	addrs      []netip.Addr
+	lastChange time.Time
+	lastRebind time.Time
+	changes    uint64
+	rebinds    uint64
+	pending    bool
+
+	metricChanges metrics.Counter
+	metricRebinds metrics.Counter
+	l             *logrus.Logger
+}
+
+// UnderlayStatus is reported on the control socket, it is the set of local underlay addresses and when they last changed
+type UnderlayStatus struct {
+	Enabled    bool         `json:"enabled"`
+	Addrs      []netip.Addr `json:"addrs"`
+	LastChange time.Time    `json:"lastChange"`
+	LastRebind time.Time    `json:"lastRebind"`
+	Changes    uint64       `json:"changes"`
+	Rebinds    uint64       `json:"rebinds"`
+	// Pending is true while a change is waiting for the addresses to settle or for the hold down to pass
+	Pending bool `json:"pending"`
+}
+
+func NewUnderlayWatchFromConfig(l *logrus.Logger, c *config.C) *UnderlayWatch {
+	uw := &UnderlayWatch{
+		notify:        make(chan struct{}, 1),
+		metricChanges: metrics.GetOrRegisterCounter("underlay_watch.changes", nil),
+		metricRebinds: metrics.GetOrRegisterCounter("underlay_watch.rebinds", nil),
+		l:             l,
+	}
+
+	uw.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		uw.reload(c, false)
+	})
+
+	return uw
+}
+
+func (uw *UnderlayWatch) reload(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("underlay_watch") {
+		return
+	}
+
+	interval := c.GetDuration("underlay_watch.interval", defaultUnderlayWatchInterval)
+	if interval < time.Second {
+		uw.l.WithField("interval", interval).Warn("underlay_watch.interval must be at least 1s, using the default")
+		interval = defaultUnderlayWatchInterval
+	}
+
+	settle := c.GetDuration("underlay_watch.settle", defaultUnderlayWatchSettle)
+	if settle < 0 {
+		uw.l.WithField("settle", settle).Warn("underlay_watch.settle can not be negative, using the default")
+		settle = defaultUnderlayWatchSettle
+	}
+
+	holdDown := c.GetDuration("underlay_watch.hold_down", defaultUnderlayWatchHoldDown)
+	if holdDown < 0 {
+		uw.l.WithField("holdDown", holdDown).Warn("underlay_watch.hold_down can not be negative, using the default")
+		holdDown = defaultUnderlayWatchHoldDown
+	}
+
+	uw.interval.Store(int64(interval))
+	uw.settle.Store(int64(settle))
+	uw.holdDown.Store(int64(holdDown))
+
+	enabled := c.GetBool("underlay_watch.enabled", false)
+	if uw.enabled.Swap(enabled) != enabled {
+		// Whatever changed while we were not watching is not a change to react to
+		uw.Lock()
+		uw.seeded = false
+		uw.pending = false
+		uw.Unlock()
+	}
+
+	if !initial {
+		uw.l.WithField("enabled", enabled).
+			WithField("interval", interval).
+			WithField("settle", settle).
+			WithField("holdDown", holdDown).
+			Info("underlay_watch has changed")
+	}
+}
+
+// Run watches the local underlay addresses until ctx is done
+func (uw *UnderlayWatch) Run(ctx context.Context, f *Interface) {
+	if uw == nil {
+		return
+	}
+
+	watchUnderlayAddrs(ctx, uw.l, uw.notify)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-uw.notify:
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		if uw.enabled.Load() {
+			uw.observe(f.underlayAddrs(), now)
+			if uw.due(now) {
+				f.underlayChanged(uw.Status())
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(uw.wait(time.Now()))
+	}
+}
+
+// observe records the current underlay addresses, returning true if they differ from the last observation
+func (uw *UnderlayWatch) observe(addrs []netip.Addr, now time.Time) bool {
+	slices.SortFunc(addrs, func(a, b netip.Addr) int { return a.Compare(b) })
+
+	uw.Lock()
+	defer uw.Unlock()
+
+	if !uw.seeded {
+		uw.seeded = true
+		uw.addrs = addrs
+		return false
+	}
+
+	if slices.Equal(uw.addrs, addrs) {
+		return false
+	}
+
+	if uw.l.Level >= logrus.DebugLevel {
+		uw.l.WithField("old", uw.addrs).WithField("new", addrs).Debug("Underlay addresses changed")
+	}
+
+	uw.addrs = addrs
+	uw.lastChange = now
+	uw.changes++
+	uw.pending = true
+	uw.metricChanges.Inc(1)
+	return true
+}
+
+// due returns true if a pending change should be acted on now, the addresses must have settled and the last rebind
+// must be at least hold_down ago. A true return clears the pending change.
+func (uw *UnderlayWatch) due(now time.Time) bool {
+	uw.Lock()
+	defer uw.Unlock()
+
+	if !uw.pending || uw.pendingWait(now) > 0 {
+		return false
+	}
+
+	uw.pending = false
+	uw.lastRebind = now
+	uw.rebinds++
+	uw.metricRebinds.Inc(1)
+	return true
+}
+
+// pendingWait is how long until a pending change is due, uw must be locked
+func (uw *UnderlayWatch) pendingWait(now time.Time) time.Duration {
+	wait := time.Duration(uw.settle.Load()) - now.Sub(uw.lastChange)
+	if !uw.lastRebind.IsZero() {
+		wait = max(wait, time.Duration(uw.holdDown.Load())-now.Sub(uw.lastRebind))
+	}
+	return wait
+}
+
+// wait is how long Run should sleep, until the next poll or until a pending change is due if that is sooner
+func (uw *UnderlayWatch) wait(now time.Time) time.Duration {
+	wait := time.Duration(uw.interval.Load())
+
+	uw.Lock()
+	defer uw.Unlock()
+	if uw.pending {
+		wait = max(min(wait, uw.pendingWait(now)), 0)
+	}
+	return wait
+}
+
+// Status returns the current underlay addresses and when they last changed, it is safe to call on a nil UnderlayWatch
+func (uw *UnderlayWatch) Status() UnderlayStatus {
+	if uw == nil {
+		return UnderlayStatus{}
+	}
+
+	uw.Lock()
+	defer uw.Unlock()
+	return UnderlayStatus{
+		Enabled:    uw.enabled.Load(),
+		Addrs:      slices.Clone(uw.addrs),
+		LastChange: uw.lastChange,
+		LastRebind: uw.lastRebind,
+		Changes:    uw.changes,
+		Rebinds:    uw.rebinds,
+		Pending:    uw.pending,
+	}
+}
+
+// underlayAddrs returns the local addresses that pass lighthouse.local_allow_list, the same set we report to the
+// lighthouses. Interfaces excluded by the allow list, docker bridges for example, can come and go without a rebind.
+func (f *Interface) underlayAddrs() []netip.Addr {
+	var addrs []netip.Addr
+	for _, ip := range localIps(f.l, f.lightHouse.GetLocalAllowList()) {
+		if !f.myVpnNet.Contains(ip) {
+			addrs = append(addrs, ip)
+		}
+	}
+	return addrs
+}
+
+// rebindUnderlay rebinds the udp socket, sends our addresses to the lighthouses and marks every tunnel to query the
+// lighthouses for its peer the next time it sends
+func (f *Interface) rebindUnderlay() {
+	_ = f.outside.Rebind()
+
+	// Trigger a lighthouse update, useful for mobile clients that should have an update interval of 0
+	f.lightHouse.SendUpdate()
+
+	// Let the main interface know that we rebound so that underlying tunnels know to trigger punches from their remotes
+	f.rebindCount++
+}
+
+// underlayChanged recovers every tunnel after our underlay addresses changed. Each tunnel is sent a test packet on its
+// current path, the remote roams to the address it arrives from, and to every other known remote of the peer so we can
+// roam to one that still works. Lighthouses only probe the current path, they do not roam.
+func (f *Interface) underlayChanged(status UnderlayStatus) {
+	f.l.WithField("addrs", status.Addrs).Info("Underlay addresses changed, rebinding and probing tunnels")
+
+	f.rebindUnderlay()
+
+	var hostinfos []*HostInfo
+	f.hostMap.ForEachVpnIp(func(hi *HostInfo) {
+		hostinfos = append(hostinfos, hi)
+	})
+
+	nb, out := make([]byte, 12, 12), make([]byte, mtu)
+	for _, hi := range hostinfos {
+		f.SendMessageToHostInfo(header.Test, header.TestRequest, hi, []byte(""), nb, out)
+
+		if f.lightHouse.amLighthouse || hi.remotes == nil {
+			continue
+		}
+
+		current := hi.remote
+		hi.remotes.ForEach(f.hostMap.PreferredRangesFor(hi), func(addr netip.AddrPort, preferred bool) {
+			if addr.IsValid() && addr != current {
+				f.sendTo(header.Test, header.TestRequest, hi.ConnectionState, hi, addr, []byte(""), nb, out)
+			}
+		})
+	}
+}
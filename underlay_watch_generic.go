@@ -0,0 +1,13 @@
+//go:build !linux || android
+// +build !linux android
+
+package nebula
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// watchUnderlayAddrs does nothing, the underlay watch polls on this platform
+func watchUnderlayAddrs(_ context.Context, _ *logrus.Logger, _ chan<- struct{}) {}
@@ -0,0 +1,36 @@
+//go:build linux && !android
+// +build linux,!android
+
+package nebula
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// watchUnderlayAddrs wakes notify whenever netlink reports an address being added or removed, until ctx is done. If the
+// subscription fails the watch falls back to polling.
+func watchUnderlayAddrs(ctx context.Context, l *logrus.Logger, notify chan<- struct{}) {
+	ach := make(chan netlink.AddrUpdate)
+	err := netlink.AddrSubscribeWithOptions(ach, ctx.Done(), netlink.AddrSubscribeOptions{
+		ErrorCallback: func(err error) {
+			l.WithError(err).Debug("Underlay address subscription error")
+		},
+	})
+	if err != nil {
+		l.WithError(err).Warn("Failed to subscribe to underlay address changes, falling back to polling")
+		return
+	}
+
+	go func() {
+		// netlink closes ach once ctx is done
+		for range ach {
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
@@ -0,0 +1,88 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnderlayWatch(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("underlay_watch: {enabled: true, settle: 1s, hold_down: 10s}"))
+	uw := NewUnderlayWatchFromConfig(l, c)
+
+	home := []netip.Addr{netip.MustParseAddr("192.168.1.10"), netip.MustParseAddr("2001::10")}
+	cafe := []netip.Addr{netip.MustParseAddr("10.0.0.5")}
+	now := time.Now()
+
+	t.Log("The first observation is not a change")
+	assert.False(t, uw.observe(home, now))
+	assert.False(t, uw.due(now))
+	assert.Equal(t, defaultUnderlayWatchInterval, uw.wait(now))
+
+	t.Log("Order does not matter")
+	assert.False(t, uw.observe([]netip.Addr{home[1], home[0]}, now))
+
+	t.Log("A change waits for the addresses to settle")
+	assert.True(t, uw.observe(cafe, now))
+	assert.False(t, uw.due(now.Add(500*time.Millisecond)))
+	assert.Equal(t, 500*time.Millisecond, uw.wait(now.Add(500*time.Millisecond)))
+
+	t.Log("Another change restarts the settle time")
+	assert.True(t, uw.observe(home, now.Add(500*time.Millisecond)))
+	assert.False(t, uw.due(now.Add(time.Second)))
+	assert.True(t, uw.due(now.Add(1500*time.Millisecond)))
+	assert.False(t, uw.due(now.Add(1500*time.Millisecond)), "a change is only acted on once")
+
+	status := uw.Status()
+	assert.True(t, status.Enabled)
+	assert.Equal(t, home, status.Addrs)
+	assert.Equal(t, now.Add(500*time.Millisecond), status.LastChange)
+	assert.Equal(t, now.Add(1500*time.Millisecond), status.LastRebind)
+	assert.Equal(t, uint64(2), status.Changes)
+	assert.Equal(t, uint64(1), status.Rebinds)
+	assert.False(t, status.Pending)
+
+	t.Log("Changes within the hold down are acted on once it passes")
+	later := now.Add(3 * time.Second)
+	assert.True(t, uw.observe(cafe, later))
+	assert.False(t, uw.due(later.Add(time.Second)))
+	assert.Equal(t, defaultUnderlayWatchInterval, uw.wait(later.Add(time.Second)), "polling continues while waiting")
+	assert.Equal(t, 2500*time.Millisecond, uw.wait(later.Add(6*time.Second)))
+	assert.True(t, uw.Status().Pending)
+	assert.True(t, uw.due(now.Add(11500*time.Millisecond)))
+	assert.Equal(t, uint64(2), uw.Status().Rebinds)
+
+	t.Log("Disabling forgets a pending change and the next observation starts over")
+	assert.True(t, uw.observe(home, now.Add(time.Minute)))
+	require.NoError(t, c.ReloadConfigString("underlay_watch: {enabled: false}"))
+	assert.False(t, uw.Status().Pending)
+	require.NoError(t, c.ReloadConfigString("underlay_watch: {enabled: true}"))
+	assert.False(t, uw.observe(cafe, now.Add(2*time.Minute)))
+	assert.False(t, uw.due(now.Add(time.Hour)))
+
+	var nilWatch *UnderlayWatch
+	assert.Equal(t, UnderlayStatus{}, nilWatch.Status())
+}
+
+func TestUnderlayWatch_reload(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("underlay_watch: {interval: 10ms, settle: -1s, hold_down: -1s}"))
+	uw := NewUnderlayWatchFromConfig(l, c)
+	assert.Equal(t, int64(defaultUnderlayWatchInterval), uw.interval.Load())
+	assert.Equal(t, int64(defaultUnderlayWatchSettle), uw.settle.Load())
+	assert.Equal(t, int64(defaultUnderlayWatchHoldDown), uw.holdDown.Load())
+	assert.False(t, uw.enabled.Load(), "off unless enabled")
+
+	require.NoError(t, c.ReloadConfigString("underlay_watch: {interval: 30s, settle: 0s, hold_down: 1m}"))
+	assert.Equal(t, int64(30*time.Second), uw.interval.Load())
+	assert.Equal(t, int64(0), uw.settle.Load())
+	assert.Equal(t, int64(time.Minute), uw.holdDown.Load())
+}
@@ -0,0 +1,322 @@
+package nebula
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+// ErrUserCert is wrapped by every refusal of a peer's user certificate, see pki.user
+var ErrUserCert = errors.New("user certificate refused")
+
+// The reasons a user certificate is refused, each is counted in certificate.user.rejected.<reason>
+const (
+	userCertMissing = "missing"
+	userCertInvalid = "invalid"
+
+	userCertMetricPrefix = "certificate.user.rejected."
+)
+
+// The reserved names the user certificate is exposed under to the firewall, see newPeerIdentity
+const (
+	userGroupPrefix = "user:"
+	userAttribute   = "user"
+)
+
+// userCertState is pki.user, a second certificate issued by a user CA for the same key as pki.cert. Together the device
+// certificate and the user certificate authenticate a tunnel to both the machine and the person using it.
+type userCertState struct {
+	// caPool is pki.user.ca, peers must present a user certificate valid for it. nil if they are not required to.
+	caPool *cert.NebulaCAPool
+	// cert is pki.user.cert and rawNoKey is how it is sent in handshakes, both nil if we do not have one
+	cert     *cert.NebulaCertificate
+	rawNoKey []byte
+}
+
+// UserCertError is a refusal of a peer's user certificate, Reason is one of missing or invalid
+type UserCertError struct {
+	Reason string
+	err    error
+}
+
+func (e *UserCertError) Error() string {
+	if e.err == nil {
+		return ErrUserCert.Error() + ": the peer did not send one"
+	}
+	return ErrUserCert.Error() + ": " + e.err.Error()
+}
+
+func (e *UserCertError) Unwrap() []error {
+	if e.err == nil {
+		return []error{ErrUserCert}
+	}
+	return []error{ErrUserCert, e.err}
+}
+
+// readPathOrPEM returns the PEM data in the config key name, or the contents of the file it names
+func readPathOrPEM(c *config.C, name string) ([]byte, error) {
+	pathOrPEM := c.GetString(name, "")
+	if pathOrPEM == "" || strings.Contains(pathOrPEM, "-----BEGIN") {
+		return []byte(pathOrPEM), nil
+	}
+
+	raw, err := os.ReadFile(pathOrPEM)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s file %s: %s", name, pathOrPEM, err)
+	}
+	return raw, nil
+}
+
+func newUserCertStateFromConfig(l *logrus.Logger, c *config.C, cs *CertState) (*userCertState, error) {
+	rawCA, err := readPathOrPEM(c, "pki.user.ca")
+	if err != nil {
+		return nil, err
+	}
+	rawCert, err := readPathOrPEM(c, "pki.user.cert")
+	if err != nil {
+		return nil, err
+	}
+	if len(rawCA) == 0 && len(rawCert) == 0 {
+		return nil, nil
+	}
+
+	st := &userCertState{}
+	if len(rawCA) > 0 {
+		st.caPool, err = cert.NewCAPoolFromBytes(rawCA)
+		if errors.Is(err, cert.ErrExpired) {
+			var expired int
+			for _, crt := range st.caPool.CAs {
+				if crt.Expired(time.Now()) {
+					expired++
+					l.WithField("cert", crt).Warn("expired certificate present in pki.user.ca")
+				}
+			}
+
+			if expired >= len(st.caPool.CAs) {
+				return nil, errors.New("no valid CA certificates present in pki.user.ca")
+			}
+
+		} else if err != nil {
+			return nil, fmt.Errorf("error while adding pki.user.ca certificate to the user CA trust store: %s", err)
+		}
+
+		// Revoking a user is the same as revoking a device
+		for _, fp := range c.GetStringSlice("pki.blocklist", []string{}) {
+			st.caPool.BlocklistFingerprint(fp)
+		}
+	}
+
+	if len(rawCert) > 0 {
+		st.cert, _, err = cert.UnmarshalNebulaCertificateFromPEM(rawCert)
+		if err != nil {
+			return nil, fmt.Errorf("error while unmarshaling pki.user.cert: %s", err)
+		}
+
+		if st.cert.Details.IsCA {
+			return nil, errors.New("pki.user.cert is a CA certificate")
+		}
+
+		if st.cert.Details.Curve != cs.Certificate.Details.Curve || !bytes.Equal(st.cert.Details.PublicKey, cs.PublicKey) {
+			return nil, fmt.Errorf("pki.user.cert: %w", ErrCertKeyMismatch)
+		}
+
+		now := time.Now()
+		if st.cert.Details.NotBefore.After(now) || st.cert.Details.NotAfter.Before(now) {
+			return nil, errors.New("pki.user.cert is expired or not yet valid")
+		}
+
+		if st.caPool != nil {
+			if _, err := st.cert.Verify(now, st.caPool); err != nil {
+				return nil, fmt.Errorf("pki.user.cert is not valid for pki.user.ca: %w", err)
+			}
+		}
+
+		// The public key is the one from pki.cert, it is sent without it the same way
+		noKey := st.cert.Copy()
+		noKey.Details.PublicKey = nil
+		st.rawNoKey, err = noKey.Marshal()
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling pki.user.cert no key: %s", err)
+		}
+	}
+
+	return st, nil
+}
+
+func (p *PKI) reloadUserCert(c *config.C, initial bool) error {
+	st, err := newUserCertStateFromConfig(p.l, c, p.GetCertState())
+	if err != nil {
+		return err
+	}
+
+	old := p.userCert.Swap(st)
+	if st == nil {
+		if old != nil {
+			p.l.Info("pki.user removed, peers are no longer required to present a user certificate")
+		}
+		return nil
+	}
+
+	e := p.l.WithField("required", st.caPool != nil)
+	if st.caPool != nil {
+		e = e.WithField("fingerprints", st.caPool.GetFingerprints())
+	}
+	if st.cert != nil {
+		e = e.WithField("cert", st.cert)
+	}
+	if initial {
+		e.Info("pki.user configured")
+	} else {
+		e.Debug("pki.user reloaded")
+	}
+	return nil
+}
+
+// userCertFor returns the user certificate to send in a handshake made with cs, without its public key. It is nil if
+// we do not have one, or if pki.cert was replaced with one for a different key and pki.user.cert was not.
+func (p *PKI) userCertFor(cs *CertState) []byte {
+	st := p.userCert.Load()
+	if st == nil || st.cert == nil {
+		return nil
+	}
+
+	if st.cert.Details.Curve != cs.Certificate.Details.Curve || !bytes.Equal(st.cert.Details.PublicKey, cs.PublicKey) {
+		return nil
+	}
+	return st.rawNoKey
+}
+
+// verifyUserCert validates the user certificate a peer sent in a handshake together with its validated device
+// certificate remoteCert. It returns a nil certificate and error if pki.user.ca is not set, since there is nothing to
+// validate it against, otherwise a *UserCertError if the user certificate is missing or not valid.
+func (p *PKI) verifyUserCert(remoteCert *cert.NebulaCertificate, raw []byte) (*cert.NebulaCertificate, error) {
+	st := p.userCert.Load()
+	if st == nil || st.caPool == nil {
+		return nil, nil
+	}
+
+	if len(raw) == 0 {
+		return nil, &UserCertError{Reason: userCertMissing}
+	}
+
+	// The user certificate is only valid for the key that completed the handshake, the one in the device certificate
+	userCert, err := recombineCertAndValidate(remoteCert.Details.PublicKey, raw, st.caPool, p.GetClockSkew())
+	if err != nil {
+		return nil, &UserCertError{Reason: userCertInvalid, err: err}
+	}
+
+	if userCert.Details.IsCA {
+		return nil, &UserCertError{Reason: userCertInvalid, err: errors.New("it is a CA certificate")}
+	}
+
+	if userCert.Details.Curve != remoteCert.Details.Curve {
+		return nil, &UserCertError{
+			Reason: userCertInvalid,
+			err:    fmt.Errorf("it is for curve %s but the device certificate is for %s", userCert.Details.Curve, remoteCert.Details.Curve),
+		}
+	}
+
+	return userCert, nil
+}
+
+// recheckUserCert validates the user certificate of an established tunnel at now, it returns a *UserCertError if it is
+// no longer valid or if pki.user.ca was set after the tunnel was established without one
+func (p *PKI) recheckUserCert(userCert *cert.NebulaCertificate, now time.Time) error {
+	st := p.userCert.Load()
+	if st == nil || st.caPool == nil {
+		return nil
+	}
+
+	if userCert == nil {
+		return &UserCertError{Reason: userCertMissing}
+	}
+
+	valid, err := userCert.VerifyWithCacheAndSkew(now, p.GetClockSkew(), st.caPool)
+	if err != nil {
+		return &UserCertError{Reason: userCertInvalid, err: err}
+	} else if !valid {
+		return &UserCertError{Reason: userCertInvalid, err: errors.New("certificate validation failed but did not return an error")}
+	}
+	return nil
+}
+
+// refusedByUserCert is called with a validated peer device certificate from a handshake and the user certificate the
+// peer sent along with it. It returns the validated user certificate, nil if pki.user.ca is not set, and true if the
+// user certificate is missing or not valid and the handshake must be dropped.
+func (f *Interface) refusedByUserCert(remoteCert *cert.NebulaCertificate, raw []byte, addr netip.AddrPort, stage int) (*cert.NebulaCertificate, bool) {
+	userCert, err := f.pki.verifyUserCert(remoteCert, raw)
+	if err == nil {
+		return userCert, false
+	}
+
+	var ue *UserCertError
+	if errors.As(err, &ue) {
+		metrics.GetOrRegisterCounter(userCertMetricPrefix+ue.Reason, nil).Inc(1)
+	}
+
+	fingerprint, _ := remoteCert.Sha256Sum()
+	e := f.l.WithError(err).WithField("udpAddr", addr).
+		WithField("certName", remoteCert.Details.Name).
+		WithField("fingerprint", fingerprint).
+		WithField("issuer", remoteCert.Details.Issuer).
+		WithField("handshake", m{"stage": stage, "style": "ix_psk0"})
+	if ue != nil {
+		e = e.WithField("reason", ue.Reason)
+	}
+	e.Info("Refusing user certificate from host")
+	f.securityEvents.Load().handshakeRejected(addr, stage, remoteCert, err)
+	return nil, true
+}
+
+// newPeerIdentity combines the device and user certificates of a peer into the certificate firewall rules match. It
+// is a copy of the device certificate, so the name, ips, issuer and CA rules match the device, with the groups of the
+// user certificate added as user:<group> and the attribute user set to the name of the user certificate. Any group or
+// attribute the device certificate has under those reserved names is dropped so a device can not claim to be a user.
+// Returns nil without a user certificate.
+func newPeerIdentity(deviceCert, userCert *cert.NebulaCertificate) *cert.NebulaCertificate {
+	if deviceCert == nil || userCert == nil {
+		return nil
+	}
+
+	id := deviceCert.Copy()
+	id.Details.Groups = id.Details.Groups[:0]
+	for _, g := range deviceCert.Details.Groups {
+		if !strings.HasPrefix(g, userGroupPrefix) {
+			id.Details.Groups = append(id.Details.Groups, g)
+		}
+	}
+	for g := range id.Details.InvertedGroups {
+		if strings.HasPrefix(g, userGroupPrefix) {
+			delete(id.Details.InvertedGroups, g)
+		}
+	}
+
+	for _, g := range userCert.Details.Groups {
+		id.Details.Groups = append(id.Details.Groups, userGroupPrefix+g)
+		id.Details.InvertedGroups[userGroupPrefix+g] = struct{}{}
+	}
+
+	if id.Details.Attributes == nil {
+		id.Details.Attributes = map[string]string{}
+	}
+	id.Details.Attributes[userAttribute] = userCert.Details.Name
+	return id
+}
+
+// firewallCert returns the certificate firewall rules are matched against, the combined identity of the peer if it
+// presented a user certificate, otherwise its device certificate
+func (cs *ConnectionState) firewallCert() *cert.NebulaCertificate {
+	if cs.peerIdentity != nil {
+		return cs.peerIdentity
+	}
+	return cs.peerCert
+}
@@ -0,0 +1,254 @@
+package nebula
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testUserCert returns a user certificate named name in groups for the public key of device
+func testUserCert(device *cert.NebulaCertificate, name string, groups ...string) *cert.NebulaCertificate {
+	u := device.Copy()
+	u.Details.Name = name
+	u.Details.Groups = groups
+	return u
+}
+
+// noKey returns a PEM certificate the way it is sent in a handshake
+func noKey(t testing.TB, pem []byte) []byte {
+	c, _, err := cert.UnmarshalNebulaCertificateFromPEM(pem)
+	require.NoError(t, err)
+	c.Details.PublicKey = nil
+	b, err := c.Marshal()
+	require.NoError(t, err)
+	return b
+}
+
+func TestNewUserCertStateFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	deviceCA := newTestCA(t, "ca")
+	userCA := newTestCA(t, "users")
+	key, crt := newTestNodeKey(t)
+
+	deviceCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(deviceCA.sign(crt, time.Hour))
+	require.NoError(t, err)
+	cs, err := newCertState(deviceCert, key)
+	require.NoError(t, err)
+
+	load := func(caPem, certPem []byte) (*userCertState, error) {
+		return newUserCertStateFromConfig(l, userCertConfig(l, caPem, certPem), cs)
+	}
+
+	st, err := load(nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, st, "no pki.user")
+
+	alice := userCA.sign(testUserCert(crt, "alice", "admins"), time.Hour)
+	st, err = load(userCA.pem, alice)
+	require.NoError(t, err)
+	require.NotNil(t, st.caPool)
+	assert.Equal(t, "alice", st.cert.Details.Name)
+	assert.Equal(t, noKey(t, alice), st.rawNoKey)
+	p := &PKI{}
+	p.userCert.Store(st)
+	assert.Equal(t, st.rawNoKey, p.userCertFor(cs))
+	other, _ := newTestNodeKey(t)
+	assert.Nil(t, p.userCertFor(&CertState{Certificate: crt, PublicKey: other.Public()}), "pki.cert moved to another key")
+
+	st, err = load(userCA.pem, nil)
+	require.NoError(t, err)
+	assert.Nil(t, st.cert, "only requiring user certificates")
+
+	st, err = load(nil, deviceCA.sign(testUserCert(crt, "alice"), time.Hour))
+	require.NoError(t, err, "our user certificate is only checked against pki.user.ca if it is set")
+	assert.NotNil(t, st.cert)
+
+	_, otherCrt := newTestNodeKey(t)
+	_, err = load(nil, userCA.sign(testUserCert(otherCrt, "alice"), time.Hour))
+	assert.ErrorIs(t, err, ErrCertKeyMismatch)
+
+	_, err = load(userCA.pem, deviceCA.sign(testUserCert(crt, "alice"), time.Hour))
+	assert.ErrorContains(t, err, "pki.user.cert is not valid for pki.user.ca")
+
+	_, err = load(nil, userCA.sign(testUserCert(crt, "alice"), -time.Minute))
+	assert.EqualError(t, err, "pki.user.cert is expired or not yet valid")
+
+	ca := testUserCert(crt, "alice")
+	ca.Details.IsCA = true
+	_, err = load(nil, userCA.sign(ca, time.Hour))
+	assert.EqualError(t, err, "pki.user.cert is a CA certificate")
+
+	_, err = load([]byte("nope"), nil)
+	assert.Error(t, err)
+}
+
+func TestPKI_verifyUserCert(t *testing.T) {
+	l := test.NewLogger()
+	deviceCA := newTestCA(t, "ca")
+	userCA := newTestCA(t, "users")
+	_, crt := newTestNodeKey(t)
+
+	peer, _, err := cert.UnmarshalNebulaCertificateFromPEM(deviceCA.sign(crt, time.Hour))
+	require.NoError(t, err)
+	alice := userCA.sign(testUserCert(crt, "alice", "admins"), time.Hour)
+
+	p := &PKI{l: l}
+	uc, err := p.verifyUserCert(peer, noKey(t, alice))
+	assert.NoError(t, err)
+	assert.Nil(t, uc, "without pki.user.ca user certificates are ignored")
+
+	require.NoError(t, p.reloadUserCert(userCertConfig(l, userCA.pem, nil), true))
+
+	uc, err = p.verifyUserCert(peer, noKey(t, alice))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", uc.Details.Name)
+	assert.Equal(t, peer.Details.PublicKey, uc.Details.PublicKey)
+
+	_, other := newTestNodeKey(t)
+	ca := testUserCert(crt, "alice")
+	ca.Details.IsCA = true
+	for _, tc := range []struct {
+		name   string
+		raw    []byte
+		reason string
+	}{
+		{"missing", nil, userCertMissing},
+		{"not a certificate", []byte("nope"), userCertInvalid},
+		{"issued by the device CA", noKey(t, deviceCA.sign(testUserCert(crt, "alice"), time.Hour)), userCertInvalid},
+		{"expired", noKey(t, userCA.sign(testUserCert(crt, "alice"), -time.Minute)), userCertInvalid},
+		{"issued for another key", noKey(t, userCA.sign(testUserCert(other, "alice"), time.Hour)), userCertInvalid},
+		{"a CA certificate", noKey(t, userCA.sign(ca, time.Hour)), userCertInvalid},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			uc, err := p.verifyUserCert(peer, tc.raw)
+			assert.Nil(t, uc)
+			assert.ErrorIs(t, err, ErrUserCert)
+			var ue *UserCertError
+			require.ErrorAs(t, err, &ue)
+			assert.Equal(t, tc.reason, ue.Reason)
+		})
+	}
+
+	assert.NoError(t, p.recheckUserCert(uc, time.Now()))
+	p.expiredGrace.Store(int64(time.Hour))
+	assert.ErrorIs(t, p.recheckUserCert(uc, uc.Details.NotAfter.Add(time.Minute)), cert.ErrExpired, "no grace for user certificates")
+
+	t.Log("A blocklisted user certificate is refused in handshakes and on established tunnels")
+	fp, err := uc.Sha256Sum()
+	require.NoError(t, err)
+	c := userCertConfig(l, userCA.pem, nil)
+	c.Settings["pki"].(map[interface{}]interface{})["blocklist"] = []interface{}{fp}
+	require.NoError(t, p.reloadUserCert(c, false))
+
+	_, err = p.verifyUserCert(peer, noKey(t, alice))
+	assert.ErrorIs(t, err, cert.ErrBlockListed)
+	assert.ErrorIs(t, p.recheckUserCert(uc, time.Now()), cert.ErrBlockListed)
+	assert.ErrorIs(t, p.recheckUserCert(nil, time.Now()), ErrUserCert, "pki.user.ca was set after the tunnel came up")
+
+	require.NoError(t, p.reloadUserCert(config.NewC(l), false))
+	assert.NoError(t, p.recheckUserCert(nil, time.Now()), "pki.user was removed")
+}
+
+// userCertConfig returns a config with pki.user set to caPem and certPem when they are not nil
+func userCertConfig(l *logrus.Logger, caPem, certPem []byte) *config.C {
+	c := config.NewC(l)
+	user := map[interface{}]interface{}{}
+	if caPem != nil {
+		user["ca"] = string(caPem)
+	}
+	if certPem != nil {
+		user["cert"] = string(certPem)
+	}
+	c.Settings["pki"] = map[interface{}]interface{}{"user": user}
+	return c
+}
+
+func TestInterface_refusedByUserCert(t *testing.T) {
+	l := test.NewLogger()
+	userCA := newTestCA(t, "users")
+	_, crt := newTestNodeKey(t)
+
+	f := &Interface{pki: &PKI{l: l}, l: l}
+	require.NoError(t, f.pki.reloadUserCert(userCertConfig(l, userCA.pem, nil), true))
+	addr := netip.MustParseAddrPort("10.0.0.2:4242")
+
+	missing := metrics.GetOrRegisterCounter(userCertMetricPrefix+userCertMissing, nil)
+	before := missing.Count()
+	uc, refused := f.refusedByUserCert(crt, nil, addr, 1)
+	assert.True(t, refused)
+	assert.Nil(t, uc)
+	assert.Equal(t, before+1, missing.Count())
+
+	uc, refused = f.refusedByUserCert(crt, noKey(t, userCA.sign(testUserCert(crt, "alice"), time.Hour)), addr, 2)
+	assert.False(t, refused)
+	assert.Equal(t, "alice", uc.Details.Name)
+}
+
+func TestNewPeerIdentity(t *testing.T) {
+	device := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Name:           "laptop",
+		Ips:            []*net.IPNet{{IP: net.IPv4(1, 2, 3, 4), Mask: net.CIDRMask(24, 32)}},
+		Groups:         []string{"laptops", "user:admins"},
+		InvertedGroups: map[string]struct{}{"laptops": {}, "user:admins": {}},
+		Attributes:     map[string]string{"env": "prod", "user": "mallory"},
+		Issuer:         "device-ca",
+	}}
+	user := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Name:           "alice",
+		Groups:         []string{"ops"},
+		InvertedGroups: map[string]struct{}{"ops": {}},
+		Issuer:         "user-ca",
+	}}
+
+	assert.Nil(t, newPeerIdentity(device, nil))
+
+	id := newPeerIdentity(device, user)
+	assert.Equal(t, "laptop", id.Details.Name)
+	assert.Equal(t, "device-ca", id.Details.Issuer)
+	assert.Equal(t, []string{"laptops", "user:ops"}, id.Details.Groups)
+	assert.Equal(t, map[string]struct{}{"laptops": {}, "user:ops": {}}, id.Details.InvertedGroups)
+	assert.Equal(t, map[string]string{"env": "prod", "user": "alice"}, id.Details.Attributes)
+	assert.Equal(t, []string{"laptops", "user:admins"}, device.Details.Groups, "the device certificate is not changed")
+	assert.Equal(t, "mallory", device.Details.Attributes["user"])
+
+	l := test.NewLogger()
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, device)
+	require.NoError(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"user:admins"}, "", netip.Prefix{}, netip.Prefix{}, "", ""))
+	require.NoError(t, fw.AddRuleWithConditions(true, firewall.ProtoTCP, 22, 22, nil, "", netip.Prefix{}, netip.Prefix{}, "", "", FirewallRuleConditions{Attributes: map[string]string{"user": "alice"}}))
+
+	h := &HostInfo{ConnectionState: &ConnectionState{peerCert: device}, vpnIp: netip.MustParseAddr("1.2.3.4")}
+	h.CreateRemoteCIDR(device)
+	p := firewall.Packet{
+		LocalIP:    netip.MustParseAddr("1.2.3.4"),
+		RemoteIP:   netip.MustParseAddr("1.2.3.4"),
+		LocalPort:  22,
+		RemotePort: 9000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	cp := cert.NewCAPool()
+
+	t.Log("With a user certificate the firewall matches the combined identity")
+	h.ConnectionState.peerUserCert = user
+	h.ConnectionState.peerIdentity = id
+	assert.NoError(t, fw.Drop(p, true, false, h, cp, nil), "user alice")
+
+	p.LocalPort = 80
+	resetConntrack(fw)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, false, h, cp, nil), "alice is not in admins, the device can not claim it")
+
+	user.Details.InvertedGroups["admins"] = struct{}{}
+	user.Details.Groups = append(user.Details.Groups, "admins")
+	h.ConnectionState.peerIdentity = newPeerIdentity(device, user)
+	resetConntrack(fw)
+	assert.NoError(t, fw.Drop(p, true, false, h, cp, nil))
+}